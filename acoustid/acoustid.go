@@ -0,0 +1,169 @@
+// Package acoustid makes the catalog interoperate with AcoustID: it computes
+// Chromaprint fingerprints, the ones AcoustID identifies recordings by, with
+// the fpcalc program, and looks recordings up with the AcoustID web service.
+package acoustid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const lookupEndpoint = "https://api.acoustid.org/v2/lookup"
+
+var client = &http.Client{Timeout: 15 * time.Second}
+
+// Fingerprint is the Chromaprint fingerprint of some audio, in the
+// compressed base64 form fpcalc prints and AcoustID accepts
+type Fingerprint struct {
+	// Duration is the length of the audio in seconds
+	Duration    int    `json:"duration"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// fpcalcPath returns the fpcalc program to run, FPCALC_PATH or fpcalc
+func fpcalcPath() string {
+	return utils.GetEnv("FPCALC_PATH", "fpcalc")
+}
+
+// FingerprintFile computes the fingerprint of the audio file at filePath
+func FingerprintFile(ctx context.Context, filePath string) (Fingerprint, error) {
+	return runFpcalc(exec.CommandContext(ctx, fpcalcPath(), "-json", filePath))
+}
+
+// FingerprintSamples computes the fingerprint of mono samples in the range
+// [-1, 1], such as those of a recording, without writing them to a file
+func FingerprintSamples(ctx context.Context, samples []float64, sampleRate int) (Fingerprint, error) {
+	cmd := exec.CommandContext(ctx, fpcalcPath(), "-json",
+		"-format", "s16le", "-rate", strconv.Itoa(sampleRate), "-channels", "1", "-")
+	cmd.Stdin = bytes.NewReader(wav.SamplesToWavBytes(samples))
+	return runFpcalc(cmd)
+}
+
+// runFpcalc runs an fpcalc command printing JSON and reads the fingerprint
+func runFpcalc(cmd *exec.Cmd) (Fingerprint, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return Fingerprint{}, fmt.Errorf("fpcalc not found, install Chromaprint or set FPCALC_PATH: %v", err)
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			err = fmt.Errorf("%v: %s", err, message)
+		}
+		return Fingerprint{}, fmt.Errorf("fpcalc failed: %v", err)
+	}
+
+	var result struct {
+		Duration    float64 `json:"duration"`
+		Fingerprint string  `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return Fingerprint{}, fmt.Errorf("error reading fpcalc output: %v", err)
+	}
+	if result.Fingerprint == "" {
+		return Fingerprint{}, errors.New("fpcalc returned no fingerprint")
+	}
+	return Fingerprint{Duration: int(result.Duration), Fingerprint: result.Fingerprint}, nil
+}
+
+// Recording is a recording AcoustID identified a fingerprint as
+type Recording struct {
+	// MBID is the MusicBrainz ID of the recording
+	MBID   string
+	Title  string
+	Artist string
+	Album  string
+	// Duration is the length of the recording in seconds, 0 if unknown
+	Duration int
+	// Score is how closely the fingerprint matched, between 0 and 1
+	Score float64
+}
+
+// Client looks fingerprints up with the AcoustID web service, as the
+// application registered with the API key
+type Client struct {
+	APIKey string
+}
+
+// NewClientFromEnv returns a client for the application key in
+// ACOUSTID_API_KEY, or nil when it isn't set
+func NewClientFromEnv() *Client {
+	key := utils.GetEnv("ACOUSTID_API_KEY")
+	if key == "" {
+		return nil
+	}
+	return &Client{APIKey: key}
+}
+
+// Lookup returns the recordings fp belongs to, best match first. Recordings
+// AcoustID knows nothing of but their ID are left out.
+func (c *Client) Lookup(ctx context.Context, fp Fingerprint) ([]Recording, error) {
+	form := url.Values{}
+	form.Set("client", c.APIKey)
+	form.Set("meta", "recordings releasegroups compress")
+	form.Set("duration", strconv.Itoa(fp.Duration))
+	form.Set("fingerprint", fp.Fingerprint)
+
+	// Fingerprints are too long for a query string
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lookupEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if status := gjson.GetBytes(body, "status").String(); status != "ok" {
+		if message := gjson.GetBytes(body, "error.message").String(); message != "" {
+			return nil, fmt.Errorf("AcoustID returned an error: %s", message)
+		}
+		return nil, fmt.Errorf("AcoustID returned %s", resp.Status)
+	}
+
+	var recordings []Recording
+	for _, result := range gjson.GetBytes(body, "results").Array() {
+		score := result.Get("score").Float()
+		for _, recording := range result.Get("recordings").Array() {
+			if recording.Get("title").String() == "" {
+				continue
+			}
+			var artists []string
+			for _, name := range recording.Get("artists.#.name").Array() {
+				artists = append(artists, name.String())
+			}
+			recordings = append(recordings, Recording{
+				MBID:     recording.Get("id").String(),
+				Title:    recording.Get("title").String(),
+				Artist:   strings.Join(artists, ", "),
+				Album:    recording.Get("releasegroups.0.title").String(),
+				Duration: int(recording.Get("duration").Int()),
+				Score:    score,
+			})
+		}
+	}
+	return recordings, nil
+}
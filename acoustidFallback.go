@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"song-recognition/acoustid"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// acoustIDService is the Service of the matches found by AcoustID
+const acoustIDService = "acoustid"
+
+var (
+	acoustIDOnce   sync.Once
+	acoustIDClient *acoustid.Client
+)
+
+// findMatches is shazam.FindMatches, except that when the recording matches
+// no song of the catalog and ACOUSTID_API_KEY is set, the recording is
+// looked up with AcoustID, and the recordings it is known as are returned
+// as matches without a song ID. A failed lookup is logged and finds
+// nothing.
+func findMatches(ctx context.Context, samples []float64, duration float64, sampleRate int) ([]shazam.Match, time.Duration, error) {
+	matches, searchDuration, err := shazam.FindMatches(ctx, samples, duration, sampleRate)
+	if err != nil || len(matches) > 0 {
+		return matches, searchDuration, err
+	}
+
+	acoustIDOnce.Do(func() { acoustIDClient = acoustid.NewClientFromEnv() })
+	if acoustIDClient == nil {
+		return matches, searchDuration, nil
+	}
+
+	startTime := time.Now()
+	found, err := acoustIDMatches(ctx, acoustIDClient, samples, sampleRate)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "failed to look the recording up with AcoustID.", slog.Any("error", xerrors.New(err)))
+	}
+	return found, searchDuration + time.Since(startTime), nil
+}
+
+// acoustIDMatches returns the recordings AcoustID knows the samples as, as
+// matches whose confidence is the score AcoustID gave them
+func acoustIDMatches(ctx context.Context, client *acoustid.Client, samples []float64, sampleRate int) ([]shazam.Match, error) {
+	fp, err := acoustid.FingerprintSamples(ctx, samples, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	recordings, err := client.Lookup(ctx, fp)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []shazam.Match{}
+	for _, recording := range recordings {
+		matches = append(matches, shazam.Match{
+			SongTitle:  recording.Title,
+			SongArtist: recording.Artist,
+			Confidence: recording.Score,
+			Speed:      1,
+			Service:    acoustIDService,
+			SongMetadata: utils.SongMetadata{
+				Album:         recording.Album,
+				Duration:      recording.Duration,
+				RecordingMBID: recording.MBID,
+			},
+		})
+	}
+	return matches, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"song-recognition/metrics"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// registerAdminHandlers adds the admin endpoints to mux. They need one of
+// the API keys of ADMIN_API_KEYS, and work in the catalog of the request
+// like the rest of the API.
+func registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/admin/jobs", adminHandler(handleAdminJobs))
+	mux.HandleFunc("/api/admin/jobs/", adminHandler(handleAdminJobCancel))
+	mux.HandleFunc("/api/admin/recognitions", adminHandler(handleAdminRecognitions))
+	mux.HandleFunc("/api/admin/stats", adminHandler(handleAdminStats))
+	mux.HandleFunc("/api/admin/ingestion", adminHandler(handleAdminIngestion))
+	mux.HandleFunc("/api/admin/gc", adminHandler(handleAdminGC))
+	mux.HandleFunc("/api/admin/reload", adminHandler(handleAdminReload))
+}
+
+// adminHandler wraps an admin endpoint handler with the API middleware,
+// and responds with a 401 to requests without an API key and a 403 to
+// those whose key isn't an admin one
+func adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return apiHandler(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkAdminAccess(r.Context()); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, errAPIKeyRequired) {
+				status = http.StatusUnauthorized
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// handleAdminJobs serves GET /api/admin/jobs, the ingestion jobs of the
+// catalog from the newest, optionally only those with the "status" query
+// value
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	jobList := ingest.list(utils.CatalogFromContext(r.Context()))
+	if status := r.URL.Query().Get("status"); status != "" {
+		matching := []ingestJob{}
+		for _, job := range jobList {
+			if job.Status == status {
+				matching = append(matching, job)
+			}
+		}
+		jobList = matching
+	}
+
+	writeJSON(w, http.StatusOK, jobList)
+}
+
+// handleAdminJobCancel serves POST /api/admin/jobs/{id}/cancel, which
+// cancels a queued or running ingestion job
+func handleAdminJobCancel(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/admin/jobs/"), "/cancel")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	job, err := ingest.cancel(utils.CatalogFromContext(r.Context()), id)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errJobFinished):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// handleAdminRecognitions serves GET /api/admin/recognitions, the
+// recognitions made in the catalog from the newest, by every client or the
+// one of the "client" query value, paged with the optional "offset" and
+// "limit" query values
+func handleAdminRecognitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit := 0, defaultHistoryPageSize
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if param := query.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*value = n
+		}
+	}
+	if limit == 0 || limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	recognitions, err := db.ListRecognitions(r.Context(), query.Get("client"), offset, limit)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to list recognitions.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to list recognitions")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recognitions)
+}
+
+// backendStats is what the database backend supports and how it has been
+// used since the server started
+type backendStats struct {
+	Backend      string               `json:"backend"`
+	Transactions bool                 `json:"transactions"`
+	MaxBatchSize int                  `json:"maxBatchSize"`
+	NativeSearch bool                 `json:"nativeSearch"`
+	SharedAccess bool                 `json:"sharedAccess"`
+	Queries      []metrics.QueryStats `json:"queries"`
+}
+
+// cacheStats is how the couples cache has been used since the server
+// started
+type cacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Size     int    `json:"size"`
+	Capacity int    `json:"capacity"`
+}
+
+// adminStats is the state of the server and of the catalog of the request
+type adminStats struct {
+	Catalog      catalogStats    `json:"catalog"`
+	Database     backendStats    `json:"database"`
+	CouplesCache *cacheStats     `json:"couplesCache"`
+	Ingestion    ingestionStatus `json:"ingestion"`
+}
+
+// handleAdminStats serves GET /api/admin/stats: the catalog stats, what
+// the database backend supports and the time its calls took, the couples
+// cache use, and the state of ingestion
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	logger := utils.GetLogger()
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	catalog, err := getCatalogStats(r.Context(), db)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to get catalog stats.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+	queries, err := metrics.DBQueryStats()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to gather database metrics.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+
+	capabilities := db.Capabilities()
+	stats := adminStats{
+		Catalog: catalog,
+		Database: backendStats{
+			Backend:      capabilities.Backend,
+			Transactions: capabilities.Transactions,
+			MaxBatchSize: capabilities.MaxBatchSize,
+			NativeSearch: capabilities.NativeSearch,
+			SharedAccess: capabilities.SharedAccess,
+			Queries:      queries,
+		},
+		Ingestion: ingest.status(),
+	}
+	if cache, ok := utils.CouplesCacheStats(); ok {
+		stats.CouplesCache = &cacheStats{Hits: cache.Hits, Misses: cache.Misses, Size: cache.Size, Capacity: cache.Capacity}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleAdminIngestion serves GET /api/admin/ingestion, the state of
+// ingestion, and POST /api/admin/ingestion, which pauses saving songs with
+// "paused=true" and resumes it with "paused=false". Paused, jobs are still
+// queued but don't start, and songs saved right away are rejected.
+func handleAdminIngestion(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		paused, err := strconv.ParseBool(r.FormValue("paused"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, `"paused" must be true or false`)
+			return
+		}
+		ingest.setPaused(paused)
+
+		logger := utils.GetLogger()
+		if paused {
+			logger.InfoContext(r.Context(), "saving songs paused.")
+		} else {
+			logger.InfoContext(r.Context(), "saving songs resumed.")
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ingest.status())
+}
+
+// handleAdminGC serves POST /api/admin/gc, which deletes the fingerprints
+// of the songs no longer in the catalog, like the gc command, and responds
+// with the IDs of those songs. Saving songs is held meanwhile, and it
+// responds with a 409 while songs are being saved.
+func handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if utils.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, errReadOnlyServer.Error())
+		return
+	}
+
+	resume, err := ingest.holdForGC()
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	defer resume()
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	songIDs, err := utils.DeleteOrphanedFingerprints(r.Context(), db)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to delete orphaned fingerprints.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete orphaned fingerprints")
+		return
+	}
+	if songIDs == nil {
+		songIDs = []uint32{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]uint32{"songIds": songIDs})
+}
+
+// handleAdminReload serves POST /api/admin/reload, which reloads the
+// settings like SIGHUP does, and responds with those that changed
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	result, err := reloadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
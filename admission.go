@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"runtime"
+	"song-recognition/config"
+	"song-recognition/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// recognitionConcurrency is the number of recordings decoded,
+	// fingerprinted and matched at the same time, 0 for no limit. Set with
+	// RECOGNITION_CONCURRENCY.
+	recognitionConcurrency = intFromEnv("RECOGNITION_CONCURRENCY", runtime.NumCPU())
+
+	// recognitionQueueSize is the number of recordings that can wait for
+	// one of them to finish. Set with RECOGNITION_QUEUE_SIZE.
+	recognitionQueueSize = intFromEnv("RECOGNITION_QUEUE_SIZE", 50)
+
+	// recognitionQueueTimeout is how long a recording waits before it is
+	// rejected, 0 for as long as its client does. Set with
+	// RECOGNITION_QUEUE_TIMEOUT.
+	recognitionQueueTimeout = durationFromEnv("RECOGNITION_QUEUE_TIMEOUT", 10*time.Second)
+)
+
+var errServerBusy = errors.New("too many recordings are being recognized, try again later")
+
+// recognitionSlots admits the recognitions of the server's clients, so
+// that a burst of recordings queues instead of using up the memory of the
+// server
+var recognitionSlots = newAdmissionController(recognitionConcurrency, recognitionQueueSize, recognitionQueueTimeout)
+
+// A reload changes the queue, while the number of recognitions running at
+// the same time takes a restart
+func init() {
+	config.OnReload(func() {
+		recognitionSlots.setQueue(intFromEnv("RECOGNITION_QUEUE_SIZE", 50), durationFromEnv("RECOGNITION_QUEUE_TIMEOUT", 10*time.Second))
+	})
+}
+
+// admissionController limits how many recognitions run at the same time.
+// The others wait in a queue of limited size, for a limited time.
+type admissionController struct {
+	// slots holds a value for every recognition running, and is nil when
+	// they aren't limited
+	slots chan struct{}
+
+	mu        sync.Mutex
+	queueSize int
+	timeout   time.Duration
+	queued    int
+	// average is the moving average of how long recognitions run, to tell
+	// rejected clients when to try again
+	average time.Duration
+}
+
+func newAdmissionController(concurrency, queueSize int, timeout time.Duration) *admissionController {
+	a := &admissionController{queueSize: queueSize, timeout: timeout}
+	if concurrency > 0 {
+		a.slots = make(chan struct{}, concurrency)
+	}
+	return a
+}
+
+// setQueue changes the size of the queue and how long recordings wait in
+// it. Recordings already queued keep waiting.
+func (a *admissionController) setQueue(queueSize int, timeout time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.queueSize, a.timeout = queueSize, timeout
+}
+
+// admit waits for a recognition to be allowed to run, and returns the
+// function to call once it is done. It returns errServerBusy when the queue
+// is full or the recognition waited too long, and ctx's error once ctx is
+// done.
+func (a *admissionController) admit(ctx context.Context) (func(), error) {
+	if release, ok := a.tryAdmit(); ok {
+		return release, nil
+	}
+
+	a.mu.Lock()
+	if a.queued >= a.queueSize {
+		a.mu.Unlock()
+		metrics.RecognitionsRejected.Inc()
+		return nil, errServerBusy
+	}
+	a.queued++
+	queueTimeout := a.timeout
+	a.mu.Unlock()
+	metrics.RecognitionsQueued.Inc()
+	defer func() {
+		a.mu.Lock()
+		a.queued--
+		a.mu.Unlock()
+		metrics.RecognitionsQueued.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if queueTimeout > 0 {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return a.started(), nil
+	case <-timeout:
+		metrics.RecognitionsRejected.Inc()
+		return nil, errServerBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tryAdmit allows a recognition to run if it can right away, without
+// queuing it, and returns the function to call once it is done
+func (a *admissionController) tryAdmit() (func(), bool) {
+	if a.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return a.started(), true
+	default:
+		return nil, false
+	}
+}
+
+// started counts a recognition that was given a slot, and returns the
+// function that frees it
+func (a *admissionController) started() func() {
+	metrics.RecognitionsRunning.Inc()
+	startTime := time.Now()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			if a.average == 0 {
+				a.average = time.Since(startTime)
+			} else {
+				a.average += (time.Since(startTime) - a.average) / 8
+			}
+			a.mu.Unlock()
+
+			metrics.RecognitionsRunning.Dec()
+			<-a.slots
+		})
+	}
+}
+
+// retryAfter estimates how long a rejected client should wait before
+// trying again: long enough for the queued recognitions to run, and at
+// least a second
+func (a *admissionController) retryAfter() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.slots == nil {
+		return time.Second
+	}
+	rounds := a.queued/cap(a.slots) + 1
+	return max(a.average*time.Duration(rounds), time.Second)
+}
+
+// retryAfterSeconds is retryAfter in whole seconds, as the Retry-After
+// header and socket messages give it
+func (a *admissionController) retryAfterSeconds() int {
+	return int(math.Ceil(a.retryAfter().Seconds()))
+}
+
+// admitRecognition waits for the recognition of r to be allowed to run, and
+// returns the function to call once it is done. Requests that can't be
+// admitted are answered with a 503 error and a Retry-After header, and
+// admitRecognition returns false.
+func admitRecognition(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := recognitionSlots.admit(r.Context())
+	if err != nil {
+		if errors.Is(err, errServerBusy) {
+			w.Header().Set("Retry-After", strconv.Itoa(recognitionSlots.retryAfterSeconds()))
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, errServerBusy.Error())
+		return nil, false
+	}
+	return release, true
+}
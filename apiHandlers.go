@@ -0,0 +1,1349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"song-recognition/protocol"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	maxSongUploadSize  = 200 << 20 // 200 MB
+	maxRecordingSize   = 20 << 20  // 20 MB
+	maxFormSize        = 1 << 20   // 1 MB, for requests without files
+	maxAPIMatchResults = 10
+
+	// defaultHistoryPageSize and maxHistoryPageSize bound the recognitions
+	// returned per history request
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 100
+
+	// defaultAirplayPageSize and maxAirplayPageSize bound the airplays
+	// returned per airplay request
+	defaultAirplayPageSize = 50
+	maxAirplayPageSize     = 500
+
+	// defaultSearchResults and maxSearchResults bound the songs returned
+	// per search
+	defaultSearchResults = 10
+	maxSearchResults     = 50
+
+	// defaultYTSegmentDuration is the length of the segment recognized when
+	// no end is given
+	defaultYTSegmentDuration = 20 * time.Second
+)
+
+// registerAPIHandlers adds the JSON API endpoints to mux
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/songs", apiHandler(handleAPISongs))
+	mux.HandleFunc("/api/songs/", apiHandler(handleAPISong))
+	mux.HandleFunc("/api/songs/search", apiHandler(handleAPISongSearch))
+	mux.HandleFunc("/api/upload", apiHandler(handleAPIUpload))
+	mux.HandleFunc("/api/jobs/", apiHandler(handleAPIJob))
+	mux.HandleFunc("/api/artists", apiHandler(handleAPIArtists))
+	mux.HandleFunc("/api/albums", apiHandler(handleAPIAlbums))
+	mux.HandleFunc("/api/events", apiHandler(handleAPIEvents))
+	mux.HandleFunc("/api/recognize", apiHandler(handleAPIRecognize))
+	mux.HandleFunc("/api/recognize/youtube", apiHandler(handleAPIRecognizeYouTube))
+	mux.HandleFunc("/api/history", apiHandler(handleAPIHistory))
+	mux.HandleFunc("/api/stats", apiHandler(handleAPIStats))
+	mux.HandleFunc("/api/airplay", apiHandler(handleAPIAirplay))
+	mux.HandleFunc("/api/airplay/report", apiHandler(handleAPIAirplayReport))
+	mux.HandleFunc("/api/spectrogram", apiHandler(handleAPISpectrogram))
+	mux.HandleFunc("/api/covers/", apiHandler(handleAPICover))
+	registerAdminHandlers(mux)
+}
+
+// apiHandler wraps an API endpoint handler with the middleware every
+// endpoint runs behind
+func apiHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return withRequestID(authenticated(withCatalog(handler)))
+}
+
+// maxRequestIDLength is the longest X-Request-ID header accepted from clients
+const maxRequestIDLength = 64
+
+// statusRecorder records the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush event streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withRequestID runs handler with the request ID given by the X-Request-ID
+// header, or a new one, which is sent back in the response, and logs the
+// request once it is handled
+func withRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength || strings.ContainsFunc(id, func(c rune) bool { return c < '!' || c > '~' }) {
+			id = utils.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := utils.WithRequestID(r.Context(), id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r.WithContext(ctx))
+
+		logger := utils.GetLogger()
+		logger.InfoContext(ctx, "request handled.",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+}
+
+// authenticated runs handler with the API key given by the X-API-Key
+// header or an "Authorization: Bearer" header, if any, on behalf of the
+// client given by the X-Client-ID header
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				secret = strings.TrimPrefix(auth, "Bearer ")
+			}
+		}
+
+		key, err := authenticate(r.Context(), secret)
+		if errors.Is(err, errInvalidAPIKey) {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			logger := utils.GetLogger()
+			logger.ErrorContext(r.Context(), "failed to look up API key.", slog.Any("error", xerrors.New(err)))
+			writeJSONError(w, http.StatusInternalServerError, "failed to look up API key")
+			return
+		}
+
+		ctx, err := withClientID(withAPIKey(r.Context(), key), r.Header.Get("X-Client-ID"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// withCatalog runs handler in the catalog given by the X-Catalog header or
+// the "catalog" query value, or in the default catalog if neither is set.
+// Requests with an API key bound to a catalog default to that catalog.
+func withCatalog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		catalog := r.Header.Get("X-Catalog")
+		if catalog == "" {
+			catalog = r.URL.Query().Get("catalog")
+		}
+		if !utils.ValidCatalog(catalog) {
+			writeJSONError(w, http.StatusBadRequest, "invalid catalog, expected up to 32 lowercase letters, digits or underscores")
+			return
+		}
+
+		catalog, err := keyCatalog(apiKeyFromContext(r.Context()), catalog)
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		handler(w, r.WithContext(utils.WithCatalog(r.Context(), catalog)))
+	}
+}
+
+// canWrite reports whether the request may change songs, and responds
+// with a 401 if it may not
+func canWrite(w http.ResponseWriter, r *http.Request) bool {
+	if err := checkWriteAccess(r.Context()); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	return true
+}
+
+// canChangeSongs reports whether the request may change songs on this
+// server, and responds with a 401 if it lacks an API key or a 403 if the
+// server is read-only
+func canChangeSongs(w http.ResponseWriter, r *http.Request) bool {
+	if !canWrite(w, r) {
+		return false
+	}
+	if utils.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, errReadOnlyServer.Error())
+		return false
+	}
+	return true
+}
+
+// startJob registers the ingestion job of r, and responds with a 503 if
+// the server is shutting down. The returned request runs in the job's
+// context, and done must be called when the job ends.
+func startJob(w http.ResponseWriter, r *http.Request) (req *http.Request, done func(), ok bool) {
+	ctx, done, err := jobs.start(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return nil, nil, false
+	}
+	return r.WithContext(ctx), done, true
+}
+
+// canRecognize applies the recognition rate limit to the request, and
+// responds with a 429 if it is exceeded
+func canRecognize(w http.ResponseWriter, r *http.Request) bool {
+	clientAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientAddr = r.RemoteAddr
+	}
+
+	allowed, wait := allowRecognition(r.Context(), clientAddr)
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.Error("failed to write JSON response.", slog.Any("error", err))
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// saveUpload copies the multipart file in field to the tmp directory and
+// returns its path
+func saveUpload(r *http.Request, field string) (string, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return "", fmt.Errorf("missing %q file: %v", field, err)
+	}
+	defer file.Close()
+
+	fileName := fmt.Sprintf("%d_%s", utils.GenerateUniqueID(), filepath.Base(header.Filename))
+	filePath := filepath.Join("tmp", fileName)
+
+	out, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, file); err != nil {
+		utils.DeleteFile(filePath)
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// uploadFileName returns the name the multipart file in field was sent with
+func uploadFileName(r *http.Request, field string) string {
+	if r.MultipartForm == nil || len(r.MultipartForm.File[field]) == 0 {
+		return ""
+	}
+	return filepath.Base(r.MultipartForm.File[field][0].Filename)
+}
+
+// handleAPISongs serves GET /api/songs and POST /api/songs.
+// POST accepts either a "youtubeUrl" or "soundcloudUrl" form value or a
+// "file" upload, with optional "title", "artist", "force", "reindex" and
+// "async" values.
+func handleAPISongs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listSongs(w, r)
+	case http.MethodPost:
+		if !canChangeSongs(w, r) {
+			return
+		}
+		r, done, ok := startJob(w, r)
+		if !ok {
+			return
+		}
+		defer done()
+		registerSong(w, r)
+	case http.MethodDelete:
+		if !canChangeSongs(w, r) {
+			return
+		}
+		pruneSongs(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listSongs serves a page of songs set by the optional "offset", "limit"
+// and "sort" query values. The total number of songs is sent in the
+// X-Total-Count header.
+func listSongs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var offset, limit int
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if param := query.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*value = n
+		}
+	}
+
+	sortBy := query.Get("sort")
+	if !utils.ValidSongSort(sortBy) {
+		writeJSONError(w, http.StatusBadRequest, "invalid sort, expected title, artist or id")
+		return
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	logger := utils.GetLogger()
+
+	total, err := db.TotalSongs(r.Context())
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to count songs.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to list songs")
+		return
+	}
+
+	songs, err := db.ListSongs(r.Context(), offset, limit, sortBy)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to list songs.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to list songs")
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, songs)
+}
+
+func registerSong(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSongUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeJSONError(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	title := r.FormValue("title")
+	artist := r.FormValue("artist")
+
+	songURL := r.FormValue("url")
+	if youtubeURL := r.FormValue("youtubeUrl"); youtubeURL != "" {
+		songURL = youtubeURL
+	}
+	if soundcloudURL := r.FormValue("soundcloudUrl"); soundcloudURL != "" {
+		if !spotify.IsSoundCloudURL(soundcloudURL) {
+			writeJSONError(w, http.StatusBadRequest, "invalid SoundCloud URL")
+			return
+		}
+		songURL = soundcloudURL
+	}
+
+	if songURL != "" {
+		if _, err := spotify.SourceFor(songURL); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		runIngestion(w, r, songURL, func(ctx context.Context) (string, string, error) {
+			track, err := spotify.DlSong(ctx, songURL, title, artist, SONGS_DIR)
+			if err != nil {
+				return "", "", err
+			}
+			return track.Title, track.Artist, nil
+		}, nil)
+		return
+	}
+
+	filePath, err := saveUpload(r, "file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "either url, youtubeUrl, soundcloudUrl or file is required")
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.FormValue("force"))
+
+	fileName := uploadFileName(r, "file")
+	runIngestion(w, r, fileName, func(ctx context.Context) (string, string, error) {
+		if title == "" || artist == "" {
+			return "", "", saveSong(ctx, filePath, fileName, force, uploadFileOptions)
+		}
+		track := &spotify.Track{Title: title, Artist: artist}
+		track.Provenance.FileName = fileName
+		return title, artist, saveTrack(ctx, filePath, track, force)
+	}, func() { utils.DeleteFile(filePath) })
+}
+
+// songIngestion saves a song and returns its title and artist, empty when
+// they are only known once the song is stored
+type songIngestion func(ctx context.Context) (title, artist string, err error)
+
+// runIngestion saves a song with save and responds with it. When the
+// "async" form value is true, save runs in a queued job instead, and the
+// response is a 202 with the job. When "reindex" is true, a song that is
+// already indexed gets its fingerprints replaced instead of a 409.
+// cleanup, if not nil, is called once save has run or won't run.
+func runIngestion(w http.ResponseWriter, r *http.Request, source string, save songIngestion, cleanup func()) {
+	ctx := r.Context()
+	if cleanup == nil {
+		cleanup = func() {}
+	}
+	if reindex, _ := strconv.ParseBool(r.FormValue("reindex")); reindex {
+		register := save
+		save = func(ctx context.Context) (string, string, error) {
+			return register(spotify.WithReindex(ctx))
+		}
+	}
+
+	if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+		job, err := ingest.enqueue(ctx, source, func(ctx context.Context, progress *jobProgress) error {
+			defer cleanup()
+			title, artist, err := save(ctx)
+			if err == nil && title != "" {
+				progress.songSaved(ctx, title, artist)
+			}
+			return err
+		})
+		if err != nil {
+			cleanup()
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	saved, err := ingest.startSaving()
+	if err != nil {
+		cleanup()
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	title, artist, err := save(ctx)
+	saved()
+	cleanup()
+	if err != nil {
+		writeRegisterError(ctx, w, err)
+		return
+	}
+
+	if title == "" || artist == "" {
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "saved"})
+		return
+	}
+	respondWithSong(ctx, w, title, artist)
+}
+
+// handleAPIJob serves GET /api/jobs/{id}, the status of a song
+// registration queued with "async"
+func handleAPIJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	job, ok := ingest.get(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	if !ok || job.Catalog != utils.CatalogFromContext(r.Context()) {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleAPIArtists serves POST /api/artists, which queues a job saving
+// every song of the Spotify artist or YouTube channel at the "url" form
+// value that isn't indexed yet, or reindexing them too with "reindex". The
+// job reports each track, then a summary of those added, skipped and failed.
+func handleAPIArtists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canChangeSongs(w, r) {
+		return
+	}
+
+	artistURL := r.FormValue("url")
+	if !spotify.IsArtistURL(artistURL) {
+		writeJSONError(w, http.StatusBadRequest, "url must be the link of a Spotify artist or a YouTube channel")
+		return
+	}
+
+	queueImport(w, r, artistURL, func(ctx context.Context, onStatus func(spotify.TrackStatus)) (spotify.ImportSummary, error) {
+		return spotify.DlArtist(ctx, artistURL, SONGS_DIR, onStatus)
+	})
+}
+
+// handleAPIAlbums serves POST /api/albums, which queues a job saving every
+// track of a MusicBrainz release that isn't indexed yet, or reindexing them
+// too with "reindex". The release is given by its ID or link in "mbid", or
+// looked up by the "artist" and "album" values. The job reports each track,
+// then a summary of those added, skipped and failed.
+func handleAPIAlbums(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canChangeSongs(w, r) {
+		return
+	}
+
+	release, artist, album := r.FormValue("mbid"), r.FormValue("artist"), r.FormValue("album")
+	source := release
+	switch {
+	case release != "" && !spotify.IsMusicBrainzRelease(release):
+		writeJSONError(w, http.StatusBadRequest, "mbid must be the ID or link of a MusicBrainz release")
+		return
+	case release == "" && (artist == "" || album == ""):
+		writeJSONError(w, http.StatusBadRequest, "either mbid, or artist and album are required")
+		return
+	case release == "":
+		source = fmt.Sprintf("'%s' by '%s'", album, artist)
+	}
+
+	queueImport(w, r, source, func(ctx context.Context, onStatus func(spotify.TrackStatus)) (spotify.ImportSummary, error) {
+		mbid := release
+		if mbid == "" {
+			found, err := spotify.FindMusicBrainzRelease(ctx, artist, album)
+			if err != nil {
+				return spotify.ImportSummary{}, err
+			}
+			mbid = found
+		}
+		return spotify.DlAlbum(ctx, mbid, SONGS_DIR, onStatus)
+	})
+}
+
+// queueImport queues a job running importAll, which imports the songs from
+// source, and responds with a 202 and the job. The job reports each track
+// importAll reports, then its summary. When the "reindex" form value is
+// true, songs that are already indexed are reindexed instead of skipped.
+func queueImport(w http.ResponseWriter, r *http.Request, source string, importAll func(ctx context.Context, onStatus func(spotify.TrackStatus)) (spotify.ImportSummary, error)) {
+	ctx := r.Context()
+	if reindex, _ := strconv.ParseBool(r.FormValue("reindex")); reindex {
+		ctx = spotify.WithReindex(ctx)
+	}
+	job, err := ingest.enqueue(ctx, source, func(ctx context.Context, progress *jobProgress) error {
+		summary, err := importAll(spotify.WithRetryFailed(ctx), func(status spotify.TrackStatus) {
+			progress.track(status)
+			if status.Stage == spotify.StageDone {
+				progress.songSaved(ctx, status.Title, status.Artist)
+			}
+		})
+		if err == nil {
+			progress.summarize(summary)
+		}
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleAPIUpload serves POST /api/upload, which saves a "file" upload as
+// the song given by the required "title" and "artist" values, without
+// looking it up on YouTube. The optional "album" and "year" values are
+// stored with it, and "async" queues it like POST /api/songs.
+func handleAPIUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canChangeSongs(w, r) {
+		return
+	}
+	r, done, ok := startJob(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSongUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	track := &spotify.Track{
+		Title:  strings.TrimSpace(r.FormValue("title")),
+		Artist: strings.TrimSpace(r.FormValue("artist")),
+		Album:  strings.TrimSpace(r.FormValue("album")),
+		Source: utils.SourceFile,
+	}
+	if track.Title == "" || track.Artist == "" {
+		writeJSONError(w, http.StatusBadRequest, "title and artist are required")
+		return
+	}
+	if year := r.FormValue("year"); year != "" {
+		n, err := strconv.Atoi(year)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid year")
+			return
+		}
+		track.ReleaseYear = n
+	}
+
+	filePath, err := saveUpload(r, "file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	track.Provenance.FileName = uploadFileName(r, "file")
+
+	runIngestion(w, r, track.Provenance.FileName, func(ctx context.Context) (string, string, error) {
+		return track.Title, track.Artist, storeTrack(ctx, filePath, track, "")
+	}, func() { utils.DeleteFile(filePath) })
+}
+
+// writeRegisterError responds to a failed song registration. Songs that
+// are already indexed get a 409 with the existing song.
+func writeRegisterError(ctx context.Context, w http.ResponseWriter, err error) {
+	var duplicate *spotify.DuplicateError
+	if errors.As(err, &duplicate) {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "song": duplicate.Song})
+		return
+	}
+
+	logger := utils.GetLogger()
+	logger.ErrorContext(ctx, "failed to register song.", slog.Any("error", xerrors.New(err)))
+	writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+}
+
+// respondWithSong writes the stored song with the given title and artist
+func respondWithSong(ctx context.Context, w http.ResponseWriter, title, artist string) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	song, songExists, err := db.GetSongByKey(ctx, utils.GenerateSongKey(title, artist))
+	if err != nil || !songExists {
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "saved"})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, song)
+}
+
+// handleAPISongSearch serves GET /api/songs/search, the songs whose title
+// or artist resemble the "q" query value, from the closest, so clients can
+// check whether a song is indexed before submitting it. The optional
+// "limit" value sets how many are returned.
+func handleAPISongSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit := defaultSearchResults
+	if param := query.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxSearchResults)
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	results, err := db.SearchSongs(r.Context(), q, limit)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to search songs.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to search songs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleAPISong serves GET and DELETE /api/songs/{id}
+func handleAPISong(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getSong(w, r)
+	case http.MethodDelete:
+		if !canChangeSongs(w, r) {
+			return
+		}
+		deleteSong(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// songWithFingerprints is a song along with its number of fingerprints
+type songWithFingerprints struct {
+	utils.Song
+	Fingerprints int
+}
+
+// getSong responds with the song of the request's path and its number of
+// fingerprints
+func getSong(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/songs/"), 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	song, songExists, err := db.GetSongByID(r.Context(), uint32(id))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to get song")
+		return
+	}
+	if !songExists {
+		writeJSONError(w, http.StatusNotFound, "song not found")
+		return
+	}
+
+	fingerprints, err := db.FingerprintCountBySong(r.Context(), uint32(id))
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to count fingerprints.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to count fingerprints")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, songWithFingerprints{Song: song, Fingerprints: fingerprints})
+}
+
+// deleteSong deletes the song of the request's path
+func deleteSong(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/songs/"), 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	_, songExists, err := db.GetSongByID(r.Context(), uint32(id))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to get song")
+		return
+	}
+	if !songExists {
+		writeJSONError(w, http.StatusNotFound, "song not found")
+		return
+	}
+
+	if err := db.DeleteSongByID(r.Context(), uint32(id)); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete song")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pruneSongs deletes the songs selected by the "ids" (comma-separated),
+// "artist" and "source" query values, along with their fingerprints. With
+// "dryRun" set, it only reports what it would delete.
+func pruneSongs(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	query := r.URL.Query()
+
+	filter := utils.SongFilter{Artist: query.Get("artist"), Source: query.Get("source")}
+	if ids := query.Get("ids"); ids != "" {
+		for _, field := range strings.Split(ids, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid song ID "+field)
+				return
+			}
+			filter.IDs = append(filter.IDs, uint32(id))
+		}
+	}
+	if filter.IsEmpty() {
+		writeJSONError(w, http.StatusBadRequest, utils.ErrEmptySongFilter.Error())
+		return
+	}
+
+	dryRun := false
+	if param := query.Get("dryRun"); param != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(param); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid dryRun")
+			return
+		}
+	}
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	result, err := utils.PruneSongs(r.Context(), db, filter, dryRun)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to prune songs.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete songs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleAPIRecognize serves POST /api/recognize with an "audio" file upload
+func handleAPIRecognize(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canRecognize(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRecordingSize)
+	if err := r.ParseMultipartForm(maxRecordingSize); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	filePath, err := saveUpload(r, "audio")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer utils.DeleteFile(filePath)
+
+	release, ok := admitRecognition(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// The recognition times out counting the decoding in
+	ctx, cancel := shazam.WithTimeout(ctx)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	audio, err := wav.DecodeFileContext(ctx, filePath)
+	if errors.Is(context.Cause(ctx), shazam.ErrTimedOut) {
+		writeTimedOut(w, []shazam.Match{})
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to decode recording.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusUnprocessableEntity, "unsupported audio file")
+		return
+	}
+
+	writeMatches(w, r, audio)
+}
+
+// handleAPIRecognizeYouTube serves POST /api/recognize/youtube, which
+// recognizes the part of the video at "url" between the "start" and "end"
+// timestamps. Timestamps are seconds or [hh:]mm:ss; start defaults to the
+// beginning of the video and end to 20 seconds after start.
+func handleAPIRecognizeYouTube(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canWrite(w, r) || !canRecognize(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseMultipartForm(maxFormSize); err != nil && err != http.ErrNotMultipart {
+		writeJSONError(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	videoURL := r.FormValue("url")
+	if !spotify.IsYouTubeURL(videoURL) {
+		writeJSONError(w, http.StatusBadRequest, "invalid YouTube URL")
+		return
+	}
+
+	var start time.Duration
+	if value := r.FormValue("start"); value != "" {
+		var err error
+		if start, err = parseTimestamp(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid start")
+			return
+		}
+	}
+
+	end := start + defaultYTSegmentDuration
+	if value := r.FormValue("end"); value != "" {
+		var err error
+		if end, err = parseTimestamp(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid end")
+			return
+		}
+	}
+
+	if end <= start {
+		writeJSONError(w, http.StatusBadRequest, "end must be after start")
+		return
+	}
+	if end-start > spotify.MaxYTSegmentDuration {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("segment can't be longer than %v", spotify.MaxYTSegmentDuration))
+		return
+	}
+
+	// Admitted first, so that rejected requests don't cost a download
+	release, ok := admitRecognition(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	audio, err := spotify.DlYTSegment(ctx, videoURL, start, end, "tmp")
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to download YouTube segment.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusBadGateway, "failed to download YouTube segment")
+		return
+	}
+
+	writeMatches(w, r, audio)
+}
+
+// maxTimestampSeconds is the longest timestamp a time.Duration holds
+const maxTimestampSeconds = float64(math.MaxInt64) / float64(time.Second)
+
+// parseTimestamp parses a number of seconds or an [hh:]mm:ss timestamp,
+// where the seconds may have a fraction
+func parseTimestamp(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	var seconds float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n < 0 || (i > 0 && n >= 60) || (i < len(parts)-1 && n != math.Trunc(n)) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		seconds = seconds*60 + n
+	}
+	if seconds >= maxTimestampSeconds {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// writeMatches recognizes audio and writes the best matches, limited by the
+// optional "limit" and "minConfidence" form values. With the "diagnostics"
+// form value set to true, the recognition is a dry run, and the matches are
+// written along with diagnostics of how they were found. A recognition that
+// times out is answered by writeTimedOut.
+func writeMatches(w http.ResponseWriter, r *http.Request, audio *wav.Audio) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	dryRun := false
+	if value := r.FormValue("diagnostics"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid diagnostics value, expected true or false")
+			return
+		}
+	}
+
+	var matches []shazam.Match
+	var diagnostics shazam.Diagnostics
+	var err error
+	if dryRun {
+		matches, diagnostics, err = shazam.Diagnose(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+	} else {
+		matches, _, err = findMatches(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+	}
+	timedOut := errors.Is(err, shazam.ErrTimedOut)
+	if err != nil && !timedOut {
+		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to get matches")
+		return
+	}
+
+	limit := maxAPIMatchResults
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	minConfidence, _ := strconv.ParseFloat(r.FormValue("minConfidence"), 64)
+
+	matches = shazam.TopMatches(matches, limit, minConfidence)
+	if timedOut {
+		if !dryRun {
+			publishRecognition(ctx, protocol.TypeMatches, protocol.Matches{Matches: matches, TimedOut: true}, true)
+		}
+		writeTimedOut(w, matches)
+		return
+	}
+	if dryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"matches": matches, "diagnostics": diagnostics})
+		return
+	}
+	publishRecognition(ctx, protocol.TypeMatches, protocol.Matches{Matches: matches}, true)
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// writeTimedOut answers a recognition that timed out with a 504 error,
+// along with the matches found by then
+func writeTimedOut(w http.ResponseWriter, matches []shazam.Match) {
+	writeJSON(w, http.StatusGatewayTimeout, map[string]interface{}{
+		"error":    "recognition timed out, the matches are partial",
+		"timedOut": true,
+		"matches":  matches,
+	})
+}
+
+// handleAPISpectrogram serves POST /api/spectrogram, which renders the
+// spectrogram of an "audio" file upload as a PNG image. The peaks
+// fingerprints are made of are marked unless the "peaks" form value is false.
+func handleAPISpectrogram(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !canRecognize(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRecordingSize)
+	if err := r.ParseMultipartForm(maxRecordingSize); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	markPeaks := true
+	if value := r.FormValue("peaks"); value != "" {
+		var err error
+		if markPeaks, err = strconv.ParseBool(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid peaks value, expected true or false")
+			return
+		}
+	}
+
+	filePath, err := saveUpload(r, "audio")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer utils.DeleteFile(filePath)
+
+	// Decoding and rendering take as long as a recognition
+	release, ok := admitRecognition(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	audio, err := wav.DecodeFileContext(ctx, filePath)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to decode audio.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusUnprocessableEntity, "unsupported audio file")
+		return
+	}
+
+	cfg, err := shazam.ConfigFromEnv()
+	if err != nil {
+		logger.ErrorContext(ctx, "invalid fingerprint config.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "invalid fingerprint config")
+		return
+	}
+
+	img, err := shazam.RenderSpectrogram(audio.Samples, audio.SampleRate, audio.Duration, cfg, markPeaks)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := png.Encode(w, img); err != nil {
+		logger.ErrorContext(ctx, "failed to write spectrogram.", slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// catalogStats is the size of a catalog
+type catalogStats struct {
+	Songs        int   `json:"songs"`
+	Fingerprints int   `json:"fingerprints"`
+	StorageBytes int64 `json:"storageBytes"`
+	// FingerprintsPerSong is the average number of fingerprints of a song
+	FingerprintsPerSong float64 `json:"fingerprintsPerSong"`
+}
+
+// getCatalogStats measures the catalog of db
+func getCatalogStats(ctx context.Context, db utils.DBClient) (catalogStats, error) {
+	var stats catalogStats
+	var err error
+	if stats.Songs, err = db.TotalSongs(ctx); err != nil {
+		return stats, fmt.Errorf("failed to count songs: %v", err)
+	}
+	if stats.Fingerprints, err = db.TotalFingerprints(ctx); err != nil {
+		return stats, fmt.Errorf("failed to count fingerprints: %v", err)
+	}
+	if stats.StorageBytes, err = db.StorageSize(ctx); err != nil {
+		return stats, fmt.Errorf("failed to get storage size: %v", err)
+	}
+	if stats.Songs > 0 {
+		stats.FingerprintsPerSong = float64(stats.Fingerprints) / float64(stats.Songs)
+	}
+	return stats, nil
+}
+
+// handleAPIStats serves GET /api/stats, the number of songs and
+// fingerprints of the catalog and the storage it takes up
+func handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	stats, err := getCatalogStats(r.Context(), db)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to get catalog stats.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleAPIHistory serves GET /api/history, the recognitions made by the
+// client of the request from the newest, paged with the optional "offset"
+// and "limit" query values
+func handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clientID := utils.ClientIDFromContext(r.Context())
+	if clientID == "" {
+		writeJSONError(w, http.StatusBadRequest, "a client ID is required, set the X-Client-ID header")
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit := 0, defaultHistoryPageSize
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if param := query.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*value = n
+		}
+	}
+	if limit == 0 || limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	recognitions, err := db.ListRecognitions(r.Context(), clientID, offset, limit)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to list recognitions.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to list recognitions")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recognitions)
+}
+
+// airplayFilterFromQuery reads the optional "station", "from" and "to"
+// query values of an airplay request, with times in RFC 3339 format
+func airplayFilterFromQuery(query url.Values) (utils.AirplayFilter, error) {
+	filter := utils.AirplayFilter{Station: query.Get("station")}
+	for name, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if param := query.Get(name); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return utils.AirplayFilter{}, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+			}
+			*value = t
+		}
+	}
+	return filter, nil
+}
+
+// handleAPIAirplay serves GET /api/airplay, the tracks played by the
+// monitored stations from the latest, selected with the optional "station",
+// "from" and "to" query values and paged with "offset" and "limit"
+func handleAPIAirplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := airplayFilterFromQuery(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit := 0, defaultAirplayPageSize
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if param := query.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*value = n
+		}
+	}
+	if limit == 0 || limit > maxAirplayPageSize {
+		limit = maxAirplayPageSize
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	airplays, err := db.ListAirplays(r.Context(), filter, offset, limit)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to list airplays.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to list airplays")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, airplays)
+}
+
+// handleAPIAirplayReport serves GET /api/airplay/report, the number of
+// plays and time played of every song among the airplays selected with the
+// optional "station", "from" and "to" query values, from the most played
+func handleAPIAirplayReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	filter, err := airplayFilterFromQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error connecting to DB")
+		return
+	}
+	defer db.Close()
+
+	report, err := airplayReport(r.Context(), db, filter)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(r.Context(), "failed to report airplay.", slog.Any("error", xerrors.New(err)))
+		writeJSONError(w, http.StatusInternalServerError, "failed to report airplay")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"90", 90 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"1:30", 90 * time.Second, true},
+		{"1:02:03.25", time.Hour + 2*time.Minute + 3250*time.Millisecond, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1:60", 0, false},
+		{"1.5:30", 0, false},
+		{"1:2:3:4", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"NaN", 0, false},
+		{"1:NaN", 0, false},
+		{"1e300", 0, false},
+		{"9223372037", 0, false},
+		{"99999999999:00", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseTimestamp(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseTimestamp(%q) error = %v, want ok %v", test.value, err, test.ok)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"song-recognition/config"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// requireAPIKey makes registering and deleting songs, and recognizing
+	// YouTube videos, need an API key. Set with REQUIRE_API_KEY, which
+	// servers that only trusted clients reach can turn off.
+	requireAPIKey = boolFromEnv("REQUIRE_API_KEY", true)
+
+	// defaultKeyRateLimit is the number of recognitions per minute allowed
+	// to API keys without a limit of their own, 0 for no limit. Set with
+	// API_KEY_RATE_LIMIT.
+	defaultKeyRateLimit atomic.Int64
+
+	// anonymousRateLimit is the number of recognitions per minute allowed to
+	// each client address without an API key, 0 for no limit. Set with
+	// ANONYMOUS_RATE_LIMIT.
+	anonymousRateLimit atomic.Int64
+)
+
+func init() {
+	setRateLimits()
+	config.OnReload(setRateLimits)
+}
+
+// setRateLimits reads the default rate limits from the settings
+func setRateLimits() {
+	defaultKeyRateLimit.Store(int64(intFromEnv("API_KEY_RATE_LIMIT", 60)))
+	anonymousRateLimit.Store(int64(intFromEnv("ANONYMOUS_RATE_LIMIT", 0)))
+}
+
+func boolFromEnv(name string, fallback bool) bool {
+	v, err := strconv.ParseBool(utils.GetEnv(name, strconv.FormatBool(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func intFromEnv(name string, fallback int) int {
+	limit, err := strconv.Atoi(utils.GetEnv(name, strconv.Itoa(fallback)))
+	if err != nil || limit < 0 {
+		return fallback
+	}
+	return limit
+}
+
+var (
+	errInvalidAPIKey   = errors.New("invalid API key")
+	errAPIKeyRequired  = errors.New("an API key is required")
+	errReadOnlyServer  = errors.New("the server is read-only, songs are changed through the server that ingests them")
+	errInvalidClientID = errors.New("invalid client ID, expected up to 64 printable ASCII characters")
+	errAdminDisabled   = errors.New("admin endpoints are disabled, set ADMIN_API_KEYS to enable them")
+	errNotAdminKey     = errors.New("the API key can't use admin endpoints")
+)
+
+type apiKeyContextKey struct{}
+
+// withAPIKey returns a copy of ctx that carries key
+func withAPIKey(ctx context.Context, key *utils.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// apiKeyFromContext returns the API key a request was made with, nil if
+// it had none
+func apiKeyFromContext(ctx context.Context) *utils.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*utils.APIKey)
+	return key
+}
+
+// authenticate returns the stored key secret belongs to, nil if secret is
+// empty, and errInvalidAPIKey if there is no such key
+func authenticate(ctx context.Context, secret string) (*utils.APIKey, error) {
+	if secret == "" {
+		return nil, nil
+	}
+
+	db, err := sharedAuthDBClient()
+	if err != nil {
+		return nil, err
+	}
+
+	key, exists, err := utils.LookupAPIKey(ctx, db, secret)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errInvalidAPIKey
+	}
+	return &key, nil
+}
+
+var (
+	authDBMu sync.Mutex
+	// authDB looks up the API keys of every request, which would otherwise
+	// open a client, and with SQL backends a connection pool, each
+	authDB utils.DBClient
+)
+
+// sharedAuthDBClient returns the read-only client of the default catalog,
+// where the API keys of every catalog live, opening it the first time
+func sharedAuthDBClient() (utils.DBClient, error) {
+	authDBMu.Lock()
+	defer authDBMu.Unlock()
+
+	if authDB != nil {
+		return authDB, nil
+	}
+	db, err := utils.NewReadOnlyDBClient()
+	if err != nil {
+		return nil, err
+	}
+	authDB = db
+	return db, nil
+}
+
+// closeAuthDBClient closes the client API keys are looked up with, once
+// the server no longer takes requests
+func closeAuthDBClient() {
+	authDBMu.Lock()
+	defer authDBMu.Unlock()
+
+	if authDB != nil {
+		authDB.Close()
+		authDB = nil
+	}
+}
+
+// keyCatalog returns the catalog a request made with key that asks for the
+// requested catalog works in. Keys bound to a catalog can't use another.
+func keyCatalog(key *utils.APIKey, requested string) (string, error) {
+	if key == nil || key.Catalog == "" {
+		return requested, nil
+	}
+	if requested != "" && requested != key.Catalog {
+		return "", fmt.Errorf("API key can't use catalog %q", requested)
+	}
+	return key.Catalog, nil
+}
+
+// checkWriteAccess returns errAPIKeyRequired when ctx has no API key and
+// one is needed to change songs
+func checkWriteAccess(ctx context.Context) error {
+	if requireAPIKey && apiKeyFromContext(ctx) == nil {
+		return errAPIKeyRequired
+	}
+	return nil
+}
+
+// adminKeyIDs returns the IDs of the API keys that may use the admin
+// endpoints, set with ADMIN_API_KEYS as a comma-separated list
+func adminKeyIDs() []string {
+	var ids []string
+	for _, id := range strings.Split(utils.GetEnv("ADMIN_API_KEYS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkAdminAccess returns errAPIKeyRequired when ctx has no API key, and
+// errNotAdminKey when its key isn't one of ADMIN_API_KEYS
+func checkAdminAccess(ctx context.Context) error {
+	ids := adminKeyIDs()
+	if len(ids) == 0 {
+		return errAdminDisabled
+	}
+	key := apiKeyFromContext(ctx)
+	if key == nil {
+		return errAPIKeyRequired
+	}
+	if !slices.Contains(ids, key.ID) {
+		return errNotAdminKey
+	}
+	return nil
+}
+
+// withClientID returns a copy of ctx whose recognitions are recorded in the
+// history of the client that sent requested, or of the API key in ctx when
+// the client sent no ID
+func withClientID(ctx context.Context, requested string) (context.Context, error) {
+	if !utils.ValidClientID(requested) {
+		return nil, errInvalidClientID
+	}
+	if requested == "" {
+		if key := apiKeyFromContext(ctx); key != nil {
+			requested = key.ID
+		}
+	}
+	return utils.WithClientID(ctx, requested), nil
+}
+
+// rateLimiter keeps a token bucket per client, refilled continuously
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// swept is when idle buckets were last dropped
+	swept time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	// maxIdleBuckets is the number of buckets past which the ones left idle
+	// long enough to be full again are dropped
+	maxIdleBuckets = 10000
+	// bucketSweepInterval is how often idle buckets are dropped at most, so
+	// that clients rotating keys or addresses don't make every request
+	// scan the buckets
+	bucketSweepInterval = time.Minute
+)
+
+// recognitionLimiter limits the recognitions made with each API key, and
+// by each anonymous client address
+var recognitionLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the bucket of client, which holds up to
+// perMinute tokens. When it is empty, allow returns false and the time
+// until the next token.
+func (l *rateLimiter) allow(client string, perMinute int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > maxIdleBuckets && now.Sub(l.swept) >= bucketSweepInterval {
+		l.swept = now
+		for id, bucket := range l.buckets {
+			if now.Sub(bucket.last) > time.Minute {
+				delete(l.buckets, id)
+			}
+		}
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(perMinute), last: now}
+		l.buckets[client] = bucket
+	}
+
+	rate := float64(perMinute) / time.Minute.Seconds()
+	bucket.tokens = math.Min(float64(perMinute), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// allowRecognition applies the recognition rate limit of the API key in
+// ctx, or of clientAddr when there is none
+func allowRecognition(ctx context.Context, clientAddr string) (bool, time.Duration) {
+	if key := apiKeyFromContext(ctx); key != nil {
+		limit := key.RateLimit
+		if limit == 0 {
+			limit = int(defaultKeyRateLimit.Load())
+		}
+		if limit == 0 {
+			return true, 0
+		}
+		return recognitionLimiter.allow("key:"+key.ID, limit)
+	}
+
+	limit := int(anonymousRateLimit.Load())
+	if limit == 0 {
+		return true, 0
+	}
+	return recognitionLimiter.allow("addr:"+clientAddr, limit)
+}
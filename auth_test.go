@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("client", 3); !ok {
+			t.Fatalf("request %d was limited, want 3 allowed", i+1)
+		}
+	}
+	ok, wait := limiter.allow("client", 3)
+	if ok {
+		t.Fatal("4th request was allowed, want it limited")
+	}
+	if wait <= 0 || wait > 20*time.Second {
+		t.Errorf("got a wait of %v, want up to the 20s a token takes", wait)
+	}
+	if ok, _ := limiter.allow("other", 3); !ok {
+		t.Error("another client was limited")
+	}
+}
+
+func TestRateLimiterSweepsIdleBucketsAtMostOncePerInterval(t *testing.T) {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	addIdle := func() {
+		idle := time.Now().Add(-2 * time.Minute)
+		for i := 0; i <= maxIdleBuckets; i++ {
+			limiter.buckets[fmt.Sprintf("idle:%d", i)] = &tokenBucket{last: idle}
+		}
+	}
+
+	addIdle()
+	limiter.allow("client", 10)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("got %d buckets after the first sweep, want 1", len(limiter.buckets))
+	}
+
+	// Within the interval, idle buckets are kept
+	addIdle()
+	limiter.allow("client", 10)
+	if len(limiter.buckets) != maxIdleBuckets+2 {
+		t.Fatalf("got %d buckets, want the %d idle ones kept until the next sweep", len(limiter.buckets), maxIdleBuckets+2)
+	}
+
+	limiter.swept = time.Now().Add(-bucketSweepInterval)
+	limiter.allow("client", 10)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("got %d buckets after the interval, want 1", len(limiter.buckets))
+	}
+}
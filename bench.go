@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"song-recognition/degrade"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchTruthFile is the ground truth bench reads in the directory of the
+// clips unless told otherwise
+const benchTruthFile = "truth.csv"
+
+// benchClip is a query clip of a benchmark and the song it was recorded
+// from
+type benchClip struct {
+	// Path is the path of the clip, relative to the benchmark directory
+	Path string `json:"file"`
+	// SongID is the song the clip was recorded from, 0 for a clip of a song
+	// missing from the catalog, which should match nothing
+	SongID uint32 `json:"songId"`
+	// Condition groups the clips in the report, such as "noise" or "clipped"
+	Condition string `json:"condition,omitempty"`
+}
+
+// benchClipResult is how a clip of a benchmark was recognized
+type benchClipResult struct {
+	benchClip
+	// FoundID is the song of the top match, 0 if nothing matched
+	FoundID          uint32  `json:"foundId"`
+	Confidence       float64 `json:"confidence,omitempty"`
+	SearchDurationMs float64 `json:"searchDurationMs"`
+	TimedOut         bool    `json:"timedOut,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// benchScores are the quality measures of a set of recognized clips
+type benchScores struct {
+	Clips int `json:"clips"`
+	// Positives are the clips of songs of the catalog, Answers the clips
+	// that matched a song and Correct those that matched the right one
+	Positives int `json:"positives"`
+	Answers   int `json:"answers"`
+	Correct   int `json:"correct"`
+	TimedOut  int `json:"timedOut"`
+	// Precision is Correct over Answers, and Recall Correct over Positives
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	MeanMs    float64 `json:"meanLatencyMs"`
+	P50Ms     float64 `json:"p50LatencyMs"`
+	P95Ms     float64 `json:"p95LatencyMs"`
+	MaxMs     float64 `json:"maxLatencyMs"`
+}
+
+// benchConfusion is a kind of mistake and how often it was made
+type benchConfusion struct {
+	ExpectedID uint32 `json:"expectedId"`
+	FoundID    uint32 `json:"foundId"`
+	Count      int    `json:"count"`
+}
+
+// benchReport is the result of a benchmark, as `bench -json` prints it
+type benchReport struct {
+	benchScores
+	// Errors are the clips that couldn't be recognized, left out of the
+	// scores
+	Errors        int                    `json:"errors"`
+	Conditions    map[string]benchScores `json:"conditions,omitempty"`
+	Confusions    []benchConfusion       `json:"confusions"`
+	Results       []benchClipResult      `json:"results"`
+	MinConfidence float64                `json:"minConfidence"`
+}
+
+// bench recognizes the labeled clips of dir listed in truthPath, or in
+// truth.csv in dir, against catalog, and reports how well they were
+// recognized: the precision and recall of the top matches with at least
+// minConfidence, the latency of the searches, and the confusions most
+// frequent mistakes. Recognitions are dry runs, left out of the history
+// and never served from the result cache.
+func bench(dir, truthPath, catalog string, minConfidence float64, confusions int, asJSON bool) {
+	if truthPath == "" {
+		truthPath = filepath.Join(dir, benchTruthFile)
+	}
+	clips, err := readBenchTruth(truthPath)
+	if err != nil {
+		fmt.Printf("Error reading the ground truth: %v\n", err)
+		os.Exit(1)
+	}
+	if len(clips) == 0 {
+		fmt.Printf("No clips listed in %s\n", truthPath)
+		os.Exit(1)
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	songs := map[uint32]utils.Song{}
+	for _, clip := range clips {
+		if clip.SongID == 0 || songs[clip.SongID].ID != 0 {
+			continue
+		}
+		song, exists, err := db.GetSongByID(ctx, clip.SongID)
+		if err != nil {
+			fmt.Printf("Error looking up song %d: %v\n", clip.SongID, err)
+			os.Exit(1)
+		}
+		if !exists {
+			fmt.Printf("Song %d of %s isn't in the catalog\n", clip.SongID, clip.Path)
+			os.Exit(1)
+		}
+		songs[clip.SongID] = song
+	}
+
+	report := benchReport{Conditions: map[string]benchScores{}, MinConfidence: minConfidence}
+	for i, clip := range clips {
+		if !asJSON {
+			fmt.Printf("\rRecognizing clip %d of %d", i+1, len(clips))
+		}
+		result := benchRecognize(utils.WithCatalog(ctx, catalog), dir, clip, minConfidence)
+		report.Results = append(report.Results, result)
+	}
+	if !asJSON {
+		fmt.Print("\r\033[K")
+	}
+
+	byCondition := map[string][]benchClipResult{}
+	mistakes := map[benchConfusion]int{}
+	var scored []benchClipResult
+	for _, result := range report.Results {
+		if result.Error != "" {
+			report.Errors++
+			continue
+		}
+		scored = append(scored, result)
+		byCondition[result.Condition] = append(byCondition[result.Condition], result)
+		if result.FoundID != result.SongID {
+			mistakes[benchConfusion{ExpectedID: result.SongID, FoundID: result.FoundID}]++
+		}
+	}
+	report.benchScores = scoreBench(scored)
+	for condition, results := range byCondition {
+		if condition != "" {
+			report.Conditions[condition] = scoreBench(results)
+		}
+	}
+
+	report.Confusions = []benchConfusion{}
+	for confusion, count := range mistakes {
+		confusion.Count = count
+		report.Confusions = append(report.Confusions, confusion)
+	}
+	sort.Slice(report.Confusions, func(i, j int) bool {
+		a, b := report.Confusions[i], report.Confusions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.ExpectedID != b.ExpectedID {
+			return a.ExpectedID < b.ExpectedID
+		}
+		return a.FoundID < b.FoundID
+	})
+	if len(report.Confusions) > confusions {
+		report.Confusions = report.Confusions[:confusions]
+	}
+
+	if asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	printBenchReport(ctx, db, report, songs)
+}
+
+// benchRecognize recognizes clip, a file of dir, and returns the song of
+// its top match with at least minConfidence
+func benchRecognize(ctx context.Context, dir string, clip benchClip, minConfidence float64) benchClipResult {
+	result := benchClipResult{benchClip: clip}
+
+	audio, err := wav.DecodeFile(filepath.Join(dir, clip.Path))
+	if err != nil {
+		result.Error = fmt.Sprintf("error decoding audio: %v", err)
+		return result
+	}
+
+	matches, searchDuration, err := shazam.FindMatches(shazam.WithoutHistory(ctx), audio.Samples, audio.Duration, audio.SampleRate)
+	result.SearchDurationMs = float64(searchDuration.Microseconds()) / 1000
+	if errors.Is(err, shazam.ErrTimedOut) {
+		result.TimedOut = true
+	} else if err != nil {
+		result.Error = fmt.Sprintf("error finding matches: %v", err)
+		return result
+	}
+
+	if len(matches) > 0 && matches[0].Confidence >= minConfidence {
+		result.FoundID = matches[0].SongID
+		result.Confidence = matches[0].Confidence
+	}
+	return result
+}
+
+// scoreBench scores the recognition of results
+func scoreBench(results []benchClipResult) benchScores {
+	scores := benchScores{Clips: len(results)}
+	latencies := make([]float64, 0, len(results))
+	for _, result := range results {
+		if result.SongID != 0 {
+			scores.Positives++
+		}
+		if result.FoundID != 0 {
+			scores.Answers++
+			if result.FoundID == result.SongID {
+				scores.Correct++
+			}
+		}
+		if result.TimedOut {
+			scores.TimedOut++
+		}
+		latencies = append(latencies, result.SearchDurationMs)
+		scores.MeanMs += result.SearchDurationMs
+	}
+
+	if scores.Answers > 0 {
+		scores.Precision = float64(scores.Correct) / float64(scores.Answers)
+	}
+	if scores.Positives > 0 {
+		scores.Recall = float64(scores.Correct) / float64(scores.Positives)
+	}
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		scores.MeanMs /= float64(len(latencies))
+		scores.P50Ms = latencies[(len(latencies)-1)*50/100]
+		scores.P95Ms = latencies[(len(latencies)-1)*95/100]
+		scores.MaxMs = latencies[len(latencies)-1]
+	}
+	return scores
+}
+
+// printBenchReport prints report, naming the songs of the confusions
+func printBenchReport(ctx context.Context, db utils.DBClient, report benchReport, songs map[uint32]utils.Song) {
+	fmt.Printf("Clips:     %d (%d of songs of the catalog, %d of other songs)\n",
+		report.Clips, report.Positives, report.Clips-report.Positives)
+	if report.Errors > 0 {
+		yellow.Printf("Errors:    %d clips couldn't be recognized and are left out\n", report.Errors)
+		for _, result := range report.Results {
+			if result.Error != "" {
+				yellow.Printf("\t%s: %s\n", result.Path, result.Error)
+			}
+		}
+	}
+	fmt.Printf("Precision: %.1f%% (%d of %d answers right)\n", report.Precision*100, report.Correct, report.Answers)
+	fmt.Printf("Recall:    %.1f%% (%d of %d songs found)\n", report.Recall*100, report.Correct, report.Positives)
+	fmt.Printf("Latency:   mean %s, p50 %s, p95 %s, max %s\n",
+		benchMs(report.MeanMs), benchMs(report.P50Ms), benchMs(report.P95Ms), benchMs(report.MaxMs))
+	if report.TimedOut > 0 {
+		yellow.Printf("Timed out: %d clips, scored on their partial matches\n", report.TimedOut)
+	}
+
+	if len(report.Conditions) > 0 {
+		conditions := make([]string, 0, len(report.Conditions))
+		for condition := range report.Conditions {
+			conditions = append(conditions, condition)
+		}
+		sort.Strings(conditions)
+
+		fmt.Println("\nBy condition:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tCONDITION\tCLIPS\tPRECISION\tRECALL\tMEAN LATENCY")
+		for _, condition := range conditions {
+			scores := report.Conditions[condition]
+			fmt.Fprintf(w, "\t%s\t%d\t%.1f%%\t%.1f%%\t%s\n",
+				condition, scores.Clips, scores.Precision*100, scores.Recall*100, benchMs(scores.MeanMs))
+		}
+		w.Flush()
+	}
+
+	if len(report.Confusions) > 0 {
+		fmt.Println("\nMost frequent mistakes:")
+		describe := func(songID uint32) string {
+			if songID == 0 {
+				return "nothing"
+			}
+			song, ok := songs[songID]
+			if !ok {
+				song, ok, _ = db.GetSongByID(ctx, songID)
+				songs[songID] = song
+			}
+			if !ok || song.ID == 0 {
+				return fmt.Sprintf("song %d", songID)
+			}
+			return fmt.Sprintf("%s by %s (%d)", song.Title, song.Artist, songID)
+		}
+		for _, confusion := range report.Confusions {
+			fmt.Printf("\t%d× %s, found %s\n", confusion.Count, describe(confusion.ExpectedID), describe(confusion.FoundID))
+		}
+	}
+}
+
+// benchMs formats a latency in milliseconds
+func benchMs(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(100 * time.Microsecond).String()
+}
+
+// readBenchTruth reads the ground truth of a benchmark: a CSV file with a
+// line per clip giving its path relative to the benchmark directory, the ID
+// of the song it was recorded from, empty or 0 for a song missing from the
+// catalog, and optionally the condition it was recorded in. Further columns,
+// like the details the degrade command writes, are ignored. A first line
+// starting with "file" is a header, and lines starting with # are comments.
+func readBenchTruth(truthPath string) ([]benchClip, error) {
+	file, err := os.Open(truthPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var clips []benchClip
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return clips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if first && strings.EqualFold(record[0], "file") {
+			continue
+		}
+		if len(record) < 2 || record[0] == "" {
+			return nil, fmt.Errorf("line %d: want a file, a song ID and optionally a condition", line)
+		}
+
+		clip := benchClip{Path: record[0]}
+		if id := strings.TrimSpace(record[1]); id != "" {
+			songID, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid song ID %q", line, id)
+			}
+			clip.SongID = uint32(songID)
+		}
+		if len(record) >= 3 {
+			clip.Condition = strings.TrimSpace(record[2])
+		}
+		clips = append(clips, clip)
+	}
+}
+
+// degradeSongs writes benchmark clips of the songs of catalog to dir: perSong
+// clips of length seconds per song and condition, cut from random positions
+// and degraded as recorded in that condition, from the first maxSongs songs
+// or all of them if 0. Clips are written to a directory per condition,
+// along with the truth.csv bench reads, which also describes every clip.
+// The same seed makes the same clips of the same songs.
+func degradeSongs(dir, catalog string, conditions []string, perSong, maxSongs int, length float64, seed int64) {
+	db, err := utils.NewReadOnlyCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Printf("Error creating %s: %v\n", dir, err)
+		os.Exit(1)
+	}
+	truthFile, err := os.Create(filepath.Join(dir, benchTruthFile))
+	if err != nil {
+		fmt.Printf("Error creating the ground truth: %v\n", err)
+		os.Exit(1)
+	}
+	defer truthFile.Close()
+	truth := csv.NewWriter(truthFile)
+	truth.Write([]string{"file", "song_id", "condition", "details"})
+
+	ctx := utils.WithCatalog(context.Background(), catalog)
+	r := rand.New(rand.NewSource(seed))
+	songs, clips := 0, 0
+	const pageSize = 100
+	for offset := 0; maxSongs == 0 || songs < maxSongs; offset += pageSize {
+		page, err := db.ListSongs(ctx, offset, pageSize, utils.SortByID)
+		if err != nil {
+			fmt.Printf("Error listing songs: %v\n", err)
+			os.Exit(1)
+		}
+		for _, song := range page {
+			if maxSongs != 0 && songs == maxSongs {
+				break
+			}
+			written, err := degradeSong(ctx, dir, song, conditions, perSong, length, r, truth)
+			clips += written
+			if err != nil {
+				yellow.Printf("Failed to degrade '%s' by '%s' (%d): %v\n", song.Title, song.Artist, song.ID, err)
+				continue
+			}
+			fmt.Printf("Degraded '%s' by '%s'\n", song.Title, song.Artist)
+			songs++
+		}
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	truth.Flush()
+	if err := truth.Error(); err != nil {
+		fmt.Printf("Error writing the ground truth: %v\n", err)
+		os.Exit(1)
+	}
+	if clips == 0 {
+		fmt.Println("No clips written: the catalog has no songs whose audio could be read")
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d clips of %d songs to %s, run `bench %s` to score them\n", clips, songs, dir, dir)
+}
+
+// degradeSong writes the clips of song and lists them in truth, and returns
+// the number written
+func degradeSong(ctx context.Context, dir string, song utils.Song, conditions []string, perSong int, length float64, r *rand.Rand, truth *csv.Writer) (int, error) {
+	filePath, cleanup, err := spotify.SongAudio(ctx, SONGS_DIR, song)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	audio, err := wav.DecodeFileContext(ctx, filePath)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding audio: %v", err)
+	}
+
+	written := 0
+	for _, condition := range conditions {
+		if err := os.MkdirAll(filepath.Join(dir, condition), 0o755); err != nil {
+			return written, err
+		}
+		for i := 1; i <= perSong; i++ {
+			clip, details, err := degrade.Query(audio.Samples, audio.SampleRate, length, condition, r)
+			if err != nil {
+				return written, err
+			}
+			path := filepath.Join(condition, fmt.Sprintf("%d-%d.wav", song.ID, i))
+			if err := wav.WriteMonoWavFile(filepath.Join(dir, path), clip, audio.SampleRate); err != nil {
+				return written, fmt.Errorf("error writing %s: %v", path, err)
+			}
+			truth.Write([]string{filepath.ToSlash(path), strconv.FormatUint(uint64(song.ID), 10), condition, details})
+			written++
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// Chat bots recognize the audio files their users send, which they
+// download from the chat service
+var (
+	errRecordingTooLarge = fmt.Errorf("recording is larger than %d MB", maxRecordingSize>>20)
+	errUnsupportedAudio  = errors.New("unsupported audio file")
+)
+
+// recognizeRemoteFile downloads the audio file at fileURL, of up to
+// maxRecordingSize bytes, and returns its best matches. fileName only
+// hints at the format of the file. A recognition that times out returns
+// the matches found by then, or ErrTimedOut if there are none.
+func recognizeRemoteFile(ctx context.Context, client *http.Client, fileURL, fileName string) ([]shazam.Match, error) {
+	filePath, err := downloadRecording(ctx, client, fileURL, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.DeleteFile(filePath)
+
+	release, err := recognitionSlots.admit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The recognition times out counting the decoding in
+	ctx, cancel := shazam.WithTimeout(ctx)
+	defer cancel()
+
+	audio, err := wav.DecodeFileContext(ctx, filePath)
+	if errors.Is(context.Cause(ctx), shazam.ErrTimedOut) {
+		return nil, shazam.ErrTimedOut
+	}
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "failed to decode recording.", slog.Any("error", xerrors.New(err)))
+		return nil, errUnsupportedAudio
+	}
+
+	matches, _, err := findMatches(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+	if err != nil && (!errors.Is(err, shazam.ErrTimedOut) || len(matches) == 0) {
+		return nil, err
+	}
+	return shazam.TopMatches(matches, maxAPIMatchResults, 0), nil
+}
+
+// downloadRecording downloads the file at fileURL to the tmp directory and
+// returns its path
+func downloadRecording(ctx context.Context, client *http.Client, fileURL, fileName string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading recording: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading recording: unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > maxRecordingSize {
+		return "", errRecordingTooLarge
+	}
+
+	filePath := filepath.Join("tmp", fmt.Sprintf("%d_%s", utils.GenerateUniqueID(), filepath.Base(fileName)))
+	out, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(resp.Body, maxRecordingSize+1))
+	if err == nil && n > maxRecordingSize {
+		err = errRecordingTooLarge
+	}
+	if err != nil {
+		utils.DeleteFile(filePath)
+		return "", err
+	}
+	return filePath, nil
+}
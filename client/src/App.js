@@ -16,6 +16,72 @@ const server = process.env.REACT_APP_BACKEND_URL || "http://localhost:5000";
 
 var socket = io(server);
 
+// Recordings are uploaded in chunks of this many bytes, each one sent once
+// the server acknowledged the previous one
+const UPLOAD_CHUNK_SIZE = 256 * 1024;
+
+function toBase64(bytes) {
+  var binary = "";
+  for (var i = 0; i < bytes.byteLength; i++) {
+    binary += String.fromCharCode(bytes[i]);
+  }
+  return btoa(binary);
+}
+
+// waitForUploadAck resolves with the next acknowledgement of the upload,
+// and rejects if the server reports it failed
+function waitForUploadAck(uploadId) {
+  return new Promise((resolve, reject) => {
+    const done = () => {
+      socket.off("uploadAck", onAck);
+      socket.off("uploadError", onError);
+    };
+    const onAck = (ack) => {
+      ack = JSON.parse(ack);
+      if (ack.uploadId === uploadId) {
+        done();
+        resolve(ack);
+      }
+    };
+    const onError = (error) => {
+      error = JSON.parse(error);
+      if (error.uploadId === uploadId) {
+        done();
+        reject(new Error(error.error));
+      }
+    };
+    socket.on("uploadAck", onAck);
+    socket.on("uploadError", onError);
+  });
+}
+
+// uploadRecording sends a recording to be matched with the chunked upload
+// protocol, which unlike a single "newRecording" message works for long
+// recordings and slow connections. The matches arrive as a "matches" event.
+async function uploadRecording(bytes, config) {
+  const uploadId = `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+
+  let ack = waitForUploadAck(uploadId);
+  socket.emit(
+    "uploadBegin",
+    JSON.stringify({ uploadId, size: bytes.byteLength, ...config })
+  );
+  await ack;
+
+  for (let seq = 0; seq * UPLOAD_CHUNK_SIZE < bytes.byteLength; seq++) {
+    const start = seq * UPLOAD_CHUNK_SIZE;
+    const chunk = bytes.subarray(start, start + UPLOAD_CHUNK_SIZE);
+    ack = waitForUploadAck(uploadId);
+    socket.emit(
+      "uploadChunk",
+      JSON.stringify({ uploadId, seq, data: toBase64(chunk) })
+    );
+    await ack;
+  }
+
+  socket.emit("uploadEnd", JSON.stringify({ uploadId }));
+}
+
 function App() {
   const [stream, setStream] = useState();
   const [matches, setMatches] = useState([]);
@@ -63,6 +129,35 @@ function App() {
       }
     });
 
+    socket.on("trackStatus", (status) => {
+      status = JSON.parse(status);
+      const song = `'${status.title}' by '${status.artist}'`;
+      if (status.stage === "done") {
+        toast.success(() => <div>{song} was downloaded</div>);
+      } else if (status.stage === "failed") {
+        toast.error(() => <div>{song} failed: {status.message}</div>);
+      } else if (status.stage === "skipped") {
+        const existing = status.existingSong;
+        const existingSong =
+          existing &&
+          (existing.Title !== status.title || existing.Artist !== status.artist)
+            ? ` as '${existing.Title}' by '${existing.Artist}'`
+            : "";
+        toast.info(() => (
+          <div>
+            {song} {status.message}
+            {existingSong}
+          </div>
+        ));
+      }
+    });
+
+    socket.on("uploadError", (error) => {
+      error = JSON.parse(error);
+      toast.error(() => <div>Recording upload failed: {error.error}</div>);
+      cleanUp();
+    });
+
     socket.on("totalSongs", (songsCount) => {
       setTotalSongs(songsCount);
     });
@@ -177,19 +272,9 @@ function App() {
           );
           const recordDuration = audioBufferDecoded.duration;
 
-          var binary = "";
-          var bytes = new Uint8Array(arrayBuffer);
-          var len = bytes.byteLength;
-          for (var i = 0; i < len; i++) {
-            binary += String.fromCharCode(bytes[i]);
-          }
-
-          // Convert byte array to base64
-          const rawAudio = btoa(binary);
           const audioConfig = audioStream.getAudioTracks()[0].getSettings();
 
-          const recordData = {
-            audio: rawAudio,
+          const recordConfig = {
             duration: recordDuration,
             channels: audioConfig.channelCount,
             sampleRate: audioConfig.sampleRate,
@@ -197,7 +282,12 @@ function App() {
           };
 
           if (sendRecordingRef.current) {
-            socket.emit("newRecording", JSON.stringify(recordData));
+            try {
+              await uploadRecording(new Uint8Array(arrayBuffer), recordConfig);
+            } catch (error) {
+              console.error("upload failed:", error);
+              cleanUp();
+            }
           }
         };
       });
@@ -3,19 +3,31 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"image/png"
+	"io/fs"
 	"log/slog"
 	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"song-recognition/metrics"
 	"song-recognition/shazam"
 	"song-recognition/spotify"
+	"song-recognition/storagetest"
 	"song-recognition/utils"
 	"song-recognition/wav"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
 
 	"github.com/fatih/color"
 	socketio "github.com/googollee/go-socket.io"
@@ -24,59 +36,268 @@ import (
 	"github.com/googollee/go-socket.io/engineio/transport/polling"
 	"github.com/googollee/go-socket.io/engineio/transport/websocket"
 	"github.com/mdobak/go-xerrors"
+	"google.golang.org/grpc"
 )
 
-const (
-	SONGS_DIR = "songs"
-)
+// SONGS_DIR is where downloaded songs are saved. Set with SONGS_DIR.
+var SONGS_DIR = utils.GetEnv("SONGS_DIR", "songs")
 
 var yellow = color.New(color.FgYellow)
 
-func find(filePath string) {
-	wavInfo, err := wav.ReadWavInfo(filePath)
-	if err != nil {
-		yellow.Println("Error reading wave info:", err)
-		return
+// recognitionResult is the JSON line `recognize -json` prints for a file
+type recognitionResult struct {
+	File             string         `json:"file"`
+	Matches          []shazam.Match `json:"matches"`
+	SearchDurationMs int64          `json:"searchDurationMs"`
+	// Diagnostics are set by `recognize -diagnostics`
+	Diagnostics *shazam.Diagnostics `json:"diagnostics,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	// TimedOut is set, along with Error, when the search timed out, and
+	// Matches are only those found by then
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+// recognize finds the songs each of filePaths was recorded from and prints
+// their top matches, as one JSON line per file if asJSON is set, along with
+// diagnostics of the searches as a dry run if diagnose is set. It exits
+// with status 1 once every file is done if any of them failed.
+func recognize(filePaths []string, top int, asJSON, diagnose bool) {
+	failed := false
+	encoder := json.NewEncoder(os.Stdout)
+	for i, filePath := range filePaths {
+		if asJSON {
+			result := recognizeFile(filePath, top, diagnose)
+			if err := encoder.Encode(result); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing result: %v\n", err)
+				os.Exit(1)
+			}
+			failed = failed || result.Error != ""
+			continue
+		}
+
+		if len(filePaths) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", filePath)
+		}
+		if !find(filePath, top, diagnose) {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
 	}
+}
+
+// recognizeFile returns the top matches of the audio file at filePath
+func recognizeFile(filePath string, top int, diagnose bool) recognitionResult {
+	result := recognitionResult{File: filePath, Matches: []shazam.Match{}}
 
-	samples, err := wav.WavBytesToSamples(wavInfo.Data)
+	audio, err := wav.DecodeFile(filePath)
 	if err != nil {
-		yellow.Println("Error converting to samples:", err)
-		return
+		result.Error = fmt.Sprintf("error decoding audio: %v", err)
+		return result
 	}
 
-	matches, searchDuration, err := shazam.FindMatches(samples, wavInfo.Duration, wavInfo.SampleRate)
+	matches, diagnostics, searchDuration, err := searchAudio(audio, diagnose)
+	result.SearchDurationMs = searchDuration.Milliseconds()
+	result.Diagnostics = diagnostics
+	if errors.Is(err, shazam.ErrTimedOut) {
+		result.Error = "recognition timed out, the matches are partial"
+		result.TimedOut = true
+	} else if err != nil {
+		result.Error = fmt.Sprintf("error finding matches: %v", err)
+		return result
+	}
+
+	result.Matches = shazam.TopMatches(matches, top, 0)
+	return result
+}
+
+// searchAudio finds the matches of audio, as a dry run that also returns
+// diagnostics of the search if diagnose is set
+func searchAudio(audio *wav.Audio, diagnose bool) ([]shazam.Match, *shazam.Diagnostics, time.Duration, error) {
+	ctx := utils.NewOperationContext()
+	if !diagnose {
+		matches, searchDuration, err := findMatches(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+		return matches, nil, searchDuration, err
+	}
+
+	startTime := time.Now()
+	matches, diagnostics, err := shazam.Diagnose(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+	if err != nil && !errors.Is(err, shazam.ErrTimedOut) {
+		return nil, nil, time.Since(startTime), err
+	}
+	return matches, &diagnostics, time.Since(startTime), err
+}
+
+// find prints the top matches of the audio file at filePath, and the
+// diagnostics of the search if diagnose is set, and reports whether it
+// could be searched for in time
+func find(filePath string, top int, diagnose bool) bool {
+	audio, err := wav.DecodeFile(filePath)
 	if err != nil {
+		yellow.Println("Error decoding audio:", err)
+		return false
+	}
+
+	matches, diagnostics, searchDuration, err := searchAudio(audio, diagnose)
+	timedOut := errors.Is(err, shazam.ErrTimedOut)
+	if err != nil && !timedOut {
 		yellow.Println("Error finding matches:", err)
-		return
+		return false
+	}
+	if timedOut {
+		yellow.Println("Recognition timed out, the matches are partial.")
+	}
+	if diagnostics != nil {
+		printDiagnostics(*diagnostics)
 	}
 
 	if len(matches) == 0 {
 		fmt.Println("\nNo match found.")
 		fmt.Printf("\nSearch took: %s\n", searchDuration)
-		return
+		return !timedOut
 	}
 
 	msg := "Matches:"
 	topMatches := matches
-	if len(matches) >= 20 {
-		msg = "Top 20 matches:"
-		topMatches = matches[:20]
+	if len(matches) > top {
+		msg = fmt.Sprintf("Top %d matches:", top)
+		topMatches = shazam.TopMatches(matches, top, 0)
 	}
 
 	fmt.Println(msg)
 	for _, match := range topMatches {
-		fmt.Printf("\t- %s by %s, score: %.2f\n",
-			match.SongTitle, match.SongArtist, match.Score)
+		if match.Service != "" {
+			fmt.Printf("\t- %s by %s, confidence: %.1f%%, found by %s\n",
+				match.SongTitle, match.SongArtist, match.Confidence*100, match.Service)
+			continue
+		}
+		fmt.Printf("\t- %s by %s, score: %.2f, confidence: %.1f%%, at %s\n",
+			match.SongTitle, match.SongArtist, match.Score, match.Confidence*100, formatOffset(match.OffsetMs))
 	}
 
 	fmt.Printf("\nSearch took: %s\n", searchDuration)
 	topMatch := topMatches[0]
-	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f, matched at %s\n",
+		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score, formatOffset(topMatch.OffsetMs))
+	if topMatch.Speed != 1 {
+		fmt.Printf("The recording plays at %.0f%% of the song's speed\n", topMatch.Speed*100)
+	}
+	return !timedOut
+}
+
+// renderSpectrogram saves the spectrogram of an audio file as a PNG image,
+// with the peaks fingerprints are made of marked if markPeaks is set
+func renderSpectrogram(filePath, outputPath string, markPeaks bool) {
+	audio, err := wav.DecodeFile(filePath)
+	if err != nil {
+		yellow.Println("Error decoding audio:", err)
+		return
+	}
+
+	cfg, err := shazam.ConfigFromEnv()
+	if err != nil {
+		yellow.Println("Invalid fingerprint config:", err)
+		return
+	}
+
+	img, err := shazam.RenderSpectrogram(audio.Samples, audio.SampleRate, audio.Duration, cfg, markPeaks)
+	if err != nil {
+		yellow.Println("Error rendering spectrogram:", err)
+		return
+	}
+
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath)) + ".png"
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		yellow.Println("Error creating image:", err)
+		return
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		yellow.Println("Error writing image:", err)
+		return
+	}
+
+	bounds := img.Bounds()
+	fmt.Printf("Spectrogram saved to %s (%d frames, %d frequency bins)\n", outputPath, bounds.Dx(), bounds.Dy())
+}
+
+// fftBench times the FFT of one window and the spectrogram of seconds of
+// noise, with the FFT backend the binary was built with and the
+// fingerprinting config of the environment. Build with -tags gonum to
+// compare the backends.
+func fftBench(seconds float64) {
+	cfg, err := shazam.ConfigFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	samples := make([]float64, int(seconds*wav.CanonicalSampleRate))
+	for i := range samples {
+		samples[i] = random.Float64()*2 - 1
+	}
+	window := samples[:min(cfg.WindowSize, len(samples))]
+
+	fftResult := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			shazam.FFT(window)
+		}
+	})
+	spectrogramResult := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := shazam.Spectrogram(samples, wav.CanonicalSampleRate, cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	fmt.Printf("Backend:     %s\n", shazam.FFTBackend)
+	fmt.Printf("FFT:         %s %s (%d samples)\n", fftResult, fftResult.MemString(), len(window))
+	fmt.Printf("Spectrogram: %s %s (%g s of audio)\n", spectrogramResult, spectrogramResult.MemString(), seconds)
 }
 
-func download(spotifyURL string) {
+// printDiagnostics prints how a recording was searched for
+func printDiagnostics(d shazam.Diagnostics) {
+	fmt.Println("Diagnostics:")
+	fmt.Printf("\tDuration:     %.1fs (%dms of silence trimmed)\n", d.Duration, d.TrimmedMs)
+	fmt.Printf("\tPeaks:        %d\n", d.Peaks)
+	fmt.Printf("\tFingerprints: %d, %d found in the database (%.1f%%)\n", d.Fingerprints, d.AddressesFound, d.HitRate*100)
+	fmt.Printf("\tCouples:      %d, up to %d per address\n", d.Couples, d.MaxCouples)
+	if len(d.Candidates) > 0 {
+		fmt.Println("\tCandidates:")
+	}
+	for _, candidate := range d.Candidates {
+		fmt.Printf("\t- %s by %s (%d), %d hashes, %d aligned\n",
+			candidate.SongTitle, candidate.SongArtist, candidate.SongID, candidate.Hashes, candidate.Aligned)
+		bins := make([]string, len(candidate.Histogram))
+		for i, bin := range candidate.Histogram {
+			bins[i] = fmt.Sprintf("%dms: %d", bin.OffsetMs, bin.Votes)
+		}
+		fmt.Printf("\t  votes by offset: %s\n", strings.Join(bins, ", "))
+	}
+	fmt.Println()
+}
+
+// formatOffset formats a position in a song as m:ss
+func formatOffset(offsetMs uint32) string {
+	seconds := offsetMs / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func download(songURL string, reindex, retryFailed bool) {
 	err := utils.CreateFolder(SONGS_DIR)
 	if err != nil {
 		err := xerrors.New(err)
@@ -86,30 +307,74 @@ func download(spotifyURL string) {
 		logger.ErrorContext(ctx, logMsg, slog.Any("error", err))
 	}
 
-	if strings.Contains(spotifyURL, "album") {
-		_, err := spotify.DlAlbum(spotifyURL, SONGS_DIR)
-		if err != nil {
-			yellow.Println("Error: ", err)
+	onStatus := func(status spotify.TrackStatus) {
+		name := fmt.Sprintf("'%s' by '%s'", status.Title, status.Artist)
+		if status.Title == "" {
+			name = songURL
+		}
+		switch status.Stage {
+		case spotify.StageSkipped:
+			yellow.Printf("%s was skipped: %s\n", name, status.Message)
+		case spotify.StageFailed:
+			yellow.Printf("%s could not be downloaded: %s\n", name, status.Message)
 		}
 	}
 
-	if strings.Contains(spotifyURL, "playlist") {
-		_, err := spotify.DlPlaylist(spotifyURL, SONGS_DIR)
+	ctx := ingestContext(reindex)
+	if retryFailed {
+		ctx = spotify.WithRetryFailed(ctx)
+	}
+	importAll := spotify.DlArtist
+	if spotify.IsMusicBrainzRelease(songURL) {
+		importAll = spotify.DlAlbum
+	}
+	if spotify.IsArtistURL(songURL) || spotify.IsMusicBrainzRelease(songURL) {
+		summary, err := importAll(ctx, songURL, SONGS_DIR, onStatus)
 		if err != nil {
 			yellow.Println("Error: ", err)
 		}
+		fmt.Printf("Added %d, skipped %d (already indexed), failed %d of %d tracks\n",
+			summary.Added, summary.Skipped, summary.Failed, summary.Tracks)
+		return
 	}
 
-	if strings.Contains(spotifyURL, "track") {
-		_, err := spotify.DlSingleTrack(spotifyURL, SONGS_DIR)
+	_, err = spotify.DlURL(ctx, songURL, SONGS_DIR, onStatus)
+	if err != nil {
+		yellow.Println("Error: ", err)
+	}
+}
+
+// album saves every track of the MusicBrainz release given by the ID or
+// link in args, or looked up by the artist and album title in args
+func album(args []string, reindex, retryFailed bool) {
+	release := args[0]
+	if len(args) > 1 {
+		mbid, err := spotify.FindMusicBrainzRelease(context.Background(), args[0], args[1])
 		if err != nil {
 			yellow.Println("Error: ", err)
+			return
 		}
+		release = mbid
+	}
+	if !strings.Contains(release, "://") {
+		release = spotify.MusicBrainzReleaseURL(release)
 	}
+	download(release, reindex, retryFailed)
 }
 
-func serve(protocol, port string) {
+// serve runs the servers until SIGINT or SIGTERM, and reloads the settings
+// on SIGHUP. With mic, the tracks the server's microphone hears are sent to
+// socket clients. With telegramToken, the server also runs that Telegram
+// bot.
+func serve(protocol, port, grpcPort string, mic bool, telegramToken string) {
+	logger := utils.GetLogger()
 	protocol = strings.ToLower(protocol)
+
+	if err := checkDatabase(); err != nil {
+		logger.Error("failed to start.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+
 	var allowOriginFunc = func(r *http.Request) bool {
 		return true
 	}
@@ -126,67 +391,649 @@ func serve(protocol, port string) {
 	})
 
 	server.OnConnect("/", func(socket socketio.Conn) error {
+		session, err := openSocketSession(socket)
+		if err != nil {
+			return err
+		}
+		socket.Join(socketRoom(session.protocolVersion))
+
 		socket.SetContext("")
-		log.Println("CONNECTED: ", socket.ID())
+		logger.Info("socket connected.", slog.String("socket_id", socket.ID()))
+		metrics.ActiveSockets.Inc()
 
 		return nil
 	})
 
 	server.OnEvent("/", "totalSongs", handleTotalSongs)
 	server.OnEvent("/", "newDownload", handleSongDownload)
+	server.OnEvent("/", "jobSubscribe", handleJobSubscribe)
 	server.OnEvent("/", "newRecording", handleNewRecording)
+	server.OnEvent("/", "streamStart", handleStreamStart)
+	server.OnEvent("/", "streamChunk", handleStreamChunk)
+	server.OnEvent("/", "streamStop", handleStreamStop)
+	server.OnEvent("/", "uploadBegin", handleUploadBegin)
+	server.OnEvent("/", "uploadChunk", handleUploadChunk)
+	server.OnEvent("/", "uploadEnd", handleUploadEnd)
+
+	var listener *micListener
+	if mic {
+		listener = newMicListener(server)
+		server.OnEvent("/", "nowPlaying", listener.handleNowPlaying)
+	}
+	handleMessages(server, listener)
 
 	server.OnError("/", func(s socketio.Conn, e error) {
-		log.Println("meet error:", e)
+		logger.Error("socket error.", slog.String("socket_id", s.ID()), slog.Any("error", xerrors.New(e)))
 	})
 
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
-		log.Println("closed", reason)
+		logger.Info("socket disconnected.", slog.String("socket_id", s.ID()), slog.String("reason", reason))
+		closeSocketSession(s)
+		metrics.ActiveSockets.Dec()
 	})
 
+	// The first SIGINT or SIGTERM shuts the server down gracefully, a
+	// second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	go func() {
 		if err := server.Serve(); err != nil {
-			log.Fatalf("socketio listen error: %s\n", err)
+			logger.Error("socket.io server stopped.", slog.Any("error", xerrors.New(err)))
+			os.Exit(1)
 		}
 	}()
-	defer server.Close()
+
+	if listener != nil {
+		go listener.run(ctx)
+	}
+
+	// SIGHUP reloads the settings that can change at runtime from the
+	// config file
+	go reloadOnSIGHUP(ctx)
+
+	waitMonitors, err := startMonitors(ctx)
+	if err != nil {
+		logger.Error("failed to monitor radio streams.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+
+	stopWebhooks, err := startWebhooks()
+	if err != nil {
+		logger.Error("failed to start webhooks.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+
+	waitTelegram, err := startTelegramBot(ctx, telegramToken)
+	if err != nil {
+		logger.Error("failed to start Telegram bot.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+
+	var grpcServer *grpc.Server
+	if grpcPort != "" {
+		grpcServer = newGRPCServer()
+		go serveGRPC(grpcServer, grpcPort)
+	}
+
+	if err := registerDiscordBot(http.DefaultServeMux); err != nil {
+		logger.Error("failed to start Discord bot.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
 
 	serveHTTPS := protocol == "https"
+	httpServer := newHTTPServer(server, port)
+	go func() {
+		if err := serveHTTP(httpServer, serveHTTPS); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server stopped.", slog.Any("error", xerrors.New(err)))
+			os.Exit(1)
+		}
+	}()
 
-	serveHTTP(server, serveHTTPS, port)
+	<-ctx.Done()
+	stop()
+	// The tracks the stations were playing are logged before the database
+	// connections close
+	waitMonitors()
+	waitTelegram()
+	shutdown(httpServer, grpcServer, server)
+	// Webhooks of the last jobs are posted once they finish
+	stopWebhooks()
 }
 
-func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port string) {
+// newHTTPServer returns the server for the socket.io, API, health and
+// metrics endpoints on port
+func newHTTPServer(socketServer *socketio.Server, port string) *http.Server {
 	http.Handle("/socket.io/", socketServer)
+	registerAPIHandlers(http.DefaultServeMux)
+	registerHealthHandlers(http.DefaultServeMux)
+	http.Handle("/metrics", metrics.Handler())
 
-	if serveHTTPS {
-		httpsAddr := ":" + port
-		httpsServer := &http.Server{
-			Addr: httpsAddr,
-			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			},
-			Handler: socketServer,
-		}
+	server := &http.Server{
+		Addr: ":" + port,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	server.RegisterOnShutdown(closeEventStreams)
+	return server
+}
 
+// serveHTTP serves HTTP or HTTPS on server until it is shut down
+func serveHTTP(server *http.Server, serveHTTPS bool) error {
+	logger := utils.GetLogger()
+
+	if serveHTTPS {
 		cert_key_default := "/etc/letsencrypt/live/localport.online/privkey.pem"
 		cert_file_default := "/etc/letsencrypt/live/localport.online/fullchain.pem"
 
 		cert_key := utils.GetEnv("CERT_KEY", cert_key_default)
 		cert_file := utils.GetEnv("CERT_FILE", cert_file_default)
 		if cert_key == "" || cert_file == "" {
-			log.Fatal("Missing cert")
+			return errors.New("missing cert")
+		}
+
+		logger.Info("starting HTTPS server.", slog.String("addr", server.Addr))
+		return server.ListenAndServeTLS(cert_file, cert_key)
+	}
+
+	logger.Info("starting HTTP server.", slog.String("addr", server.Addr))
+	return server.ListenAndServe()
+}
+
+// exportDB writes the songs and fingerprints in the database to filePath
+func exportDB(filePath string) {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := utils.DumpStorage(ctx, db, filePath); err != nil {
+		fmt.Printf("Failed to export database: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Database exported to %s\n", filePath)
+}
+
+// exportChromaprints writes the Chromaprint fingerprint of every song to
+// filePath, as JSON lines
+func exportChromaprints(filePath string) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		fmt.Printf("Error creating %s: %v\n", filePath, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	exported, err := spotify.ExportChromaprints(context.Background(), SONGS_DIR, file, func(song utils.Song, err error) {
+		yellow.Printf("'%s' by '%s' was left out: %v\n", song.Title, song.Artist, err)
+	})
+	if err != nil {
+		fmt.Printf("Export stopped after %d songs: %v\n", exported, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported the fingerprints of %d songs to %s\n", exported, filePath)
+}
+
+// importDB adds the songs and fingerprints of an exported file to the database
+func importDB(filePath string) {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	songs, err := utils.LoadStorage(ctx, db, filePath)
+	if err != nil {
+		fmt.Printf("Failed to import database after %d songs: %v\n", songs, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d songs from %s\n", songs, filePath)
+}
+
+// migrate brings the database schema to version target, or to the latest
+// version when target is negative
+func migrate(target int) {
+	from, to, err := utils.Migrate(context.Background(), target)
+	if err != nil {
+		fmt.Printf("Migration stopped at schema version %d: %v\n", to, err)
+		os.Exit(1)
+	}
+
+	if from == to {
+		fmt.Printf("Schema is at version %d, nothing to migrate\n", to)
+		return
+	}
+	fmt.Printf("Schema migrated from version %d to %d\n", from, to)
+}
+
+// reshard splits the fingerprints of the bolt database of catalog over
+// shards files
+func reshard(catalog string, shards int) {
+	ctx := utils.WithCatalog(context.Background(), catalog)
+	moved, err := utils.ReshardBolt(ctx, shards)
+	if err != nil {
+		fmt.Printf("Resharding stopped after moving %d addresses: %v\n", moved, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Moved %d addresses, set BOLT_SHARDS=%d to use the database\n", moved, shards)
+}
+
+// buildSegment moves the fingerprints saved in the database of catalog
+// into a new segment
+func buildSegment(catalog string) {
+	ctx := context.Background()
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	fmt.Println("Building a segment, its fingerprints are deleted from the database once every server had SEGMENTS_REFRESH to load it")
+	info, err := utils.BuildSegment(ctx, db, catalog)
+	if err != nil {
+		fmt.Printf("Failed to build segment: %v\n", err)
+		os.Exit(1)
+	}
+	if info.Name == "" {
+		fmt.Println("No fingerprints to move")
+		return
+	}
+	fmt.Printf("Moved %d fingerprints of %d songs to segment %s (%.1f MB)\n",
+		info.Fingerprints, info.Songs, info.Name, float64(info.Size)/(1<<20))
+}
+
+// compactSegments merges the segments of catalog into one
+func compactSegments(catalog string) {
+	ctx := context.Background()
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	info, replaced, err := utils.CompactSegments(ctx, db, catalog)
+	if err != nil {
+		fmt.Printf("Failed to compact segments: %v\n", err)
+		os.Exit(1)
+	}
+	if replaced == 0 {
+		fmt.Println("No segments to compact")
+		return
+	}
+	fmt.Printf("Merged %d segments into %s, with %d fingerprints of %d songs (%.1f MB)\n",
+		replaced, info.Name, info.Fingerprints, info.Songs, float64(info.Size)/(1<<20))
+}
+
+func listSegments(catalog string) {
+	segments, err := utils.ListSegments(context.Background(), catalog)
+	if err != nil {
+		fmt.Printf("Failed to list segments: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(segments) == 0 {
+		fmt.Println("No segments")
+		return
+	}
+	for _, seg := range segments {
+		fmt.Printf("%s\tsongs: %d\tfingerprints: %d\tsize: %.1f MB\tcreated: %s\n",
+			seg.Name, seg.Songs, seg.Fingerprints, float64(seg.Size)/(1<<20), seg.Created.Format(time.RFC3339))
+	}
+}
+
+// buildFingerprintIndex compiles the fingerprints of catalog into the index
+// file at outputPath, or the catalog's index in FINGERPRINT_INDEX_DIR
+func buildFingerprintIndex(catalog, outputPath string) {
+	if outputPath == "" {
+		if !utils.FingerprintIndexesEnabled() {
+			fmt.Println("Set FINGERPRINT_INDEX_DIR or give the path of the index with -o")
+			os.Exit(1)
+		}
+		outputPath = utils.FingerprintIndexPath(catalog)
+	}
+
+	ctx := context.Background()
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	info, err := utils.BuildFingerprintIndex(ctx, db, catalog, outputPath)
+	if err != nil {
+		fmt.Printf("Failed to build the fingerprint index: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Indexed %d fingerprints of %d songs under %d addresses in %s (%.1f MB)\n",
+		info.Fingerprints, info.Songs, info.Addresses, info.Path, float64(info.Size)/(1<<20))
+}
+
+// benchFingerprintIndex times looking up batches of addresses in the
+// fingerprint index at indexPath, or the catalog's index in
+// FINGERPRINT_INDEX_DIR, and in the database of catalog. The addresses are
+// drawn from the index. Run it without READ_ONLY, or the database's lookups
+// go to the index as well.
+func benchFingerprintIndex(catalog, indexPath string, addresses int) {
+	if indexPath == "" {
+		if !utils.FingerprintIndexesEnabled() {
+			fmt.Println("Set FINGERPRINT_INDEX_DIR or give the path of the index with -index")
+			os.Exit(1)
+		}
+		indexPath = utils.FingerprintIndexPath(catalog)
+	}
+
+	index, err := utils.OpenFingerprintIndex(indexPath)
+	if err != nil {
+		fmt.Printf("Error opening the fingerprint index: %v\n", err)
+		os.Exit(1)
+	}
+	defer index.Close()
+	info := index.Info()
+	if info.Addresses == 0 {
+		fmt.Println("The index has no fingerprints")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	random := rand.New(rand.NewSource(1))
+	batches := make([][]uint32, 16)
+	for i := range batches {
+		batches[i] = make([]uint32, addresses)
+		for j := range batches[i] {
+			batches[i][j] = index.Address(random.Intn(info.Addresses))
+		}
+	}
+
+	indexCouples, err := index.Lookup(ctx, batches[0])
+	if err != nil {
+		fmt.Printf("Error looking fingerprints up in the index: %v\n", err)
+		os.Exit(1)
+	}
+	dbCouples, err := db.GetCouples(ctx, batches[0])
+	if err != nil {
+		fmt.Printf("Error looking fingerprints up in the database: %v\n", err)
+		os.Exit(1)
+	}
+	if len(indexCouples) != len(dbCouples) {
+		yellow.Printf("The index and the database found %d and %d of the addresses, rebuild the index if songs changed since it was built\n",
+			len(indexCouples), len(dbCouples))
+	}
+
+	indexResult := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := index.Lookup(ctx, batches[i%len(batches)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	dbResult := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetCouples(ctx, batches[i%len(batches)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	fmt.Printf("Index:    %d fingerprints under %d addresses (%.1f MB, built %s)\n",
+		info.Fingerprints, info.Addresses, float64(info.Size)/(1<<20), info.Built.Format(time.RFC3339))
+	fmt.Printf("Lookups of %d addresses:\n", addresses)
+	fmt.Printf("\tIndex:    %s %s\n", indexResult, indexResult.MemString())
+	fmt.Printf("\tDatabase: %s %s (%s)\n", dbResult, dbResult.MemString(), utils.GetEnv("STORAGE_TYPE", "mongo"))
+}
+
+// refingerprint fingerprints the songs of catalog again with the
+// fingerprinting parameters of the environment, then swaps the new
+// fingerprints in
+func refingerprint(catalog string) {
+	ctx := utils.WithCatalog(context.Background(), catalog)
+	cfg, err := shazam.ConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Invalid fingerprint configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	staging, err := spotify.RefingerprintStagingCatalog(catalog)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Fingerprinting songs into catalog %q, run again to resume if stopped\n", staging)
+
+	result, err := spotify.RefingerprintCatalog(ctx, SONGS_DIR, cfg, func(song utils.Song, err error) {
+		if err != nil {
+			yellow.Printf("Failed to fingerprint '%s' by '%s' (%d): %v\n", song.Title, song.Artist, song.ID, err)
+			return
+		}
+		fmt.Printf("Fingerprinted '%s' by '%s'\n", song.Title, song.Artist)
+	})
+	if err != nil {
+		fmt.Printf("Reindexing stopped after %d songs: %v\n", result.Songs, err)
+		os.Exit(1)
+	}
+	if !result.Swapped {
+		fmt.Printf("Fingerprinted %d songs, but %d failed: %v. Fix them or delete them, then run again to finish.\n", result.Songs, len(result.Failed), result.Failed)
+		os.Exit(1)
+	}
+	fmt.Printf("Fingerprinted %d songs and swapped in %d fingerprints\n", result.Songs, result.Fingerprints)
+}
+
+// gc deletes the fingerprints of songs that are no longer in the database
+func gc() {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	songIDs, err := utils.DeleteOrphanedFingerprints(ctx, db)
+	if err != nil {
+		fmt.Printf("Failed to delete orphaned fingerprints: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(songIDs) == 0 {
+		fmt.Println("No orphaned fingerprints found")
+		return
+	}
+	fmt.Printf("Deleted the fingerprints of %d missing songs: %v\n", len(songIDs), songIDs)
+}
+
+// conformance checks that the backend selected by STORAGE_TYPE behaves
+// like the others, using catalog, which must be empty
+func conformance(catalog string) {
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	fmt.Printf("Checking the %s backend in catalog %q: %s\n", db.Capabilities().Backend, catalog, strings.Join(storagetest.Checks(), ", "))
+	if err := storagetest.Check(context.Background(), db); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			yellow.Println(line)
 		}
+		os.Exit(1)
+	}
+	fmt.Println("The backend passed every check")
+}
+
+// prune deletes the songs selected by filter along with their
+// fingerprints, or only lists them with dryRun
+func prune(filter utils.SongFilter, dryRun bool) {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	result, err := utils.PruneSongs(ctx, db, filter, dryRun)
+	if err != nil {
+		fmt.Printf("Failed to delete songs: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case result.Songs == 0:
+		fmt.Println("No songs match")
+	case dryRun:
+		fmt.Printf("Would delete %d songs and %d fingerprints: %v\n", result.Songs, result.Fingerprints, result.SongIDs)
+	default:
+		fmt.Printf("Deleted %d songs and %d fingerprints: %v\n", result.Songs, result.Fingerprints, result.SongIDs)
+	}
+}
+
+// stats prints how many songs and fingerprints the database holds, and
+// the storage it takes up
+func stats() {
+	ctx := context.Background()
+	db, err := utils.NewReadOnlyDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	stats, err := getCatalogStats(ctx, db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	capabilities := db.Capabilities()
+	fmt.Printf("Storage:      %s\n", capabilities.Backend)
+	fmt.Printf("Songs:        %d\n", stats.Songs)
+	fmt.Printf("Fingerprints: %d\n", stats.Fingerprints)
+	if stats.Songs > 0 {
+		fmt.Printf("Per song:     %.0f\n", stats.FingerprintsPerSong)
+	}
+	fmt.Printf("Size:         %.1f MB\n", float64(stats.StorageBytes)/(1<<20))
+}
+
+// createAPIKey creates an API key and prints its secret, which is shown
+// only once
+func createAPIKey(name, catalog string, rateLimit int) {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	secret, key, err := utils.CreateAPIKey(ctx, db, name, catalog, rateLimit)
+	if err != nil {
+		fmt.Printf("Failed to create API key: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Created API key %s (%s)\n", key.ID, key.Name)
+	fmt.Printf("Secret: %s\n", secret)
+	yellow.Println("Store the secret now, it can't be shown again.")
+}
+
+func listAPIKeys() {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	keys, err := db.ListAPIKeys(ctx)
+	if err != nil {
+		fmt.Printf("Failed to list API keys: %v\n", err)
+		os.Exit(1)
+	}
 
-		log.Printf("Starting HTTPS server on %s\n", httpsAddr)
-		if err := httpsServer.ListenAndServeTLS(cert_file, cert_key); err != nil {
-			log.Fatalf("HTTPS server ListenAndServeTLS: %v", err)
+	if len(keys) == 0 {
+		fmt.Println("No API keys")
+		return
+	}
+	for _, key := range keys {
+		catalog := key.Catalog
+		if catalog == "" {
+			catalog = "any"
+		}
+		rateLimit := "default"
+		if key.RateLimit > 0 {
+			rateLimit = fmt.Sprintf("%d/min", key.RateLimit)
 		}
+		fmt.Printf("%s\t%s\tcatalog: %s\trate limit: %s\tcreated: %s\n",
+			key.ID, key.Name, catalog, rateLimit, key.Created.Format(time.RFC3339))
+	}
+}
+
+func revokeAPIKey(id string) {
+	ctx := context.Background()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := db.DeleteAPIKey(ctx, id); err != nil {
+		fmt.Printf("Failed to revoke API key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Revoked API key %s\n", id)
+}
+
+// history prints the last count recognitions made by clientID, or by
+// every client if it is empty
+func history(clientID string, count int) {
+	ctx := utils.NewOperationContext()
+	db, err := utils.NewDBClient()
+	if err != nil {
+		fmt.Printf("Error creating DB client: %v\n", err)
+		os.Exit(1)
 	}
+	defer db.Close()
 
-	log.Printf("Starting HTTP server on port %v", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("HTTP server ListenAndServe: %v", err)
+	recognitions, err := db.ListRecognitions(ctx, clientID, 0, count)
+	if err != nil {
+		fmt.Printf("Failed to list recognitions: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(recognitions) == 0 {
+		fmt.Println("No recognitions")
+		return
+	}
+	for _, recognition := range recognitions {
+		result := "no match"
+		if recognition.Matched() {
+			result = fmt.Sprintf("'%s' by '%s' (confidence %.2f)", recognition.SongTitle, recognition.SongArtist, recognition.Confidence)
+		}
+		client := recognition.ClientID
+		if client == "" {
+			client = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\n", recognition.Time.Format(time.RFC3339), client, result)
 	}
 }
 
@@ -195,19 +1042,25 @@ func erase(songsDir string) {
 	ctx := context.Background()
 
 	// wipe db
-	dbClient, err := utils.NewDbClient()
+	dbClient, err := utils.NewDBClient()
 	if err != nil {
 		msg := fmt.Sprintf("Error creating DB client: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
 	}
 
-	err = dbClient.DeleteCollection("fingerprints")
+	err = dbClient.DeleteCollection(ctx, "fingerprints")
+	if err != nil {
+		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
+		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+	}
+
+	err = dbClient.DeleteCollection(ctx, "songs")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
 	}
 
-	err = dbClient.DeleteCollection("songs")
+	err = dbClient.DeleteCollection(ctx, "settings")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
@@ -238,7 +1091,7 @@ func erase(songsDir string) {
 	fmt.Println("Erase complete")
 }
 
-func save(path string, force bool) {
+func save(path string, force, reindex bool, opts fileOptions) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		fmt.Printf("Error stating path %v: %v\n", path, err)
@@ -253,8 +1106,8 @@ func save(path string, force bool) {
 			}
 			// Process only files, skip directories
 			if !info.IsDir() {
-				err := saveSong(filePath, force)
-				if err != nil {
+				err := saveSong(ingestContext(reindex), filePath, filepath.Base(filePath), force, opts)
+				if err != nil && !errors.Is(err, errDeclined) {
 					fmt.Printf("Error saving song (%v): %v\n", filePath, err)
 				}
 			}
@@ -264,37 +1117,111 @@ func save(path string, force bool) {
 			fmt.Printf("Error walking the directory %v: %v\n", path, err)
 		}
 	} else {
-		err := saveSong(path, force)
-		if err != nil {
+		err := saveSong(ingestContext(reindex), path, filepath.Base(path), force, opts)
+		if err != nil && !errors.Is(err, errDeclined) {
 			fmt.Printf("Error saving song (%v): %v\n", path, err)
 		}
 	}
 }
 
-func saveSong(filePath string, force bool) error {
-	metadata, err := wav.GetMetadata(filePath)
+// ingestContext returns the context of a song ingestion started from the
+// command line, which reindexes the songs already indexed if reindex is set
+func ingestContext(reindex bool) context.Context {
+	ctx := utils.NewOperationContext()
+	if reindex {
+		ctx = spotify.WithReindex(ctx)
+	}
+	return ctx
+}
+
+// saveSong saves the audio file at filePath, known as fileName, as the song
+// its tags describe
+func saveSong(ctx context.Context, filePath, fileName string, force bool, opts fileOptions) error {
+	track, err := trackFromFile(filePath, fileName, opts.namePattern)
 	if err != nil {
 		return err
 	}
+	track.Provenance.FileName = fileName
+
+	if opts.confirm {
+		ok, err := confirmTrack(filePath, track)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errDeclined
+		}
+	}
+
+	return saveTrack(ctx, filePath, track, force)
+}
+
+// trackFromFile reads the title, artist, album, release year and artwork
+// of an audio file from its ID3 tags or Vorbis comments. A missing title or
+// artist is read from fileName with namePattern, if it isn't nil.
+func trackFromFile(filePath, fileName string, namePattern *regexp.Regexp) (*spotify.Track, error) {
+	metadata, err := wav.GetMetadata(filePath)
+	if err != nil {
+		return nil, err
+	}
 
 	durationFloat, err := strconv.ParseFloat(metadata.Format.Duration, 64)
 	if err != nil {
-		return fmt.Errorf("failed to parse duration to float: %v", err)
+		return nil, fmt.Errorf("failed to parse duration to float: %v", err)
 	}
 
-	tags := metadata.Format.Tags
 	track := &spotify.Track{
-		Album:    tags["album"],
-		Artist:   tags["artist"],
-		Title:    tags["title"],
+		Album:    metadata.Tag("album"),
+		Artist:   metadata.Tag("artist", "album_artist", "albumartist"),
+		Title:    metadata.Tag("title"),
 		Duration: int(math.Round(durationFloat)),
 	}
+	if date := metadata.Tag("date", "year", "originalyear"); len(date) >= 4 {
+		track.ReleaseYear, _ = strconv.Atoi(date[:4])
+	}
+
+	if (track.Title == "" || track.Artist == "") && namePattern != nil {
+		name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+		if match := namePattern.FindStringSubmatch(name); match != nil {
+			if i := namePattern.SubexpIndex("title"); track.Title == "" && i >= 0 {
+				track.Title = strings.TrimSpace(match[i])
+			}
+			if i := namePattern.SubexpIndex("artist"); track.Artist == "" && i >= 0 {
+				track.Artist = strings.TrimSpace(match[i])
+			}
+			if i := namePattern.SubexpIndex("album"); track.Album == "" && i >= 0 {
+				track.Album = strings.TrimSpace(match[i])
+			}
+		}
+	}
 
+	// Songs are saved without their artwork rather than not at all
+	track.CoverURL, err = saveFileCover(filePath, metadata)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.Warn("failed to save embedded artwork.", slog.String("file", filePath), slog.Any("error", xerrors.New(err)))
+	}
+
+	return track, nil
+}
+
+// saveTrack fingerprints the audio file at filePath as the given track in
+// the catalog selected by ctx and moves its WAV version to the songs
+// directory
+func saveTrack(ctx context.Context, filePath string, track *spotify.Track, force bool) error {
 	ytID, err := spotify.GetYoutubeId(*track)
 	if err != nil && !force {
 		return fmt.Errorf("failed to get YouTube ID for song: %v", err)
 	}
 
+	return storeTrack(ctx, filePath, track, ytID)
+}
+
+// storeTrack fingerprints the audio file at filePath as the given track in
+// the catalog selected by ctx, with ytID if it's not empty, and moves its
+// WAV version to the songs directory. A track that is already indexed is
+// rejected, or reindexed when ctx asks for it.
+func storeTrack(ctx context.Context, filePath string, track *spotify.Track, ytID string) error {
 	if track.Title == "" {
 		return fmt.Errorf("no title found in metadata")
 	}
@@ -302,7 +1229,28 @@ func saveSong(filePath string, force bool) error {
 		return fmt.Errorf("no artist found in metadata")
 	}
 
-	err = spotify.ProcessAndSaveSong(filePath, track.Title, track.Artist, ytID)
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	existing, err := spotify.FindDuplicate(ctx, db, track.Title, track.Artist, ytID)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("error checking song existence: %v", err)
+	}
+	if existing != nil {
+		if !spotify.Reindexing(ctx) {
+			return &spotify.DuplicateError{Song: *existing}
+		}
+		err = spotify.ReindexSong(ctx, filePath, *existing)
+	} else {
+		if track.Source == "" {
+			track.Source = utils.SourceFile
+		}
+		spotify.EnrichTrack(ctx, track)
+
+		err = spotify.ProcessAndSaveSong(ctx, filePath, track.Title, track.Artist, ytID, track.Metadata())
+	}
 	if err != nil {
 		return fmt.Errorf("failed to process or save song: %v", err)
 	}
@@ -319,3 +1267,141 @@ func saveSong(filePath string, force bool) error {
 
 	return nil
 }
+
+// audioExtensions are the file extensions index picks up
+var audioExtensions = map[string]bool{
+	".wav": true, ".mp3": true, ".flac": true, ".ogg": true, ".oga": true,
+	".m4a": true, ".aac": true, ".opus": true, ".wma": true, ".aif": true, ".aiff": true,
+}
+
+// index saves every audio file under dirPath, fingerprinting up to workers
+// files at a time
+func index(dirPath string, workers int, force, reindex, retryFailed bool, opts fileOptions) {
+	var files []string
+	err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error walking the directory %v: %v\n", dirPath, err)
+		return
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No audio files found in", dirPath)
+		return
+	}
+
+	// Asking about files saved concurrently would mix their output
+	if workers < 1 || opts.confirm {
+		workers = 1
+	}
+
+	// The files saved and failed are remembered under the absolute path of
+	// the directory, so that indexing it again after an interruption skips
+	// them
+	progressCtx := utils.NewOperationContext()
+	if retryFailed {
+		progressCtx = spotify.WithRetryFailed(progressCtx)
+	}
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		fmt.Printf("Error resolving the directory %v: %v\n", dirPath, err)
+		return
+	}
+	progress, err := spotify.LoadImportProgress(progressCtx, absPath)
+	if err != nil {
+		fmt.Printf("Error loading the progress of an earlier index: %v\n", err)
+		return
+	}
+	keys := make([]string, len(files))
+	for i, filePath := range files {
+		keys[i] = indexFileKey(dirPath, filePath)
+	}
+
+	fmt.Printf("Indexing %d files with %d workers\n", len(files), workers)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		processed int
+		failed    int
+		skipped   int
+	)
+	startTime := time.Now()
+	jobs := make(chan int)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				filePath := files[i]
+				if reason := progress.Skip(keys[i]); reason != "" {
+					mu.Lock()
+					processed++
+					skipped++
+					fmt.Printf("[%d/%d] Skipped %v: %s\n", processed, len(files), filePath, reason)
+					mu.Unlock()
+					continue
+				}
+
+				err := saveSong(ingestContext(reindex), filePath, filepath.Base(filePath), force, opts)
+				if errors.Is(err, errDeclined) {
+					// Not recorded, so that indexing again asks again
+					mu.Lock()
+					processed++
+					skipped++
+					fmt.Printf("[%d/%d] Skipped %v: declined\n", processed, len(files), filePath)
+					mu.Unlock()
+					continue
+				}
+				var duplicate *spotify.DuplicateError
+				progress.Record(progressCtx, keys[i], err == nil || errors.As(err, &duplicate))
+
+				mu.Lock()
+				processed++
+				if err != nil {
+					failed++
+					yellow.Printf("[%d/%d] Error saving song (%v): %v\n", processed, len(files), filePath, err)
+				} else {
+					fmt.Printf("[%d/%d] Saved %v\n", processed, len(files), filePath)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Finish(progressCtx, keys)
+
+	fmt.Printf("\nIndexed %d of %d files in %s (%d failed, %d skipped)\n",
+		len(files)-failed-skipped, len(files), time.Since(startTime).Round(time.Millisecond), failed, skipped)
+	if n := progress.Failed(); n > 0 {
+		yellow.Printf("%d files failed, run the same command with --retry-failed to retry them\n", n)
+	}
+}
+
+// indexFileKey identifies a file of an indexed directory by its path in the
+// directory, size and modification time, so that a file changed since an
+// earlier index is saved again
+func indexFileKey(dirPath, filePath string) string {
+	key := filePath
+	if rel, err := filepath.Rel(dirPath, filePath); err == nil {
+		key = rel
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return key
+	}
+	return fmt.Sprintf("%s\x00%d\x00%d", key, info.Size(), info.ModTime().UnixNano())
+}
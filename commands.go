@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"song-recognition/degrade"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+)
+
+// command is a subcommand of the CLI, run as `main.go <name> [flags] <args>`
+type command struct {
+	name string
+	// aliases are other names the command answers to, kept for scripts
+	// written against older versions
+	aliases []string
+	// args describes the positional arguments in the usage line
+	args string
+	// summary is the description listed by help
+	summary string
+	// minArgs is the number of positional arguments the command needs
+	minArgs int
+	// usesDB brings the database schema up to date before the command runs
+	usesDB bool
+	// setup declares the command's flags on fs, and returns the function
+	// that runs it with its positional arguments once they are parsed
+	setup func(fs *flag.FlagSet) func(args []string)
+	// subcommands replace setup for commands grouping several others
+	subcommands []*command
+}
+
+// commands are the subcommands of the CLI, in the order help lists them
+var commands = []*command{
+	{
+		name:    "serve",
+		summary: "Serve the web app, the HTTP API and the gRPC API",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			protocol := fs.String("proto", "http", "Protocol to use (http or https)")
+			port := fs.String("p", utils.GetEnv("PORT", "5000"), "Port to use")
+			grpcPort := fs.String("grpc", utils.GetEnv("GRPC_PORT", "50051"), "Port for the gRPC server (empty to disable)")
+			mic := fs.Bool("mic", false, "recognize what the server's microphone hears and send it to clients (see MIC_DEVICE)")
+			telegramToken := fs.String("telegram-token", utils.GetEnv("TELEGRAM_BOT_TOKEN"), "token of a Telegram bot to answer with the songs users send it")
+			return func([]string) {
+				serve(*protocol, *port, *grpcPort, *mic, *telegramToken)
+			}
+		},
+	},
+	{
+		name:    "recognize",
+		aliases: []string{"find"},
+		args:    "<path_to_audio_file>...",
+		summary: "Find the songs audio files were recorded from",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			top := fs.Int("top", 20, "number of matches to show per file")
+			asJSON := fs.Bool("json", false, "print a JSON line per file instead, and log to stderr")
+			diagnose := fs.Bool("diagnostics", false, "also print how the fingerprints were found, as a dry run left out of the history")
+			return func(args []string) {
+				if *top < 1 {
+					usageError(fs, "-top must be at least 1")
+				}
+				if *asJSON {
+					utils.SetLogOutput(os.Stderr)
+				}
+				recognize(args, *top, *asJSON, *diagnose)
+			}
+		},
+	},
+	{
+		name:    "index",
+		aliases: []string{"save", "download"},
+		args:    "<path_or_url>",
+		summary: "Save an audio file, every audio file of a directory, or the songs of a Spotify, YouTube or SoundCloud link",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			force := fs.Bool("force", false, "save songs with or without YouTube ID")
+			fs.BoolVar(force, "f", false, "save songs with or without YouTube ID (shorthand)")
+			reindex := fs.Bool("reindex", false, "replace the fingerprints of songs that are already indexed instead of skipping them")
+			retryFailed := fs.Bool("retry-failed", false, "retry the songs an interrupted import of the same playlist or directory failed to save")
+			workers := fs.Int("w", runtime.NumCPU(), "number of files of a directory to fingerprint concurrently")
+			namePattern := fs.String("name-pattern", defaultNamePattern, "how the title, artist and album missing from a file's tags are read from its name, with {title}, {artist}, {album} and {*} for anything else")
+			confirm := fs.Bool("confirm", false, "show what was read of each file and ask before saving it, to correct it")
+			return func(args []string) {
+				path := args[0]
+				if strings.Contains(path, "://") {
+					download(path, *reindex, *retryFailed)
+					return
+				}
+
+				pattern, err := compileNamePattern(*namePattern)
+				if err != nil {
+					usageError(fs, err.Error())
+				}
+				opts := fileOptions{namePattern: pattern, confirm: *confirm}
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					index(path, *workers, *force, *reindex, *retryFailed, opts)
+					return
+				}
+				save(path, *force, *reindex, opts)
+			}
+		},
+	},
+	{
+		name:    "album",
+		args:    "<release_id_or_url> | <artist> <album>",
+		summary: "Save every track of an album, given by its MusicBrainz release or looked up there by artist and title",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			reindex := fs.Bool("reindex", false, "replace the fingerprints of songs that are already indexed instead of skipping them")
+			retryFailed := fs.Bool("retry-failed", false, "retry the songs an interrupted import of the same album failed to save")
+			return func(args []string) {
+				if len(args) == 1 && !spotify.IsMusicBrainzRelease(args[0]) {
+					usageError(fs, "expected the ID or link of a MusicBrainz release, or an artist and album")
+				}
+				album(args, *reindex, *retryFailed)
+			}
+		},
+	},
+	{
+		name:    "stats",
+		summary: "Show how many songs and fingerprints the database holds",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func([]string) {
+				stats()
+			}
+		},
+	},
+	{
+		name:    "history",
+		summary: "Show the latest recognitions",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			clientID := fs.String("client", "", "only show the recognitions of this client (default: every client)")
+			count := fs.Int("n", 20, "number of recognitions to show")
+			return func([]string) {
+				if *count < 1 {
+					usageError(fs, "-n must be at least 1")
+				}
+				history(*clientID, *count)
+			}
+		},
+	},
+	{
+		name:    "erase",
+		summary: "Delete every song and fingerprint, and the downloaded song files",
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func([]string) {
+				erase(SONGS_DIR)
+			}
+		},
+	},
+	{
+		name:    "export",
+		args:    "<path_to_dump_file>",
+		summary: "Write every song and fingerprint to a dump file",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func(args []string) {
+				exportDB(args[0])
+			}
+		},
+	},
+	{
+		name:    "chromaprint",
+		args:    "<path_to_output_file>",
+		summary: "Write the Chromaprint fingerprint of every song, as AcoustID identifies them, to a JSON lines file",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func(args []string) {
+				exportChromaprints(args[0])
+			}
+		},
+	},
+	{
+		name:    "import",
+		args:    "<path_to_dump_file>",
+		summary: "Add the songs and fingerprints of a dump file",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func(args []string) {
+				importDB(args[0])
+			}
+		},
+	},
+	{
+		name:    "migrate",
+		summary: "Move the database schema to another version",
+		setup: func(fs *flag.FlagSet) func([]string) {
+			target := fs.Int("to", -1, "schema version to migrate up or down to (default: latest)")
+			return func([]string) {
+				migrate(*target)
+			}
+		},
+	},
+	{
+		name:    "reshard",
+		summary: "Split the fingerprints of a bolt database over another number of files",
+		setup: func(fs *flag.FlagSet) func([]string) {
+			shards := fs.Int("shards", 1, "number of files to split fingerprints over")
+			catalog := fs.String("catalog", "", "catalog to reshard (default: the default catalog)")
+			return func([]string) {
+				reshard(*catalog, *shards)
+			}
+		},
+	},
+	{
+		name:    "segments",
+		summary: "Move fingerprints into the segments kept at SEGMENTS_URL",
+		usesDB:  true,
+		subcommands: []*command{
+			{
+				name:    "build",
+				summary: "Move the fingerprints saved in the database into a new segment",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "catalog to build a segment of (default: the default catalog)")
+					return func([]string) {
+						buildSegment(*catalog)
+					}
+				},
+			},
+			{
+				name:    "compact",
+				summary: "Merge the segments into one, dropping the fingerprints of deleted songs",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "catalog to compact the segments of (default: the default catalog)")
+					return func([]string) {
+						compactSegments(*catalog)
+					}
+				},
+			},
+			{
+				name:    "list",
+				summary: "List the segments",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "catalog to list the segments of (default: the default catalog)")
+					return func([]string) {
+						listSegments(*catalog)
+					}
+				},
+			},
+		},
+	},
+	{
+		name:    "fpindex",
+		summary: "Compile fingerprints into the index files kept in FINGERPRINT_INDEX_DIR",
+		usesDB:  true,
+		subcommands: []*command{
+			{
+				name:    "build",
+				summary: "Compile the fingerprints of a catalog into its index file",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "catalog to index (default: the default catalog)")
+					output := fs.String("o", "", "path of the index (default: the catalog's index in FINGERPRINT_INDEX_DIR)")
+					return func([]string) {
+						buildFingerprintIndex(*catalog, *output)
+					}
+				},
+			},
+			{
+				name:    "bench",
+				summary: "Time fingerprint lookups in an index against the database",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "catalog whose index is timed (default: the default catalog)")
+					index := fs.String("index", "", "path of the index (default: the catalog's index in FINGERPRINT_INDEX_DIR)")
+					addresses := fs.Int("addresses", 1000, "number of addresses looked up at once, about as many as in a 10 second recording")
+					return func([]string) {
+						if *addresses <= 0 {
+							usageError(fs, "-addresses must be positive")
+						}
+						benchFingerprintIndex(*catalog, *index, *addresses)
+					}
+				},
+			},
+		},
+	},
+	{
+		name:    "reindex",
+		summary: "Fingerprint every song again after fingerprinting parameters changed",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			catalog := fs.String("catalog", "", "catalog to reindex (default: the default catalog)")
+			return func([]string) {
+				refingerprint(*catalog)
+			}
+		},
+	},
+	{
+		name:    "gc",
+		summary: "Delete the fingerprints of songs that are no longer saved",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			return func([]string) {
+				gc()
+			}
+		},
+	},
+	{
+		name:    "conformance",
+		summary: "Check that the storage backend behaves like the others",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			catalog := fs.String("catalog", "conformance", "empty catalog to run the checks in, which is emptied again afterwards")
+			return func([]string) {
+				conformance(*catalog)
+			}
+		},
+	},
+	{
+		name:    "prune",
+		summary: "Delete songs in bulk along with their fingerprints",
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			ids := fs.String("ids", "", "comma-separated IDs of the songs to delete")
+			artist := fs.String("artist", "", "delete the songs of this artist")
+			source := fs.String("source", "", "delete the songs taken from this source: youtube, soundcloud or file")
+			dryRun := fs.Bool("dry-run", false, "only show what would be deleted")
+			return func([]string) {
+				filter := utils.SongFilter{Artist: *artist, Source: *source}
+				for _, field := range strings.FieldsFunc(*ids, func(r rune) bool { return r == ',' }) {
+					id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+					if err != nil {
+						usageError(fs, "invalid song ID "+field)
+					}
+					filter.IDs = append(filter.IDs, uint32(id))
+				}
+				if filter.IsEmpty() {
+					usageError(fs, "set -ids, -artist or -source")
+				}
+				prune(filter, *dryRun)
+			}
+		},
+	},
+	{
+		name:    "apikey",
+		summary: "Manage the API keys of the HTTP and gRPC APIs",
+		usesDB:  true,
+		subcommands: []*command{
+			{
+				name:    "create",
+				args:    "<name>",
+				summary: "Create an API key and print it",
+				minArgs: 1,
+				setup: func(fs *flag.FlagSet) func([]string) {
+					catalog := fs.String("catalog", "", "only catalog the key can use (default: any)")
+					rateLimit := fs.Int("rate", 0, "recognitions allowed per minute (default: API_KEY_RATE_LIMIT)")
+					return func(args []string) {
+						createAPIKey(args[0], *catalog, *rateLimit)
+					}
+				},
+			},
+			{
+				name:    "list",
+				summary: "List the API keys",
+				setup: func(fs *flag.FlagSet) func([]string) {
+					return func([]string) {
+						listAPIKeys()
+					}
+				},
+			},
+			{
+				name:    "revoke",
+				args:    "<id>",
+				summary: "Revoke an API key",
+				minArgs: 1,
+				setup: func(fs *flag.FlagSet) func([]string) {
+					return func(args []string) {
+						revokeAPIKey(args[0])
+					}
+				},
+			},
+		},
+	},
+	{
+		name:    "bench",
+		args:    "<clips_directory>",
+		summary: "Measure how well labeled clips are recognized, to evaluate fingerprinting and matching changes",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			truth := fs.String("truth", "", "CSV file of the clips: path in the directory, song ID (empty for songs missing from the catalog) and optional condition (default: <clips_directory>/truth.csv)")
+			catalog := fs.String("catalog", "", "catalog to recognize the clips in (default: the default catalog)")
+			minConfidence := fs.Float64("min-confidence", 0, "least confidence of a top match to count it as an answer")
+			confusions := fs.Int("confusions", 10, "number of most frequent mistakes to show")
+			asJSON := fs.Bool("json", false, "print the report, with the result of every clip, as JSON")
+			return func(args []string) {
+				if *confusions < 0 {
+					usageError(fs, "-confusions can't be negative")
+				}
+				if *asJSON {
+					utils.SetLogOutput(os.Stderr)
+				}
+				bench(args[0], *truth, *catalog, *minConfidence, *confusions, *asJSON)
+			}
+		},
+	},
+	{
+		name:    "degrade",
+		args:    "<output_directory>",
+		summary: "Write noisy, reverberated, filtered, clipped and sped up clips of saved songs to benchmark with",
+		minArgs: 1,
+		usesDB:  true,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			catalog := fs.String("catalog", "", "catalog whose songs are degraded (default: the default catalog)")
+			conditions := fs.String("conditions", strings.Join(degrade.Conditions, ","), "comma-separated conditions to write clips in")
+			perSong := fs.Int("clips", 1, "number of clips per song and condition")
+			length := fs.Float64("length", 8, "length of the clips in seconds")
+			maxSongs := fs.Int("songs", 0, "number of songs to degrade, 0 for all")
+			seed := fs.Int64("seed", 1, "seed of the random positions and strengths, the same seed writes the same clips")
+			return func(args []string) {
+				var selected []string
+				for _, condition := range strings.Split(*conditions, ",") {
+					condition = strings.TrimSpace(condition)
+					if !slices.Contains(degrade.Conditions, condition) {
+						usageError(fs, fmt.Sprintf("unknown condition %q, want some of %s", condition, strings.Join(degrade.Conditions, ", ")))
+					}
+					selected = append(selected, condition)
+				}
+				if *perSong <= 0 {
+					usageError(fs, "-clips must be positive")
+				}
+				if *length <= 0 {
+					usageError(fs, "-length must be positive")
+				}
+				if *maxSongs < 0 {
+					usageError(fs, "-songs can't be negative")
+				}
+				degradeSongs(args[0], *catalog, selected, *perSong, *maxSongs, *length, *seed)
+			}
+		},
+	},
+	{
+		name:    "spectrogram",
+		args:    "<path_to_audio_file>",
+		summary: "Save the spectrogram of an audio file as a PNG image",
+		minArgs: 1,
+		setup: func(fs *flag.FlagSet) func([]string) {
+			output := fs.String("o", "", "path of the PNG image (default: <audio_file_name>.png)")
+			noPeaks := fs.Bool("no-peaks", false, "don't mark the peaks fingerprints are made of")
+			return func(args []string) {
+				renderSpectrogram(args[0], *output, !*noPeaks)
+			}
+		},
+	},
+	{
+		name:    "fftbench",
+		summary: "Time the FFT backend the binary was built with",
+		setup: func(fs *flag.FlagSet) func([]string) {
+			seconds := fs.Float64("seconds", 30, "length of the audio the spectrogram is timed on")
+			return func([]string) {
+				if *seconds <= 0 {
+					usageError(fs, "-seconds must be positive")
+				}
+				fftBench(*seconds)
+			}
+		},
+	},
+}
+
+// runCommand runs the command of commands named by args[0] with the rest of
+// args. prefix is the names of the commands the command is grouped under.
+func runCommand(prefix string, commands []*command, args []string) {
+	if len(args) < 1 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		if len(args) > 1 {
+			if cmd := lookupCommand(commands, args[1]); cmd != nil {
+				printCommandUsage(prefix, cmd)
+				return
+			}
+		}
+		printCommands(prefix, commands)
+		if len(args) < 1 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	cmd := lookupCommand(commands, args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		printCommands(prefix, commands)
+		os.Exit(2)
+	}
+	name := strings.TrimSpace(prefix + " " + cmd.name)
+
+	if cmd.subcommands != nil {
+		if cmd.usesDB && len(args) > 1 && lookupCommand(cmd.subcommands, args[1]) != nil {
+			prepareDB()
+		}
+		runCommand(name, cmd.subcommands, args[1:])
+		return
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	run := cmd.setup(fs)
+	fs.Usage = func() { printCommandUsage(prefix, cmd) }
+	fs.Parse(args[1:])
+	if fs.NArg() < cmd.minArgs {
+		usageError(fs, fmt.Sprintf("%s needs %s", name, cmd.args))
+	}
+
+	if cmd.usesDB {
+		prepareDB()
+	}
+	run(fs.Args())
+}
+
+// lookupCommand returns the command of commands with the name or alias
+// name, or nil
+func lookupCommand(commands []*command, name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+		for _, alias := range cmd.aliases {
+			if alias == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// printCommands lists commands with their summaries
+func printCommands(prefix string, commands []*command) {
+	program := strings.TrimSpace("main.go " + prefix)
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for the flags of a command.\n", program)
+}
+
+// printCommandUsage prints the usage line, summary and flags of cmd
+func printCommandUsage(prefix string, cmd *command) {
+	name := strings.TrimSpace(prefix + " " + cmd.name)
+	if cmd.subcommands != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n", cmd.summary)
+		printCommands(name, cmd.subcommands)
+		return
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cmd.setup(fs)
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+
+	usage := "main.go " + name
+	if hasFlags {
+		usage += " [flags]"
+	}
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n", usage, cmd.summary)
+	if len(cmd.aliases) > 0 {
+		fmt.Fprintf(os.Stderr, "\nAliases: %s\n", strings.Join(cmd.aliases, ", "))
+	}
+	if hasFlags {
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		fs.SetOutput(os.Stderr)
+		fs.PrintDefaults()
+	}
+}
+
+// usageError prints msg and the usage of the command of fs, and exits
+func usageError(fs *flag.FlagSet, msg string) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", msg)
+	fs.Usage()
+	os.Exit(2)
+}
+
+// prepareDB brings the database schema up to date before a command touches
+// the database, or checks that it is in read-only mode
+func prepareDB() {
+	if utils.ReadOnly() {
+		if err := utils.CheckSchema(context.Background()); err != nil {
+			fmt.Printf("Failed to check database schema: %v\n", err)
+			os.Exit(1)
+		}
+	} else if _, _, err := utils.Migrate(context.Background(), -1); err != nil {
+		fmt.Printf("Failed to migrate database schema: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,485 @@
+// Package config loads the settings of the server from a YAML file, which
+// the environment variables of the same name override.
+//
+// Settings are named like environment variables. In the file they can be
+// written flat or nested, with nested keys joined by underscores, so these
+// are the same setting:
+//
+//	STORAGE_TYPE: bolt
+//
+//	storage:
+//	  type: bolt
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the file settings are loaded from when SEEKTUNE_CONFIG
+// isn't set. It is optional.
+const DefaultPath = "seektune.yaml"
+
+var (
+	// mu guards the file and its settings, which Reload replaces
+	mu sync.RWMutex
+	// path is the file the settings were loaded from, empty if none
+	path string
+	// fileValues holds the settings of the file by name
+	fileValues map[string]string
+	// loadErr is the error loading the file failed with
+	loadErr error
+
+	// reloadMu serializes reloads, and guards the functions they call
+	reloadMu    sync.Mutex
+	checks      []func(lookup func(name string) (string, bool)) error
+	reloadHooks []func()
+)
+
+// The file is loaded before any package reads its settings, since they are
+// read when packages are initialized
+func init() {
+	path = findFile()
+	if path != "" {
+		fileValues, loadErr = loadFile(path)
+	}
+}
+
+// findFile returns the file settings are loaded from, empty if there is
+// none
+func findFile() string {
+	if path := os.Getenv("SEEKTUNE_CONFIG"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(DefaultPath); err != nil {
+		return ""
+	}
+	return DefaultPath
+}
+
+// Path returns the file the settings were loaded from, empty if none was
+func Path() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return path
+}
+
+// Lookup returns the value of the setting name from the environment or, if
+// it isn't set there, from the config file. It reports whether it was set
+// in either.
+func Lookup(name string) (string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return lookupIn(fileValues, name)
+}
+
+// lookupIn is Lookup with the settings of the file in values
+func lookupIn(values map[string]string, name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := values[name]
+	return value, ok
+}
+
+// Validate checks that the config file could be loaded, that it only has
+// known settings, and that every setting is set to a valid value
+func Validate() error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if loadErr != nil {
+		return fmt.Errorf("error loading %s: %v", path, loadErr)
+	}
+	return validate(path, fileValues)
+}
+
+// validate checks the settings of the file at path, whose values are
+// values
+func validate(path string, values map[string]string) error {
+	var errs []error
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := settings[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %s in %s", name, path))
+		}
+	}
+
+	names = names[:0]
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := lookupIn(values, name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := settings[name].validate(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", name, value, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// AddCheck adds a check Reload runs on the settings it is about to apply,
+// for settings that are only valid together. check looks settings up with
+// lookup instead of Lookup, and returns an error if they can't be used.
+func AddCheck(check func(lookup func(name string) (string, bool)) error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	checks = append(checks, check)
+}
+
+// OnReload adds a function Reload calls once it applied new settings, for
+// the packages that keep what they read from a setting, to read it again
+func OnReload(hook func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// ReloadResult lists the settings a reload changed
+type ReloadResult struct {
+	// Applied are the changed settings now in use
+	Applied []string `json:"applied"`
+	// Ignored are the changed settings that are only read when the process
+	// starts, which keep their value until it restarts
+	Ignored []string `json:"ignored"`
+}
+
+// Reload loads the config file again, or the file created since the
+// process started, and applies the settings that can change while it runs.
+// The others keep the value they had, like those set in the environment,
+// which overrides the file. Nothing changes if the file is invalid or a
+// check added with AddCheck fails; otherwise the functions added with
+// OnReload are called.
+func Reload() (ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	mu.RLock()
+	filePath, current := path, fileValues
+	mu.RUnlock()
+	if filePath == "" {
+		filePath = findFile()
+	}
+	if filePath == "" {
+		return ReloadResult{}, fmt.Errorf("no config file, set SEEKTUNE_CONFIG or create %s", DefaultPath)
+	}
+
+	loaded, err := loadFile(filePath)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("error loading %s: %v", filePath, err)
+	}
+	if err := validate(filePath, loaded); err != nil {
+		return ReloadResult{}, err
+	}
+
+	var result ReloadResult
+	values := map[string]string{}
+	for name := range settings {
+		oldValue, oldOk := current[name]
+		newValue, newOk := loaded[name]
+		value, ok := oldValue, oldOk
+		if settings[name].reloadable {
+			value, ok = newValue, newOk
+		}
+		if ok {
+			values[name] = value
+		}
+
+		changed := oldValue != newValue || oldOk != newOk
+		if _, inEnv := os.LookupEnv(name); !changed || inEnv {
+			continue
+		}
+		if settings[name].reloadable {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.Ignored = append(result.Ignored, name)
+		}
+	}
+	sort.Strings(result.Applied)
+	sort.Strings(result.Ignored)
+
+	for _, check := range checks {
+		if err := check(func(name string) (string, bool) { return lookupIn(values, name) }); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+
+	mu.Lock()
+	path, fileValues = filePath, values
+	mu.Unlock()
+
+	for _, hook := range reloadHooks {
+		hook()
+	}
+	return result, nil
+}
+
+// loadFile reads the settings of a YAML file, flattening nested keys
+func loadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if err := flatten(values, "", document); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// flatten adds the settings of a YAML mapping to values, prefixing their
+// names with prefix
+func flatten(values map[string]string, prefix string, mapping map[string]interface{}) error {
+	for key, value := range mapping {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(values, name, value); err != nil {
+				return err
+			}
+		case []interface{}:
+			return fmt.Errorf("%s: lists aren't supported", name)
+		default:
+			if _, ok := values[name]; ok {
+				return fmt.Errorf("%s is set twice", name)
+			}
+			if value == nil {
+				values[name] = ""
+			} else {
+				values[name] = fmt.Sprint(value)
+			}
+		}
+	}
+	return nil
+}
+
+// setting describes the values a setting accepts
+type setting struct {
+	kind    string   // "string", "int", "float", "bool" or "duration"
+	allowed []string // values a string setting is limited to, if any
+	// reloadable is whether Reload applies the setting, because the process
+	// reads it again as it runs
+	reloadable bool
+}
+
+// reloadable returns s, applied by Reload
+func reloadable(s setting) setting {
+	s.reloadable = true
+	return s
+}
+
+func (s setting) validate(value string) error {
+	switch s.kind {
+	case "int":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		if n < 0 {
+			return errors.New("expected a positive integer")
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return errors.New("expected a number")
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return errors.New("expected true or false")
+		}
+	case "duration":
+		if _, err := time.ParseDuration(value); err != nil {
+			return errors.New("expected a duration such as 30s or 5m")
+		}
+	}
+
+	if len(s.allowed) > 0 {
+		for _, allowed := range s.allowed {
+			if strings.EqualFold(value, allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(s.allowed, ", "))
+	}
+	return nil
+}
+
+var (
+	stringSetting   = setting{kind: "string"}
+	intSetting      = setting{kind: "int"}
+	floatSetting    = setting{kind: "float"}
+	boolSetting     = setting{kind: "bool"}
+	durationSetting = setting{kind: "duration"}
+)
+
+// settings lists every setting the server reads. Settings read anywhere
+// must be added here, or they can only be set from the environment. Those
+// marked reloadable must be read again after a reload, either every time
+// they are used or by a function added with OnReload.
+var settings = map[string]setting{
+	// Storage
+	"STORAGE_TYPE":                   {kind: "string", allowed: []string{"mongo", "mongodb", "postgres", "postgresql", "mysql", "mariadb", "redis", "cassandra", "scylla", "scylladb", "bolt", "bbolt", "memory"}},
+	"DB_USER":                        stringSetting,
+	"DB_PASS":                        stringSetting,
+	"DB_NAME":                        stringSetting,
+	"DB_HOST":                        stringSetting,
+	"DB_PORT":                        intSetting,
+	"DB_SSLMODE":                     stringSetting,
+	"DB_PATH":                        stringSetting,
+	"DB_INSERT_BATCH_SIZE":           intSetting,
+	"COUPLES_CACHE_SIZE":             reloadable(intSetting),
+	"ADDRESS_FILTER":                 boolSetting,
+	"ADDRESS_FILTER_REFRESH":         durationSetting,
+	"ADDRESS_FILTER_MAX_SIZE":        intSetting,
+	"RESULT_CACHE_SIZE":              reloadable(intSetting),
+	"RESULT_CACHE_TTL":               reloadable(durationSetting),
+	"READ_ONLY":                      boolSetting,
+	"BOLT_TIMEOUT":                   durationSetting,
+	"BOLT_NO_SYNC":                   boolSetting,
+	"BOLT_SHARDS":                    intSetting,
+	"BOLT_INITIAL_MMAP_SIZE":         intSetting,
+	"MONGO_MAX_POOL_SIZE":            intSetting,
+	"MONGO_MIN_POOL_SIZE":            intSetting,
+	"MONGO_CONNECT_TIMEOUT":          durationSetting,
+	"MONGO_SERVER_SELECTION_TIMEOUT": durationSetting,
+	"MONGO_MAX_RETRIES":              intSetting,
+	"MONGO_RETRY_BACKOFF":            durationSetting,
+	"CASSANDRA_CONSISTENCY":          {kind: "string", allowed: []string{"ANY", "ONE", "TWO", "THREE", "QUORUM", "ALL", "LOCAL_QUORUM", "EACH_QUORUM", "LOCAL_ONE"}},
+	"CASSANDRA_LOCAL_DC":             stringSetting,
+	"CASSANDRA_REPLICATION_FACTOR":   intSetting,
+	"CASSANDRA_BATCH_SIZE":           intSetting,
+	"CASSANDRA_TIMEOUT":              durationSetting,
+	"SEGMENTS_URL":                   stringSetting,
+	"SEGMENTS_REFRESH":               durationSetting,
+	"SEGMENTS_CACHE_SIZE":            reloadable(intSetting),
+	"FINGERPRINT_INDEX_DIR":          stringSetting,
+	"FINGERPRINT_INDEX_REFRESH":      durationSetting,
+	"S3_ENDPOINT":                    stringSetting,
+	"AWS_REGION":                     stringSetting,
+	"AWS_ACCESS_KEY_ID":              stringSetting,
+	"AWS_SECRET_ACCESS_KEY":          stringSetting,
+	"AWS_SESSION_TOKEN":              stringSetting,
+
+	// Server
+	"PORT":                 intSetting,
+	"GRPC_PORT":            intSetting,
+	"CERT_KEY":             stringSetting,
+	"CERT_FILE":            stringSetting,
+	"SHUTDOWN_TIMEOUT":     durationSetting,
+	"PUBLIC_URL":           stringSetting,
+	"MIC_INPUT_FORMAT":     stringSetting,
+	"MIC_DEVICE":           stringSetting,
+	"MIC_WINDOW":           durationSetting,
+	"MIC_INTERVAL":         durationSetting,
+	"MONITOR_STREAMS":      stringSetting,
+	"MONITOR_WINDOW":       durationSetting,
+	"MONITOR_INTERVAL":     durationSetting,
+	"REQUIRE_API_KEY":      boolSetting,
+	"API_KEY_RATE_LIMIT":   reloadable(intSetting),
+	"ANONYMOUS_RATE_LIMIT": reloadable(intSetting),
+	"ADMIN_API_KEYS":       reloadable(stringSetting),
+	"INGEST_WORKERS":       intSetting,
+	"INGEST_QUEUE_SIZE":    intSetting,
+	"JOB_RETENTION":        durationSetting,
+	"UPLOAD_MAX_SIZE":      intSetting,
+	"UPLOAD_TIMEOUT":       durationSetting,
+	"WEBHOOK_URLS":         stringSetting,
+	"WEBHOOK_SECRET":       stringSetting,
+	"WEBHOOK_EVENTS":       stringSetting,
+	"WEBHOOK_TIMEOUT":      durationSetting,
+	"WEBHOOK_MAX_ATTEMPTS": intSetting,
+
+	// Chat bots
+	"DISCORD_PUBLIC_KEY":     stringSetting,
+	"DISCORD_APPLICATION_ID": stringSetting,
+	"DISCORD_BOT_TOKEN":      stringSetting,
+	"TELEGRAM_BOT_TOKEN":     stringSetting,
+
+	// Directories
+	"SONGS_DIR":            stringSetting,
+	"DEBUG_DIR":            stringSetting,
+	"AUDIO_CACHE_DIR":      stringSetting,
+	"AUDIO_CACHE_MAX_SIZE": intSetting,
+	"COVERS_DIR":           stringSetting,
+
+	// Logging
+	"LOG_LEVEL":  reloadable(setting{kind: "string", allowed: []string{"debug", "info", "warn", "error"}}),
+	"LOG_FORMAT": {kind: "string", allowed: []string{"json", "text"}},
+
+	// Fingerprinting
+	"FINGERPRINT_WINDOW_SIZE":      intSetting,
+	"FINGERPRINT_HOP_SIZE":         intSetting,
+	"FINGERPRINT_DOWNSAMPLE_RATIO": intSetting,
+	"FINGERPRINT_MAX_FREQ":         floatSetting,
+	"FINGERPRINT_TARGET_ZONE_SIZE": intSetting,
+	"FINGERPRINT_FREQ_BITS":        intSetting,
+	"FINGERPRINT_DELTA_BITS":       intSetting,
+	"FINGERPRINT_PEAK_PICKING":     {kind: "string", allowed: []string{"adaptive"}},
+	"FINGERPRINT_PEAK_SENSITIVITY": floatSetting,
+	"FINGERPRINT_FRAMING":          {kind: "string", allowed: []string{"hop", "legacy"}},
+
+	// Recognition
+	"SCORING_BIN_MS":                 reloadable(intSetting),
+	"SCORING_MIN_ALIGNED_HASHES":     reloadable(intSetting),
+	"SCORING_MAX_SPEED_CHANGE":       reloadable(floatSetting),
+	"SCORING_SPEED_STEP":             reloadable(floatSetting),
+	"SCORING_SEGMENT_SECONDS":        reloadable(floatSetting),
+	"SCORING_SEGMENT_MIN_CONFIDENCE": reloadable(floatSetting),
+	"RECOGNITION_TIMEOUT":            reloadable(durationSetting),
+	"RECOGNITION_CONCURRENCY":        intSetting,
+	"RECOGNITION_QUEUE_SIZE":         reloadable(intSetting),
+	"RECOGNITION_QUEUE_TIMEOUT":      reloadable(durationSetting),
+
+	// Preprocessing
+	"PREPROCESS_NORMALIZE":         reloadable(boolSetting),
+	"PREPROCESS_TARGET_LEVEL":      reloadable(floatSetting),
+	"PREPROCESS_TRIM_SILENCE":      reloadable(boolSetting),
+	"PREPROCESS_SILENCE_THRESHOLD": reloadable(floatSetting),
+	"PREPROCESS_SONG_FILTERS":      reloadable(stringSetting),
+	"PREPROCESS_RECORDING_FILTERS": reloadable(stringSetting),
+
+	// Downloads and metadata
+	"SOUNDCLOUD_CLIENT_ID":   stringSetting,
+	"SPOTIFY_CLIENT_ID":      stringSetting,
+	"SPOTIFY_CLIENT_SECRET":  stringSetting,
+	"METADATA_PROVIDER":      {kind: "string", allowed: []string{"spotify", "itunes", "none"}},
+	"ITUNES_COUNTRY":         stringSetting,
+	"MUSICBRAINZ_USER_AGENT": stringSetting,
+
+	// AcoustID
+	"ACOUSTID_API_KEY": stringSetting,
+	"FPCALC_PATH":      stringSetting,
+
+	// YouTube downloads
+	"YOUTUBE_DOWNLOADERS":       stringSetting,
+	"YTDLP_PATH":                stringSetting,
+	"YOUTUBE_CONCURRENCY":       intSetting,
+	"YOUTUBE_DOWNLOAD_INTERVAL": durationSetting,
+}
@@ -0,0 +1,100 @@
+// Package couplecodec encodes the couples stored under a fingerprint
+// address, their song ID and anchor time, for the backends that keep every
+// couple of an address in one value. Couples are encoded one after the
+// other without a header, so a value grows by appending the encoded
+// couples of a new song to it, without reading it first.
+//
+// Two encodings are provided. The fixed one takes 8 bytes per couple and
+// can be searched without decoding. The varint one takes 4 to 6 bytes per
+// couple for the song IDs and recording lengths of usual catalogs, and 10
+// at most.
+package couplecodec
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"song-recognition/models"
+)
+
+// FixedSize is the size of a couple in the fixed encoding
+const FixedSize = 8
+
+// ErrCorrupt is returned when decoding bytes that aren't encoded couples
+var ErrCorrupt = errors.New("corrupt couples")
+
+// AppendFixed appends couple to dst in the fixed encoding: its anchor time
+// and its song ID, big-endian, in 4 bytes each
+func AppendFixed(dst []byte, couple models.Couple) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, couple.AnchorTimeMs)
+	return binary.BigEndian.AppendUint32(dst, couple.SongID)
+}
+
+// DecodeFixed decodes the couples of data, encoded with AppendFixed
+func DecodeFixed(data []byte) ([]models.Couple, error) {
+	if len(data)%FixedSize != 0 {
+		return nil, ErrCorrupt
+	}
+
+	couples := make([]models.Couple, 0, len(data)/FixedSize)
+	for i := 0; i < len(data); i += FixedSize {
+		couples = append(couples, models.Couple{
+			AnchorTimeMs: binary.BigEndian.Uint32(data[i:]),
+			SongID:       binary.BigEndian.Uint32(data[i+4:]),
+		})
+	}
+	return couples, nil
+}
+
+// AppendVarint appends couple to dst in the varint encoding: the uvarints
+// of its song ID and of its anchor time
+func AppendVarint(dst []byte, couple models.Couple) []byte {
+	dst = binary.AppendUvarint(dst, uint64(couple.SongID))
+	return binary.AppendUvarint(dst, uint64(couple.AnchorTimeMs))
+}
+
+// DecodeVarint decodes the couples of data, encoded with AppendVarint
+func DecodeVarint(data []byte) ([]models.Couple, error) {
+	// Couples take at least 2 bytes
+	couples := make([]models.Couple, 0, len(data)/4)
+	for len(data) > 0 {
+		songID, n := decodeUint32(data)
+		if n <= 0 {
+			return nil, ErrCorrupt
+		}
+		data = data[n:]
+
+		anchorTimeMs, n := decodeUint32(data)
+		if n <= 0 {
+			return nil, ErrCorrupt
+		}
+		data = data[n:]
+
+		couples = append(couples, models.Couple{SongID: songID, AnchorTimeMs: anchorTimeMs})
+	}
+	return couples, nil
+}
+
+// decodeUint32 decodes a uvarint from data like binary.Uvarint, and fails
+// the same way if it doesn't fit in 32 bits
+func decodeUint32(data []byte) (uint32, int) {
+	value, n := binary.Uvarint(data)
+	if n > 0 && value > math.MaxUint32 {
+		return 0, -n
+	}
+	return uint32(value), n
+}
+
+// Unique sorts couples by song ID and anchor time and drops the repeated
+// ones, which appending the same couple twice leaves, in place
+func Unique(couples []models.Couple) []models.Couple {
+	slices.SortFunc(couples, func(a, b models.Couple) int {
+		if c := cmp.Compare(a.SongID, b.SongID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs)
+	})
+	return slices.Compact(couples)
+}
@@ -0,0 +1,136 @@
+package couplecodec
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"slices"
+	"song-recognition/models"
+	"testing"
+)
+
+// testCouples are couples at the edges of both encodings
+var testCouples = []models.Couple{
+	{SongID: 0, AnchorTimeMs: 0},
+	{SongID: 1, AnchorTimeMs: 127},
+	{SongID: 128, AnchorTimeMs: 16384},
+	{SongID: 1 << 21, AnchorTimeMs: 1 << 28},
+	{SongID: math.MaxUint32, AnchorTimeMs: math.MaxUint32},
+}
+
+func TestRoundTrip(t *testing.T) {
+	encodings := []struct {
+		name   string
+		append func(dst []byte, couple models.Couple) []byte
+		decode func(data []byte) ([]models.Couple, error)
+	}{
+		{"fixed", AppendFixed, DecodeFixed},
+		{"varint", AppendVarint, DecodeVarint},
+	}
+
+	for _, encoding := range encodings {
+		var data []byte
+		for _, couple := range testCouples {
+			data = encoding.append(data, couple)
+		}
+		couples, err := encoding.decode(data)
+		if err != nil {
+			t.Errorf("%s: %v", encoding.name, err)
+		} else if !slices.Equal(couples, testCouples) {
+			t.Errorf("%s: decoded %v, want %v", encoding.name, couples, testCouples)
+		}
+
+		if couples, err := encoding.decode(nil); err != nil || len(couples) != 0 {
+			t.Errorf("%s: decoding nothing returned %v, error %v", encoding.name, couples, err)
+		}
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(data []byte) ([]models.Couple, error)
+		data   []byte
+	}{
+		{"fixed, short couple", DecodeFixed, []byte{1, 2, 3}},
+		{"fixed, couple and a half", DecodeFixed, make([]byte, FixedSize+4)},
+		{"varint, truncated song ID", DecodeVarint, []byte{0x80}},
+		{"varint, missing anchor time", DecodeVarint, []byte{1}},
+		{"varint, truncated anchor time", DecodeVarint, []byte{1, 0xff, 0xff}},
+		{"varint, song ID over 32 bits", DecodeVarint, []byte{0x80, 0x80, 0x80, 0x80, 0x10, 1}},
+		{"varint, anchor time over 32 bits", DecodeVarint, []byte{1, 0xff, 0xff, 0xff, 0xff, 0x1f}},
+		{"varint, over 64 bits", DecodeVarint, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1}},
+	}
+
+	for _, test := range tests {
+		if couples, err := test.decode(test.data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: returned %v, error %v, want ErrCorrupt", test.name, couples, err)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	couples := []models.Couple{{SongID: 2, AnchorTimeMs: 1}, {SongID: 1, AnchorTimeMs: 5}, {SongID: 2, AnchorTimeMs: 1}, {SongID: 1, AnchorTimeMs: 3}}
+	want := []models.Couple{{SongID: 1, AnchorTimeMs: 3}, {SongID: 1, AnchorTimeMs: 5}, {SongID: 2, AnchorTimeMs: 1}}
+	if got := Unique(couples); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// encodeSeeds adds the encoding of testCouples, along with truncated and
+// corrupt values, to the corpus of f
+func encodeSeeds(f *testing.F, appendCouple func(dst []byte, couple models.Couple) []byte) {
+	var data []byte
+	for _, couple := range testCouples {
+		data = appendCouple(data, couple)
+	}
+	f.Add(data)
+	f.Add(data[:len(data)-1])
+	f.Add([]byte{})
+	f.Add([]byte{0x80, 0x80, 0x80, 0x80, 0x10, 1})
+}
+
+func FuzzDecodeFixed(f *testing.F) {
+	encodeSeeds(f, AppendFixed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		couples, err := DecodeFixed(data)
+		if err != nil {
+			return
+		}
+
+		// Every value of the right length is valid, and encodes one way
+		var encoded []byte
+		for _, couple := range couples {
+			encoded = AppendFixed(encoded, couple)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Errorf("decoded %v, which encodes to %x instead of %x", couples, encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeVarint(f *testing.F) {
+	encodeSeeds(f, AppendVarint)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		couples, err := DecodeVarint(data)
+		if err != nil {
+			return
+		}
+
+		// Uvarints padded with zero groups decode too, so the couples are
+		// compared rather than the bytes
+		var encoded []byte
+		for _, couple := range couples {
+			encoded = AppendVarint(encoded, couple)
+		}
+		decoded, err := DecodeVarint(encoded)
+		if err != nil {
+			t.Fatalf("couples %v encode to %x, which fails to decode: %v", couples, encoded, err)
+		}
+		if !slices.Equal(decoded, couples) {
+			t.Errorf("couples %v decode to %v once encoded again", couples, decoded)
+		}
+	})
+}
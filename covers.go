@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+)
+
+// COVERS_DIR is where the artwork embedded in saved audio files is kept.
+// Set with COVERS_DIR.
+var COVERS_DIR = utils.GetEnv("COVERS_DIR", "covers")
+
+// coverNamePattern matches the names covers are stored under
+var coverNamePattern = regexp.MustCompile(`^[0-9a-f]{32}\.(jpg|png)$`)
+
+// saveFileCover stores the artwork embedded in the audio file described by
+// metadata and returns its URL, or "" if the file has none. Covers are named
+// after a hash of their image, so the tracks of an album share theirs.
+func saveFileCover(filePath string, metadata wav.FFmpegMetadata) (string, error) {
+	stream, ext, ok := metadata.Picture()
+	if !ok {
+		return "", nil
+	}
+	image, err := wav.ExtractPicture(filePath, stream, ext)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(image)
+	name := hex.EncodeToString(sum[:16]) + ext
+	coverPath := filepath.Join(COVERS_DIR, name)
+	if _, err := os.Stat(coverPath); os.IsNotExist(err) {
+		if err := utils.CreateFolder(COVERS_DIR); err != nil {
+			return "", err
+		}
+		tmpPath := coverPath + ".tmp"
+		if err := os.WriteFile(tmpPath, image, 0644); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, coverPath); err != nil {
+			return "", err
+		}
+	}
+
+	// Covers are served by this server, so clients elsewhere need its
+	// address to load them
+	return strings.TrimSuffix(utils.GetEnv("PUBLIC_URL", ""), "/") + "/api/covers/" + name, nil
+}
+
+// handleAPICover serves GET /api/covers/{name}, the artwork of songs saved
+// from files
+func handleAPICover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/covers/")
+	if !coverNamePattern.MatchString(name) {
+		writeJSONError(w, http.StatusNotFound, "cover not found")
+		return
+	}
+	coverPath := filepath.Join(COVERS_DIR, name)
+	if _, err := os.Stat(coverPath); err != nil {
+		writeJSONError(w, http.StatusNotFound, "cover not found")
+		return
+	}
+
+	// A name is a hash of the image, so it never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, coverPath)
+}
+
+// hasAbsoluteURL reports whether a cover URL can be given to services
+// outside the server, which can't load covers served under a relative URL
+// when PUBLIC_URL is unset
+func hasAbsoluteURL(coverURL string) bool {
+	return strings.HasPrefix(coverURL, "http://") || strings.HasPrefix(coverURL, "https://")
+}
@@ -0,0 +1,245 @@
+// Package degrade makes test queries out of songs by simulating what
+// happens to a song between the speaker and the microphone of a recording:
+// background noise, room reverb, the frequency response of small speakers
+// and microphones, clipping, and the speed changes of DJ sets and edits.
+package degrade
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"song-recognition/wav"
+	"strings"
+)
+
+// Conditions are the conditions Query simulates: the song as is, each
+// degradation alone, and several of them at once
+var Conditions = []string{"clean", "noise", "reverb", "eq", "clipped", "speed", "mixed"}
+
+// Query cuts a clip of seconds at a random position of samples, the mono
+// audio of a song at sampleRate, and degrades it as recorded in condition,
+// one of Conditions, with strengths drawn from r. It returns the clip along
+// with a description of where it was cut from and what was done to it.
+func Query(samples []float64, sampleRate int, seconds float64, condition string, r *rand.Rand) ([]float64, string, error) {
+	noise := condition == "noise"
+	reverb := condition == "reverb"
+	eq := condition == "eq"
+	clipped := condition == "clipped"
+	speed := condition == "speed"
+	switch condition {
+	case "clean", "noise", "reverb", "eq", "clipped", "speed":
+	case "mixed":
+		// Two to four of them
+		picks := r.Perm(5)[:2+r.Intn(3)]
+		for _, pick := range picks {
+			switch pick {
+			case 0:
+				noise = true
+			case 1:
+				reverb = true
+			case 2:
+				eq = true
+			case 3:
+				clipped = true
+			case 4:
+				speed = true
+			}
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown condition %q, want one of %s", condition, strings.Join(Conditions, ", "))
+	}
+
+	factor := 1.0
+	if speed {
+		// 2 to 6% faster or slower
+		factor = 1 + (0.02+0.04*r.Float64())*float64(1-2*r.Intn(2))
+	}
+
+	// A faster clip is cut longer, so it lasts seconds once sped up
+	length := min(int(seconds*factor*float64(sampleRate)), len(samples))
+	start := 0
+	if len(samples) > length {
+		start = r.Intn(len(samples) - length + 1)
+	}
+	clip := append([]float64(nil), samples[start:start+length]...)
+	details := []string{fmt.Sprintf("from %.1fs", float64(start)/float64(sampleRate))}
+
+	if speed {
+		var err error
+		if clip, err = ChangeSpeed(clip, sampleRate, factor); err != nil {
+			return nil, "", err
+		}
+		details = append(details, fmt.Sprintf("%+.1f%% speed", (factor-1)*100))
+	}
+	if eq {
+		low, high := 200+400*r.Float64(), 2500+2500*r.Float64()
+		clip = Equalize(clip, sampleRate, low, high)
+		details = append(details, fmt.Sprintf("%.0f-%.0f Hz", low, high))
+	}
+	if reverb {
+		decay, wet := 0.3+1.2*r.Float64(), 0.2+0.4*r.Float64()
+		clip = Reverb(clip, sampleRate, decay, wet)
+		details = append(details, fmt.Sprintf("%.1fs reverb, %.0f%% wet", decay, wet*100))
+	}
+	if noise {
+		snr := 10 * r.Float64()
+		clip = Noise(clip, snr, r)
+		details = append(details, fmt.Sprintf("noise at %.1f dB SNR", snr))
+	}
+	if clipped {
+		gain := 6 + 14*r.Float64()
+		clip = Clip(clip, gain)
+		details = append(details, fmt.Sprintf("clipped with %.1f dB gain", gain))
+	} else {
+		normalize(clip)
+	}
+
+	return clip, strings.Join(details, ", "), nil
+}
+
+// Noise returns samples with white noise added, snrDB decibels below their
+// level
+func Noise(samples []float64, snrDB float64, r *rand.Rand) []float64 {
+	level := rms(samples) / math.Pow(10, snrDB/20)
+	out := make([]float64, len(samples))
+	for i, sample := range samples {
+		out[i] = sample + level*r.NormFloat64()
+	}
+	return out
+}
+
+// Reverb returns samples played in a room whose reverberation takes decay
+// seconds to fade by 60 dB, with wet, between 0 and 1, the share of
+// reverberated sound. It is a Schroeder reverberator: four parallel comb
+// filters followed by two all-pass filters.
+func Reverb(samples []float64, sampleRate int, decay, wet float64) []float64 {
+	wetSamples := make([]float64, len(samples))
+	for _, delayMs := range []float64{29.7, 37.1, 41.1, 43.7} {
+		delay := max(1, int(delayMs*float64(sampleRate)/1000))
+		// The gain that fades the comb by 60 dB in decay seconds
+		gain := math.Pow(10, -3*delayMs/1000/decay)
+		comb := make([]float64, len(samples))
+		for i, sample := range samples {
+			comb[i] = sample
+			if i >= delay {
+				comb[i] += gain * comb[i-delay]
+			}
+			wetSamples[i] += comb[i] / 4
+		}
+	}
+
+	for _, delayMs := range []float64{5, 1.7} {
+		delay := max(1, int(delayMs*float64(sampleRate)/1000))
+		const gain = 0.7
+		allPass := make([]float64, len(wetSamples))
+		for i, sample := range wetSamples {
+			allPass[i] = -gain * sample
+			if i >= delay {
+				allPass[i] += wetSamples[i-delay] + gain*allPass[i-delay]
+			}
+		}
+		wetSamples = allPass
+	}
+
+	// Comb filters add up to much more than the dry sound
+	scale := rms(samples) / max(rms(wetSamples), 1e-12)
+	out := make([]float64, len(samples))
+	for i, sample := range samples {
+		out[i] = (1-wet)*sample + wet*scale*wetSamples[i]
+	}
+	return out
+}
+
+// Equalize returns samples with the frequencies below lowCutHz and above
+// highCutHz filtered out, like played by a phone speaker or recorded by a
+// cheap microphone
+func Equalize(samples []float64, sampleRate int, lowCutHz, highCutHz float64) []float64 {
+	out := newBiquad(sampleRate, lowCutHz, true).filter(samples)
+	return newBiquad(sampleRate, highCutHz, false).filter(out)
+}
+
+// Clip returns samples amplified by gainDB decibels and clipped to [-1, 1],
+// like recorded too loud
+func Clip(samples []float64, gainDB float64) []float64 {
+	gain := math.Pow(10, gainDB/20) / max(peak(samples), 1e-12)
+	out := make([]float64, len(samples))
+	for i, sample := range samples {
+		out[i] = math.Max(-1, math.Min(1, sample*gain))
+	}
+	return out
+}
+
+// ChangeSpeed returns samples played factor times faster, which raises
+// their pitch as much, like a DJ speeding a record up
+func ChangeSpeed(samples []float64, sampleRate int, factor float64) ([]float64, error) {
+	if factor <= 0 {
+		return nil, fmt.Errorf("invalid speed factor %g", factor)
+	}
+	// Resampled to fewer samples, the clip is played faster at sampleRate
+	return wav.Resample(samples, sampleRate, int(math.Round(float64(sampleRate)/factor)))
+}
+
+// biquad is a second-order Butterworth filter, from the Audio EQ Cookbook
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// newBiquad returns a high-pass filter at cutoffHz if highPass is set, and
+// a low-pass filter otherwise
+func newBiquad(sampleRate int, cutoffHz float64, highPass bool) biquad {
+	w0 := 2 * math.Pi * math.Min(cutoffHz, 0.49*float64(sampleRate)) / float64(sampleRate)
+	alpha := math.Sin(w0) / (2 * math.Sqrt2 / 2)
+	cos := math.Cos(w0)
+	a0 := 1 + alpha
+
+	f := biquad{a1: -2 * cos / a0, a2: (1 - alpha) / a0}
+	if highPass {
+		f.b0 = (1 + cos) / 2 / a0
+		f.b1 = -(1 + cos) / a0
+	} else {
+		f.b0 = (1 - cos) / 2 / a0
+		f.b1 = (1 - cos) / a0
+	}
+	f.b2 = f.b0
+	return f
+}
+
+func (f biquad) filter(samples []float64) []float64 {
+	out := make([]float64, len(samples))
+	var x1, x2, y1, y2 float64
+	for i, x := range samples {
+		y := f.b0*x + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		x2, x1 = x1, x
+		y2, y1 = y1, y
+		out[i] = y
+	}
+	return out
+}
+
+// normalize scales samples down in place so that none is louder than 1
+func normalize(samples []float64) {
+	if p := peak(samples); p > 1 {
+		for i := range samples {
+			samples[i] /= p
+		}
+	}
+}
+
+func peak(samples []float64) float64 {
+	p := 0.0
+	for _, sample := range samples {
+		p = math.Max(p, math.Abs(sample))
+	}
+	return p
+}
+
+func rms(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, sample := range samples {
+		sum += sample * sample
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+var (
+	// discordPublicKey is the hex encoded public key of the Discord
+	// application, which signs the interactions Discord posts. The bot is
+	// enabled when it is set. Set with DISCORD_PUBLIC_KEY.
+	discordPublicKey = utils.GetEnv("DISCORD_PUBLIC_KEY")
+
+	// discordApplicationID and discordBotToken register the commands of
+	// the bot on startup when both are set. Set with
+	// DISCORD_APPLICATION_ID and DISCORD_BOT_TOKEN.
+	discordApplicationID = utils.GetEnv("DISCORD_APPLICATION_ID")
+	discordBotToken      = utils.GetEnv("DISCORD_BOT_TOKEN")
+)
+
+const (
+	discordAPI = "https://discord.com/api/v10"
+
+	// discordRecognitionTimeout bounds downloading and recognizing an
+	// attachment. Interaction tokens last 15 minutes.
+	discordRecognitionTimeout = 2 * time.Minute
+
+	// Names of the commands of the bot
+	discordRecognizeCommand        = "recognize"
+	discordRecognizeMessageCommand = "Recognize song"
+)
+
+// Discord interaction, command and response types
+const (
+	discordInteractionPing    = 1
+	discordInteractionCommand = 2
+
+	discordSlashCommand   = 1
+	discordMessageCommand = 3
+
+	discordAttachmentOption = 11
+
+	discordResponsePong             = 1
+	discordResponseMessage          = 4
+	discordResponseDeferredMessage  = 5
+	discordEphemeralFlag            = 1 << 6
+	discordEmbedColor               = 0x1db954
+	discordMaxEmbedFieldValueLength = 1024
+)
+
+var discordClient = &http.Client{Timeout: 30 * time.Second}
+
+// discordInteraction is the part of a Discord interaction the bot reads
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	Data          struct {
+		Name     string `json:"name"`
+		Type     int    `json:"type"`
+		TargetID string `json:"target_id"`
+		Options  []struct {
+			Name  string          `json:"name"`
+			Type  int             `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]discordAttachment `json:"attachments"`
+			Messages    map[string]struct {
+				Attachments []discordAttachment `json:"attachments"`
+			} `json:"messages"`
+		} `json:"resolved"`
+	} `json:"data"`
+	// Member is set in servers and User in direct messages
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User *discordUser `json:"user"`
+}
+
+type discordUser struct {
+	ID string `json:"id"`
+}
+
+type discordAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// discordMessage is the content of a message the bot sends
+type discordMessage struct {
+	Content string         `json:"content"`
+	Embeds  []discordEmbed `json:"embeds,omitempty"`
+	Flags   int            `json:"flags,omitempty"`
+}
+
+type discordEmbed struct {
+	Title     string                `json:"title"`
+	URL       string                `json:"url,omitempty"`
+	Color     int                   `json:"color"`
+	Thumbnail *discordEmbedImage    `json:"thumbnail,omitempty"`
+	Fields    []discordEmbedField   `json:"fields,omitempty"`
+	Footer    *discordEmbedFootnote `json:"footer,omitempty"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbedFootnote struct {
+	Text string `json:"text"`
+}
+
+// registerDiscordBot serves the interactions endpoint of the Discord bot
+// on mux when DISCORD_PUBLIC_KEY is set, and registers its commands with
+// Discord when the application ID and bot token are set too
+func registerDiscordBot(mux *http.ServeMux) error {
+	if discordPublicKey == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(discordPublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid DISCORD_PUBLIC_KEY, expected the hex encoded public key of the application")
+	}
+
+	// Discord signs its requests instead of sending an API key
+	mux.HandleFunc("/api/discord/interactions", withRequestID(func(w http.ResponseWriter, r *http.Request) {
+		handleDiscordInteraction(w, r, ed25519.PublicKey(key))
+	}))
+
+	if discordApplicationID != "" && discordBotToken != "" {
+		if err := registerDiscordCommands(); err != nil {
+			logger := utils.GetLogger()
+			logger.Error("failed to register Discord commands.", slog.Any("error", xerrors.New(err)))
+		}
+	}
+	return nil
+}
+
+// registerDiscordCommands replaces the global commands of the application
+// with those of the bot: a /recognize command taking an audio attachment,
+// and a message command recognizing the audio attached to a message
+func registerDiscordCommands() error {
+	commands := []map[string]interface{}{
+		{
+			"name":        discordRecognizeCommand,
+			"type":        discordSlashCommand,
+			"description": "Recognize the song in an audio file",
+			"options": []map[string]interface{}{{
+				"name":        "audio",
+				"description": "Recording of the song",
+				"type":        discordAttachmentOption,
+				"required":    true,
+			}},
+		},
+		{
+			"name": discordRecognizeMessageCommand,
+			"type": discordMessageCommand,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return discordRequest(ctx, http.MethodPut, fmt.Sprintf("/applications/%s/commands", discordApplicationID), commands, true)
+}
+
+// handleDiscordInteraction serves POST /api/discord/interactions, where
+// Discord posts the commands users send to the bot. Recognitions take
+// longer than the 3 seconds Discord waits for a response, so the bot
+// answers that it is thinking and edits its answer once the attachment is
+// recognized.
+func handleDiscordInteraction(w http.ResponseWriter, r *http.Request, publicKey ed25519.PublicKey) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || !ed25519.Verify(publicKey, append([]byte(timestamp), body...), signature) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid request signature")
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid interaction")
+		return
+	}
+
+	switch interaction.Type {
+	case discordInteractionPing:
+		writeJSON(w, http.StatusOK, map[string]int{"type": discordResponsePong})
+		return
+	case discordInteractionCommand:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "unsupported interaction type")
+		return
+	}
+
+	attachment, ok := interaction.attachment()
+	if !ok {
+		writeDiscordMessage(w, discordResponseMessage, discordMessage{
+			Content: "Attach an audio file to recognize.",
+			Flags:   discordEphemeralFlag,
+		})
+		return
+	}
+	if attachment.Size > maxRecordingSize {
+		writeDiscordMessage(w, discordResponseMessage, discordMessage{
+			Content: fmt.Sprintf("Couldn't recognize %s: %v.", attachment.Filename, errRecordingTooLarge),
+			Flags:   discordEphemeralFlag,
+		})
+		return
+	}
+
+	userID := interaction.userID()
+	if allowed, wait := allowRecognition(ctx, "discord:"+userID); !allowed {
+		writeDiscordMessage(w, discordResponseMessage, discordMessage{
+			Content: fmt.Sprintf("Too many recognitions, try again in %v.", wait.Round(time.Second)),
+			Flags:   discordEphemeralFlag,
+		})
+		return
+	}
+
+	// Recognitions are tracked like jobs, so that shutdown waits for them
+	jobCtx, done, err := jobs.start(context.Background())
+	if err != nil {
+		writeDiscordMessage(w, discordResponseMessage, discordMessage{
+			Content: "The server is shutting down, try again later.",
+			Flags:   discordEphemeralFlag,
+		})
+		return
+	}
+	jobCtx = utils.WithRequestID(jobCtx, utils.RequestIDFromContext(ctx))
+	jobCtx = utils.WithClientID(jobCtx, "discord:"+userID)
+
+	logger.InfoContext(ctx, "recognizing Discord attachment.", slog.String("file", attachment.Filename), slog.Int64("size", attachment.Size))
+	writeDiscordMessage(w, discordResponseDeferredMessage, discordMessage{})
+
+	go func() {
+		defer done()
+		ctx, cancel := context.WithTimeout(jobCtx, discordRecognitionTimeout)
+		defer cancel()
+
+		reply := recognizeDiscordAttachment(ctx, attachment)
+		path := fmt.Sprintf("/webhooks/%s/%s/messages/@original", interaction.ApplicationID, interaction.Token)
+		if err := discordRequest(ctx, http.MethodPatch, path, reply, false); err != nil {
+			logger.ErrorContext(ctx, "failed to send Discord reply.", slog.Any("error", xerrors.New(err)))
+		}
+	}()
+}
+
+// attachment returns the audio file of a command: the attachment option of
+// /recognize, or the first audio or video attachment of the message a
+// message command targets
+func (i *discordInteraction) attachment() (discordAttachment, bool) {
+	switch i.Data.Type {
+	case discordSlashCommand:
+		for _, option := range i.Data.Options {
+			if option.Type != discordAttachmentOption {
+				continue
+			}
+			var id string
+			if err := json.Unmarshal(option.Value, &id); err != nil {
+				return discordAttachment{}, false
+			}
+			attachment, ok := i.Data.Resolved.Attachments[id]
+			return attachment, ok
+		}
+	case discordMessageCommand:
+		for _, attachment := range i.Data.Resolved.Messages[i.Data.TargetID].Attachments {
+			if strings.HasPrefix(attachment.ContentType, "audio/") || strings.HasPrefix(attachment.ContentType, "video/") {
+				return attachment, true
+			}
+		}
+	}
+	return discordAttachment{}, false
+}
+
+// userID returns the ID of the user who sent the interaction
+func (i *discordInteraction) userID() string {
+	if i.Member != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// recognizeDiscordAttachment recognizes an attachment and returns the
+// reply describing its best match
+func recognizeDiscordAttachment(ctx context.Context, attachment discordAttachment) discordMessage {
+	logger := utils.GetLogger()
+
+	matches, err := recognizeRemoteFile(ctx, discordClient, attachment.URL, attachment.Filename)
+	switch {
+	case errors.Is(err, errRecordingTooLarge), errors.Is(err, errUnsupportedAudio), errors.Is(err, shazam.ErrTimedOut), errors.Is(err, errServerBusy):
+		return discordMessage{Content: fmt.Sprintf("Couldn't recognize %s: %v.", attachment.Filename, err)}
+	case err != nil:
+		logger.ErrorContext(ctx, "failed to recognize Discord attachment.", slog.Any("error", xerrors.New(err)))
+		return discordMessage{Content: fmt.Sprintf("Couldn't recognize %s, try again later.", attachment.Filename)}
+	case len(matches) == 0:
+		return discordMessage{Content: fmt.Sprintf("No song matches %s.", attachment.Filename)}
+	}
+
+	return discordMessage{Embeds: []discordEmbed{discordMatchEmbed(matches)}}
+}
+
+// discordMatchEmbed describes the best of matches, listing the next ones
+func discordMatchEmbed(matches []shazam.Match) discordEmbed {
+	best := matches[0]
+	embed := discordEmbed{
+		Title: best.SongTitle,
+		Color: discordEmbedColor,
+		Fields: []discordEmbedField{
+			{Name: "Artist", Value: best.SongArtist, Inline: true},
+			{Name: "Confidence", Value: fmt.Sprintf("%.0f%%", best.Confidence*100), Inline: true},
+			{Name: "Position", Value: formatOffset(best.OffsetMs), Inline: true},
+		},
+	}
+	if best.YouTubeID != "" {
+		embed.URL = "https://www.youtube.com/watch?v=" + best.YouTubeID
+	}
+	if hasAbsoluteURL(best.CoverURL) {
+		embed.Thumbnail = &discordEmbedImage{URL: best.CoverURL}
+	}
+	if best.Album != "" {
+		embed.Footer = &discordEmbedFootnote{Text: best.Album}
+	}
+
+	var others []string
+	for _, match := range matches[1:min(len(matches), 4)] {
+		line := fmt.Sprintf("%s - %s (%.0f%%)", match.SongArtist, match.SongTitle, match.Confidence*100)
+		if len(strings.Join(append(others, line), "\n")) > discordMaxEmbedFieldValueLength {
+			break
+		}
+		others = append(others, line)
+	}
+	if len(others) > 0 {
+		embed.Fields = append(embed.Fields, discordEmbedField{Name: "Also close", Value: strings.Join(others, "\n")})
+	}
+	return embed
+}
+
+// writeDiscordMessage responds to an interaction
+func writeDiscordMessage(w http.ResponseWriter, responseType int, message discordMessage) {
+	response := map[string]interface{}{"type": responseType}
+	if responseType == discordResponseMessage {
+		response["data"] = message
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// discordRequest sends a request with a JSON body to the Discord API,
+// authenticated with the bot token if authenticate is set. Interaction
+// webhooks are authenticated by their token instead.
+func discordRequest(ctx context.Context, method, path string, body interface{}, authenticate bool) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, discordAPI+path, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authenticate {
+		req.Header.Set("Authorization", "Bot "+discordBotToken)
+	}
+
+	resp, err := discordClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, message)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package events passes what happens to ingestion jobs and recognitions to
+// whoever follows them, such as socket and Server-Sent Events clients and
+// the logs, without the code they happen in knowing about them. Followers
+// of a job or request subscribe to its topic, while listeners get every
+// event.
+package events
+
+import (
+	"sync"
+)
+
+// Event is something that happened to an ingestion job or a recognition,
+// published under the topic of the job or of the request that made it
+type Event struct {
+	Topic string
+	// Type is the type of Payload: a protocol message type or one of the
+	// lifecycle event types
+	Type    string
+	Payload interface{}
+	// Final is set on the last event of the topic
+	Final bool
+	// RequestID and Catalog are those of the request or job the event
+	// happened in
+	RequestID string
+	Catalog   string
+}
+
+// JobTopic returns the topic of the events of an ingestion job
+func JobTopic(jobID string) string {
+	return "job:" + jobID
+}
+
+// RequestTopic returns the topic of the recognitions made by a request in
+// a catalog. Clients pick their own request IDs, so the catalog keeps
+// other catalogs from following them.
+func RequestTopic(catalog, requestID string) string {
+	return "request:" + catalog + ":" + requestID
+}
+
+// subscriptionBuffer is the number of events a subscription holds until its
+// subscriber reads them
+const subscriptionBuffer = 16
+
+// Bus delivers the events published under a topic to its subscribers
+type Bus struct {
+	mu            sync.Mutex
+	subscriptions map[string]map[*Subscription]bool
+}
+
+// NewBus returns a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{subscriptions: make(map[string]map[*Subscription]bool)}
+}
+
+// Subscription receives the events of a topic on C until it is closed
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	bus    *Bus
+	topic  string
+	closed bool // guarded by bus.mu
+}
+
+// Subscribe returns a subscription to the events of topic published from
+// now on
+func (b *Bus) Subscribe(topic string) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, bus: b, topic: topic}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscriptions[topic] == nil {
+		b.subscriptions[topic] = make(map[*Subscription]bool)
+	}
+	b.subscriptions[topic][s] = true
+	return s
+}
+
+// Publish delivers event to the subscribers of its topic. It never blocks:
+// a subscriber that falls behind loses its oldest events, since the latest
+// ones tell where a job or recognition is at.
+func (b *Bus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subscriptions[event.Topic] {
+		for {
+			select {
+			case s.c <- event:
+			default:
+				select {
+				case <-s.c:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Close stops the subscription and closes C
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(b.subscriptions[s.topic], s)
+	if len(b.subscriptions[s.topic]) == 0 {
+		delete(b.subscriptions, s.topic)
+	}
+	close(s.c)
+}
+
+// bus is the bus of the server
+var bus = NewBus()
+
+// Subscribe subscribes to topic on the bus of the server
+func Subscribe(topic string) *Subscription {
+	return bus.Subscribe(topic)
+}
+
+// Publish publishes event on the bus of the server, and passes it to the
+// listeners
+func Publish(event Event) {
+	bus.Publish(event)
+	notify(event)
+}
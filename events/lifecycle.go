@@ -0,0 +1,115 @@
+package events
+
+import (
+	"context"
+	"song-recognition/utils"
+	"sync"
+)
+
+// Types of the events the subsystems publish as songs are saved and
+// recognized, along with the protocol messages of the transports. Each
+// names its payload type.
+const (
+	// SongDownloaded is published once the audio of a song is downloaded,
+	// before it is fingerprinted: Download
+	SongDownloaded = "song_downloaded"
+	// FingerprintsStored is published once a song is saved or reindexed
+	// with its fingerprints: Indexing
+	FingerprintsStored = "fingerprints_stored"
+	// MatchFound is published when a recognition matches a song: Match
+	MatchFound = "match_found"
+	// JobFailed is published when an ingestion job fails or is cancelled:
+	// JobFailure
+	JobFailed = "job_failed"
+)
+
+// Download is the payload of SongDownloaded
+type Download struct {
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	Source    string `json:"source"` // name of the audio source
+	SourceURL string `json:"sourceUrl,omitempty"`
+}
+
+// Indexing is the payload of FingerprintsStored
+type Indexing struct {
+	SongID       uint32 `json:"songId"`
+	Title        string `json:"title"`
+	Artist       string `json:"artist"`
+	Fingerprints int    `json:"fingerprints"`
+	// Reindexed is set when the song was already indexed and only its
+	// fingerprints were replaced
+	Reindexed bool `json:"reindexed,omitempty"`
+}
+
+// Match is the payload of MatchFound, the best match of a recognition
+type Match struct {
+	SongID     uint32  `json:"songId"`
+	Title      string  `json:"title"`
+	Artist     string  `json:"artist"`
+	Confidence float64 `json:"confidence"`
+	OffsetMs   uint32  `json:"offsetMs"`
+	ClientID   string  `json:"clientId,omitempty"`
+}
+
+// JobFailure is the payload of JobFailed
+type JobFailure struct {
+	JobID     string `json:"jobId"`
+	Source    string `json:"source"`
+	Error     string `json:"error"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+}
+
+type topicContextKey struct{}
+
+// WithTopic returns a context whose events are published under topic, such
+// as that of the job it runs
+func WithTopic(ctx context.Context, topic string) context.Context {
+	return context.WithValue(ctx, topicContextKey{}, topic)
+}
+
+// TopicFromContext returns the topic the events of ctx are published
+// under: the one set with WithTopic, or the topic of the request ID and
+// catalog of ctx
+func TopicFromContext(ctx context.Context) string {
+	if topic, ok := ctx.Value(topicContextKey{}).(string); ok {
+		return topic
+	}
+	return RequestTopic(utils.CatalogFromContext(ctx), utils.RequestIDFromContext(ctx))
+}
+
+// Emit publishes an event of eventType that happened in ctx on the bus of
+// the server
+func Emit(ctx context.Context, eventType string, payload interface{}) {
+	Publish(Event{
+		Topic:     TopicFromContext(ctx),
+		Type:      eventType,
+		Payload:   payload,
+		RequestID: utils.RequestIDFromContext(ctx),
+		Catalog:   utils.CatalogFromContext(ctx),
+	})
+}
+
+var (
+	listenersMu sync.RWMutex
+	listeners   []func(Event)
+)
+
+// Listen calls listener with every event published on the bus of the
+// server, whatever its topic, such as to log them. Listeners are called
+// by the publisher, which may hold locks, so they must not block; slow
+// work such as a request belongs in a goroutine.
+func Listen(listener func(Event)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// notify calls the listeners with event
+func notify(event Event) {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
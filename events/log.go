@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"song-recognition/utils"
+)
+
+// Log is a listener that logs the lifecycle events, along with the request
+// ID and catalog they happened in
+func Log(event Event) {
+	logger := utils.GetLogger()
+	ctx := utils.WithCatalog(utils.WithRequestID(context.Background(), event.RequestID), event.Catalog)
+
+	switch payload := event.Payload.(type) {
+	case Download:
+		logger.InfoContext(ctx, "song downloaded.",
+			slog.String("title", payload.Title),
+			slog.String("artist", payload.Artist),
+			slog.String("source", payload.Source),
+		)
+	case Indexing:
+		msg := "song saved."
+		if payload.Reindexed {
+			msg = "song reindexed."
+		}
+		logger.InfoContext(ctx, msg,
+			slog.Any("song_id", payload.SongID),
+			slog.String("title", payload.Title),
+			slog.String("artist", payload.Artist),
+			slog.Int("fingerprints", payload.Fingerprints),
+		)
+	case Match:
+		// Recognitions are logged when they finish
+		logger.DebugContext(ctx, "match found.",
+			slog.Any("song_id", payload.SongID),
+			slog.Float64("confidence", payload.Confidence),
+		)
+	case JobFailure:
+		logger.ErrorContext(ctx, "ingestion job failed.",
+			slog.String("job_id", payload.JobID),
+			slog.Bool("cancelled", payload.Cancelled),
+			slog.String("error", payload.Error),
+		)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"song-recognition/spotify"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultNamePattern is how the title and artist missing from the tags of
+// a file are read from its name by default
+const defaultNamePattern = "{artist} - {title}"
+
+// uploadFileOptions reads the songs uploaded without a title or artist,
+// whose file names are expected to follow the default pattern
+var uploadFileOptions = fileOptions{namePattern: mustCompileNamePattern(defaultNamePattern)}
+
+// errDeclined is returned for the files the user chose not to save
+var errDeclined = errors.New("declined")
+
+// fileOptions is how the songs of local files are read before saving them
+type fileOptions struct {
+	namePattern *regexp.Regexp // reads what the tags lack from the file name
+	confirm     bool           // asks the user to confirm every song
+}
+
+// namePatternFields are the placeholders of a file name pattern, {*}
+// matching anything, such as a track number
+var namePatternFields = regexp.MustCompile(`\{(title|artist|album|\*)\}`)
+
+// compileNamePattern turns a file name pattern such as "{artist} - {title}"
+// into a regexp with a group per placeholder. Everything else in the
+// pattern has to appear as it is in the file name, without its extension.
+func compileNamePattern(pattern string) (*regexp.Regexp, error) {
+	if !strings.Contains(pattern, "{title}") {
+		return nil, fmt.Errorf("file name pattern %q has no {title}", pattern)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := map[string]bool{}
+	last := 0
+	for _, loc := range namePatternFields.FindAllStringSubmatchIndex(pattern, -1) {
+		field := pattern[loc[2]:loc[3]]
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		last = loc[1]
+		if field == "*" {
+			expr.WriteString(".*?")
+			continue
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("file name pattern %q has {%s} twice", pattern, field)
+		}
+		seen[field] = true
+		fmt.Fprintf(&expr, "(?P<%s>.+?)", field)
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func mustCompileNamePattern(pattern string) *regexp.Regexp {
+	re, err := compileNamePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+var (
+	// promptMu keeps files indexed concurrently from asking at once
+	promptMu sync.Mutex
+	stdin    = bufio.NewReader(os.Stdin)
+)
+
+// confirmTrack shows what was read of the file at filePath and asks the
+// user whether to save it, letting them correct it first
+func confirmTrack(filePath string, track *spotify.Track) (bool, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	for {
+		fmt.Printf("\n%s\n", filePath)
+		fmt.Printf("  Title:  %s\n", track.Title)
+		fmt.Printf("  Artist: %s\n", track.Artist)
+		fmt.Printf("  Album:  %s\n", track.Album)
+		if track.ReleaseYear != 0 {
+			fmt.Printf("  Year:   %d\n", track.ReleaseYear)
+		}
+		if track.CoverURL != "" {
+			fmt.Printf("  Cover:  %s\n", track.CoverURL)
+		}
+
+		answer, err := prompt("Save it? [Y]es, [n]o, [e]dit: ")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "", "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		case "e", "edit":
+			if err := editTrack(track); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// editTrack asks the user for the details of track, keeping those they
+// leave empty
+func editTrack(track *spotify.Track) error {
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"Title", &track.Title},
+		{"Artist", &track.Artist},
+		{"Album", &track.Album},
+	} {
+		answer, err := prompt(fmt.Sprintf("%s [%s]: ", field.name, *field.value))
+		if err != nil {
+			return err
+		}
+		if answer != "" {
+			*field.value = answer
+		}
+	}
+
+	for {
+		answer, err := prompt(fmt.Sprintf("Year [%d]: ", track.ReleaseYear))
+		if err != nil {
+			return err
+		}
+		if answer == "" {
+			return nil
+		}
+		if year, err := strconv.Atoi(answer); err == nil && year >= 0 {
+			track.ReleaseYear = year
+			return nil
+		}
+		fmt.Println("The year must be a number.")
+	}
+}
+
+// prompt prints question and returns the line the user answers
+func prompt(question string) (string, error) {
+	fmt.Print(question)
+	answer, err := stdin.ReadString('\n')
+	if err == io.EOF && answer == "" {
+		return "", errors.New("no answer on standard input")
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
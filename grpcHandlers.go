@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"song-recognition/pb"
+	"song-recognition/protocol"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements pb.SeekTuneServer on top of the same DB client and
+// recognition code as the HTTP API
+type grpcServer struct {
+	pb.UnimplementedSeekTuneServer
+}
+
+// newGRPCServer returns a gRPC server with the SeekTune service registered
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.MaxRecvMsgSize(maxSongUploadSize),
+		grpc.UnaryInterceptor(authUnaryInterceptor),
+		grpc.StreamInterceptor(authStreamInterceptor),
+	)
+	pb.RegisterSeekTuneServer(server, &grpcServer{})
+	return server
+}
+
+// serveGRPC serves server on port and blocks until it stops
+func serveGRPC(server *grpc.Server, port string) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.Error("gRPC server listen failed.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+
+	logger := utils.GetLogger()
+	logger.Info("starting gRPC server.", slog.String("port", port))
+	if err := server.Serve(listener); err != nil {
+		logger.Error("gRPC server stopped.", slog.Any("error", xerrors.New(err)))
+		os.Exit(1)
+	}
+}
+
+// grpcMetadata returns the first value of the metadata key of the call,
+// empty if it has none
+func grpcMetadata(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcContext returns a copy of ctx that carries the request ID given by the
+// "x-request-id" metadata of the call, or a new one, which is sent back in
+// the response header, and the API key given by its "x-api-key" or
+// "authorization: Bearer" metadata, if any. It selects the catalog given by
+// the "catalog" metadata, and records recognitions for the client given by
+// the "x-client-id" metadata.
+func grpcContext(ctx context.Context) (context.Context, error) {
+	id := grpcMetadata(ctx, "x-request-id")
+	if id == "" || len(id) > maxRequestIDLength {
+		id = utils.NewRequestID()
+	}
+	ctx = utils.WithRequestID(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+
+	catalog := grpcMetadata(ctx, "catalog")
+	if !utils.ValidCatalog(catalog) {
+		return nil, status.Error(codes.InvalidArgument, "invalid catalog, expected up to 32 lowercase letters, digits or underscores")
+	}
+
+	secret := grpcMetadata(ctx, "x-api-key")
+	if secret == "" {
+		secret = strings.TrimPrefix(grpcMetadata(ctx, "authorization"), "Bearer ")
+	}
+	key, err := authenticate(ctx, secret)
+	if errors.Is(err, errInvalidAPIKey) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(ctx, "failed to look up API key.", slog.Any("error", xerrors.New(err)))
+		return nil, status.Error(codes.Unavailable, "failed to look up API key")
+	}
+
+	catalog, err = keyCatalog(key, catalog)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	ctx, err = withClientID(withAPIKey(ctx, key), grpcMetadata(ctx, "x-client-id"))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return utils.WithCatalog(ctx, catalog), nil
+}
+
+func authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// catalogServerStream overrides the context of a stream with one that
+// carries its API key and selects its catalog
+type catalogServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *catalogServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func authStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &catalogServerStream{ServerStream: stream, ctx: ctx})
+}
+
+func songToProto(song utils.Song) *pb.Song {
+	return &pb.Song{
+		Id:          song.ID,
+		Title:       song.Title,
+		Artist:      song.Artist,
+		YoutubeId:   song.YouTubeID,
+		Album:       song.Album,
+		Duration:    uint32(song.Duration),
+		ReleaseYear: uint32(song.ReleaseYear),
+		CoverUrl:    song.CoverURL,
+		Source:      song.Source,
+		SourceUrl:   song.SourceURL,
+	}
+}
+
+// writeTempAudio writes audio to a new file in the tmp directory and returns its path
+func writeTempAudio(audio []byte) (string, error) {
+	filePath := filepath.Join("tmp", fmt.Sprintf("%d_grpc", utils.GenerateUniqueID()))
+	if err := os.WriteFile(filePath, audio, 0644); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+func (s *grpcServer) RegisterSong(ctx context.Context, req *pb.RegisterSongRequest) (*pb.Song, error) {
+	logger := utils.GetLogger()
+	if err := checkWriteAccess(ctx); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if utils.ReadOnly() {
+		return nil, status.Error(codes.FailedPrecondition, errReadOnlyServer.Error())
+	}
+
+	ctx, done, err := jobs.start(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer done()
+	saved, err := ingest.startSaving()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer saved()
+	if req.GetReindex() {
+		ctx = spotify.WithReindex(ctx)
+	}
+	title, artist := req.GetTitle(), req.GetArtist()
+
+	switch source := req.GetSource().(type) {
+	case *pb.RegisterSongRequest_YoutubeUrl:
+		track, err := spotify.DlSong(ctx, source.YoutubeUrl, title, artist, SONGS_DIR)
+		var duplicate *spotify.DuplicateError
+		if errors.As(err, &duplicate) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to register YouTube song.", slog.Any("error", xerrors.New(err)))
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		title, artist = track.Title, track.Artist
+
+	case *pb.RegisterSongRequest_SoundcloudUrl:
+		if !spotify.IsSoundCloudURL(source.SoundcloudUrl) {
+			return nil, status.Error(codes.InvalidArgument, "invalid SoundCloud URL")
+		}
+		track, err := spotify.DlSong(ctx, source.SoundcloudUrl, title, artist, SONGS_DIR)
+		var duplicate *spotify.DuplicateError
+		if errors.As(err, &duplicate) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to register SoundCloud song.", slog.Any("error", xerrors.New(err)))
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		title, artist = track.Title, track.Artist
+
+	case *pb.RegisterSongRequest_Audio:
+		filePath, err := writeTempAudio(source.Audio)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to store audio")
+		}
+		defer utils.DeleteFile(filePath)
+
+		track := &spotify.Track{Title: title, Artist: artist}
+		if title == "" || artist == "" {
+			track, err = trackFromFile(filePath, "", nil)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, "unsupported audio file")
+			}
+		}
+
+		err = saveTrack(ctx, filePath, track, req.GetForce())
+		var duplicate *spotify.DuplicateError
+		if errors.As(err, &duplicate) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to register uploaded song.", slog.Any("error", xerrors.New(err)))
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		title, artist = track.Title, track.Artist
+
+	default:
+		return nil, status.Error(codes.InvalidArgument, "one of youtube_url, soundcloud_url or audio is required")
+	}
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "error connecting to DB")
+	}
+	defer db.Close()
+
+	song, songExists, err := db.GetSongByKey(ctx, utils.GenerateSongKey(title, artist))
+	if err != nil || !songExists {
+		return nil, status.Error(codes.Internal, "song was saved but could not be read back")
+	}
+
+	return songToProto(song), nil
+}
+
+func (s *grpcServer) Recognize(stream pb.SeekTune_RecognizeServer) error {
+	logger := utils.GetLogger()
+	ctx := stream.Context()
+
+	var clientAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		clientAddr = p.Addr.String()
+		if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+			clientAddr = host
+		}
+	}
+	if allowed, wait := allowRecognition(ctx, clientAddr); !allowed {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %v", wait.Round(time.Second))
+	}
+
+	var (
+		format *pb.PCMFormat
+		data   []byte
+	)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if req.GetFormat() != nil {
+			format = req.GetFormat()
+		}
+		data = append(data, req.GetAudio()...)
+		if len(data) > maxRecordingSize {
+			return status.Error(codes.ResourceExhausted, "recording is too large")
+		}
+	}
+
+	if len(data) == 0 {
+		return status.Error(codes.InvalidArgument, "no audio received")
+	}
+
+	release, err := recognitionSlots.admit(ctx)
+	if errors.Is(err, errServerBusy) {
+		return status.Errorf(codes.Unavailable, "%v, retry in %ds", err, recognitionSlots.retryAfterSeconds())
+	}
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+	defer release()
+
+	// The recognition times out counting the decoding in
+	ctx, cancel := shazam.WithTimeout(ctx)
+	defer cancel()
+
+	audio, err := decodeRecognizeAudio(ctx, format, data)
+	if errors.Is(context.Cause(ctx), shazam.ErrTimedOut) {
+		return status.Error(codes.DeadlineExceeded, shazam.ErrTimedOut.Error())
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to decode recording.", slog.Any("error", xerrors.New(err)))
+		return status.Error(codes.InvalidArgument, "unsupported audio")
+	}
+
+	matches, searchDuration, err := findMatches(ctx, audio.Samples, audio.Duration, audio.SampleRate)
+	timedOut := errors.Is(err, shazam.ErrTimedOut)
+	if err != nil && !timedOut {
+		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", xerrors.New(err)))
+		return status.Error(codes.Internal, "failed to get matches")
+	}
+
+	matches = shazam.TopMatches(matches, maxAPIMatchResults, 0)
+	publishRecognition(ctx, protocol.TypeMatches, protocol.Matches{Matches: matches, TimedOut: timedOut}, true)
+
+	resp := &pb.RecognizeResponse{SearchDurationMs: searchDuration.Milliseconds()}
+	for _, match := range matches {
+		resp.Matches = append(resp.Matches, &pb.Match{
+			Song: songToProto(utils.Song{
+				ID:           match.SongID,
+				Title:        match.SongTitle,
+				Artist:       match.SongArtist,
+				YouTubeID:    match.YouTubeID,
+				SongMetadata: match.SongMetadata,
+			}),
+			TimestampMs: match.Timestamp,
+			Score:       match.Score,
+			Confidence:  match.Confidence,
+			OffsetMs:    match.OffsetMs,
+			Speed:       match.Speed,
+		})
+	}
+
+	// The matches found before the timeout are the details of its error
+	if timedOut {
+		st, err := status.New(codes.DeadlineExceeded, "recognition timed out, the matches are partial").WithDetails(resp)
+		if err != nil {
+			return status.Error(codes.DeadlineExceeded, shazam.ErrTimedOut.Error())
+		}
+		return st.Err()
+	}
+	return stream.SendAndClose(resp)
+}
+
+// decodeRecognizeAudio decodes raw PCM when format is set, and an audio
+// file otherwise
+func decodeRecognizeAudio(ctx context.Context, format *pb.PCMFormat, data []byte) (*wav.Audio, error) {
+	if format == nil {
+		filePath, err := writeTempAudio(data)
+		if err != nil {
+			return nil, err
+		}
+		defer utils.DeleteFile(filePath)
+
+		return wav.DecodeFileContext(ctx, filePath)
+	}
+
+	if format.GetSampleRate() <= 0 || format.GetChannels() <= 0 {
+		return nil, errors.New("invalid PCM format")
+	}
+
+	bitsPerSample := int(format.GetBitsPerSample())
+	if bitsPerSample == 0 {
+		bitsPerSample = 16
+	}
+
+	samples, err := wav.PCMBytesToMonoSamples(data, int(format.GetChannels()), bitsPerSample, format.GetFloat())
+	if err != nil {
+		return nil, err
+	}
+
+	sampleRate := int(format.GetSampleRate())
+	return &wav.Audio{
+		Samples:    samples,
+		SampleRate: sampleRate,
+		Duration:   float64(len(samples)) / float64(sampleRate),
+	}, nil
+}
+
+func (s *grpcServer) ListSongs(ctx context.Context, req *pb.ListSongsRequest) (*pb.ListSongsResponse, error) {
+	if !utils.ValidSongSort(req.GetSortBy()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid sort_by, expected title, artist or id")
+	}
+
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "error connecting to DB")
+	}
+	defer db.Close()
+
+	logger := utils.GetLogger()
+
+	total, err := db.TotalSongs(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to count songs.", slog.Any("error", xerrors.New(err)))
+		return nil, status.Error(codes.Internal, "failed to list songs")
+	}
+
+	songs, err := db.ListSongs(ctx, int(req.GetOffset()), int(req.GetLimit()), req.GetSortBy())
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to list songs.", slog.Any("error", xerrors.New(err)))
+		return nil, status.Error(codes.Internal, "failed to list songs")
+	}
+
+	resp := &pb.ListSongsResponse{Total: uint32(total)}
+	for _, song := range songs {
+		resp.Songs = append(resp.Songs, songToProto(song))
+	}
+
+	return resp, nil
+}
+
+func (s *grpcServer) DeleteSong(ctx context.Context, req *pb.DeleteSongRequest) (*pb.DeleteSongResponse, error) {
+	if err := checkWriteAccess(ctx); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if utils.ReadOnly() {
+		return nil, status.Error(codes.FailedPrecondition, errReadOnlyServer.Error())
+	}
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "error connecting to DB")
+	}
+	defer db.Close()
+
+	_, songExists, err := db.GetSongByID(ctx, req.GetId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get song")
+	}
+	if !songExists {
+		return nil, status.Error(codes.NotFound, "song not found")
+	}
+
+	if err := db.DeleteSongByID(ctx, req.GetId()); err != nil {
+		return nil, status.Error(codes.Internal, "failed to delete song")
+	}
+
+	return &pb.DeleteSongResponse{}, nil
+}
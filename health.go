@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"song-recognition/utils"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// requiredTools are the external programs audio is decoded, converted and
+// tagged with
+var requiredTools = []string{"ffmpeg", "ffprobe"}
+
+// readinessTimeout bounds the database check of a readiness probe
+const readinessTimeout = 5 * time.Second
+
+// startupTimeout bounds the database check the server starts with
+const startupTimeout = 10 * time.Second
+
+// registerHealthHandlers registers the liveness and readiness probes. They
+// need no API key, so orchestration platforms can always reach them.
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+}
+
+// handleHealthz serves /healthz, which succeeds as long as the server can
+// answer requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz serves /readyz, which succeeds when the database can be
+// reached and the required tools are installed, and otherwise responds with
+// a 503 and the checks that failed
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	ready := true
+	checks := map[string]string{}
+
+	if err := pingDatabase(ctx); err != nil {
+		logger.WarnContext(ctx, "readiness check failed.", slog.String("check", "database"), slog.Any("error", xerrors.New(err)))
+		checks["database"] = "unreachable"
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	for _, tool := range requiredTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			checks[tool] = "not found"
+			ready = false
+		} else {
+			checks[tool] = "ok"
+		}
+	}
+
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+}
+
+// pingDatabase checks that the default catalog of the database can be
+// reached
+func pingDatabase(ctx context.Context) error {
+	db, err := utils.NewReadOnlyDBClient()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Ping(ctx)
+}
+
+// checkDatabase makes sure the database can be reached before the server
+// starts, so that a misconfigured server fails at once rather than on its
+// first requests, and logs what its backend supports
+func checkDatabase() error {
+	logger := utils.GetLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+
+	db, err := utils.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Ping(ctx); err != nil {
+		return fmt.Errorf("error reaching the database: %v", err)
+	}
+
+	capabilities := db.Capabilities()
+	logger.Info("database ready.",
+		slog.String("backend", capabilities.Backend),
+		slog.Bool("transactions", capabilities.Transactions),
+		slog.Int("max_batch_size", capabilities.MaxBatchSize),
+		slog.Bool("native_search", capabilities.NativeSearch),
+		slog.Bool("shared_access", capabilities.SharedAccess),
+	)
+	switch {
+	case capabilities.Backend == "memory":
+		logger.Warn("the database is kept in memory, commands can't see it and it is lost when the server stops.")
+	case !capabilities.SharedAccess:
+		logger.Info("the database is locked while the server uses it, commands run meanwhile may time out waiting for it.", slog.String("backend", capabilities.Backend))
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"song-recognition/events"
+	"song-recognition/protocol"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Statuses of an ingestion job
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var (
+	// ingestWorkers is the number of ingestion jobs run at the same time.
+	// Set with INGEST_WORKERS.
+	ingestWorkers = intFromEnv("INGEST_WORKERS", 2)
+
+	// ingestQueueSize is the number of jobs that can wait for a worker.
+	// Set with INGEST_QUEUE_SIZE.
+	ingestQueueSize = intFromEnv("INGEST_QUEUE_SIZE", 100)
+
+	// jobRetention is how long finished jobs can still be polled. Set with
+	// JOB_RETENTION.
+	jobRetention = durationFromEnv("JOB_RETENTION", time.Hour)
+)
+
+var (
+	errQueueFull       = errors.New("too many songs are waiting to be saved, try again later")
+	errIngestionPaused = errors.New("saving songs is paused, try again later")
+	errJobNotFound     = errors.New("job not found")
+	errJobFinished     = errors.New("job already finished")
+	errJobCancelled    = errors.New("job cancelled by an admin")
+	errSavesRunning    = errors.New("songs are being saved, pause saving and wait for them to finish")
+	errGCRunning       = errors.New("orphaned fingerprints are already being deleted")
+)
+
+// ingestJob is a song download and registration run in the background
+type ingestJob struct {
+	protocol.JobStatus
+
+	run    func(ctx context.Context, progress *jobProgress) error
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   func()
+}
+
+// cancelReason returns why the context of job is done: an admin cancelled
+// it, or the server is shutting down
+func (job *ingestJob) cancelReason() error {
+	if cause := context.Cause(job.ctx); errors.Is(cause, errJobCancelled) {
+		return cause
+	}
+	return errShuttingDown
+}
+
+// snapshot returns a copy of job that is safe to read after the queue is
+// unlocked
+func (job *ingestJob) snapshot() ingestJob {
+	s := *job
+	s.Songs = append([]utils.Song(nil), job.Songs...)
+	s.Tracks = append([]spotify.TrackStatus(nil), job.Tracks...)
+	return s
+}
+
+// ingestQueue runs ingestion jobs on a pool of workers and keeps their
+// status until they expire. Saving songs can be held, for an admin or
+// while orphaned fingerprints are deleted: jobs are still queued but don't
+// start, and songs saved outside of jobs are rejected.
+type ingestQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*ingestJob
+	pending chan *ingestJob
+	once    sync.Once
+
+	// paused is whether an admin paused saving songs, and collecting whether
+	// orphaned fingerprints are being deleted. Either holds saving.
+	paused     bool
+	collecting bool
+	// resumed is closed once saving is no longer held, and nil while it
+	// isn't
+	resumed chan struct{}
+	// saving is the number of songs being saved outside of jobs
+	saving int
+}
+
+// ingest is the queue of the songs being saved by the server
+var ingest = &ingestQueue{jobs: make(map[string]*ingestJob)}
+
+// enqueue queues run as a new job for the songs from source, and returns
+// the job. run gets a context that carries the values of ctx, but isn't
+// cancelled with it. Every change of the job is published as a "jobStatus"
+// event under its topic.
+func (q *ingestQueue) enqueue(ctx context.Context, source string, run func(ctx context.Context, progress *jobProgress) error) (ingestJob, error) {
+	q.once.Do(q.startWorkers)
+
+	// Queued jobs count as running, so that shutdown waits for them
+	jobCtx, done, err := jobs.start(context.WithoutCancel(ctx))
+	if err != nil {
+		return ingestJob{}, err
+	}
+	jobCtx, cancel := context.WithCancelCause(jobCtx)
+
+	job := &ingestJob{
+		JobStatus: protocol.JobStatus{
+			ID:      utils.NewRequestID(),
+			Source:  source,
+			Catalog: utils.CatalogFromContext(ctx),
+			Status:  jobQueued,
+			Created: time.Now().UTC(),
+		},
+		run:    run,
+		ctx:    jobCtx,
+		cancel: cancel,
+		done:   func() { cancel(nil); done() },
+	}
+	q.mu.Lock()
+	q.prune()
+	select {
+	case q.pending <- job:
+	default:
+		q.mu.Unlock()
+		job.done()
+		return ingestJob{}, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	snapshot := job.snapshot()
+	q.mu.Unlock()
+
+	return snapshot, nil
+}
+
+// get returns the job with the given ID
+func (q *ingestQueue) get(id string) (ingestJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return ingestJob{}, false
+	}
+	return job.snapshot(), true
+}
+
+// list returns the jobs of catalog, the newest first
+func (q *ingestQueue) list(catalog string) []ingestJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	jobs := []ingestJob{}
+	for _, job := range q.jobs {
+		if job.Catalog == catalog {
+			jobs = append(jobs, job.snapshot())
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].Created.After(jobs[j].Created)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// cancel cancels the job of catalog with the given ID. A queued job is
+// cancelled right away, a running one once it stops, rolling back the song
+// it was saving.
+func (q *ingestQueue) cancel(catalog, id string) (ingestJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || job.Catalog != catalog {
+		return ingestJob{}, errJobNotFound
+	}
+	if job.Finished != nil {
+		return job.snapshot(), errJobFinished
+	}
+
+	job.cancel(errJobCancelled)
+	if job.Status == jobQueued {
+		now := time.Now().UTC()
+		job.Status = jobCancelled
+		job.Error = errJobCancelled.Error()
+		job.Finished = &now
+		q.publish(job)
+		// The worker that gets to it skips it, shutdown needn't wait
+		job.done()
+	}
+	return job.snapshot(), nil
+}
+
+// ingestionStatus is whether saving songs is held, and how many jobs wait
+// and run, in every catalog
+type ingestionStatus struct {
+	Paused    bool `json:"paused"`
+	GCRunning bool `json:"gcRunning"`
+	Queued    int  `json:"queued"`
+	Running   int  `json:"running"`
+}
+
+// status returns whether saving songs is held, and how many jobs wait and
+// run
+func (q *ingestQueue) status() ingestionStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := ingestionStatus{Paused: q.paused, GCRunning: q.collecting}
+	for _, job := range q.jobs {
+		switch job.Status {
+		case jobQueued:
+			status.Queued++
+		case jobRunning:
+			status.Running++
+		}
+	}
+	return status
+}
+
+// setPaused pauses or resumes saving songs. Paused, jobs are still queued
+// but don't start, running jobs finish, and songs saved outside of jobs are
+// rejected.
+func (q *ingestQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.hold(func() { q.paused = paused })
+}
+
+// holdForGC holds saving songs while orphaned fingerprints are deleted, so
+// that the fingerprints of a song being saved aren't taken for orphans,
+// until the returned function is called. It fails with errSavesRunning
+// while songs are being saved.
+func (q *ingestQueue) holdForGC() (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.collecting {
+		return nil, errGCRunning
+	}
+	if q.saving > 0 {
+		return nil, errSavesRunning
+	}
+	for _, job := range q.jobs {
+		if job.Status == jobRunning {
+			return nil, errSavesRunning
+		}
+	}
+
+	q.hold(func() { q.collecting = true })
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.hold(func() { q.collecting = false })
+	}, nil
+}
+
+// hold applies change to what holds saving songs, and lets the jobs waiting
+// start once nothing does anymore. q.mu must be held.
+func (q *ingestQueue) hold(change func()) {
+	wasHeld := q.paused || q.collecting
+	change()
+	held := q.paused || q.collecting
+	switch {
+	case held && !wasHeld:
+		q.resumed = make(chan struct{})
+	case !held && wasHeld:
+		close(q.resumed)
+		q.resumed = nil
+	}
+}
+
+// startSaving counts a song saved outside of jobs until the returned
+// function is called. It fails with errIngestionPaused while saving songs
+// is held.
+func (q *ingestQueue) startSaving() (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.resumed != nil {
+		return nil, errIngestionPaused
+	}
+	q.saving++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.saving--
+		})
+	}, nil
+}
+
+// subscribe returns the job with the given ID as it is now, along with a
+// subscription to its changes from then on. Once the job is finished, the
+// subscription gets nothing more and should be closed.
+func (q *ingestQueue) subscribe(id string) (ingestJob, *events.Subscription, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return ingestJob{}, nil, false
+	}
+	return job.snapshot(), events.Subscribe(events.JobTopic(id)), true
+}
+
+// prune forgets the jobs that finished more than jobRetention ago. q.mu
+// must be held.
+func (q *ingestQueue) prune() {
+	for id, job := range q.jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// update applies change to job and publishes it
+func (q *ingestQueue) update(job *ingestJob, change func(job *ingestJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	change(job)
+	q.publish(job)
+}
+
+// publish publishes the status of job. Changes are published with q.mu
+// held, so that subscribe doesn't miss any.
+func (q *ingestQueue) publish(job *ingestJob) {
+	events.Publish(events.Event{
+		Topic:     events.JobTopic(job.ID),
+		Type:      protocol.TypeJobStatus,
+		Payload:   job.snapshot().JobStatus,
+		Final:     job.Finished != nil,
+		RequestID: utils.RequestIDFromContext(job.ctx),
+		Catalog:   job.Catalog,
+	})
+}
+
+func (q *ingestQueue) startWorkers() {
+	q.pending = make(chan *ingestJob, ingestQueueSize)
+	workers := ingestWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+func (q *ingestQueue) work() {
+	for job := range q.pending {
+		q.process(job)
+	}
+}
+
+// process runs job once saving songs isn't held, unless it was cancelled
+// while queued. The events of the job are published under its topic.
+func (q *ingestQueue) process(job *ingestJob) {
+	defer job.done()
+
+	if !q.begin(job) {
+		return
+	}
+
+	ctx := events.WithTopic(job.ctx, events.JobTopic(job.ID))
+	ctx = spotify.WithProgress(ctx, func(stage string) {
+		q.update(job, func(job *ingestJob) { job.Stage = stage })
+	})
+	err := job.run(ctx, &jobProgress{queue: q, job: job})
+
+	// The failure comes before the last status, which ends the streams
+	// following the job
+	if err != nil {
+		events.Emit(ctx, events.JobFailed, events.JobFailure{
+			JobID:     job.ID,
+			Source:    job.Source,
+			Error:     err.Error(),
+			Cancelled: job.ctx.Err() != nil,
+		})
+	}
+
+	q.update(job, func(job *ingestJob) {
+		now := time.Now().UTC()
+		job.Finished = &now
+		switch {
+		case err != nil && job.ctx.Err() != nil:
+			job.Status = jobCancelled
+			job.Error = err.Error()
+		case err != nil:
+			job.Status = jobFailed
+			job.Error = err.Error()
+		default:
+			job.Status = jobDone
+		}
+	})
+}
+
+// begin waits for saving songs not to be held, then marks job running and
+// reports whether it should run: not once it was cancelled
+func (q *ingestQueue) begin(job *ingestJob) bool {
+	for {
+		q.mu.Lock()
+		if job.Finished != nil {
+			q.mu.Unlock()
+			return false
+		}
+		if err := job.ctx.Err(); err != nil {
+			now := time.Now().UTC()
+			job.Status = jobCancelled
+			job.Error = job.cancelReason().Error()
+			job.Finished = &now
+			q.publish(job)
+			q.mu.Unlock()
+			return false
+		}
+
+		resumed := q.resumed
+		if resumed == nil {
+			now := time.Now().UTC()
+			job.Status = jobRunning
+			job.Started = &now
+			q.publish(job)
+			q.mu.Unlock()
+			return true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-resumed:
+		case <-job.ctx.Done():
+		}
+	}
+}
+
+// jobProgress is how a running job records what it did
+type jobProgress struct {
+	queue *ingestQueue
+	job   *ingestJob
+}
+
+// songSaved records the song with the given title and artist, saved in
+// the catalog of ctx, as a result of the job
+func (p *jobProgress) songSaved(ctx context.Context, title, artist string) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	song, exists, err := db.GetSongByKey(ctx, utils.GenerateSongKey(title, artist))
+	if err != nil || !exists {
+		return
+	}
+	p.queue.update(p.job, func(job *ingestJob) { job.Songs = append(job.Songs, song) })
+}
+
+// summarize records what became of the tracks of an artist or album import
+func (p *jobProgress) summarize(summary spotify.ImportSummary) {
+	p.queue.update(p.job, func(job *ingestJob) { job.Summary = &summary })
+}
+
+// track records the progress of a track of a playlist or album
+func (p *jobProgress) track(status spotify.TrackStatus) {
+	p.queue.update(p.job, func(job *ingestJob) {
+		for i, track := range job.Tracks {
+			if track.Title == status.Title && track.Artist == status.Artist {
+				job.Tracks[i] = status
+				return
+			}
+		}
+		job.Tracks = append(job.Tracks, status)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	// liveRestartDelay is how long a live input that failed or ended waits
+	// before it is reopened
+	liveRestartDelay = 5 * time.Second
+
+	// liveMissesBeforeSilence is how many recognitions of a live input in a
+	// row must match nothing before the track playing is considered over,
+	// so a quiet passage doesn't end it
+	liveMissesBeforeSilence = 3
+)
+
+// liveTrack is a track recognized on a live input
+type liveTrack struct {
+	match shazam.Match
+	// started is when the first recording it was recognized in started,
+	// and lastHeard when the last one ended
+	started   time.Time
+	lastHeard time.Time
+}
+
+// liveInput follows the tracks playing on a live audio input read by
+// FFmpeg, like a microphone or a radio stream, by recognizing the last
+// window of audio every interval
+type liveInput struct {
+	// name tells the input apart in logs
+	name      string
+	inputArgs []string
+	window    time.Duration
+	interval  time.Duration
+	// onChange is called when the track playing changes, with the track
+	// that ended and the one that started, either of which can be nil. It
+	// is called with mu held.
+	onChange func(ended, started *liveTrack)
+
+	busy atomic.Bool // a recognition is running
+
+	mu      sync.Mutex
+	playing *liveTrack
+	misses  int
+}
+
+// run reads the input until ctx is done, reopening it after
+// liveRestartDelay when it fails or ends. The track still playing then
+// ends when it was last heard.
+func (in *liveInput) run(ctx context.Context) {
+	logger := utils.GetLogger()
+	defer in.stop()
+
+	window := int(in.window.Seconds() * wav.CanonicalSampleRate)
+	interval := int(in.interval.Seconds() * wav.CanonicalSampleRate)
+
+	for {
+		var samples []float64
+		pending := 0
+		err := wav.Capture(ctx, in.inputArgs, func(chunk []float64) {
+			samples = append(samples, chunk...)
+			if len(samples) > window {
+				samples = append(samples[:0], samples[len(samples)-window:]...)
+			}
+
+			pending += len(chunk)
+			if pending < interval {
+				return
+			}
+			pending = 0
+
+			// Recognitions run next to the capture so it doesn't fall
+			// behind, and are skipped while the previous one runs
+			if !in.busy.CompareAndSwap(false, true) {
+				return
+			}
+			recording := append([]float64(nil), samples...)
+			end := time.Now()
+			go func() {
+				defer in.busy.Store(false)
+				in.recognize(ctx, recording, end)
+			}()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			logger.Error("live input stopped, reopening it.", slog.String("input", in.name), slog.Any("error", xerrors.New(err)))
+		} else {
+			logger.Warn("live input ended, reopening it.", slog.String("input", in.name))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(liveRestartDelay):
+		}
+	}
+}
+
+// recognize matches a recording of the input that ended at end, and
+// follows the track it matches
+func (in *liveInput) recognize(ctx context.Context, samples []float64, end time.Time) {
+	logger := utils.GetLogger()
+
+	// The same track is recognized many times, so it isn't recorded
+	ctx = shazam.WithoutHistory(utils.WithRequestID(ctx, utils.NewRequestID()))
+	duration := float64(len(samples)) / wav.CanonicalSampleRate
+	matches, _, err := shazam.FindMatches(ctx, samples, duration, wav.CanonicalSampleRate)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to recognize live input.", slog.String("input", in.name), slog.Any("error", xerrors.New(err)))
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	// The input was stopped while this recording was recognized
+	if ctx.Err() != nil {
+		return
+	}
+
+	if len(matches) == 0 {
+		in.misses++
+		if in.playing != nil && in.misses == liveMissesBeforeSilence {
+			ended := in.playing
+			in.playing = nil
+			in.onChange(ended, nil)
+		}
+		return
+	}
+
+	in.misses = 0
+	match := matches[0]
+	if in.playing != nil && in.playing.match.SongID == match.SongID {
+		in.playing.lastHeard = end
+		in.playing.match.Confidence = max(in.playing.match.Confidence, match.Confidence)
+		return
+	}
+
+	ended := in.playing
+	started := end.Add(-time.Duration(duration * float64(time.Second)))
+	in.playing = &liveTrack{match: match, started: started, lastHeard: end}
+	logger.InfoContext(ctx, "now playing.", slog.String("input", in.name), slog.Any("song_id", match.SongID))
+	in.onChange(ended, in.playing)
+}
+
+// stop ends the track playing
+func (in *liveInput) stop() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.playing != nil {
+		ended := in.playing
+		in.playing = nil
+		in.onChange(ended, nil)
+	}
+}
+
+// nowPlaying returns the match of the track playing, nil if none is
+func (in *liveInput) nowPlaying() *shazam.Match {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.playing == nil {
+		return nil
+	}
+	match := in.playing.match
+	return &match
+}
@@ -0,0 +1,143 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "seektune"
+
+var (
+	// RecognitionDuration is the time FindMatches takes per recording
+	RecognitionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "recognition_duration_seconds",
+		Help:      "Time taken to find matches for a recording.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	// Recognitions counts recognitions by result ("match", "no_match",
+	// "timeout" or "error"), which gives the match hit rate
+	Recognitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recognitions_total",
+		Help:      "Recognition requests by result.",
+	}, []string{"result"})
+
+	// RecognitionsRunning is the number of recognitions of the server's
+	// clients running, and RecognitionsQueued that of those waiting to
+	RecognitionsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recognitions_running",
+		Help:      "Recognitions running.",
+	})
+	RecognitionsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recognitions_queued",
+		Help:      "Recognitions waiting for a running one to finish.",
+	})
+
+	// RecognitionsRejected counts the recognitions rejected because too
+	// many were running and queued
+	RecognitionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recognitions_rejected_total",
+		Help:      "Recognitions rejected because the server was busy.",
+	})
+
+	// FingerprintsStored counts fingerprints written to the database
+	FingerprintsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fingerprints_stored_total",
+		Help:      "Fingerprints written to the database.",
+	})
+
+	// DBQueryDuration is the time each DBClient call takes, by backend and method
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time taken by database calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"backend", "operation"})
+
+	// CouplesCacheLookups counts address lookups in the couples cache by
+	// result ("hit" or "miss")
+	CouplesCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "couples_cache_lookups_total",
+		Help:      "Fingerprint address lookups in the couples cache by result.",
+	}, []string{"result"})
+
+	// AddressFilterLookups counts addresses checked against the address
+	// filter by result ("maybe" or "absent")
+	AddressFilterLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "address_filter_lookups_total",
+		Help:      "Fingerprint addresses checked against the address filter by result.",
+	}, []string{"result"})
+
+	// RecognitionCacheLookups counts recordings looked up in the
+	// recognition result cache by result ("hit" or "miss")
+	RecognitionCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recognition_cache_lookups_total",
+		Help:      "Recordings looked up in the recognition result cache by result.",
+	}, []string{"result"})
+
+	// ActiveSockets is the number of connected socket.io clients
+	ActiveSockets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_socket_sessions",
+		Help:      "Connected WebSocket/socket.io sessions.",
+	})
+)
+
+// QueryStats is how many database calls of an operation a backend made
+// since the server started, and how long they took altogether
+type QueryStats struct {
+	Backend   string  `json:"backend"`
+	Operation string  `json:"operation"`
+	Count     uint64  `json:"count"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// DBQueryStats returns the statistics of DBQueryDuration, by backend and
+// operation
+func DBQueryStats() ([]QueryStats, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []QueryStats{}
+	for _, family := range families {
+		if family.GetName() != namespace+"_db_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			queries := QueryStats{
+				Count:   metric.GetHistogram().GetSampleCount(),
+				Seconds: metric.GetHistogram().GetSampleSum(),
+			}
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "backend":
+					queries.Backend = label.GetValue()
+				case "operation":
+					queries.Operation = label.GetValue()
+				}
+			}
+			stats = append(stats, queries)
+		}
+	}
+	return stats, nil
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"song-recognition/protocol"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+var (
+	// micInputFormat is the FFmpeg input device the microphone is read
+	// with: alsa or pulse on Linux, avfoundation on macOS and dshow on
+	// Windows. Set with MIC_INPUT_FORMAT.
+	micInputFormat = utils.GetEnv("MIC_INPUT_FORMAT", defaultMicInputFormat())
+
+	// micDevice is the microphone to record, as named by micInputFormat.
+	// Set with MIC_DEVICE.
+	micDevice = utils.GetEnv("MIC_DEVICE", defaultMicDevice(micInputFormat))
+
+	// micWindow is how much of the latest audio every recognition of the
+	// microphone uses. Set with MIC_WINDOW.
+	micWindow = durationFromEnv("MIC_WINDOW", 10*time.Second)
+
+	// micInterval is the time between two recognitions of the microphone.
+	// Set with MIC_INTERVAL.
+	micInterval = durationFromEnv("MIC_INTERVAL", 5*time.Second)
+)
+
+func defaultMicInputFormat() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "avfoundation"
+	case "windows":
+		return "dshow"
+	default:
+		return "alsa"
+	}
+}
+
+func defaultMicDevice(inputFormat string) string {
+	if inputFormat == "avfoundation" {
+		return ":0"
+	}
+	return "default"
+}
+
+// micListener recognizes what the server's microphone hears, and tells
+// every socket client the track playing in the room with a "nowPlaying"
+// message
+type micListener struct {
+	*liveInput
+	socketServer *socketio.Server
+}
+
+func newMicListener(socketServer *socketio.Server) *micListener {
+	l := &micListener{socketServer: socketServer}
+	l.liveInput = &liveInput{
+		name:      "microphone",
+		inputArgs: []string{"-f", micInputFormat, "-i", micDevice},
+		window:    micWindow,
+		interval:  micInterval,
+		onChange: func(ended, started *liveTrack) {
+			l.publish(started)
+		},
+	}
+	return l
+}
+
+// run records the microphone until ctx is done
+func (l *micListener) run(ctx context.Context) {
+	logger := utils.GetLogger()
+	logger.Info("listening to the microphone.",
+		slog.String("input_format", micInputFormat), slog.String("device", micDevice))
+	l.liveInput.run(ctx)
+}
+
+// publish sends the track playing, nil if none is, to every socket client
+func (l *micListener) publish(playing *liveTrack) {
+	var match *shazam.Match
+	if playing != nil {
+		match = &playing.match
+	}
+
+	broadcastMessage(l.socketServer, protocol.TypeNowPlaying, protocol.NowPlaying{Match: match})
+}
+
+// handleNowPlaying sends the track playing to a client that just connected
+func (l *micListener) handleNowPlaying(socket socketio.Conn) {
+	emitMessage(socket, protocol.TypeNowPlaying, protocol.NowPlaying{Match: l.nowPlaying()})
+}
@@ -12,3 +12,33 @@ type RecordData struct {
 	SampleRate int     `json:"sampleRate"`
 	SampleSize int     `json:"sampleSize"`
 }
+
+// StreamStart describes the raw PCM audio a client is about to stream.
+// Interval is how many seconds of new audio to collect between partial
+// matches; zero means the server default.
+type StreamStart struct {
+	Channels   int     `json:"channels"`
+	SampleRate int     `json:"sampleRate"`
+	SampleSize int     `json:"sampleSize"`
+	Interval   float64 `json:"interval"`
+}
+
+// UploadBegin starts a recording upload sent in chunks, for recordings too
+// large for a single message. Size is the number of bytes of audio that
+// will be sent; the other fields are those of RecordData.
+type UploadBegin struct {
+	UploadID   string  `json:"uploadId"`
+	Size       int     `json:"size"`
+	Duration   float64 `json:"duration"`
+	Channels   int     `json:"channels"`
+	SampleRate int     `json:"sampleRate"`
+	SampleSize int     `json:"sampleSize"`
+}
+
+// UploadChunk is a piece of a recording upload. Seq numbers the chunks of
+// an upload from 0, and Data is the base64 encoded audio of the chunk.
+type UploadChunk struct {
+	UploadID string `json:"uploadId"`
+	Seq      int    `json:"seq"`
+	Data     string `json:"data"`
+}
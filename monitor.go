@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+var (
+	// monitorStreams are the internet radio streams the server monitors,
+	// as comma-separated <station>=<url> pairs. Set with MONITOR_STREAMS.
+	monitorStreams = utils.GetEnv("MONITOR_STREAMS")
+
+	// monitorWindow is how much of the latest audio of a stream every
+	// recognition uses. Set with MONITOR_WINDOW.
+	monitorWindow = durationFromEnv("MONITOR_WINDOW", 10*time.Second)
+
+	// monitorInterval is the time between two recognitions of a stream.
+	// Set with MONITOR_INTERVAL.
+	monitorInterval = durationFromEnv("MONITOR_INTERVAL", 5*time.Second)
+)
+
+const (
+	// airplayStoreTimeout bounds storing an airplay, which also happens
+	// while the server shuts down
+	airplayStoreTimeout = 10 * time.Second
+
+	// airplayReportPageSize is the number of airplays a report reads at a
+	// time
+	airplayReportPageSize = 1000
+)
+
+// station is a monitored radio stream
+type station struct {
+	name string
+	url  string
+}
+
+// parseMonitorStreams parses the <station>=<url> pairs of MONITOR_STREAMS
+func parseMonitorStreams(value string) ([]station, error) {
+	var stations []station
+	names := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, streamURL, ok := strings.Cut(pair, "=")
+		name, streamURL = strings.TrimSpace(name), strings.TrimSpace(streamURL)
+		if !ok || name == "" || streamURL == "" {
+			return nil, fmt.Errorf("invalid stream %q, expected <station>=<url>", pair)
+		}
+		if _, err := url.ParseRequestURI(streamURL); err != nil {
+			return nil, fmt.Errorf("invalid URL of station %s: %v", name, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("station %s is listed twice", name)
+		}
+		names[name] = true
+		stations = append(stations, station{name: name, url: streamURL})
+	}
+	return stations, nil
+}
+
+// startMonitors follows the tracks played by the stations of
+// MONITOR_STREAMS until ctx is done, and logs each of them in the airplay
+// table once it ends. The returned function waits for the monitors to
+// stop and log the tracks they were playing.
+func startMonitors(ctx context.Context) (func(), error) {
+	stations, err := parseMonitorStreams(monitorStreams)
+	if err != nil {
+		return nil, err
+	}
+	if len(stations) == 0 {
+		return func() {}, nil
+	}
+	if utils.ReadOnly() {
+		return nil, errors.New("airplay can't be logged by a read-only server")
+	}
+
+	logger := utils.GetLogger()
+	var wg sync.WaitGroup
+	for _, s := range stations {
+		s := s
+		input := &liveInput{
+			name:      s.name,
+			inputArgs: []string{"-i", s.url},
+			window:    monitorWindow,
+			interval:  monitorInterval,
+			onChange: func(ended, started *liveTrack) {
+				if ended != nil {
+					storeAirplay(s.name, ended)
+				}
+			},
+		}
+
+		logger.Info("monitoring station.", slog.String("station", s.name), slog.String("url", s.url))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input.run(ctx)
+		}()
+	}
+	return wg.Wait, nil
+}
+
+// storeAirplay logs a track that played on a station
+func storeAirplay(stationName string, track *liveTrack) {
+	logger := utils.GetLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), airplayStoreTimeout)
+	defer cancel()
+
+	db, err := utils.NewDBClient()
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to store airplay.", slog.String("station", stationName), slog.Any("error", xerrors.New(err)))
+		return
+	}
+	defer db.Close()
+
+	err = db.StoreAirplay(ctx, utils.Airplay{
+		Station:    stationName,
+		SongID:     track.match.SongID,
+		SongTitle:  track.match.SongTitle,
+		SongArtist: track.match.SongArtist,
+		Started:    track.started.UTC(),
+		Ended:      track.lastHeard.UTC(),
+		Confidence: track.match.Confidence,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to store airplay.", slog.String("station", stationName), slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// airplayReportEntry is how often a song was played over the period of an
+// airplay report
+type airplayReportEntry struct {
+	SongID        uint32  `json:"songId"`
+	SongTitle     string  `json:"songTitle"`
+	SongArtist    string  `json:"songArtist"`
+	Plays         int     `json:"plays"`
+	SecondsPlayed float64 `json:"secondsPlayed"`
+	// Stations is the number of plays of each station
+	Stations   map[string]int `json:"stations"`
+	LastPlayed time.Time      `json:"lastPlayed"`
+}
+
+// airplayReport counts the plays of every song among the airplays selected
+// by filter, from the most played
+func airplayReport(ctx context.Context, db utils.DBClient, filter utils.AirplayFilter) ([]airplayReportEntry, error) {
+	entries := map[uint32]*airplayReportEntry{}
+	for offset := 0; ; offset += airplayReportPageSize {
+		airplays, err := db.ListAirplays(ctx, filter, offset, airplayReportPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, airplay := range airplays {
+			entry, ok := entries[airplay.SongID]
+			if !ok {
+				// Airplays come from the latest, so the first one has the
+				// song's current title and artist
+				entry = &airplayReportEntry{
+					SongID:     airplay.SongID,
+					SongTitle:  airplay.SongTitle,
+					SongArtist: airplay.SongArtist,
+					Stations:   map[string]int{},
+					LastPlayed: airplay.Started,
+				}
+				entries[airplay.SongID] = entry
+			}
+			entry.Plays++
+			entry.SecondsPlayed += airplay.Ended.Sub(airplay.Started).Seconds()
+			entry.Stations[airplay.Station]++
+		}
+
+		if len(airplays) < airplayReportPageSize {
+			break
+		}
+	}
+
+	report := make([]airplayReportEntry, 0, len(entries))
+	for _, entry := range entries {
+		report = append(report, *entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Plays != report[j].Plays {
+			return report[i].Plays > report[j].Plays
+		}
+		return report[i].LastPlayed.After(report[j].LastPlayed)
+	})
+	return report, nil
+}
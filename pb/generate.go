@@ -0,0 +1,4 @@
+// Package pb holds the gRPC service definition and its generated code.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative seektune.proto
@@ -0,0 +1,263 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.3
+// source: seektune.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SeekTune_RegisterSong_FullMethodName = "/seektune.SeekTune/RegisterSong"
+	SeekTune_Recognize_FullMethodName    = "/seektune.SeekTune/Recognize"
+	SeekTune_ListSongs_FullMethodName    = "/seektune.SeekTune/ListSongs"
+	SeekTune_DeleteSong_FullMethodName   = "/seektune.SeekTune/DeleteSong"
+)
+
+// SeekTuneClient is the client API for SeekTune service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SeekTuneClient interface {
+	// RegisterSong downloads a YouTube video or SoundCloud track, or
+	// fingerprints an uploaded audio file, and saves it as a song.
+	RegisterSong(ctx context.Context, in *RegisterSongRequest, opts ...grpc.CallOption) (*Song, error)
+	// Recognize receives a recording in chunks and returns the best matches
+	// once the client closes the stream.
+	Recognize(ctx context.Context, opts ...grpc.CallOption) (SeekTune_RecognizeClient, error)
+	ListSongs(ctx context.Context, in *ListSongsRequest, opts ...grpc.CallOption) (*ListSongsResponse, error)
+	DeleteSong(ctx context.Context, in *DeleteSongRequest, opts ...grpc.CallOption) (*DeleteSongResponse, error)
+}
+
+type seekTuneClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSeekTuneClient(cc grpc.ClientConnInterface) SeekTuneClient {
+	return &seekTuneClient{cc}
+}
+
+func (c *seekTuneClient) RegisterSong(ctx context.Context, in *RegisterSongRequest, opts ...grpc.CallOption) (*Song, error) {
+	out := new(Song)
+	err := c.cc.Invoke(ctx, SeekTune_RegisterSong_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *seekTuneClient) Recognize(ctx context.Context, opts ...grpc.CallOption) (SeekTune_RecognizeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SeekTune_ServiceDesc.Streams[0], SeekTune_Recognize_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &seekTuneRecognizeClient{stream}
+	return x, nil
+}
+
+type SeekTune_RecognizeClient interface {
+	Send(*RecognizeRequest) error
+	CloseAndRecv() (*RecognizeResponse, error)
+	grpc.ClientStream
+}
+
+type seekTuneRecognizeClient struct {
+	grpc.ClientStream
+}
+
+func (x *seekTuneRecognizeClient) Send(m *RecognizeRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *seekTuneRecognizeClient) CloseAndRecv() (*RecognizeResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(RecognizeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *seekTuneClient) ListSongs(ctx context.Context, in *ListSongsRequest, opts ...grpc.CallOption) (*ListSongsResponse, error) {
+	out := new(ListSongsResponse)
+	err := c.cc.Invoke(ctx, SeekTune_ListSongs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *seekTuneClient) DeleteSong(ctx context.Context, in *DeleteSongRequest, opts ...grpc.CallOption) (*DeleteSongResponse, error) {
+	out := new(DeleteSongResponse)
+	err := c.cc.Invoke(ctx, SeekTune_DeleteSong_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SeekTuneServer is the server API for SeekTune service.
+// All implementations must embed UnimplementedSeekTuneServer
+// for forward compatibility
+type SeekTuneServer interface {
+	// RegisterSong downloads a YouTube video or SoundCloud track, or
+	// fingerprints an uploaded audio file, and saves it as a song.
+	RegisterSong(context.Context, *RegisterSongRequest) (*Song, error)
+	// Recognize receives a recording in chunks and returns the best matches
+	// once the client closes the stream.
+	Recognize(SeekTune_RecognizeServer) error
+	ListSongs(context.Context, *ListSongsRequest) (*ListSongsResponse, error)
+	DeleteSong(context.Context, *DeleteSongRequest) (*DeleteSongResponse, error)
+	mustEmbedUnimplementedSeekTuneServer()
+}
+
+// UnimplementedSeekTuneServer must be embedded to have forward compatible implementations.
+type UnimplementedSeekTuneServer struct {
+}
+
+func (UnimplementedSeekTuneServer) RegisterSong(context.Context, *RegisterSongRequest) (*Song, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterSong not implemented")
+}
+func (UnimplementedSeekTuneServer) Recognize(SeekTune_RecognizeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Recognize not implemented")
+}
+func (UnimplementedSeekTuneServer) ListSongs(context.Context, *ListSongsRequest) (*ListSongsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSongs not implemented")
+}
+func (UnimplementedSeekTuneServer) DeleteSong(context.Context, *DeleteSongRequest) (*DeleteSongResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSong not implemented")
+}
+func (UnimplementedSeekTuneServer) mustEmbedUnimplementedSeekTuneServer() {}
+
+// UnsafeSeekTuneServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SeekTuneServer will
+// result in compilation errors.
+type UnsafeSeekTuneServer interface {
+	mustEmbedUnimplementedSeekTuneServer()
+}
+
+func RegisterSeekTuneServer(s grpc.ServiceRegistrar, srv SeekTuneServer) {
+	s.RegisterService(&SeekTune_ServiceDesc, srv)
+}
+
+func _SeekTune_RegisterSong_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterSongRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SeekTuneServer).RegisterSong(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SeekTune_RegisterSong_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SeekTuneServer).RegisterSong(ctx, req.(*RegisterSongRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SeekTune_Recognize_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SeekTuneServer).Recognize(&seekTuneRecognizeServer{stream})
+}
+
+type SeekTune_RecognizeServer interface {
+	SendAndClose(*RecognizeResponse) error
+	Recv() (*RecognizeRequest, error)
+	grpc.ServerStream
+}
+
+type seekTuneRecognizeServer struct {
+	grpc.ServerStream
+}
+
+func (x *seekTuneRecognizeServer) SendAndClose(m *RecognizeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *seekTuneRecognizeServer) Recv() (*RecognizeRequest, error) {
+	m := new(RecognizeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _SeekTune_ListSongs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSongsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SeekTuneServer).ListSongs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SeekTune_ListSongs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SeekTuneServer).ListSongs(ctx, req.(*ListSongsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SeekTune_DeleteSong_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSongRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SeekTuneServer).DeleteSong(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SeekTune_DeleteSong_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SeekTuneServer).DeleteSong(ctx, req.(*DeleteSongRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SeekTune_ServiceDesc is the grpc.ServiceDesc for SeekTune service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SeekTune_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "seektune.SeekTune",
+	HandlerType: (*SeekTuneServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterSong",
+			Handler:    _SeekTune_RegisterSong_Handler,
+		},
+		{
+			MethodName: "ListSongs",
+			Handler:    _SeekTune_ListSongs_Handler,
+		},
+		{
+			MethodName: "DeleteSong",
+			Handler:    _SeekTune_DeleteSong_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Recognize",
+			Handler:       _SeekTune_Recognize_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "seektune.proto",
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"song-recognition/events"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"time"
+)
+
+// Types of the messages clients send. The payload type of each is named
+// in its comment; messages without one have no payload.
+const (
+	// TypeTotalSongs asks for the number of songs in the catalog, which is
+	// sent back as a TotalSongs message
+	TypeTotalSongs = "totalSongs"
+	// TypeNewDownload queues the download of songs: NewDownload
+	TypeNewDownload = "newDownload"
+	// TypeJobSubscribe asks for the progress of an ingestion job:
+	// JobSubscribe
+	TypeJobSubscribe = "jobSubscribe"
+	// TypeNewRecording recognizes a recording: NewRecording
+	TypeNewRecording = "newRecording"
+	// TypeStreamStart starts streaming raw audio to recognize: StreamStart
+	TypeStreamStart = "streamStart"
+	// TypeStreamChunk sends the next audio of a stream: StreamChunk
+	TypeStreamChunk = "streamChunk"
+	// TypeStreamStop ends a stream, which sends its final matches
+	TypeStreamStop = "streamStop"
+	// TypeUploadBegin starts uploading a recording in chunks: UploadBegin
+	TypeUploadBegin = "uploadBegin"
+	// TypeUploadChunk sends the next chunk of an upload: UploadChunk
+	TypeUploadChunk = "uploadChunk"
+	// TypeUploadEnd recognizes an uploaded recording: UploadEnd
+	TypeUploadEnd = "uploadEnd"
+	// TypeNowPlaying asks for the track the server's microphone hears,
+	// which is sent back as a NowPlaying message
+	TypeNowPlaying = "nowPlaying"
+)
+
+// Types of the messages the server sends, along with TypeTotalSongs and
+// TypeNowPlaying. The payload type of each is named in its comment.
+const (
+	// TypeError rejects a message: Error
+	TypeError = "error"
+	// TypeDownloadStatus reports on a download: DownloadStatus
+	TypeDownloadStatus = "downloadStatus"
+	// TypeTrackStatus reports on a track of a download: TrackStatus
+	TypeTrackStatus = "trackStatus"
+	// TypeJobStatus reports on an ingestion job: JobStatus
+	TypeJobStatus = "jobStatus"
+	// TypeJobError reports a job that can't be followed: ErrorMessage
+	TypeJobError = "jobError"
+	// TypeMatches holds the matches of a recording: Matches
+	TypeMatches = "matches"
+	// TypeRecognitionError reports a recording that wasn't recognized:
+	// ErrorMessage
+	TypeRecognitionError = "recognitionError"
+	// TypeStreamMatches holds the matches of a stream: StreamMatches
+	TypeStreamMatches = "streamMatches"
+	// TypeStreamError reports a stream that can't go on: ErrorMessage
+	TypeStreamError = "streamError"
+	// TypeUploadAck acknowledges the beginning or a chunk of an upload:
+	// UploadAck
+	TypeUploadAck = "uploadAck"
+	// TypeUploadError reports an upload that failed: UploadError
+	TypeUploadError = "uploadError"
+
+	// The lifecycle events of the jobs and recognitions a client follows
+	TypeSongDownloaded     = events.SongDownloaded     // Download
+	TypeFingerprintsStored = events.FingerprintsStored // Indexing
+	TypeMatchFound         = events.MatchFound         // MatchFound
+	TypeJobFailed          = events.JobFailed          // JobFailure
+)
+
+// NewRecording is a whole recording, with its base64 encoded audio
+type NewRecording = models.RecordData
+
+// StreamStart describes the raw PCM audio a stream is made of
+type StreamStart = models.StreamStart
+
+// UploadBegin announces a recording uploaded in chunks
+type UploadBegin = models.UploadBegin
+
+// UploadChunk is a piece of a recording upload
+type UploadChunk = models.UploadChunk
+
+// Match is a song a recording matched
+type Match = shazam.Match
+
+// TrackStatus is the progress of a track being downloaded
+type TrackStatus = spotify.TrackStatus
+
+// ImportSummary counts what became of the tracks of an artist or album
+// import
+type ImportSummary = spotify.ImportSummary
+
+// Download is a song whose audio was downloaded
+type Download = events.Download
+
+// Indexing is a song saved or reindexed with its fingerprints
+type Indexing = events.Indexing
+
+// MatchFound is the best match of a recognition
+type MatchFound = events.Match
+
+// JobFailure is an ingestion job that failed or was cancelled
+type JobFailure = events.JobFailure
+
+// NewDownload is a link to songs of any supported source
+type NewDownload struct {
+	URL string `json:"url"`
+}
+
+// JobSubscribe selects the job to report on
+type JobSubscribe struct {
+	JobID string `json:"jobId"`
+}
+
+// StreamChunk holds the base64 encoded raw PCM audio of a stream
+type StreamChunk struct {
+	Data string `json:"data"`
+}
+
+// UploadEnd selects the upload to recognize
+type UploadEnd struct {
+	UploadID string `json:"uploadId"`
+}
+
+// TotalSongs is the number of songs in the catalog
+type TotalSongs struct {
+	Count int `json:"count"`
+}
+
+// ErrorMessage describes why a request failed. RetryAfter is the number
+// of seconds to wait before sending a request rejected because the server
+// is busy again.
+type ErrorMessage struct {
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// DownloadStatus reports on a download. Type is info, success or error.
+type DownloadStatus struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// JobStatus is the progress of an ingestion job. Status is queued,
+// running, done, failed or cancelled.
+type JobStatus struct {
+	ID      string `json:"id"`
+	Source  string `json:"source"` // URL or file name the songs come from
+	Catalog string `json:"catalog,omitempty"`
+	Status  string `json:"status"`
+	// Stage is the last stage entered by a song of the job: downloading,
+	// converting, fingerprinting or storing
+	Stage    string        `json:"stage,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Songs    []utils.Song  `json:"songs,omitempty"`
+	Tracks   []TrackStatus `json:"tracks,omitempty"` // progress of each track of a playlist or album
+	Created  time.Time     `json:"created"`
+	Started  *time.Time    `json:"started,omitempty"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	// Summary counts the tracks of an artist or album import added, skipped
+	// and failed, once it is done
+	Summary *ImportSummary `json:"summary,omitempty"`
+}
+
+// Matches are the best matches of a recording, best first. TimedOut is set
+// when the recognition timed out, and Matches are only those found by then.
+type Matches struct {
+	Matches  []Match `json:"matches"`
+	TimedOut bool    `json:"timedOut,omitempty"`
+}
+
+// StreamMatches are the best matches of the audio streamed so far. Final
+// is set on the last matches of a stream, and TimedOut like for Matches.
+type StreamMatches struct {
+	Final    bool    `json:"final"`
+	Duration float64 `json:"duration"` // seconds of audio matched
+	Matches  []Match `json:"matches"`
+	TimedOut bool    `json:"timedOut,omitempty"`
+}
+
+// UploadAck acknowledges the bytes of audio of an upload received so far
+type UploadAck struct {
+	UploadID string `json:"uploadId"`
+	Received int    `json:"received"`
+}
+
+// UploadError reports an upload that failed, which is dropped
+type UploadError struct {
+	UploadID string `json:"uploadId"`
+	Error    string `json:"error"`
+}
+
+// NowPlaying is the track the server's microphone hears, nil when nothing
+// is recognized
+type NowPlaying struct {
+	Match *Match `json:"match"`
+}
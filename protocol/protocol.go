@@ -0,0 +1,132 @@
+// Package protocol defines the messages exchanged with socket clients that
+// connect with a protocol version. Every message is an Envelope sent on the
+// MessageEvent socket.io event, whose Type selects one of the payloads
+// defined here and whose Version is the version the client connected with.
+//
+// Clients that connect without a version are sent the older events named
+// after each message type, whose arguments are JSON strings.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the latest protocol version
+const Version = 1
+
+// MessageEvent is the socket.io event envelopes are sent on, both ways
+const MessageEvent = "message"
+
+// SupportedVersions lists the protocol versions the server speaks
+var SupportedVersions = []int{Version}
+
+// Supported reports whether the server speaks version
+func Supported(version int) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Envelope wraps every message. Payload is the JSON of the payload type of
+// Type, and is left out by messages without one.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewEnvelope wraps payload, nil for none, in a message of msgType
+func NewEnvelope(msgType string, version int, payload interface{}) (Envelope, error) {
+	env := Envelope{Type: msgType, Version: version}
+	if payload == nil {
+		return env, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return env, fmt.Errorf("failed to marshal %s payload: %v", msgType, err)
+	}
+	env.Payload = data
+	return env, nil
+}
+
+// Decode unmarshals the payload of env into payload
+func (env Envelope) Decode(payload interface{}) error {
+	if len(env.Payload) == 0 {
+		return &Error{Code: CodeInvalidMessage, Message: fmt.Sprintf("%s message has no payload", env.Type)}
+	}
+	if err := json.Unmarshal(env.Payload, payload); err != nil {
+		return &Error{Code: CodeInvalidMessage, Message: fmt.Sprintf("invalid %s payload: %v", env.Type, err)}
+	}
+	return nil
+}
+
+// Parse reads an envelope sent by a client. Envelopes that aren't JSON,
+// have no type or a version the server doesn't speak are rejected with an
+// *Error.
+func Parse(data string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(data), &env); err != nil {
+		return env, &Error{Code: CodeInvalidMessage, Message: fmt.Sprintf("invalid envelope: %v", err)}
+	}
+	if env.Type == "" {
+		return env, &Error{Code: CodeInvalidMessage, Message: "envelope has no type"}
+	}
+	if !Supported(env.Version) {
+		return env, UnsupportedVersion(env.Version)
+	}
+	return env, nil
+}
+
+// Codes of the Error messages
+const (
+	// CodeUnsupportedVersion rejects a message of a protocol version the
+	// server doesn't speak
+	CodeUnsupportedVersion = "unsupportedVersion"
+	// CodeUnknownType rejects a message of a type the server doesn't handle
+	CodeUnknownType = "unknownType"
+	// CodeInvalidMessage rejects a message that can't be read
+	CodeInvalidMessage = "invalidMessage"
+)
+
+// Error is the payload of an Error message, sent in reply to a message the
+// server rejected. SupportedVersions is set when the version was.
+type Error struct {
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	Type              string `json:"type,omitempty"` // of the rejected message
+	SupportedVersions []int  `json:"supportedVersions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// UnsupportedVersion returns the Error rejecting version
+func UnsupportedVersion(version int) *Error {
+	return &Error{
+		Code:              CodeUnsupportedVersion,
+		Message:           fmt.Sprintf("unsupported protocol version %d", version),
+		SupportedVersions: SupportedVersions,
+	}
+}
+
+// UnknownType returns the Error rejecting a message of msgType
+func UnknownType(msgType string) *Error {
+	return &Error{Code: CodeUnknownType, Message: fmt.Sprintf("unknown message type %q", msgType), Type: msgType}
+}
+
+// AsError returns err as an *Error, wrapping errors of other kinds as
+// invalid messages
+func AsError(err error) *Error {
+	var protocolErr *Error
+	if errors.As(err, &protocolErr) {
+		return protocolErr
+	}
+	return &Error{Code: CodeInvalidMessage, Message: err.Error()}
+}
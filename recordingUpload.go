@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"song-recognition/models"
+	"song-recognition/protocol"
+	"song-recognition/utils"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/mdobak/go-xerrors"
+)
+
+// Recordings too large for a single "newRecording" message are uploaded in
+// chunks: "uploadBegin" announces the recording and its size, "uploadChunk"
+// sends its audio a piece at a time, numbered from 0, and "uploadEnd"
+// reassembles and matches it. Every begin and chunk is acknowledged with an
+// "uploadAck" event, so slow clients can wait for it before sending more,
+// and failures are reported with "uploadError" events.
+
+var (
+	// maxUploadSize is the largest recording, in bytes of audio, that can
+	// be uploaded in chunks. Set with UPLOAD_MAX_SIZE.
+	maxUploadSize = intFromEnv("UPLOAD_MAX_SIZE", 32<<20)
+
+	// uploadTimeout is how long an upload can go without a chunk before it
+	// is dropped. Set with UPLOAD_TIMEOUT.
+	uploadTimeout = durationFromEnv("UPLOAD_TIMEOUT", 30*time.Second)
+)
+
+const (
+	maxUploadChunkSize = 1 << 20 // bytes of audio per chunk
+	maxSocketUploads   = 2       // uploads a socket can have in progress at once
+	maxUploadIDLength  = 64
+)
+
+// recordingUpload is a recording being uploaded in chunks
+type recordingUpload struct {
+	config    models.UploadBegin
+	chunks    map[int][]byte
+	received  int // bytes of audio received so far
+	timer     *time.Timer
+	requestID string // tags the logs of every chunk of the upload
+}
+
+// audio reassembles the chunks of the upload, or fails if some are missing
+func (u *recordingUpload) audio() ([]byte, error) {
+	audio := make([]byte, 0, u.received)
+	for seq := 0; seq < len(u.chunks); seq++ {
+		chunk, ok := u.chunks[seq]
+		if !ok {
+			return nil, fmt.Errorf("chunk %d is missing", seq)
+		}
+		audio = append(audio, chunk...)
+	}
+	if len(audio) != u.config.Size {
+		return nil, fmt.Errorf("received %d bytes of audio, expected %d", len(audio), u.config.Size)
+	}
+	return audio, nil
+}
+
+func emitUploadError(socket socketio.Conn, uploadID, message string) {
+	emitMessage(socket, protocol.TypeUploadError, protocol.UploadError{UploadID: uploadID, Error: message})
+}
+
+func emitUploadAck(socket socketio.Conn, uploadID string, received int) {
+	emitMessage(socket, protocol.TypeUploadAck, protocol.UploadAck{UploadID: uploadID, Received: received})
+}
+
+// socketSessionOf returns the session of socket, nil if it has none
+func socketSessionOf(socket socketio.Conn) *socketSession {
+	value, ok := socketSessions.Load(socket.ID())
+	if !ok {
+		return nil
+	}
+	return value.(*socketSession)
+}
+
+func handleUploadBegin(socket socketio.Conn, beginData string) {
+	logger := utils.GetLogger()
+	ctx := socketContext(socket)
+
+	var config models.UploadBegin
+	if err := json.Unmarshal([]byte(beginData), &config); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal upload config.", slog.Any("error", err))
+		return
+	}
+
+	if config.UploadID == "" || len(config.UploadID) > maxUploadIDLength {
+		emitUploadError(socket, config.UploadID, fmt.Sprintf("invalid upload ID, expected 1 to %d characters", maxUploadIDLength))
+		return
+	}
+
+	if !validAudioFormat(config.Channels, config.SampleRate, config.SampleSize) {
+		msg := fmt.Sprintf("unsupported recording format (sampleRate: %d, channels: %d, sampleSize: %d)",
+			config.SampleRate, config.Channels, config.SampleSize)
+		emitUploadError(socket, config.UploadID, msg)
+		return
+	}
+
+	if config.Size <= 0 || config.Size > maxUploadSize {
+		emitUploadError(socket, config.UploadID, fmt.Sprintf("invalid recording size %d, expected up to %d bytes", config.Size, maxUploadSize))
+		return
+	}
+
+	if !allowSocketRecognition(ctx, socket) {
+		emitUploadError(socket, config.UploadID, "rate limit exceeded")
+		return
+	}
+
+	session := socketSessionOf(socket)
+	if session == nil {
+		return
+	}
+
+	session.uploadsMu.Lock()
+	defer session.uploadsMu.Unlock()
+
+	if _, ok := session.uploads[config.UploadID]; ok {
+		emitUploadError(socket, config.UploadID, "upload already started")
+		return
+	}
+	if len(session.uploads) >= maxSocketUploads {
+		emitUploadError(socket, config.UploadID, fmt.Sprintf("too many uploads in progress, at most %d are allowed", maxSocketUploads))
+		return
+	}
+
+	upload := &recordingUpload{
+		config:    config,
+		chunks:    make(map[int][]byte),
+		requestID: utils.RequestIDFromContext(ctx),
+	}
+	upload.timer = time.AfterFunc(uploadTimeout, func() {
+		if dropUpload(session, config.UploadID, upload) {
+			emitUploadError(socket, config.UploadID, "upload timed out")
+		}
+	})
+
+	if session.uploads == nil {
+		session.uploads = make(map[string]*recordingUpload)
+	}
+	session.uploads[config.UploadID] = upload
+
+	emitUploadAck(socket, config.UploadID, 0)
+}
+
+// dropUpload forgets upload, unless it already was. It reports whether the
+// upload was dropped.
+func dropUpload(session *socketSession, uploadID string, upload *recordingUpload) bool {
+	session.uploadsMu.Lock()
+	defer session.uploadsMu.Unlock()
+
+	if session.uploads[uploadID] != upload {
+		return false
+	}
+	upload.timer.Stop()
+	delete(session.uploads, uploadID)
+	return true
+}
+
+func handleUploadChunk(socket socketio.Conn, chunkData string) {
+	logger := utils.GetLogger()
+	ctx := socketContext(socket)
+
+	var chunk models.UploadChunk
+	if err := json.Unmarshal([]byte(chunkData), &chunk); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal upload chunk.", slog.Any("error", err))
+		return
+	}
+
+	session := socketSessionOf(socket)
+	if session == nil {
+		return
+	}
+
+	session.uploadsMu.Lock()
+	defer session.uploadsMu.Unlock()
+
+	upload, ok := session.uploads[chunk.UploadID]
+	if !ok {
+		emitUploadError(socket, chunk.UploadID, "upload not started")
+		return
+	}
+	ctx = utils.WithRequestID(ctx, upload.requestID)
+
+	fail := func(message string) {
+		upload.timer.Stop()
+		delete(session.uploads, chunk.UploadID)
+		emitUploadError(socket, chunk.UploadID, message)
+	}
+
+	if len(chunk.Data) > base64.StdEncoding.EncodedLen(maxUploadChunkSize) {
+		fail(fmt.Sprintf("chunk %d is larger than %d bytes", chunk.Seq, maxUploadChunkSize))
+		return
+	}
+
+	audio, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to decode upload chunk.", slog.Any("error", err))
+		fail(fmt.Sprintf("chunk %d is not valid base64", chunk.Seq))
+		return
+	}
+
+	// Every chunk holds at least a byte, so there are at most as many
+	// chunks as bytes
+	if chunk.Seq < 0 || chunk.Seq >= upload.config.Size {
+		fail(fmt.Sprintf("invalid chunk sequence number %d", chunk.Seq))
+		return
+	}
+	if len(audio) == 0 || len(audio) > maxUploadChunkSize {
+		fail(fmt.Sprintf("chunk %d has %d bytes, expected 1 to %d", chunk.Seq, len(audio), maxUploadChunkSize))
+		return
+	}
+
+	// A chunk sent again, such as one whose ack was late, replaces the first
+	received := upload.received - len(upload.chunks[chunk.Seq]) + len(audio)
+	if received > upload.config.Size {
+		fail(fmt.Sprintf("received more than the %d bytes announced", upload.config.Size))
+		return
+	}
+
+	upload.chunks[chunk.Seq] = audio
+	upload.received = received
+	upload.timer.Reset(uploadTimeout)
+
+	emitUploadAck(socket, chunk.UploadID, upload.received)
+}
+
+// handleUploadEnd reassembles an upload and sends its matches to the client
+// as a "matches" event, like "newRecording" does
+func handleUploadEnd(socket socketio.Conn, endData string) {
+	logger := utils.GetLogger()
+	ctx := socketContext(socket)
+
+	var end struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal([]byte(endData), &end); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal upload end.", slog.Any("error", err))
+		return
+	}
+
+	session := socketSessionOf(socket)
+	if session == nil {
+		return
+	}
+
+	session.uploadsMu.Lock()
+	upload, ok := session.uploads[end.UploadID]
+	if ok {
+		upload.timer.Stop()
+		delete(session.uploads, end.UploadID)
+	}
+	session.uploadsMu.Unlock()
+	if !ok {
+		emitUploadError(socket, end.UploadID, "upload not started")
+		return
+	}
+	ctx = utils.WithRequestID(ctx, upload.requestID)
+
+	release, err := recognitionSlots.admit(ctx)
+	if err != nil {
+		emitMessage(socket, protocol.TypeRecognitionError, busyMessage(err))
+		return
+	}
+	defer release()
+
+	audio, err := upload.audio()
+	if err != nil {
+		emitUploadError(socket, end.UploadID, err.Error())
+		return
+	}
+
+	recData := models.RecordData{
+		Duration:   upload.config.Duration,
+		Channels:   upload.config.Channels,
+		SampleRate: upload.config.SampleRate,
+		SampleSize: upload.config.SampleSize,
+	}
+	samples, err := utils.ProcessRecordingAudio(audio, &recData, true)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to process recording.", slog.Any("error", err))
+		emitUploadError(socket, end.UploadID, "failed to process recording")
+		return
+	}
+
+	emitRecordingMatches(ctx, socket, samples, recData.Duration, recData.SampleRate)
+}
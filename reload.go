@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"song-recognition/config"
+	"song-recognition/utils"
+	"syscall"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// reloadOnSIGHUP reloads the settings every time the process receives
+// SIGHUP, until ctx is done
+func reloadOnSIGHUP(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			reloadSettings()
+		}
+	}
+}
+
+// reloadSettings loads the config file again and applies the settings that
+// can change while the server runs, such as the log level, rate limits,
+// cache sizes and scoring, without dropping its connections and jobs. It
+// logs which settings changed, and which only apply after a restart.
+func reloadSettings() (config.ReloadResult, error) {
+	logger := utils.GetLogger()
+	result, err := config.Reload()
+	if err != nil {
+		logger.Error("failed to reload settings, they are unchanged.", slog.Any("error", xerrors.New(err)))
+		return result, err
+	}
+
+	logger.Info("settings reloaded.", slog.String("file", config.Path()), slog.Any("applied", result.Applied))
+	if len(result.Ignored) > 0 {
+		logger.Warn("settings changed that only apply after a restart.", slog.Any("settings", result.Ignored))
+	}
+	return result, nil
+}
@@ -0,0 +1,252 @@
+package shazam
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+)
+
+// Config holds the parameters that turn audio into fingerprints. Songs
+// saved with one Config can only be recognized with the same Config, so
+// the config used is stored in the database with the first saved song.
+type Config struct {
+	// WindowSize is the number of samples in each FFT window
+	WindowSize int `json:"windowSize"`
+	// HopSize is the number of samples between consecutive windows
+	HopSize int `json:"hopSize"`
+	// DownsampleRatio is the factor the audio is downsampled by before the FFT
+	DownsampleRatio int `json:"downsampleRatio"`
+	// MaxFreq is the cutoff of the low-pass filter, in Hz
+	MaxFreq float64 `json:"maxFreq"`
+	// TargetZoneSize is the number of peaks each anchor is paired with
+	TargetZoneSize int `json:"targetZoneSize"`
+	// FreqBits and DeltaBits set how an address is split between the
+	// anchor and target frequencies and their time delta
+	FreqBits  int `json:"freqBits"`
+	DeltaBits int `json:"deltaBits"`
+	// PeakPicking selects how spectrogram peaks are picked. Empty keeps the
+	// strongest bin of each band that is above the average of the frame's
+	// bands, and PeakPickingAdaptive compares each band to its own energy
+	// over the surrounding frames, which holds up better against noise.
+	PeakPicking string `json:"peakPicking,omitempty"`
+	// PeakSensitivity is how many times its band's average energy a peak
+	// must reach with adaptive peak picking. Lower values keep more peaks.
+	PeakSensitivity float64 `json:"peakSensitivity,omitempty"`
+	// Framing selects how many windows the audio is cut into. FramingHop
+	// starts one every HopSize samples to the end of the audio. Empty keeps
+	// the count songs were saved with before, the number of samples over
+	// WindowSize - HopSize, whose windows only cover the start of the
+	// audio and are stretched over its duration.
+	Framing string `json:"framing,omitempty"`
+}
+
+// FramingHop selects windows every HopSize samples over the whole audio
+const FramingHop = "hop"
+
+// framingLegacy is the FINGERPRINT_FRAMING value of the empty Framing
+const framingLegacy = "legacy"
+
+// PeakPickingAdaptive selects per-band adaptive thresholds for peak picking
+const PeakPickingAdaptive = "adaptive"
+
+// defaultPeakSensitivity is the PeakSensitivity used when adaptive peak
+// picking is enabled without one
+const defaultPeakSensitivity = 2.5
+
+// DefaultConfig returns the parameters songs are saved with unless
+// FINGERPRINT_* variables are set
+func DefaultConfig() Config {
+	return Config{
+		WindowSize:      1024,
+		HopSize:         1024 / 32,
+		DownsampleRatio: 4,
+		MaxFreq:         5000,
+		TargetZoneSize:  5,
+		FreqBits:        9,
+		DeltaBits:       14,
+		Framing:         FramingHop,
+	}
+}
+
+// ConfigFromEnv returns DefaultConfig overridden by the FINGERPRINT_*
+// environment variables
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+
+	ints := map[string]*int{
+		"FINGERPRINT_WINDOW_SIZE":      &cfg.WindowSize,
+		"FINGERPRINT_HOP_SIZE":         &cfg.HopSize,
+		"FINGERPRINT_DOWNSAMPLE_RATIO": &cfg.DownsampleRatio,
+		"FINGERPRINT_TARGET_ZONE_SIZE": &cfg.TargetZoneSize,
+		"FINGERPRINT_FREQ_BITS":        &cfg.FreqBits,
+		"FINGERPRINT_DELTA_BITS":       &cfg.DeltaBits,
+	}
+	for name, field := range ints {
+		if value := utils.GetEnv(name); value != "" {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	floats := map[string]*float64{
+		"FINGERPRINT_MAX_FREQ":         &cfg.MaxFreq,
+		"FINGERPRINT_PEAK_SENSITIVITY": &cfg.PeakSensitivity,
+	}
+	for name, field := range floats {
+		if value := utils.GetEnv(name); value != "" {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	cfg.PeakPicking = utils.GetEnv("FINGERPRINT_PEAK_PICKING", cfg.PeakPicking)
+	cfg.Framing = utils.GetEnv("FINGERPRINT_FRAMING", cfg.Framing)
+	if cfg.Framing == framingLegacy {
+		cfg.Framing = ""
+	}
+	if cfg.PeakPicking == PeakPickingAdaptive && cfg.PeakSensitivity == 0 {
+		cfg.PeakSensitivity = defaultPeakSensitivity
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that the parameters can be used together
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.WindowSize < 64 || cfg.WindowSize&(cfg.WindowSize-1) != 0:
+		return errors.New("window size must be a power of two of at least 64")
+	case cfg.HopSize <= 0 || cfg.HopSize >= cfg.WindowSize:
+		return errors.New("hop size must be between 0 and the window size")
+	case cfg.Framing != "" && cfg.Framing != FramingHop:
+		return fmt.Errorf("framing must be %q or %q", FramingHop, framingLegacy)
+	case cfg.Framing == "" && 2*cfg.HopSize > cfg.WindowSize:
+		// The windows would start past the end of the audio
+		return errors.New("hop size must be at most half the window size with legacy framing")
+	case cfg.DownsampleRatio < 1:
+		return errors.New("downsample ratio must be at least 1")
+	case cfg.MaxFreq <= 0:
+		return errors.New("max frequency must be positive")
+	case cfg.TargetZoneSize < 1:
+		return errors.New("target zone size must be at least 1")
+	case cfg.FreqBits < 1 || cfg.DeltaBits < 1 || 2*cfg.FreqBits+cfg.DeltaBits > 32:
+		return errors.New("address bits must be positive and fit in 32 bits")
+	case cfg.PeakPicking != "" && cfg.PeakPicking != PeakPickingAdaptive:
+		return fmt.Errorf("peak picking must be empty or %q", PeakPickingAdaptive)
+	case cfg.PeakPicking == PeakPickingAdaptive && cfg.PeakSensitivity <= 0:
+		return errors.New("peak sensitivity must be positive")
+	}
+	return nil
+}
+
+// frames returns the number of windows of the spectrogram of n downsampled
+// samples. With FramingHop, audio shorter than a window has one window,
+// zero-padded.
+func (cfg Config) frames(n int) int {
+	switch {
+	case cfg.Framing == "":
+		return n / (cfg.WindowSize - cfg.HopSize)
+	case n <= 0:
+		return 0
+	case n < cfg.WindowSize:
+		return 1
+	}
+	return (n-cfg.WindowSize)/cfg.HopSize + 1
+}
+
+// frameSeconds returns the time between the starts of two windows with
+// FramingHop
+func (cfg Config) frameSeconds() float64 {
+	ratio := wav.CanonicalSampleRate / (wav.CanonicalSampleRate / cfg.DownsampleRatio)
+	return float64(cfg.HopSize*ratio) / wav.CanonicalSampleRate
+}
+
+// LoadConfig returns the configured fingerprinting parameters, checking
+// them against the ones stored in db. It fails if the database was built
+// with different parameters.
+func LoadConfig(ctx context.Context, db utils.DBClient) (Config, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	stored, exists, err := db.GetSetting(ctx, utils.FingerprintConfigSetting)
+	if err != nil {
+		return Config{}, err
+	}
+	if !exists {
+		return cfg, nil
+	}
+	if stored == reindexingConfig {
+		return Config{}, ErrReindexing
+	}
+
+	var storedCfg Config
+	if err := json.Unmarshal([]byte(stored), &storedCfg); err != nil {
+		return Config{}, fmt.Errorf("invalid stored fingerprint config: %v", err)
+	}
+	if storedCfg != cfg {
+		return Config{}, fmt.Errorf("fingerprint config %+v doesn't match the one the database was built with %+v", cfg, storedCfg)
+	}
+
+	return cfg, nil
+}
+
+// StoredConfig returns the config the songs in db are fingerprinted with,
+// and false if none is recorded or the catalog is being re-fingerprinted
+func StoredConfig(ctx context.Context, db utils.DBClient) (Config, bool, error) {
+	stored, exists, err := db.GetSetting(ctx, utils.FingerprintConfigSetting)
+	if err != nil || !exists || stored == reindexingConfig {
+		return Config{}, false, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(stored), &cfg); err != nil {
+		return Config{}, false, fmt.Errorf("invalid stored fingerprint config: %v", err)
+	}
+	return cfg, true, nil
+}
+
+// reindexingConfig is stored in place of the fingerprint config while the
+// fingerprints of a catalog are being replaced
+const reindexingConfig = "reindexing"
+
+// ErrReindexing is returned by LoadConfig while the fingerprints of the
+// catalog are being replaced by those made with other parameters
+var ErrReindexing = errors.New("the catalog is being re-fingerprinted, try again once it is done")
+
+// MarkReindexing makes LoadConfig fail with ErrReindexing for db until
+// SaveConfig records its new config
+func MarkReindexing(ctx context.Context, db utils.DBClient) error {
+	return db.SetSetting(ctx, utils.FingerprintConfigSetting, reindexingConfig)
+}
+
+// SaveConfig records cfg as the config the songs in db are fingerprinted with
+func SaveConfig(ctx context.Context, db utils.DBClient, cfg Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	return db.SetSetting(ctx, utils.FingerprintConfigSetting, string(data))
+}
+
+// Hash identifies cfg by the hex encoded start of the SHA-256 of its JSON,
+// which songs record as the parameters they were fingerprinted with
+func (cfg Config) Hash() string {
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
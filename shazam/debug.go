@@ -0,0 +1,123 @@
+package shazam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// debugDir is where the intermediate results of every recognition are
+// saved, to find out why a clip doesn't match. Set with DEBUG_DIR; nothing
+// is saved when it's empty.
+var debugDir = utils.GetEnv("DEBUG_DIR")
+
+// maxDebugMatches is the number of matches saved with a recognition
+const maxDebugMatches = 10
+
+// recognitionDump is what a recognition is saved with in debug mode
+type recognitionDump struct {
+	samples      []float64
+	sampleRate   int
+	duration     float64
+	cfg          Config
+	spectrogram  [][]complex128
+	peaks        []Peak
+	fingerprints int
+	matches      []Match
+}
+
+// debugPeak is a peak as saved in debug mode
+type debugPeak struct {
+	Time      float64 `json:"time"`
+	Frame     int     `json:"frame"`
+	Bin       int     `json:"bin"`
+	Magnitude float64 `json:"magnitude"`
+}
+
+// dumpRecognition saves a recognition in a directory of its own under
+// debugDir: the decoded mono audio, its spectrogram, the spectrogram with
+// the picked peaks marked, and a JSON summary with the peaks and matches.
+// Failing to save it is only logged.
+func dumpRecognition(ctx context.Context, dump recognitionDump) {
+	logger := utils.GetLogger()
+
+	requestID := utils.RequestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = fmt.Sprint(utils.GenerateUniqueID())
+	}
+	dir := filepath.Join(debugDir, time.Now().UTC().Format("20060102-150405.000")+"-"+requestID)
+
+	if err := writeRecognitionDump(ctx, dir, dump); err != nil {
+		logger.WarnContext(ctx, "failed to save recognition debug artifacts.",
+			slog.String("dir", dir),
+			slog.Any("error", xerrors.New(err)),
+		)
+		return
+	}
+	logger.DebugContext(ctx, "recognition debug artifacts saved.", slog.String("dir", dir))
+}
+
+func writeRecognitionDump(ctx context.Context, dir string, dump recognitionDump) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := wav.WriteMonoWavFile(filepath.Join(dir, "audio.wav"), dump.samples, dump.sampleRate); err != nil {
+		return fmt.Errorf("error writing audio: %v", err)
+	}
+
+	peaks := make([]debugPeak, len(dump.peaks))
+	for i, peak := range dump.peaks {
+		peaks[i] = debugPeak{Time: peak.Time, Frame: peak.Frame, Bin: peak.Bin, Magnitude: cmplx.Abs(peak.Freq)}
+	}
+
+	matches := dump.matches
+	if len(matches) > maxDebugMatches {
+		matches = matches[:maxDebugMatches]
+	}
+
+	summary, err := json.MarshalIndent(map[string]interface{}{
+		"requestId":    utils.RequestIDFromContext(ctx),
+		"catalog":      utils.CatalogFromContext(ctx),
+		"time":         time.Now().UTC(),
+		"sampleRate":   dump.sampleRate,
+		"duration":     dump.duration,
+		"samples":      len(dump.samples),
+		"config":       dump.cfg,
+		"frames":       len(dump.spectrogram),
+		"fingerprints": dump.fingerprints,
+		"peaks":        peaks,
+		"matches":      matches,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "recognition.json"), summary, 0644); err != nil {
+		return fmt.Errorf("error writing summary: %v", err)
+	}
+
+	if len(dump.spectrogram) == 0 {
+		return nil
+	}
+
+	img := spectrogramImage(dump.spectrogram, spectrogramBins(dump.cfg))
+	if err := writePNG(filepath.Join(dir, "spectrogram.png"), img); err != nil {
+		return fmt.Errorf("error writing spectrogram: %v", err)
+	}
+
+	drawPeaks(img, dump.peaks)
+	if err := writePNG(filepath.Join(dir, "peaks.png"), img); err != nil {
+		return fmt.Errorf("error writing peaks: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package shazam
+
+import (
+	"context"
+	"log/slog"
+	"song-recognition/utils"
+	"sort"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// maxDiagnosticCandidates is the number of songs diagnostics describe
+const maxDiagnosticCandidates = 5
+
+// maxDiagnosticBins is the number of histogram bins described per song
+const maxDiagnosticBins = 10
+
+// Diagnostics describes how a recording was searched for, to tune
+// fingerprinting and scoring on new audio material. The counts are those
+// of the whole recording at its own speed, before any retry.
+type Diagnostics struct {
+	// Duration is the length of the recording once preprocessed, in
+	// seconds, and TrimmedMs the silence trimmed from its start
+	Duration  float64 `json:"duration"`
+	TrimmedMs int     `json:"trimmedMs"`
+	// Peaks is the number of peaks picked from the spectrogram
+	Peaks int `json:"peaks"`
+	// Fingerprints is the number of addresses made of the peaks
+	Fingerprints int `json:"fingerprints"`
+	// AddressesFound is the number of them stored in the database, and
+	// HitRate their share of Fingerprints
+	AddressesFound int     `json:"addressesFound"`
+	HitRate        float64 `json:"hitRate"`
+	// Couples is the number of couples the found addresses hold, and
+	// MaxCouples that of the address with the most. Addresses shared by
+	// many songs tell little apart.
+	Couples    int `json:"couples"`
+	MaxCouples int `json:"maxCouples"`
+	// Candidates are the songs sharing the most hashes with the recording,
+	// the most first
+	Candidates []Candidate `json:"candidates"`
+	// Speed is the speed the matches were found at, 0 without a match, and
+	// Segmented whether they were found in segments of the recording
+	Speed     float64 `json:"speed"`
+	Segmented bool    `json:"segmented"`
+}
+
+// Candidate is a song sharing hashes with a recording
+type Candidate struct {
+	SongID     uint32 `json:"songId"`
+	SongTitle  string `json:"songTitle"`
+	SongArtist string `json:"songArtist"`
+	// Hashes is the number of hashes it shares with the recording
+	Hashes int `json:"hashes"`
+	// Aligned is the number of them around the peak of its offset
+	// histogram, its score, 0 if fewer than SCORING_MIN_ALIGNED_HASHES
+	Aligned int `json:"aligned"`
+	// Histogram are the bins of its offset histogram with the most votes,
+	// the most first
+	Histogram []HistogramBin `json:"histogram"`
+}
+
+// HistogramBin is a bin of the histogram of the offsets between the song
+// and recording anchor times of the hashes of a song
+type HistogramBin struct {
+	// OffsetMs is where the bin starts
+	OffsetMs int64 `json:"offsetMs"`
+	Votes    int   `json:"votes"`
+}
+
+// Diagnose searches for a recording like FindMatches, and also returns
+// diagnostics of how its fingerprints were found in the database. It is a
+// dry run: the recognition isn't cached, recorded in the history, counted
+// in the metrics or announced to event listeners.
+func Diagnose(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, Diagnostics, error) {
+	var diagnostics Diagnostics
+	matches, _, err := findMatches(WithoutHistory(ctx), audioSamples, audioDuration, sampleRate, &diagnostics)
+	return matches, diagnostics, err
+}
+
+// diagnose describes the search that got result
+func diagnose(ctx context.Context, db utils.DBClient, result searchResult, scoring Scoring) Diagnostics {
+	diagnostics := Diagnostics{
+		Peaks:          len(result.peaks),
+		Fingerprints:   result.fingerprints,
+		AddressesFound: result.hits,
+		Couples:        result.couples,
+		MaxCouples:     result.maxCouples,
+		Candidates:     []Candidate{},
+	}
+	if result.fingerprints > 0 {
+		diagnostics.HitRate = float64(result.hits) / float64(result.fingerprints)
+	}
+
+	songIDs := make([]uint32, 0, len(result.hashes))
+	for songID := range result.hashes {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Slice(songIDs, func(i, j int) bool {
+		a, b := len(result.hashes[songIDs[i]]), len(result.hashes[songIDs[j]])
+		return a > b || (a == b && songIDs[i] < songIDs[j])
+	})
+	if len(songIDs) > maxDiagnosticCandidates {
+		songIDs = songIDs[:maxDiagnosticCandidates]
+	}
+
+	for _, songID := range songIDs {
+		times := result.hashes[songID]
+		candidate := Candidate{SongID: songID, Hashes: len(times)}
+		if score, ok := scoring.score(times); ok {
+			candidate.Aligned = score.aligned
+		}
+
+		song, found, err := db.GetSongByID(ctx, songID)
+		if err != nil {
+			logger := utils.GetLogger()
+			logger.WarnContext(ctx, "failed to get candidate song.", slog.Any("song_id", songID), slog.Any("error", xerrors.New(err)))
+		} else if found {
+			candidate.SongTitle = song.Title
+			candidate.SongArtist = song.Artist
+		}
+
+		for bin, votes := range scoring.histogram(times) {
+			candidate.Histogram = append(candidate.Histogram, HistogramBin{OffsetMs: bin * int64(scoring.BinMs), Votes: votes})
+		}
+		sort.Slice(candidate.Histogram, func(i, j int) bool {
+			a, b := candidate.Histogram[i], candidate.Histogram[j]
+			return a.Votes > b.Votes || (a.Votes == b.Votes && a.OffsetMs < b.OffsetMs)
+		})
+		if len(candidate.Histogram) > maxDiagnosticBins {
+			candidate.Histogram = candidate.Histogram[:maxDiagnosticBins]
+		}
+
+		diagnostics.Candidates = append(diagnostics.Candidates, candidate)
+	}
+	return diagnostics
+}
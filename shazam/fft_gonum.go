@@ -0,0 +1,36 @@
+//go:build gonum
+
+package shazam
+
+import (
+	"math/cmplx"
+	"sync"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+// FFTBackend names the FFT implementation the binary was built with
+const FFTBackend = "gonum"
+
+// fftPools holds a pool of gonum FFTs for each window size. An FFT keeps
+// its work buffers between calls, so it can't be shared by the goroutines
+// of a spectrogram.
+var fftPools sync.Map // int -> *sync.Pool
+
+func fft(input []float64) []complex128 {
+	n := len(input)
+	pool, _ := fftPools.LoadOrStore(n, &sync.Pool{
+		New: func() any { return fourier.NewFFT(n) },
+	})
+	transform := pool.(*sync.Pool).Get().(*fourier.FFT)
+	defer pool.(*sync.Pool).Put(transform)
+
+	// The transform of real samples only has n/2+1 independent
+	// coefficients, the others are their conjugates in reverse order
+	result := make([]complex128, n)
+	transform.Coefficients(result[:n/2+1], input)
+	for k := 1; k < (n+1)/2; k++ {
+		result[n-k] = cmplx.Conj(result[k])
+	}
+	return result
+}
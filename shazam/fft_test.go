@@ -0,0 +1,60 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// dft is the discrete Fourier transform computed from its definition, the
+// reference both FFT backends must agree with. Run the tests with and
+// without the gonum tag to check both.
+func dft(input []float64) []complex128 {
+	n := len(input)
+	output := make([]complex128, n)
+	for k := range output {
+		var sum complex128
+		for t, sample := range input {
+			angle := -2 * math.Pi * float64(k) * float64(t) / float64(n)
+			sum += complex(sample, 0) * cmplx.Exp(complex(0, angle))
+		}
+		output[k] = sum
+	}
+	return output
+}
+
+func TestFFTMatchesDFT(t *testing.T) {
+	const epsilon = 1e-9
+	r := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{1, 2, 8, 64, 1024} {
+		input := make([]float64, n)
+		for i := range input {
+			input[i] = 2*r.Float64() - 1
+		}
+
+		got, want := FFT(input), dft(input)
+		if len(got) != n {
+			t.Fatalf("%s FFT of %d samples returned %d coefficients", FFTBackend, n, len(got))
+		}
+		for k := range want {
+			if cmplx.Abs(got[k]-want[k]) > epsilon*float64(n) {
+				t.Fatalf("%s FFT of %d samples: coefficient %d is %v, want %v", FFTBackend, n, k, got[k], want[k])
+			}
+		}
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	input := make([]float64, DefaultConfig().WindowSize)
+	for i := range input {
+		input[i] = 2*r.Float64() - 1
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FFT(input)
+	}
+}
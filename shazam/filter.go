@@ -6,8 +6,9 @@ import (
 
 // LowPassFilter is a first-order low-pass filter using H(p) = 1 / (1 + pRC)
 type LowPassFilter struct {
-	alpha float64 // Filter coefficient
-	yPrev float64 // Previous output value
+	alpha   float64 // Filter coefficient
+	yPrev   float64 // Previous output value
+	started bool    // a sample was filtered
 }
 
 // NewLowPassFilter creates a new low-pass filter
@@ -21,12 +22,14 @@ func NewLowPassFilter(cutoffFrequency, sampleRate float64) *LowPassFilter {
 	}
 }
 
-// Filter processes the input signal through the low-pass filter
+// Filter processes the input signal through the low-pass filter. A signal
+// can be filtered a chunk at a time, each chunk continuing from the last.
 func (lpf *LowPassFilter) Filter(input []float64) []float64 {
 	filtered := make([]float64, len(input))
 	for i, x := range input {
-		if i == 0 {
+		if !lpf.started {
 			filtered[i] = x * lpf.alpha
+			lpf.started = true
 		} else {
 			filtered[i] = lpf.alpha*x + (1-lpf.alpha)*lpf.yPrev
 		}
@@ -34,3 +37,39 @@ func (lpf *LowPassFilter) Filter(input []float64) []float64 {
 	}
 	return filtered
 }
+
+// biquadFilter is a second-order Butterworth filter, in transposed direct
+// form II so that it runs a chunk at a time like LowPassFilter
+type biquadFilter struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+// newBiquadFilter returns a low-pass filter, or a high-pass one if highPass
+// is set, with a cutoff at cutoffFrequency
+func newBiquadFilter(cutoffFrequency, sampleRate float64, highPass bool) *biquadFilter {
+	w0 := 2 * math.Pi * cutoffFrequency / sampleRate
+	cos, alpha := math.Cos(w0), math.Sin(w0)/math.Sqrt2
+	a0 := 1 + alpha
+
+	f := &biquadFilter{a1: -2 * cos / a0, a2: (1 - alpha) / a0}
+	if highPass {
+		f.b0 = (1 + cos) / 2 / a0
+		f.b1 = -(1 + cos) / a0
+	} else {
+		f.b0 = (1 - cos) / 2 / a0
+		f.b1 = (1 - cos) / a0
+	}
+	f.b2 = f.b0
+	return f
+}
+
+// Filter filters input in place, continuing from the last chunk
+func (f *biquadFilter) Filter(input []float64) {
+	for i, x := range input {
+		y := f.b0*x + f.z1
+		f.z1 = f.b1*x - f.a1*y + f.z2
+		f.z2 = f.b2*x - f.a2*y
+		input[i] = y
+	}
+}
@@ -1,6 +1,8 @@
 package shazam
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/png"
@@ -52,3 +54,85 @@ func SpectrogramToImage(spectrogram [][]complex128, outputPath string) error {
 
 	return nil
 }
+
+// RenderSpectrogram renders the spectrogram samples are fingerprinted from
+// with cfg, with time going right and frequency going up. With markPeaks,
+// the peaks their fingerprints are made of are marked in red.
+func RenderSpectrogram(samples []float64, sampleRate int, duration float64, cfg Config, markPeaks bool) (image.Image, error) {
+	spectrogram, err := Spectrogram(samples, sampleRate, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get spectrogram of samples: %v", err)
+	}
+	if len(spectrogram) == 0 {
+		return nil, errors.New("the audio is too short for a spectrogram")
+	}
+
+	img := spectrogramImage(spectrogram, spectrogramBins(cfg))
+	if markPeaks {
+		drawPeaks(img, ExtractPeaks(spectrogram, duration, cfg))
+	}
+	return img, nil
+}
+
+// spectrogramBins is the number of frequency bins of a spectrogram computed
+// with cfg that peaks are picked from
+func spectrogramBins(cfg Config) int {
+	bands := peakBands(cfg.WindowSize)
+	return bands[len(bands)-1].max
+}
+
+// debugImageRange is the span of magnitudes, in decibels below the loudest
+// bin, that spectrogramImage shades; quieter bins are black
+const debugImageRange = 80.0
+
+// spectrogramImage renders the magnitudes of the first numBins bins of a
+// spectrogram on a decibel scale, with time going right and frequency going
+// up, so quiet details stay visible next to loud ones
+func spectrogramImage(spectrogram [][]complex128, numBins int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(spectrogram), numBins))
+
+	maxMagnitude := 0.0
+	for _, frame := range spectrogram {
+		for _, value := range frame[:numBins] {
+			maxMagnitude = math.Max(maxMagnitude, cmplx.Abs(value))
+		}
+	}
+
+	for t, frame := range spectrogram {
+		for f, value := range frame[:numBins] {
+			var intensity uint8
+			if magnitude := cmplx.Abs(value); magnitude > 0 && maxMagnitude > 0 {
+				db := 20 * math.Log10(magnitude/maxMagnitude)
+				intensity = uint8(255 * math.Max(0, 1+db/debugImageRange))
+			}
+			img.SetRGBA(t, numBins-1-f, color.RGBA{R: intensity, G: intensity, B: intensity, A: 255})
+		}
+	}
+
+	return img
+}
+
+// drawPeaks marks every peak with a red cross on an image rendered by
+// spectrogramImage
+func drawPeaks(img *image.RGBA, peaks []Peak) {
+	red := color.RGBA{R: 255, A: 255}
+	height := img.Bounds().Dy()
+	for _, peak := range peaks {
+		x, y := peak.Frame, height-1-peak.Bin
+		for d := -2; d <= 2; d++ {
+			img.SetRGBA(x+d, y, red)
+			img.SetRGBA(x, y+d, red)
+		}
+	}
+}
+
+// writePNG saves img to a PNG file
+func writePNG(outputPath string, img image.Image) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return png.Encode(file, img)
+}
@@ -0,0 +1,308 @@
+package shazam
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"song-recognition/config"
+	"strconv"
+	"strings"
+)
+
+// Preprocessing tunes how audio is prepared before it is fingerprinted,
+// both for saved songs and for recordings. Peaks are picked relative to
+// the loudness around them, so the same audio gets the same peaks at any
+// level; normalizing first makes the silence threshold relative to the
+// loudness of the audio, so that quiet phone recordings get their silent
+// edges trimmed rather than being mistaken for silence whole. Unlike
+// Config, Preprocessing can be changed at any time: trimmed audio keeps its
+// timing, so songs saved with other settings are still recognized.
+type Preprocessing struct {
+	// Normalize scales the audio to TargetLevel
+	Normalize bool
+	// TargetLevel is the RMS level audio is normalized to, in dBFS
+	TargetLevel float64
+	// TrimSilence drops the start and end of the audio that are quieter
+	// than SilenceThreshold
+	TrimSilence bool
+	// SilenceThreshold is the level, in dBFS once normalized, under which
+	// a stretch of audio is silent
+	SilenceThreshold float64
+	// SongFilters and RecordingFilters filter songs and recordings before
+	// anything else, such as a high-pass removing the rumble that phone
+	// microphones pick up from recordings, which would otherwise take the
+	// peaks of the lowest bands
+	SongFilters      FilterChain
+	RecordingFilters FilterChain
+}
+
+// preprocessBlockSeconds is the length of the blocks audio is trimmed by
+const preprocessBlockSeconds = 0.01
+
+// DefaultPreprocessing returns the preprocessing used unless PREPROCESS_*
+// variables are set
+func DefaultPreprocessing() Preprocessing {
+	return Preprocessing{
+		Normalize:        true,
+		TargetLevel:      -20,
+		TrimSilence:      true,
+		SilenceThreshold: -50,
+	}
+}
+
+// PreprocessingFromEnv returns DefaultPreprocessing overridden by the
+// PREPROCESS_* environment variables
+func PreprocessingFromEnv() (Preprocessing, error) {
+	return preprocessingFrom(config.Lookup)
+}
+
+// preprocessingFrom returns DefaultPreprocessing overridden by the
+// PREPROCESS_* settings lookup finds
+func preprocessingFrom(lookup func(name string) (string, bool)) (Preprocessing, error) {
+	p := DefaultPreprocessing()
+
+	bools := map[string]*bool{
+		"PREPROCESS_NORMALIZE":    &p.Normalize,
+		"PREPROCESS_TRIM_SILENCE": &p.TrimSilence,
+	}
+	for name, field := range bools {
+		if value, _ := lookup(name); value != "" {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return Preprocessing{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	chains := map[string]*FilterChain{
+		"PREPROCESS_SONG_FILTERS":      &p.SongFilters,
+		"PREPROCESS_RECORDING_FILTERS": &p.RecordingFilters,
+	}
+	for name, field := range chains {
+		value, _ := lookup(name)
+		chain, err := ParseFilterChain(value)
+		if err != nil {
+			return Preprocessing{}, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*field = chain
+	}
+
+	floats := map[string]*float64{
+		"PREPROCESS_TARGET_LEVEL":      &p.TargetLevel,
+		"PREPROCESS_SILENCE_THRESHOLD": &p.SilenceThreshold,
+	}
+	for name, field := range floats {
+		if value, _ := lookup(name); value != "" {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Preprocessing{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	return p, p.Validate()
+}
+
+// Validate checks that the parameters can be used
+func (p Preprocessing) Validate() error {
+	switch {
+	case p.TargetLevel >= 0:
+		return errors.New("target level must be below 0 dBFS")
+	case p.SilenceThreshold >= 0:
+		return errors.New("silence threshold must be below 0 dBFS")
+	case p.Normalize && p.TrimSilence && p.SilenceThreshold >= p.TargetLevel:
+		return errors.New("silence threshold must be below the target level")
+	}
+	return nil
+}
+
+// enabled reports whether p measures audio to change its level or trim it
+func (p Preprocessing) enabled() bool {
+	return p.Normalize || p.TrimSilence
+}
+
+// Apply returns the samples of a recording at sampleRate preprocessed, and
+// the number of samples trimmed from its start. samples isn't modified.
+func (p Preprocessing) Apply(samples []float64, sampleRate int) ([]float64, int) {
+	if filters := p.RecordingFilters.newFilters(sampleRate); len(filters) > 0 {
+		samples = append([]float64(nil), samples...)
+		applyFilters(filters, samples)
+	}
+	if !p.enabled() {
+		return samples, 0
+	}
+
+	levels := newAudioLevels(sampleRate)
+	levels.write(samples)
+	gain, start, end := p.plan(levels)
+
+	processed := make([]float64, end-start)
+	for i, x := range samples[start:end] {
+		processed[i] = x * gain
+	}
+	return processed, start
+}
+
+// plan returns the gain audio of levels is normalized with, and the first
+// and last samples it keeps
+func (p Preprocessing) plan(levels *audioLevels) (gain float64, start, end int) {
+	levels.finish()
+	gain, start, end = 1, 0, levels.samples
+
+	if p.Normalize && levels.sumSquares > 0 {
+		rms := math.Sqrt(levels.sumSquares / float64(levels.samples))
+		gain = math.Pow(10, p.TargetLevel/20) / rms
+	}
+
+	if p.TrimSilence {
+		// Blocks are compared by their mean square, which spares square
+		// roots
+		threshold := math.Pow(10, p.SilenceThreshold/10) / (gain * gain)
+		first, last := -1, -1
+		for i, meanSquare := range levels.blocks {
+			if meanSquare >= threshold {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		// Audio that is silent throughout is kept whole, there is nothing
+		// else to fingerprint
+		if first >= 0 {
+			start = first * levels.blockSize
+			end = min((last+1)*levels.blockSize, levels.samples)
+		}
+	}
+	return gain, start, end
+}
+
+// audioLevels measures the loudness of audio written to it a chunk at a
+// time, overall and in blocks of blockSize samples
+type audioLevels struct {
+	blockSize  int
+	blocks     []float64 // mean square of each block
+	sumSquares float64
+	samples    int
+
+	// blockSum and blockCount are those of the block in progress
+	blockSum   float64
+	blockCount int
+}
+
+func newAudioLevels(sampleRate int) *audioLevels {
+	return &audioLevels{blockSize: max(1, int(float64(sampleRate)*preprocessBlockSeconds))}
+}
+
+func (l *audioLevels) write(samples []float64) {
+	for _, x := range samples {
+		square := x * x
+		l.sumSquares += square
+		l.blockSum += square
+		l.blockCount++
+		if l.blockCount == l.blockSize {
+			l.blocks = append(l.blocks, l.blockSum/float64(l.blockCount))
+			l.blockSum, l.blockCount = 0, 0
+		}
+	}
+	l.samples += len(samples)
+}
+
+// finish ends the last block, which can be short
+func (l *audioLevels) finish() {
+	if l.blockCount > 0 {
+		l.blocks = append(l.blocks, l.blockSum/float64(l.blockCount))
+		l.blockSum, l.blockCount = 0, 0
+	}
+}
+
+// Filter is a filter of a FilterChain
+type Filter struct {
+	// Kind is "highpass", "lowpass" or "bandpass"
+	Kind string
+	// Low and High are the cutoff frequencies in Hz, Low of high-pass and
+	// band-pass filters and High of low-pass and band-pass ones
+	Low, High float64
+}
+
+// FilterChain is a series of second-order filters that audio goes through
+// in order, written as comma-separated filters such as
+// "highpass:80,lowpass:5000" or "bandpass:80-5000". Repeating a filter
+// makes it steeper.
+type FilterChain []Filter
+
+// ParseFilterChain parses the filters of spec, none if it is empty
+func ParseFilterChain(spec string) (FilterChain, error) {
+	var chain FilterChain
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kind, cutoffs, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("filter %q has no cutoff frequency", part)
+		}
+
+		filter := Filter{Kind: strings.ToLower(strings.TrimSpace(kind))}
+		var err error
+		switch filter.Kind {
+		case "highpass":
+			filter.Low, err = parseCutoff(cutoffs)
+		case "lowpass":
+			filter.High, err = parseCutoff(cutoffs)
+		case "bandpass":
+			low, high, ok := strings.Cut(cutoffs, "-")
+			if !ok {
+				return nil, fmt.Errorf("band-pass filter %q needs a low and a high cutoff, such as bandpass:80-5000", part)
+			}
+			if filter.Low, err = parseCutoff(low); err == nil {
+				filter.High, err = parseCutoff(high)
+			}
+			if err == nil && filter.Low >= filter.High {
+				err = errors.New("the low cutoff must be below the high one")
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter %q, expected highpass, lowpass or bandpass", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", part, err)
+		}
+		chain = append(chain, filter)
+	}
+	return chain, nil
+}
+
+func parseCutoff(value string) (float64, error) {
+	cutoff, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || cutoff <= 0 {
+		return 0, fmt.Errorf("cutoff frequency %q must be a positive number of Hz", value)
+	}
+	return cutoff, nil
+}
+
+// newFilters returns the filters of the chain for audio at sampleRate.
+// Cutoffs at or above the Nyquist frequency of the audio have nothing to
+// cut, so they are left out.
+func (c FilterChain) newFilters(sampleRate int) []*biquadFilter {
+	nyquist := float64(sampleRate) / 2
+	var filters []*biquadFilter
+	for _, filter := range c {
+		if filter.Low > 0 && filter.Low < nyquist {
+			filters = append(filters, newBiquadFilter(filter.Low, float64(sampleRate), true))
+		}
+		if filter.High > 0 && filter.High < nyquist {
+			filters = append(filters, newBiquadFilter(filter.High, float64(sampleRate), false))
+		}
+	}
+	return filters
+}
+
+// applyFilters runs samples through filters in place
+func applyFilters(filters []*biquadFilter, samples []float64) {
+	for _, filter := range filters {
+		filter.Filter(samples)
+	}
+}
@@ -0,0 +1,178 @@
+package shazam
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"song-recognition/config"
+	"song-recognition/events"
+	"song-recognition/metrics"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// results is the process-wide cache of recent recognitions, so that
+// clients sending the same recording again, such as retries, get its
+// matches without querying the database. It is nil when RESULT_CACHE_SIZE
+// is unset or 0.
+var results = newResultCacheFromEnv()
+
+func newResultCacheFromEnv() *resultCache {
+	size, ttl := resultCacheSettings()
+	if size <= 0 {
+		return nil
+	}
+
+	cache := newResultCache(size, ttl)
+	// A song saved in a catalog may match recordings that matched nothing
+	events.Listen(func(event events.Event) {
+		if event.Type == events.FingerprintsStored {
+			cache.clear(event.Catalog)
+		}
+	})
+	return cache
+}
+
+// resultCacheSettings returns the size and TTL of the result cache, the
+// size 0 if it is unset or invalid
+func resultCacheSettings() (int, time.Duration) {
+	size, err := strconv.Atoi(utils.GetEnv("RESULT_CACHE_SIZE", "0"))
+	if err != nil || size < 0 {
+		size = 0
+	}
+	ttl, err := time.ParseDuration(utils.GetEnv("RESULT_CACHE_TTL", "5m"))
+	if err != nil || ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return size, ttl
+}
+
+// A reload resizes the cache, down to nothing with a size of 0, and sets
+// the TTL of the recordings cached from then on. A cache disabled when the
+// process started stays disabled.
+func init() {
+	config.OnReload(func() {
+		if results != nil {
+			results.resize(resultCacheSettings())
+		}
+	})
+}
+
+// resultKey identifies a recording by the hash of its samples and sample
+// rate, in a catalog
+type resultKey struct {
+	catalog string
+	hash    [sha256.Size]byte
+}
+
+func newResultKey(catalog string, samples []float64, sampleRate int) resultKey {
+	h := sha256.New()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(sampleRate))
+	h.Write(buf[:])
+	for _, sample := range samples {
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(sample))
+		h.Write(buf[:])
+	}
+
+	key := resultKey{catalog: catalog}
+	h.Sum(key.hash[:0])
+	return key
+}
+
+// resultCache is an LRU cache from recordings to their matches, whose
+// entries expire ttl after they are added
+type resultCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front is the most recently used
+	entries  map[resultKey]*list.Element
+}
+
+type resultCacheEntry struct {
+	key     resultKey
+	matches []Match
+	expires time.Time
+}
+
+func newResultCache(capacity int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[resultKey]*list.Element),
+	}
+}
+
+// get returns a copy of the cached matches of key, and false if they
+// aren't cached or expired
+func (c *resultCache) get(key resultKey) ([]Match, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && time.Now().After(elem.Value.(*resultCacheEntry).expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		metrics.RecognitionCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	metrics.RecognitionCacheLookups.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(elem)
+	return append([]Match(nil), elem.Value.(*resultCacheEntry).matches...), true
+}
+
+// add caches a copy of the matches of key
+func (c *resultCache) add(key resultKey, matches []Match) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &resultCacheEntry{key, append([]Match(nil), matches...), time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// resize changes the capacity and TTL of the cache, evicting the least
+// recently used recordings beyond its capacity
+func (c *resultCache) resize(capacity int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity, c.ttl = capacity, ttl
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// clear drops every recording of catalog from the cache
+func (c *resultCache) clear(catalog string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if key.catalog == catalog {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package shazam
+
+import (
+	"errors"
+	"fmt"
+	"song-recognition/config"
+	"strconv"
+)
+
+// Reloaded settings must make a valid scoring and preprocessing before they
+// replace the current ones, since both are read for every recognition
+func init() {
+	config.AddCheck(func(lookup func(name string) (string, bool)) error {
+		if _, err := scoringFrom(lookup); err != nil {
+			return fmt.Errorf("invalid scoring configuration: %v", err)
+		}
+		if _, err := preprocessingFrom(lookup); err != nil {
+			return fmt.Errorf("invalid preprocessing configuration: %v", err)
+		}
+		return nil
+	})
+}
+
+// Scoring tunes how the songs sharing fingerprints with a recording are
+// scored. A song that really plays in the recording has many hashes whose
+// song and recording anchor times are apart by the same offset, while
+// chance matches are spread over many offsets. Unlike Config, Scoring only
+// affects recognition, so it can be changed at any time.
+type Scoring struct {
+	// BinMs is the width of the histogram bins offsets are counted in, in
+	// milliseconds
+	BinMs int
+	// MinAlignedHashes is how many hashes must agree on an offset for a
+	// song to match
+	MinAlignedHashes int
+	// MaxSpeedChange is how much faster or slower than the saved song a
+	// recording may play, as a fraction of its speed, e.g. 0.1 for 10%.
+	// When the recording matches no song, it is searched for again
+	// stretched by every SpeedStep up to MaxSpeedChange. 0 disables it.
+	MaxSpeedChange float64
+	// SpeedStep is the speed difference between two retries
+	SpeedStep float64
+	// SegmentSeconds is the length of the overlapping segments a recording
+	// without a confident match is searched for again in, each on its own,
+	// since a short clean part of a mostly noisy recording can match when
+	// the whole doesn't. Segments start every half of it. 0 disables it.
+	SegmentSeconds float64
+	// SegmentMinConfidence is the confidence below which the best match of
+	// the whole recording isn't trusted, and its segments are searched too.
+	// With 0, only recordings that match no song are.
+	SegmentMinConfidence float64
+}
+
+// DefaultScoring returns the scoring used unless SCORING_* variables are set
+func DefaultScoring() Scoring {
+	return Scoring{
+		BinMs:            100,
+		MinAlignedHashes: 5,
+		SpeedStep:        0.02,
+		SegmentSeconds:   5,
+	}
+}
+
+// ScoringFromEnv returns DefaultScoring overridden by the SCORING_*
+// environment variables
+func ScoringFromEnv() (Scoring, error) {
+	return scoringFrom(config.Lookup)
+}
+
+// scoringFrom returns DefaultScoring overridden by the SCORING_* settings
+// lookup finds
+func scoringFrom(lookup func(name string) (string, bool)) (Scoring, error) {
+	scoring := DefaultScoring()
+
+	ints := map[string]*int{
+		"SCORING_BIN_MS":             &scoring.BinMs,
+		"SCORING_MIN_ALIGNED_HASHES": &scoring.MinAlignedHashes,
+	}
+	for name, field := range ints {
+		if value, _ := lookup(name); value != "" {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return Scoring{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	floats := map[string]*float64{
+		"SCORING_MAX_SPEED_CHANGE":       &scoring.MaxSpeedChange,
+		"SCORING_SPEED_STEP":             &scoring.SpeedStep,
+		"SCORING_SEGMENT_SECONDS":        &scoring.SegmentSeconds,
+		"SCORING_SEGMENT_MIN_CONFIDENCE": &scoring.SegmentMinConfidence,
+	}
+	for name, field := range floats {
+		if value, _ := lookup(name); value != "" {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Scoring{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = v
+		}
+	}
+
+	return scoring, scoring.Validate()
+}
+
+// Validate checks that the parameters can be used
+func (s Scoring) Validate() error {
+	switch {
+	case s.BinMs < 1:
+		return errors.New("scoring bin width must be at least 1 ms")
+	case s.MinAlignedHashes < 1:
+		return errors.New("minimum aligned hashes must be at least 1")
+	case s.MaxSpeedChange < 0 || s.MaxSpeedChange >= 0.5:
+		return errors.New("maximum speed change must be between 0 and 0.5")
+	case s.MaxSpeedChange > 0 && s.SpeedStep <= 0:
+		return errors.New("speed step must be positive")
+	case s.SegmentSeconds < 0:
+		return errors.New("segment length must not be negative")
+	case s.SegmentMinConfidence < 0 || s.SegmentMinConfidence > 1:
+		return errors.New("segment minimum confidence must be between 0 and 1")
+	}
+	return nil
+}
+
+// speeds returns the speeds, relative to the saved songs, a recording that
+// matches no song is searched for again at, the closest to 1 first
+func (s Scoring) speeds() []float64 {
+	var speeds []float64
+	// The epsilon keeps MaxSpeedChange itself despite rounding errors
+	for change := s.SpeedStep; s.MaxSpeedChange > 0 && change <= s.MaxSpeedChange+1e-9; change += s.SpeedStep {
+		speeds = append(speeds, 1+change, 1-change)
+	}
+	return speeds
+}
+
+// segments returns the start and end samples of the segments a recording
+// of n samples is searched in, none if it isn't longer than one segment.
+// The last segment ends with the recording.
+func (s Scoring) segments(n, sampleRate int) [][2]int {
+	length := int(s.SegmentSeconds * float64(sampleRate))
+	if length <= 0 || n <= length {
+		return nil
+	}
+
+	hop := max(length/2, 1)
+	var segments [][2]int
+	for start := 0; start+length < n; start += hop {
+		segments = append(segments, [2]int{start, start + length})
+	}
+	return append(segments, [2]int{n - length, n})
+}
+
+// songScore is how well a song lines up with a recording
+type songScore struct {
+	// aligned is the number of hashes around the peak of the offset
+	// histogram
+	aligned int
+	// offsetMs is the offset of the peak, the position in the song where
+	// the recording starts
+	offsetMs uint32
+}
+
+// score builds the histogram of the offsets between the song and recording
+// anchor times of a song's hashes, given as (recording, song) pairs, and
+// finds its peak. The hashes of a bin are counted along with those of the
+// bins next to it, since a true offset close to the edge of a bin spreads
+// over two. It reports false if fewer than MinAlignedHashes hashes agree.
+func (s Scoring) score(times [][2]uint32) (songScore, bool) {
+	if len(times) < s.MinAlignedHashes {
+		return songScore{}, false
+	}
+
+	histogram := s.histogram(times)
+	var peak int64
+	aligned := 0
+	for bin, count := range histogram {
+		count += histogram[bin-1] + histogram[bin+1]
+		if count > aligned || (count == aligned && bin < peak) {
+			peak, aligned = bin, count
+		}
+	}
+
+	if aligned < s.MinAlignedHashes {
+		return songScore{}, false
+	}
+	if peak < 0 {
+		// The recording starts before the song
+		return songScore{aligned: aligned}, true
+	}
+	return songScore{aligned: aligned, offsetMs: uint32(peak * int64(s.BinMs))}, true
+}
+
+// histogram counts the hashes of times in bins of BinMs by the offset
+// between their song and recording anchor times
+func (s Scoring) histogram(times [][2]uint32) map[int64]int {
+	binMs := int64(s.BinMs)
+	histogram := make(map[int64]int)
+	for _, t := range times {
+		offset := int64(t[1]) - int64(t[0])
+		// Floor division, so offsets just below zero don't share bin 0
+		bin := offset / binMs
+		if offset < 0 && offset%binMs != 0 {
+			bin--
+		}
+		histogram[bin]++
+	}
+	return histogram
+}
@@ -0,0 +1,119 @@
+package shazam
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestScoringHistogramFloorsNegativeOffsets(t *testing.T) {
+	s := Scoring{BinMs: 100}
+
+	// (recording, song) anchor times, the offset is song - recording
+	times := [][2]uint32{
+		{1000, 1000}, // 0
+		{1000, 1099}, // 99
+		{1000, 999},  // -1
+		{1000, 900},  // -100
+		{1000, 899},  // -101
+	}
+	want := map[int64]int{0: 2, -1: 2, -2: 1}
+	if got := s.histogram(times); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScoringScore(t *testing.T) {
+	// repeat returns n hashes whose song anchor time is offsetMs after the
+	// recording's
+	repeat := func(n int, offsetMs uint32) [][2]uint32 {
+		var times [][2]uint32
+		for i := 0; i < n; i++ {
+			recording := uint32(i * 500)
+			times = append(times, [2]uint32{recording, recording + offsetMs})
+		}
+		return times
+	}
+	join := func(parts ...[][2]uint32) [][2]uint32 {
+		var times [][2]uint32
+		for _, part := range parts {
+			times = append(times, part...)
+		}
+		return times
+	}
+
+	tests := []struct {
+		name  string
+		times [][2]uint32
+		want  songScore
+		ok    bool
+	}{
+		{"fewer hashes than the minimum", repeat(4, 2000), songScore{}, false},
+		{"just enough aligned hashes", repeat(5, 2000), songScore{aligned: 5, offsetMs: 2000}, true},
+		{"enough hashes, too few aligned", join(repeat(2, 0), repeat(2, 5000), repeat(2, 10000)), songScore{}, false},
+		{"peak split across adjacent bins", join(repeat(3, 1099), repeat(3, 1100)), songScore{aligned: 6, offsetMs: 1000}, true},
+		{"peak over scattered hashes", join(repeat(6, 3000), repeat(1, 500), repeat(1, 8000)), songScore{aligned: 6, offsetMs: 3000}, true},
+		{"song starts with the recording", repeat(5, 0), songScore{aligned: 5}, true},
+	}
+
+	s := Scoring{BinMs: 100, MinAlignedHashes: 5}
+	for _, test := range tests {
+		got, ok := s.score(test.times)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+
+	// Song anchor times before the recording's make a negative peak
+	negative := [][2]uint32{{5000, 4950}, {6000, 5950}, {7000, 6950}, {8000, 7950}, {9000, 8950}}
+	if got, ok := s.score(negative); !ok || got != (songScore{aligned: 5}) {
+		t.Errorf("negative offsets: got %+v, %v, want 5 aligned at 0", got, ok)
+	}
+}
+
+func TestScoringSpeeds(t *testing.T) {
+	tests := []struct {
+		maxChange, step float64
+		want            []float64
+	}{
+		{0, 0.02, nil},
+		{0.05, 0.02, []float64{1.02, 0.98, 1.04, 0.96}},
+		{0.06, 0.02, []float64{1.02, 0.98, 1.04, 0.96, 1.06, 0.94}},
+		{0.1, 0.05, []float64{1.05, 0.95, 1.1, 0.9}},
+	}
+
+	for _, test := range tests {
+		got := Scoring{MaxSpeedChange: test.maxChange, SpeedStep: test.step}.speeds()
+		if len(got) != len(test.want) {
+			t.Errorf("max change %v, step %v: got %v, want %v", test.maxChange, test.step, got, test.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 1e-9 {
+				t.Errorf("max change %v, step %v: got %v, want %v", test.maxChange, test.step, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestScoringSegments(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds float64
+		n       int
+		want    [][2]int
+	}{
+		{"disabled", 0, 100, nil},
+		{"recording no longer than a segment", 4, 40, nil},
+		{"segments end with the recording", 4, 100, [][2]int{{0, 40}, {20, 60}, {40, 80}, {60, 100}}},
+		{"tail shorter than a hop", 4, 105, [][2]int{{0, 40}, {20, 60}, {40, 80}, {60, 100}, {65, 105}}},
+	}
+
+	for _, test := range tests {
+		got := Scoring{SegmentSeconds: test.seconds}.segments(test.n, 10)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
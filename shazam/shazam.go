@@ -1,8 +1,13 @@
 package shazam
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
+	"song-recognition/events"
+	"song-recognition/metrics"
 	"song-recognition/utils"
 	"sort"
 	"time"
@@ -14,59 +19,335 @@ type Match struct {
 	SongArtist string
 	YouTubeID  string
 	Timestamp  uint32
-	Score      float64
+	// Score is the number of the recording's hashes that agree on the same
+	// alignment with the song
+	Score float64
+	// Confidence is the share of the recording's fingerprints that agree on
+	// the same alignment with the song, between 0 and 1
+	Confidence float64
+	// OffsetMs is the estimated position in the song where the recording starts
+	OffsetMs uint32
+	// OffsetSeconds is OffsetMs in seconds, for players that seek by seconds
+	OffsetSeconds float64
+	// Speed is how many times faster than the song the recording plays,
+	// e.g. 1.06 for a nightcore edit 6% faster. It is 1 unless the
+	// recording only matched once stretched.
+	Speed float64
+	// Service is the service that recognized the recording, such as
+	// "acoustid", for matches of songs that aren't in the catalog, which
+	// have no song ID. It is empty for the songs of the catalog.
+	Service string `json:",omitempty"`
+	utils.SongMetadata
 }
 
-// FindMatches processes the audio samples and finds matches in the database
-func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
+// TopMatches returns at most n matches with a confidence of at least
+// minConfidence, keeping their order
+func TopMatches(matches []Match, n int, minConfidence float64) []Match {
+	top := []Match{}
+	for _, match := range matches {
+		if len(top) >= n {
+			break
+		}
+		if match.Confidence >= minConfidence {
+			top = append(top, match)
+		}
+	}
+	return top
+}
+
+// FindMatches processes the audio samples and finds matches in the database.
+// The database lookups are cancelled when ctx is done. A recognition that
+// takes longer than RECOGNITION_TIMEOUT gives up, and returns ErrTimedOut
+// along with the matches found by then.
+func FindMatches(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
+	skip, _ := ctx.Value(withoutHistoryContextKey{}).(bool)
+
+	// Recognitions left out of the history are windows of streams and live
+	// inputs, which are never sent again, so they aren't cached
+	var matches []Match
+	var searchDuration time.Duration
+	var err error
+	cached := false
+	if results != nil && !skip {
+		startTime := time.Now()
+		key := newResultKey(utils.CatalogFromContext(ctx), audioSamples, sampleRate)
+		if matches, cached = results.get(key); cached {
+			searchDuration = time.Since(startTime)
+		} else if matches, searchDuration, err = findMatches(ctx, audioSamples, audioDuration, sampleRate, nil); err == nil {
+			results.add(key, matches)
+		}
+	} else {
+		matches, searchDuration, err = findMatches(ctx, audioSamples, audioDuration, sampleRate, nil)
+	}
+
+	metrics.RecognitionDuration.Observe(searchDuration.Seconds())
+	switch {
+	case errors.Is(err, ErrTimedOut):
+		metrics.Recognitions.WithLabelValues("timeout").Inc()
+	case err != nil:
+		metrics.Recognitions.WithLabelValues("error").Inc()
+	case len(matches) == 0:
+		metrics.Recognitions.WithLabelValues("no_match").Inc()
+	default:
+		metrics.Recognitions.WithLabelValues("match").Inc()
+	}
+
+	if err == nil {
+		attrs := []any{
+			slog.Float64("audio_duration", audioDuration),
+			slog.Int("matches", len(matches)),
+			slog.Duration("duration", searchDuration),
+		}
+		if len(matches) > 0 {
+			attrs = append(attrs, slog.Any("top_song_id", matches[0].SongID))
+		}
+		if cached {
+			attrs = append(attrs, slog.Bool("cached", true))
+		}
+		logger := utils.GetLogger()
+		logger.InfoContext(ctx, "recognition finished.", attrs...)
+	}
+	if errors.Is(err, ErrTimedOut) {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "recognition timed out.",
+			slog.Float64("audio_duration", audioDuration),
+			slog.Int("partial_matches", len(matches)),
+			slog.Duration("duration", searchDuration))
+	}
+
+	// Cached recognitions are recorded too, they were made again
+	if err == nil {
+		recordRecognition(ctx, matches)
+	}
+
+	// Partial matches of a stream aren't found yet
+	if err == nil && len(matches) > 0 && !skip {
+		events.Emit(ctx, events.MatchFound, events.Match{
+			SongID:     matches[0].SongID,
+			Title:      matches[0].SongTitle,
+			Artist:     matches[0].SongArtist,
+			Confidence: matches[0].Confidence,
+			OffsetMs:   matches[0].OffsetMs,
+			ClientID:   utils.ClientIDFromContext(ctx),
+		})
+	}
+
+	return matches, searchDuration, err
+}
+
+// findMatches searches for a recording, and fills diagnostics with how it
+// was searched for unless it is nil
+func findMatches(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int, diagnostics *Diagnostics) ([]Match, time.Duration, error) {
 	startTime := time.Now()
-	logger := utils.GetLogger()
 
-	spectrogram, err := Spectrogram(audioSamples, sampleRate)
-	if err != nil {
-		return nil, time.Since(startTime), fmt.Errorf("failed to get spectrogram of samples: %v", err)
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	// A search stopped by the timeout returns the matches found by then
+	trimmed := 0
+	stop := func(matches []Match, err error) ([]Match, time.Duration, error) {
+		if !timedOut(ctx) {
+			return nil, time.Since(startTime), err
+		}
+		untrim(matches, trimmed, sampleRate)
+		return matches, time.Since(startTime), ErrTimedOut
 	}
 
-	peaks := ExtractPeaks(spectrogram, audioDuration)
-	fingerprints := Fingerprint(peaks, utils.GenerateUniqueID())
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return stop(nil, err)
+	}
+	defer db.Close()
 
-	addresses := make([]uint32, 0, len(fingerprints))
-	for address := range fingerprints {
-		addresses = append(addresses, address)
+	cfg, err := LoadConfig(ctx, db)
+	if err != nil {
+		return stop(nil, err)
 	}
 
-	db, err := utils.NewDbClient()
+	scoring, err := ScoringFromEnv()
 	if err != nil {
 		return nil, time.Since(startTime), err
 	}
-	defer db.Close()
 
-	m, err := db.GetCouples(addresses)
+	pre, err := PreprocessingFromEnv()
 	if err != nil {
 		return nil, time.Since(startTime), err
 	}
+	preprocessed, trimmed := pre.Apply(audioSamples, sampleRate)
+	if len(preprocessed) != len(audioSamples) {
+		audioDuration = float64(len(preprocessed)) / float64(sampleRate)
+	}
+	audioSamples = preprocessed
+
+	result, err := search(ctx, db, audioSamples, audioDuration, sampleRate, cfg, scoring, 1)
+	if err != nil {
+		return stop(result.matches, err)
+	}
+	if diagnostics != nil {
+		*diagnostics = diagnose(ctx, db, result, scoring)
+		diagnostics.Duration = audioDuration
+		diagnostics.TrimmedMs = int(math.Round(float64(trimmed) / float64(sampleRate) * 1000))
+	}
+
+	// A recording played faster or slower than the song, like in DJ sets
+	// and nightcore edits, shares few hashes with it, so it is stretched
+	// back to the speeds it may have been changed by
+	if len(result.matches) == 0 {
+		for _, speed := range scoring.speeds() {
+			stretched, err := search(ctx, db, audioSamples, audioDuration, sampleRate, cfg, scoring, speed)
+			if err != nil {
+				return stop(stretched.matches, err)
+			}
+			if len(stretched.matches) > 0 {
+				result = stretched
+				break
+			}
+		}
+	}
+
+	// Noise over most of a recording can bury a song that plays clearly in
+	// part of it, so a recording without a confident match is searched
+	// for again in shorter segments, at the speed it matched at if any
+	if len(result.matches) == 0 || result.matches[0].Confidence < scoring.SegmentMinConfidence {
+		speed := 1.0
+		if len(result.matches) > 0 {
+			speed = result.matches[0].Speed
+		}
+		segmentMatches, err := searchSegments(ctx, db, audioSamples, sampleRate, cfg, scoring, speed)
+		if err != nil {
+			if len(segmentMatches) == 0 {
+				segmentMatches = result.matches
+			}
+			return stop(segmentMatches, err)
+		}
+		if len(segmentMatches) > 0 {
+			result.matches = segmentMatches
+			if diagnostics != nil {
+				diagnostics.Segmented = true
+			}
+		}
+	}
+	if diagnostics != nil && len(result.matches) > 0 {
+		diagnostics.Speed = result.matches[0].Speed
+	}
+
+	untrim(result.matches, trimmed, sampleRate)
+
+	if debugDir != "" {
+		dumpRecognition(ctx, recognitionDump{
+			samples:      audioSamples,
+			sampleRate:   sampleRate,
+			duration:     audioDuration,
+			cfg:          cfg,
+			spectrogram:  result.spectrogram,
+			peaks:        result.peaks,
+			fingerprints: result.fingerprints,
+			matches:      result.matches,
+		})
+	}
+
+	return result.matches, time.Since(startTime), nil
+}
+
+// untrim positions the matches of a recording whose first trimmed samples
+// were trimmed from the start of the whole recording, which is earlier in
+// the song by what was trimmed
+func untrim(matches []Match, trimmed, sampleRate int) {
+	for i, match := range matches {
+		trimmedMs := float64(trimmed) / float64(sampleRate) * 1000 * match.Speed
+		matches[i].OffsetMs = uint32(math.Round(max(float64(match.OffsetMs)-trimmedMs, 0)))
+		matches[i].OffsetSeconds = float64(matches[i].OffsetMs) / 1000
+	}
+}
+
+// searchResult is a recording's fingerprints and the songs they match
+type searchResult struct {
+	spectrogram  [][]complex128
+	peaks        []Peak
+	fingerprints int
+	matches      []Match
+
+	// hits is the number of addresses of the fingerprints found in the
+	// database, couples the number of couples they hold and maxCouples
+	// that of the address with the most
+	hits       int
+	couples    int
+	maxCouples int
+	// hashes are the (recording, song) anchor times of the hashes every
+	// song shares with the recording
+	hashes map[uint32][][2]uint32
+}
+
+// search fingerprints the recording stretched to speed times its length,
+// which brings a recording played speed times faster than a song back to
+// the song's speed, and returns the songs it matches sorted by score. A
+// search whose ctx is done while it scores the songs returns those scored
+// by then along with ctx's error.
+func search(ctx context.Context, db utils.DBClient, audioSamples []float64, audioDuration float64, sampleRate int, cfg Config, scoring Scoring, speed float64) (searchResult, error) {
+	logger := utils.GetLogger()
+
+	if err := ctx.Err(); err != nil {
+		return searchResult{}, err
+	}
+
+	// Playing the samples at a lower rate stretches them, lowering their
+	// pitch along with their tempo like a slowed down record
+	sampleRate = int(math.Round(float64(sampleRate) / speed))
+	audioDuration *= speed
+
+	spectrogram, err := Spectrogram(audioSamples, sampleRate, cfg)
+	if err != nil {
+		return searchResult{}, fmt.Errorf("failed to get spectrogram of samples: %v", err)
+	}
+
+	peaks := ExtractPeaks(spectrogram, audioDuration, cfg)
+	fingerprints := Fingerprint(peaks, utils.GenerateUniqueID(), cfg)
+
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+
+	m, err := db.GetCouples(ctx, addresses)
+	if err != nil {
+		return searchResult{}, err
+	}
 
 	matches := map[uint32][][2]uint32{} // songID -> [(sampleTime, dbTime)]
 	timestamps := map[uint32][]uint32{}
 
-	for address, couples := range m {
-		for _, couple := range couples {
+	hits, couples, maxCouples := 0, 0, 0
+	for address, addressCouples := range m {
+		if len(addressCouples) > 0 {
+			hits++
+		}
+		couples += len(addressCouples)
+		maxCouples = max(maxCouples, len(addressCouples))
+		for _, couple := range addressCouples {
 			matches[couple.SongID] = append(matches[couple.SongID], [2]uint32{fingerprints[address].AnchorTimeMs, couple.AnchorTimeMs})
 			timestamps[couple.SongID] = append(timestamps[couple.SongID], couple.AnchorTimeMs)
 		}
 	}
 
-	scores := analyzeRelativeTiming(matches)
-
 	var matchList []Match
-	for songID, points := range scores {
-		song, songExists, err := db.GetSongByID(songID)
+	var stopped error
+	for songID, times := range matches {
+		if stopped = ctx.Err(); stopped != nil {
+			break
+		}
+
+		score, ok := scoring.score(times)
+		if !ok {
+			continue
+		}
+
+		song, songExists, err := db.GetSongByID(ctx, songID)
 		if !songExists {
-			logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
+			logger.InfoContext(ctx, fmt.Sprintf("song with ID (%v) doesn't exist", songID))
 			continue
 		}
 		if err != nil {
-			logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
+			logger.InfoContext(ctx, fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
 			continue
 		}
 
@@ -74,7 +355,24 @@ func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int)
 			return timestamps[songID][i] < timestamps[songID][j]
 		})
 
-		match := Match{songID, song.Title, song.Artist, song.YouTubeID, timestamps[songID][0], points}
+		confidence := float64(score.aligned) / float64(len(fingerprints))
+		if confidence > 1 {
+			confidence = 1
+		}
+
+		match := Match{
+			SongID:        songID,
+			SongTitle:     song.Title,
+			SongArtist:    song.Artist,
+			YouTubeID:     song.YouTubeID,
+			Timestamp:     timestamps[songID][0],
+			Score:         float64(score.aligned),
+			Confidence:    confidence,
+			OffsetMs:      score.offsetMs,
+			OffsetSeconds: float64(score.offsetMs) / 1000,
+			Speed:         speed,
+			SongMetadata:  song.SongMetadata,
+		}
 		matchList = append(matchList, match)
 	}
 
@@ -82,24 +380,102 @@ func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int)
 		return matchList[i].Score > matchList[j].Score
 	})
 
-	return matchList, time.Since(startTime), nil
+	return searchResult{
+		spectrogram:  spectrogram,
+		peaks:        peaks,
+		fingerprints: len(fingerprints),
+		matches:      matchList,
+		hits:         hits,
+		couples:      couples,
+		maxCouples:   maxCouples,
+		hashes:       matches,
+	}, stopped
 }
 
-// AnalyzeRelativeTiming checks for consistent relative timing and returns a score
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
-	for songID, times := range matches {
-		count := 0
-		for i := 0; i < len(times); i++ {
-			for j := i + 1; j < len(times); j++ {
-				sampleDiff := math.Abs(float64(times[i][0] - times[j][0]))
-				dbDiff := math.Abs(float64(times[i][1] - times[j][1]))
-				if math.Abs(sampleDiff-dbDiff) < 100 { // Allow some tolerance
-					count++
-				}
-			}
+// searchSegments searches for the segments of a recording on their own
+// and merges their matches. Each segment votes for the song it matches
+// best, and songs are sorted by votes then by the confidence of their most
+// confident segment, whose match they keep. A segment search that fails
+// stops the search, which returns the matches of the segments searched
+// before it along with the error.
+func searchSegments(ctx context.Context, db utils.DBClient, audioSamples []float64, sampleRate int, cfg Config, scoring Scoring, speed float64) ([]Match, error) {
+	votes := map[uint32]int{}
+	best := map[uint32]Match{}
+	var err error
+	for _, segment := range scoring.segments(len(audioSamples), sampleRate) {
+		samples := audioSamples[segment[0]:segment[1]]
+		duration := float64(len(samples)) / float64(sampleRate)
+		var result searchResult
+		if result, err = search(ctx, db, samples, duration, sampleRate, cfg, scoring, speed); err != nil {
+			break
+		}
+		if len(result.matches) == 0 {
+			continue
 		}
-		scores[songID] = float64(count)
+
+		// The segment starts later in the recording than the recording in
+		// the song, by its start at the song's speed
+		match := result.matches[0]
+		startMs := float64(segment[0]) / float64(sampleRate) * 1000 * speed
+		match.OffsetMs = uint32(math.Round(max(float64(match.OffsetMs)-startMs, 0)))
+		match.OffsetSeconds = float64(match.OffsetMs) / 1000
+
+		votes[match.SongID]++
+		if previous, ok := best[match.SongID]; !ok || match.Confidence > previous.Confidence {
+			best[match.SongID] = match
+		}
+	}
+
+	matches := make([]Match, 0, len(best))
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if votes[matches[i].SongID] != votes[matches[j].SongID] {
+			return votes[matches[i].SongID] > votes[matches[j].SongID]
+		}
+		return matches[i].Confidence > matches[j].Confidence
+	})
+	return matches, err
+}
+
+type withoutHistoryContextKey struct{}
+
+// WithoutHistory returns a copy of ctx whose recognitions aren't recorded
+// in the recognition history, e.g. for the partial results of a stream
+func WithoutHistory(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutHistoryContextKey{}, true)
+}
+
+// recordRecognition stores the best of matches, or the lack of one, in the
+// history of the client of ctx. A recognition doesn't fail because its
+// history couldn't be saved.
+func recordRecognition(ctx context.Context, matches []Match) {
+	if skip, _ := ctx.Value(withoutHistoryContextKey{}).(bool); skip {
+		return
+	}
+	logger := utils.GetLogger()
+
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to record recognition.", slog.Any("error", err))
+		return
+	}
+	defer db.Close()
+
+	recognition := utils.Recognition{
+		Time:     time.Now().UTC(),
+		ClientID: utils.ClientIDFromContext(ctx),
+	}
+	if len(matches) > 0 {
+		recognition.SongID = matches[0].SongID
+		recognition.SongTitle = matches[0].SongTitle
+		recognition.SongArtist = matches[0].SongArtist
+		recognition.Confidence = matches[0].Confidence
+	}
+
+	// Read-only servers leave the history to the server that can write
+	if err := db.StoreRecognition(ctx, recognition); err != nil && !errors.Is(err, utils.ErrReadOnly) {
+		logger.ErrorContext(ctx, "failed to record recognition.", slog.Any("error", err))
 	}
-	return scores
 }
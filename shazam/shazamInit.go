@@ -1,6 +1,7 @@
 package shazam
 
 import (
+	"context"
 	"fmt"
 	"song-recognition/models"
 	"song-recognition/utils"
@@ -16,27 +17,32 @@ type Match1 struct {
 	Coherency  float64
 }
 
-func Search(audioSamples []float64, audioDuration float64, sampleRate int) ([]Match1, error) {
-	spectrogram, err := Spectrogram(audioSamples, sampleRate)
+func Search(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int) ([]Match1, error) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	cfg, err := LoadConfig(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	spectrogram, err := Spectrogram(audioSamples, sampleRate, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get spectrogram of samples: %v", err)
 	}
 
-	peaks := ExtractPeaks(spectrogram, audioDuration)
-	fingerprints := Fingerprint(peaks, utils.GenerateUniqueID())
+	peaks := ExtractPeaks(spectrogram, audioDuration, cfg)
+	fingerprints := Fingerprint(peaks, utils.GenerateUniqueID(), cfg)
 
 	addresses := make([]uint32, 0, len(fingerprints))
 	for address, _ := range fingerprints {
 		addresses = append(addresses, address)
 	}
 
-	db, err := utils.NewDbClient()
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
-	couples, err := db.GetCouples(addresses)
+	couples, err := db.GetCouples(ctx, addresses)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +53,7 @@ func Search(audioSamples []float64, audioDuration float64, sampleRate int) ([]Ma
 
 	var matchList []Match1
 	for songID, coherency := range matches {
-		song, songExists, err := db.GetSongByID(songID)
+		song, songExists, err := db.GetSongByID(ctx, songID)
 		if err != nil || !songExists {
 			return nil, err
 		}
@@ -5,53 +5,92 @@ import (
 	"fmt"
 	"math"
 	"math/cmplx"
+	"runtime"
+	"song-recognition/wav"
+	"sync"
 )
 
-const (
-	dspRatio    = 4
-	freqBinSize = 1024
-	maxFreq     = 5000.0 // 5kHz
-	hopSize     = freqBinSize / 32
-)
+// Spectrogram computes the short-time Fourier transform of the samples using
+// the window and hop sizes of cfg. Samples at a rate other than
+// wav.CanonicalSampleRate are resampled first, so the frequency bins don't
+// depend on the input rate.
+func Spectrogram(samples []float64, sampleRate int, cfg Config) ([][]complex128, error) {
+	if sampleRate != wav.CanonicalSampleRate {
+		resampled, err := wav.Resample(samples, sampleRate, wav.CanonicalSampleRate)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resample audio samples: %v", err)
+		}
+		samples, sampleRate = resampled, wav.CanonicalSampleRate
+	}
 
-func Spectrogram(samples []float64, sampleRate int) ([][]complex128, error) {
-	lpf := NewLowPassFilter(maxFreq, float64(sampleRate))
+	lpf := NewLowPassFilter(cfg.MaxFreq, float64(sampleRate))
 	filteredSamples := lpf.Filter(samples)
 
-	downsampledSamples, err := Downsample(filteredSamples, sampleRate, sampleRate/dspRatio)
+	downsampledSamples, err := Downsample(filteredSamples, sampleRate, sampleRate/cfg.DownsampleRatio)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't downsample audio samples: %v", err)
 	}
 
-	numOfWindows := len(downsampledSamples) / (freqBinSize - hopSize)
-	spectrogram := make([][]complex128, numOfWindows)
+	spectrogram := make([][]complex128, cfg.frames(len(downsampledSamples)))
+	stftFrames(spectrogram, 0, downsampledSamples, 0, cfg.HopSize, hammingWindow(cfg.WindowSize))
+
+	return spectrogram, nil
+}
 
-	// Apply Hamming window function
-	window := make([]float64, freqBinSize)
+// hammingWindow returns the Hamming window function of size samples
+func hammingWindow(size int) []float64 {
+	window := make([]float64, size)
 	for i := range window {
-		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(float64(freqBinSize)-1))
+		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(float64(size)-1))
 	}
+	return window
+}
+
+// stftFrames sets frames to the FFTs of the windows of samples starting
+// every hopSize samples, from the first-th window on. samples starts with
+// the offset-th sample. Windows are independent, so they are split into
+// contiguous chunks that are transformed concurrently.
+func stftFrames(frames [][]complex128, first int, samples []float64, offset, hopSize int, window []float64) {
+	stftFramesOn(runtime.NumCPU(), frames, first, samples, offset, hopSize, window)
+}
 
-	// Perform STFT
-	for i := 0; i < numOfWindows; i++ {
-		start := i * hopSize
-		end := start + freqBinSize
-		if end > len(downsampledSamples) {
-			end = len(downsampledSamples)
+// stftFramesOn is stftFrames with the windows split among workers
+// goroutines
+func stftFramesOn(workers int, frames [][]complex128, first int, samples []float64, offset, hopSize int, window []float64) {
+	chunkSize := (len(frames) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(frames); lo += chunkSize {
+		hi := lo + chunkSize
+		if hi > len(frames) {
+			hi = len(frames)
 		}
 
-		bin := make([]float64, freqBinSize)
-		copy(bin, downsampledSamples[start:end])
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				frames[i] = stftWindow(samples, (first+i)*hopSize-offset, window)
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+}
 
-		// Apply Hamming window
-		for j := range window {
-			bin[j] *= window[j]
-		}
+// stftWindow returns the FFT of the samples in the window starting at start,
+// zero-padded past the end of the samples
+func stftWindow(samples []float64, start int, window []float64) []complex128 {
+	start = min(start, len(samples))
+	end := min(start+len(window), len(samples))
+
+	bin := make([]float64, len(window))
+	copy(bin, samples[start:end])
 
-		spectrogram[i] = FFT(bin)
+	// Apply Hamming window
+	for j := range window {
+		bin[j] *= window[j]
 	}
 
-	return spectrogram, nil
+	return FFT(bin)
 }
 
 // Downsample downsamples the input audio from originalSampleRate to targetSampleRate
@@ -86,73 +125,248 @@ func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]fl
 	return resampled, nil
 }
 
+// peakBand is a range of FFT bins peaks are picked from
+type peakBand struct{ min, max int }
+
+// peakBands returns the logarithmically spaced bands peaks are picked from,
+// scaled to the window size
+func peakBands(windowSize int) []peakBand {
+	bands := []peakBand{{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512}}
+	for i := range bands {
+		bands[i].min = bands[i].min * windowSize / 1024
+		bands[i].max = bands[i].max * windowSize / 1024
+	}
+	return bands
+}
+
 type Peak struct {
 	Time float64
 	Freq complex128
+	// Frame and Bin locate the peak in the spectrogram it was picked from
+	Frame, Bin int
 }
 
 // ExtractPeaks analyzes a spectrogram and extracts significant peaks in the frequency domain over time.
-func ExtractPeaks(spectrogram [][]complex128, audioDuration float64) []Peak {
+// The frequency bands scale with the window size of cfg. With legacy framing, the windows are
+// stretched over audioDuration.
+func ExtractPeaks(spectrogram [][]complex128, audioDuration float64, cfg Config) []Peak {
 	if len(spectrogram) < 1 {
 		return []Peak{}
 	}
 
+	picker := newPeakPicker(len(spectrogram), audioDuration, cfg)
+	for _, frame := range spectrogram {
+		picker.add(frame)
+	}
+	return picker.peaks
+}
+
+const (
+	// adaptiveAverageSeconds is how far before and after a frame the band
+	// energy is averaged over for its adaptive threshold
+	adaptiveAverageSeconds = 1.0
+	// adaptiveNeighborBins is how many bins on each side a peak must be
+	// the maximum of. Consecutive frames overlap almost entirely, so peaks
+	// are only compared along frequency.
+	adaptiveNeighborBins = 2
+)
+
+// peakPicker picks the peaks of a spectrogram of frames frames a frame at
+// a time, so that the spectrogram doesn't need to be held whole. Adaptive
+// peak picking keeps the frames its averages span until it picks their
+// peaks.
+type peakPicker struct {
+	cfg         Config
+	bands       []peakBand
+	frames      int
+	binDuration float64
+	// averageFrames is how many frames before and after a frame adaptive
+	// thresholds are averaged over
+	averageFrames int
+
+	// pending holds the spectrum and the magnitudes of the frames added
+	// whose peaks aren't picked yet, from the picked-th frame on
+	pending    [][]complex128
+	magnitudes [][]float64
+	picked     int
+	added      int
+	// energySums[b][t-sumsStart] is the sum of the mean magnitudes of band
+	// b over the first t frames, so moving averages take constant time
+	energySums [][]float64
+	sumsStart  int
+
+	peaks []Peak
+}
+
+func newPeakPicker(frames int, audioDuration float64, cfg Config) *peakPicker {
+	p := &peakPicker{
+		cfg:         cfg,
+		bands:       peakBands(cfg.WindowSize),
+		frames:      frames,
+		binDuration: audioDuration / float64(frames),
+	}
+	if cfg.Framing == FramingHop {
+		p.binDuration = cfg.frameSeconds()
+	}
+
+	p.averageFrames = 1
+	if p.binDuration > 0 {
+		p.averageFrames = int(math.Max(1, math.Round(adaptiveAverageSeconds/p.binDuration)))
+	}
+	p.energySums = make([][]float64, len(p.bands))
+	for b := range p.energySums {
+		p.energySums[b] = []float64{0}
+	}
+	return p
+}
+
+// add picks the peaks of the next frame, or with adaptive peak picking, of
+// the frames whose surrounding frames were all added
+func (p *peakPicker) add(frame []complex128) {
+	t := p.added
+	p.added++
+	if p.cfg.PeakPicking != PeakPickingAdaptive {
+		p.peaks = append(p.peaks, framePeaks(frame, t, p.binDuration, p.bands)...)
+		return
+	}
+
+	numBins := p.bands[len(p.bands)-1].max
+	magnitudes := make([]float64, numBins)
+	for f := range magnitudes {
+		magnitudes[f] = cmplx.Abs(frame[f])
+	}
+	for b, band := range p.bands {
+		var sum float64
+		for _, magnitude := range magnitudes[band.min:band.max] {
+			sum += magnitude
+		}
+		sums := p.energySums[b]
+		p.energySums[b] = append(sums, sums[len(sums)-1]+sum/float64(band.max-band.min))
+	}
+	p.pending = append(p.pending, frame)
+	p.magnitudes = append(p.magnitudes, magnitudes)
+
+	for p.picked < p.frames && min(p.picked+p.averageFrames+1, p.frames) <= p.added {
+		p.pickAdaptive()
+	}
+}
+
+// pickAdaptive picks, in the next pending frame and each band, the
+// strongest bin if it is a local maximum over the neighbouring bins, and
+// reaches cfg.PeakSensitivity times the band's mean magnitude averaged over
+// the surrounding frames. Thresholds follow the loudness of each band, so a
+// noisy band doesn't drown out the peaks of the others.
+func (p *peakPicker) pickAdaptive() {
+	t := p.picked
+	frame, magnitudes := p.pending[0], p.magnitudes[0]
+	p.pending, p.magnitudes = p.pending[1:], p.magnitudes[1:]
+	p.picked++
+
+	first, last := t-p.averageFrames, t+p.averageFrames+1
+	if first < 0 {
+		first = 0
+	}
+	if last > p.frames {
+		last = p.frames
+	}
+
+	for b, band := range p.bands {
+		strongest := band.min
+		for f := band.min; f < band.max; f++ {
+			if magnitudes[f] > magnitudes[strongest] {
+				strongest = f
+			}
+		}
+
+		magnitude := magnitudes[strongest]
+		sums := p.energySums[b]
+		average := (sums[last-p.sumsStart] - sums[first-p.sumsStart]) / float64(last-first)
+		if magnitude == 0 || magnitude < p.cfg.PeakSensitivity*average {
+			continue
+		}
+		if !isLocalMaximum(magnitudes, strongest) {
+			continue
+		}
+
+		peakTimeInBin := float64(strongest) * p.binDuration / float64(len(frame))
+		peakTime := float64(t)*p.binDuration + peakTimeInBin
+		p.peaks = append(p.peaks, Peak{Time: peakTime, Freq: frame[strongest], Frame: t, Bin: strongest})
+	}
+
+	// The sums before the first frame the next average spans aren't needed
+	if drop := p.picked - p.averageFrames - p.sumsStart; drop > 0 {
+		for b := range p.energySums {
+			p.energySums[b] = p.energySums[b][drop:]
+		}
+		p.sumsStart += drop
+	}
+}
+
+// framePeaks returns the peaks of the t-th frame of a spectrogram whose
+// frames last binDuration: the strongest bin of each band, when it exceeds
+// the average of the strongest bins of the bands
+func framePeaks(bin []complex128, binIdx int, binDuration float64, bands []peakBand) []Peak {
 	type maxies struct {
 		maxMag  float64
 		maxFreq complex128
 		freqIdx int
 	}
 
-	bands := []struct{ min, max int }{{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512}}
-
 	var peaks []Peak
-	binDuration := audioDuration / float64(len(spectrogram))
-
-	for binIdx, bin := range spectrogram {
-		var maxMags []float64
-		var maxFreqs []complex128
-		var freqIndices []float64
-
-		binBandMaxies := []maxies{}
-		for _, band := range bands {
-			var maxx maxies
-			var maxMag float64
-			for idx, freq := range bin[band.min:band.max] {
-				magnitude := cmplx.Abs(freq)
-				if magnitude > maxMag {
-					maxMag = magnitude
-					freqIdx := band.min + idx
-					maxx = maxies{magnitude, freq, freqIdx}
-				}
+	var maxMags []float64
+	var maxFreqs []complex128
+	var freqIndices []float64
+
+	binBandMaxies := []maxies{}
+	for _, band := range bands {
+		var maxx maxies
+		var maxMag float64
+		for idx, freq := range bin[band.min:band.max] {
+			magnitude := cmplx.Abs(freq)
+			if magnitude > maxMag {
+				maxMag = magnitude
+				freqIdx := band.min + idx
+				maxx = maxies{magnitude, freq, freqIdx}
 			}
-			binBandMaxies = append(binBandMaxies, maxx)
 		}
+		binBandMaxies = append(binBandMaxies, maxx)
+	}
 
-		for _, value := range binBandMaxies {
-			maxMags = append(maxMags, value.maxMag)
-			maxFreqs = append(maxFreqs, value.maxFreq)
-			freqIndices = append(freqIndices, float64(value.freqIdx))
-		}
+	for _, value := range binBandMaxies {
+		maxMags = append(maxMags, value.maxMag)
+		maxFreqs = append(maxFreqs, value.maxFreq)
+		freqIndices = append(freqIndices, float64(value.freqIdx))
+	}
 
-		// Calculate the average magnitude
-		var maxMagsSum float64
-		for _, max := range maxMags {
-			maxMagsSum += max
-		}
-		avg := maxMagsSum / float64(len(maxFreqs)) // * coefficient
+	// Calculate the average magnitude
+	var maxMagsSum float64
+	for _, max := range maxMags {
+		maxMagsSum += max
+	}
+	avg := maxMagsSum / float64(len(maxFreqs)) // * coefficient
 
-		// Add peaks that exceed the average magnitude
-		for i, value := range maxMags {
-			if value > avg {
-				peakTimeInBin := freqIndices[i] * binDuration / float64(len(bin))
+	// Add peaks that exceed the average magnitude
+	for i, value := range maxMags {
+		if value > avg {
+			peakTimeInBin := freqIndices[i] * binDuration / float64(len(bin))
 
-				// Calculate the absolute time of the peak
-				peakTime := float64(binIdx)*binDuration + peakTimeInBin
+			// Calculate the absolute time of the peak
+			peakTime := float64(binIdx)*binDuration + peakTimeInBin
 
-				peaks = append(peaks, Peak{Time: peakTime, Freq: maxFreqs[i]})
-			}
+			peaks = append(peaks, Peak{Time: peakTime, Freq: maxFreqs[i], Frame: binIdx, Bin: int(freqIndices[i])})
 		}
 	}
 
 	return peaks
 }
+
+// isLocalMaximum reports whether magnitudes[f] is at least as large as the
+// magnitudes of the bins around it
+func isLocalMaximum(magnitudes []float64, f int) bool {
+	for df := -adaptiveNeighborBins; df <= adaptiveNeighborBins; df++ {
+		if f+df >= 0 && f+df < len(magnitudes) && magnitudes[f+df] > magnitudes[f] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+package shazam
+
+import (
+	"math"
+	"math/rand"
+	"song-recognition/degrade"
+	"song-recognition/models"
+	"song-recognition/wav"
+	"testing"
+)
+
+// testSignal returns seconds of a chord of tones in noise at sampleRate,
+// drawn from seed
+func testSignal(seconds float64, sampleRate int, seed int64) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	freqs := []float64{220 + 200*r.Float64(), 600 + 400*r.Float64(), 1200 + 800*r.Float64()}
+	samples := make([]float64, int(seconds*float64(sampleRate)))
+	for i := range samples {
+		t := float64(i) / float64(sampleRate)
+		for _, freq := range freqs {
+			samples[i] += 0.25 * math.Sin(2*math.Pi*freq*t)
+		}
+		samples[i] += 0.05 * r.NormFloat64()
+	}
+	return samples
+}
+
+func TestSTFTFramesParallelMatchesSerial(t *testing.T) {
+	cfg := DefaultConfig()
+	samples := testSignal(2, wav.CanonicalSampleRate/cfg.DownsampleRatio, 1)
+	window := hammingWindow(cfg.WindowSize)
+
+	// Frame counts that don't divide evenly among the workers, fewer
+	// frames than workers, and none
+	for _, count := range []int{0, 1, 5, 97, 100} {
+		serial := make([][]complex128, count)
+		for i := range serial {
+			serial[i] = stftWindow(samples, i*cfg.HopSize, window)
+		}
+
+		for _, workers := range []int{1, 3, 4, 7, 16} {
+			frames := make([][]complex128, count)
+			stftFramesOn(workers, frames, 0, samples, 0, cfg.HopSize, window)
+			for i := range frames {
+				if len(frames[i]) != len(serial[i]) {
+					t.Fatalf("%d frames on %d workers: frame %d has %d bins, want %d", count, workers, i, len(frames[i]), len(serial[i]))
+				}
+				for bin := range frames[i] {
+					if frames[i][bin] != serial[i][bin] {
+						t.Fatalf("%d frames on %d workers: frame %d differs at bin %d", count, workers, i, bin)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSpectrogramMatchesSerial(t *testing.T) {
+	cfg := DefaultConfig()
+	samples := testSignal(3, wav.CanonicalSampleRate, 2)
+
+	spectrogram, err := Spectrogram(samples, wav.CanonicalSampleRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downsampled, err := Downsample(NewLowPassFilter(cfg.MaxFreq, float64(wav.CanonicalSampleRate)).Filter(samples), wav.CanonicalSampleRate, wav.CanonicalSampleRate/cfg.DownsampleRatio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := hammingWindow(cfg.WindowSize)
+	if want := (len(downsampled)-cfg.WindowSize)/cfg.HopSize + 1; len(spectrogram) != want {
+		t.Fatalf("got %d frames, want %d", len(spectrogram), want)
+	}
+	for i, frame := range spectrogram {
+		want := stftWindow(downsampled, i*cfg.HopSize, window)
+		for bin := range frame {
+			if frame[bin] != want[bin] {
+				t.Fatalf("frame %d differs at bin %d", i, bin)
+			}
+		}
+	}
+}
+
+// Windows start every hop up to the end of the audio, even with hops of
+// more than half a window
+func TestSpectrogramLargeHop(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HopSize = 768
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	samples := testSignal(5, wav.CanonicalSampleRate, 4)
+
+	spectrogram, err := Spectrogram(samples, wav.CanonicalSampleRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downsampled := (len(samples) + cfg.DownsampleRatio - 1) / cfg.DownsampleRatio
+	if want := (downsampled-cfg.WindowSize)/cfg.HopSize + 1; len(spectrogram) != want {
+		t.Fatalf("got %d frames, want %d", len(spectrogram), want)
+	}
+
+	// The stream picks the same peaks a chunk at a time
+	want := ExtractPeaks(spectrogram, 5, cfg)
+	stream, err := NewPeakStream(len(samples), wav.CanonicalSampleRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(samples); start += 10000 {
+		stream.Write(samples[start:min(start+10000, len(samples))])
+	}
+	got, err := stream.Peaks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("stream picked %d peaks, want %d", len(got), len(want))
+	}
+
+	// Legacy framing would start windows past the end of the audio
+	cfg.Framing = ""
+	if err := cfg.Validate(); err == nil {
+		t.Error("legacy framing accepted a hop of more than half a window")
+	}
+}
+
+// Audio shorter than a window has one window, and no audio none
+func TestSpectrogramShortAudio(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, test := range []struct{ samples, frames int }{{0, 0}, {100, 1}} {
+		spectrogram, err := Spectrogram(make([]float64, test.samples), wav.CanonicalSampleRate, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spectrogram) != test.frames {
+			t.Errorf("%d samples: got %d frames, want %d", test.samples, len(spectrogram), test.frames)
+		}
+	}
+}
+
+func BenchmarkSpectrogram(b *testing.B) {
+	cfg := DefaultConfig()
+	samples := testSignal(10, wav.CanonicalSampleRate, 3)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Spectrogram(samples, wav.CanonicalSampleRate, cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testSong returns seconds of a melody at wav.CanonicalSampleRate, a chord
+// of random notes every quarter of a second, drawn from seed
+func testSong(seconds float64, seed int64) []float64 {
+	const noteSeconds = 0.25
+	r := rand.New(rand.NewSource(seed))
+	sampleRate := float64(wav.CanonicalSampleRate)
+	samples := make([]float64, int(seconds*sampleRate))
+	noteLength := int(noteSeconds * sampleRate)
+	for start := 0; start < len(samples); start += noteLength {
+		end := min(start+noteLength, len(samples))
+		for note := 0; note < 3; note++ {
+			// Semitones from A2 to A6
+			freq := 110 * math.Pow(2, float64(r.Intn(48))/12)
+			amplitude := 0.1 + 0.2*r.Float64()
+			for i := start; i < end; i++ {
+				t := float64(i-start) / sampleRate
+				samples[i] += amplitude * math.Exp(-3*t) * math.Sin(2*math.Pi*freq*t)
+			}
+		}
+	}
+	return samples
+}
+
+// recognizeTestClip returns the ID of the song of index whose hashes align
+// best with those of clip, 0 if none do, as search does
+func recognizeTestClip(t *testing.T, index map[uint32][]models.Couple, clip []float64, cfg Config) uint32 {
+	spectrogram, err := Spectrogram(clip, wav.CanonicalSampleRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duration := float64(len(clip)) / wav.CanonicalSampleRate
+	fingerprints := Fingerprint(ExtractPeaks(spectrogram, duration, cfg), 0, cfg)
+
+	times := map[uint32][][2]uint32{}
+	for address, fingerprint := range fingerprints {
+		for _, couple := range index[address] {
+			times[couple.SongID] = append(times[couple.SongID], [2]uint32{fingerprint.AnchorTimeMs, couple.AnchorTimeMs})
+		}
+	}
+
+	var best uint32
+	bestScore := 0
+	for songID, songTimes := range times {
+		score, ok := DefaultScoring().score(songTimes)
+		if ok && (score.aligned > bestScore || score.aligned == bestScore && songID < best) {
+			best, bestScore = songID, score.aligned
+		}
+	}
+	return best
+}
+
+// Adaptive peak picking must recognize clean and noisy recordings of songs
+// at least as well as the fixed threshold
+func TestAdaptivePeakPickingRecognizesAsWell(t *testing.T) {
+	const (
+		songs       = 8
+		songSeconds = 8
+	)
+	songSamples := make([][]float64, songs)
+	for i := range songSamples {
+		songSamples[i] = testSong(songSeconds, int64(i+1))
+	}
+
+	// Adaptive peak picking was measured against the fixed threshold with
+	// the windows songs were saved with then
+	fixed := DefaultConfig()
+	fixed.Framing = ""
+	adaptive := fixed
+	adaptive.PeakPicking = PeakPickingAdaptive
+	adaptive.PeakSensitivity = defaultPeakSensitivity
+	configs := map[string]Config{"fixed": fixed, "adaptive": adaptive}
+
+	// The recordings are the same for both, noise is drawn once
+	r := rand.New(rand.NewSource(42))
+	conditions := []string{"clean", "noise at 0 dB", "noise at -10 dB", "noise at -15 dB"}
+	recordings := map[string][][]float64{}
+	for _, samples := range songSamples {
+		recordings["clean"] = append(recordings["clean"], samples)
+		recordings["noise at 0 dB"] = append(recordings["noise at 0 dB"], degrade.Noise(samples, 0, r))
+		recordings["noise at -10 dB"] = append(recordings["noise at -10 dB"], degrade.Noise(samples, -10, r))
+		recordings["noise at -15 dB"] = append(recordings["noise at -15 dB"], degrade.Noise(samples, -15, r))
+	}
+
+	recognized := map[string]map[string]int{}
+	for name, cfg := range configs {
+		index := map[uint32][]models.Couple{}
+		for i, samples := range songSamples {
+			spectrogram, err := Spectrogram(samples, wav.CanonicalSampleRate, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			songID := uint32(i + 1)
+			for address, couple := range Fingerprint(ExtractPeaks(spectrogram, songSeconds, cfg), songID, cfg) {
+				index[address] = append(index[address], couple)
+			}
+		}
+
+		recognized[name] = map[string]int{}
+		for _, condition := range conditions {
+			for i, samples := range recordings[condition] {
+				if recognizeTestClip(t, index, samples, cfg) == uint32(i+1) {
+					recognized[name][condition]++
+				}
+			}
+		}
+	}
+
+	for _, condition := range conditions {
+		fixed, adaptive := recognized["fixed"][condition], recognized["adaptive"][condition]
+		t.Logf("%s: fixed threshold recognized %d/%d, adaptive %d/%d", condition, fixed, songs, adaptive, songs)
+		if adaptive < fixed {
+			t.Errorf("%s: adaptive peak picking recognized %d recordings, fewer than the %d of the fixed threshold", condition, adaptive, fixed)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package shazam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"song-recognition/wav"
+)
+
+// PeakStream picks the peaks of audio passed to it a chunk at a time: the
+// peaks ExtractPeaks picks from the Spectrogram of the whole audio. Only
+// the samples of the windows being transformed are held, so memory doesn't
+// grow with the length of the audio. The number of windows depends on that
+// length, which must be known upfront.
+type PeakStream struct {
+	cfg       Config
+	resampler *wav.Resampler // nil for audio at wav.CanonicalSampleRate
+	lpf       *LowPassFilter
+	// remaining is the number of samples not passed on yet
+	remaining int
+
+	// ratio samples are averaged into each downsampled sample, and sum
+	// and count are those of the group in progress
+	ratio int
+	sum   float64
+	count int
+	// downsampled holds the downsampled samples from the offset-th on,
+	// out of length for the whole audio
+	downsampled []float64
+	offset      int
+	length      int
+
+	window []float64
+	frames int
+	next   int // index of the next window to transform
+	picker *peakPicker
+}
+
+// NewPeakStream returns a PeakStream of audio of samples samples at
+// sampleRate
+func NewPeakStream(samples, sampleRate int, cfg Config) (*PeakStream, error) {
+	if sampleRate <= 0 {
+		return nil, errors.New("sample rate must be positive")
+	}
+
+	s := &PeakStream{cfg: cfg, remaining: samples, window: hammingWindow(cfg.WindowSize)}
+
+	length := samples
+	if sampleRate != wav.CanonicalSampleRate {
+		resampler, err := wav.NewResampler(sampleRate, wav.CanonicalSampleRate, samples)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resample audio samples: %v", err)
+		}
+		s.resampler = resampler
+		length = resampler.Len()
+	}
+	s.lpf = NewLowPassFilter(cfg.MaxFreq, wav.CanonicalSampleRate)
+
+	targetRate := wav.CanonicalSampleRate / cfg.DownsampleRatio
+	if targetRate <= 0 {
+		return nil, errors.New("couldn't downsample audio samples: sample rates must be positive")
+	}
+	s.ratio = wav.CanonicalSampleRate / targetRate
+	s.length = (length + s.ratio - 1) / s.ratio
+
+	s.frames = cfg.frames(s.length)
+	s.picker = newPeakPicker(s.frames, float64(samples)/float64(sampleRate), cfg)
+	return s, nil
+}
+
+// Write passes on the next samples. It reports whether the peaks are all
+// picked, which can happen before the end of the audio, after which the
+// rest of it isn't needed.
+func (s *PeakStream) Write(samples []float64) bool {
+	if s.Done() {
+		return true
+	}
+
+	samples = samples[:min(len(samples), s.remaining)]
+	s.remaining -= len(samples)
+	if s.resampler != nil {
+		samples = s.resampler.Write(samples)
+	}
+
+	for _, x := range s.lpf.Filter(samples) {
+		s.sum += x
+		s.count++
+		if s.count == s.ratio {
+			s.downsampled = append(s.downsampled, s.sum/float64(s.count))
+			s.sum, s.count = 0, 0
+		}
+	}
+	// The last group of the audio can be short
+	if s.remaining == 0 && s.count > 0 {
+		s.downsampled = append(s.downsampled, s.sum/float64(s.count))
+		s.sum, s.count = 0, 0
+	}
+
+	s.transform()
+	return s.Done()
+}
+
+// transform picks the peaks of the windows whose samples were all received
+func (s *PeakStream) transform() {
+	received := s.offset + len(s.downsampled)
+	ready := s.next
+	for ready < s.frames && (ready*s.cfg.HopSize+s.cfg.WindowSize <= received || received == s.length) {
+		ready++
+	}
+	if ready == s.next {
+		return
+	}
+
+	frames := make([][]complex128, ready-s.next)
+	stftFrames(frames, s.next, s.downsampled, s.offset, s.cfg.HopSize, s.window)
+	for _, frame := range frames {
+		s.picker.add(frame)
+	}
+	s.next = ready
+
+	// Drop the samples before the next window
+	if drop := min(s.next*s.cfg.HopSize-s.offset, len(s.downsampled)); drop > 0 {
+		s.downsampled = append(s.downsampled[:0], s.downsampled[drop:]...)
+		s.offset += drop
+	}
+}
+
+// Done reports whether the peaks are all picked
+func (s *PeakStream) Done() bool {
+	return s.next == s.frames
+}
+
+// Peaks returns the peaks picked, once they all are
+func (s *PeakStream) Peaks() ([]Peak, error) {
+	if !s.Done() {
+		return nil, fmt.Errorf("audio ended %d samples early", s.remaining)
+	}
+	if s.frames == 0 {
+		return []Peak{}, nil
+	}
+	return s.picker.peaks, nil
+}
+
+// FilePeaks picks the peaks of an audio file of samples samples, like
+// ExtractPeaks of its Spectrogram, decoding only as much of it as the
+// spectrogram needs a chunk at a time. The audio is preprocessed with pre
+// as a song first, which takes another pass over the file to measure it;
+// the peaks keep their time in the whole file. It returns the duration of the audio
+// along with the peaks.
+func FilePeaks(filePath string, samples int, cfg Config, pre Preprocessing) ([]Peak, float64, error) {
+	gain, start, end := 1.0, 0, samples
+	if pre.enabled() {
+		levels, err := measureFile(filePath, samples, pre.SongFilters)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A file shorter than samples fails below like without
+		// preprocessing
+		levels.samples = max(levels.samples, samples)
+		gain, start, end = pre.plan(levels)
+	}
+
+	stream, err := wav.OpenStream(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stream.Close()
+
+	peakStream, err := NewPeakStream(end-start, stream.SampleRate, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	filters := pre.SongFilters.newFilters(stream.SampleRate)
+	skip := start
+	for !peakStream.Done() {
+		chunk, err := stream.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Skipped samples are filtered too, to carry the state of the
+		// filters over
+		applyFilters(filters, chunk)
+		if skip >= len(chunk) {
+			skip -= len(chunk)
+			continue
+		}
+		chunk = chunk[skip:]
+		skip = 0
+		if gain != 1 {
+			for i := range chunk {
+				chunk[i] *= gain
+			}
+		}
+		peakStream.Write(chunk)
+	}
+
+	peaks, err := peakStream.Peaks()
+	if err != nil {
+		return nil, 0, err
+	}
+	if start > 0 {
+		lead := float64(start) / float64(stream.SampleRate)
+		for i := range peaks {
+			peaks[i].Time += lead
+		}
+	}
+	return peaks, float64(samples) / float64(stream.SampleRate), nil
+}
+
+// measureFile returns the levels of the first samples samples of an audio
+// file once it goes through chain
+func measureFile(filePath string, samples int, chain FilterChain) (*audioLevels, error) {
+	stream, err := wav.OpenStream(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	levels := newAudioLevels(stream.SampleRate)
+	filters := chain.newFilters(stream.SampleRate)
+	for levels.samples < samples {
+		chunk, err := stream.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = chunk[:min(len(chunk), samples-levels.samples)]
+		applyFilters(filters, chunk)
+		levels.write(chunk)
+	}
+	return levels, nil
+}
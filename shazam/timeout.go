@@ -0,0 +1,52 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"song-recognition/config"
+	"song-recognition/utils"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimedOut is returned by FindMatches when a recognition takes longer
+// than its timeout, along with the matches found by then
+var ErrTimedOut = errors.New("recognition timed out")
+
+// recognitionTimeout is how long a recognition may take, from decoding the
+// recording to scoring its matches, or 0 for no limit, as a time.Duration.
+// Set with RECOGNITION_TIMEOUT.
+var recognitionTimeout atomic.Int64
+
+func init() {
+	recognitionTimeout.Store(int64(recognitionTimeoutFromEnv()))
+	config.OnReload(func() {
+		recognitionTimeout.Store(int64(recognitionTimeoutFromEnv()))
+	})
+}
+
+func recognitionTimeoutFromEnv() time.Duration {
+	timeout, err := time.ParseDuration(utils.GetEnv("RECOGNITION_TIMEOUT", "30s"))
+	if err != nil || timeout < 0 {
+		return 30 * time.Second
+	}
+	return timeout
+}
+
+// WithTimeout returns a copy of ctx that is done once the recognition
+// timeout has passed, so that whatever is done with it gives up, and
+// FindMatches returns ErrTimedOut. FindMatches applies the timeout itself,
+// so callers only need it to count the decoding of the recording in; the
+// earliest deadline wins.
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(recognitionTimeout.Load())
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, ErrTimedOut)
+}
+
+// timedOut reports whether ctx is done because its recognition timed out
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrTimedOut)
+}
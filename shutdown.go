@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"song-recognition/utils"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/mdobak/go-xerrors"
+	"google.golang.org/grpc"
+)
+
+var (
+	// shutdownTimeout is how long the server waits for running requests and
+	// ingestion jobs on shutdown before cancelling them. Set with
+	// SHUTDOWN_TIMEOUT.
+	shutdownTimeout = durationFromEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	// cancelledJobsTimeout is how long cancelled jobs get to roll back
+	cancelledJobsTimeout = 10 * time.Second
+)
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(utils.GetEnv(name, fallback.String()))
+	if err != nil || d < 0 {
+		return fallback
+	}
+	return d
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// jobTracker keeps track of the running ingestion jobs, so that shutdown
+// can wait for them and cancel the ones that don't finish in time
+type jobTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	running int
+
+	ctx       context.Context // cancelled to cancel every job
+	cancelAll context.CancelFunc
+}
+
+// jobs tracks the songs being downloaded and saved by the server
+var jobs = newJobTracker()
+
+func newJobTracker() *jobTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobTracker{ctx: ctx, cancelAll: cancel}
+}
+
+// start registers a new job and returns the context to run it in, which
+// is also cancelled when shutdown gives up waiting, along with the function
+// to call when it is done. It returns errShuttingDown once the tracker is
+// closed.
+func (t *jobTracker) start(parent context.Context) (context.Context, func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, nil, errShuttingDown
+	}
+	t.wg.Add(1)
+	t.running++
+
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(t.ctx, cancel)
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			stop()
+			cancel()
+
+			t.mu.Lock()
+			t.running--
+			t.mu.Unlock()
+			t.wg.Done()
+		})
+	}
+	return ctx, done, nil
+}
+
+// close stops new jobs from starting
+func (t *jobTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+}
+
+// count returns the number of running jobs
+func (t *jobTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+// wait waits for the running jobs to finish, and reports whether they did
+// before ctx was done
+func (t *jobTracker) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// cancel cancels every running job
+func (t *jobTracker) cancel() {
+	t.cancelAll()
+}
+
+// shutdown stops the servers from accepting new connections and work,
+// waits up to shutdownTimeout for running requests and jobs, then cancels
+// those left. Cancelled jobs roll back the song they were saving, and every
+// DB client is closed as its job returns.
+func shutdown(httpServer *http.Server, grpcServer *grpc.Server, socketServer *socketio.Server) {
+	logger := utils.GetLogger()
+	logger.Info("shutting down.", slog.Int("jobs", jobs.count()), slog.Duration("timeout", shutdownTimeout))
+
+	jobs.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+		}
+	}()
+
+	if grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcServer.Stop()
+				<-stopped
+			}
+		}()
+	}
+
+	if !jobs.wait(ctx) {
+		logger.Warn("cancelling unfinished jobs.", slog.Int("jobs", jobs.count()))
+		jobs.cancel()
+
+		cancelledCtx, cancel := context.WithTimeout(context.Background(), cancelledJobsTimeout)
+		defer cancel()
+		if !jobs.wait(cancelledCtx) {
+			logger.Error("jobs didn't stop after being cancelled.", slog.Int("jobs", jobs.count()))
+		}
+	}
+
+	wg.Wait()
+	// Socket clients get the status of their downloads until the end
+	socketServer.Close()
+
+	closeAuthDBClient()
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), cancelledJobsTimeout)
+	defer cancelClose()
+	if err := utils.CloseConnections(closeCtx); err != nil {
+		logger.Error("failed to close database connections.", slog.Any("error", xerrors.New(err)))
+	}
+	logger.Info("shutdown complete.")
+}
@@ -2,37 +2,169 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"song-recognition/models"
+	"song-recognition/protocol"
 	"song-recognition/shazam"
 	"song-recognition/spotify"
 	"song-recognition/utils"
-	"strings"
+	"song-recognition/wav"
+	"strconv"
+	"sync"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/mdobak/go-xerrors"
 )
 
-func downloadStatus(statusType, message string) string {
-	data := map[string]interface{}{"type": statusType, "message": message}
-	jsonData, err := json.Marshal(data)
+func downloadStatus(statusType, message string) protocol.DownloadStatus {
+	return protocol.DownloadStatus{Type: statusType, Message: message}
+}
+
+// trackStatusEmitter returns a spotify.DlTracks callback that pushes every
+// track status update to socket as a "trackStatus" message
+func trackStatusEmitter(socket socketio.Conn) func(spotify.TrackStatus) {
+	var mu sync.Mutex
+	return func(status spotify.TrackStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		emitMessage(socket, protocol.TypeTrackStatus, status)
+	}
+}
+
+// socketSession is what a socket was authenticated with when it connected
+type socketSession struct {
+	key        *utils.APIKey
+	catalog    string
+	clientID   string
+	clientAddr string
+	// protocolVersion is the protocol version of the messages the socket
+	// exchanges, 0 for the older events
+	protocolVersion int
+
+	uploadsMu sync.Mutex
+	uploads   map[string]*recordingUpload // chunked uploads in progress, by ID
+}
+
+// socketSessions maps the IDs of connected sockets to their sessions. The
+// socket context holds the recognition stream, so sessions are kept apart.
+var socketSessions sync.Map
+
+// openSocketSession authenticates socket with the API key given by the
+// X-API-Key header or the "apiKey" query value of its connection URL, and
+// selects the catalog given by the "catalog" query value. Its recognitions
+// are recorded for the client given by the "clientId" query value, and its
+// messages follow the protocol version given by the "protocolVersion"
+// query value, if any.
+func openSocketSession(socket socketio.Conn) (*socketSession, error) {
+	u := socket.URL()
+	query := u.Query()
+
+	catalog := query.Get("catalog")
+	if !utils.ValidCatalog(catalog) {
+		return nil, fmt.Errorf("invalid catalog: %q", catalog)
+	}
+
+	secret := socket.RemoteHeader().Get("X-API-Key")
+	if secret == "" {
+		secret = query.Get("apiKey")
+	}
+	key, err := authenticate(context.Background(), secret)
 	if err != nil {
-		logger := utils.GetLogger()
-		ctx := context.Background()
-		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "failed to marshal data.", slog.Any("error", err))
-		return ""
+		return nil, err
+	}
+
+	catalog, err = keyCatalog(key, catalog)
+	if err != nil {
+		return nil, err
 	}
-	return string(jsonData)
+
+	clientID := query.Get("clientId")
+	if !utils.ValidClientID(clientID) {
+		return nil, errInvalidClientID
+	}
+
+	clientAddr := socket.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		clientAddr = host
+	}
+
+	var version int
+	if value := query.Get("protocolVersion"); value != "" {
+		version, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol version: %q", value)
+		}
+		if !protocol.Supported(version) {
+			return nil, protocol.UnsupportedVersion(version)
+		}
+	}
+
+	session := &socketSession{key: key, catalog: catalog, clientID: clientID, clientAddr: clientAddr, protocolVersion: version}
+	socketSessions.Store(socket.ID(), session)
+	return session, nil
+}
+
+// closeSocketSession forgets the session of a disconnected socket, along
+// with the uploads it didn't finish
+func closeSocketSession(socket socketio.Conn) {
+	value, ok := socketSessions.LoadAndDelete(socket.ID())
+	if !ok {
+		return
+	}
+
+	session := value.(*socketSession)
+	session.uploadsMu.Lock()
+	defer session.uploadsMu.Unlock()
+	for id, upload := range session.uploads {
+		upload.timer.Stop()
+		delete(session.uploads, id)
+	}
+}
+
+// socketContext returns a context to handle an event of socket in, which
+// carries a new request ID and the socket's API key and client ID, and
+// selects its catalog
+func socketContext(socket socketio.Conn) context.Context {
+	ctx := utils.NewOperationContext()
+	if value, ok := socketSessions.Load(socket.ID()); ok {
+		session := value.(*socketSession)
+		ctx = withAPIKey(ctx, session.key)
+		ctx = utils.WithCatalog(ctx, session.catalog)
+		ctx, _ = withClientID(ctx, session.clientID)
+	}
+	return ctx
+}
+
+// allowSocketRecognition applies the recognition rate limit to socket
+func allowSocketRecognition(ctx context.Context, socket socketio.Conn) bool {
+	var clientAddr string
+	if value, ok := socketSessions.Load(socket.ID()); ok {
+		clientAddr = value.(*socketSession).clientAddr
+	}
+
+	allowed, _ := allowRecognition(ctx, clientAddr)
+	return allowed
+}
+
+// busyMessage describes a recognition that wasn't admitted by
+// recognitionSlots, with when to try again
+func busyMessage(err error) protocol.ErrorMessage {
+	if !errors.Is(err, errServerBusy) {
+		return protocol.ErrorMessage{Message: err.Error()}
+	}
+	return protocol.ErrorMessage{Message: err.Error(), RetryAfter: recognitionSlots.retryAfterSeconds()}
 }
 
 func handleTotalSongs(socket socketio.Conn) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx := socketContext(socket)
 
-	db, err := utils.NewDbClient()
+	db, err := utils.NewReadOnlyCatalogDBClient(utils.CatalogFromContext(ctx))
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error connecting to DB", slog.Any("error", err))
@@ -40,143 +172,164 @@ func handleTotalSongs(socket socketio.Conn) {
 	}
 	defer db.Close()
 
-	totalSongs, err := db.TotalSongs()
+	totalSongs, err := db.TotalSongs(ctx)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "Log error getting total songs", slog.Any("error", err))
 		return
 	}
 
-	socket.Emit("totalSongs", totalSongs)
+	emitMessage(socket, protocol.TypeTotalSongs, protocol.TotalSongs{Count: totalSongs})
 }
 
-func handleSongDownload(socket socketio.Conn, spotifyURL string) {
-	logger := utils.GetLogger()
-	ctx := context.Background()
+// handleSongDownload queues the download of the songs at songURL, a link to
+// any supported source. The socket is sent "jobStatus" messages as the job
+// progresses, along with the usual "downloadStatus" and "trackStatus"
+// messages.
+func handleSongDownload(socket socketio.Conn, songURL string) {
+	ctx := socketContext(socket)
 
-	// Handle album download
-	if strings.Contains(spotifyURL, "album") {
-		tracksInAlbum, err := spotify.AlbumInfo(spotifyURL)
-		if err != nil {
-			fmt.Println("log error: ", err)
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
-			}
-			return
-		}
+	if err := checkWriteAccess(ctx); err != nil {
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", err.Error()))
+		return
+	}
+	if utils.ReadOnly() {
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", errReadOnlyServer.Error()))
+		return
+	}
 
-		statusMsg := fmt.Sprintf("%v songs found in album.", len(tracksInAlbum))
-		socket.Emit("downloadStatus", downloadStatus("info", statusMsg))
+	job, err := ingest.enqueue(ctx, songURL, func(ctx context.Context, progress *jobProgress) error {
+		return downloadSongs(ctx, socket, songURL, progress)
+	})
+	if err != nil {
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", err.Error()))
+		return
+	}
 
-		totalTracksDownloaded, err := spotify.DlAlbum(spotifyURL, SONGS_DIR)
-		if err != nil {
-			socket.Emit("downloadStatus", downloadStatus("error", "Couldn't to download album."))
+	followJob(socket, job.ID)
+}
 
-			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to download album.", slog.Any("error", err))
-			return
-		}
+// handleJobSubscribe sends the socket "jobStatus" messages for the job with
+// the given ID, from its current status until it ends
+func handleJobSubscribe(socket socketio.Conn, jobID string) {
+	ctx := socketContext(socket)
 
-		statusMsg = fmt.Sprintf("%d songs downloaded from album", totalTracksDownloaded)
-		socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
+	job, ok := ingest.get(jobID)
+	if !ok || job.Catalog != utils.CatalogFromContext(ctx) {
+		emitMessage(socket, protocol.TypeJobError, protocol.ErrorMessage{Message: "job not found"})
+		return
 	}
 
-	// Handle playlist download
-	if strings.Contains(spotifyURL, "playlist") {
-		tracksInPL, err := spotify.PlaylistInfo(spotifyURL)
-		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
-			}
-			return
-		}
-
-		statusMsg := fmt.Sprintf("%v songs found in playlist.", len(tracksInPL))
-		socket.Emit("downloadStatus", downloadStatus("info", statusMsg))
-
-		totalTracksDownloaded, err := spotify.DlPlaylist(spotifyURL, SONGS_DIR)
-		if err != nil {
-			socket.Emit("downloadStatus", downloadStatus("error", "Couldn't download playlist."))
+	followJob(socket, jobID)
+}
 
-			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to download playlist.", slog.Any("error", err))
-			return
-		}
+// followJob sends socket the status of the job with the given ID as a
+// "jobStatus" message, then every change of it until it ends
+func followJob(socket socketio.Conn, jobID string) {
+	job, subscription, ok := ingest.subscribe(jobID)
+	if !ok {
+		return
+	}
 
-		statusMsg = fmt.Sprintf("%d songs downloaded from playlist.", totalTracksDownloaded)
-		socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
+	emitMessage(socket, protocol.TypeJobStatus, job.JobStatus)
+	if job.Finished != nil {
+		subscription.Close()
+		return
 	}
 
-	// Handle track download
-	if strings.Contains(spotifyURL, "track") {
-		trackInfo, err := spotify.TrackInfo(spotifyURL)
-		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
+	go func() {
+		defer subscription.Close()
+		for event := range subscription.C {
+			emitMessage(socket, event.Type, event.Payload)
+			if event.Final {
+				return
 			}
-			return
 		}
+	}()
+}
 
-		// check if track already exist
-		db, err := utils.NewDbClient()
-		if err != nil {
-			fmt.Errorf("Log - error connecting to DB: %d", err)
+// downloadSongs downloads and saves the songs songURL points at, reporting
+// their progress to socket and to the job
+func downloadSongs(ctx context.Context, socket socketio.Conn, songURL string, progress *jobProgress) error {
+	logger := utils.GetLogger()
+
+	emitTrackStatus := trackStatusEmitter(socket)
+	onStatus := func(status spotify.TrackStatus) {
+		emitTrackStatus(status)
+		progress.track(status)
+		if status.Stage == spotify.StageDone {
+			progress.songSaved(ctx, status.Title, status.Artist)
 		}
-		defer db.Close()
+	}
 
-		song, songExists, err := db.GetSongByKey(utils.GenerateSongKey(trackInfo.Title, trackInfo.Artist))
-		if err == nil {
-			if songExists {
-				statusMsg := fmt.Sprintf(
-					"'%s' by '%s' already exists in the database (https://www.youtube.com/watch?v=%s)",
-					song.Title, song.Artist, song.YouTubeID)
+	source, err := spotify.SourceFor(songURL)
+	if err != nil {
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", err.Error()))
+		return err
+	}
 
-				socket.Emit("downloadStatus", downloadStatus("error", statusMsg))
-				return
-			}
+	tracks, err := source.Resolve(ctx, songURL)
+	if err != nil {
+		if len(err.Error()) <= 25 {
+			emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", err.Error()))
+			logger.InfoContext(ctx, err.Error())
 		} else {
 			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to get song by key.", slog.Any("error", err))
+			logger.ErrorContext(ctx, "error getting song info", slog.Any("error", err))
 		}
+		return err
+	}
+
+	if len(tracks) == 1 {
+		track := tracks[0]
+		err := spotify.SaveTrack(ctx, source, &track, SONGS_DIR)
 
-		totalDownloads, err := spotify.DlSingleTrack(spotifyURL, SONGS_DIR)
+		var duplicate *spotify.DuplicateError
+		if errors.As(err, &duplicate) {
+			statusMsg := fmt.Sprintf("'%s' by '%s' already exists in the database", duplicate.Song.Title, duplicate.Song.Artist)
+			if duplicate.Song.YouTubeID != "" {
+				statusMsg += fmt.Sprintf(" (https://www.youtube.com/watch?v=%s)", duplicate.Song.YouTubeID)
+			}
+			emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", statusMsg))
+			return err
+		}
 		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
+			statusMsg := fmt.Sprintf("%s failed to download", songURL)
+			if track.Title != "" {
+				statusMsg = fmt.Sprintf("'%s' by '%s' failed to download", track.Title, track.Artist)
 			}
-			return
+			emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", statusMsg))
+			return err
 		}
 
-		statusMsg := ""
-		if totalDownloads != 1 {
-			statusMsg = fmt.Sprintf("'%s' by '%s' failed to download", trackInfo.Title, trackInfo.Artist)
-			socket.Emit("downloadStatus", downloadStatus("error", statusMsg))
-		} else {
-			statusMsg = fmt.Sprintf("'%s' by '%s' was downloaded", trackInfo.Title, trackInfo.Artist)
-			socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
-		}
+		statusMsg := fmt.Sprintf("'%s' by '%s' was downloaded", track.Title, track.Artist)
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("success", statusMsg))
+		progress.songSaved(ctx, track.Title, track.Artist)
+		return nil
+	}
+
+	statusMsg := fmt.Sprintf("%v songs found.", len(tracks))
+	emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("info", statusMsg))
+
+	// Downloading the same playlist again resumes it, retrying the tracks
+	// that failed
+	totalTracksDownloaded, err := spotify.DlPlaylist(spotify.WithRetryFailed(ctx), source, songURL, tracks, SONGS_DIR, onStatus)
+	if err != nil {
+		emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("error", "Couldn't download songs."))
+
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to download songs.", slog.Any("error", err))
+		return err
 	}
+
+	statusMsg = fmt.Sprintf("%d songs downloaded.", totalTracksDownloaded)
+	emitMessage(socket, protocol.TypeDownloadStatus, downloadStatus("success", statusMsg))
+	return nil
 }
 
 func handleNewRecording(socket socketio.Conn, recordData string) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx := socketContext(socket)
 
 	var recData models.RecordData
 	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
@@ -185,6 +338,19 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		return
 	}
 
+	if !allowSocketRecognition(ctx, socket) {
+		emitMessage(socket, protocol.TypeRecognitionError, protocol.ErrorMessage{Message: "rate limit exceeded"})
+		return
+	}
+
+	// Admitted before decoding, so that rejected recordings cost nothing
+	release, err := recognitionSlots.admit(ctx)
+	if err != nil {
+		emitMessage(socket, protocol.TypeRecognitionError, busyMessage(err))
+		return
+	}
+	defer release()
+
 	samples, err := utils.ProcessRecording(&recData, true)
 	if err != nil {
 		err := xerrors.New(err)
@@ -192,22 +358,188 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		return
 	}
 
-	matches, _, err := shazam.FindMatches(samples, recData.Duration, recData.SampleRate)
-	if err != nil {
+	emitRecordingMatches(ctx, socket, samples, recData.Duration, recData.SampleRate)
+}
+
+// emitRecordingMatches matches the samples of a recording and sends the top
+// matches to the client as a "matches" message. Callers are admitted by
+// recognitionSlots first.
+func emitRecordingMatches(ctx context.Context, socket socketio.Conn, samples []float64, duration float64, sampleRate int) {
+	logger := utils.GetLogger()
+
+	matches, _, err := findMatches(ctx, samples, duration, sampleRate)
+	timedOut := errors.Is(err, shazam.ErrTimedOut)
+	if err != nil && !timedOut {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
 	}
 
-	jsonData, err := json.Marshal(matches)
 	if len(matches) > 10 {
-		jsonData, _ = json.Marshal(matches[:10])
+		matches = shazam.TopMatches(matches, 10, 0)
+	}
+
+	result := protocol.Matches{Matches: matches, TimedOut: timedOut}
+	emitMessage(socket, protocol.TypeMatches, result)
+	publishRecognition(ctx, protocol.TypeMatches, result, true)
+}
+
+const (
+	defaultStreamInterval = 3.0  // seconds of new audio between partial matches
+	maxStreamDuration     = 20.0 // seconds of audio after which a stream is finalized
+	maxStreamCandidates   = 5
+)
+
+// recognitionStream holds the audio received so far from a streaming client
+type recognitionStream struct {
+	config    models.StreamStart
+	samples   []float64
+	pending   float64 // seconds of audio received since the last partial match
+	requestID string  // tags the logs of every chunk of the stream
+}
+
+func (s *recognitionStream) duration() float64 {
+	return float64(len(s.samples)) / float64(s.config.SampleRate)
+}
+
+const (
+	// minSampleRate and maxSampleRate bound the sample rate of raw PCM
+	// audio, so that a client can't make the server buffer an enormous
+	// number of samples per second of audio
+	minSampleRate = 8000
+	maxSampleRate = 192000
+)
+
+// validAudioFormat reports whether raw PCM audio with the given format can
+// be matched: mono or stereo, at a sample rate of minSampleRate to
+// maxSampleRate
+func validAudioFormat(channels, sampleRate, sampleSize int) bool {
+	validSampleSize := sampleSize == 8 || sampleSize == 16 || sampleSize == 24 || sampleSize == 32
+	validSampleRate := sampleRate >= minSampleRate && sampleRate <= maxSampleRate
+	return validSampleRate && (channels == 1 || channels == 2) && validSampleSize
+}
+
+func handleStreamStart(socket socketio.Conn, startData string) {
+	logger := utils.GetLogger()
+	ctx := socketContext(socket)
+
+	var config models.StreamStart
+	if err := json.Unmarshal([]byte(startData), &config); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal stream config.", slog.Any("error", err))
+		return
+	}
+
+	if !validAudioFormat(config.Channels, config.SampleRate, config.SampleSize) {
+		msg := fmt.Sprintf("unsupported stream format (sampleRate: %d, channels: %d, sampleSize: %d)",
+			config.SampleRate, config.Channels, config.SampleSize)
+		emitMessage(socket, protocol.TypeStreamError, protocol.ErrorMessage{Message: msg})
+		return
 	}
 
+	if config.Interval <= 0 {
+		config.Interval = defaultStreamInterval
+	}
+
+	if !allowSocketRecognition(ctx, socket) {
+		emitMessage(socket, protocol.TypeStreamError, protocol.ErrorMessage{Message: "rate limit exceeded"})
+		return
+	}
+
+	socket.SetContext(&recognitionStream{config: config, requestID: utils.RequestIDFromContext(ctx)})
+}
+
+func handleStreamChunk(socket socketio.Conn, chunk string) {
+	logger := utils.GetLogger()
+	ctx := socketContext(socket)
+
+	stream, ok := socket.Context().(*recognitionStream)
+	if !ok {
+		emitMessage(socket, protocol.TypeStreamError, protocol.ErrorMessage{Message: "stream not started"})
+		return
+	}
+	ctx = utils.WithRequestID(ctx, stream.requestID)
+
+	pcm, err := base64.StdEncoding.DecodeString(chunk)
 	if err != nil {
 		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "failed to marshal matches.", slog.Any("error", err))
+		logger.ErrorContext(ctx, "Failed to decode stream chunk.", slog.Any("error", err))
 		return
 	}
 
-	socket.Emit("matches", string(jsonData))
+	samples, err := wav.PCMBytesToMonoSamples(pcm, stream.config.Channels, stream.config.SampleSize, false)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to convert stream chunk.", slog.Any("error", err))
+		return
+	}
+
+	stream.samples = append(stream.samples, samples...)
+	stream.pending += float64(len(samples)) / float64(stream.config.SampleRate)
+
+	if stream.duration() >= maxStreamDuration {
+		emitStreamMatches(ctx, socket, stream, true)
+		socket.SetContext("")
+		return
+	}
+
+	if stream.pending >= stream.config.Interval {
+		stream.pending = 0
+		emitStreamMatches(ctx, socket, stream, false)
+	}
+}
+
+func handleStreamStop(socket socketio.Conn) {
+	stream, ok := socket.Context().(*recognitionStream)
+	if !ok {
+		return
+	}
+
+	if len(stream.samples) > 0 {
+		ctx := utils.WithRequestID(socketContext(socket), stream.requestID)
+		emitStreamMatches(ctx, socket, stream, true)
+	}
+	socket.SetContext("")
+}
+
+// emitStreamMatches matches all audio received so far and sends the top
+// candidates to the client as a "streamMatches" message. Only the final
+// matches of a stream are recorded in the recognition history. Partial
+// matches are skipped while the server is busy, instead of queued.
+func emitStreamMatches(ctx context.Context, socket socketio.Conn, stream *recognitionStream, final bool) {
+	logger := utils.GetLogger()
+
+	if !final {
+		ctx = shazam.WithoutHistory(ctx)
+		release, ok := recognitionSlots.tryAdmit()
+		if !ok {
+			return
+		}
+		defer release()
+	} else {
+		release, err := recognitionSlots.admit(ctx)
+		if err != nil {
+			emitMessage(socket, protocol.TypeStreamError, busyMessage(err))
+			return
+		}
+		defer release()
+	}
+
+	matches, _, err := shazam.FindMatches(ctx, stream.samples, stream.duration(), stream.config.SampleRate)
+	timedOut := errors.Is(err, shazam.ErrTimedOut)
+	if err != nil && !timedOut {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to get stream matches.", slog.Any("error", err))
+		return
+	}
+
+	candidates := shazam.TopMatches(matches, maxStreamCandidates, 0)
+
+	streamMatches := protocol.StreamMatches{
+		Final:    final,
+		Duration: stream.duration(),
+		Matches:  candidates,
+		TimedOut: timedOut,
+	}
+	emitMessage(socket, protocol.TypeStreamMatches, streamMatches)
+	publishRecognition(ctx, protocol.TypeStreamMatches, streamMatches, final)
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"song-recognition/protocol"
+	"song-recognition/utils"
+
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/mdobak/go-xerrors"
+)
+
+// Sockets either connect with the "protocolVersion" query value and
+// exchange protocol.Envelope messages on the protocol.MessageEvent event,
+// or without it and exchange the older events named after each message
+// type. Handlers send messages with emitMessage, which picks the right form
+// for the socket.
+
+var errUnversionedSocket = errors.New("connect with a protocolVersion to send messages")
+
+// socketRoom returns the room of the sockets of a protocol version, 0 for
+// those that connected without one, so that broadcasts can be sent to each
+// in its form
+func socketRoom(version int) string {
+	if version == 0 {
+		return "events"
+	}
+	return fmt.Sprintf("protocol-v%d", version)
+}
+
+// socketVersion returns the protocol version socket connected with, 0 if
+// none
+func socketVersion(socket socketio.Conn) int {
+	if session := socketSessionOf(socket); session != nil {
+		return session.protocolVersion
+	}
+	return 0
+}
+
+// socketEvent returns the event and its argument that send a message of
+// msgType to sockets of a protocol version, 0 for those that connected
+// without one
+func socketEvent(version int, msgType string, payload interface{}) (string, interface{}, error) {
+	if version > 0 {
+		env, err := protocol.NewEnvelope(msgType, version, payload)
+		if err != nil {
+			return "", nil, err
+		}
+		jsonData, err := json.Marshal(env)
+		return protocol.MessageEvent, string(jsonData), err
+	}
+
+	// Older events carry their payload as a JSON string, except for these
+	switch p := payload.(type) {
+	case protocol.TotalSongs:
+		return msgType, p.Count, nil
+	case protocol.ErrorMessage:
+		return msgType, p.Message, nil
+	case protocol.Matches:
+		payload = p.Matches
+	}
+	jsonData, err := json.Marshal(payload)
+	return msgType, string(jsonData), err
+}
+
+// emitMessage sends a message of msgType to socket
+func emitMessage(socket socketio.Conn, msgType string, payload interface{}) {
+	event, arg, err := socketEvent(socketVersion(socket), msgType, payload)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.Error("failed to marshal message.", slog.String("type", msgType), slog.Any("error", xerrors.New(err)))
+		return
+	}
+	socket.Emit(event, arg)
+}
+
+// broadcastMessage sends a message of msgType to every socket
+func broadcastMessage(server *socketio.Server, msgType string, payload interface{}) {
+	for _, version := range append([]int{0}, protocol.SupportedVersions...) {
+		event, arg, err := socketEvent(version, msgType, payload)
+		if err != nil {
+			logger := utils.GetLogger()
+			logger.Error("failed to marshal message.", slog.String("type", msgType), slog.Any("error", xerrors.New(err)))
+			return
+		}
+		server.BroadcastToRoom("/", socketRoom(version), event, arg)
+	}
+}
+
+// emitProtocolError rejects a message of socket. The rejection is always
+// an envelope, since only envelopes are rejected.
+func emitProtocolError(socket socketio.Conn, msgType string, err error) {
+	version := socketVersion(socket)
+	if version == 0 {
+		version = protocol.Version
+	}
+
+	rejection := protocol.AsError(err)
+	if rejection.Type == "" {
+		rejection.Type = msgType
+	}
+	event, arg, err := socketEvent(version, protocol.TypeError, rejection)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.Error("failed to marshal message.", slog.String("type", protocol.TypeError), slog.Any("error", xerrors.New(err)))
+		return
+	}
+	socket.Emit(event, arg)
+}
+
+// handleMessages handles the envelopes sent by sockets of a protocol
+// version. listener is nil when the server doesn't listen to its
+// microphone.
+func handleMessages(server *socketio.Server, listener *micListener) {
+	server.OnEvent("/", protocol.MessageEvent, func(socket socketio.Conn, data string) {
+		handleMessage(socket, listener, data)
+	})
+}
+
+// handleMessage hands an envelope sent by socket to the handler of its
+// type. Messages the server can't handle are rejected with an error
+// message.
+func handleMessage(socket socketio.Conn, listener *micListener, data string) {
+	env, err := protocol.Parse(data)
+	if err != nil {
+		emitProtocolError(socket, env.Type, err)
+		return
+	}
+
+	version := socketVersion(socket)
+	if version == 0 {
+		emitProtocolError(socket, env.Type, errUnversionedSocket)
+		return
+	}
+	if env.Version != version {
+		emitProtocolError(socket, env.Type, protocol.UnsupportedVersion(env.Version))
+		return
+	}
+
+	// Payloads that older events carry as a JSON string are checked, then
+	// handed over as is
+	switch env.Type {
+	case protocol.TypeTotalSongs:
+		handleTotalSongs(socket)
+	case protocol.TypeNewDownload:
+		var download protocol.NewDownload
+		if err := env.Decode(&download); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleSongDownload(socket, download.URL)
+	case protocol.TypeJobSubscribe:
+		var subscribe protocol.JobSubscribe
+		if err := env.Decode(&subscribe); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleJobSubscribe(socket, subscribe.JobID)
+	case protocol.TypeNewRecording:
+		if err := env.Decode(&protocol.NewRecording{}); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleNewRecording(socket, string(env.Payload))
+	case protocol.TypeStreamStart:
+		if err := env.Decode(&protocol.StreamStart{}); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleStreamStart(socket, string(env.Payload))
+	case protocol.TypeStreamChunk:
+		var chunk protocol.StreamChunk
+		if err := env.Decode(&chunk); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleStreamChunk(socket, chunk.Data)
+	case protocol.TypeStreamStop:
+		handleStreamStop(socket)
+	case protocol.TypeUploadBegin:
+		if err := env.Decode(&protocol.UploadBegin{}); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleUploadBegin(socket, string(env.Payload))
+	case protocol.TypeUploadChunk:
+		if err := env.Decode(&protocol.UploadChunk{}); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleUploadChunk(socket, string(env.Payload))
+	case protocol.TypeUploadEnd:
+		if err := env.Decode(&protocol.UploadEnd{}); err != nil {
+			emitProtocolError(socket, env.Type, err)
+			return
+		}
+		handleUploadEnd(socket, string(env.Payload))
+	case protocol.TypeNowPlaying:
+		if listener == nil {
+			emitProtocolError(socket, env.Type, protocol.UnknownType(env.Type))
+			return
+		}
+		listener.handleNowPlaying(socket)
+	default:
+		emitProtocolError(socket, env.Type, protocol.UnknownType(env.Type))
+	}
+}
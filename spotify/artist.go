@@ -0,0 +1,265 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kkdai/youtube/v2"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// spotifyArtistPattern matches the page of a Spotify artist and
+	// captures its ID
+	spotifyArtistPattern = regexp.MustCompile(`^https://open\.spotify\.com/artist/([a-zA-Z0-9]{22})`)
+
+	// youtubeChannelPattern matches the page of a YouTube channel, by ID,
+	// handle, custom URL or user name
+	youtubeChannelPattern = regexp.MustCompile(`^https?://((www|m|music)\.)?youtube\.com/(channel/UC[\w-]{22}|@[^/?#]+|c/[^/?#]+|user/[^/?#]+)`)
+
+	// youtubeChannelIDPattern finds the ID of a channel in its page
+	youtubeChannelIDPattern = regexp.MustCompile(`"(?:externalId|channelId)":"(UC[\w-]{22})"`)
+)
+
+const (
+	spotifyArtistEndpoint = "https://api.spotify.com/v1/artists/"
+	spotifyAlbumsEndpoint = "https://api.spotify.com/v1/albums"
+
+	// spotifyAlbumsPerRequest is the most albums Spotify returns at once
+	spotifyAlbumsPerRequest = 20
+)
+
+// IsArtistURL reports whether rawURL is the page of a Spotify artist or of
+// a YouTube channel, whose songs can be imported all at once
+func IsArtistURL(rawURL string) bool {
+	return spotifyArtistPattern.MatchString(rawURL) || youtubeChannelPattern.MatchString(rawURL)
+}
+
+// ImportSummary counts what became of the tracks of an artist or album
+// import
+type ImportSummary struct {
+	Tracks int `json:"tracks"`
+	Added  int `json:"added"`
+	// Skipped counts the tracks that were already indexed, or saved by an
+	// earlier run of the same import
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// DlArtist downloads and saves every song of the Spotify artist or YouTube
+// channel at rawURL in the catalog selected by ctx, skipping those already
+// indexed, and returns what became of them. Like DlPlaylist, importing the
+// same artist again resumes an interrupted import. onStatus, if not nil, is
+// called every time a track changes stage.
+func DlArtist(ctx context.Context, rawURL, savePath string, onStatus func(TrackStatus)) (ImportSummary, error) {
+	if !IsArtistURL(rawURL) {
+		return ImportSummary{}, errors.New("expected the link of a Spotify artist or a YouTube channel")
+	}
+	source, err := SourceFor(rawURL)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+
+	tracks, err := source.Resolve(ctx, rawURL)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	return importTracks(ctx, source, rawURL, tracks, savePath, onStatus)
+}
+
+// importTracks is DlPlaylist, counting what became of the tracks
+func importTracks(ctx context.Context, source AudioSource, rawURL string, tracks []Track, savePath string, onStatus func(TrackStatus)) (ImportSummary, error) {
+	var mu sync.Mutex
+	summary := ImportSummary{Tracks: len(tracks)}
+	record := func(status TrackStatus) {
+		mu.Lock()
+		switch status.Stage {
+		case StageDone:
+			summary.Added++
+		case StageSkipped:
+			summary.Skipped++
+		case StageFailed:
+			summary.Failed++
+		}
+		mu.Unlock()
+		if onStatus != nil {
+			onStatus(status)
+		}
+	}
+
+	if _, err := DlPlaylist(ctx, source, rawURL, tracks, savePath, record); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// spotifyArtistTracks returns the tracks of the albums and singles of the
+// Spotify artist at rawURL, each song once. Spotify only lists them through
+// its Web API, so SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET are needed.
+func spotifyArtistTracks(ctx context.Context, rawURL string) ([]Track, error) {
+	match := spotifyArtistPattern.FindStringSubmatch(rawURL)
+	if match == nil {
+		return nil, errors.New("invalid artist url")
+	}
+	artistID := match[1]
+
+	clientID, clientSecret := utils.GetEnv("SPOTIFY_CLIENT_ID"), utils.GetEnv("SPOTIFY_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		return nil, errors.New("importing a Spotify artist needs SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+	}
+	api := &spotifyMetadata{clientID: clientID, clientSecret: clientSecret}
+	get := func(endpoint string) (string, error) {
+		token, err := api.accessToken(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get Spotify access token: %v", err)
+		}
+		return metadataGet(ctx, endpoint, "Bearer "+token)
+	}
+
+	body, err := get(spotifyArtistEndpoint + artistID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting artist: %v", err)
+	}
+	artist := gjson.Get(body, "name").String()
+	fmt.Printf("Collecting tracks of '%s'...\n", artist)
+
+	var albumIDs []string
+	next := spotifyArtistEndpoint + artistID + "/albums?" + url.Values{"include_groups": {"album,single"}, "limit": {"50"}}.Encode()
+	for next != "" {
+		body, err := get(next)
+		if err != nil {
+			return nil, fmt.Errorf("error listing albums: %v", err)
+		}
+		for _, id := range gjson.Get(body, "items.#.id").Array() {
+			albumIDs = append(albumIDs, id.String())
+		}
+		next = gjson.Get(body, "next").String()
+	}
+
+	var tracks []Track
+	for start := 0; start < len(albumIDs); start += spotifyAlbumsPerRequest {
+		end := min(start+spotifyAlbumsPerRequest, len(albumIDs))
+		body, err := get(spotifyAlbumsEndpoint + "?ids=" + strings.Join(albumIDs[start:end], ","))
+		if err != nil {
+			return nil, fmt.Errorf("error getting albums: %v", err)
+		}
+
+		for _, album := range gjson.Get(body, "albums").Array() {
+			items := album.Get("tracks.items").Array()
+			// Albums of more than 50 tracks list the others on further pages
+			for next := album.Get("tracks.next").String(); next != ""; {
+				page, err := get(next)
+				if err != nil {
+					return nil, fmt.Errorf("error getting album tracks: %v", err)
+				}
+				items = append(items, gjson.Get(page, "items").Array()...)
+				next = gjson.Get(page, "next").String()
+			}
+
+			// Release dates are a year, a month or a day, such as 2019-05-17
+			releaseYear, _ := strconv.Atoi(strings.SplitN(album.Get("release_date").String(), "-", 2)[0])
+			for _, item := range items {
+				var artists []string
+				for _, name := range item.Get("artists.#.name").Array() {
+					artists = append(artists, name.String())
+				}
+				tracks = append(tracks, Track{
+					Title:       item.Get("name").String(),
+					Artist:      item.Get("artists.0.name").String(),
+					Artists:     artists,
+					Album:       album.Get("name").String(),
+					Duration:    int(math.Round(item.Get("duration_ms").Float() / 1000)),
+					ReleaseYear: releaseYear,
+					CoverURL:    album.Get("images.0.url").String(),
+				})
+			}
+		}
+	}
+
+	tracks = uniqueTracks(tracks)
+	fmt.Println("Tracks collected:", len(tracks))
+	return tracks, nil
+}
+
+// youtubeChannelTracks returns the videos uploaded by the YouTube channel
+// at rawURL, titled and credited like the videos themselves
+func youtubeChannelTracks(ctx context.Context, rawURL string) ([]Track, error) {
+	channelID, err := youtubeChannelID(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The uploads of a channel are a playlist whose ID is that of the
+	// channel with UU in place of UC
+	client := youtube.Client{}
+	playlist, err := client.GetPlaylistContext(ctx, "UU"+strings.TrimPrefix(channelID, "UC"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing the videos of the channel: %v", err)
+	}
+	fmt.Printf("Collecting tracks of '%s'...\n", playlist.Author)
+
+	var tracks []Track
+	for _, video := range playlist.Videos {
+		artist := video.Author
+		if artist == "" {
+			artist = playlist.Author
+		}
+		tracks = append(tracks, Track{
+			Title:     video.Title,
+			Artist:    channelSuffixPattern.ReplaceAllString(artist, ""),
+			Duration:  int(video.Duration.Seconds()),
+			YouTubeID: video.ID,
+			Source:    utils.SourceYouTube,
+			SourceURL: youtubeURL(video.ID),
+		})
+	}
+
+	fmt.Println("Tracks collected:", len(tracks))
+	return tracks, nil
+}
+
+// youtubeChannelID returns the ID of the YouTube channel at rawURL, looking
+// it up in the channel's page unless rawURL holds it
+func youtubeChannelID(ctx context.Context, rawURL string) (string, error) {
+	match := youtubeChannelPattern.FindStringSubmatch(rawURL)
+	if match == nil {
+		return "", errors.New("invalid channel url")
+	}
+	if id, ok := strings.CutPrefix(match[3], "channel/"); ok {
+		return id, nil
+	}
+
+	page, err := metadataGet(ctx, "https://www.youtube.com/"+match[3], "")
+	if err != nil {
+		return "", fmt.Errorf("error getting the channel page: %v", err)
+	}
+	found := youtubeChannelIDPattern.FindStringSubmatch(page)
+	if found == nil {
+		return "", errors.New("no channel found at this url")
+	}
+	return found[1], nil
+}
+
+// uniqueTracks returns tracks without the songs listed more than once, such
+// as a single that is also on an album, keeping the first of each
+func uniqueTracks(tracks []Track) []Track {
+	seen := map[string]bool{}
+	var unique []Track
+	for _, track := range tracks {
+		key := normalizeTitle(track.Title) + "\x00" + normalizeArtist(track.Artist)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, track)
+	}
+	return unique
+}
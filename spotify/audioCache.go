@@ -0,0 +1,187 @@
+package spotify
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// ytAudioCache keeps the audio downloaded from YouTube videos, so that
+// saving a video again, reindexing its song or recognizing a part of it
+// doesn't download it again. It is nil when AUDIO_CACHE_DIR is unset.
+var ytAudioCache = newAudioCacheFromEnv()
+
+func newAudioCacheFromEnv() *audioCache {
+	dir := utils.GetEnv("AUDIO_CACHE_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	maxSize, err := strconv.ParseInt(utils.GetEnv("AUDIO_CACHE_MAX_SIZE", "0"), 10, 64)
+	if err != nil || maxSize <= 0 {
+		maxSize = 2 << 30
+	}
+	return &audioCache{dir: dir, maxSize: maxSize}
+}
+
+// audioCache is a directory of audio files named after the ID of their
+// video. Once its files add up to more than maxSize bytes, the files used
+// least recently are deleted. Files are written under a temporary name and
+// renamed, so processes can share the directory.
+type audioCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+}
+
+func (c *audioCache) path(ytID string) string {
+	return filepath.Join(c.dir, ytID+".m4a")
+}
+
+// lookup returns the path of the cached audio of a video and marks it as
+// used, and false if it isn't cached
+func (c *audioCache) lookup(ctx context.Context, ytID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path(ytID)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	// The modification time of a file is when it was last used
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	logger := utils.GetLogger()
+	logger.DebugContext(ctx, "using cached audio.", slog.String("youtube_id", ytID))
+	return path, true
+}
+
+// copyTo copies the cached audio of a video to filePath, and returns false
+// if it isn't cached
+func (c *audioCache) copyTo(ctx context.Context, ytID, filePath string) (bool, error) {
+	path, ok := c.lookup(ctx, ytID)
+	if !ok {
+		return false, nil
+	}
+
+	// A file that is open can still be read once evicted
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	return true, copyToFile(in, filePath)
+}
+
+// add copies the audio of a video downloaded to filePath into the cache,
+// and evicts the files used least recently if it is full. Failing to cache
+// it doesn't fail the download, so errors are only logged.
+func (c *audioCache) add(ctx context.Context, ytID, filePath string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	logger := utils.GetLogger()
+	if err := c.store(ytID, filePath); err != nil {
+		logger.WarnContext(ctx, "failed to cache audio.", slog.String("youtube_id", ytID), slog.Any("error", xerrors.New(err)))
+		return
+	}
+	if err := c.evict(); err != nil {
+		logger.WarnContext(ctx, "failed to evict cached audio.", slog.Any("error", xerrors.New(err)))
+	}
+}
+
+func (c *audioCache) store(ytID, filePath string) error {
+	if err := utils.CreateFolder(c.dir); err != nil {
+		return err
+	}
+	in, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(c.dir, ytID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(ytID))
+}
+
+// evict deletes the files used least recently until the cache holds at
+// most maxSize bytes
+func (c *audioCache) evict() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".m4a" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted by another process meanwhile
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, file := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+// copyToFile writes everything read from r to a new file at filePath
+func copyToFile(r io.Reader, filePath string) error {
+	out, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
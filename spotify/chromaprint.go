@@ -0,0 +1,89 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"song-recognition/acoustid"
+	"song-recognition/utils"
+)
+
+// ChromaprintRecord is a line of a Chromaprint export: the fingerprint
+// AcoustID identifies a song of the catalog by, with what identifies the
+// song, so that it can be submitted to AcoustID or compared with other
+// Chromaprint databases
+type ChromaprintRecord struct {
+	SongID        uint32 `json:"songId"`
+	Title         string `json:"title"`
+	Artist        string `json:"artist"`
+	Album         string `json:"album,omitempty"`
+	YouTubeID     string `json:"youtubeId,omitempty"`
+	RecordingMBID string `json:"recordingMbid,omitempty"`
+	acoustid.Fingerprint
+}
+
+// ExportChromaprints writes a ChromaprintRecord for every song of the
+// catalog selected by ctx to w, one JSON object per line, and returns how
+// many were written. The audio of each song is found like for reindexing:
+// in songsDir, or downloaded again. Songs whose audio can't be found or
+// fingerprinted are left out and reported to onError, if not nil.
+func ExportChromaprints(ctx context.Context, songsDir string, w io.Writer, onError func(song utils.Song, err error)) (int, error) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	enc := json.NewEncoder(w)
+	exported := 0
+	for offset := 0; ; offset += refingerprintPageSize {
+		songs, err := db.ListSongs(ctx, offset, refingerprintPageSize, utils.SortByID)
+		if err != nil {
+			return exported, fmt.Errorf("error listing songs: %v", err)
+		}
+
+		for _, song := range songs {
+			if err := ctx.Err(); err != nil {
+				return exported, err
+			}
+
+			fp, err := songChromaprint(ctx, songsDir, song)
+			if err != nil {
+				if onError != nil {
+					onError(song, err)
+				}
+				continue
+			}
+
+			record := ChromaprintRecord{
+				SongID:        song.ID,
+				Title:         song.Title,
+				Artist:        song.Artist,
+				Album:         song.Album,
+				YouTubeID:     song.YouTubeID,
+				RecordingMBID: song.RecordingMBID,
+				Fingerprint:   fp,
+			}
+			if err := enc.Encode(record); err != nil {
+				return exported, err
+			}
+			exported++
+		}
+
+		if len(songs) < refingerprintPageSize {
+			return exported, nil
+		}
+	}
+}
+
+// songChromaprint returns the Chromaprint fingerprint of the audio of song
+func songChromaprint(ctx context.Context, songsDir string, song utils.Song) (acoustid.Fingerprint, error) {
+	filePath, cleanup, err := SongAudio(ctx, songsDir, song)
+	if err != nil {
+		return acoustid.Fingerprint{}, err
+	}
+	defer cleanup()
+
+	return acoustid.FingerprintFile(ctx, filePath)
+}
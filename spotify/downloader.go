@@ -2,236 +2,156 @@ package spotify
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
+	"song-recognition/events"
+	"song-recognition/models"
 	"song-recognition/shazam"
 	"song-recognition/utils"
 	"song-recognition/wav"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/kkdai/youtube/v2"
-	"github.com/mdobak/go-xerrors"
 )
 
 const DELETE_SONG_FILE = false
 
 var yellow = color.New(color.FgYellow)
 
-func DlSingleTrack(url, savePath string) (int, error) {
-	trackInfo, err := TrackInfo(url)
-	if err != nil {
-		return 0, err
-	}
+// Stages a track goes through in DlTracks
+const (
+	StageSearching      = "searching"
+	StageDownloading    = "downloading"
+	StageFingerprinting = "fingerprinting"
+	StageDone           = "done"
+	StageSkipped        = "skipped"
+	StageFailed         = "failed"
+)
 
-	fmt.Println("Getting track info...")
-	time.Sleep(500 * time.Millisecond)
-	track := []Track{*trackInfo}
+// Stages ProcessAndSaveSong reports along with StageFingerprinting
+const (
+	StageConverting = "converting"
+	StageStoring    = "storing"
+)
 
-	fmt.Println("Now, downloading track...")
-	totalTracksDownloaded, err := dlTrack(track, savePath)
-	if err != nil {
-		return 0, err
-	}
+type progressContextKey struct{}
 
-	return totalTracksDownloaded, nil
+// WithProgress returns a copy of ctx with which every song download and
+// save reports the stage it enters to fn
+func WithProgress(ctx context.Context, fn func(stage string)) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, fn)
 }
 
-func DlPlaylist(url, savePath string) (int, error) {
-	tracks, err := PlaylistInfo(url)
-	if err != nil {
-		return 0, err
+// reportStage reports stage to the progress function of ctx, if any
+func reportStage(ctx context.Context, stage string) {
+	if fn, ok := ctx.Value(progressContextKey{}).(func(string)); ok {
+		fn(stage)
 	}
+}
 
-	time.Sleep(1 * time.Second)
-	fmt.Println("Now, downloading playlist...")
-	totalTracksDownloaded, err := dlTrack(tracks, savePath)
-	if err != nil {
-		return 0, err
-	}
+type reindexContextKey struct{}
 
-	return totalTracksDownloaded, nil
+// WithReindex returns a copy of ctx with which songs that are already
+// indexed get their fingerprints replaced by ReindexSong instead of being
+// rejected with a DuplicateError
+func WithReindex(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reindexContextKey{}, true)
 }
 
-func DlAlbum(url, savePath string) (int, error) {
-	tracks, err := AlbumInfo(url)
-	if err != nil {
-		return 0, err
-	}
-
-	time.Sleep(1 * time.Second)
-	fmt.Println("Now, downloading album...")
-	totalTracksDownloaded, err := dlTrack(tracks, savePath)
-	if err != nil {
-		return 0, err
-	}
+// Reindexing reports whether ctx reindexes songs that are already indexed
+func Reindexing(ctx context.Context) bool {
+	reindex, _ := ctx.Value(reindexContextKey{}).(bool)
+	return reindex
+}
 
-	return totalTracksDownloaded, nil
+// TrackStatus reports the progress of one track through DlTracks
+type TrackStatus struct {
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	Stage     string `json:"stage"`
+	Message   string `json:"message,omitempty"`
+	YouTubeID string `json:"youtubeId,omitempty"`
+	// Existing is the indexed song a skipped track duplicates
+	Existing *utils.Song `json:"existingSong,omitempty"`
 }
 
-func dlTrack(tracks []Track, path string) (int, error) {
-	var wg sync.WaitGroup
-	var downloadedTracks []string
-	var totalTracks int
-	logger := utils.GetLogger()
-	results := make(chan int, len(tracks))
-	numCPUs := runtime.NumCPU()
-	semaphore := make(chan struct{}, numCPUs)
+// youtubeSource downloads the audio of YouTube videos
+type youtubeSource struct{}
 
-	ctx := context.Background()
+func (s *youtubeSource) Name() string {
+	return "YouTube"
+}
 
-	db, err := utils.NewDbClient()
-	if err != nil {
-		return 0, err
+// Resolve returns the video rawURL points at, or the videos of a channel.
+// The details of a video are only fetched by Metadata, once it is known
+// not to be indexed.
+func (s *youtubeSource) Resolve(ctx context.Context, rawURL string) ([]Track, error) {
+	if youtubeChannelPattern.MatchString(rawURL) {
+		return youtubeChannelTracks(ctx, rawURL)
 	}
-	defer db.Close()
-
-	for _, t := range tracks {
-		wg.Add(1)
-		go func(track Track) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() {
-				<-semaphore
-			}()
-
-			trackCopy := &Track{
-				Album:    track.Album,
-				Artist:   track.Artist,
-				Artists:  track.Artists,
-				Duration: track.Duration,
-				Title:    track.Title,
-			}
-
-			// check if song exists
-			keyExists, err := SongKeyExists(utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist))
-			if err != nil {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error checking song existence", slog.Any("error", err))
-			}
-			if keyExists {
-				logMessage := fmt.Sprintf("'%s' by '%s' already exits.", trackCopy.Title, trackCopy.Artist)
-				logger.Info(logMessage)
-				return
-			}
-
-			ytID, err := getYTID(trackCopy)
-			if ytID == "" || err != nil {
-				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
-				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
-				return
-			}
-
-			trackCopy.Title, trackCopy.Artist = correctFilename(trackCopy.Title, trackCopy.Artist)
-			fileName := fmt.Sprintf("%s - %s", trackCopy.Title, trackCopy.Artist)
-			filePath := filepath.Join(path, fileName+".m4a")
-
-			err = downloadYTaudio(ytID, path, filePath)
-			if err != nil {
-				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
-				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
-				return
-			}
-
-			err = ProcessAndSaveSong(filePath, trackCopy.Title, trackCopy.Artist, ytID)
-			if err != nil {
-				logMessage := fmt.Sprintf("Failed to process song ('%s' by '%s')", trackCopy.Title, trackCopy.Artist)
-				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
-				return
-			}
-
-			utils.DeleteFile(filepath.Join(path, fileName+".m4a"))
-
-			wavFilePath := filepath.Join(path, fileName+".wav")
-
-			if err := addTags(wavFilePath, *trackCopy); err != nil {
-				logMessage := fmt.Sprintf("Error adding tags: %s", filePath+".wav")
-				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
-
-				return
-			}
-
-			if DELETE_SONG_FILE {
-				utils.DeleteFile(wavFilePath)
-			}
-
-			fmt.Printf("'%s' by '%s' was downloaded\n", track.Title, track.Artist)
-			downloadedTracks = append(downloadedTracks, fmt.Sprintf("%s, %s", track.Title, track.Artist))
-			results <- 1
-		}(t)
-	}
-
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	for range results {
-		totalTracks++
-	}
-
-	fmt.Println("Total tracks downloaded:", totalTracks)
-	return totalTracks, nil
 
-}
-
-/* github.com/kkdai/youtube */
-func downloadYTaudio(id, path, filePath string) error {
-	dir, err := os.Stat(path)
+	ytID, err := youtube.ExtractVideoID(rawURL)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid YouTube URL: %v", err)
 	}
 
-	if !dir.IsDir() {
-		return errors.New("the path is not valid (not a dir)")
-	}
+	return []Track{{
+		YouTubeID: ytID,
+		Source:    utils.SourceYouTube,
+		SourceURL: youtubeURL(ytID),
+	}}, nil
+}
 
+// Metadata takes an empty title or artist from the video's title and
+// channel
+func (s *youtubeSource) Metadata(ctx context.Context, track *Track) error {
 	client := youtube.Client{}
-	video, err := client.GetVideo(id)
+	video, err := client.GetVideoContext(ctx, track.YouTubeID)
 	if err != nil {
 		return err
 	}
-
-	/*
-		itag code: 140, container: m4a, content: audio, bitrate: 128k
-		change the FindByItag parameter to 139 if you want smaller files (but with a bitrate of 48k)
-		https://gist.github.com/sidneys/7095afe4da4ae58694d128b1034e01e2
-	*/
-	formats := video.Formats.Itag(140)
-
-	/* in some cases, when attempting to download the audio
-	using the library github.com/kkdai/youtube,
-	the download fails (and shows the file size as 0 bytes)
-	until the second or third attempt. */
-	var fileSize int64
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
+	if track.Title == "" {
+		track.Title = video.Title
+	}
+	if track.Artist == "" {
+		track.Artist = video.Author
+	}
+	if track.Duration == 0 {
+		track.Duration = int(video.Duration.Seconds())
 	}
 
-	for fileSize == 0 {
-		stream, _, err := client.GetStream(video, &formats[0])
-		if err != nil {
-			return err
-		}
-
-		if _, err = io.Copy(file, stream); err != nil {
-			return err
-		}
+	// The album, release date and artwork of the song are better than the
+	// upload date and thumbnail of the video
+	EnrichTrack(ctx, track)
+	if track.ReleaseYear == 0 && !video.PublishDate.IsZero() {
+		track.ReleaseYear = video.PublishDate.Year()
+	}
+	if track.CoverURL == "" && len(video.Thumbnails) > 0 {
+		// Thumbnails are ordered from smallest to largest
+		track.CoverURL = video.Thumbnails[len(video.Thumbnails)-1].URL
+	}
+	return nil
+}
 
-		fileSize, _ = GetFileSize(filePath)
+func (s *youtubeSource) Download(ctx context.Context, track *Track, dir string) (string, error) {
+	filePath := trackFilePath(dir, track, ".m4a")
+	downloader, err := downloadYTaudio(ctx, track.YouTubeID, dir, filePath)
+	if err != nil {
+		return "", err
 	}
-	defer file.Close()
+	track.Provenance.Downloader = downloader
+	return filePath, nil
+}
 
-	return nil
+// youtubeURL returns the watch page URL of a YouTube video
+func youtubeURL(ytID string) string {
+	return "https://www.youtube.com/watch?v=" + ytID
 }
 
 func addTags(file string, track Track) error {
@@ -268,59 +188,146 @@ func addTags(file string, track Track) error {
 	return nil
 }
 
-func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error {
-	db, err := utils.NewDbClient()
+// ProcessAndSaveSong registers a song with its metadata in the catalog
+// selected by ctx and stores the fingerprints of the audio file. A zero
+// duration is taken from the audio, and the time of ingestion and the
+// fingerprinting parameters are added to its provenance.
+func ProcessAndSaveSong(ctx context.Context, songFilePath, songTitle, songArtist, ytID string, meta utils.SongMetadata) error {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	wavFilePath, err := wav.ConvertToWAV(songFilePath, 1)
+	cfg, err := shazam.LoadConfig(ctx, db)
 	if err != nil {
 		return err
 	}
 
-	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	peaks, duration, err := analyzeSongFile(ctx, songFilePath, cfg)
 	if err != nil {
 		return err
 	}
 
-	samples, err := wav.WavBytesToSamples(wavInfo.Data)
+	if meta.Duration == 0 {
+		meta.Duration = int(math.Round(duration))
+	}
+	meta.Provenance.IngestedAt = time.Now().UTC()
+	meta.Provenance.FingerprintConfig = cfg.Hash()
+
+	reportStage(ctx, StageStoring)
+	fingerprintCount := 0
+	songID, err := db.RegisterSongWithFingerprints(ctx, songTitle, songArtist, ytID, meta, func(songID uint32) map[uint32]models.Couple {
+		fingerprints := shazam.Fingerprint(peaks, songID, cfg)
+		fingerprintCount = len(fingerprints)
+		return fingerprints
+	})
 	if err != nil {
-		return fmt.Errorf("error converting wav bytes to float64: %v", err)
+		return fmt.Errorf("error registering song: %v", err)
 	}
 
-	spectro, err := shazam.Spectrogram(samples, wavInfo.SampleRate)
-	if err != nil {
-		return fmt.Errorf("error creating spectrogram: %v", err)
+	if err := shazam.SaveConfig(ctx, db, cfg); err != nil {
+		return fmt.Errorf("error storing fingerprint config: %v", err)
 	}
 
-	songID, err := db.RegisterSong(songTitle, songArtist, ytID)
+	events.Emit(ctx, events.FingerprintsStored, events.Indexing{
+		SongID:       songID,
+		Title:        songTitle,
+		Artist:       songArtist,
+		Fingerprints: fingerprintCount,
+	})
+	return nil
+}
+
+// ReindexSong replaces the fingerprints of an indexed song of the catalog
+// selected by ctx with those of the audio file, e.g. after an ingestion
+// that stopped halfway. The song's details are left as they are.
+func ReindexSong(ctx context.Context, songFilePath string, song utils.Song) error {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
 	if err != nil {
 		return err
 	}
+	defer db.Close()
 
-	peaks := shazam.ExtractPeaks(spectro, wavInfo.Duration)
-	fingerprints := shazam.Fingerprint(peaks, songID)
+	cfg, err := shazam.LoadConfig(ctx, db)
+	if err != nil {
+		return err
+	}
 
-	err = db.StoreFingerprints(fingerprints)
+	peaks, _, err := analyzeSongFile(ctx, songFilePath, cfg)
 	if err != nil {
-		db.DeleteSongByID(songID)
-		return fmt.Errorf("error to storing fingerpring: %v", err)
+		return err
 	}
+	fingerprints := shazam.Fingerprint(peaks, song.ID, cfg)
 
-	fmt.Println("Fingerprints saved in MongoDB successfully")
+	reportStage(ctx, StageStoring)
+	if err := db.DeleteFingerprintsBySongID(ctx, song.ID); err != nil {
+		return fmt.Errorf("error deleting old fingerprints: %v", err)
+	}
+	// Fingerprints are stored idempotently, so a failed reindex can simply
+	// be run again
+	if err := db.StoreFingerprints(ctx, fingerprints); err != nil {
+		return fmt.Errorf("error storing fingerprints, reindex the song again: %v", err)
+	}
+
+	if err := shazam.SaveConfig(ctx, db, cfg); err != nil {
+		return fmt.Errorf("error storing fingerprint config: %v", err)
+	}
+
+	events.Emit(ctx, events.FingerprintsStored, events.Indexing{
+		SongID:       song.ID,
+		Title:        song.Title,
+		Artist:       song.Artist,
+		Fingerprints: len(fingerprints),
+		Reindexed:    true,
+	})
 	return nil
 }
 
-func getYTID(trackCopy *Track) (string, error) {
+// analyzeSongFile keeps a mono WAV copy of the audio file at songFilePath
+// next to it, and returns the peaks of its spectrogram and its duration.
+// The file is streamed rather than decoded whole, once for the copy, which
+// also gives its length, and once for the peaks.
+func analyzeSongFile(ctx context.Context, songFilePath string, cfg shazam.Config) ([]shazam.Peak, float64, error) {
+	reportStage(ctx, StageConverting)
+	wavFilePath := strings.TrimSuffix(songFilePath, filepath.Ext(songFilePath)) + ".wav"
+	// A WAV song is only replaced by its copy once it has been read again
+	copyPath := wavFilePath
+	if copyPath == songFilePath {
+		copyPath += ".tmp"
+	}
+	_, samples, err := wav.CopyToMonoWav(songFilePath, copyPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error writing wav file: %v", err)
+	}
+
+	pre, err := shazam.PreprocessingFromEnv()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reportStage(ctx, StageFingerprinting)
+	peaks, duration, err := shazam.FilePeaks(songFilePath, samples, cfg, pre)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating spectrogram: %v", err)
+	}
+
+	if copyPath != wavFilePath {
+		if err := os.Rename(copyPath, wavFilePath); err != nil {
+			return nil, 0, fmt.Errorf("error writing wav file: %v", err)
+		}
+	}
+	return peaks, duration, nil
+}
+
+func getYTID(ctx context.Context, trackCopy *Track) (string, error) {
 	ytID, err := GetYoutubeId(*trackCopy)
 	if ytID == "" || err != nil {
 		return "", err
 	}
 
 	// Check if YouTube ID exists
-	ytidExists, err := YtIDExists(ytID)
+	ytidExists, err := YtIDExists(ctx, ytID)
 	if err != nil {
 		return "", fmt.Errorf("error checking YT ID existence: %v", err)
 	}
@@ -335,7 +342,7 @@ func getYTID(trackCopy *Track) (string, error) {
 			return "", err
 		}
 
-		ytidExists, err = YtIDExists(ytID)
+		ytidExists, err = YtIDExists(ctx, ytID)
 		if err != nil {
 			return "", fmt.Errorf("error checking YT ID existence: %v", err)
 		}
@@ -0,0 +1,109 @@
+package spotify
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"song-recognition/utils"
+	"strings"
+	"unicode"
+)
+
+// DuplicateError is returned when a song being added is already indexed
+type DuplicateError struct {
+	Song utils.Song
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("'%s' by '%s' is already indexed", e.Song.Title, e.Song.Artist)
+}
+
+var (
+	// featuringPattern matches a featured artists suffix such as
+	// "(feat. X)", "ft. X" or "featuring X", up to the end of the string
+	featuringPattern = regexp.MustCompile(`(?i)[\(\[]?\s*\b(feat|ft|featuring)\b\.?\s.*$`)
+
+	// noisePattern matches the decorations commonly found in video titles
+	noisePattern = regexp.MustCompile(`(?i)[\(\[]\s*(official\s*)?(music\s*)?(video|audio|lyrics?(\s*video)?|visualizer|hd|hq)\s*[\)\]]`)
+
+	// channelSuffixPattern matches the suffixes of YouTube music channels
+	channelSuffixPattern = regexp.MustCompile(`(?i)(\s*-\s*topic|vevo)$`)
+)
+
+// normalizeTitle reduces a song title to lowercase words without featured
+// artists, video decorations or punctuation
+func normalizeTitle(title string) string {
+	title = noisePattern.ReplaceAllString(title, " ")
+	title = featuringPattern.ReplaceAllString(title, "")
+	return normalizeWords(title)
+}
+
+// normalizeArtist reduces an artist name to the lowercase words of the main
+// artist, without featured artists or channel suffixes
+func normalizeArtist(artist string) string {
+	artist = featuringPattern.ReplaceAllString(artist, "")
+	artist = channelSuffixPattern.ReplaceAllString(strings.TrimSpace(artist), "")
+	return normalizeWords(artist)
+}
+
+// normalizeWords normalizes s like song keys, then drops punctuation and
+// collapses whitespace
+func normalizeWords(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return r
+		case r == '\'' || r == '’':
+			return -1
+		default:
+			return ' '
+		}
+	}, utils.NormalizeText(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// FindDuplicate returns the indexed song that has ytID, or the same title
+// and artist. Titles and artists are compared after normalizing casing,
+// accents, character widths, punctuation, featured artists and video title
+// decorations. Empty arguments are not compared.
+func FindDuplicate(ctx context.Context, db utils.DBClient, title, artist, ytID string) (*utils.Song, error) {
+	if ytID != "" {
+		song, exists, err := db.GetSongByYTID(ctx, ytID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return &song, nil
+		}
+	}
+
+	if title == "" || artist == "" {
+		return nil, nil
+	}
+
+	song, exists, err := db.GetSongByKey(ctx, utils.GenerateSongKey(title, artist))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return &song, nil
+	}
+
+	normTitle, normArtist := normalizeTitle(title), normalizeArtist(artist)
+	if normTitle == "" || normArtist == "" {
+		return nil, nil
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, utils.SortByID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range songs {
+		if normalizeTitle(songs[i].Title) == normTitle && normalizeArtist(songs[i].Artist) == normArtist {
+			return &songs[i], nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,171 @@
+package spotify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"song-recognition/utils"
+	"sync"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+type retryFailedContextKey struct{}
+
+// WithRetryFailed returns a copy of ctx with which an import that was
+// interrupted retries the songs it failed to save, which are skipped
+// otherwise
+func WithRetryFailed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryFailedContextKey{}, true)
+}
+
+func retryingFailed(ctx context.Context) bool {
+	retry, _ := ctx.Value(retryFailedContextKey{}).(bool)
+	return retry
+}
+
+// importState is what is remembered of an import, in a setting of its
+// catalog. Songs are identified by a short hash of their key, so that
+// large imports fit in a setting.
+type importState struct {
+	Name   string   `json:"name"`
+	Done   []string `json:"done,omitempty"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+// ImportProgress records which songs of a bulk import, such as a playlist
+// or a directory, were saved or failed to be, so that an interrupted import
+// resumes where it stopped. Songs are identified by keys that stay the same
+// from one run to the next. Its methods can be called concurrently.
+type ImportProgress struct {
+	mu      sync.Mutex
+	setting string
+	state   importState
+	retry   bool
+}
+
+// importSetting returns the setting the progress of the import named name
+// is stored in
+func importSetting(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "import:" + hex.EncodeToString(sum[:16])
+}
+
+// importKey returns the short hash a song is stored under
+func importKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// importTrackKey identifies a track of an import by what its source
+// resolved, before saving it completes its details
+func importTrackKey(track Track) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s", track.SourceURL, track.YouTubeID, track.Title, track.Artist)
+}
+
+// LoadImportProgress returns the progress of the import named name, such as
+// the URL of a playlist, in the catalog selected by ctx, which retries the
+// songs that failed if ctx was made with WithRetryFailed
+func LoadImportProgress(ctx context.Context, name string) (*ImportProgress, error) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	progress := &ImportProgress{
+		setting: importSetting(name),
+		state:   importState{Name: name},
+		retry:   retryingFailed(ctx),
+	}
+	value, exists, err := db.GetSetting(ctx, progress.setting)
+	if err != nil {
+		return nil, err
+	}
+	if exists && value != "" {
+		if err := json.Unmarshal([]byte(value), &progress.state); err != nil {
+			return nil, fmt.Errorf("invalid progress of import of %s: %v", name, err)
+		}
+	}
+	return progress, nil
+}
+
+// Skip returns why the song with key is skipped, or "" if it has to be
+// saved
+func (p *ImportProgress) Skip(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key = importKey(key)
+	switch {
+	case slices.Contains(p.state.Done, key):
+		return "saved by an earlier import"
+	case slices.Contains(p.state.Failed, key) && !p.retry:
+		return "failed in an earlier import"
+	}
+	return ""
+}
+
+// Record stores whether the song with key was saved or failed to be.
+// Failing to store it only means the song is tried again, so errors are
+// only logged.
+func (p *ImportProgress) Record(ctx context.Context, key string, saved bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key = importKey(key)
+	p.state.Failed = slices.DeleteFunc(p.state.Failed, func(failed string) bool { return failed == key })
+	if !saved {
+		p.state.Failed = append(p.state.Failed, key)
+	} else if !slices.Contains(p.state.Done, key) {
+		p.state.Done = append(p.state.Done, key)
+	}
+
+	data, err := json.Marshal(p.state)
+	if err == nil {
+		err = p.save(ctx, string(data))
+	}
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "failed to save import progress.", slog.String("import", p.state.Name), slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// Failed returns the number of songs that failed and weren't saved since
+func (p *ImportProgress) Failed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.state.Failed)
+}
+
+// Finish forgets the import once the songs with keys are all saved, so
+// that importing the same songs again starts over
+func (p *ImportProgress) Finish(ctx context.Context, keys []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, key := range keys {
+		if !slices.Contains(p.state.Done, importKey(key)) {
+			return
+		}
+	}
+	if err := p.save(ctx, ""); err != nil {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "failed to clear import progress.", slog.String("import", p.state.Name), slog.Any("error", xerrors.New(err)))
+	}
+}
+
+func (p *ImportProgress) save(ctx context.Context, value string) error {
+	// Not kept open, since some backends only allow one connection at a
+	// time and songs are saved meanwhile
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.SetSetting(ctx, p.setting, value)
+}
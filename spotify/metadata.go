@@ -0,0 +1,333 @@
+package spotify
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+	"github.com/tidwall/gjson"
+)
+
+// MetadataProvider looks up the details of a song, such as its album,
+// release year and artwork, from its title and artist
+type MetadataProvider interface {
+	// Name identifies the provider in logs
+	Name() string
+	// SearchTrack returns the best match for title and artist, or nil if
+	// the provider doesn't know the song
+	SearchTrack(ctx context.Context, title, artist string) (*Track, error)
+}
+
+// Metadata providers that can be selected with METADATA_PROVIDER
+const (
+	MetadataSpotify = "spotify"
+	MetadataITunes  = "itunes"
+	MetadataNone    = "none"
+)
+
+var metadataClient = &http.Client{Timeout: 15 * time.Second}
+
+// NewMetadataProvider returns the provider selected by METADATA_PROVIDER.
+// By default it is Spotify when SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET
+// are set, and the iTunes Search API, which needs no credentials, otherwise.
+// It returns nil for "none".
+func NewMetadataProvider() (MetadataProvider, error) {
+	clientID := utils.GetEnv("SPOTIFY_CLIENT_ID")
+	clientSecret := utils.GetEnv("SPOTIFY_CLIENT_SECRET")
+
+	name := strings.ToLower(utils.GetEnv("METADATA_PROVIDER"))
+	if name == "" {
+		name = MetadataITunes
+		if clientID != "" && clientSecret != "" {
+			name = MetadataSpotify
+		}
+	}
+
+	switch name {
+	case MetadataSpotify:
+		if clientID == "" || clientSecret == "" {
+			return nil, errors.New("the spotify metadata provider needs SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+		}
+		return &spotifyMetadata{clientID: clientID, clientSecret: clientSecret}, nil
+	case MetadataITunes:
+		return &iTunesMetadata{country: utils.GetEnv("ITUNES_COUNTRY", "US")}, nil
+	case MetadataNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown metadata provider %q, expected spotify, itunes or none", name)
+	}
+}
+
+var (
+	metadataProviderOnce sync.Once
+	metadataProvider     MetadataProvider
+)
+
+// defaultMetadataProvider returns the provider selected by
+// METADATA_PROVIDER, nil if none is or the selection is invalid
+func defaultMetadataProvider(ctx context.Context) MetadataProvider {
+	metadataProviderOnce.Do(func() {
+		provider, err := NewMetadataProvider()
+		if err != nil {
+			logger := utils.GetLogger()
+			logger.ErrorContext(ctx, "invalid metadata provider, songs won't be looked up.", slog.Any("error", xerrors.New(err)))
+			return
+		}
+		metadataProvider = provider
+	})
+	return metadataProvider
+}
+
+// EnrichTrack fills the album, release year, duration and cover of track
+// that are unknown with those found by the selected metadata provider. The
+// title and artist are kept as they are, since songs are identified by
+// them. A failed lookup leaves track unchanged.
+func EnrichTrack(ctx context.Context, track *Track) {
+	if track.Title == "" || track.Artist == "" {
+		return
+	}
+	if track.Album != "" && track.ReleaseYear != 0 && track.Duration != 0 && track.CoverURL != "" {
+		return
+	}
+
+	provider := defaultMetadataProvider(ctx)
+	if provider == nil {
+		return
+	}
+
+	found, err := provider.SearchTrack(ctx, track.Title, track.Artist)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.WarnContext(ctx, "failed to look up song metadata.",
+			slog.String("provider", provider.Name()),
+			slog.Any("error", xerrors.New(err)),
+		)
+		return
+	}
+	if found == nil {
+		return
+	}
+
+	if track.Album == "" {
+		track.Album = found.Album
+	}
+	if track.ReleaseYear == 0 {
+		track.ReleaseYear = found.ReleaseYear
+	}
+	if track.Duration == 0 {
+		track.Duration = found.Duration
+	}
+	if track.CoverURL == "" {
+		track.CoverURL = found.CoverURL
+	}
+}
+
+// metadataGet requests endpoint, with the given authorization header if it
+// isn't empty, and returns the body
+func metadataGet(ctx context.Context, endpoint, authorization string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return doMetadataRequest(req)
+}
+
+// doMetadataRequest sends req with the metadata client and returns the body
+func doMetadataRequest(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// bestResult returns the first of results credited to artist, or else to
+// an artist that includes it or is included in it, such as a band with a
+// featured artist. artistPath is the path of the credited artist in a result.
+func bestResult(results []gjson.Result, artistPath, artist string) (gjson.Result, bool) {
+	artist = strings.ToLower(artist)
+	var partial *gjson.Result
+	for i, result := range results {
+		credited := strings.ToLower(result.Get(artistPath).String())
+		if credited == "" {
+			continue
+		}
+		if credited == artist {
+			return result, true
+		}
+		if partial == nil && (strings.Contains(credited, artist) || strings.Contains(artist, credited)) {
+			partial = &results[i]
+		}
+	}
+	if partial == nil {
+		return gjson.Result{}, false
+	}
+	return *partial, true
+}
+
+// iTunesMetadata looks songs up with the iTunes Search API, which needs no
+// credentials. Set the store country with ITUNES_COUNTRY.
+type iTunesMetadata struct {
+	country string
+}
+
+const iTunesSearchEndpoint = "https://itunes.apple.com/search"
+
+func (p *iTunesMetadata) Name() string {
+	return MetadataITunes
+}
+
+func (p *iTunesMetadata) SearchTrack(ctx context.Context, title, artist string) (*Track, error) {
+	query := url.Values{}
+	query.Set("term", artist+" "+title)
+	query.Set("media", "music")
+	query.Set("entity", "song")
+	query.Set("limit", "10")
+	query.Set("country", p.country)
+
+	body, err := metadataGet(ctx, iTunesSearchEndpoint+"?"+query.Encode(), "")
+	if err != nil {
+		return nil, fmt.Errorf("error searching iTunes: %v", err)
+	}
+
+	result, ok := bestResult(gjson.Get(body, "results").Array(), "artistName", artist)
+	if !ok {
+		return nil, nil
+	}
+
+	track := &Track{
+		Title:    result.Get("trackName").String(),
+		Artist:   result.Get("artistName").String(),
+		Album:    result.Get("collectionName").String(),
+		Duration: int(math.Round(result.Get("trackTimeMillis").Float() / 1000)),
+	}
+	if date, err := time.Parse(time.RFC3339, result.Get("releaseDate").String()); err == nil {
+		track.ReleaseYear = date.Year()
+	}
+	if artwork := result.Get("artworkUrl100").String(); artwork != "" {
+		// Artwork URLs can be resized by changing their dimensions
+		track.CoverURL = strings.Replace(artwork, "100x100bb", "600x600bb", 1)
+	}
+	return track, nil
+}
+
+// spotifyMetadata looks songs up with the Spotify Web API, authenticated as
+// the app given by SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET
+type spotifyMetadata struct {
+	clientID, clientSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+const (
+	spotifyAccountsEndpoint = "https://accounts.spotify.com/api/token"
+	spotifySearchEndpoint   = "https://api.spotify.com/v1/search"
+)
+
+func (p *spotifyMetadata) Name() string {
+	return MetadataSpotify
+}
+
+// accessToken returns an app access token, requesting a new one when the
+// last one expired
+func (p *spotifyMetadata) accessToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Now().Before(p.expires) {
+		return p.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, spotifyAccountsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.clientID+":"+p.clientSecret)))
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Spotify returned %s", resp.Status)
+	}
+
+	p.token = gjson.Get(string(body), "access_token").String()
+	// Renew the token a minute early, so it doesn't expire mid-request
+	lifetime := time.Duration(gjson.Get(string(body), "expires_in").Int()) * time.Second
+	p.expires = time.Now().Add(lifetime - time.Minute)
+	return p.token, nil
+}
+
+func (p *spotifyMetadata) SearchTrack(ctx context.Context, title, artist string) (*Track, error) {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Spotify access token: %v", err)
+	}
+
+	query := url.Values{}
+	query.Set("q", fmt.Sprintf("track:%s artist:%s", title, artist))
+	query.Set("type", "track")
+	query.Set("limit", "10")
+
+	body, err := metadataGet(ctx, spotifySearchEndpoint+"?"+query.Encode(), "Bearer "+token)
+	if err != nil {
+		return nil, fmt.Errorf("error searching Spotify: %v", err)
+	}
+
+	item, ok := bestResult(gjson.Get(body, "tracks.items").Array(), "artists.0.name", artist)
+	if !ok {
+		return nil, nil
+	}
+
+	track := &Track{
+		Title:    item.Get("name").String(),
+		Artist:   item.Get("artists.0.name").String(),
+		Album:    item.Get("album.name").String(),
+		Duration: int(math.Round(item.Get("duration_ms").Float() / 1000)),
+		CoverURL: item.Get("album.images.0.url").String(),
+	}
+	for _, artist := range item.Get("artists.#.name").Array() {
+		track.Artists = append(track.Artists, artist.String())
+	}
+	// Release dates are YYYY, YYYY-MM or YYYY-MM-DD
+	if date := item.Get("album.release_date").String(); len(date) >= 4 {
+		track.ReleaseYear, _ = strconv.Atoi(date[:4])
+	}
+	return track, nil
+}
@@ -0,0 +1,196 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	musicBrainzEndpoint = "https://musicbrainz.org/ws/2/"
+	coverArtEndpoint    = "https://coverartarchive.org/release/"
+
+	// musicBrainzInterval is how often MusicBrainz accepts a request from
+	// the same client
+	musicBrainzInterval = time.Second
+)
+
+var (
+	// mbidPattern matches a MusicBrainz ID
+	mbidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	// musicBrainzReleasePattern matches the page of a MusicBrainz release
+	// and captures its ID
+	musicBrainzReleasePattern = regexp.MustCompile(`^https://(?:beta\.)?musicbrainz\.org/release/([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
+
+	musicBrainzMu   sync.Mutex
+	musicBrainzLast time.Time
+)
+
+// musicBrainzSource downloads the releases of MusicBrainz, such as albums.
+// Like Spotify, MusicBrainz only provides their details; the audio of each
+// track is downloaded from the YouTube video that matches it best.
+type musicBrainzSource struct {
+	spotifySource
+}
+
+func (s *musicBrainzSource) Name() string {
+	return "MusicBrainz"
+}
+
+func (s *musicBrainzSource) Resolve(ctx context.Context, rawURL string) ([]Track, error) {
+	match := musicBrainzReleasePattern.FindStringSubmatch(rawURL)
+	if match == nil {
+		return nil, errors.New("invalid release url")
+	}
+	return musicBrainzReleaseTracks(ctx, match[1])
+}
+
+// IsMusicBrainzRelease reports whether release is the ID or the page of a
+// MusicBrainz release
+func IsMusicBrainzRelease(release string) bool {
+	return mbidPattern.MatchString(release) || musicBrainzReleasePattern.MatchString(release)
+}
+
+// MusicBrainzReleaseURL returns the page of the MusicBrainz release with
+// the given ID
+func MusicBrainzReleaseURL(mbid string) string {
+	return "https://musicbrainz.org/release/" + mbid
+}
+
+// DlAlbum downloads and saves every track of a MusicBrainz release, given
+// by its ID or page, in the catalog selected by ctx, skipping those already
+// indexed, and returns what became of them. Songs are saved with the
+// MusicBrainz IDs of their recording and of the release. Like DlPlaylist,
+// importing the same release again resumes an interrupted import. onStatus,
+// if not nil, is called every time a track changes stage.
+func DlAlbum(ctx context.Context, release, savePath string, onStatus func(TrackStatus)) (ImportSummary, error) {
+	if !IsMusicBrainzRelease(release) {
+		return ImportSummary{}, errors.New("expected the ID or link of a MusicBrainz release")
+	}
+	rawURL := release
+	if mbidPattern.MatchString(release) {
+		rawURL = MusicBrainzReleaseURL(release)
+	}
+	source, err := SourceFor(rawURL)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+
+	tracks, err := source.Resolve(ctx, rawURL)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	return importTracks(ctx, source, rawURL, tracks, savePath, onStatus)
+}
+
+// FindMusicBrainzRelease returns the ID of the MusicBrainz release that best
+// matches the album title and artist
+func FindMusicBrainzRelease(ctx context.Context, artist, album string) (string, error) {
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("release:%s AND artist:%s", luceneQuote(album), luceneQuote(artist)))
+	query.Set("limit", "10")
+	query.Set("fmt", "json")
+
+	body, err := musicBrainzGet(ctx, musicBrainzEndpoint+"release?"+query.Encode())
+	if err != nil {
+		return "", fmt.Errorf("error searching MusicBrainz: %v", err)
+	}
+
+	// Releases come best match first
+	release, ok := bestResult(gjson.Get(body, "releases").Array(), "artist-credit.0.name", artist)
+	if !ok {
+		return "", fmt.Errorf("no release of '%s' by '%s' found on MusicBrainz", album, artist)
+	}
+	return release.Get("id").String(), nil
+}
+
+// musicBrainzReleaseTracks returns the tracks of every medium of the
+// MusicBrainz release with the given ID
+func musicBrainzReleaseTracks(ctx context.Context, mbid string) ([]Track, error) {
+	query := url.Values{}
+	query.Set("inc", "recordings artist-credits")
+	query.Set("fmt", "json")
+
+	body, err := musicBrainzGet(ctx, musicBrainzEndpoint+"release/"+mbid+"?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error getting release: %v", err)
+	}
+
+	album := gjson.Get(body, "title").String()
+	fmt.Printf("Collecting tracks of '%s'...\n", album)
+
+	// Release dates are a year, a month or a day, such as 2019-05-17
+	releaseYear, _ := strconv.Atoi(strings.SplitN(gjson.Get(body, "date").String(), "-", 2)[0])
+	var coverURL string
+	if gjson.Get(body, "cover-art-archive.front").Bool() {
+		coverURL = coverArtEndpoint + mbid + "/front-500"
+	}
+
+	var tracks []Track
+	for _, medium := range gjson.Get(body, "media").Array() {
+		for _, item := range medium.Get("tracks").Array() {
+			var artists []string
+			for _, name := range item.Get("artist-credit.#.name").Array() {
+				artists = append(artists, name.String())
+			}
+			tracks = append(tracks, Track{
+				Title:         item.Get("title").String(),
+				Artist:        item.Get("artist-credit.0.name").String(),
+				Artists:       artists,
+				Album:         album,
+				Duration:      int(math.Round(item.Get("length").Float() / 1000)),
+				ReleaseYear:   releaseYear,
+				CoverURL:      coverURL,
+				RecordingMBID: item.Get("recording.id").String(),
+				ReleaseMBID:   mbid,
+			})
+		}
+	}
+
+	fmt.Println("Tracks collected:", len(tracks))
+	return tracks, nil
+}
+
+// musicBrainzGet requests endpoint and returns the body. Requests are
+// spaced by musicBrainzInterval and identify the app with
+// MUSICBRAINZ_USER_AGENT, as MusicBrainz asks of its clients.
+func musicBrainzGet(ctx context.Context, endpoint string) (string, error) {
+	musicBrainzMu.Lock()
+	wait := time.Until(musicBrainzLast.Add(musicBrainzInterval))
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			musicBrainzMu.Unlock()
+			return "", ctx.Err()
+		}
+	}
+	musicBrainzLast = time.Now()
+	musicBrainzMu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", utils.GetEnv("MUSICBRAINZ_USER_AGENT", "seek-tune/1.0 ( https://github.com/ernesto27/seek-tune )"))
+	req.Header.Set("Accept", "application/json")
+	return doMetadataRequest(req)
+}
+
+// luceneQuote quotes s as a phrase of a Lucene query, such as those of the
+// MusicBrainz search
+func luceneQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,333 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+)
+
+// refingerprintStateSetting is the setting of the staging catalog the
+// progress of a re-fingerprinting is stored under, so that an interrupted
+// run picks up where it stopped
+const refingerprintStateSetting = "refingerprintState"
+
+const (
+	// refingerprintPageSize is the number of songs listed at a time
+	refingerprintPageSize = 100
+
+	// refingerprintCopyBatchSize is the number of fingerprints copied from
+	// the staging catalog at a time
+	refingerprintCopyBatchSize = 10000
+)
+
+// refingerprintState is the progress of a re-fingerprinting
+type refingerprintState struct {
+	Config shazam.Config `json:"config"`
+	// LastSongID is the last song fingerprinted, songs being fingerprinted
+	// by ID. Failed songs are tried again by the next run.
+	LastSongID uint32   `json:"lastSongId"`
+	Failed     []uint32 `json:"failed,omitempty"`
+	// Swapping is set once the fingerprints are being copied into the
+	// catalog, which a run that stops then only has to finish
+	Swapping bool `json:"swapping,omitempty"`
+}
+
+// RefingerprintResult sums up a re-fingerprinting
+type RefingerprintResult struct {
+	Songs        int // songs fingerprinted by this run
+	Fingerprints int // fingerprints copied into the catalog
+	// Failed are the songs that couldn't be fingerprinted, which keep the
+	// catalog from being swapped
+	Failed  []uint32
+	Swapped bool
+}
+
+// RefingerprintProgress is told about every song once it is fingerprinted
+// or failed to be
+type RefingerprintProgress func(song utils.Song, err error)
+
+// RefingerprintStagingCatalog returns the catalog the new fingerprints of
+// catalog are made in before they replace the old ones
+func RefingerprintStagingCatalog(catalog string) (string, error) {
+	staging := "refingerprint"
+	if catalog != utils.DefaultCatalog {
+		staging = catalog + "_refingerprint"
+	}
+	if !utils.ValidCatalog(staging) {
+		return "", fmt.Errorf("catalog name %q is too long to stage its fingerprints", catalog)
+	}
+	return staging, nil
+}
+
+// RefingerprintCatalog fingerprints every song of the catalog selected by
+// ctx again with cfg, after fingerprinting parameters changed. Songs are
+// fingerprinted from their WAV file in songsDir when it was kept, or
+// downloaded again from their source, into a staging catalog that the
+// catalog keeps being recognized from meanwhile. Once every song is
+// fingerprinted, the catalog's fingerprints are replaced by the staged
+// ones; recognitions fail with shazam.ErrReindexing until they all are.
+// Nothing may save songs in the catalog while it runs. A run that stops
+// for any reason, or leaves failed songs, is resumed by running it again.
+func RefingerprintCatalog(ctx context.Context, songsDir string, cfg shazam.Config, progress RefingerprintProgress) (RefingerprintResult, error) {
+	var result RefingerprintResult
+	catalog := utils.CatalogFromContext(ctx)
+	stagingCatalog, err := RefingerprintStagingCatalog(catalog)
+	if err != nil {
+		return result, err
+	}
+
+	db, err := utils.NewCatalogDBClient(catalog)
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+
+	staging, err := utils.NewCatalogDBClient(stagingCatalog)
+	if err != nil {
+		return result, err
+	}
+	defer staging.Close()
+
+	state, err := loadRefingerprintState(ctx, staging, cfg)
+	if err != nil {
+		return result, err
+	}
+
+	if !state.Swapping {
+		if err := refingerprintSongs(ctx, db, staging, songsDir, &state, &result, progress); err != nil {
+			return result, err
+		}
+		if len(state.Failed) > 0 {
+			result.Failed = state.Failed
+			return result, nil
+		}
+
+		state.Swapping = true
+		if err := saveRefingerprintState(ctx, staging, state); err != nil {
+			return result, err
+		}
+	}
+
+	result.Fingerprints, err = swapFingerprints(ctx, db, staging, cfg)
+	if err != nil {
+		return result, fmt.Errorf("error replacing fingerprints, run again to finish: %v", err)
+	}
+	result.Swapped = true
+
+	if err := staging.DeleteCollection(ctx, "fingerprints"); err != nil {
+		return result, fmt.Errorf("error clearing staging catalog %s: %v", stagingCatalog, err)
+	}
+	if err := staging.SetSetting(ctx, refingerprintStateSetting, ""); err != nil {
+		return result, fmt.Errorf("error clearing staging catalog %s: %v", stagingCatalog, err)
+	}
+	return result, nil
+}
+
+// loadRefingerprintState returns the progress of the last run with cfg. A
+// run with other parameters is started over, unless it was already
+// swapping fingerprints, which has to be finished first.
+func loadRefingerprintState(ctx context.Context, staging utils.DBClient, cfg shazam.Config) (refingerprintState, error) {
+	value, exists, err := staging.GetSetting(ctx, refingerprintStateSetting)
+	if err != nil {
+		return refingerprintState{}, err
+	}
+
+	var state refingerprintState
+	if exists && value != "" {
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			return refingerprintState{}, fmt.Errorf("invalid re-fingerprinting state: %v", err)
+		}
+		if state.Config == cfg {
+			return state, nil
+		}
+		if state.Swapping {
+			return refingerprintState{}, fmt.Errorf("a re-fingerprinting with %+v is being swapped in, run it again with those parameters to finish it", state.Config)
+		}
+	}
+
+	// Fingerprints left by an abandoned run were made with other parameters
+	if err := staging.DeleteCollection(ctx, "fingerprints"); err != nil {
+		return refingerprintState{}, err
+	}
+	state = refingerprintState{Config: cfg}
+	return state, saveRefingerprintState(ctx, staging, state)
+}
+
+func saveRefingerprintState(ctx context.Context, staging utils.DBClient, state refingerprintState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return staging.SetSetting(ctx, refingerprintStateSetting, string(data))
+}
+
+// refingerprintSongs fingerprints the songs of db that state hasn't, or
+// failed to, into staging, saving the progress after every song
+func refingerprintSongs(ctx context.Context, db, staging utils.DBClient, songsDir string, state *refingerprintState, result *RefingerprintResult, progress RefingerprintProgress) error {
+	retry := slices.Clone(state.Failed)
+	listed := map[uint32]bool{}
+
+	for offset := 0; ; offset += refingerprintPageSize {
+		songs, err := db.ListSongs(ctx, offset, refingerprintPageSize, utils.SortByID)
+		if err != nil {
+			return fmt.Errorf("error listing songs: %v", err)
+		}
+
+		for _, song := range songs {
+			listed[song.ID] = true
+			if song.ID <= state.LastSongID && !slices.Contains(retry, song.ID) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := refingerprintSong(ctx, staging, songsDir, song, state.Config)
+			state.Failed = slices.DeleteFunc(state.Failed, func(id uint32) bool { return id == song.ID })
+			if err != nil {
+				state.Failed = append(state.Failed, song.ID)
+			} else {
+				result.Songs++
+			}
+			if progress != nil {
+				progress(song, err)
+			}
+
+			state.LastSongID = max(state.LastSongID, song.ID)
+			if err := saveRefingerprintState(ctx, staging, *state); err != nil {
+				return err
+			}
+		}
+
+		if len(songs) < refingerprintPageSize {
+			// Failed songs deleted since aren't waited for
+			state.Failed = slices.DeleteFunc(state.Failed, func(id uint32) bool { return !listed[id] })
+			return saveRefingerprintState(ctx, staging, *state)
+		}
+	}
+}
+
+// refingerprintSong stores the fingerprints of song made with cfg in
+// staging. Fingerprints are stored idempotently, so a song interrupted
+// halfway is simply fingerprinted again.
+func refingerprintSong(ctx context.Context, staging utils.DBClient, songsDir string, song utils.Song, cfg shazam.Config) error {
+	filePath, cleanup, err := SongAudio(ctx, songsDir, song)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	peaks, _, err := analyzeSongFile(ctx, filePath, cfg)
+	if err != nil {
+		return err
+	}
+	return staging.StoreFingerprints(ctx, shazam.Fingerprint(peaks, song.ID, cfg))
+}
+
+// SongAudio returns the path of the audio of song, along with the function
+// deleting it once it is used if it had to be downloaded again
+func SongAudio(ctx context.Context, songsDir string, song utils.Song) (string, func(), error) {
+	track := &Track{Title: song.Title, Artist: song.Artist, YouTubeID: song.YouTubeID, Source: song.Source, SourceURL: song.SourceURL}
+
+	// saveTrack keeps a WAV copy of every song it saves in songsDir
+	kept := trackFilePath(songsDir, track, ".wav")
+	if _, err := os.Stat(kept); err == nil {
+		return kept, func() {}, nil
+	}
+
+	// Songs from YouTube, including those found from Spotify, are
+	// downloaded from their video, those of other sources from their URL
+	var source AudioSource = &youtubeSource{}
+	if song.YouTubeID == "" {
+		if song.SourceURL == "" {
+			return "", nil, fmt.Errorf("no audio kept in %s and no source to download it from", songsDir)
+		}
+		var err error
+		if source, err = SourceFor(song.SourceURL); err != nil {
+			return "", nil, err
+		}
+		tracks, err := source.Resolve(ctx, song.SourceURL)
+		if err != nil {
+			return "", nil, fmt.Errorf("error resolving %s: %v", song.SourceURL, err)
+		}
+		if len(tracks) != 1 {
+			return "", nil, fmt.Errorf("%s no longer points at a single track", song.SourceURL)
+		}
+		resolved := tracks[0]
+		resolved.Title, resolved.Artist = song.Title, song.Artist
+		if err := source.Metadata(ctx, &resolved); err != nil {
+			return "", nil, err
+		}
+		track = &resolved
+	}
+
+	dir, err := os.MkdirTemp("tmp", "refingerprint")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	filePath, err := source.Download(ctx, track, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error downloading audio: %v", err)
+	}
+	return filePath, cleanup, nil
+}
+
+// swapFingerprints replaces the fingerprints of db with those of staging,
+// made with cfg, and returns how many there are. db can't be recognized
+// from until it is done.
+func swapFingerprints(ctx context.Context, db, staging utils.DBClient, cfg shazam.Config) (int, error) {
+	if err := shazam.MarkReindexing(ctx, db); err != nil {
+		return 0, err
+	}
+	if err := db.DeleteCollection(ctx, "fingerprints"); err != nil {
+		return 0, err
+	}
+
+	// StoreFingerprints takes a couple per address, so the couples of an
+	// address go to as many batches
+	var batches []map[uint32]models.Couple
+	pending, copied := 0, 0
+	flush := func() error {
+		for _, batch := range batches {
+			if err := db.StoreFingerprints(ctx, batch); err != nil {
+				return err
+			}
+		}
+		copied += pending
+		batches, pending = nil, 0
+		return nil
+	}
+
+	err := staging.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		for i, couple := range couples {
+			if i == len(batches) {
+				batches = append(batches, map[uint32]models.Couple{})
+			}
+			batches[i][address] = couple
+		}
+		pending += len(couples)
+		if pending >= refingerprintCopyBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return copied, err
+	}
+
+	if err := shazam.SaveConfig(ctx, db, cfg); err != nil {
+		return copied, fmt.Errorf("error storing fingerprint config: %v", err)
+	}
+	return copied, nil
+}
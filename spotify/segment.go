@@ -0,0 +1,80 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// MaxYTSegmentDuration is the longest part of a video DlYTSegment downloads
+const MaxYTSegmentDuration = 5 * time.Minute
+
+// IsYouTubeURL reports whether rawURL points at a YouTube video
+func IsYouTubeURL(rawURL string) bool {
+	_, err := youtube.ExtractVideoID(rawURL)
+	return err == nil
+}
+
+// DlYTSegment downloads the audio of a YouTube video between start and end
+// and decodes it. FFmpeg seeks in the stream, so only that part is fetched,
+// and the songs in a long mix or compilation can be recognized without
+// downloading all of it. Videos in the audio cache are cut from their
+// cached audio without downloading anything.
+func DlYTSegment(ctx context.Context, videoURL string, start, end time.Duration, savePath string) (*wav.Audio, error) {
+	ytID, err := youtube.ExtractVideoID(videoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid YouTube URL: %v", err)
+	}
+	if start < 0 || end <= start {
+		return nil, errors.New("segment end must be after its start")
+	}
+	if end-start > MaxYTSegmentDuration {
+		return nil, fmt.Errorf("segment can't be longer than %v", MaxYTSegmentDuration)
+	}
+
+	// A cached video is cut locally instead
+	input, cached := ytAudioCache.lookup(ctx, ytID)
+	if !cached {
+		release, err := ytDownloads.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		var duration time.Duration
+		if input, duration, err = ytStreamURL(ctx, ytID); err != nil {
+			return nil, err
+		}
+		if duration > 0 && start >= duration {
+			return nil, fmt.Errorf("segment starts after the end of the %v video", duration)
+		}
+	}
+
+	filePath := filepath.Join(savePath, fmt.Sprintf("%s_%d.wav", ytID, utils.GenerateUniqueID()))
+	defer utils.DeleteFile(filePath)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y",
+		"-ss", strconv.FormatFloat(start.Seconds(), 'f', 3, 64),
+		"-t", strconv.FormatFloat((end-start).Seconds(), 'f', 3, 64),
+		"-i", input,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(wav.CanonicalSampleRate), "-c:a", "pcm_s16le",
+		filePath,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to download YouTube segment: %v, output: %s", err, string(out))
+	}
+
+	audio, err := wav.DecodeFile(filePath)
+	if err == nil && cached && len(audio.Samples) == 0 {
+		return nil, errors.New("segment starts after the end of the video")
+	}
+	return audio, err
+}
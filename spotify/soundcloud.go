@@ -0,0 +1,196 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"song-recognition/utils"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// soundCloudAPI is the API used by the SoundCloud web player. It needs the
+// client ID of a SoundCloud app, set with SOUNDCLOUD_CLIENT_ID.
+const soundCloudAPI = "https://api-v2.soundcloud.com"
+
+var soundCloudClient = &http.Client{Timeout: 30 * time.Second}
+
+// soundCloudExtensions maps the MIME types of SoundCloud streams to the
+// extension of the file they are saved as
+var soundCloudExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/mp4":  ".m4a",
+}
+
+// IsSoundCloudURL reports whether rawURL points at SoundCloud
+func IsSoundCloudURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "soundcloud.com", "m.soundcloud.com", "on.soundcloud.com":
+		return true
+	}
+	return false
+}
+
+// soundCloudGet requests endpoint with the client ID and returns the body
+func soundCloudGet(endpoint, clientID string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("client_id", clientID)
+	u.RawQuery = query.Encode()
+
+	resp, err := soundCloudClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("SoundCloud returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// soundCloudTrackInfo resolves a SoundCloud track URL and returns the track
+// along with the URL and file extension of its audio stream
+func soundCloudTrackInfo(trackURL string) (*Track, string, string, error) {
+	clientID := utils.GetEnv("SOUNDCLOUD_CLIENT_ID")
+	if clientID == "" {
+		return nil, "", "", errors.New("SOUNDCLOUD_CLIENT_ID is not set")
+	}
+
+	// Short links redirect to the track page, which the API can resolve
+	if u, err := url.Parse(trackURL); err == nil && u.Hostname() == "on.soundcloud.com" {
+		resp, err := soundCloudClient.Get(trackURL)
+		if err != nil {
+			return nil, "", "", err
+		}
+		resp.Body.Close()
+		trackURL = resp.Request.URL.String()
+	}
+
+	info, err := soundCloudGet(soundCloudAPI+"/resolve?url="+url.QueryEscape(trackURL), clientID)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error resolving SoundCloud URL: %v", err)
+	}
+	if kind := gjson.Get(info, "kind").String(); kind != "track" {
+		return nil, "", "", fmt.Errorf("SoundCloud URL is a %s, not a track", kind)
+	}
+
+	track := &Track{
+		Title:     gjson.Get(info, "title").String(),
+		Artist:    gjson.Get(info, "publisher_metadata.artist").String(),
+		Album:     gjson.Get(info, "publisher_metadata.album_title").String(),
+		Duration:  int(math.Round(gjson.Get(info, "duration").Float() / 1000)),
+		Source:    utils.SourceSoundCloud,
+		SourceURL: gjson.Get(info, "permalink_url").String(),
+	}
+	if track.Artist == "" {
+		track.Artist = gjson.Get(info, "user.username").String()
+	}
+	if artwork := gjson.Get(info, "artwork_url").String(); artwork != "" {
+		// Artwork URLs point at the 100x100 version by default
+		track.CoverURL = strings.Replace(artwork, "-large.", "-t500x500.", 1)
+	}
+	for _, field := range []string{"release_date", "display_date", "created_at"} {
+		if date, err := time.Parse(time.RFC3339, gjson.Get(info, field).String()); err == nil {
+			track.ReleaseYear = date.Year()
+			break
+		}
+	}
+
+	// Prefer a progressive (single file) stream over HLS, and skip the 30
+	// second previews served for subscription-only tracks
+	var transcoding gjson.Result
+	var ext string
+	for _, t := range gjson.Get(info, "media.transcodings").Array() {
+		mimeType, _, _ := strings.Cut(t.Get("format.mime_type").String(), ";")
+		tExt, ok := soundCloudExtensions[mimeType]
+		if !ok || t.Get("snipped").Bool() {
+			continue
+		}
+		if !transcoding.Exists() || t.Get("format.protocol").String() == "progressive" {
+			transcoding, ext = t, tExt
+		}
+	}
+	if !transcoding.Exists() {
+		return nil, "", "", errors.New("SoundCloud track has no downloadable stream")
+	}
+
+	stream, err := soundCloudGet(transcoding.Get("url").String(), clientID)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error getting SoundCloud stream: %v", err)
+	}
+	streamURL := gjson.Get(stream, "url").String()
+	if streamURL == "" {
+		return nil, "", "", errors.New("SoundCloud returned no stream URL")
+	}
+
+	return track, streamURL, ext, nil
+}
+
+// soundCloudSource downloads the audio of SoundCloud tracks
+type soundCloudSource struct{}
+
+func (s *soundCloudSource) Name() string {
+	return "SoundCloud"
+}
+
+// Resolve returns the track rawURL points at, along with its stream
+func (s *soundCloudSource) Resolve(ctx context.Context, rawURL string) ([]Track, error) {
+	track, streamURL, ext, err := soundCloudTrackInfo(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	track.streamURL, track.streamExt = streamURL, ext
+	return []Track{*track}, nil
+}
+
+// Metadata does nothing, since SoundCloud resolves tracks with their details
+func (s *soundCloudSource) Metadata(ctx context.Context, track *Track) error {
+	return nil
+}
+
+func (s *soundCloudSource) Download(ctx context.Context, track *Track, dir string) (string, error) {
+	filePath := trackFilePath(dir, track, track.streamExt)
+
+	// FFmpeg handles both progressive and HLS streams
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", track.streamURL, "-vn", "-c", "copy", filePath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to download SoundCloud audio: %v, output: %s", err, string(out))
+	}
+
+	track.Provenance.Downloader = "ffmpeg"
+	track.Provenance.StreamURL = withoutQuery(track.streamURL)
+	return filePath, nil
+}
+
+// withoutQuery returns rawURL without its query and fragment
+func withoutQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
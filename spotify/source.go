@@ -0,0 +1,348 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"song-recognition/events"
+	"song-recognition/utils"
+	"strings"
+	"sync"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// AudioSource is a service songs can be downloaded from. Saving a song from
+// a source takes three steps: Resolve finds the tracks a URL points at,
+// Metadata completes the details of one of them, and Download fetches its
+// audio.
+type AudioSource interface {
+	// Name identifies the source in messages and logs
+	Name() string
+	// Resolve returns the tracks rawURL points at: one for a song, or all
+	// of those of a playlist, album or artist
+	Resolve(ctx context.Context, rawURL string) ([]Track, error)
+	// Metadata fills in the details of a resolved track that are needed to
+	// save it, such as its title, artist or the YouTube video its audio
+	// comes from. Details already set are kept.
+	Metadata(ctx context.Context, track *Track) error
+	// Download saves the audio of track in dir and returns the file path
+	Download(ctx context.Context, track *Track, dir string) (string, error)
+}
+
+// ErrUnsupportedURL is returned for URLs no registered source handles
+var ErrUnsupportedURL = errors.New("unsupported URL, expected a YouTube, SoundCloud, Spotify or MusicBrainz link")
+
+type registeredSource struct {
+	pattern *regexp.Regexp
+	source  AudioSource
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   []registeredSource
+)
+
+// RegisterAudioSource makes source handle the URLs that match pattern.
+// Sources are tried in the order they were registered.
+func RegisterAudioSource(pattern *regexp.Regexp, source AudioSource) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources = append(sources, registeredSource{pattern: pattern, source: source})
+}
+
+// SourceFor returns the source that handles rawURL, or ErrUnsupportedURL
+func SourceFor(rawURL string) (AudioSource, error) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	for _, registered := range sources {
+		if registered.pattern.MatchString(rawURL) {
+			return registered.source, nil
+		}
+	}
+	return nil, ErrUnsupportedURL
+}
+
+func init() {
+	// SoundCloud comes first, since its track URLs can contain "album" or "track"
+	RegisterAudioSource(regexp.MustCompile(`^https?://((www|m|on)\.)?soundcloud\.com/`), &soundCloudSource{})
+	RegisterAudioSource(regexp.MustCompile(`^https?://((www|m|music)\.)?(youtube\.com|youtu\.be)/`), &youtubeSource{})
+	RegisterAudioSource(regexp.MustCompile(`^https://open\.spotify\.com/(track|playlist|album|artist)/`), &spotifySource{})
+	RegisterAudioSource(musicBrainzReleasePattern, &musicBrainzSource{})
+}
+
+// DlSong downloads the song rawURL points at and saves it in the catalog
+// selected by ctx. Empty title or artist are taken from the source.
+func DlSong(ctx context.Context, rawURL, title, artist, savePath string) (*Track, error) {
+	source, err := SourceFor(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks, err := source.Resolve(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) != 1 {
+		return nil, fmt.Errorf("the %s URL points at %d songs, expected one", source.Name(), len(tracks))
+	}
+
+	track := tracks[0]
+	if title != "" {
+		track.Title = title
+	}
+	if artist != "" {
+		track.Artist = artist
+	}
+
+	if err := SaveTrack(ctx, source, &track, savePath); err != nil {
+		return nil, err
+	}
+	return &track, nil
+}
+
+// SaveTrack downloads a track resolved by source and saves it in the
+// catalog selected by ctx. The details found on the way are set on track.
+func SaveTrack(ctx context.Context, source AudioSource, track *Track, savePath string) error {
+	return saveTrack(ctx, source, track, savePath, nil)
+}
+
+// DlURL downloads every song rawURL points at, a single song or a whole
+// playlist or album, and saves them in the catalog selected by ctx. It
+// returns the number of songs saved.
+func DlURL(ctx context.Context, rawURL, savePath string, onStatus func(TrackStatus)) (int, error) {
+	source, err := SourceFor(rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	tracks, err := source.Resolve(ctx, rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(tracks) > 1 {
+		return DlPlaylist(ctx, source, rawURL, tracks, savePath, onStatus)
+	}
+	return DlTracks(ctx, source, tracks, savePath, onStatus)
+}
+
+// DlTracks downloads, fingerprints and saves the tracks resolved by source
+// in the catalog selected by ctx, a few at a time, and returns the number
+// of tracks saved. onStatus, if not nil, is called from the download
+// goroutines every time a track changes stage.
+func DlTracks(ctx context.Context, source AudioSource, tracks []Track, savePath string, onStatus func(TrackStatus)) (int, error) {
+	return dlTracks(ctx, source, tracks, savePath, onStatus, nil)
+}
+
+// DlPlaylist is DlTracks for the tracks of the playlist or album at rawURL.
+// The tracks saved and failed are remembered in the catalog until every
+// track is saved, so importing rawURL again after an interruption skips
+// the tracks already saved, and those that failed unless ctx was made with
+// WithRetryFailed.
+func DlPlaylist(ctx context.Context, source AudioSource, rawURL string, tracks []Track, savePath string, onStatus func(TrackStatus)) (int, error) {
+	progress, err := LoadImportProgress(ctx, rawURL)
+	if err != nil {
+		return 0, fmt.Errorf("error loading import progress: %v", err)
+	}
+	return dlTracks(ctx, source, tracks, savePath, onStatus, progress)
+}
+
+// dlTracks is DlTracks, recording the progress of the import in progress
+// unless it is nil
+func dlTracks(ctx context.Context, source AudioSource, tracks []Track, savePath string, onStatus func(TrackStatus), progress *ImportProgress) (int, error) {
+	var wg sync.WaitGroup
+	results := make(chan int, len(tracks))
+	semaphore := make(chan struct{}, runtime.NumCPU())
+
+	for _, t := range tracks {
+		wg.Add(1)
+		go func(track Track) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() {
+				<-semaphore
+			}()
+
+			// Tracks are reported under the title and artist they were
+			// resolved with, which saving may correct
+			title, artist := track.Title, track.Artist
+			report := func(stage, message string) {
+				if onStatus != nil {
+					onStatus(TrackStatus{Title: title, Artist: artist, Stage: stage, Message: message, YouTubeID: track.YouTubeID})
+				}
+			}
+
+			// Tracks not started yet are skipped once the job is cancelled
+			if ctx.Err() != nil {
+				report(StageFailed, "cancelled")
+				return
+			}
+
+			key := importTrackKey(track)
+			if progress != nil {
+				if reason := progress.Skip(key); reason != "" {
+					report(StageSkipped, reason)
+					return
+				}
+			}
+
+			err := saveTrack(ctx, source, &track, savePath, report)
+			var duplicate *DuplicateError
+			isDuplicate := errors.As(err, &duplicate)
+			saved := err == nil || isDuplicate
+			// Tracks stopped by a cancellation are neither saved nor failed
+			if progress != nil && (saved || ctx.Err() == nil) {
+				progress.Record(ctx, key, saved)
+			}
+
+			if isDuplicate {
+				if onStatus != nil {
+					onStatus(TrackStatus{
+						Title:     title,
+						Artist:    artist,
+						Stage:     StageSkipped,
+						Message:   "already indexed",
+						YouTubeID: duplicate.Song.YouTubeID,
+						Existing:  &duplicate.Song,
+					})
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			report(StageDone, "")
+			fmt.Printf("'%s' by '%s' was downloaded\n", title, artist)
+			results <- 1
+		}(t)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	totalTracks := 0
+	for range results {
+		totalTracks++
+	}
+
+	if progress != nil && ctx.Err() == nil {
+		keys := make([]string, len(tracks))
+		for i, track := range tracks {
+			keys[i] = importTrackKey(track)
+		}
+		progress.Finish(ctx, keys)
+	}
+
+	fmt.Println("Total tracks downloaded:", totalTracks)
+	return totalTracks, nil
+}
+
+// saveTrack completes the details of track with source, downloads its audio
+// to savePath, and fingerprints and saves it unless it is already indexed,
+// in which case it is only reindexed if ctx asks for it.
+// report, if not nil, is told every stage the track enters, and why it
+// failed.
+func saveTrack(ctx context.Context, source AudioSource, track *Track, savePath string, report func(stage, message string)) error {
+	logger := utils.GetLogger()
+	if report == nil {
+		report = func(stage, message string) {}
+	}
+	fail := func(message string, err error) error {
+		logMessage := fmt.Sprintf("'%s' by '%s' could not be saved: %s", track.Title, track.Artist, message)
+		logger.ErrorContext(ctx, logMessage, slog.String("source", source.Name()), slog.Any("error", xerrors.New(err)))
+		report(StageFailed, message)
+		return err
+	}
+
+	// Look for the song with what the source resolved first, to avoid
+	// looking up details of a song that is already indexed
+	existing, err := findTrackDuplicate(ctx, track)
+	if err != nil {
+		return fail("error checking song existence", err)
+	}
+	if existing != nil && !Reindexing(ctx) {
+		return &DuplicateError{Song: *existing}
+	}
+
+	report(StageSearching, "")
+	if err := source.Metadata(ctx, track); err != nil {
+		return fail(err.Error(), err)
+	}
+	if track.Title == "" || track.Artist == "" {
+		return fail("no title or artist found", errors.New("no title or artist found"))
+	}
+
+	existing, err = findTrackDuplicate(ctx, track)
+	if err != nil {
+		return fail("error checking song existence", err)
+	}
+	if existing != nil && !Reindexing(ctx) {
+		return &DuplicateError{Song: *existing}
+	}
+
+	track.Title, track.Artist = correctFilename(track.Title, track.Artist)
+
+	report(StageDownloading, "")
+	reportStage(ctx, StageDownloading)
+	filePath, err := source.Download(ctx, track, savePath)
+	if err != nil {
+		return fail("download failed", err)
+	}
+	events.Emit(ctx, events.SongDownloaded, events.Download{
+		Title:     track.Title,
+		Artist:    track.Artist,
+		Source:    source.Name(),
+		SourceURL: track.SourceURL,
+	})
+
+	report(StageFingerprinting, "")
+	if existing != nil {
+		err = ReindexSong(ctx, filePath, *existing)
+	} else {
+		err = ProcessAndSaveSong(ctx, filePath, track.Title, track.Artist, track.YouTubeID, track.Metadata())
+	}
+	if err != nil {
+		return fail("fingerprinting failed", err)
+	}
+
+	utils.DeleteFile(filePath)
+
+	wavFilePath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".wav"
+	if err := addTags(wavFilePath, *track); err != nil {
+		return fail("failed to tag song file", err)
+	}
+
+	if DELETE_SONG_FILE {
+		utils.DeleteFile(wavFilePath)
+	}
+
+	return nil
+}
+
+// findTrackDuplicate returns the song of the catalog selected by ctx that
+// track duplicates, if any. The database isn't kept open while the track is
+// saved, since some backends only allow one connection at a time.
+func findTrackDuplicate(ctx context.Context, track *Track) (*utils.Song, error) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return FindDuplicate(ctx, db, track.Title, track.Artist, track.YouTubeID)
+}
+
+// trackFilePath returns the path track is downloaded to in dir, with the
+// given extension
+func trackFilePath(dir string, track *Track, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s - %s", track.Title, track.Artist)+ext)
+}
@@ -1,15 +1,20 @@
 package spotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"net/http"
 	"regexp"
+	"song-recognition/utils"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mdobak/go-xerrors"
 	"github.com/tidwall/gjson"
 )
 
@@ -22,6 +27,37 @@ type Track struct {
 	Title, Artist, Album string
 	Artists              []string
 	Duration             int
+	ReleaseYear          int
+	CoverURL             string
+	Source, SourceURL    string
+	// RecordingMBID and ReleaseMBID identify the track and its album on
+	// MusicBrainz, if it was imported from there
+	RecordingMBID, ReleaseMBID string
+	// YouTubeID is the video the audio of the track is downloaded from, if
+	// it comes from YouTube
+	YouTubeID string
+	// Provenance records how the audio was obtained. Sources set it when
+	// they download the track.
+	Provenance utils.SongProvenance
+
+	// streamURL and streamExt are the audio stream of a SoundCloud track
+	// and the extension of the file it is saved as
+	streamURL, streamExt string
+}
+
+// Metadata returns the details of the track stored with its song
+func (t *Track) Metadata() utils.SongMetadata {
+	return utils.SongMetadata{
+		Album:         t.Album,
+		Duration:      t.Duration,
+		ReleaseYear:   t.ReleaseYear,
+		CoverURL:      t.CoverURL,
+		Source:        t.Source,
+		SourceURL:     t.SourceURL,
+		Provenance:    t.Provenance,
+		RecordingMBID: t.RecordingMBID,
+		ReleaseMBID:   t.ReleaseMBID,
+	}
 }
 
 const (
@@ -127,11 +163,13 @@ func TrackInfo(url string) (*Track, error) {
 	durationInSeconds = durationInSeconds / 1000
 
 	track := &Track{
-		Title:    gjson.Get(jsonResponse, "data.trackUnion.name").String(),
-		Artist:   gjson.Get(jsonResponse, "data.trackUnion.firstArtist.items.0.profile.name").String(),
-		Artists:  allArtists,
-		Duration: durationInSeconds,
-		Album:    gjson.Get(jsonResponse, "data.trackUnion.albumOfTrack.name").String(),
+		Title:       gjson.Get(jsonResponse, "data.trackUnion.name").String(),
+		Artist:      gjson.Get(jsonResponse, "data.trackUnion.firstArtist.items.0.profile.name").String(),
+		Artists:     allArtists,
+		Duration:    durationInSeconds,
+		Album:       gjson.Get(jsonResponse, "data.trackUnion.albumOfTrack.name").String(),
+		ReleaseYear: int(gjson.Get(jsonResponse, "data.trackUnion.albumOfTrack.date.year").Int()),
+		CoverURL:    gjson.Get(jsonResponse, "data.trackUnion.albumOfTrack.coverArt.sources.0.url").String(),
 	}
 
 	return track.buildTrack(), nil
@@ -232,11 +270,13 @@ func jsonList(resourceType, id string, offset, limit int64) (string, error) {
 
 func (t *Track) buildTrack() *Track {
 	track := &Track{
-		Title:    t.Title,
-		Artist:   t.Artist,
-		Artists:  t.Artists,
-		Duration: t.Duration,
-		Album:    t.Album,
+		Title:       t.Title,
+		Artist:      t.Artist,
+		Artists:     t.Artists,
+		Duration:    t.Duration,
+		Album:       t.Album,
+		ReleaseYear: t.ReleaseYear,
+		CoverURL:    t.CoverURL,
 	}
 
 	return track
@@ -253,6 +293,8 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 	artistName := map[bool]string{true: "itemV2.data.artists.items.0.profile.name", false: "track.artists.items.0.profile.name"}[resourceType == "playlist"]
 	albumName := map[bool]string{true: "itemV2.data.albumOfTrack.name", false: "data.albumUnion.name"}[resourceType == "playlist"]
 	duration := map[bool]string{true: "itemV2.data.trackDuration.totalMilliseconds", false: "track.duration.totalMilliseconds"}[resourceType == "playlist"]
+	releaseYear := map[bool]string{true: "itemV2.data.albumOfTrack.date.year", false: "data.albumUnion.date.isoString"}[resourceType == "playlist"]
+	coverURL := map[bool]string{true: "itemV2.data.albumOfTrack.coverArt.sources.0.url", false: "data.albumUnion.coverArt.sources.0.url"}[resourceType == "playlist"]
 
 	var tracks []Track
 	items := gjson.Get(jsonResponse, itemList).Array()
@@ -266,8 +308,70 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 			Duration: durationInSeconds,
 			Album:    map[bool]string{true: item.Get(albumName).String(), false: gjson.Get(jsonResponse, albumName).String()}[resourceType == "playlist"],
 		}
+		if resourceType == "playlist" {
+			track.ReleaseYear = int(item.Get(releaseYear).Int())
+			track.CoverURL = item.Get(coverURL).String()
+		} else {
+			// Album dates are ISO strings such as 2019-05-17T00:00:00Z
+			if date := gjson.Get(jsonResponse, releaseYear).String(); len(date) >= 4 {
+				track.ReleaseYear, _ = strconv.Atoi(date[:4])
+			}
+			track.CoverURL = gjson.Get(jsonResponse, coverURL).String()
+		}
 		tracks = append(tracks, *track.buildTrack())
 	}
 
 	return tracks
 }
+
+// spotifySource downloads Spotify tracks, playlists, albums and artists.
+// Spotify only provides their details; the audio of each track is
+// downloaded from the YouTube video that matches it best.
+type spotifySource struct{}
+
+func (s *spotifySource) Name() string {
+	return "Spotify"
+}
+
+func (s *spotifySource) Resolve(ctx context.Context, rawURL string) ([]Track, error) {
+	switch {
+	case strings.Contains(rawURL, "/album/"):
+		return AlbumInfo(rawURL)
+	case strings.Contains(rawURL, "/playlist/"):
+		return PlaylistInfo(rawURL)
+	case strings.Contains(rawURL, "/artist/"):
+		return spotifyArtistTracks(ctx, rawURL)
+	default:
+		track, err := TrackInfo(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return []Track{*track}, nil
+	}
+}
+
+// Metadata finds the YouTube video of track
+func (s *spotifySource) Metadata(ctx context.Context, track *Track) error {
+	ytID, err := getYTID(ctx, track)
+	if ytID == "" || err != nil {
+		if err != nil {
+			logger := utils.GetLogger()
+			logger.ErrorContext(ctx, "failed to find YouTube video.", slog.Any("error", xerrors.New(err)))
+		}
+		return errors.New("no matching YouTube video found")
+	}
+
+	track.YouTubeID = ytID
+	track.Source, track.SourceURL = utils.SourceYouTube, youtubeURL(ytID)
+	return nil
+}
+
+func (s *spotifySource) Download(ctx context.Context, track *Track, dir string) (string, error) {
+	filePath := trackFilePath(dir, track, ".m4a")
+	downloader, err := downloadYTaudio(ctx, track.YouTubeID, dir, filePath)
+	if err != nil {
+		return "", err
+	}
+	track.Provenance.Downloader = downloader
+	return filePath, nil
+}
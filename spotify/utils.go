@@ -1,6 +1,7 @@
 package spotify
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -39,29 +40,14 @@ func GetFileSize(file string) (int64, error) {
 	return size, nil
 }
 
-func SongKeyExists(key string) (bool, error) {
-	db, err := utils.NewDbClient()
+func YtIDExists(ctx context.Context, ytID string) (bool, error) {
+	db, err := utils.NewCatalogDBClient(utils.CatalogFromContext(ctx))
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 
-	_, songExists, err := db.GetSongByKey(key)
-	if err != nil {
-		return false, err
-	}
-
-	return songExists, nil
-}
-
-func YtIDExists(ytID string) (bool, error) {
-	db, err := utils.NewDbClient()
-	if err != nil {
-		return false, err
-	}
-	defer db.Close()
-
-	_, songExits, err := db.GetSongByYTID(ytID)
+	_, songExits, err := db.GetSongByYTID(ctx, ytID)
 	if err != nil {
 		return false, err
 	}
@@ -3,7 +3,6 @@ package spotify
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"errors"
 	"io"
@@ -24,8 +23,7 @@ const developerKey = ""
 func getYoutubeIdWithAPI(spTrack Track) (string, error) {
 	service, err := youtube.NewService(context.TODO(), option.WithAPIKey(developerKey))
 	if err != nil {
-		log.Fatalf("Error creating new YouTube client: %v", err)
-		return "", err
+		return "", fmt.Errorf("error creating new YouTube client: %v", err)
 	}
 
 	// Video category ID 10 is for music videos
@@ -34,8 +32,7 @@ func getYoutubeIdWithAPI(spTrack Track) (string, error) {
 
 	response, err := call.Do()
 	if err != nil {
-		log.Fatalf("Error making search API call: %v", err)
-		return "", err
+		return "", fmt.Errorf("error making search API call: %v", err)
 	}
 	for _, item := range response.Items {
 		switch item.Id.Kind {
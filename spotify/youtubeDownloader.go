@@ -0,0 +1,368 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+	"github.com/mdobak/go-xerrors"
+)
+
+// YouTubeDownloader fetches the audio of YouTube videos. Downloads are
+// tried with every downloader of YOUTUBE_DOWNLOADERS in turn until one
+// succeeds, so a downloader broken by a change of YouTube or of its own
+// output doesn't stop imports.
+type YouTubeDownloader interface {
+	// Name identifies the downloader in YOUTUBE_DOWNLOADERS and logs
+	Name() string
+	// Version is recorded in the provenance of the songs it downloads, ""
+	// if it is unknown
+	Version(ctx context.Context) string
+	// Download saves the audio of a video to filePath, an .m4a file
+	Download(ctx context.Context, ytID, filePath string) error
+	// StreamURL returns the URL of the audio stream of a video, for FFmpeg
+	// to read part of, and the duration of the video, 0 if it is unknown
+	StreamURL(ctx context.Context, ytID string) (string, time.Duration, error)
+}
+
+var (
+	youtubeDownloadersMu sync.RWMutex
+	youtubeDownloaders   = map[string]YouTubeDownloader{}
+)
+
+// RegisterYouTubeDownloader makes downloader available to
+// YOUTUBE_DOWNLOADERS under its name
+func RegisterYouTubeDownloader(downloader YouTubeDownloader) {
+	youtubeDownloadersMu.Lock()
+	defer youtubeDownloadersMu.Unlock()
+	youtubeDownloaders[downloader.Name()] = downloader
+}
+
+func init() {
+	RegisterYouTubeDownloader(&nativeYTDownloader{})
+	RegisterYouTubeDownloader(&ytdlpDownloader{path: utils.GetEnv("YTDLP_PATH", "yt-dlp")})
+}
+
+// ytDownloads limits the downloads from YouTube of the process, so that
+// bulk imports don't get throttled
+var ytDownloads = newYTLimiterFromEnv()
+
+func newYTLimiterFromEnv() *ytLimiter {
+	concurrency, err := strconv.Atoi(utils.GetEnv("YOUTUBE_CONCURRENCY", "2"))
+	if err != nil || concurrency <= 0 {
+		concurrency = 2
+	}
+	interval, err := time.ParseDuration(utils.GetEnv("YOUTUBE_DOWNLOAD_INTERVAL", "1s"))
+	if err != nil || interval < 0 {
+		interval = time.Second
+	}
+	return &ytLimiter{slots: make(chan struct{}, concurrency), interval: interval}
+}
+
+// ytLimiter lets a limited number of downloads run at a time, and starts
+// them at least interval apart
+type ytLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // when the next download may start
+}
+
+// acquire waits for the turn of a download, and returns the function to
+// call once it is done
+func (l *ytLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-l.slots }
+
+	l.mu.Lock()
+	start := time.Now()
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(start)):
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// activeYTDownloaders returns the downloaders of YOUTUBE_DOWNLOADERS in
+// order, skipping unknown ones
+func activeYTDownloaders(ctx context.Context) []YouTubeDownloader {
+	youtubeDownloadersMu.RLock()
+	defer youtubeDownloadersMu.RUnlock()
+
+	var active []YouTubeDownloader
+	for _, name := range strings.Split(utils.GetEnv("YOUTUBE_DOWNLOADERS", "native,yt-dlp"), ",") {
+		name = strings.TrimSpace(name)
+		if downloader, ok := youtubeDownloaders[name]; ok {
+			active = append(active, downloader)
+		} else if name != "" {
+			logger := utils.GetLogger()
+			logger.WarnContext(ctx, "unknown YouTube downloader.", slog.String("downloader", name))
+		}
+	}
+	if len(active) == 0 {
+		active = append(active, youtubeDownloaders["native"])
+	}
+	return active
+}
+
+// downloadYTaudio saves the audio of a video to filePath, from the audio
+// cache if it is there, and returns the downloader that fetched it, with
+// its version
+func downloadYTaudio(ctx context.Context, id, path, filePath string) (string, error) {
+	dir, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+
+	if !dir.IsDir() {
+		return "", errors.New("the path is not valid (not a dir)")
+	}
+
+	if cached, err := ytAudioCache.copyTo(ctx, id, filePath); cached || err != nil {
+		return "audio cache", err
+	}
+
+	release, err := ytDownloads.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	var used string
+	err = tryYTDownloaders(ctx, func(downloader YouTubeDownloader) error {
+		err := downloader.Download(ctx, id, filePath)
+		if err != nil {
+			utils.DeleteFile(filePath)
+			return err
+		}
+		used = downloader.Name()
+		if version := downloader.Version(ctx); version != "" {
+			used += " " + version
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ytAudioCache.add(ctx, id, filePath)
+	return used, nil
+}
+
+// ytStreamURL returns the URL of the audio stream of a video and its
+// duration, from the first downloader that finds them
+func ytStreamURL(ctx context.Context, ytID string) (string, time.Duration, error) {
+	var streamURL string
+	var duration time.Duration
+	err := tryYTDownloaders(ctx, func(downloader YouTubeDownloader) error {
+		var err error
+		streamURL, duration, err = downloader.StreamURL(ctx, ytID)
+		return err
+	})
+	return streamURL, duration, err
+}
+
+// tryYTDownloaders calls fn with every active downloader until it succeeds
+func tryYTDownloaders(ctx context.Context, fn func(YouTubeDownloader) error) error {
+	logger := utils.GetLogger()
+	var failures []string
+
+	for _, downloader := range activeYTDownloaders(ctx) {
+		err := fn(downloader)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger.WarnContext(ctx, "YouTube downloader failed.", slog.String("downloader", downloader.Name()), slog.Any("error", xerrors.New(err)))
+		failures = append(failures, fmt.Sprintf("%s: %v", downloader.Name(), err))
+	}
+	return fmt.Errorf("every YouTube downloader failed: %s", strings.Join(failures, "; "))
+}
+
+// nativeYTDownloader downloads videos with github.com/kkdai/youtube, so it
+// needs no other program
+type nativeYTDownloader struct{}
+
+func (d *nativeYTDownloader) Name() string {
+	return "native"
+}
+
+// Version returns the version of the module the binary was built with
+func (d *nativeYTDownloader) Version(ctx context.Context) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/kkdai/youtube/v2" {
+			return "kkdai/youtube " + dep.Version
+		}
+	}
+	return ""
+}
+
+func (d *nativeYTDownloader) Download(ctx context.Context, ytID, filePath string) error {
+	client := youtube.Client{}
+	video, err := client.GetVideoContext(ctx, ytID)
+	if err != nil {
+		return err
+	}
+
+	/*
+		itag code: 140, container: m4a, content: audio, bitrate: 128k
+		change the FindByItag parameter to 139 if you want smaller files (but with a bitrate of 48k)
+		https://gist.github.com/sidneys/7095afe4da4ae58694d128b1034e01e2
+	*/
+	formats := video.Formats.Itag(140)
+	if len(formats) == 0 {
+		return errors.New("video has no m4a audio stream")
+	}
+
+	/* in some cases, when attempting to download the audio
+	using the library github.com/kkdai/youtube,
+	the download fails (and shows the file size as 0 bytes)
+	until the second or third attempt. */
+	var fileSize int64
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for fileSize == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		stream, _, err := client.GetStreamContext(ctx, video, &formats[0])
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, stream)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+
+		fileSize, _ = GetFileSize(filePath)
+	}
+
+	return nil
+}
+
+func (d *nativeYTDownloader) StreamURL(ctx context.Context, ytID string) (string, time.Duration, error) {
+	client := youtube.Client{}
+	video, err := client.GetVideoContext(ctx, ytID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Same format as Download, falling back to any stream with audio
+	formats := video.Formats.Itag(140)
+	if len(formats) == 0 {
+		formats = video.Formats.WithAudioChannels()
+	}
+	if len(formats) == 0 {
+		return "", 0, errors.New("video has no audio stream")
+	}
+
+	streamURL, err := client.GetStreamURLContext(ctx, video, &formats[0])
+	return streamURL, video.Duration, err
+}
+
+// ytdlpDownloader downloads videos with the yt-dlp program at path, which
+// keeps up with YouTube changes faster but must be installed
+type ytdlpDownloader struct {
+	path string
+
+	versionOnce sync.Once
+	version     string
+}
+
+func (d *ytdlpDownloader) Name() string {
+	return "yt-dlp"
+}
+
+// Version asks yt-dlp its version, once per process
+func (d *ytdlpDownloader) Version(ctx context.Context) string {
+	d.versionOnce.Do(func() {
+		if out, err := exec.CommandContext(ctx, d.path, "--version").Output(); err == nil {
+			d.version = strings.TrimSpace(string(out))
+		}
+	})
+	return d.version
+}
+
+func (d *ytdlpDownloader) Download(ctx context.Context, ytID, filePath string) error {
+	// yt-dlp names the file after the format it extracts the audio to
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	_, err := d.run(ctx, "-f", "140/bestaudio[ext=m4a]/bestaudio", "-x", "--audio-format", "m4a",
+		"-o", base+".%(ext)s", "--", youtubeURL(ytID))
+	if err != nil {
+		return err
+	}
+	if base+".m4a" != filePath {
+		return os.Rename(base+".m4a", filePath)
+	}
+	return nil
+}
+
+func (d *ytdlpDownloader) StreamURL(ctx context.Context, ytID string) (string, time.Duration, error) {
+	out, err := d.run(ctx, "-f", "140/bestaudio", "--print", "duration", "--print", "urls", "--", youtubeURL(ytID))
+	if err != nil {
+		return "", 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return "", 0, fmt.Errorf("unexpected yt-dlp output: %s", out)
+	}
+	// Live streams have no duration
+	var duration time.Duration
+	if seconds, err := strconv.ParseFloat(lines[0], 64); err == nil {
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	return lines[1], duration, nil
+}
+
+// run runs yt-dlp with args and returns its output
+func (d *ytdlpDownloader) run(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"--quiet", "--no-warnings", "--no-playlist"}, args...)
+	cmd := exec.CommandContext(ctx, d.path, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("yt-dlp failed: %v, output: %s", err, stderr.String())
+	}
+	return string(out), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"song-recognition/events"
+	"song-recognition/protocol"
+	"song-recognition/utils"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so that
+// proxies don't close it
+const sseKeepAlive = 15 * time.Second
+
+// sseShutdown is closed when the HTTP server shuts down, which ends the
+// event streams of requests. Those of jobs end with their job.
+var (
+	sseShutdown     = make(chan struct{})
+	sseShutdownOnce sync.Once
+)
+
+// closeEventStreams ends the event streams of requests
+func closeEventStreams() {
+	sseShutdownOnce.Do(func() { close(sseShutdown) })
+}
+
+// publishRecognition publishes the matches of a recognition under the
+// request ID of ctx, for the clients following it. Only final matches end
+// their event stream.
+func publishRecognition(ctx context.Context, msgType string, payload interface{}, final bool) {
+	events.Publish(events.Event{
+		Topic:   events.RequestTopic(utils.CatalogFromContext(ctx), utils.RequestIDFromContext(ctx)),
+		Type:    msgType,
+		Payload: payload,
+		Final:   final,
+	})
+}
+
+// handleAPIEvents serves GET /api/events, a Server-Sent Events stream for
+// clients that can't hold a socket. With the "jobId" query value, it sends
+// the job's status as a "jobStatus" event, then every change of it until it
+// ends. With "requestId", it sends the matches of the recognition made by
+// the request with that X-Request-ID from then on as a "matches" event,
+// after which the stream ends. Event data is the JSON payload of the
+// protocol message of the same type.
+func handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx := r.Context()
+	jobID, requestID := r.URL.Query().Get("jobId"), r.URL.Query().Get("requestId")
+	if (jobID == "") == (requestID == "") {
+		writeJSONError(w, http.StatusBadRequest, "set either jobId or requestId")
+		return
+	}
+
+	var subscription *events.Subscription
+	var first *events.Event
+	shutdown := sseShutdown
+	if jobID != "" {
+		job, jobSubscription, ok := ingest.subscribe(jobID)
+		if ok && job.Catalog != utils.CatalogFromContext(ctx) {
+			jobSubscription.Close()
+			ok = false
+		}
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		subscription = jobSubscription
+		first = &events.Event{Type: protocol.TypeJobStatus, Payload: job.JobStatus, Final: job.Finished != nil}
+		// Shutdown waits for jobs, so their streams get their last status
+		shutdown = nil
+	} else {
+		subscription = events.Subscribe(events.RequestTopic(utils.CatalogFromContext(ctx), requestID))
+	}
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	if err := flusher.Flush(); err != nil {
+		return
+	}
+
+	if first != nil {
+		if !writeSSEEvent(ctx, w, flusher, *first) || first.Final {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-subscription.C:
+			if !writeSSEEvent(ctx, w, flusher, event) || event.Final {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || flusher.Flush() != nil {
+				return
+			}
+		case <-shutdown:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeSSEEvent writes event to an event stream, and reports whether the
+// client can still be written to
+func writeSSEEvent(ctx context.Context, w http.ResponseWriter, flusher *http.ResponseController, event events.Event) bool {
+	jsonData, err := json.Marshal(event.Payload)
+	if err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(ctx, "failed to marshal event.", slog.String("type", event.Type), slog.Any("error", xerrors.New(err)))
+		return true
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, jsonData); err != nil {
+		return false
+	}
+	return flusher.Flush() == nil
+}
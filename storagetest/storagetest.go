@@ -0,0 +1,785 @@
+// Package storagetest checks that a storage backend behaves the way the
+// rest of the server expects of every utils.DBClient, in the manner of
+// testing/fstest, so that new backends can be verified and the differences
+// between existing ones are caught.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collections are the collections DeleteCollection empties between checks
+var collections = []string{"fingerprints", "songs", "settings", "recognitions", "airplay"}
+
+// check is a behavior expected of every backend
+type check struct {
+	name string
+	run  func(ctx context.Context, db utils.DBClient) error
+}
+
+var checks = []check{
+	{"empty catalog", checkEmpty},
+	{"songs", checkSongs},
+	{"unique songs", checkUniqueSongs},
+	{"shared addresses", checkSharedAddresses},
+	{"listing songs", checkListSongs},
+	{"deleting songs", checkDeleteSongs},
+	{"deleting fingerprints", checkDeleteFingerprints},
+	{"settings", checkSettings},
+	{"API keys", checkAPIKeys},
+	{"recognitions", checkRecognitions},
+	{"airplays", checkAirplays},
+	{"collections", checkCollections},
+	{"canceled context", checkCanceled},
+	{"concurrent access", checkConcurrency},
+}
+
+// Check runs every check against db, which must be the client of an empty
+// catalog, and returns the failures, naming the checks that found them.
+// The catalog is emptied after every check, so it can't hold data that
+// matters.
+func Check(ctx context.Context, db utils.DBClient) error {
+	total, err := db.TotalSongs(ctx)
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return fmt.Errorf("the catalog holds %d songs, checks need an empty one", total)
+	}
+
+	var errs []error
+	for _, c := range checks {
+		if err := c.run(ctx, db); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", c.name, err))
+		}
+		if err := empty(ctx, db); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run runs every check as a subtest of t, each against a client newDB
+// returns, so that go test checks a backend. The clients must be of an
+// empty catalog, which is emptied after every check.
+func Run(t *testing.T, newDB func() utils.DBClient) {
+	ctx := context.Background()
+
+	db := newDB()
+	total, err := db.TotalSongs(ctx)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total > 0 {
+		t.Fatalf("the catalog holds %d songs, checks need an empty one", total)
+	}
+
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			db := newDB()
+			defer db.Close()
+
+			if err := c.run(ctx, db); err != nil {
+				t.Error(err)
+			}
+			if err := empty(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Checks returns the names of the checks Check runs, in order
+func Checks() []string {
+	names := make([]string, len(checks))
+	for i, c := range checks {
+		names[i] = c.name
+	}
+	return names
+}
+
+// empty deletes everything the checks stored
+func empty(ctx context.Context, db utils.DBClient) error {
+	for _, collection := range collections {
+		if err := db.DeleteCollection(ctx, collection); err != nil {
+			return fmt.Errorf("error emptying %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// register registers a song with a couple at every address of addresses
+func register(ctx context.Context, db utils.DBClient, title, artist, ytID string, addresses ...uint32) (uint32, error) {
+	return db.RegisterSongWithFingerprints(ctx, title, artist, ytID, utils.SongMetadata{}, func(songID uint32) map[uint32]models.Couple {
+		fingerprints := make(map[uint32]models.Couple, len(addresses))
+		for i, address := range addresses {
+			fingerprints[address] = models.Couple{SongID: songID, AnchorTimeMs: uint32(i * 100)}
+		}
+		return fingerprints
+	})
+}
+
+// sortCouples sorts couples by song and anchor time, since backends return
+// them in any order
+func sortCouples(couples []models.Couple) []models.Couple {
+	sort.Slice(couples, func(i, j int) bool {
+		if couples[i].SongID != couples[j].SongID {
+			return couples[i].SongID < couples[j].SongID
+		}
+		return couples[i].AnchorTimeMs < couples[j].AnchorTimeMs
+	})
+	return couples
+}
+
+func sameCouples(got, want []models.Couple) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	got, want = sortCouples(append([]models.Couple(nil), got...)), sortCouples(append([]models.Couple(nil), want...))
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTime reports whether two times are equal to the millisecond, the
+// precision every backend keeps
+func sameTime(a, b time.Time) bool {
+	return a.UnixMilli() == b.UnixMilli()
+}
+
+func checkEmpty(ctx context.Context, db utils.DBClient) error {
+	couples, err := db.GetCouples(ctx, []uint32{1, 2, 3})
+	if err != nil {
+		return err
+	}
+	if len(couples) != 0 {
+		return fmt.Errorf("GetCouples of unknown addresses returned %v, want no addresses", couples)
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, utils.SortByID)
+	if err != nil {
+		return err
+	}
+	if songs == nil || len(songs) != 0 {
+		return fmt.Errorf("ListSongs returned %v, want an empty list", songs)
+	}
+
+	if _, found, err := db.GetSongByID(ctx, 12345); err != nil || found {
+		return fmt.Errorf("GetSongByID of an unknown song returned found %v, error %v", found, err)
+	}
+	if _, found, err := db.GetSongByYTID(ctx, ""); err != nil || found {
+		return fmt.Errorf("GetSongByYTID of an empty ID returned found %v, error %v", found, err)
+	}
+	return nil
+}
+
+func checkSongs(ctx context.Context, db utils.DBClient) error {
+	meta := utils.SongMetadata{
+		Album:       "Album",
+		Duration:    215,
+		ReleaseYear: 1999,
+		CoverURL:    "https://example.com/cover.jpg",
+		Source:      utils.SourceFile,
+		SourceURL:   "https://example.com/song",
+		Provenance: utils.SongProvenance{
+			FileName:   "song.mp3",
+			IngestedAt: time.Now().UTC(),
+		},
+		RecordingMBID: "b1a9c0e9-d987-4042-ae91-78d6a3267d69",
+		ReleaseMBID:   "f4a31f0a-51dd-4fa7-986d-3095c40c5ed9",
+	}
+	songID, err := db.RegisterSongWithFingerprints(ctx, "Title", "Artist", "ytid0000001", meta, func(songID uint32) map[uint32]models.Couple {
+		return map[uint32]models.Couple{10: {SongID: songID, AnchorTimeMs: 100}, 20: {SongID: songID, AnchorTimeMs: 200}}
+	})
+	if err != nil {
+		return err
+	}
+
+	lookups := []struct {
+		name   string
+		lookup func() (utils.Song, bool, error)
+	}{
+		{"GetSongByID", func() (utils.Song, bool, error) { return db.GetSongByID(ctx, songID) }},
+		{"GetSongByYTID", func() (utils.Song, bool, error) { return db.GetSongByYTID(ctx, "ytid0000001") }},
+		{"GetSongByKey", func() (utils.Song, bool, error) {
+			return db.GetSongByKey(ctx, utils.GenerateSongKey("Title", "Artist"))
+		}},
+	}
+	for _, l := range lookups {
+		song, found, err := l.lookup()
+		if err != nil || !found {
+			return fmt.Errorf("%s returned found %v, error %v", l.name, found, err)
+		}
+		if song.ID != songID || song.Title != "Title" || song.Artist != "Artist" || song.YouTubeID != "ytid0000001" {
+			return fmt.Errorf("%s returned %+v", l.name, song)
+		}
+		got, want := song.SongMetadata, meta
+		if got.Album != want.Album || got.Duration != want.Duration || got.ReleaseYear != want.ReleaseYear ||
+			got.CoverURL != want.CoverURL || got.Source != want.Source || got.SourceURL != want.SourceURL ||
+			got.Provenance.FileName != want.Provenance.FileName || !sameTime(got.Provenance.IngestedAt, want.Provenance.IngestedAt) ||
+			got.RecordingMBID != want.RecordingMBID || got.ReleaseMBID != want.ReleaseMBID {
+			return fmt.Errorf("%s returned metadata %+v, want %+v", l.name, got, want)
+		}
+	}
+
+	// A song saved without a YouTube ID isn't found by an empty one
+	if _, err := register(ctx, db, "No ID", "Artist", "", 30); err != nil {
+		return err
+	}
+	if _, found, err := db.GetSongByYTID(ctx, ""); err != nil || found {
+		return fmt.Errorf("GetSongByYTID of an empty ID returned found %v, error %v", found, err)
+	}
+
+	// Titles and artists can hold the "---" separating them in song keys
+	delimited, err := register(ctx, db, "Intro---Outro", "Artist---Band", "", 40)
+	if err != nil {
+		return err
+	}
+	song, found, err := db.GetSongByID(ctx, delimited)
+	if err != nil || !found || song.Title != "Intro---Outro" || song.Artist != "Artist---Band" {
+		return fmt.Errorf("GetSongByID of a title holding the key separator returned %+v, found %v, error %v", song, found, err)
+	}
+
+	if total, err := db.TotalSongs(ctx); err != nil || total != 3 {
+		return fmt.Errorf("TotalSongs returned %d, error %v, want 3", total, err)
+	}
+	if total, err := db.TotalFingerprints(ctx); err != nil || total != 4 {
+		return fmt.Errorf("TotalFingerprints returned %d, error %v, want 4", total, err)
+	}
+	if count, err := db.FingerprintCountBySong(ctx, songID); err != nil || count != 2 {
+		return fmt.Errorf("FingerprintCountBySong returned %d, error %v, want 2", count, err)
+	}
+	return nil
+}
+
+func checkUniqueSongs(ctx context.Context, db utils.DBClient) error {
+	if _, err := register(ctx, db, "Title", "Artist", "ytid0000001", 1); err != nil {
+		return err
+	}
+	if _, err := register(ctx, db, "Title", "Artist", "ytid0000001", 2); err == nil {
+		return errors.New("registering the same song twice succeeded")
+	}
+	if _, err := db.RegisterSong(ctx, "Title", "Artist", "ytid0000001", utils.SongMetadata{}); err == nil {
+		return errors.New("registering the same song twice without fingerprints succeeded")
+	}
+
+	// The failed registration must not leave its fingerprints behind
+	if couples, err := db.GetCouples(ctx, []uint32{2}); err != nil || len(couples) != 0 {
+		return fmt.Errorf("the fingerprints of a duplicate song were kept: %v, error %v", couples, err)
+	}
+
+	// Songs whose title and artist only join the same way aren't the same
+	if _, err := register(ctx, db, "A---B", "C", "ytid0000002", 3); err != nil {
+		return err
+	}
+	if _, err := register(ctx, db, "A", "B---C", "ytid0000002", 4); err != nil {
+		return fmt.Errorf("registering a song whose title and artist join like another's failed: %v", err)
+	}
+
+	if total, err := db.TotalSongs(ctx); err != nil || total != 3 {
+		return fmt.Errorf("TotalSongs returned %d, error %v, want 3", total, err)
+	}
+	return nil
+}
+
+func checkSharedAddresses(ctx context.Context, db utils.DBClient) error {
+	first, err := register(ctx, db, "First", "Artist", "", 100, 101)
+	if err != nil {
+		return err
+	}
+	second, err := register(ctx, db, "Second", "Artist", "", 100)
+	if err != nil {
+		return err
+	}
+
+	want := []models.Couple{{SongID: first, AnchorTimeMs: 0}, {SongID: second, AnchorTimeMs: 0}}
+	couples, err := db.GetCouples(ctx, []uint32{100, 101, 102})
+	if err != nil {
+		return err
+	}
+	if !sameCouples(couples[100], want) {
+		return fmt.Errorf("GetCouples of a shared address returned %v, want %v", couples[100], want)
+	}
+	if _, ok := couples[102]; ok {
+		return fmt.Errorf("GetCouples returned an unknown address: %v", couples[102])
+	}
+
+	// Storing a couple again doesn't duplicate it
+	err = db.StoreFingerprints(ctx, map[uint32]models.Couple{100: {SongID: first, AnchorTimeMs: 0}})
+	if err != nil {
+		return err
+	}
+	if couples, err = db.GetCouples(ctx, []uint32{100}); err != nil {
+		return err
+	}
+	if !sameCouples(couples[100], want) {
+		return fmt.Errorf("storing a couple again changed the address to %v, want %v", couples[100], want)
+	}
+	if total, err := db.TotalFingerprints(ctx); err != nil || total != 3 {
+		return fmt.Errorf("TotalFingerprints returned %d, error %v, want 3", total, err)
+	}
+
+	visited := map[uint32][]models.Couple{}
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		if _, ok := visited[address]; ok {
+			return fmt.Errorf("ForEachFingerprint visited address %d twice", address)
+		}
+		visited[address] = couples
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(visited) != 2 || !sameCouples(visited[100], want) || len(visited[101]) != 1 {
+		return fmt.Errorf("ForEachFingerprint visited %v", visited)
+	}
+	return nil
+}
+
+func checkListSongs(ctx context.Context, db utils.DBClient) error {
+	for _, song := range [][2]string{{"Bravo", "Zulu"}, {"Alpha", "Yankee"}, {"Charlie", "Xray"}} {
+		if _, err := register(ctx, db, song[0], song[1], "", 1); err != nil {
+			return err
+		}
+	}
+
+	titles := func(songs []utils.Song) []string {
+		names := make([]string, len(songs))
+		for i, song := range songs {
+			names[i] = song.Title
+		}
+		return names
+	}
+	orders := []struct {
+		sortBy string
+		want   []string
+	}{
+		{utils.SortByTitle, []string{"Alpha", "Bravo", "Charlie"}},
+		{utils.SortByArtist, []string{"Charlie", "Alpha", "Bravo"}},
+	}
+	for _, order := range orders {
+		songs, err := db.ListSongs(ctx, 0, 0, order.sortBy)
+		if err != nil {
+			return err
+		}
+		if got := titles(songs); fmt.Sprint(got) != fmt.Sprint(order.want) {
+			return fmt.Errorf("ListSongs sorted by %s returned %v, want %v", order.sortBy, got, order.want)
+		}
+	}
+
+	songs, err := db.ListSongs(ctx, 1, 1, utils.SortByTitle)
+	if err != nil {
+		return err
+	}
+	if got := titles(songs); fmt.Sprint(got) != "[Bravo]" {
+		return fmt.Errorf("ListSongs from 1 limited to 1 returned %v, want [Bravo]", got)
+	}
+	if songs, err = db.ListSongs(ctx, 5, 10, utils.SortByTitle); err != nil || len(songs) != 0 {
+		return fmt.Errorf("ListSongs past the end returned %v, error %v", titles(songs), err)
+	}
+
+	results, err := db.SearchSongs(ctx, "charly", 10)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || results[0].Title != "Charlie" {
+		return fmt.Errorf("SearchSongs of a misspelled title returned %v", results)
+	}
+	return nil
+}
+
+func checkDeleteSongs(ctx context.Context, db utils.DBClient) error {
+	deleted, err := register(ctx, db, "Deleted", "Artist", "ytid0000001", 100, 101)
+	if err != nil {
+		return err
+	}
+	kept, err := register(ctx, db, "Kept", "Artist", "ytid0000002", 100)
+	if err != nil {
+		return err
+	}
+
+	if err := db.DeleteSongByID(ctx, deleted); err != nil {
+		return err
+	}
+	if _, found, err := db.GetSongByID(ctx, deleted); err != nil || found {
+		return fmt.Errorf("GetSongByID of a deleted song returned found %v, error %v", found, err)
+	}
+	if _, found, err := db.GetSongByYTID(ctx, "ytid0000001"); err != nil || found {
+		return fmt.Errorf("GetSongByYTID of a deleted song returned found %v, error %v", found, err)
+	}
+	if _, found, err := db.GetSongByKey(ctx, utils.GenerateSongKey("Deleted", "Artist")); err != nil || found {
+		return fmt.Errorf("GetSongByKey of a deleted song returned found %v, error %v", found, err)
+	}
+
+	couples, err := db.GetCouples(ctx, []uint32{100, 101})
+	if err != nil {
+		return err
+	}
+	want := []models.Couple{{SongID: kept, AnchorTimeMs: 0}}
+	if !sameCouples(couples[100], want) || len(couples[101]) != 0 {
+		return fmt.Errorf("deleting a song left couples %v, want only %v at address 100", couples, want)
+	}
+
+	// The song can be saved again
+	again, err := register(ctx, db, "Deleted", "Artist", "ytid0000001", 100)
+	if err != nil {
+		return fmt.Errorf("saving a deleted song again failed: %v", err)
+	}
+
+	if err := db.DeleteSongs(ctx, []uint32{again, kept}); err != nil {
+		return err
+	}
+	if total, err := db.TotalSongs(ctx); err != nil || total != 0 {
+		return fmt.Errorf("TotalSongs returned %d, error %v after deleting every song", total, err)
+	}
+	if total, err := db.TotalFingerprints(ctx); err != nil || total != 0 {
+		return fmt.Errorf("TotalFingerprints returned %d, error %v after deleting every song", total, err)
+	}
+
+	// Deleting a song that doesn't exist isn't an error
+	if err := db.DeleteSongByID(ctx, deleted); err != nil {
+		return fmt.Errorf("deleting a missing song failed: %v", err)
+	}
+	return nil
+}
+
+func checkDeleteFingerprints(ctx context.Context, db utils.DBClient) error {
+	songID, err := register(ctx, db, "Title", "Artist", "", 100, 101)
+	if err != nil {
+		return err
+	}
+	other, err := register(ctx, db, "Other", "Artist", "", 100)
+	if err != nil {
+		return err
+	}
+
+	if err := db.DeleteFingerprintsBySongID(ctx, songID); err != nil {
+		return err
+	}
+	if _, found, err := db.GetSongByID(ctx, songID); err != nil || !found {
+		return fmt.Errorf("DeleteFingerprintsBySongID deleted the song too: found %v, error %v", found, err)
+	}
+	if count, err := db.FingerprintCountBySong(ctx, songID); err != nil || count != 0 {
+		return fmt.Errorf("FingerprintCountBySong returned %d, error %v, want 0", count, err)
+	}
+	if count, err := db.FingerprintCountBySong(ctx, other); err != nil || count != 1 {
+		return fmt.Errorf("FingerprintCountBySong of another song returned %d, error %v, want 1", count, err)
+	}
+	return nil
+}
+
+func checkSettings(ctx context.Context, db utils.DBClient) error {
+	if _, found, err := db.GetSetting(ctx, "missing"); err != nil || found {
+		return fmt.Errorf("GetSetting of a missing setting returned found %v, error %v", found, err)
+	}
+	for _, value := range []string{"first", "second"} {
+		if err := db.SetSetting(ctx, "key", value); err != nil {
+			return err
+		}
+		got, found, err := db.GetSetting(ctx, "key")
+		if err != nil || !found || got != value {
+			return fmt.Errorf("GetSetting returned %q, found %v, error %v, want %q", got, found, err, value)
+		}
+	}
+	return nil
+}
+
+func checkAPIKeys(ctx context.Context, db utils.DBClient) error {
+	created := time.Now().UTC()
+	keys := []utils.APIKey{
+		{ID: "key1", Hash: "hash1", Name: "First", Created: created},
+		{ID: "key2", Hash: "hash2", Name: "Second", Catalog: "radio", RateLimit: 10, Created: created},
+	}
+	for _, key := range keys {
+		if err := db.StoreAPIKey(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	got, found, err := db.GetAPIKey(ctx, "hash2")
+	if err != nil || !found {
+		return fmt.Errorf("GetAPIKey returned found %v, error %v", found, err)
+	}
+	if got.ID != "key2" || got.Name != "Second" || got.Catalog != "radio" || got.RateLimit != 10 || !sameTime(got.Created, created) {
+		return fmt.Errorf("GetAPIKey returned %+v, want %+v", got, keys[1])
+	}
+	if _, found, err := db.GetAPIKey(ctx, "unknown"); err != nil || found {
+		return fmt.Errorf("GetAPIKey of an unknown hash returned found %v, error %v", found, err)
+	}
+
+	if err := db.DeleteAPIKey(ctx, "key1"); err != nil {
+		return err
+	}
+	listed, err := db.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if len(listed) != 1 || listed[0].ID != "key2" {
+		return fmt.Errorf("ListAPIKeys returned %v after deleting key1, want only key2", listed)
+	}
+	return nil
+}
+
+func checkRecognitions(ctx context.Context, db utils.DBClient) error {
+	start := time.Now().UTC()
+	clients := []string{"a", "b", "a", ""}
+	for i, client := range clients {
+		recognition := utils.Recognition{Time: start.Add(time.Duration(i) * time.Second), SongID: uint32(i + 1), ClientID: client}
+		if err := db.StoreRecognition(ctx, recognition); err != nil {
+			return err
+		}
+	}
+
+	songIDs := func(recognitions []utils.Recognition) []uint32 {
+		ids := make([]uint32, len(recognitions))
+		for i, recognition := range recognitions {
+			ids[i] = recognition.SongID
+		}
+		return ids
+	}
+	pages := []struct {
+		client        string
+		offset, limit int
+		want          []uint32
+	}{
+		{"", 0, 10, []uint32{4, 3, 2, 1}},
+		{"", 1, 2, []uint32{3, 2}},
+		{"a", 0, 10, []uint32{3, 1}},
+		{"a", 1, 10, []uint32{1}},
+		{"c", 0, 10, []uint32{}},
+	}
+	for _, page := range pages {
+		recognitions, err := db.ListRecognitions(ctx, page.client, page.offset, page.limit)
+		if err != nil {
+			return err
+		}
+		if got := songIDs(recognitions); fmt.Sprint(got) != fmt.Sprint(page.want) {
+			return fmt.Errorf("ListRecognitions of client %q from %d limited to %d returned songs %v, want %v",
+				page.client, page.offset, page.limit, got, page.want)
+		}
+	}
+
+	recognitions, err := db.ListRecognitions(ctx, "", 0, 10)
+	if err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	for _, recognition := range recognitions {
+		if recognition.ID == "" || ids[recognition.ID] {
+			return fmt.Errorf("recognitions were given the IDs %v, want distinct IDs", recognitions)
+		}
+		ids[recognition.ID] = true
+		if !sameTime(recognition.Time, start.Add(time.Duration(recognition.SongID-1)*time.Second)) {
+			return fmt.Errorf("recognition of song %d has time %v", recognition.SongID, recognition.Time)
+		}
+	}
+	return nil
+}
+
+func checkAirplays(ctx context.Context, db utils.DBClient) error {
+	start := time.Now().UTC().Truncate(time.Second)
+	// Stored out of order, as monitored stations finish at different times
+	airplays := []struct {
+		station string
+		minutes int
+	}{{"one", 2}, {"two", 0}, {"one", 0}, {"two", 3}, {"one", 1}}
+	for i, a := range airplays {
+		airplay := utils.Airplay{
+			Station: a.station,
+			SongID:  uint32(i + 1),
+			Started: start.Add(time.Duration(a.minutes) * time.Minute),
+			Ended:   start.Add(time.Duration(a.minutes)*time.Minute + 30*time.Second),
+		}
+		if err := db.StoreAirplay(ctx, airplay); err != nil {
+			return err
+		}
+	}
+
+	minute := func(n int) time.Time { return start.Add(time.Duration(n) * time.Minute) }
+	pages := []struct {
+		filter        utils.AirplayFilter
+		offset, limit int
+		want          []uint32
+	}{
+		{utils.AirplayFilter{}, 0, 10, nil},
+		{utils.AirplayFilter{Station: "one"}, 0, 10, []uint32{1, 5, 3}},
+		{utils.AirplayFilter{Station: "one"}, 1, 1, []uint32{5}},
+		{utils.AirplayFilter{From: minute(1), To: minute(3)}, 0, 10, []uint32{1, 5}},
+		{utils.AirplayFilter{Station: "two", From: minute(0)}, 0, 10, []uint32{4, 2}},
+		{utils.AirplayFilter{Station: "three"}, 0, 10, []uint32{}},
+	}
+	for _, page := range pages {
+		got, err := db.ListAirplays(ctx, page.filter, page.offset, page.limit)
+		if err != nil {
+			return err
+		}
+		if page.want == nil {
+			// Airplays starting at the same time can come in any order
+			if len(got) != len(airplays) {
+				return fmt.Errorf("ListAirplays returned %d airplays, want %d", len(got), len(airplays))
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i].Started.After(got[i-1].Started) {
+					return fmt.Errorf("ListAirplays didn't return the latest first: %v", got)
+				}
+			}
+			continue
+		}
+
+		songIDs := make([]uint32, len(got))
+		for i, airplay := range got {
+			songIDs[i] = airplay.SongID
+		}
+		if fmt.Sprint(songIDs) != fmt.Sprint(page.want) {
+			return fmt.Errorf("ListAirplays of %+v from %d limited to %d returned songs %v, want %v",
+				page.filter, page.offset, page.limit, songIDs, page.want)
+		}
+	}
+	return nil
+}
+
+func checkCollections(ctx context.Context, db utils.DBClient) error {
+	if _, err := register(ctx, db, "Title", "Artist", "", 1); err != nil {
+		return err
+	}
+	if err := db.SetSetting(ctx, "key", "value"); err != nil {
+		return err
+	}
+
+	if err := db.DeleteCollection(ctx, "fingerprints"); err != nil {
+		return err
+	}
+	if total, err := db.TotalFingerprints(ctx); err != nil || total != 0 {
+		return fmt.Errorf("TotalFingerprints returned %d, error %v after deleting the fingerprints", total, err)
+	}
+	if total, err := db.TotalSongs(ctx); err != nil || total != 1 {
+		return fmt.Errorf("deleting the fingerprints deleted songs: TotalSongs returned %d, error %v", total, err)
+	}
+
+	if err := db.DeleteCollection(ctx, "songs"); err != nil {
+		return err
+	}
+	if total, err := db.TotalSongs(ctx); err != nil || total != 0 {
+		return fmt.Errorf("TotalSongs returned %d, error %v after deleting the songs", total, err)
+	}
+	// The unique constraint is cleared along with the songs
+	if _, err := register(ctx, db, "Title", "Artist", "", 1); err != nil {
+		return fmt.Errorf("saving a song again after deleting the songs failed: %v", err)
+	}
+	if _, found, err := db.GetSetting(ctx, "key"); err != nil || !found {
+		return fmt.Errorf("deleting the songs deleted settings: found %v, error %v", found, err)
+	}
+
+	if err := db.DeleteCollection(ctx, "unknown"); err == nil {
+		return errors.New("deleting an unknown collection succeeded")
+	}
+	return nil
+}
+
+func checkCanceled(ctx context.Context, db utils.DBClient) error {
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"GetCouples", func() error { _, err := db.GetCouples(canceled, []uint32{1}); return err }},
+		{"StoreFingerprints", func() error {
+			return db.StoreFingerprints(canceled, map[uint32]models.Couple{1: {SongID: 1, AnchorTimeMs: 1}})
+		}},
+		{"RegisterSongWithFingerprints", func() error { _, err := register(canceled, db, "Title", "Artist", "", 1); return err }},
+		{"ListSongs", func() error { _, err := db.ListSongs(canceled, 0, 0, utils.SortByID); return err }},
+	}
+	for _, c := range calls {
+		if err := c.call(); err == nil {
+			return fmt.Errorf("%s succeeded with a canceled context", c.name)
+		}
+	}
+	if total, err := db.TotalSongs(ctx); err != nil || total != 0 {
+		return fmt.Errorf("a song was saved with a canceled context: TotalSongs returned %d, error %v", total, err)
+	}
+	return nil
+}
+
+// concurrentWriters is the number of goroutines of checkConcurrency
+const concurrentWriters = 8
+
+func checkConcurrency(ctx context.Context, db utils.DBClient) error {
+	const songsPerWriter = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*concurrentWriters)
+
+	// Writers save songs sharing an address while readers look it up
+	for w := 0; w < concurrentWriters; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < songsPerWriter; i++ {
+				title := fmt.Sprintf("Song %d-%d", w, i)
+				if _, err := register(ctx, db, title, "Artist", "", 1000, uint32(2000+w*songsPerWriter+i)); err != nil {
+					errs <- fmt.Errorf("saving %s: %v", title, err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < songsPerWriter; i++ {
+				if _, err := db.GetCouples(ctx, []uint32{1000}); err != nil {
+					errs <- fmt.Errorf("reading while saving: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	couples, err := db.GetCouples(ctx, []uint32{1000})
+	if err != nil {
+		return err
+	}
+	if len(couples[1000]) != concurrentWriters*songsPerWriter {
+		return fmt.Errorf("the shared address has %d couples, want %d", len(couples[1000]), concurrentWriters*songsPerWriter)
+	}
+
+	// Saving the same song at once succeeds only once
+	var saved sync.WaitGroup
+	results := make(chan error, concurrentWriters)
+	for w := 0; w < concurrentWriters; w++ {
+		saved.Add(1)
+		go func() {
+			defer saved.Done()
+			_, err := register(ctx, db, "Same", "Artist", "ytid0000001", 3000)
+			results <- err
+		}()
+	}
+	saved.Wait()
+	close(results)
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		return fmt.Errorf("saving the same song at once succeeded %d times, want once", succeeded)
+	}
+	return nil
+}
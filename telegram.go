@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+
+	// telegramPollTimeout is how long a request for updates waits for
+	// messages before Telegram answers it empty
+	telegramPollTimeout = 50 * time.Second
+
+	// telegramRetryDelay is how long the bot waits after failing to get
+	// updates
+	telegramRetryDelay = 5 * time.Second
+
+	// telegramRecognitionTimeout bounds downloading and recognizing a file
+	telegramRecognitionTimeout = 2 * time.Minute
+)
+
+// telegramBot recognizes the voice notes and audio files users send to a
+// Telegram bot, which it gets by polling for updates
+type telegramBot struct {
+	token  string
+	client *http.Client
+}
+
+// telegramUpdate is the part of a Telegram update the bot reads
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From *struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Text      string        `json:"text"`
+	Voice     *telegramFile `json:"voice"`
+	Audio     *telegramFile `json:"audio"`
+	Video     *telegramFile `json:"video"`
+	VideoNote *telegramFile `json:"video_note"`
+	Document  *telegramFile `json:"document"`
+}
+
+type telegramFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+}
+
+// telegramResponse is the envelope of every response of the Bot API
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+const telegramHelp = "Send me a voice note or an audio file and I'll tell you what song it is."
+
+func newTelegramBot(token string) *telegramBot {
+	return &telegramBot{
+		token:  token,
+		client: &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+	}
+}
+
+// startTelegramBot runs the Telegram bot with token until ctx is done, and
+// returns the function waiting for it to stop. Recognitions still running
+// then are tracked like jobs, so shutdown waits for them.
+func startTelegramBot(ctx context.Context, token string) (func(), error) {
+	if token == "" {
+		return func() {}, nil
+	}
+
+	bot := newTelegramBot(token)
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := bot.call(ctx, "getMe", nil, &me); err != nil {
+		return nil, fmt.Errorf("error connecting to Telegram: %v", err)
+	}
+
+	logger := utils.GetLogger()
+	logger.Info("running Telegram bot.", slog.String("bot", "@"+me.Username))
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		bot.run(ctx)
+	}()
+	return func() { <-stopped }, nil
+}
+
+// run polls for updates and handles them until ctx is done
+func (b *telegramBot) run(ctx context.Context) {
+	logger := utils.GetLogger()
+	var offset int64
+
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		params := map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}
+		if err := b.call(ctx, "getUpdates", params, &updates); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("failed to get Telegram updates.", slog.Any("error", xerrors.New(err)))
+			select {
+			case <-time.After(telegramRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				b.handleMessage(update.Message)
+			}
+		}
+	}
+}
+
+// handleMessage recognizes the file of a message in the background, and
+// answers other messages with help
+func (b *telegramBot) handleMessage(message *telegramMessage) {
+	logger := utils.GetLogger()
+	ctx := utils.WithRequestID(context.Background(), utils.NewRequestID())
+
+	file := message.file()
+	if file == nil {
+		b.reply(ctx, message, telegramHelp)
+		return
+	}
+	if file.FileSize > maxRecordingSize {
+		b.reply(ctx, message, fmt.Sprintf("Couldn't recognize that: %v.", errRecordingTooLarge))
+		return
+	}
+
+	var userID string
+	if message.From != nil {
+		userID = strconv.FormatInt(message.From.ID, 10)
+	}
+	if allowed, wait := allowRecognition(ctx, "telegram:"+userID); !allowed {
+		b.reply(ctx, message, fmt.Sprintf("Too many recognitions, try again in %v.", wait.Round(time.Second)))
+		return
+	}
+
+	jobCtx, done, err := jobs.start(ctx)
+	if err != nil {
+		b.reply(ctx, message, "The server is shutting down, try again later.")
+		return
+	}
+	jobCtx = utils.WithClientID(jobCtx, "telegram:"+userID)
+
+	logger.InfoContext(ctx, "recognizing Telegram file.", slog.String("file_name", file.FileName), slog.Int64("size", file.FileSize))
+	go func() {
+		defer done()
+		ctx, cancel := context.WithTimeout(jobCtx, telegramRecognitionTimeout)
+		defer cancel()
+
+		b.call(ctx, "sendChatAction", map[string]interface{}{"chat_id": message.Chat.ID, "action": "typing"}, nil)
+		b.recognize(ctx, message, file)
+	}()
+}
+
+// file returns the audio or video of a message, nil if it has none
+func (m *telegramMessage) file() *telegramFile {
+	switch {
+	case m.Voice != nil:
+		return m.Voice
+	case m.Audio != nil:
+		return m.Audio
+	case m.Video != nil:
+		return m.Video
+	case m.VideoNote != nil:
+		return m.VideoNote
+	case m.Document != nil && (strings.HasPrefix(m.Document.MimeType, "audio/") || strings.HasPrefix(m.Document.MimeType, "video/")):
+		return m.Document
+	}
+	return nil
+}
+
+// recognize downloads and recognizes a file, and replies with its best
+// match
+func (b *telegramBot) recognize(ctx context.Context, message *telegramMessage, file *telegramFile) {
+	logger := utils.GetLogger()
+
+	var telegramFile struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := b.call(ctx, "getFile", map[string]interface{}{"file_id": file.FileID}, &telegramFile); err != nil {
+		logger.ErrorContext(ctx, "failed to get Telegram file.", slog.Any("error", xerrors.New(err)))
+		b.reply(ctx, message, "Couldn't download that, try again later.")
+		return
+	}
+
+	// Voice notes have no name, but their path ends with their extension
+	fileName := file.FileName
+	if fileName == "" {
+		fileName = telegramFile.FilePath[strings.LastIndex(telegramFile.FilePath, "/")+1:]
+	}
+
+	fileURL := fmt.Sprintf("%s/file/bot%s/%s", telegramAPI, b.token, telegramFile.FilePath)
+	matches, err := recognizeRemoteFile(ctx, b.client, fileURL, fileName)
+	switch {
+	case errors.Is(err, errRecordingTooLarge), errors.Is(err, errUnsupportedAudio), errors.Is(err, shazam.ErrTimedOut), errors.Is(err, errServerBusy):
+		b.reply(ctx, message, fmt.Sprintf("Couldn't recognize that: %v.", err))
+		return
+	case err != nil:
+		logger.ErrorContext(ctx, "failed to recognize Telegram file.", slog.Any("error", xerrors.New(b.redact(err))))
+		b.reply(ctx, message, "Couldn't recognize that, try again later.")
+		return
+	case len(matches) == 0:
+		b.reply(ctx, message, "No song matches that.")
+		return
+	}
+
+	b.replyWithMatch(ctx, message, matches[0])
+}
+
+// replyWithMatch describes a match, with its cover art as a photo when it
+// has one and a button opening the song on YouTube
+func (b *telegramBot) replyWithMatch(ctx context.Context, message *telegramMessage, match shazam.Match) {
+	logger := utils.GetLogger()
+
+	caption := fmt.Sprintf("<b>%s</b>\n%s", html.EscapeString(match.SongTitle), html.EscapeString(match.SongArtist))
+	if match.Album != "" {
+		caption += "\n<i>" + html.EscapeString(match.Album) + "</i>"
+	}
+	caption += fmt.Sprintf("\n\nConfidence %.0f%% · at %s", match.Confidence*100, formatOffset(match.OffsetMs))
+
+	params := map[string]interface{}{
+		"chat_id":             message.Chat.ID,
+		"reply_to_message_id": message.MessageID,
+		"parse_mode":          "HTML",
+	}
+	if match.YouTubeID != "" {
+		params["reply_markup"] = map[string]interface{}{
+			"inline_keyboard": [][]map[string]string{{{
+				"text": "▶ YouTube",
+				"url":  "https://www.youtube.com/watch?v=" + match.YouTubeID,
+			}}},
+		}
+	}
+
+	method := "sendMessage"
+	params["text"] = caption
+	if hasAbsoluteURL(match.CoverURL) {
+		method = "sendPhoto"
+		delete(params, "text")
+		params["photo"] = match.CoverURL
+		params["caption"] = caption
+	}
+
+	if err := b.call(ctx, method, params, nil); err != nil {
+		logger.ErrorContext(ctx, "failed to send Telegram reply.", slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// reply answers message with text
+func (b *telegramBot) reply(ctx context.Context, message *telegramMessage, text string) {
+	params := map[string]interface{}{
+		"chat_id":             message.Chat.ID,
+		"reply_to_message_id": message.MessageID,
+		"text":                text,
+	}
+	if err := b.call(ctx, "sendMessage", params, nil); err != nil {
+		logger := utils.GetLogger()
+		logger.ErrorContext(ctx, "failed to send Telegram reply.", slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// call calls a method of the Bot API with JSON params, and decodes its
+// result into result unless it is nil. Its errors never hold the token.
+func (b *telegramBot) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	var body bytes.Buffer
+	if params != nil {
+		if err := json.NewEncoder(&body).Encode(params); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/%s", telegramAPI, b.token, method), &body)
+	if err != nil {
+		return b.redact(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return b.redact(err)
+	}
+	defer resp.Body.Close()
+
+	var response telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: unexpected status %s", method, resp.Status)
+	}
+	if !response.OK {
+		return fmt.Errorf("%s: %s", method, response.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+// redact removes the token from err, since the Bot API takes it in the URL
+// of every request
+func (b *telegramBot) redact(err error) error {
+	return errors.New(strings.ReplaceAll(err.Error(), b.token, "<token>"))
+}
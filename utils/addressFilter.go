@@ -0,0 +1,317 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"song-recognition/metrics"
+	"song-recognition/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	// addressFilterBitsPerAddress and addressFilterHashes give address
+	// filters about 1% of false positives
+	addressFilterBitsPerAddress = 10
+	addressFilterHashes         = 7
+
+	// addressFilterMinAddresses is the fewest addresses a filter is sized
+	// for, so that the filter of a new catalog isn't full after a few songs
+	addressFilterMinAddresses = 1 << 20
+
+	// addressSpaceBits is the number of possible addresses. A filter that
+	// needs as many bits has one per address instead, with no false
+	// positives.
+	addressSpaceBits = 1 << 32
+)
+
+var (
+	// addressFilterEnabled is whether GetCouples checks the addresses it is
+	// given against a Bloom filter of the catalog's addresses before
+	// querying the database. Set with ADDRESS_FILTER.
+	addressFilterEnabled, _ = strconv.ParseBool(GetEnv("ADDRESS_FILTER", "false"))
+
+	// addressFilterRefresh is how often the filter of a catalog is built
+	// again from the database, to add the addresses other processes saved
+	// and drop those of deleted songs. Set with ADDRESS_FILTER_REFRESH.
+	addressFilterRefresh = durationFromEnv("ADDRESS_FILTER_REFRESH", 5*time.Minute)
+
+	// addressFilterMaxSize is the most bytes the filter of a catalog takes.
+	// A filter that would need more is clamped to it, at the cost of more
+	// false positives. Set with ADDRESS_FILTER_MAX_SIZE.
+	addressFilterMaxSize = intFromEnv("ADDRESS_FILTER_MAX_SIZE", 64<<20)
+
+	// addressFilters are the filters of the catalogs used by the process
+	addressFilters   = map[string]*addressFilter{}
+	addressFiltersMu sync.Mutex
+)
+
+// bloomFilter is a Bloom filter of fingerprint addresses
+type bloomFilter struct {
+	bits []uint64
+	size uint64
+	// hashCount is the number of bits set per address
+	hashCount int
+	// capacity is the number of addresses the filter is sized for, and
+	// count the number added to it
+	capacity int
+	count    int
+	// clamped is whether the filter is smaller than capacity needs
+	clamped bool
+}
+
+// newBloomFilter returns a filter sized for capacity addresses, of at most
+// maxSize bytes. A filter clamped to maxSize sets fewer bits per address,
+// which keeps it from filling up.
+func newBloomFilter(capacity, maxSize int) *bloomFilter {
+	size := (uint64(capacity)*addressFilterBitsPerAddress + 63) &^ 63
+	maxBits := max(uint64(maxSize)*8&^63, 64)
+	if size >= addressSpaceBits && maxBits >= addressSpaceBits {
+		return &bloomFilter{bits: make([]uint64, addressSpaceBits/64), size: addressSpaceBits, hashCount: 1, capacity: capacity}
+	}
+	if size <= maxBits {
+		return &bloomFilter{bits: make([]uint64, size/64), size: size, hashCount: addressFilterHashes, capacity: capacity}
+	}
+
+	// ln 2 bits per address set the fewest false positives
+	hashCount := int(math.Round(float64(maxBits) / float64(capacity) * math.Ln2))
+	hashCount = min(max(hashCount, 1), addressFilterHashes)
+	return &bloomFilter{bits: make([]uint64, maxBits/64), size: maxBits, hashCount: hashCount, capacity: capacity, clamped: true}
+}
+
+// bytes returns the memory taken by the bits of the filter
+func (f *bloomFilter) bytes() int {
+	return len(f.bits) * 8
+}
+
+// hashes returns the two hashes the bits of address are derived from: bit
+// h1 + i*h2 for its i-th hash. A filter with a bit per address uses the
+// address itself.
+func (f *bloomFilter) hashes(address uint32) (uint64, uint64) {
+	if f.size == addressSpaceBits {
+		return uint64(address), 0
+	}
+
+	// splitmix64
+	z := uint64(address) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z & 0xffffffff, z>>32 | 1
+}
+
+func (f *bloomFilter) add(address uint32) {
+	h1, h2 := f.hashes(address)
+	for i := 0; i < f.hashCount; i++ {
+		bit := (h1 + uint64(i)*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// mayContain reports whether address may have been added to the filter.
+// It is only false for addresses that never were.
+func (f *bloomFilter) mayContain(address uint32) bool {
+	h1, h2 := f.hashes(address)
+	for i := 0; i < f.hashCount; i++ {
+		bit := (h1 + uint64(i)*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addressFilter holds the Bloom filter of the addresses of a catalog,
+// shared by the clients of the process. The filter is built in the
+// background from the database, and addresses saved through the process
+// are added to it as they are.
+type addressFilter struct {
+	catalog string
+
+	mu sync.RWMutex
+	// current is the filter in use, nil until it is first built
+	current *bloomFilter
+	// building is whether the filter is being built again, and pending the
+	// addresses saved meanwhile, which the scan may have missed
+	building bool
+	pending  []uint32
+	built    time.Time
+}
+
+// addressFilterFor returns the address filter of catalog
+func addressFilterFor(catalog string) *addressFilter {
+	addressFiltersMu.Lock()
+	defer addressFiltersMu.Unlock()
+
+	filter, ok := addressFilters[catalog]
+	if !ok {
+		filter = &addressFilter{catalog: catalog}
+		addressFilters[catalog] = filter
+	}
+	return filter
+}
+
+// check returns the addresses that may have couples. Until the filter is
+// built, that is all of them.
+func (f *addressFilter) check(addresses []uint32) []uint32 {
+	f.refreshIfDue()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.current == nil {
+		return addresses
+	}
+
+	present := make([]uint32, 0, len(addresses))
+	for _, address := range addresses {
+		if f.current.mayContain(address) {
+			present = append(present, address)
+		}
+	}
+	metrics.AddressFilterLookups.WithLabelValues("maybe").Add(float64(len(present)))
+	metrics.AddressFilterLookups.WithLabelValues("absent").Add(float64(len(addresses) - len(present)))
+	return present
+}
+
+// add adds addresses that were just saved to the filter
+func (f *addressFilter) add(addresses []uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.current != nil {
+		for _, address := range addresses {
+			f.current.add(address)
+		}
+	}
+	if f.building {
+		f.pending = append(f.pending, addresses...)
+	}
+}
+
+// refreshIfDue starts building the filter again when it was never built,
+// is older than addressFilterRefresh, or holds more addresses than it was
+// sized for
+func (f *addressFilter) refreshIfDue() {
+	f.mu.RLock()
+	due := !f.building && (f.current == nil || time.Since(f.built) >= addressFilterRefresh || f.current.count > f.current.capacity)
+	f.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.building {
+		return
+	}
+	f.building = true
+	go f.rebuild()
+}
+
+// rebuild builds the filter from the addresses stored in the database, and
+// replaces the current one with it
+func (f *addressFilter) rebuild() {
+	filter, err := f.scan(context.Background())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		logger := GetLogger()
+		logger.Warn("failed to build the address filter, addresses are looked up without it.",
+			slog.String("catalog", f.catalog), slog.Any("error", xerrors.New(err)))
+	} else {
+		for _, address := range f.pending {
+			filter.add(address)
+		}
+		f.current = filter
+	}
+	f.building = false
+	f.pending = nil
+	f.built = time.Now()
+}
+
+// scan returns a filter of the addresses stored in the database
+func (f *addressFilter) scan(ctx context.Context) (*bloomFilter, error) {
+	db, _, err := newBackend(f.catalog, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// Couples outnumber addresses, so the filter is oversized rather than
+	// full
+	total, err := db.TotalFingerprints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := newBloomFilter(max(total+total/4, addressFilterMinAddresses), addressFilterMaxSize)
+	logger := GetLogger()
+	if filter.clamped {
+		logger.Warn("the address filter is clamped to ADDRESS_FILTER_MAX_SIZE, it lets more absent addresses through.",
+			slog.String("catalog", f.catalog), slog.Int("capacity", filter.capacity), slog.Int("bytes", filter.bytes()))
+	} else {
+		logger.Info("allocated the address filter.",
+			slog.String("catalog", f.catalog), slog.Int("capacity", filter.capacity), slog.Int("bytes", filter.bytes()))
+	}
+
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		filter.add(address)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// filteredDB checks the addresses GetCouples is given against the address
+// filter of its catalog, and only queries the database for those that may
+// have couples. The addresses saved through it are added to the filter;
+// those saved by other processes are only found once the filter is built
+// again.
+type filteredDB struct {
+	DBClient
+	filter *addressFilter
+}
+
+func (db *filteredDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	present := db.filter.check(addresses)
+	if len(present) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return map[uint32][]models.Couple{}, nil
+	}
+	return db.DBClient.GetCouples(ctx, present)
+}
+
+func (db *filteredDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	err := db.DBClient.StoreFingerprints(ctx, fingerprints)
+
+	// Even a failed write may have stored some of them
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+	db.filter.add(addresses)
+	return err
+}
+
+func (db *filteredDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	var addresses []uint32
+	songID, err := db.DBClient.RegisterSongWithFingerprints(ctx, songTitle, songArtist, ytID, meta, func(songID uint32) map[uint32]models.Couple {
+		fingerprints := fingerprint(songID)
+		addresses = make([]uint32, 0, len(fingerprints))
+		for address := range fingerprints {
+			addresses = append(addresses, address)
+		}
+		return fingerprints
+	})
+	db.filter.add(addresses)
+	return songID, err
+}
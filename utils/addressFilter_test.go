@@ -0,0 +1,37 @@
+package utils
+
+import "testing"
+
+func TestNewBloomFilterSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		capacity  int
+		maxSize   int
+		wantBytes int
+		wantHash  int
+		clamped   bool
+	}{
+		{"within the bound", 1 << 20, 64 << 20, 10 << 20 / 8, addressFilterHashes, false},
+		{"clamped", 1 << 26, 64 << 20, 64 << 20, 6, true},
+		{"clamped to under a bit per address", 1 << 26, 1 << 20, 1 << 20, 1, true},
+	}
+
+	for _, test := range tests {
+		filter := newBloomFilter(test.capacity, test.maxSize)
+		if filter.bytes() != test.wantBytes || filter.hashCount != test.wantHash || filter.clamped != test.clamped {
+			t.Errorf("%s: got %d bytes, %d hashes, clamped %v, want %d bytes, %d hashes, clamped %v", test.name,
+				filter.bytes(), filter.hashCount, filter.clamped, test.wantBytes, test.wantHash, test.clamped)
+		}
+	}
+
+	// A clamped filter still finds every address added to it
+	filter := newBloomFilter(1<<20, 1<<10)
+	for address := uint32(0); address < 1<<16; address++ {
+		filter.add(address * 65521)
+	}
+	for address := uint32(0); address < 1<<16; address++ {
+		if !filter.mayContain(address * 65521) {
+			t.Fatalf("clamped filter lost address %d", address*65521)
+		}
+	}
+}
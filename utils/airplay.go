@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Airplay is a track identified on a monitored radio stream, from when it
+// was first heard to when it was last heard
+type Airplay struct {
+	ID      string `json:"id"`
+	Station string `json:"station"`
+	// The title and artist are kept in case the song is deleted
+	SongID     uint32    `json:"songId"`
+	SongTitle  string    `json:"songTitle"`
+	SongArtist string    `json:"songArtist"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	// Confidence is the best confidence the track was recognized with
+	Confidence float64 `json:"confidence"`
+}
+
+// AirplayFilter selects airplays by station and by when they started
+type AirplayFilter struct {
+	// Station selects the airplays of one station, every station if empty
+	Station string
+	// From and To select the airplays that started from From included to
+	// To excluded. Zero times leave that side open.
+	From, To time.Time
+}
+
+// matches reports whether airplay is selected by f. It serves the backends
+// that can't filter in their queries.
+func (f AirplayFilter) matches(airplay Airplay) bool {
+	return (f.Station == "" || airplay.Station == f.Station) &&
+		(f.From.IsZero() || !airplay.Started.Before(f.From)) &&
+		(f.To.IsZero() || airplay.Started.Before(f.To))
+}
+
+// decodeAirplays decodes JSON encoded airplays. It serves the backends that
+// store airplays as JSON.
+func decodeAirplays(values []string) ([]Airplay, error) {
+	airplays := make([]Airplay, 0, len(values))
+	for _, value := range values {
+		var airplay Airplay
+		if err := json.Unmarshal([]byte(value), &airplay); err != nil {
+			return nil, fmt.Errorf("invalid airplay: %v", err)
+		}
+		airplays = append(airplays, airplay)
+	}
+	return airplays, nil
+}
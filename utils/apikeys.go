@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so that leaked keys are easy to spot
+const apiKeyPrefix = "stk_"
+
+// APIKey is a key clients authenticate to the server with. Only the hash
+// of the secret is stored.
+type APIKey struct {
+	ID   string `json:"id"`   // short public identifier, used to revoke the key
+	Hash string `json:"hash"` // hex SHA-256 of the secret
+	Name string `json:"name"`
+	// Catalog, if not empty, is the only catalog requests with the key can use
+	Catalog string `json:"catalog,omitempty"`
+	// RateLimit is the number of recognitions allowed per minute, 0 for the
+	// server default
+	RateLimit int       `json:"rateLimit,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// hashAPIKey returns the hash an API key secret is stored under
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey generates and stores a new API key, and returns its secret.
+// The secret can't be recovered afterwards.
+func CreateAPIKey(ctx context.Context, db DBClient, name, catalog string, rateLimit int) (string, APIKey, error) {
+	if !ValidCatalog(catalog) {
+		return "", APIKey{}, fmt.Errorf("invalid catalog name: %q", catalog)
+	}
+	if rateLimit < 0 {
+		return "", APIKey{}, fmt.Errorf("invalid rate limit: %d", rateLimit)
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", APIKey{}, fmt.Errorf("error generating API key: %v", err)
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(random)
+
+	hash := hashAPIKey(secret)
+	key := APIKey{
+		ID:        hash[:12],
+		Hash:      hash,
+		Name:      name,
+		Catalog:   catalog,
+		RateLimit: rateLimit,
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+	if err := db.StoreAPIKey(ctx, key); err != nil {
+		return "", APIKey{}, err
+	}
+
+	return secret, key, nil
+}
+
+// LookupAPIKey returns the stored API key secret belongs to
+func LookupAPIKey(ctx context.Context, db DBClient, secret string) (APIKey, bool, error) {
+	return db.GetAPIKey(ctx, hashAPIKey(secret))
+}
+
+// decodeAPIKeys decodes JSON encoded API keys, oldest first. It serves the
+// backends that store keys as JSON.
+func decodeAPIKeys(values []string) ([]APIKey, error) {
+	keys := make([]APIKey, 0, len(values))
+	for _, value := range values {
+		var key APIKey
+		if err := json.Unmarshal([]byte(value), &key); err != nil {
+			return nil, fmt.Errorf("invalid API key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
@@ -0,0 +1,1241 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"song-recognition/couplecodec"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltSongsBucket        = []byte("songs")
+	boltSongKeysBucket     = []byte("songKeys")
+	boltSongYTIDsBucket    = []byte("songYTIDs")
+	boltSongUniqueBucket   = []byte("songUnique")
+	boltFingerprintsBucket = []byte("fingerprints")
+	boltSettingsBucket     = []byte("settings")
+	boltAPIKeysBucket      = []byte("apiKeys")      // API key hashes to the JSON encoded keys
+	boltRecognitionsBucket = []byte("recognitions") // big-endian sequence numbers to the JSON encoded recognitions
+	boltAirplayBucket      = []byte("airplay")      // big-endian start times in nanoseconds and sequence numbers to the JSON encoded airplays
+)
+
+// BoltDB is a DBClient backed by an embedded bbolt file. It needs no
+// external server and no cgo. Fingerprint values are the couples of an
+// address in the fixed encoding of couplecodec, 8 bytes each, which is the
+// big-endian form of packCouple.
+type BoltDB struct {
+	db   *bolt.DB
+	path string
+	// shards hold the fingerprints of the addresses equal to their index
+	// modulo their number, and shardPaths are their files. The first one
+	// is db.
+	shards     []*bolt.DB
+	shardPaths []string
+}
+
+var (
+	// boltTimeout is how long opening a file waits for another process
+	// holding it to let go. Set with BOLT_TIMEOUT.
+	boltTimeout = durationFromEnv("BOLT_TIMEOUT", 5*time.Second)
+
+	// boltNoSync skips syncing the file to disk after every write, which
+	// speeds up ingestion but can lose the last writes if the machine
+	// crashes. Set with BOLT_NO_SYNC.
+	boltNoSync, _ = strconv.ParseBool(GetEnv("BOLT_NO_SYNC", "false"))
+
+	// boltInitialMmapSize is the size, in bytes, the file is mapped in
+	// memory with. Writes that grow the file past it wait for every read to
+	// finish, so a size larger than the database keeps recognitions and
+	// ingestion from blocking each other. Set with BOLT_INITIAL_MMAP_SIZE.
+	boltInitialMmapSize, _ = strconv.Atoi(GetEnv("BOLT_INITIAL_MMAP_SIZE", "0"))
+)
+
+// sharedBoltFile is a database file opened once for every client using it.
+// A bbolt file can only be opened by one handle at a time, even within a
+// process, so clients opened at the same time, like a recognition made
+// while a song is saved, would otherwise wait for each other and time out.
+type sharedBoltFile struct {
+	db   *bolt.DB
+	refs int
+}
+
+var (
+	boltFilesMu sync.Mutex
+	boltFiles   = map[string]*sharedBoltFile{}
+)
+
+// boltBuckets are the buckets every database file has
+var boltBuckets = [][]byte{boltSongsBucket, boltSongKeysBucket, boltSongYTIDsBucket, boltSongUniqueBucket, boltFingerprintsBucket, boltSettingsBucket, boltAPIKeysBucket, boltRecognitionsBucket, boltAirplayBucket}
+
+// openBoltFile returns the handle of the file at path, opening it and
+// creating buckets if no client has it open. Read-only processes open
+// files read-only, which lets several of them share a file, and only check
+// that the buckets exist.
+func openBoltFile(path string, buckets [][]byte) (*bolt.DB, error) {
+	boltFilesMu.Lock()
+	defer boltFilesMu.Unlock()
+
+	if file, ok := boltFiles[path]; ok {
+		file.refs++
+		return file.db, nil
+	}
+
+	// bbolt would create a missing file it can't then initialize
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("error opening bolt database %s: %v", path, err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:         boltTimeout,
+		NoSync:          boltNoSync,
+		InitialMmapSize: boltInitialMmapSize,
+		ReadOnly:        readOnly,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening bolt database %s: %v", path, err)
+	}
+
+	if readOnly {
+		err = db.View(func(tx *bolt.Tx) error {
+			for _, name := range buckets {
+				if tx.Bucket(name) == nil {
+					return fmt.Errorf("bucket %s is missing, open the file from a process that can write to create it", name)
+				}
+			}
+			return nil
+		})
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range buckets {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error preparing buckets: %v", err)
+	}
+
+	boltFiles[path] = &sharedBoltFile{db: db, refs: 1}
+	return db, nil
+}
+
+// closeBoltFile releases a handle returned by openBoltFile, closing the
+// file once no client uses it
+func closeBoltFile(path string) error {
+	boltFilesMu.Lock()
+	defer boltFilesMu.Unlock()
+
+	file, ok := boltFiles[path]
+	if !ok {
+		return nil
+	}
+	file.refs--
+	if file.refs > 0 {
+		return nil
+	}
+	delete(boltFiles, path)
+	return file.db.Close()
+}
+
+// newBoltDB opens (or creates) the database file of catalog, along with
+// the files its fingerprints are sharded over
+func newBoltDB(catalog string) (*BoltDB, error) {
+	path := boltPath(catalog)
+	db, err := openBoltFile(path, boltBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	bdb := &BoltDB{db: db, path: path, shards: []*bolt.DB{db}, shardPaths: []string{path}}
+	if err := bdb.openShards(); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return bdb, nil
+}
+
+// boltPath returns the database file of catalog, which is DB_PATH for the
+// default catalog and DB_PATH with the catalog name before its extension
+// for the others
+func boltPath(catalog string) string {
+	path := GetEnv("DB_PATH", "song-recognition.db")
+	if catalog != DefaultCatalog {
+		// Each catalog is a separate file next to the default one
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "." + catalog + ext
+	}
+
+	// Clients share the handle of a file however its path is written
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+func boltUint32Key(v uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, v)
+	return key
+}
+
+// encodeSong serializes a song as length-prefixed title, artist, ytID, key,
+// album and cover URL, followed by its duration and release year as
+// uvarints, and its length-prefixed source, source URL, JSON provenance and
+// MusicBrainz recording and release IDs
+func encodeSong(song Song, key string) []byte {
+	var buf []byte
+	appendString := func(field string) {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+
+	for _, field := range []string{song.Title, song.Artist, song.YouTubeID, key, song.Album, song.CoverURL} {
+		appendString(field)
+	}
+	buf = binary.AppendUvarint(buf, uint64(song.Duration))
+	buf = binary.AppendUvarint(buf, uint64(song.ReleaseYear))
+	appendString(song.Source)
+	appendString(song.SourceURL)
+	appendString(song.Provenance.encode())
+	appendString(song.RecordingMBID)
+	appendString(song.ReleaseMBID)
+	return buf
+}
+
+// decodeSong reverses encodeSong. Records written before songs had
+// metadata end after the key and decode with empty metadata, records
+// written before songs had sources end after the release year, records
+// written before songs had a provenance end after the source URL, and
+// records written before songs had MusicBrainz IDs end after the
+// provenance.
+func decodeSong(data []byte) (song Song, key string, err error) {
+	corrupt := errors.New("corrupt song record")
+
+	readString := func() (string, error) {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return "", corrupt
+		}
+		field := string(data[n : n+int(length)])
+		data = data[n+int(length):]
+		return field, nil
+	}
+
+	fields := make([]string, 11)
+	for i := 0; i < 6; i++ {
+		if i == 4 && len(data) == 0 {
+			return Song{Title: fields[0], Artist: fields[1], YouTubeID: fields[2]}, fields[3], nil
+		}
+		if fields[i], err = readString(); err != nil {
+			return Song{}, "", err
+		}
+	}
+
+	numbers := make([]int, 2)
+	for i := range numbers {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Song{}, "", corrupt
+		}
+		numbers[i] = int(value)
+		data = data[n:]
+	}
+
+	for i := 6; i < len(fields) && len(data) > 0; i++ {
+		if fields[i], err = readString(); err != nil {
+			return Song{}, "", err
+		}
+	}
+
+	song = Song{
+		Title:     fields[0],
+		Artist:    fields[1],
+		YouTubeID: fields[2],
+		SongMetadata: SongMetadata{
+			Album:         fields[4],
+			CoverURL:      fields[5],
+			Duration:      numbers[0],
+			ReleaseYear:   numbers[1],
+			Source:        fields[6],
+			SourceURL:     fields[7],
+			Provenance:    decodeSongProvenance(fields[8]),
+			RecordingMBID: fields[9],
+			ReleaseMBID:   fields[10],
+		},
+	}
+	return song, fields[3], nil
+}
+
+// Close releases the underlying database files, which are closed once no
+// other client uses them
+func (db *BoltDB) Close() error {
+	if db.db == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, path := range db.shardPaths {
+		if err := closeBoltFile(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	db.db, db.shards, db.shardPaths = nil, nil, nil
+	return errors.Join(errs...)
+}
+
+// Ping checks that the database file can be read
+func (db *BoltDB) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Capabilities reports the capabilities of bolt. Fingerprints are spread
+// over shard files, so a song isn't saved in a single transaction.
+func (db *BoltDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "bolt",
+		Transactions: false,
+		MaxBatchSize: 0,
+		NativeSearch: false,
+		SharedAccess: false,
+	}
+}
+
+// StoreFingerprints stores fingerprints in their shards, which are written
+// in parallel
+func (db *BoltDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	byShard := make([]map[uint32]models.Couple, len(db.shards))
+	for address, couple := range fingerprints {
+		i := db.shardOf(address)
+		if byShard[i] == nil {
+			byShard[i] = make(map[uint32]models.Couple)
+		}
+		byShard[i][address] = couple
+	}
+
+	err := db.forEachShard(func(i int, shard *bolt.DB) error {
+		if len(byShard[i]) == 0 {
+			return nil
+		}
+		return shard.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltFingerprintsBucket)
+			var packed []byte
+			for address, couple := range byShard[i] {
+				packed = couplecodec.AppendFixed(packed[:0], couple)
+				if err := addBoltCouples(bucket, boltUint32Key(address), packed); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error storing fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+// addBoltCouples adds the packed couples to those of key in bucket, leaving
+// out the ones it already has
+func addBoltCouples(bucket *bolt.Bucket, key, packed []byte) error {
+	existing := bucket.Get(key)
+	value := make([]byte, 0, len(existing)+len(packed))
+	value = append(value, existing...)
+	for i := 0; i+8 <= len(packed); i += 8 {
+		if !containsPackedCouple(existing, packed[i:i+8]) {
+			value = append(value, packed[i:i+8]...)
+		}
+	}
+	if len(value) == len(existing) {
+		return nil
+	}
+	return bucket.Put(key, value)
+}
+
+func containsPackedCouple(value, packed []byte) bool {
+	for i := 0; i+8 <= len(value); i += 8 {
+		if bytes.Equal(value[i:i+8], packed) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCouples looks addresses up in their shards, which are read in
+// parallel
+func (db *BoltDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	byShard := make([][]uint32, len(db.shards))
+	for _, address := range addresses {
+		i := db.shardOf(address)
+		byShard[i] = append(byShard[i], address)
+	}
+
+	shardCouples := make([]map[uint32][]models.Couple, len(db.shards))
+	err := db.forEachShard(func(i int, shard *bolt.DB) error {
+		couples := make(map[uint32][]models.Couple)
+		shardCouples[i] = couples
+
+		for _, chunk := range chunkAddresses(byShard[i], addressBatchSize) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := shard.View(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(boltFingerprintsBucket)
+				for _, address := range chunk {
+					addressCouples, err := couplecodec.DecodeFixed(bucket.Get(boltUint32Key(address)))
+					if err != nil {
+						return fmt.Errorf("corrupt fingerprint value for address %d", address)
+					}
+					if len(addressCouples) > 0 {
+						couples[address] = addressCouples
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("error retrieving couples: %v", err)
+	}
+
+	if len(shardCouples) == 1 {
+		return shardCouples[0], nil
+	}
+	couples := make(map[uint32][]models.Couple)
+	for _, shard := range shardCouples {
+		for address, addressCouples := range shard {
+			couples[address] = addressCouples
+		}
+	}
+	return couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address,
+// one shard after the other. fn runs inside a read transaction, so it must
+// not write to db.
+func (db *BoltDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	for _, shard := range db.shards {
+		err := shard.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltFingerprintsBucket).ForEach(func(key, value []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				address := binary.BigEndian.Uint32(key)
+				couples, err := couplecodec.DecodeFixed(value)
+				if err != nil {
+					return fmt.Errorf("corrupt fingerprint value for address %d", address)
+				}
+				return fn(address, couples)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *BoltDB) TotalSongs(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int
+	err := db.db.View(func(tx *bolt.Tx) error {
+		total = tx.Bucket(boltSongsBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (db *BoltDB) TotalFingerprints(ctx context.Context) (int, error) {
+	return db.countCouples(ctx, func(packed []byte) bool { return true })
+}
+
+func (db *BoltDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	return db.countCouples(ctx, func(packed []byte) bool {
+		return unpackCouple(binary.BigEndian.Uint64(packed)).SongID == songID
+	})
+}
+
+// countCouples counts the packed couples of every shard that match selects
+func (db *BoltDB) countCouples(ctx context.Context, selects func(packed []byte) bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	counts := make([]int, len(db.shards))
+	err := db.forEachShard(func(i int, shard *bolt.DB) error {
+		return shard.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltFingerprintsBucket).ForEach(func(key, value []byte) error {
+				for j := 0; j+8 <= len(value); j += 8 {
+					if selects(value[j : j+8]) {
+						counts[i]++
+					}
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count fingerprints: %v", err)
+	}
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total, nil
+}
+
+// StorageSize returns the size of the database file and of its shards
+func (db *BoltDB) StorageSize(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sizes := make([]int64, len(db.shards))
+	err := db.forEachShard(func(i int, shard *bolt.DB) error {
+		return shard.View(func(tx *bolt.Tx) error {
+			sizes[i] = tx.Size()
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, nil
+}
+
+func (db *BoltDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints stores the fingerprints of a song, then
+// registers it. See storeBeforeRegistering.
+func (db *BoltDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	err := storeBeforeRegistering(ctx, db, songID, fingerprint(songID), func() error {
+		return db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+func (db *BoltDB) registerSong(ctx context.Context, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := GenerateSongKey(songTitle, songArtist)
+	id := boltUint32Key(songID)
+	unique := []byte(ytID + "|" + key)
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		uniqueBucket := tx.Bucket(boltSongUniqueBucket)
+		if uniqueBucket.Get(unique) != nil {
+			return fmt.Errorf("song with ytID or key already exists: %s", unique)
+		}
+
+		if err := uniqueBucket.Put(unique, id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltSongsBucket).Put(id, encodeSong(Song{Title: songTitle, Artist: songArtist, YouTubeID: ytID, SongMetadata: meta}, key)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltSongKeysBucket).Put([]byte(key), id); err != nil {
+			return err
+		}
+		if ytID == "" {
+			return nil
+		}
+		return tx.Bucket(boltSongYTIDsBucket).Put([]byte(ytID), id)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return nil
+}
+
+func (db *BoltDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+	if err := ctx.Err(); err != nil {
+		return Song{}, false, err
+	}
+
+	var song Song
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var id []byte
+		switch field {
+		case SongFieldID:
+			songID, ok := value.(uint32)
+			if !ok {
+				return fmt.Errorf("invalid song ID: %v", value)
+			}
+			id = boltUint32Key(songID)
+		case SongFieldYTID:
+			id = tx.Bucket(boltSongYTIDsBucket).Get([]byte(fmt.Sprint(value)))
+		case SongFieldKey:
+			id = tx.Bucket(boltSongKeysBucket).Get([]byte(fmt.Sprint(value)))
+		default:
+			return errSongField(field)
+		}
+		if id == nil {
+			return nil
+		}
+
+		data := tx.Bucket(boltSongsBucket).Get(id)
+		if data == nil {
+			return nil
+		}
+
+		decoded, _, err := decodeSong(data)
+		if err != nil {
+			return err
+		}
+		song = decoded
+		song.ID = binary.BigEndian.Uint32(id)
+		songExists = true
+		return nil
+	})
+	if err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+
+	return song, songExists, nil
+}
+
+func (db *BoltDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *BoltDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *BoltDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+// ListSongs returns a page of songs. Songs are keyed by ID, so every song
+// is loaded and sorted in memory.
+func (db *BoltDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	songs := []Song{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSongsBucket).ForEach(func(id, data []byte) error {
+			song, _, err := decodeSong(data)
+			if err != nil {
+				return err
+			}
+			song.ID = binary.BigEndian.Uint32(id)
+			songs = append(songs, song)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return pageSongs(songs, offset, limit, sortBy)
+}
+
+// SearchSongs ranks every song, since Bolt has no text queries
+func (db *BoltDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *BoltDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.DeleteSongs(ctx, []uint32{songID})
+}
+
+// DeleteSongs deletes songs along with their fingerprints, removing the
+// couples of them all in one pass over every shard. The songs are deleted
+// first, with the fingerprints of the first shard, so those of the other
+// shards are only orphaned if deleting them fails.
+func (db *BoltDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deleted := make(map[uint32]bool, len(songIDs))
+	for _, songID := range songIDs {
+		deleted[songID] = true
+	}
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		for _, songID := range songIDs {
+			if err := deleteBoltSong(tx, songID); err != nil {
+				return err
+			}
+		}
+		return deleteBoltFingerprints(tx, deleted)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete songs: %v", err)
+	}
+
+	err = db.forEachShard(func(i int, shard *bolt.DB) error {
+		if i == 0 {
+			return nil
+		}
+		return shard.Update(func(tx *bolt.Tx) error {
+			return deleteBoltFingerprints(tx, deleted)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+// deleteBoltSong removes a song and the keys it is looked up by
+func deleteBoltSong(tx *bolt.Tx, songID uint32) error {
+	id := boltUint32Key(songID)
+	songs := tx.Bucket(boltSongsBucket)
+	data := songs.Get(id)
+	if data == nil {
+		return nil
+	}
+
+	song, key, err := decodeSong(data)
+	if err != nil {
+		return err
+	}
+	ytID := song.YouTubeID
+
+	if err := tx.Bucket(boltSongKeysBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	if ytID != "" {
+		if err := tx.Bucket(boltSongYTIDsBucket).Delete([]byte(ytID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltSongUniqueBucket).Delete([]byte(ytID + "|" + key)); err != nil {
+		return err
+	}
+	return songs.Delete(id)
+}
+
+// DeleteFingerprintsBySongID removes the couples of songID from every
+// address. Bolt has no index by song, so every address is scanned, in
+// every shard in parallel.
+func (db *BoltDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deleted := map[uint32]bool{songID: true}
+	err := db.forEachShard(func(i int, shard *bolt.DB) error {
+		return shard.Update(func(tx *bolt.Tx) error {
+			return deleteBoltFingerprints(tx, deleted)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+// deleteBoltFingerprints removes the couples of the songs in songIDs from
+// the fingerprints bucket, dropping the addresses left without couples
+func deleteBoltFingerprints(tx *bolt.Tx, songIDs map[uint32]bool) error {
+	bucket := tx.Bucket(boltFingerprintsBucket)
+	updates := map[string][]byte{}
+
+	err := bucket.ForEach(func(key, value []byte) error {
+		if len(value)%8 != 0 {
+			return fmt.Errorf("corrupt fingerprint value for address %d", binary.BigEndian.Uint32(key))
+		}
+
+		var kept []byte
+		for i := 0; i < len(value); i += 8 {
+			if !songIDs[unpackCouple(binary.BigEndian.Uint64(value[i:i+8])).SongID] {
+				kept = append(kept, value[i:i+8]...)
+			}
+		}
+		if len(kept) != len(value) {
+			updates[string(key)] = kept
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The bucket can't be modified while ForEach iterates over it
+	for key, value := range updates {
+		if len(value) == 0 {
+			err = bucket.Delete([]byte(key))
+		} else {
+			err = bucket.Put([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *BoltDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	var (
+		value  string
+		exists bool
+	)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(boltSettingsBucket).Get([]byte(key)); data != nil {
+			value, exists = string(data), true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	return value, exists, nil
+}
+
+func (db *BoltDB) SetSetting(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettingsBucket).Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+func (db *BoltDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeysBucket).Put([]byte(key.Hash), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *BoltDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, false, err
+	}
+
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltAPIKeysBucket).Get([]byte(hash)); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+	if data == nil {
+		return APIKey{}, false, nil
+	}
+
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return APIKey{}, false, fmt.Errorf("invalid API key %s: %v", hash, err)
+	}
+
+	return key, true, nil
+}
+
+func (db *BoltDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeysBucket).ForEach(func(_, value []byte) error {
+			values = append(values, string(value))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+
+	return decodeAPIKeys(values)
+}
+
+func (db *BoltDB) DeleteAPIKey(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAPIKeysBucket)
+		var hashes [][]byte
+		err := bucket.ForEach(func(hash, value []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(value, &key); err == nil && key.ID == id {
+				hashes = append(hashes, append([]byte(nil), hash...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			if err := bucket.Delete(hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *BoltDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecognitionsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		recognition.ID = strconv.FormatUint(id, 10)
+		data, err := json.Marshal(recognition)
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+// ListRecognitions walks the recognitions from the newest. Filtering by
+// client scans the whole history.
+func (db *BoltDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	recognitions := []Recognition{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltRecognitionsBucket).Cursor()
+		skipped := 0
+		for key, value := cursor.Last(); key != nil && len(recognitions) < limit; key, value = cursor.Prev() {
+			var recognition Recognition
+			if err := json.Unmarshal(value, &recognition); err != nil {
+				return fmt.Errorf("invalid recognition %d: %v", binary.BigEndian.Uint64(key), err)
+			}
+			if clientID != "" && recognition.ClientID != clientID {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			recognitions = append(recognitions, recognition)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+
+	return recognitions, nil
+}
+
+// boltAirplayKey returns the key of an airplay that started at started, or
+// the first key of those that started then when seq is 0
+func boltAirplayKey(started time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(started.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func (db *BoltDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAirplayBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		airplay.ID = strconv.FormatUint(id, 10)
+		data, err := json.Marshal(airplay)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltAirplayKey(airplay.Started, id), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+// ListAirplays walks the airplays back from filter.To. Filtering by station
+// scans every airplay of the time range.
+func (db *BoltDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	airplays := []Airplay{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltAirplayBucket).Cursor()
+		key, value := cursor.Last()
+		if !filter.To.IsZero() {
+			// Seek lands on the first airplay started at To or later
+			if key, _ = cursor.Seek(boltAirplayKey(filter.To, 0)); key == nil {
+				key, value = cursor.Last()
+			} else {
+				key, value = cursor.Prev()
+			}
+		}
+
+		skipped := 0
+		for ; key != nil && len(airplays) < limit; key, value = cursor.Prev() {
+			var airplay Airplay
+			if err := json.Unmarshal(value, &airplay); err != nil {
+				return fmt.Errorf("invalid airplay %d: %v", binary.BigEndian.Uint64(key[8:]), err)
+			}
+			if !filter.From.IsZero() && airplay.Started.Before(filter.From) {
+				break
+			}
+			if !filter.matches(airplay) {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			airplays = append(airplays, airplay)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+
+	return airplays, nil
+}
+
+// DeleteCollection empties the buckets belonging to the "songs", "fingerprints", "settings", "recognitions" or "airplay" collection
+func (db *BoltDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	var buckets [][]byte
+	switch collectionName {
+	case "fingerprints":
+		buckets = [][]byte{boltFingerprintsBucket}
+	case "settings":
+		buckets = [][]byte{boltSettingsBucket}
+	case "recognitions":
+		buckets = [][]byte{boltRecognitionsBucket}
+	case "airplay":
+		buckets = [][]byte{boltAirplayBucket}
+	case "songs":
+		buckets = [][]byte{boltSongsBucket, boltSongKeysBucket, boltSongYTIDsBucket, boltSongUniqueBucket}
+	default:
+		return fmt.Errorf("error deleting collection: unknown collection %q", collectionName)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Only fingerprints are sharded
+	shards := db.shards[:1]
+	if collectionName == "fingerprints" {
+		shards = db.shards
+	}
+
+	for _, shard := range shards {
+		err := shard.Update(func(tx *bolt.Tx) error {
+			// The number of shards outlives the other settings
+			var shardCount []byte
+			if collectionName == "settings" {
+				shardCount = bytes.Clone(tx.Bucket(boltSettingsBucket).Get([]byte(boltShardsSetting)))
+			}
+
+			for _, name := range buckets {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+				if _, err := tx.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+
+			if shardCount != nil {
+				return tx.Bucket(boltSettingsBucket).Put([]byte(boltShardsSetting), shardCount)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrations returns the schema migrations of the bolt backend
+func (db *BoltDB) migrations() []Migration {
+	return []Migration{
+		songKeyMigration(1, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		songKeyMigration(2, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *BoltDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	var songs []storedSongKey
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSongsBucket).ForEach(func(id, data []byte) error {
+			song, key, err := decodeSong(data)
+			if err != nil {
+				return err
+			}
+			songs = append(songs, storedSongKey{
+				ID:        binary.BigEndian.Uint32(id),
+				YouTubeID: song.YouTubeID,
+				Title:     song.Title,
+				Artist:    song.Artist,
+				Key:       key,
+			})
+			return nil
+		})
+	})
+	return songs, err
+}
+
+// rekeySong saves a song and the keys it is looked up by under key
+func (db *BoltDB) rekeySong(ctx context.Context, stored storedSongKey, key string) error {
+	id := boltUint32Key(stored.ID)
+	return db.db.Update(func(tx *bolt.Tx) error {
+		songs := tx.Bucket(boltSongsBucket)
+		data := songs.Get(id)
+		if data == nil {
+			return nil
+		}
+		song, oldKey, err := decodeSong(data)
+		if err != nil {
+			return err
+		}
+
+		if err := songs.Put(id, encodeSong(song, key)); err != nil {
+			return err
+		}
+		keys, unique := tx.Bucket(boltSongKeysBucket), tx.Bucket(boltSongUniqueBucket)
+		if string(keys.Get([]byte(oldKey))) == string(id) {
+			if err := keys.Delete([]byte(oldKey)); err != nil {
+				return err
+			}
+		}
+		if err := keys.Put([]byte(key), id); err != nil {
+			return err
+		}
+		if err := unique.Delete([]byte(song.YouTubeID + "|" + oldKey)); err != nil {
+			return err
+		}
+		return unique.Put([]byte(song.YouTubeID+"|"+key), id)
+	})
+}
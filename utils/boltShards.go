@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltShards is the number of files the fingerprints of a bolt database
+// are split over, by address modulo boltShards. bbolt writes one
+// transaction per file at a time, so shards let ingestion write several at
+// once, and lookups read them in parallel. Set with BOLT_SHARDS. A new
+// database takes the number it is first opened with, and an existing one
+// is split differently with ReshardBolt.
+var boltShards = max(intFromEnv("BOLT_SHARDS", 1), 1)
+
+// boltShardsSetting records in the main file how many shards the
+// fingerprints are split over, as "<n>", or as "<from>><to>" while they are
+// moved. Databases without it have one shard.
+const boltShardsSetting = "boltShards"
+
+// boltReshardBatchSize is the number of addresses ReshardBolt moves per
+// transaction
+const boltReshardBatchSize = 10000
+
+// boltShardPath returns the file of shard i of the database at path. The
+// first shard is the database file itself. Catalog names can't have a
+// dash, so shard files never clash with catalog files.
+func boltShardPath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-shard" + strconv.Itoa(i) + ext
+}
+
+// parseBoltShards parses the value of boltShardsSetting. to is from unless
+// the fingerprints are being moved.
+func parseBoltShards(value string) (from, to int, err error) {
+	fromValue, toValue, moving := strings.Cut(value, ">")
+	if !moving {
+		toValue = fromValue
+	}
+	if from, err = strconv.Atoi(fromValue); err == nil {
+		to, err = strconv.Atoi(toValue)
+	}
+	if err != nil || from < 1 || to < 1 {
+		return 0, 0, fmt.Errorf("invalid %s setting %q", boltShardsSetting, value)
+	}
+	return from, to, nil
+}
+
+// readBoltShards returns the value of boltShardsSetting in the main file
+// db, nil if it isn't set, and whether the file has no fingerprints
+func readBoltShards(db *bolt.DB) (value []byte, empty bool, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		value = bytes.Clone(tx.Bucket(boltSettingsBucket).Get([]byte(boltShardsSetting)))
+		key, _ := tx.Bucket(boltFingerprintsBucket).Cursor().First()
+		empty = key == nil
+		return nil
+	})
+	return value, empty, err
+}
+
+// writeBoltShards sets boltShardsSetting in the main file db
+func writeBoltShards(db *bolt.DB, value string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettingsBucket).Put([]byte(boltShardsSetting), []byte(value))
+	})
+}
+
+// openShards opens the shards of the database after the first, checking
+// that its fingerprints are split over boltShards of them
+func (db *BoltDB) openShards() error {
+	value, empty, err := readBoltShards(db.db)
+	if err != nil {
+		return fmt.Errorf("error reading the shards of %s: %v", db.path, err)
+	}
+
+	count := 1
+	switch {
+	case value != nil:
+		from, to, err := parseBoltShards(string(value))
+		if err != nil {
+			return err
+		}
+		if from != to {
+			return fmt.Errorf("moving the fingerprints of %s from %d to %d shards didn't finish, run reshard again", db.path, from, to)
+		}
+		count = from
+	case empty && boltShards > 1 && !readOnly:
+		if err := writeBoltShards(db.db, strconv.Itoa(boltShards)); err != nil {
+			return fmt.Errorf("error recording the shards of %s: %v", db.path, err)
+		}
+		count = boltShards
+	}
+
+	if count != boltShards {
+		return fmt.Errorf("the fingerprints of %s are split over %d shards but BOLT_SHARDS is %d, run reshard to change it", db.path, count, boltShards)
+	}
+
+	for i := 1; i < count; i++ {
+		path := boltShardPath(db.path, i)
+		shard, err := openBoltFile(path, [][]byte{boltFingerprintsBucket})
+		if err != nil {
+			return err
+		}
+		db.shards = append(db.shards, shard)
+		db.shardPaths = append(db.shardPaths, path)
+	}
+	return nil
+}
+
+// shardOf returns the index of the shard the fingerprints of address are in
+func (db *BoltDB) shardOf(address uint32) int {
+	return int(address % uint32(len(db.shards)))
+}
+
+// forEachShard calls fn with every shard in parallel, and returns the errors
+// it returned
+func (db *BoltDB) forEachShard(fn func(i int, shard *bolt.DB) error) error {
+	if len(db.shards) == 1 {
+		return fn(0, db.shards[0])
+	}
+
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, shard := range db.shards {
+		wg.Add(1)
+		go func(i int, shard *bolt.DB) {
+			defer wg.Done()
+			errs[i] = fn(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// errBoltBatchFull stops collecting a batch of addresses to move
+var errBoltBatchFull = errors.New("batch full")
+
+// ReshardBolt splits the fingerprints of the bolt database of the catalog
+// selected by ctx over shards files, moving every address to the file of
+// its new shard and deleting the files left empty. Nothing else may use
+// the database while it runs; an interrupted run is finished by running it
+// again. It returns the number of addresses moved.
+func ReshardBolt(ctx context.Context, shards int) (int, error) {
+	if storageType != "bolt" && storageType != "bbolt" {
+		return 0, errors.New("only the bolt backend is sharded")
+	}
+	if readOnly {
+		return 0, ErrReadOnly
+	}
+	if shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards: %d", shards)
+	}
+	catalog := CatalogFromContext(ctx)
+	if !ValidCatalog(catalog) {
+		return 0, fmt.Errorf("invalid catalog name: %q", catalog)
+	}
+
+	path := boltPath(catalog)
+	main, err := openBoltFile(path, boltBuckets)
+	if err != nil {
+		return 0, err
+	}
+	defer closeBoltFile(path)
+
+	value, _, err := readBoltShards(main)
+	if err != nil {
+		return 0, fmt.Errorf("error reading the shards of %s: %v", path, err)
+	}
+	from, to := 1, 1
+	if value != nil {
+		if from, to, err = parseBoltShards(string(value)); err != nil {
+			return 0, err
+		}
+	}
+
+	// Record the move first, so the database isn't used half moved
+	if err := writeBoltShards(main, fmt.Sprintf("%d>%d", from, shards)); err != nil {
+		return 0, fmt.Errorf("error recording the shards of %s: %v", path, err)
+	}
+
+	// An interrupted run may have left addresses in the files of its own
+	// target too
+	files := max(from, to, shards)
+	handles := make([]*bolt.DB, files)
+	for i := range handles {
+		shardPath := boltShardPath(path, i)
+		if i > 0 {
+			handles[i], err = openBoltFile(shardPath, [][]byte{boltFingerprintsBucket})
+			if err != nil {
+				return 0, err
+			}
+			defer closeBoltFile(shardPath)
+		} else {
+			handles[i] = main
+		}
+	}
+
+	moved := 0
+	for i, handle := range handles {
+		for {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+
+			n, err := moveBoltBatch(handle, i, handles[:shards])
+			if err != nil {
+				return moved, fmt.Errorf("error moving fingerprints out of %s: %v", boltShardPath(path, i), err)
+			}
+			if n == 0 {
+				break
+			}
+			moved += n
+		}
+	}
+
+	// The files past the last shard are empty now
+	for i := shards; i < files; i++ {
+		if i == 0 {
+			continue
+		}
+		shardPath := boltShardPath(path, i)
+		if err := closeBoltFile(shardPath); err != nil {
+			return moved, err
+		}
+		if err := os.Remove(shardPath); err != nil {
+			return moved, err
+		}
+	}
+
+	if err := writeBoltShards(main, strconv.Itoa(shards)); err != nil {
+		return moved, fmt.Errorf("error recording the shards of %s: %v", path, err)
+	}
+	return moved, nil
+}
+
+// moveBoltBatch moves up to boltReshardBatchSize addresses of the file at
+// index i that belong to another of shards there, and returns how many it
+// moved. Addresses are added to their new shard before being deleted from
+// the old one, so an interrupted move loses nothing.
+func moveBoltBatch(file *bolt.DB, i int, shards []*bolt.DB) (int, error) {
+	batch := map[int]map[string][]byte{}
+	n := 0
+	err := file.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFingerprintsBucket).ForEach(func(key, value []byte) error {
+			target := int(binary.BigEndian.Uint32(key) % uint32(len(shards)))
+			if target == i {
+				return nil
+			}
+			if batch[target] == nil {
+				batch[target] = map[string][]byte{}
+			}
+			batch[target][string(key)] = bytes.Clone(value)
+			n++
+			if n == boltReshardBatchSize {
+				return errBoltBatchFull
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errBoltBatchFull {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	for target, values := range batch {
+		err := shards[target].Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltFingerprintsBucket)
+			for key, value := range values {
+				if err := addBoltCouples(bucket, []byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = file.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltFingerprintsBucket)
+		for _, values := range batch {
+			for key := range values {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
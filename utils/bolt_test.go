@@ -0,0 +1,20 @@
+package utils_test
+
+import (
+	"path/filepath"
+	"song-recognition/storagetest"
+	"song-recognition/utils"
+	"testing"
+)
+
+func TestBoltConformance(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "song-recognition.db"))
+
+	storagetest.Run(t, func() utils.DBClient {
+		db, err := utils.NewBoltDB(utils.DefaultCatalog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
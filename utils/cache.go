@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"song-recognition/config"
+	"song-recognition/metrics"
+	"song-recognition/models"
+	"strconv"
+	"sync"
+)
+
+// couplesCache is the process-wide GetCouples cache, shared by every client
+// NewDBClient returns. It is nil when COUPLES_CACHE_SIZE is unset or 0.
+var couplesCache = newCouplesCacheFromEnv()
+
+func newCouplesCacheFromEnv() *addressCache {
+	size, err := strconv.Atoi(GetEnv("COUPLES_CACHE_SIZE", "0"))
+	if err != nil || size <= 0 {
+		return nil
+	}
+	return newAddressCache(size)
+}
+
+// A reload resizes the cache, down to nothing with a size of 0. A cache
+// disabled when the process started stays disabled, since the clients
+// created meanwhile don't use it.
+func init() {
+	config.OnReload(func() {
+		if couplesCache != nil {
+			couplesCache.resize(intFromEnv("COUPLES_CACHE_SIZE", 0))
+		}
+	})
+}
+
+// CacheStats reports how the couples cache has been used
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Size     int
+	Capacity int
+}
+
+// CouplesCacheStats returns the couples cache statistics, and false when
+// the cache is disabled
+func CouplesCacheStats() (CacheStats, bool) {
+	if couplesCache == nil {
+		return CacheStats{}, false
+	}
+	return couplesCache.stats(), true
+}
+
+// addressCache is an LRU cache from fingerprint addresses to their couples.
+// Catalogs share its capacity but not its entries.
+type addressCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used
+	entries  map[addressCacheKey]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type addressCacheKey struct {
+	catalog string
+	address uint32
+}
+
+type addressCacheEntry struct {
+	key     addressCacheKey
+	couples []models.Couple
+}
+
+func newAddressCache(capacity int) *addressCache {
+	return &addressCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[addressCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached couples of the addresses of catalog found in the
+// cache and the addresses that were not
+func (c *addressCache) get(catalog string, addresses []uint32) (map[uint32][]models.Couple, []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := make(map[uint32][]models.Couple)
+	var missing []uint32
+	for _, address := range addresses {
+		elem, ok := c.entries[addressCacheKey{catalog, address}]
+		if !ok {
+			missing = append(missing, address)
+			continue
+		}
+		c.order.MoveToFront(elem)
+		if couples := elem.Value.(*addressCacheEntry).couples; len(couples) > 0 {
+			found[address] = couples
+		}
+	}
+
+	hits, misses := len(addresses)-len(missing), len(missing)
+	c.hits += uint64(hits)
+	c.misses += uint64(misses)
+	metrics.CouplesCacheLookups.WithLabelValues("hit").Add(float64(hits))
+	metrics.CouplesCacheLookups.WithLabelValues("miss").Add(float64(misses))
+
+	return found, missing
+}
+
+// add caches the couples of addresses of catalog, including the addresses
+// that have none so that they are not looked up again
+func (c *addressCache) add(catalog string, addresses []uint32, couples map[uint32][]models.Couple) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, address := range addresses {
+		key := addressCacheKey{catalog, address}
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*addressCacheEntry).couples = couples[address]
+			c.order.MoveToFront(elem)
+			continue
+		}
+
+		c.entries[key] = c.order.PushFront(&addressCacheEntry{key, couples[address]})
+		if c.order.Len() > c.capacity {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*addressCacheEntry).key)
+		}
+	}
+}
+
+// remove drops addresses of catalog from the cache
+func (c *addressCache) remove(catalog string, addresses []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, address := range addresses {
+		key := addressCacheKey{catalog, address}
+		if elem, ok := c.entries[key]; ok {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear drops every address of catalog from the cache
+func (c *addressCache) clear(catalog string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if key.catalog == catalog {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// resize changes the capacity of the cache, evicting the least recently
+// used addresses beyond it
+func (c *addressCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*addressCacheEntry).key)
+	}
+}
+
+func (c *addressCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Size: c.order.Len(), Capacity: c.capacity}
+}
+
+// cachedDB serves GetCouples from an addressCache and keeps the cache in
+// sync with the writes made through it. Writes made by other processes are
+// not seen until the affected addresses are evicted.
+type cachedDB struct {
+	DBClient
+	cache   *addressCache
+	catalog string
+}
+
+func (db *cachedDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples, missing := db.cache.get(db.catalog, addresses)
+	if len(missing) == 0 {
+		return couples, nil
+	}
+
+	fetched, err := db.DBClient.GetCouples(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	db.cache.add(db.catalog, missing, fetched)
+
+	for address, addressCouples := range fetched {
+		couples[address] = addressCouples
+	}
+	return couples, nil
+}
+
+func (db *cachedDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+
+	err := db.DBClient.StoreFingerprints(ctx, fingerprints)
+	db.cache.remove(db.catalog, addresses)
+	return err
+}
+
+func (db *cachedDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	var addresses []uint32
+	songID, err := db.DBClient.RegisterSongWithFingerprints(ctx, songTitle, songArtist, ytID, meta, func(songID uint32) map[uint32]models.Couple {
+		fingerprints := fingerprint(songID)
+		addresses = make([]uint32, 0, len(fingerprints))
+		for address := range fingerprints {
+			addresses = append(addresses, address)
+		}
+		return fingerprints
+	})
+	db.cache.remove(db.catalog, addresses)
+	return songID, err
+}
+
+func (db *cachedDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	err := db.DBClient.DeleteSongByID(ctx, songID)
+	db.cache.clear(db.catalog)
+	return err
+}
+
+func (db *cachedDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	err := db.DBClient.DeleteSongs(ctx, songIDs)
+	db.cache.clear(db.catalog)
+	return err
+}
+
+func (db *cachedDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	err := db.DBClient.DeleteFingerprintsBySongID(ctx, songID)
+	db.cache.clear(db.catalog)
+	return err
+}
+
+func (db *cachedDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	err := db.DBClient.DeleteCollection(ctx, collectionName)
+	db.cache.clear(db.catalog)
+	return err
+}
@@ -0,0 +1,892 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// cassandraKeyspace is the keyspace of the default catalog, unless DB_NAME
+// is set. Other catalogs have a keyspace named after it and the catalog.
+const cassandraKeyspace = "song_recognition"
+
+// maxCassandraKeyspaceLength is the longest name Cassandra accepts for a
+// keyspace
+const maxCassandraKeyspaceLength = 48
+
+// cassandraLookupConcurrency is the number of queries or batches a client
+// runs at a time. GetCouples reads a single partition from its replicas
+// per address, which spreads recognitions over the cluster.
+const cassandraLookupConcurrency = 64
+
+var (
+	// cassandraReplicationFactor is the number of copies of every row kept
+	// in the keyspaces the backend creates. Set with
+	// CASSANDRA_REPLICATION_FACTOR.
+	cassandraReplicationFactor = intFromEnv("CASSANDRA_REPLICATION_FACTOR", 1)
+
+	// cassandraLocalDC makes queries go to the nodes of that datacenter
+	// first. Set with CASSANDRA_LOCAL_DC.
+	cassandraLocalDC = GetEnv("CASSANDRA_LOCAL_DC")
+
+	// cassandraTimeout bounds every query. Set with CASSANDRA_TIMEOUT.
+	cassandraTimeout = durationFromEnv("CASSANDRA_TIMEOUT", 10*time.Second)
+
+	// cassandraBatchSize is the number of rows StoreFingerprints writes per
+	// batch. Cassandra warns about and then rejects batches that grow too
+	// large, so it is kept lower than insertBatchSize. Set with
+	// CASSANDRA_BATCH_SIZE.
+	cassandraBatchSize = max(intFromEnv("CASSANDRA_BATCH_SIZE", 100), 1)
+)
+
+var (
+	cassandraSessionMu sync.Mutex
+	// cassandraSession is shared by every CassandraDB of the process, like
+	// mongoClient, and isn't bound to a keyspace, so that catalogs share it
+	cassandraSession *gocql.Session
+
+	// cassandraKeyspaces records the keyspaces whose tables this process
+	// created
+	cassandraKeyspaces sync.Map
+)
+
+// CassandraDB is a DBClient backed by Cassandra or ScyllaDB. Fingerprints
+// are partitioned by address, so the lookups of a recognition spread
+// across the cluster, and are also kept partitioned by song, so that a
+// song's fingerprints can be deleted without scanning every address.
+// Queries are prepared once per session by the driver.
+type CassandraDB struct {
+	session  *gocql.Session
+	keyspace string
+}
+
+// sharedCassandraSession returns the session shared by every CassandraDB,
+// connecting it the first time. DB_HOST can list several nodes separated
+// by commas.
+func sharedCassandraSession() (*gocql.Session, error) {
+	cassandraSessionMu.Lock()
+	defer cassandraSessionMu.Unlock()
+
+	if cassandraSession != nil {
+		return cassandraSession, nil
+	}
+
+	hosts := strings.Split(dbHost, ",")
+	if dbHost == "" {
+		hosts = []string{"localhost"}
+	}
+	cluster := gocql.NewCluster(hosts...)
+	if dbPort != "" {
+		port, err := strconv.Atoi(dbPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_PORT: %v", err)
+		}
+		cluster.Port = port
+	}
+	if dbUsername != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: dbUsername, Password: dbPassword}
+	}
+
+	consistency, err := gocql.ParseConsistencyWrapper(GetEnv("CASSANDRA_CONSISTENCY", "LOCAL_QUORUM"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CASSANDRA_CONSISTENCY: %v", err)
+	}
+	cluster.Consistency = consistency
+	cluster.Timeout = cassandraTimeout
+	cluster.ConnectTimeout = cassandraTimeout
+
+	// Queries go straight to a replica of the partition they read or
+	// write, rather than through a coordinator that forwards them
+	fallback := gocql.RoundRobinHostPolicy()
+	if cassandraLocalDC != "" {
+		fallback = gocql.DCAwareRoundRobinPolicy(cassandraLocalDC)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(fallback)
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Cassandra: %v", err)
+	}
+
+	cassandraSession = session
+	return session, nil
+}
+
+// closeCassandraSession closes the session shared by every CassandraDB
+func closeCassandraSession() {
+	cassandraSessionMu.Lock()
+	defer cassandraSessionMu.Unlock()
+
+	if cassandraSession != nil {
+		cassandraSession.Close()
+		cassandraSession = nil
+	}
+}
+
+// newCassandraDB creates a new instance of CassandraDB for catalog, and
+// creates its keyspace and tables the first time the process opens it. A
+// read-only instance creates nothing.
+func newCassandraDB(catalog string, readOnly bool) (*CassandraDB, error) {
+	keyspace := dbName
+	if keyspace == "" {
+		keyspace = cassandraKeyspace
+	}
+	if catalog != DefaultCatalog {
+		keyspace += "_" + catalog
+	}
+	if len(keyspace) > maxCassandraKeyspaceLength {
+		return nil, fmt.Errorf("keyspace name %s is longer than %d characters, use a shorter catalog name", keyspace, maxCassandraKeyspaceLength)
+	}
+
+	session, err := sharedCassandraSession()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &CassandraDB{session: session, keyspace: keyspace}
+	if readOnly {
+		return db, nil
+	}
+	if _, done := cassandraKeyspaces.Load(keyspace); !done {
+		if err := db.createTables(context.Background()); err != nil {
+			return nil, err
+		}
+		cassandraKeyspaces.Store(keyspace, true)
+	}
+	return db, nil
+}
+
+// createTables creates the keyspace and its tables. Recognitions and
+// airplays are kept in one partition per client or station, along with one
+// for them all, ordered from the newest.
+func (db *CassandraDB) createTables(ctx context.Context) error {
+	statements := []string{
+		fmt.Sprintf(`CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}`, db.keyspace, cassandraReplicationFactor),
+		`CREATE TABLE IF NOT EXISTS ` + db.table("fingerprints") + ` (
+			address bigint,
+			song_id bigint,
+			anchor_time_ms bigint,
+			PRIMARY KEY ((address), song_id, anchor_time_ms)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("song_fingerprints") + ` (
+			song_id bigint,
+			address bigint,
+			anchor_time_ms bigint,
+			PRIMARY KEY ((song_id), address, anchor_time_ms)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("songs") + ` (
+			id bigint PRIMARY KEY,
+			title text,
+			artist text,
+			yt_id text,
+			key text,
+			album text,
+			duration int,
+			release_year int,
+			cover_url text,
+			source text,
+			source_url text,
+			provenance text
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("song_keys") + ` (key text PRIMARY KEY, id bigint)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("song_yt_ids") + ` (yt_id text PRIMARY KEY, id bigint)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("song_unique") + ` (yt_id_key text PRIMARY KEY, id bigint)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("settings") + ` (key text PRIMARY KEY, value text)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("api_keys") + ` (hash text PRIMARY KEY, data text)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("recognitions") + ` (
+			scope text,
+			id timeuuid,
+			data text,
+			PRIMARY KEY ((scope), id)
+		) WITH CLUSTERING ORDER BY (id DESC)`,
+		`CREATE TABLE IF NOT EXISTS ` + db.table("airplay") + ` (
+			scope text,
+			started timestamp,
+			id timeuuid,
+			data text,
+			PRIMARY KEY ((scope), started, id)
+		) WITH CLUSTERING ORDER BY (started DESC, id DESC)`,
+	}
+
+	for _, statement := range statements {
+		if err := db.session.Query(statement).WithContext(ctx).Exec(); err != nil {
+			return fmt.Errorf("error creating tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// table returns the name of table qualified by the keyspace of the client
+func (db *CassandraDB) table(name string) string {
+	return db.keyspace + "." + name
+}
+
+// query returns a query of the client's session bound to ctx
+func (db *CassandraDB) query(ctx context.Context, statement string, values ...interface{}) *gocql.Query {
+	return db.session.Query(statement, values...).WithContext(ctx)
+}
+
+// Close releases the client. The shared session stays open for the other
+// clients, until CloseConnections.
+func (db *CassandraDB) Close() error {
+	db.session = nil
+	return nil
+}
+
+// Ping checks that the Cassandra cluster can be reached
+func (db *CassandraDB) Ping(ctx context.Context) error {
+	var version string
+	return db.query(ctx, `SELECT release_version FROM system.local`).Scan(&version)
+}
+
+// Capabilities reports the capabilities of Cassandra. Batches of rows of
+// different partitions aren't atomic, so fingerprints are stored before
+// their song.
+func (db *CassandraDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "cassandra",
+		Transactions: false,
+		MaxBatchSize: cassandraBatchSize,
+		NativeSearch: false,
+		SharedAccess: true,
+	}
+}
+
+// StoreFingerprints writes fingerprints in unlogged batches of
+// cassandraBatchSize rows, once by address and once by song. The batches
+// by song hold a single partition, which Cassandra writes at once.
+func (db *CassandraDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	var byAddress []*gocql.Batch
+	bySong := map[uint32]*gocql.Batch{}
+	var fullBySong []*gocql.Batch
+
+	for address, couple := range fingerprints {
+		if len(byAddress) == 0 || byAddress[len(byAddress)-1].Size() == cassandraBatchSize {
+			byAddress = append(byAddress, db.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx))
+		}
+		byAddress[len(byAddress)-1].Query(`INSERT INTO `+db.table("fingerprints")+` (address, song_id, anchor_time_ms) VALUES (?, ?, ?)`,
+			int64(address), int64(couple.SongID), int64(couple.AnchorTimeMs))
+
+		batch := bySong[couple.SongID]
+		if batch == nil || batch.Size() == cassandraBatchSize {
+			if batch != nil {
+				fullBySong = append(fullBySong, batch)
+			}
+			batch = db.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+			bySong[couple.SongID] = batch
+		}
+		batch.Query(`INSERT INTO `+db.table("song_fingerprints")+` (song_id, address, anchor_time_ms) VALUES (?, ?, ?)`,
+			int64(couple.SongID), int64(address), int64(couple.AnchorTimeMs))
+	}
+
+	batches := append(byAddress, fullBySong...)
+	for _, batch := range bySong {
+		batches = append(batches, batch)
+	}
+	err := runParallel(len(batches), cassandraLookupConcurrency, func(i int) error {
+		return db.session.ExecuteBatch(batches[i])
+	})
+	if err != nil {
+		return fmt.Errorf("error storing fingerprints: %v", err)
+	}
+	return nil
+}
+
+// GetCouples reads the partition of every address, cassandraLookupConcurrency
+// at a time, rather than with an IN query that a single coordinator would
+// have to gather
+func (db *CassandraDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	results := make([][]models.Couple, len(addresses))
+	err := runParallel(len(addresses), cassandraLookupConcurrency, func(i int) error {
+		iter := db.query(ctx, `SELECT song_id, anchor_time_ms FROM `+db.table("fingerprints")+` WHERE address = ?`, int64(addresses[i])).Iter()
+		var songID, anchorTimeMs int64
+		for iter.Scan(&songID, &anchorTimeMs) {
+			results[i] = append(results[i], models.Couple{SongID: uint32(songID), AnchorTimeMs: uint32(anchorTimeMs)})
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving couples: %v", err)
+	}
+
+	couples := make(map[uint32][]models.Couple)
+	for i, address := range addresses {
+		if len(results[i]) > 0 {
+			couples[address] = append(couples[address], results[i]...)
+		}
+	}
+	return couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address. The
+// rows of a partition are read together, so an address is done once the
+// next one starts.
+func (db *CassandraDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	iter := db.query(ctx, `SELECT address, song_id, anchor_time_ms FROM `+db.table("fingerprints")).Iter()
+
+	var current int64 = -1
+	var couples []models.Couple
+	var address, songID, anchorTimeMs int64
+	for iter.Scan(&address, &songID, &anchorTimeMs) {
+		if address != current && len(couples) > 0 {
+			if err := fn(uint32(current), couples); err != nil {
+				iter.Close()
+				return err
+			}
+			couples = nil
+		}
+		current = address
+		couples = append(couples, models.Couple{SongID: uint32(songID), AnchorTimeMs: uint32(anchorTimeMs)})
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+
+	if len(couples) > 0 {
+		return fn(uint32(current), couples)
+	}
+	return nil
+}
+
+func (db *CassandraDB) TotalSongs(ctx context.Context) (int, error) {
+	var total int64
+	if err := db.query(ctx, `SELECT COUNT(*) FROM `+db.table("songs")).Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed to count songs: %v", err)
+	}
+	return int(total), nil
+}
+
+// TotalFingerprints counts the couples page by page, since a COUNT over a
+// large table times out
+func (db *CassandraDB) TotalFingerprints(ctx context.Context) (int, error) {
+	iter := db.query(ctx, `SELECT address FROM `+db.table("fingerprints")).Iter()
+	total := 0
+	var address int64
+	for iter.Scan(&address) {
+		total++
+	}
+	if err := iter.Close(); err != nil {
+		return 0, fmt.Errorf("failed to count fingerprints: %v", err)
+	}
+	return total, nil
+}
+
+func (db *CassandraDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	var total int64
+	err := db.query(ctx, `SELECT COUNT(*) FROM `+db.table("song_fingerprints")+` WHERE song_id = ?`, int64(songID)).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count fingerprints: %v", err)
+	}
+	return int(total), nil
+}
+
+// StorageSize estimates the size of the keyspace from the size estimates
+// of the node answering, which Cassandra refreshes every few minutes
+func (db *CassandraDB) StorageSize(ctx context.Context) (int64, error) {
+	iter := db.query(ctx, `SELECT mean_partition_size, partitions_count FROM system.size_estimates WHERE keyspace_name = ?`, db.keyspace).Iter()
+	var size int64
+	var meanPartitionSize, partitionsCount int64
+	for iter.Scan(&meanPartitionSize, &partitionsCount) {
+		size += meanPartitionSize * partitionsCount
+	}
+	if err := iter.Close(); err != nil {
+		return 0, fmt.Errorf("failed to get size estimates: %v", err)
+	}
+	return size, nil
+}
+
+func (db *CassandraDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints stores the fingerprints of a song, then
+// registers it. See storeBeforeRegistering.
+func (db *CassandraDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	err := storeBeforeRegistering(ctx, db, songID, fingerprint(songID), func() error {
+		return db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+func (db *CassandraDB) registerSong(ctx context.Context, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	key := GenerateSongKey(songTitle, songArtist)
+	id := int64(songID)
+
+	// Reserve the (ytID, key) pair with a lightweight transaction, so the
+	// same song can't be registered twice
+	unique := ytID + "|" + key
+	applied, err := db.query(ctx, `INSERT INTO `+db.table("song_unique")+` (yt_id_key, id) VALUES (?, ?) IF NOT EXISTS`, unique, id).
+		MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+	if !applied {
+		return fmt.Errorf("song with ytID or key already exists: %s", unique)
+	}
+
+	batch := db.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`INSERT INTO `+db.table("songs")+` (id, title, artist, yt_id, key, album, duration, release_year, cover_url, source, source_url, provenance, recording_mbid, release_mbid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, songTitle, songArtist, ytID, key, meta.Album, meta.Duration, meta.ReleaseYear, meta.CoverURL, meta.Source, meta.SourceURL, meta.Provenance.encode(),
+		meta.RecordingMBID, meta.ReleaseMBID)
+	batch.Query(`INSERT INTO `+db.table("song_keys")+` (key, id) VALUES (?, ?)`, key, id)
+	if ytID != "" {
+		batch.Query(`INSERT INTO `+db.table("song_yt_ids")+` (yt_id, id) VALUES (?, ?)`, ytID, id)
+	}
+	if err := db.session.ExecuteBatch(batch); err != nil {
+		db.query(context.WithoutCancel(ctx), `DELETE FROM `+db.table("song_unique")+` WHERE yt_id_key = ?`, unique).Exec()
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return nil
+}
+
+// cassandraSongColumns are the columns a song is read from, in the order
+// of scanSong
+const cassandraSongColumns = "id, title, artist, yt_id, key, album, duration, release_year, cover_url, source, source_url, provenance, recording_mbid, release_mbid"
+
+// scanSong reads a row of cassandraSongColumns into a Song
+func scanSong(scan func(dest ...interface{}) bool) (Song, bool) {
+	var song Song
+	var id int64
+	var key, provenance string
+	if !scan(&id, &song.Title, &song.Artist, &song.YouTubeID, &key, &song.Album, &song.Duration, &song.ReleaseYear,
+		&song.CoverURL, &song.Source, &song.SourceURL, &provenance, &song.RecordingMBID, &song.ReleaseMBID) {
+		return Song{}, false
+	}
+	song.ID = uint32(id)
+	song.Provenance = decodeSongProvenance(provenance)
+	return song, true
+}
+
+func (db *CassandraDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+
+	var id int64
+	switch field {
+	case SongFieldID:
+		songID, err := strconv.ParseUint(fmt.Sprint(value), 10, 32)
+		if err != nil {
+			return Song{}, false, fmt.Errorf("invalid song ID %v", value)
+		}
+		id = int64(songID)
+	case SongFieldYTID, SongFieldKey:
+		if value == "" {
+			// Songs without a YouTube ID aren't indexed by it
+			return Song{}, false, nil
+		}
+
+		lookup := `SELECT id FROM ` + db.table("song_yt_ids") + ` WHERE yt_id = ?`
+		if field == SongFieldKey {
+			lookup = `SELECT id FROM ` + db.table("song_keys") + ` WHERE key = ?`
+		}
+		if err := db.query(ctx, lookup, fmt.Sprint(value)).Scan(&id); err != nil {
+			if errors.Is(err, gocql.ErrNotFound) {
+				return Song{}, false, nil
+			}
+			return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+		}
+	default:
+		return Song{}, false, errSongField(field)
+	}
+
+	iter := db.query(ctx, `SELECT `+cassandraSongColumns+` FROM `+db.table("songs")+` WHERE id = ?`, id).Iter()
+	song, found := scanSong(iter.Scan)
+	if err := iter.Close(); err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+	return song, found, nil
+}
+
+func (db *CassandraDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *CassandraDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *CassandraDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+// ListSongs returns a page of songs. Cassandra can only sort the rows of a
+// partition, so every song is loaded and sorted in memory.
+func (db *CassandraDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	iter := db.query(ctx, `SELECT `+cassandraSongColumns+` FROM `+db.table("songs")).Iter()
+	songs := []Song{}
+	for {
+		song, ok := scanSong(iter.Scan)
+		if !ok {
+			break
+		}
+		songs = append(songs, song)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return pageSongs(songs, offset, limit, sortBy)
+}
+
+// SearchSongs ranks every song, since Cassandra has no text queries
+func (db *CassandraDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *CassandraDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.DeleteSongs(ctx, []uint32{songID})
+}
+
+// DeleteSongs deletes songs along with their fingerprints
+func (db *CassandraDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	for _, songID := range songIDs {
+		if err := db.DeleteFingerprintsBySongID(ctx, songID); err != nil {
+			return err
+		}
+		if err := db.deleteSong(ctx, songID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSong removes a song and the rows it is looked up by
+func (db *CassandraDB) deleteSong(ctx context.Context, songID uint32) error {
+	var ytID, key string
+	err := db.query(ctx, `SELECT yt_id, key FROM `+db.table("songs")+` WHERE id = ?`, int64(songID)).Scan(&ytID, &key)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	batch := db.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`DELETE FROM `+db.table("songs")+` WHERE id = ?`, int64(songID))
+	batch.Query(`DELETE FROM `+db.table("song_keys")+` WHERE key = ?`, key)
+	batch.Query(`DELETE FROM `+db.table("song_unique")+` WHERE yt_id_key = ?`, ytID+"|"+key)
+	if ytID != "" {
+		batch.Query(`DELETE FROM `+db.table("song_yt_ids")+` WHERE yt_id = ?`, ytID)
+	}
+	if err := db.session.ExecuteBatch(batch); err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteFingerprintsBySongID removes the couples of songID from the
+// addresses its partition by song lists, then that partition
+func (db *CassandraDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	iter := db.query(ctx, `SELECT DISTINCT address FROM `+db.table("song_fingerprints")+` WHERE song_id = ?`, int64(songID)).Iter()
+	var addresses []int64
+	var address int64
+	for iter.Scan(&address) {
+		addresses = append(addresses, address)
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	err := runParallel(len(addresses), cassandraLookupConcurrency, func(i int) error {
+		return db.query(ctx, `DELETE FROM `+db.table("fingerprints")+` WHERE address = ? AND song_id = ?`, addresses[i], int64(songID)).Exec()
+	})
+	if err == nil {
+		err = db.query(ctx, `DELETE FROM `+db.table("song_fingerprints")+` WHERE song_id = ?`, int64(songID)).Exec()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+func (db *CassandraDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := db.query(ctx, `SELECT value FROM `+db.table("settings")+` WHERE key = ?`, key).Scan(&value)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	return value, true, nil
+}
+
+func (db *CassandraDB) SetSetting(ctx context.Context, key, value string) error {
+	if err := db.query(ctx, `INSERT INTO `+db.table("settings")+` (key, value) VALUES (?, ?)`, key, value).Exec(); err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CassandraDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	if err := db.query(ctx, `INSERT INTO `+db.table("api_keys")+` (hash, data) VALUES (?, ?)`, key.Hash, string(data)).Exec(); err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CassandraDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	var data string
+	err := db.query(ctx, `SELECT data FROM `+db.table("api_keys")+` WHERE hash = ?`, hash).Scan(&data)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return APIKey{}, false, fmt.Errorf("invalid API key %s: %v", hash, err)
+	}
+
+	return key, true, nil
+}
+
+func (db *CassandraDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	values, err := db.scanStrings(ctx, `SELECT data FROM `+db.table("api_keys"), 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+
+	return decodeAPIKeys(values)
+}
+
+func (db *CassandraDB) DeleteAPIKey(ctx context.Context, id string) error {
+	keys, err := db.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key.ID == id {
+			if err := db.query(ctx, `DELETE FROM `+db.table("api_keys")+` WHERE hash = ?`, key.Hash).Exec(); err != nil {
+				return fmt.Errorf("failed to delete API key: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scanStrings returns the limit values of the single column query selects
+// after skipping offset of them, or all of them from offset when limit
+// isn't positive. Cassandra has no OFFSET, so skipped rows are still read.
+func (db *CassandraDB) scanStrings(ctx context.Context, query string, offset, limit int, values ...interface{}) ([]string, error) {
+	iter := db.query(ctx, query, values...).Iter()
+	var results []string
+	var value string
+	for i := 0; (limit <= 0 || len(results) < limit) && iter.Scan(&value); i++ {
+		if i >= offset {
+			results = append(results, value)
+		}
+	}
+	return results, iter.Close()
+}
+
+// StoreRecognition adds recognition to the history of every client, and to
+// the history of its own client
+func (db *CassandraDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	id := gocql.TimeUUID()
+	recognition.ID = id.String()
+	data, err := json.Marshal(recognition)
+	if err != nil {
+		return err
+	}
+
+	batch := db.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	insert := `INSERT INTO ` + db.table("recognitions") + ` (scope, id, data) VALUES (?, ?, ?)`
+	batch.Query(insert, "all", id, string(data))
+	if recognition.ClientID != "" {
+		batch.Query(insert, "client:"+recognition.ClientID, id, string(data))
+	}
+	if err := db.session.ExecuteBatch(batch); err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CassandraDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	scope := "all"
+	if clientID != "" {
+		scope = "client:" + clientID
+	}
+
+	values, err := db.scanStrings(ctx, `SELECT data FROM `+db.table("recognitions")+` WHERE scope = ?`, offset, limit, scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+
+	return decodeRecognitions(values)
+}
+
+// StoreAirplay adds airplay to the airplays of every station, and to those
+// of its own station
+func (db *CassandraDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	id := gocql.TimeUUID()
+	airplay.ID = id.String()
+	data, err := json.Marshal(airplay)
+	if err != nil {
+		return err
+	}
+
+	batch := db.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	insert := `INSERT INTO ` + db.table("airplay") + ` (scope, started, id, data) VALUES (?, ?, ?, ?)`
+	batch.Query(insert, "all", airplay.Started, id, string(data))
+	batch.Query(insert, "station:"+airplay.Station, airplay.Started, id, string(data))
+	if err := db.session.ExecuteBatch(batch); err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CassandraDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	scope := "all"
+	if filter.Station != "" {
+		scope = "station:" + filter.Station
+	}
+
+	query := `SELECT data FROM ` + db.table("airplay") + ` WHERE scope = ?`
+	values := []interface{}{scope}
+	if !filter.From.IsZero() {
+		query += ` AND started >= ?`
+		values = append(values, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += ` AND started < ?`
+		values = append(values, filter.To)
+	}
+
+	data, err := db.scanStrings(ctx, query, offset, limit, values...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+
+	return decodeAirplays(data)
+}
+
+// cassandraCollections are the tables of every collection DeleteCollection
+// accepts
+var cassandraCollections = map[string][]string{
+	"songs":        {"songs", "song_keys", "song_yt_ids", "song_unique"},
+	"fingerprints": {"fingerprints", "song_fingerprints"},
+	"settings":     {"settings"},
+	"recognitions": {"recognitions"},
+	"airplay":      {"airplay"},
+}
+
+// DeleteCollection truncates the tables of the "songs", "fingerprints",
+// "settings", "recognitions" or "airplay" collection
+func (db *CassandraDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	tables, ok := cassandraCollections[collectionName]
+	if !ok {
+		return fmt.Errorf("error deleting collection: unknown collection %q", collectionName)
+	}
+
+	for _, table := range tables {
+		if err := db.query(ctx, `TRUNCATE `+db.table(table)).Exec(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// migrations returns the schema migrations of the Cassandra backend.
+// createTables sets up version 0.
+func (db *CassandraDB) migrations() []Migration {
+	return []Migration{
+		songKeyMigration(1, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		{
+			Version:     2,
+			Description: "add song MusicBrainz ID columns",
+			Up: func(ctx context.Context) error {
+				for _, column := range []string{"recording_mbid", "release_mbid"} {
+					exists, err := db.columnExists(ctx, "songs", column)
+					if err != nil {
+						return err
+					}
+					if exists {
+						continue
+					}
+					if err := db.query(ctx, `ALTER TABLE `+db.table("songs")+` ADD `+column+` text`).Exec(); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Down: func(ctx context.Context) error {
+				return db.query(ctx, `ALTER TABLE `+db.table("songs")+` DROP (recording_mbid, release_mbid)`).Exec()
+			},
+		},
+		songKeyMigration(3, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// columnExists reports whether the table of the keyspace has the column
+func (db *CassandraDB) columnExists(ctx context.Context, table, column string) (bool, error) {
+	var name string
+	err := db.query(ctx, `SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`,
+		db.keyspace, table, column).Scan(&name)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *CassandraDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	iter := db.query(ctx, `SELECT id, yt_id, title, artist, key FROM `+db.table("songs")).Iter()
+	var songs []storedSongKey
+	var song storedSongKey
+	var id int64
+	for iter.Scan(&id, &song.YouTubeID, &song.Title, &song.Artist, &song.Key) {
+		song.ID = uint32(id)
+		songs = append(songs, song)
+	}
+	return songs, iter.Close()
+}
+
+// rekeySong saves a song and the keys it is looked up by under key
+func (db *CassandraDB) rekeySong(ctx context.Context, song storedSongKey, key string) error {
+	id := int64(song.ID)
+	batch := db.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`UPDATE `+db.table("songs")+` SET key = ? WHERE id = ?`, key, id)
+	batch.Query(`DELETE FROM `+db.table("song_keys")+` WHERE key = ?`, song.Key)
+	batch.Query(`INSERT INTO `+db.table("song_keys")+` (key, id) VALUES (?, ?)`, key, id)
+	batch.Query(`DELETE FROM `+db.table("song_unique")+` WHERE yt_id_key = ?`, song.YouTubeID+"|"+song.Key)
+	batch.Query(`INSERT INTO `+db.table("song_unique")+` (yt_id_key, id) VALUES (?, ?)`, song.YouTubeID+"|"+key, id)
+	return db.session.ExecuteBatch(batch)
+}
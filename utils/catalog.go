@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"regexp"
+	"sync"
+)
+
+// DefaultCatalog is the catalog used when none is given. Its songs and
+// fingerprints are stored where they were before catalogs existed.
+const DefaultCatalog = ""
+
+// catalogPattern keeps catalog names usable as part of database, schema,
+// collection, key and file names in every backend
+var catalogPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// ValidCatalog reports whether name can be used as a catalog
+func ValidCatalog(name string) bool {
+	return name == DefaultCatalog || catalogPattern.MatchString(name)
+}
+
+type catalogContextKey struct{}
+
+// WithCatalog returns a copy of ctx that selects catalog
+func WithCatalog(ctx context.Context, catalog string) context.Context {
+	return context.WithValue(ctx, catalogContextKey{}, catalog)
+}
+
+// CatalogFromContext returns the catalog selected by ctx, DefaultCatalog
+// if none is
+func CatalogFromContext(ctx context.Context) string {
+	catalog, _ := ctx.Value(catalogContextKey{}).(string)
+	return catalog
+}
+
+// migratedCatalogs records the catalogs whose schema this process has
+// brought up to date, or found up to date. The default catalog is migrated,
+// or checked by read-only processes, on startup.
+var migratedCatalogs sync.Map
+
+// migrateCatalog brings the schema of a catalog other than the default one
+// up to date the first time it is opened, which also creates it
+func migrateCatalog(ctx context.Context, db DBClient, catalog string) error {
+	if catalog == DefaultCatalog {
+		return nil
+	}
+	if _, done := migratedCatalogs.Load(catalog); done {
+		return nil
+	}
+
+	if _, _, err := migrate(ctx, db, -1); err != nil {
+		return err
+	}
+	migratedCatalogs.Store(catalog, true)
+	return nil
+}
+
+// checkCatalogSchema fails the first time a catalog other than the default
+// one is opened read-only if its schema isn't up to date, since a read-only
+// client can't migrate it
+func checkCatalogSchema(ctx context.Context, db DBClient, catalog string) error {
+	if catalog == DefaultCatalog {
+		return nil
+	}
+	if _, done := migratedCatalogs.Load(catalog); done {
+		return nil
+	}
+
+	if err := checkSchema(ctx, db); err != nil {
+		return err
+	}
+	migratedCatalogs.Store(catalog, true)
+	return nil
+}
@@ -2,15 +2,14 @@ package utils
 
 import (
 	"context"
-	"errors"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"song-recognition/models"
-	"strings"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // godotenv.Load(".env")
@@ -22,204 +21,510 @@ var (
 	dbHost     = GetEnv("DB_HOST")
 	dbPort     = GetEnv("DB_PORT")
 
-	dbUri = "mongodb://" + dbUsername + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName
+	storageType = GetEnv("STORAGE_TYPE", "mongo")
 )
 
-// DbClient represents a MongoDB client
-type DbClient struct {
-	client *mongo.Client
-}
+// addressBatchSize is the number of addresses looked up per GetCouples query
+const addressBatchSize = 1000
 
-// NewDbClient creates a new instance of DbClient
-func NewDbClient() (*DbClient, error) {
-	if dbUsername == "" || dbPassword == "" {
-		dbUri = "mongodb://localhost:27017"
-	}
+// maxInsertBatchSize keeps multi-row inserts under PostgreSQL's limit of
+// 65535 parameters per statement
+const maxInsertBatchSize = 65535 / 3
 
-	clientOptions := options.Client().ApplyURI(dbUri)
-	client, err := mongo.Connect(context.Background(), clientOptions)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to MongoDB: %d", err)
-	}
-	return &DbClient{client: client}, nil
-}
+// insertBatchSize is the number of fingerprint rows the SQL backends insert
+// per statement, set with DB_INSERT_BATCH_SIZE
+var insertBatchSize = insertBatchSizeFromEnv()
 
-// Close closes the underlying MongoDB client
-func (db *DbClient) Close() error {
-	if db.client != nil {
-		return db.client.Disconnect(context.Background())
+func insertBatchSizeFromEnv() int {
+	size, err := strconv.Atoi(GetEnv("DB_INSERT_BATCH_SIZE", "1000"))
+	if err != nil || size < 1 {
+		return 1000
 	}
-	return nil
+	if size > maxInsertBatchSize {
+		return maxInsertBatchSize
+	}
+	return size
 }
 
-func (db *DbClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
-	collection := db.client.Database("song-recognition").Collection("fingerprints")
-
-	for address, couple := range fingerprints {
-		filter := bson.M{"_id": address}
-		update := bson.M{
-			"$push": bson.M{
-				"couples": bson.M{
-					"anchorTimeMs": couple.AnchorTimeMs,
-					"songID":       couple.SongID,
-				},
-			},
-		}
-		opts := options.Update().SetUpsert(true)
-
-		_, err := collection.UpdateOne(context.Background(), filter, update, opts)
-		if err != nil {
-			return fmt.Errorf("error upserting document: %s", err)
-		}
-	}
+// DBClient is the set of operations every storage backend must provide.
+// Every call except Close honours cancellation and deadlines set on ctx.
+type DBClient interface {
+	Close() error
+	// Ping checks that the database can be reached, for health checks
+	Ping(ctx context.Context) error
+	// Capabilities reports what the backend supports
+	Capabilities() Capabilities
+	StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error
+	GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error)
+	ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error
+	TotalSongs(ctx context.Context) (int, error)
+	// TotalFingerprints counts the stored couples
+	TotalFingerprints(ctx context.Context) (int, error)
+	// FingerprintCountBySong counts the couples of songID
+	FingerprintCountBySong(ctx context.Context, songID uint32) (int, error)
+	// StorageSize returns the number of bytes the catalog takes up in the
+	// database
+	StorageSize(ctx context.Context) (int64, error)
+	RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error)
+	// RegisterSongWithFingerprints registers a song along with the
+	// fingerprints fingerprint returns for its ID, so that a failure never
+	// leaves a song that can't be recognized
+	RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error)
+	// GetSong returns the song whose field is value, a uint32 for
+	// SongFieldID and a string otherwise
+	GetSong(ctx context.Context, field SongField, value interface{}) (Song, bool, error)
+	GetSongByID(ctx context.Context, songID uint32) (Song, bool, error)
+	GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error)
+	GetSongByKey(ctx context.Context, key string) (Song, bool, error)
+	ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error)
+	// SearchSongs returns up to limit songs whose title or artist resemble
+	// query, from the closest, tolerating typos and any word order
+	SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error)
+	DeleteSongByID(ctx context.Context, songID uint32) error
+	// DeleteSongs deletes songs along with their fingerprints, more
+	// efficiently than one at a time
+	DeleteSongs(ctx context.Context, songIDs []uint32) error
+	DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error
+	DeleteCollection(ctx context.Context, collectionName string) error
+	GetSetting(ctx context.Context, key string) (string, bool, error)
+	SetSetting(ctx context.Context, key, value string) error
+	StoreAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	StoreRecognition(ctx context.Context, recognition Recognition) error
+	// ListRecognitions returns a page of the recognitions made by clientID,
+	// or by every client if it is empty, from the newest
+	ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error)
+	StoreAirplay(ctx context.Context, airplay Airplay) error
+	// ListAirplays returns a page of the airplays selected by filter, from
+	// the latest to start
+	ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error)
+}
 
-	return nil
+// Capabilities describes what a backend supports, so that callers can
+// adapt to it rather than assume the same behavior of every backend
+type Capabilities struct {
+	// Backend is the name of the backend, such as "postgres"
+	Backend string
+	// Transactions reports whether RegisterSongWithFingerprints registers a
+	// song and stores its fingerprints atomically. Without them, a crash in
+	// between can leave fingerprints for gc to delete.
+	Transactions bool
+	// MaxBatchSize is the most fingerprints StoreFingerprints writes per
+	// round trip to the database, 0 if it writes them all at once
+	MaxBatchSize int
+	// NativeSearch reports whether SearchSongs searches in the database,
+	// rather than loading every song to rank them, which slows down as the
+	// catalog grows
+	NativeSearch bool
+	// SharedAccess reports whether several processes can use the database
+	// at once. A bolt file is locked by the process using it, unless every
+	// process opens it read-only, and the memory backend is only seen by
+	// its own process.
+	SharedAccess bool
 }
 
-func (db *DbClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
-	collection := db.client.Database("song-recognition").Collection("fingerprints")
+// FingerprintFunc returns the fingerprints of a song given its ID
+type FingerprintFunc func(songID uint32) map[uint32]models.Couple
 
-	couples := make(map[uint32][]models.Couple)
+// NewDBClient creates a DBClient for the default catalog of the backend
+// selected by STORAGE_TYPE
+func NewDBClient() (DBClient, error) {
+	return NewCatalogDBClient(DefaultCatalog)
+}
 
-	for _, address := range addresses {
-		// Find the document corresponding to the address
-		var result bson.M
-		err := collection.FindOne(context.Background(), bson.M{"_id": address}).Decode(&result)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				continue
-			}
-			return nil, fmt.Errorf("error retrieving document for address %d: %s", address, err)
-		}
+// NewCatalogDBClient creates a DBClient whose songs, fingerprints and
+// settings are isolated in catalog. A catalog is created the first time
+// it is used. The client is read-only when READ_ONLY is set.
+func NewCatalogDBClient(catalog string) (DBClient, error) {
+	return newDBClient(catalog, readOnly)
+}
 
-		// Extract couples from the document and append them to the couples map
-		var docCouples []models.Couple
-		couplesList, ok := result["couples"].(primitive.A)
-		if !ok {
-			return nil, fmt.Errorf("couples field in document for address %d is not valid", address)
-		}
+// NewReadOnlyDBClient creates a read-only DBClient for the default catalog
+// of the backend selected by STORAGE_TYPE
+func NewReadOnlyDBClient() (DBClient, error) {
+	return NewReadOnlyCatalogDBClient(DefaultCatalog)
+}
 
-		for _, item := range couplesList {
-			itemMap, ok := item.(primitive.M)
-			if !ok {
-				return nil, fmt.Errorf("invalid couple format in document for address %d", address)
-			}
+// NewReadOnlyCatalogDBClient creates a DBClient that reads catalog and
+// fails every write with ErrReadOnly. Unlike NewCatalogDBClient, it neither
+// creates nor migrates the catalog, and fails if its schema isn't up to
+// date. MongoDB clients read from secondaries when there are any, and
+// fingerprints are looked up in the fingerprint index of the catalog when
+// FINGERPRINT_INDEX_DIR has one.
+func NewReadOnlyCatalogDBClient(catalog string) (DBClient, error) {
+	return newDBClient(catalog, true)
+}
 
-			couple := models.Couple{
-				AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
-				SongID:       uint32(itemMap["songID"].(int64)),
-			}
-			docCouples = append(docCouples, couple)
-		}
-		couples[address] = docCouples
+func newDBClient(catalog string, readOnly bool) (DBClient, error) {
+	if !ValidCatalog(catalog) {
+		return nil, fmt.Errorf("invalid catalog name: %q", catalog)
 	}
 
-	return couples, nil
-}
-
-func (db *DbClient) TotalSongs() (int, error) {
-	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
-	total, err := existingSongsCollection.CountDocuments(context.Background(), bson.D{})
+	db, backend, err := newBackend(catalog, readOnly)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return int(total), nil
-}
-
-func (db *DbClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
-	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
+	if readOnly {
+		if err := checkCatalogSchema(context.Background(), db, catalog); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error checking catalog %s: %v", catalog, err)
+		}
+		db = readOnlyDB{DBClient: db}
+	} else if err := migrateCatalog(context.Background(), db, catalog); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating catalog %s: %v", catalog, err)
+	}
 
-	// Create a compound unique index on ytID and key, if it doesn't already exist
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
-		Options: options.Index().SetUnique(true),
+	db = &instrumentedDB{DBClient: db, backend: backend}
+	if addressFilterEnabled {
+		db = &filteredDB{DBClient: db, filter: addressFilterFor(catalog)}
 	}
-	_, err := existingSongsCollection.Indexes().CreateOne(context.Background(), indexModel)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create unique index: %v", err)
+	if SegmentsEnabled() {
+		index, err := segmentIndexFor(catalog)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db = &segmentedDB{DBClient: db, index: index}
 	}
-
-	// Attempt to insert the song with ytID and key
-	songID := GenerateUniqueID()
-	key := GenerateSongKey(songTitle, songArtist)
-	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "ytID": ytID})
-	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
-		} else {
-			return 0, fmt.Errorf("failed to register song: %v", err)
+	if readOnly && FingerprintIndexesEnabled() {
+		index, err := acquireFingerprintIndex(catalog)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error opening the fingerprint index of catalog %s: %v", catalog, err)
+		}
+		if index != nil {
+			db = &indexedDB{DBClient: db, index: index}
 		}
 	}
+	if couplesCache != nil {
+		db = &cachedDB{DBClient: db, cache: couplesCache, catalog: catalog}
+	}
+	return db, nil
+}
 
-	return songID, nil
+// newBackend connects to catalog in the backend selected by STORAGE_TYPE
+// and returns it along with the backend's name. A read-only connection
+// doesn't create the catalog.
+func newBackend(catalog string, readOnly bool) (DBClient, string, error) {
+	switch storageType {
+	case "mongo", "mongodb":
+		db, err := newMongoDB(catalog, readOnly)
+		return db, "mongo", err
+	case "postgres", "postgresql":
+		db, err := newPostgresDB(catalog, readOnly)
+		return db, "postgres", err
+	case "mysql", "mariadb":
+		db, err := newMySQLDB(catalog, readOnly)
+		return db, "mysql", err
+	case "redis":
+		db, err := newRedisDB(catalog)
+		return db, "redis", err
+	case "cassandra", "scylla", "scylladb":
+		db, err := newCassandraDB(catalog, readOnly)
+		return db, "cassandra", err
+	case "bolt", "bbolt":
+		db, err := newBoltDB(catalog)
+		return db, "bolt", err
+	case "memory":
+		return newMemoryDB(catalog), "memory", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported storage type: %s", storageType)
+	}
 }
 
 type Song struct {
+	ID        uint32
 	Title     string
 	Artist    string
 	YouTubeID string
+	SongMetadata
+}
+
+// SongMetadata holds the optional details of a song that are shown with
+// its matches
+type SongMetadata struct {
+	Album       string
+	Duration    int // seconds
+	ReleaseYear int
+	CoverURL    string
+	Source      string // where the audio came from, one of the Source constants
+	SourceURL   string
+	Provenance  SongProvenance
+	// RecordingMBID and ReleaseMBID are the MusicBrainz IDs of the song and
+	// of the album it was imported from, to refresh its details later
+	RecordingMBID string
+	ReleaseMBID   string
+}
+
+// SongProvenance records how a song was ingested, so that catalogs can be
+// audited. Songs saved before it was recorded have an empty provenance.
+// Reindexing a song keeps the provenance of its first ingestion.
+type SongProvenance struct {
+	// FileName is the name of the file the song was saved or uploaded from
+	FileName string `json:"fileName,omitempty" bson:"fileName,omitempty"`
+	// StreamURL is the audio stream the song was downloaded from, when it
+	// isn't its SourceURL, without the query, whose signatures expire
+	StreamURL string `json:"streamUrl,omitempty" bson:"streamUrl,omitempty"`
+	// Downloader is the program and version that downloaded the audio,
+	// such as "yt-dlp 2024.08.06"
+	Downloader string `json:"downloader,omitempty" bson:"downloader,omitempty"`
+	// IngestedAt is when the song was saved
+	IngestedAt time.Time `json:"ingestedAt" bson:"ingestedAt"`
+	// FingerprintConfig is the hash of the fingerprinting parameters the
+	// song was fingerprinted with
+	FingerprintConfig string `json:"fingerprintConfig,omitempty" bson:"fingerprintConfig,omitempty"`
 }
 
-const FILTER_KEYS = "_id | ytID | key"
+// IsZero reports whether nothing is known of how the song was ingested
+func (p SongProvenance) IsZero() bool {
+	return p == SongProvenance{}
+}
 
-func (db *DbClient) GetSong(filterKey string, value interface{}) (s Song, songExists bool, e error) {
-	if !strings.Contains(FILTER_KEYS, filterKey) {
-		return Song{}, false, errors.New("invalid filter key")
+// encode returns the provenance as JSON, or "" if it is empty, the way the
+// backends without documents store it
+func (p SongProvenance) encode() string {
+	if p.IsZero() {
+		return ""
 	}
+	data, _ := json.Marshal(p)
+	return string(data)
+}
 
-	songsCollection := db.client.Database("song-recognition").Collection("songs")
-	var song bson.M
+// decodeSongProvenance reverses encode. A provenance that can't be decoded
+// is left empty rather than failing to read the song.
+func decodeSongProvenance(value string) SongProvenance {
+	var p SongProvenance
+	if value != "" {
+		json.Unmarshal([]byte(value), &p)
+	}
+	return p
+}
 
-	filter := bson.M{filterKey: value}
+// Value stores the provenance in the SQL backends
+func (p SongProvenance) Value() (driver.Value, error) {
+	return p.encode(), nil
+}
 
-	err := songsCollection.FindOne(context.Background(), filter).Decode(&song)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return Song{}, false, nil
-		}
-		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+// Scan reads the provenance from the SQL backends
+func (p *SongProvenance) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*p = SongProvenance{}
+	case string:
+		*p = decodeSongProvenance(src)
+	case []byte:
+		*p = decodeSongProvenance(string(src))
+	default:
+		return fmt.Errorf("cannot scan %T into SongProvenance", src)
 	}
+	return nil
+}
 
-	ytID := song["ytID"].(string)
-	title := strings.Split(song["key"].(string), "---")[0]
-	artist := strings.Split(song["key"].(string), "---")[1]
+// Sources a song's audio can be taken from. Songs saved before sources were
+// recorded have an empty source.
+const (
+	SourceYouTube    = "youtube"
+	SourceSoundCloud = "soundcloud"
+	SourceFile       = "file"
+)
 
-	songInstance := Song{title, artist, ytID}
+// SongField is a field GetSong can look songs up by. Each backend maps it
+// to its own column or index, so lookups never build queries from strings
+// given by callers.
+type SongField int
+
+// Fields songs can be looked up by
+const (
+	// SongFieldID looks songs up by their uint32 ID
+	SongFieldID SongField = iota
+	// SongFieldYTID looks songs up by their YouTube ID
+	SongFieldYTID
+	// SongFieldKey looks songs up by the key GenerateSongKey returns
+	SongFieldKey
+)
 
-	return songInstance, true, nil
+func (f SongField) String() string {
+	switch f {
+	case SongFieldID:
+		return "id"
+	case SongFieldYTID:
+		return "ytID"
+	case SongFieldKey:
+		return "key"
+	}
+	return fmt.Sprintf("SongField(%d)", int(f))
 }
 
-func (db *DbClient) GetSongByID(songID uint32) (Song, bool, error) {
-	return db.GetSong("_id", songID)
+// errSongField is the error of GetSong given an unknown field
+func errSongField(field SongField) error {
+	return fmt.Errorf("invalid song field: %v", field)
 }
 
-func (db *DbClient) GetSongByYTID(ytID string) (Song, bool, error) {
-	return db.GetSong("ytID", ytID)
-}
+// Orders ListSongs can return songs in. Ties are broken by the other
+// field, then by ID.
+const (
+	SortByTitle  = "title"
+	SortByArtist = "artist"
+	SortByID     = "id"
+)
 
-func (db *DbClient) GetSongByKey(key string) (Song, bool, error) {
-	return db.GetSong("key", key)
+// sqlSongOrders maps the ListSongs orders to SQL ORDER BY clauses
+var sqlSongOrders = map[string]string{
+	SortByTitle:  "title, artist, id",
+	SortByArtist: "artist, title, id",
+	SortByID:     "id",
 }
 
-func (db *DbClient) DeleteSongByID(songID uint32) error {
-	songsCollection := db.client.Database("song-recognition").Collection("songs")
+// ValidSongSort reports whether ListSongs accepts sortBy. An empty sortBy
+// sorts by title.
+func ValidSongSort(sortBy string) bool {
+	_, ok := sqlSongOrders[sortBy]
+	return ok || sortBy == ""
+}
 
-	filter := bson.M{"_id": songID}
+// songOrder returns the ListSongs order for sortBy, defaulting to title
+func songOrder(sortBy string) (string, error) {
+	if sortBy == "" {
+		return SortByTitle, nil
+	}
+	if !ValidSongSort(sortBy) {
+		return "", fmt.Errorf("invalid sort key: %s", sortBy)
+	}
+	return sortBy, nil
+}
 
-	_, err := songsCollection.DeleteOne(context.Background(), filter)
+// pageSongs sorts songs by sortBy and returns the limit songs starting at
+// offset, or all of them from offset when limit isn't positive. It serves
+// the backends that can't sort and page in the database.
+func pageSongs(songs []Song, offset, limit int, sortBy string) ([]Song, error) {
+	order, err := songOrder(sortBy)
 	if err != nil {
-		return fmt.Errorf("failed to delete song: %v", err)
+		return nil, err
 	}
 
-	return nil
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := songs[i], songs[j]
+		switch order {
+		case SortByTitle:
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+			if a.Artist != b.Artist {
+				return a.Artist < b.Artist
+			}
+		case SortByArtist:
+			if a.Artist != b.Artist {
+				return a.Artist < b.Artist
+			}
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+		}
+		return a.ID < b.ID
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(songs) {
+		return []Song{}, nil
+	}
+	songs = songs[offset:]
+	if limit > 0 && limit < len(songs) {
+		songs = songs[:limit]
+	}
+	return songs, nil
 }
 
-func (db *DbClient) DeleteCollection(collectionName string) error {
-	collection := db.client.Database("song-recognition").Collection(collectionName)
-	err := collection.Drop(context.Background())
+// sqlSongColumns are the columns the SQL backends read a song from, in the
+// order of the ID followed by songFields
+const sqlSongColumns = "id, title, artist, COALESCE(yt_id, ''), album, duration, release_year, cover_url, source, source_url, provenance, recording_mbid, release_mbid"
+
+// songFields returns the destinations to scan the columns of a song into,
+// after its ID
+func songFields(song *Song) []interface{} {
+	return []interface{}{&song.Title, &song.Artist, &song.YouTubeID, &song.Album, &song.Duration, &song.ReleaseYear, &song.CoverURL, &song.Source, &song.SourceURL, &song.Provenance, &song.RecordingMBID, &song.ReleaseMBID}
+}
+
+// nullString returns s as a query argument, NULL when it's empty
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// chunkAddresses splits addresses into consecutive slices of at most size elements
+func chunkAddresses(addresses []uint32, size int) [][]uint32 {
+	var chunks [][]uint32
+	for start := 0; start < len(addresses); start += size {
+		end := start + size
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		chunks = append(chunks, addresses[start:end])
+	}
+	return chunks
+}
+
+// storeBeforeRegistering stores the fingerprints of songID, then registers
+// the song with register, for the backends that can't do both in one
+// transaction. A crash in between leaves orphaned fingerprints, which
+// DeleteOrphanedFingerprints removes, rather than a song without
+// fingerprints. Any other failure removes the fingerprints again.
+func storeBeforeRegistering(ctx context.Context, db DBClient, songID uint32, fingerprints map[uint32]models.Couple, register func() error) error {
+	err := db.StoreFingerprints(ctx, fingerprints)
+	if err == nil {
+		err = register()
+	}
 	if err != nil {
-		return fmt.Errorf("error deleting collection: %v", err)
+		// Clean up even when ctx was cancelled
+		db.DeleteFingerprintsBySongID(context.WithoutCancel(ctx), songID)
+		return err
 	}
 	return nil
 }
+
+// sqlExecer runs statements on a database or in a transaction
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertFingerprints inserts fingerprints in tx with multi-row statements of
+// up to insertBatchSize rows. query returns the statement for n rows, which
+// takes the address, anchor time and song ID of each row in turn.
+func insertFingerprints(ctx context.Context, tx *sql.Tx, fingerprints map[uint32]models.Couple, query func(n int) string) error {
+	args := make([]interface{}, 0, 3*insertBatchSize)
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, query(len(args)/3), args...)
+		args = args[:0]
+		return err
+	}
+
+	for address, couple := range fingerprints {
+		args = append(args, int64(address), int64(couple.AnchorTimeMs), int64(couple.SongID))
+		if len(args) == 3*insertBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// packCouple packs a couple into a single integer as (anchorTimeMs << 32 | songID)
+func packCouple(couple models.Couple) uint64 {
+	return uint64(couple.AnchorTimeMs)<<32 | uint64(couple.SongID)
+}
+
+// unpackCouple reverses packCouple
+func unpackCouple(packed uint64) models.Couple {
+	return models.Couple{
+		AnchorTimeMs: uint32(packed >> 32),
+		SongID:       uint32(packed),
+	}
+}
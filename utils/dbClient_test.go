@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"slices"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestChunkAddresses(t *testing.T) {
+	tests := []struct {
+		addresses int
+		want      []int // the length of every chunk
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{1000, []int{1000}},
+		{1001, []int{1000, 1}},
+	}
+
+	for _, test := range tests {
+		addresses := make([]uint32, test.addresses)
+		for i := range addresses {
+			addresses[i] = uint32(i)
+		}
+
+		chunks := chunkAddresses(addresses, addressBatchSize)
+		var lengths []int
+		var joined []uint32
+		for _, chunk := range chunks {
+			lengths = append(lengths, len(chunk))
+			joined = append(joined, chunk...)
+		}
+		if !slices.Equal(lengths, test.want) {
+			t.Errorf("%d addresses: got chunks of %v, want %v", test.addresses, lengths, test.want)
+		}
+		if !slices.Equal(joined, addresses) {
+			t.Errorf("%d addresses: chunks don't add up to the addresses", test.addresses)
+		}
+	}
+}
+
+// benchSongID is the first song ID the fingerprints stored by benchmarks
+// belong to, far from those of real songs
+const benchSongID = 0xbe000000
+
+// storeBenchFingerprints stores the fingerprints of songs songs of perSong
+// random addresses in db, deleted once b is done, and returns the addresses
+func storeBenchFingerprints(b *testing.B, db DBClient, songs, perSong int) []uint32 {
+	ctx := context.Background()
+	r := rand.New(rand.NewSource(1))
+
+	var addresses []uint32
+	for song := 0; song < songs; song++ {
+		songID := benchSongID + uint32(song)
+		fingerprints := make(map[uint32]models.Couple, perSong)
+		for i := 0; i < perSong; i++ {
+			address := r.Uint32()
+			fingerprints[address] = models.Couple{AnchorTimeMs: uint32(i * 12), SongID: songID}
+			addresses = append(addresses, address)
+		}
+		if err := db.StoreFingerprints(ctx, fingerprints); err != nil {
+			b.Fatalf("failed to store fingerprints: %v", err)
+		}
+		b.Cleanup(func() { db.DeleteFingerprintsBySongID(ctx, songID) })
+	}
+	return addresses
+}
+
+// benchQuery returns n of addresses drawn at random, like the addresses a
+// recording of a stored song looks up
+func benchQuery(addresses []uint32, n int) []uint32 {
+	r := rand.New(rand.NewSource(2))
+	query := make([]uint32, n)
+	for i := range query {
+		query[i] = addresses[r.Intn(len(addresses))]
+	}
+	return query
+}
+
+// benchmarkGetCouples measures db looking up the addresses of a recording
+// in batches, as GetCouples does, against one address per round trip
+func benchmarkGetCouples(b *testing.B, db DBClient) {
+	ctx := context.Background()
+	query := benchQuery(storeBenchFingerprints(b, db, 20, 5000), 2000)
+
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetCouples(ctx, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per address", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, address := range query {
+				if _, err := db.GetCouples(ctx, []uint32{address}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// benchmarkInsertFingerprints measures inserting the fingerprints of a song
+// in the SQL database of db with insertFingerprints at several batch sizes,
+// against the statement prepared once and executed per row it replaced.
+// query is the insert statement of the backend.
+func benchmarkInsertFingerprints(b *testing.B, db DBClient, sqlDB *sql.DB, query func(n int) string) {
+	ctx := context.Background()
+	r := rand.New(rand.NewSource(3))
+	fingerprints := make(map[uint32]models.Couple, 5000)
+	for i := 0; len(fingerprints) < 5000; i++ {
+		fingerprints[r.Uint32()] = models.Couple{AnchorTimeMs: uint32(i * 12), SongID: benchSongID}
+	}
+
+	// insert stores the fingerprints in a transaction with store, as
+	// StoreFingerprints does, and deletes them untimed
+	insert := func(b *testing.B, store func(tx *sql.Tx) error) {
+		for i := 0; i < b.N; i++ {
+			tx, err := sqlDB.BeginTx(ctx, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := store(tx); err != nil {
+				tx.Rollback()
+				b.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.StopTimer()
+			if err := db.DeleteFingerprintsBySongID(ctx, benchSongID); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		}
+		b.ReportMetric(float64(len(fingerprints)*b.N)/b.Elapsed().Seconds(), "rows/s")
+	}
+
+	b.Run("per row", func(b *testing.B) {
+		insert(b, func(tx *sql.Tx) error {
+			stmt, err := tx.PrepareContext(ctx, query(1))
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for address, couple := range fingerprints {
+				if _, err := stmt.ExecContext(ctx, int64(address), int64(couple.AnchorTimeMs), int64(couple.SongID)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+
+	defer func(size int) { insertBatchSize = size }(insertBatchSize)
+	for _, size := range []int{100, 1000, maxInsertBatchSize} {
+		b.Run(fmt.Sprintf("batches of %d", size), func(b *testing.B) {
+			insertBatchSize = size
+			insert(b, func(tx *sql.Tx) error {
+				return insertFingerprints(ctx, tx, fingerprints, query)
+			})
+		})
+	}
+}
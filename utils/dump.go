@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"song-recognition/models"
+)
+
+// FingerprintConfigSetting is the setting the fingerprinting parameters are
+// stored under
+const FingerprintConfigSetting = "fingerprintConfig"
+
+// dumpVersion is the version of the dump format written by DumpStorage
+const dumpVersion = 1
+
+// loadBatchSize is the number of fingerprints LoadStorage stores per call
+const loadBatchSize = 10000
+
+// dumpSettings are the settings carried over by a dump. The schema version
+// is left out as it depends on the backend.
+var dumpSettings = []string{FingerprintConfigSetting}
+
+// dumpRecord is one line of a dump. A dump starts with a header record
+// holding the version and settings, followed by one record per song and
+// then one per fingerprint address.
+type dumpRecord struct {
+	Version     int               `json:"version,omitempty"`
+	Settings    map[string]string `json:"settings,omitempty"`
+	Song        *Song             `json:"song,omitempty"`
+	Fingerprint *dumpFingerprint  `json:"fingerprint,omitempty"`
+}
+
+type dumpFingerprint struct {
+	Address uint32      `json:"address"`
+	Couples [][2]uint32 `json:"couples"` // [anchorTimeMs, songID]
+}
+
+// DumpStorage writes the songs, fingerprints and settings of db to path as
+// gzipped JSON lines, which LoadStorage can read into any backend
+func DumpStorage(ctx context.Context, db DBClient, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	bw := bufio.NewWriter(zw)
+	enc := json.NewEncoder(bw)
+
+	header := dumpRecord{Version: dumpVersion, Settings: map[string]string{}}
+	for _, key := range dumpSettings {
+		value, exists, err := db.GetSetting(ctx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			header.Settings[key] = value
+		}
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return err
+	}
+	for i := range songs {
+		if err := enc.Encode(dumpRecord{Song: &songs[i]}); err != nil {
+			return err
+		}
+	}
+
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		fingerprint := &dumpFingerprint{Address: address, Couples: make([][2]uint32, len(couples))}
+		for i, couple := range couples {
+			fingerprint.Couples[i] = [2]uint32{couple.AnchorTimeMs, couple.SongID}
+		}
+		return enc.Encode(dumpRecord{Fingerprint: fingerprint})
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping fingerprints: %v", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// LoadStorage reads a dump written by DumpStorage into db and returns the
+// number of songs added. Songs get new IDs in db. Songs that db already
+// has are skipped along with their fingerprints.
+func LoadStorage(ctx context.Context, db DBClient, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dump file: %v", err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(zr))
+
+	var header dumpRecord
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("invalid dump header: %v", err)
+	}
+	if header.Version != dumpVersion {
+		return 0, fmt.Errorf("unsupported dump version %d", header.Version)
+	}
+
+	for key, value := range header.Settings {
+		current, exists, err := db.GetSetting(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if exists && current != value {
+			return 0, fmt.Errorf("setting %s of the dump (%s) doesn't match the database (%s)", key, value, current)
+		}
+		if err := db.SetSetting(ctx, key, value); err != nil {
+			return 0, err
+		}
+	}
+
+	songIDs := map[uint32]uint32{} // dump song ID -> new song ID, for the songs added
+	batch := map[uint32]models.Couple{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := db.StoreFingerprints(ctx, batch)
+		batch = map[uint32]models.Couple{}
+		return err
+	}
+
+	for {
+		var record dumpRecord
+		if err := dec.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return len(songIDs), fmt.Errorf("invalid dump record: %v", err)
+		}
+
+		switch {
+		case record.Song != nil:
+			song := record.Song
+			_, exists, err := db.GetSongByKey(ctx, GenerateSongKey(song.Title, song.Artist))
+			if err != nil {
+				return len(songIDs), err
+			}
+			if exists {
+				continue
+			}
+
+			songID, err := db.RegisterSong(ctx, song.Title, song.Artist, song.YouTubeID, song.SongMetadata)
+			if err != nil {
+				return len(songIDs), err
+			}
+			songIDs[song.ID] = songID
+
+		case record.Fingerprint != nil:
+			address := record.Fingerprint.Address
+			for _, couple := range record.Fingerprint.Couples {
+				songID, ok := songIDs[couple[1]]
+				if !ok {
+					continue
+				}
+
+				// StoreFingerprints takes one couple per address
+				if _, ok := batch[address]; ok || len(batch) >= loadBatchSize {
+					if err := flush(); err != nil {
+						return len(songIDs), err
+					}
+				}
+				batch[address] = models.Couple{AnchorTimeMs: couple[0], SongID: songID}
+			}
+		}
+	}
+
+	return len(songIDs), flush()
+}
@@ -0,0 +1,7 @@
+package utils
+
+// The backends the tests of package utils_test check
+var (
+	NewMemoryDB = newMemoryDB
+	NewBoltDB   = newBoltDB
+)
@@ -0,0 +1,437 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fingerprint indexes are read-only files of the fingerprints of a catalog,
+// compiled for recognition servers, which map them in memory and find each
+// address with a binary search instead of querying the database:
+//
+//	header     fingerprintIndexMagic, number of addresses, number of
+//	           songs, number of couples, build time, in 32 bytes
+//	addresses  every address, sorted, in 4 bytes
+//	starts     per address, 4 bytes: the number of couples before its
+//	           first, followed by the total number of couples
+//	couples    8 bytes each: song ID, anchor time in ms, grouped by
+//	           address in the order of the addresses
+//
+// Numbers are little-endian. Couples don't repeat their address, so an
+// index takes 8 bytes per couple and per address, where a segment takes 12
+// per couple.
+const (
+	fingerprintIndexMagic      = "STIDX001"
+	fingerprintIndexExt        = ".idx"
+	fingerprintIndexHeaderSize = 32
+	fingerprintIndexCoupleSize = 8
+)
+
+var (
+	// fingerprintIndexDir is the directory of the fingerprint indexes
+	// recognitions look addresses up in, instead of the database. Indexes
+	// are disabled when it's empty. Set with FINGERPRINT_INDEX_DIR.
+	fingerprintIndexDir = GetEnv("FINGERPRINT_INDEX_DIR")
+
+	// fingerprintIndexRefresh is how often the file of an index is checked
+	// for a newer build. Set with FINGERPRINT_INDEX_REFRESH.
+	fingerprintIndexRefresh = durationFromEnv("FINGERPRINT_INDEX_REFRESH", 10*time.Second)
+
+	// fingerprintIndexes are the indexes of the catalogs opened by the
+	// process
+	fingerprintIndexes = map[string]*fingerprintIndexFile{}
+	// fingerprintIndexesMu guards fingerprintIndexes and the references to
+	// every index
+	fingerprintIndexesMu sync.Mutex
+)
+
+// FingerprintIndexInfo describes a fingerprint index
+type FingerprintIndexInfo struct {
+	Path         string
+	Addresses    int
+	Songs        int
+	Fingerprints int
+	Size         int64
+	Built        time.Time
+}
+
+// FingerprintIndex is a fingerprint index mapped in memory
+type FingerprintIndex struct {
+	info FingerprintIndexInfo
+	data []byte
+	// starts and couples are the offsets of their sections in data
+	starts  int
+	couples int
+
+	// refs counts the clients using the index, which is unmapped once it
+	// is retired and has none. Both are guarded by fingerprintIndexesMu.
+	refs    int
+	retired bool
+}
+
+// fingerprintIndexFile is the index of a catalog, as last opened from its
+// file
+type fingerprintIndexFile struct {
+	index   *FingerprintIndex
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// FingerprintIndexesEnabled reports whether FINGERPRINT_INDEX_DIR is set
+func FingerprintIndexesEnabled() bool {
+	return fingerprintIndexDir != ""
+}
+
+// FingerprintIndexPath returns the path of the fingerprint index of
+// catalog. The index of the default catalog is kept at the root of
+// FINGERPRINT_INDEX_DIR, and those of other catalogs under catalogs/.
+func FingerprintIndexPath(catalog string) string {
+	if catalog == DefaultCatalog {
+		return filepath.Join(fingerprintIndexDir, "fingerprints"+fingerprintIndexExt)
+	}
+	return filepath.Join(fingerprintIndexDir, "catalogs", catalog+fingerprintIndexExt)
+}
+
+// BuildFingerprintIndex compiles the fingerprints of the songs of catalog
+// in db, and those of its segments, into the index file at filePath. The
+// file is replaced at once, so servers never map it half written.
+func BuildFingerprintIndex(ctx context.Context, db DBClient, catalog, filePath string) (FingerprintIndexInfo, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return FingerprintIndexInfo{}, err
+	}
+	saved := make(map[uint32]bool, len(songs))
+	for _, song := range songs {
+		saved[song.ID] = true
+	}
+
+	var entries []segmentEntry
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		for _, couple := range couples {
+			if saved[couple.SongID] {
+				entries = append(entries, segmentEntry{address, couple.SongID, couple.AnchorTimeMs})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return FingerprintIndexInfo{}, fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+
+	if SegmentsEnabled() {
+		index, err := segmentIndexFor(catalog)
+		if err != nil {
+			return FingerprintIndexInfo{}, err
+		}
+		segments, err := index.live(ctx)
+		if err != nil {
+			return FingerprintIndexInfo{}, err
+		}
+		for _, seg := range segments {
+			segEntries, err := index.readEntries(ctx, seg)
+			if err != nil {
+				return FingerprintIndexInfo{}, fmt.Errorf("error reading segment %s: %v", seg.name, err)
+			}
+			for _, entry := range segEntries {
+				if saved[entry.songID] {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+
+	// While a segment is being built, its couples are in the database too
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.address != b.address {
+			return a.address < b.address
+		}
+		if a.songID != b.songID {
+			return a.songID < b.songID
+		}
+		return a.anchorTimeMs < b.anchorTimeMs
+	})
+	unique := entries[:0]
+	for i, entry := range entries {
+		if i == 0 || entry != entries[i-1] {
+			unique = append(unique, entry)
+		}
+	}
+	entries = unique
+	if len(entries) > math.MaxUint32 {
+		return FingerprintIndexInfo{}, fmt.Errorf("too many fingerprints for an index: %d", len(entries))
+	}
+
+	if err := CreateFolder(filepath.Dir(filePath)); err != nil {
+		return FingerprintIndexInfo{}, err
+	}
+	tmpPath := filePath + ".tmp"
+	info, err := writeFingerprintIndex(tmpPath, entries)
+	if err != nil {
+		os.Remove(tmpPath)
+		return FingerprintIndexInfo{}, fmt.Errorf("error writing index: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return FingerprintIndexInfo{}, err
+	}
+	info.Path = filePath
+	return info, nil
+}
+
+// writeFingerprintIndex writes the index of entries, sorted by address, to
+// the file at filePath
+func writeFingerprintIndex(filePath string, entries []segmentEntry) (info FingerprintIndexInfo, err error) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var addresses []uint32
+	var starts []uint32
+	songs := map[uint32]bool{}
+	for i, entry := range entries {
+		if i == 0 || entry.address != entries[i-1].address {
+			addresses = append(addresses, entry.address)
+			starts = append(starts, uint32(i))
+		}
+		songs[entry.songID] = true
+	}
+	starts = append(starts, uint32(len(entries)))
+
+	info = FingerprintIndexInfo{
+		Addresses:    len(addresses),
+		Songs:        len(songs),
+		Fingerprints: len(entries),
+		Size:         int64(fingerprintIndexHeaderSize + 4*len(addresses) + 4*len(starts) + fingerprintIndexCoupleSize*len(entries)),
+		Built:        time.Now().UTC().Truncate(time.Second),
+	}
+
+	w := bufio.NewWriterSize(file, 1<<20)
+	header := make([]byte, fingerprintIndexHeaderSize)
+	copy(header, fingerprintIndexMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(info.Addresses))
+	binary.LittleEndian.PutUint32(header[12:], uint32(info.Songs))
+	binary.LittleEndian.PutUint64(header[16:], uint64(info.Fingerprints))
+	binary.LittleEndian.PutUint64(header[24:], uint64(info.Built.Unix()))
+	if _, err := w.Write(header); err != nil {
+		return info, err
+	}
+
+	buf := make([]byte, fingerprintIndexCoupleSize)
+	for _, address := range addresses {
+		binary.LittleEndian.PutUint32(buf, address)
+		if _, err := w.Write(buf[:4]); err != nil {
+			return info, err
+		}
+	}
+	for _, start := range starts {
+		binary.LittleEndian.PutUint32(buf, start)
+		if _, err := w.Write(buf[:4]); err != nil {
+			return info, err
+		}
+	}
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint32(buf[0:], entry.songID)
+		binary.LittleEndian.PutUint32(buf[4:], entry.anchorTimeMs)
+		if _, err := w.Write(buf); err != nil {
+			return info, err
+		}
+	}
+
+	return info, w.Flush()
+}
+
+// OpenFingerprintIndex maps the fingerprint index at filePath in memory.
+// Close unmaps it.
+func OpenFingerprintIndex(filePath string) (*FingerprintIndex, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < fingerprintIndexHeaderSize || stat.Size() > math.MaxInt {
+		return nil, fmt.Errorf("%s is not a fingerprint index", filePath)
+	}
+
+	data, err := mapFile(file, int(stat.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("error mapping %s: %v", filePath, err)
+	}
+	if string(data[:8]) != fingerprintIndexMagic {
+		unmapFile(data)
+		return nil, fmt.Errorf("%s is not a fingerprint index", filePath)
+	}
+
+	index := &FingerprintIndex{
+		info: FingerprintIndexInfo{
+			Path:         filePath,
+			Addresses:    int(binary.LittleEndian.Uint32(data[8:])),
+			Songs:        int(binary.LittleEndian.Uint32(data[12:])),
+			Fingerprints: int(binary.LittleEndian.Uint64(data[16:])),
+			Size:         stat.Size(),
+			Built:        time.Unix(int64(binary.LittleEndian.Uint64(data[24:])), 0).UTC(),
+		},
+		data: data,
+	}
+	index.starts = fingerprintIndexHeaderSize + 4*index.info.Addresses
+	index.couples = index.starts + 4*(index.info.Addresses+1)
+	if int64(index.couples+fingerprintIndexCoupleSize*index.info.Fingerprints) != stat.Size() {
+		unmapFile(data)
+		return nil, fmt.Errorf("fingerprint index %s is truncated", filePath)
+	}
+	return index, nil
+}
+
+// Info describes the index
+func (x *FingerprintIndex) Info() FingerprintIndexInfo {
+	return x.info
+}
+
+// Address returns the i-th address of the index, in ascending order, for i
+// below Info().Addresses
+func (x *FingerprintIndex) Address(i int) uint32 {
+	return binary.LittleEndian.Uint32(x.data[fingerprintIndexHeaderSize+4*i:])
+}
+
+// Lookup returns the couples of addresses found in the index
+func (x *FingerprintIndex) Lookup(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		i := sort.Search(x.info.Addresses, func(i int) bool { return x.Address(i) >= address })
+		if i == x.info.Addresses || x.Address(i) != address {
+			continue
+		}
+
+		start := int(binary.LittleEndian.Uint32(x.data[x.starts+4*i:]))
+		end := int(binary.LittleEndian.Uint32(x.data[x.starts+4*(i+1):]))
+		addressCouples := make([]models.Couple, 0, end-start)
+		for j := start; j < end; j++ {
+			couple := x.data[x.couples+fingerprintIndexCoupleSize*j:]
+			addressCouples = append(addressCouples, models.Couple{
+				SongID:       binary.LittleEndian.Uint32(couple[0:]),
+				AnchorTimeMs: binary.LittleEndian.Uint32(couple[4:]),
+			})
+		}
+		couples[address] = addressCouples
+	}
+	return couples, nil
+}
+
+// Close unmaps the index. It must no longer be used.
+func (x *FingerprintIndex) Close() error {
+	return unmapFile(x.data)
+}
+
+// acquireFingerprintIndex returns the index of catalog, opening it again
+// when its file changed, or nil if the catalog has none. The index stays
+// mapped until it is released.
+func acquireFingerprintIndex(catalog string) (*FingerprintIndex, error) {
+	fingerprintIndexesMu.Lock()
+	defer fingerprintIndexesMu.Unlock()
+
+	current := fingerprintIndexes[catalog]
+	if current == nil || time.Since(current.checked) >= fingerprintIndexRefresh {
+		next, err := refreshFingerprintIndex(catalog, current)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && current.index != nil && next.index != current.index {
+			current.index.retired = true
+			current.index.releaseLocked()
+		}
+		fingerprintIndexes[catalog] = next
+		current = next
+	}
+
+	if current.index == nil {
+		return nil, nil
+	}
+	current.index.refs++
+	return current.index, nil
+}
+
+// refreshFingerprintIndex checks the file of the index of catalog, last
+// opened as current, and returns it opened again if it changed. The
+// returned index holds a reference for as long as it is current.
+func refreshFingerprintIndex(catalog string, current *fingerprintIndexFile) (*fingerprintIndexFile, error) {
+	filePath := FingerprintIndexPath(catalog)
+	stat, err := os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &fingerprintIndexFile{checked: time.Now()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && current.index != nil && stat.ModTime().Equal(current.modTime) && stat.Size() == current.size {
+		next := *current
+		next.checked = time.Now()
+		return &next, nil
+	}
+
+	index, err := OpenFingerprintIndex(filePath)
+	if err != nil {
+		return nil, err
+	}
+	index.refs = 1
+	return &fingerprintIndexFile{index: index, modTime: stat.ModTime(), size: stat.Size(), checked: time.Now()}, nil
+}
+
+// release gives back a reference acquired with acquireFingerprintIndex
+func (x *FingerprintIndex) release() {
+	fingerprintIndexesMu.Lock()
+	defer fingerprintIndexesMu.Unlock()
+	x.releaseLocked()
+}
+
+func (x *FingerprintIndex) releaseLocked() {
+	x.refs--
+	if x.retired && x.refs == 0 {
+		x.Close()
+	}
+}
+
+// indexedDB looks fingerprints up in the fingerprint index of a catalog
+// instead of the database, for read-only clients. Songs saved since the
+// index was built are only found once it is built again; recognitions
+// skip the deleted ones.
+type indexedDB struct {
+	DBClient
+	index *FingerprintIndex
+	once  sync.Once
+}
+
+func (db *indexedDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	return db.index.Lookup(ctx, addresses)
+}
+
+func (db *indexedDB) Close() error {
+	db.once.Do(db.index.release)
+	return db.DBClient.Close()
+}
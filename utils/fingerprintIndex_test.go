@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"song-recognition/models"
+	"sort"
+	"testing"
+)
+
+// openTestIndex writes the index of entries, in any order, and maps it
+// until tb is done
+func openTestIndex(tb testing.TB, entries []segmentEntry) *FingerprintIndex {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.address != b.address {
+			return a.address < b.address
+		}
+		if a.songID != b.songID {
+			return a.songID < b.songID
+		}
+		return a.anchorTimeMs < b.anchorTimeMs
+	})
+
+	filePath := filepath.Join(tb.TempDir(), "fingerprints"+fingerprintIndexExt)
+	if _, err := writeFingerprintIndex(filePath, entries); err != nil {
+		tb.Fatalf("failed to write index: %v", err)
+	}
+	index, err := OpenFingerprintIndex(filePath)
+	if err != nil {
+		tb.Fatalf("failed to open index: %v", err)
+	}
+	tb.Cleanup(func() { index.Close() })
+	return index
+}
+
+func TestFingerprintIndexLookup(t *testing.T) {
+	entries := []segmentEntry{
+		{address: 0, songID: 1, anchorTimeMs: 10},
+		{address: 5, songID: 1, anchorTimeMs: 20},
+		{address: 5, songID: 2, anchorTimeMs: 30},
+		{address: 5, songID: 1, anchorTimeMs: 40},
+		{address: 9, songID: 3, anchorTimeMs: 50},
+		{address: 0xffffffff, songID: 2, anchorTimeMs: 60},
+	}
+
+	tests := []struct {
+		name      string
+		entries   []segmentEntry
+		addresses []uint32
+		want      map[uint32][]models.Couple
+	}{
+		{
+			name:      "empty index",
+			addresses: []uint32{0, 5, 0xffffffff},
+			want:      map[uint32][]models.Couple{},
+		},
+		{
+			name:      "first and last address",
+			entries:   entries,
+			addresses: []uint32{0, 0xffffffff},
+			want: map[uint32][]models.Couple{
+				0:          {{SongID: 1, AnchorTimeMs: 10}},
+				0xffffffff: {{SongID: 2, AnchorTimeMs: 60}},
+			},
+		},
+		{
+			name:      "address of several couples",
+			entries:   entries,
+			addresses: []uint32{5},
+			want: map[uint32][]models.Couple{
+				5: {{SongID: 1, AnchorTimeMs: 20}, {SongID: 1, AnchorTimeMs: 40}, {SongID: 2, AnchorTimeMs: 30}},
+			},
+		},
+		{
+			name:      "duplicate addresses",
+			entries:   entries,
+			addresses: []uint32{9, 9, 9},
+			want: map[uint32][]models.Couple{
+				9: {{SongID: 3, AnchorTimeMs: 50}},
+			},
+		},
+		{
+			name:      "missing addresses",
+			entries:   entries,
+			addresses: []uint32{1, 6, 10, 0xfffffffe},
+			want:      map[uint32][]models.Couple{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := openTestIndex(t, append([]segmentEntry(nil), test.entries...))
+			got, err := index.Lookup(context.Background(), test.addresses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// BenchmarkFingerprintIndexLookup measures looking the addresses of a
+// recording up in an index, against the bolt database it is built from
+func BenchmarkFingerprintIndexLookup(b *testing.B) {
+	b.Setenv("DB_PATH", filepath.Join(b.TempDir(), "song-recognition.db"))
+	db, err := newBoltDB(DefaultCatalog)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Registered first, so the database closes after the fingerprints are
+	// deleted
+	b.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	query := benchQuery(storeBenchFingerprints(b, db, 20, 5000), 2000)
+
+	var entries []segmentEntry
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		for _, couple := range couples {
+			entries = append(entries, segmentEntry{address, couple.SongID, couple.AnchorTimeMs})
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	index := openTestIndex(b, entries)
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := index.Lookup(ctx, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("bolt", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetCouples(ctx, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
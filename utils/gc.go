@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"sort"
+)
+
+// DeleteOrphanedFingerprints deletes the fingerprints that point at songs
+// db no longer has, left behind by deletions made before DeleteSongByID
+// removed them. It returns the IDs of the missing songs.
+func DeleteOrphanedFingerprints(ctx context.Context, db DBClient) ([]uint32, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[uint32]bool, len(songs))
+	for _, song := range songs {
+		known[song.ID] = true
+	}
+
+	orphans := map[uint32]bool{}
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		for _, couple := range couples {
+			if !known[couple.SongID] {
+				orphans[couple.SongID] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+
+	songIDs := make([]uint32, 0, len(orphans))
+	for songID := range orphans {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Slice(songIDs, func(i, j int) bool { return songIDs[i] < songIDs[j] })
+
+	for i, songID := range songIDs {
+		if err := db.DeleteFingerprintsBySongID(ctx, songID); err != nil {
+			return songIDs[:i], err
+		}
+	}
+
+	return songIDs, nil
+}
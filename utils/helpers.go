@@ -79,6 +79,13 @@ func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64
 		return nil, err
 	}
 
+	return ProcessRecordingAudio(decodedAudioData, recData, saveRecording)
+}
+
+// ProcessRecordingAudio works like ProcessRecording for audio that is
+// already decoded, such as a recording reassembled from chunks. The Audio
+// field of recData is ignored.
+func ProcessRecordingAudio(decodedAudioData []byte, recData *models.RecordData, saveRecording bool) ([]float64, error) {
 	now := time.Now()
 	fileName := fmt.Sprintf("%04d_%02d_%02d_%02d_%02d_%02d.wav",
 		now.Second(), now.Minute(), now.Hour(),
@@ -86,7 +93,7 @@ func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64
 	)
 	filePath := "tmp/" + fileName
 
-	err = wav.WriteWavFile(filePath, decodedAudioData, recData.SampleRate, recData.Channels, recData.SampleSize)
+	err := wav.WriteWavFile(filePath, decodedAudioData, recData.SampleRate, recData.Channels, recData.SampleSize)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"song-recognition/metrics"
+	"song-recognition/models"
+	"time"
+)
+
+// instrumentedDB wraps a DBClient and records the duration of every call
+// in the DB query metrics, labelled with the backend name. Calls are also
+// logged at debug level, tagged with the request they were made for.
+type instrumentedDB struct {
+	DBClient
+	backend string
+}
+
+func (db *instrumentedDB) observe(ctx context.Context, operation string, start time.Time) {
+	elapsed := time.Since(start)
+	metrics.DBQueryDuration.WithLabelValues(db.backend, operation).Observe(elapsed.Seconds())
+
+	logger := GetLogger()
+	logger.DebugContext(ctx, "DB call.",
+		slog.String("backend", db.backend),
+		slog.String("operation", operation),
+		slog.Duration("duration", elapsed),
+	)
+}
+
+func (db *instrumentedDB) Ping(ctx context.Context) error {
+	defer db.observe(ctx, "Ping", time.Now())
+	return db.DBClient.Ping(ctx)
+}
+
+func (db *instrumentedDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	defer db.observe(ctx, "StoreFingerprints", time.Now())
+	err := db.DBClient.StoreFingerprints(ctx, fingerprints)
+	if err == nil {
+		metrics.FingerprintsStored.Add(float64(len(fingerprints)))
+	}
+	return err
+}
+
+func (db *instrumentedDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	defer db.observe(ctx, "GetCouples", time.Now())
+	return db.DBClient.GetCouples(ctx, addresses)
+}
+
+func (db *instrumentedDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	defer db.observe(ctx, "ForEachFingerprint", time.Now())
+	return db.DBClient.ForEachFingerprint(ctx, fn)
+}
+
+func (db *instrumentedDB) TotalSongs(ctx context.Context) (int, error) {
+	defer db.observe(ctx, "TotalSongs", time.Now())
+	return db.DBClient.TotalSongs(ctx)
+}
+
+func (db *instrumentedDB) TotalFingerprints(ctx context.Context) (int, error) {
+	defer db.observe(ctx, "TotalFingerprints", time.Now())
+	return db.DBClient.TotalFingerprints(ctx)
+}
+
+func (db *instrumentedDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	defer db.observe(ctx, "FingerprintCountBySong", time.Now())
+	return db.DBClient.FingerprintCountBySong(ctx, songID)
+}
+
+func (db *instrumentedDB) StorageSize(ctx context.Context) (int64, error) {
+	defer db.observe(ctx, "StorageSize", time.Now())
+	return db.DBClient.StorageSize(ctx)
+}
+
+func (db *instrumentedDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	defer db.observe(ctx, "RegisterSong", time.Now())
+	return db.DBClient.RegisterSong(ctx, songTitle, songArtist, ytID, meta)
+}
+
+func (db *instrumentedDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	defer db.observe(ctx, "RegisterSongWithFingerprints", time.Now())
+	stored := 0
+	songID, err := db.DBClient.RegisterSongWithFingerprints(ctx, songTitle, songArtist, ytID, meta, func(songID uint32) map[uint32]models.Couple {
+		fingerprints := fingerprint(songID)
+		stored = len(fingerprints)
+		return fingerprints
+	})
+	if err == nil {
+		metrics.FingerprintsStored.Add(float64(stored))
+	}
+	return songID, err
+}
+
+func (db *instrumentedDB) GetSong(ctx context.Context, field SongField, value interface{}) (Song, bool, error) {
+	defer db.observe(ctx, "GetSong", time.Now())
+	return db.DBClient.GetSong(ctx, field, value)
+}
+
+func (db *instrumentedDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	defer db.observe(ctx, "GetSong", time.Now())
+	return db.DBClient.GetSongByID(ctx, songID)
+}
+
+func (db *instrumentedDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	defer db.observe(ctx, "GetSong", time.Now())
+	return db.DBClient.GetSongByYTID(ctx, ytID)
+}
+
+func (db *instrumentedDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	defer db.observe(ctx, "GetSong", time.Now())
+	return db.DBClient.GetSongByKey(ctx, key)
+}
+
+func (db *instrumentedDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	defer db.observe(ctx, "ListSongs", time.Now())
+	return db.DBClient.ListSongs(ctx, offset, limit, sortBy)
+}
+
+func (db *instrumentedDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	defer db.observe(ctx, "SearchSongs", time.Now())
+	return db.DBClient.SearchSongs(ctx, query, limit)
+}
+
+func (db *instrumentedDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	defer db.observe(ctx, "DeleteSongs", time.Now())
+	return db.DBClient.DeleteSongs(ctx, songIDs)
+}
+
+func (db *instrumentedDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	defer db.observe(ctx, "DeleteSongByID", time.Now())
+	return db.DBClient.DeleteSongByID(ctx, songID)
+}
+
+func (db *instrumentedDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	defer db.observe(ctx, "DeleteFingerprintsBySongID", time.Now())
+	return db.DBClient.DeleteFingerprintsBySongID(ctx, songID)
+}
+
+func (db *instrumentedDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	defer db.observe(ctx, "DeleteCollection", time.Now())
+	return db.DBClient.DeleteCollection(ctx, collectionName)
+}
+
+func (db *instrumentedDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	defer db.observe(ctx, "GetSetting", time.Now())
+	return db.DBClient.GetSetting(ctx, key)
+}
+
+func (db *instrumentedDB) SetSetting(ctx context.Context, key, value string) error {
+	defer db.observe(ctx, "SetSetting", time.Now())
+	return db.DBClient.SetSetting(ctx, key, value)
+}
+
+func (db *instrumentedDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	defer db.observe(ctx, "StoreAPIKey", time.Now())
+	return db.DBClient.StoreAPIKey(ctx, key)
+}
+
+func (db *instrumentedDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	defer db.observe(ctx, "GetAPIKey", time.Now())
+	return db.DBClient.GetAPIKey(ctx, hash)
+}
+
+func (db *instrumentedDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	defer db.observe(ctx, "ListAPIKeys", time.Now())
+	return db.DBClient.ListAPIKeys(ctx)
+}
+
+func (db *instrumentedDB) DeleteAPIKey(ctx context.Context, id string) error {
+	defer db.observe(ctx, "DeleteAPIKey", time.Now())
+	return db.DBClient.DeleteAPIKey(ctx, id)
+}
+
+func (db *instrumentedDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	defer db.observe(ctx, "StoreRecognition", time.Now())
+	return db.DBClient.StoreRecognition(ctx, recognition)
+}
+
+func (db *instrumentedDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	defer db.observe(ctx, "ListRecognitions", time.Now())
+	return db.DBClient.ListRecognitions(ctx, clientID, offset, limit)
+}
+
+func (db *instrumentedDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	defer db.observe(ctx, "StoreAirplay", time.Now())
+	return db.DBClient.StoreAirplay(ctx, airplay)
+}
+
+func (db *instrumentedDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	defer db.observe(ctx, "ListAirplays", time.Now())
+	return db.DBClient.ListAirplays(ctx, filter, offset, limit)
+}
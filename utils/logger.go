@@ -1,13 +1,68 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"song-recognition/config"
+	"strings"
+	"sync"
 
 	"github.com/mdobak/go-xerrors"
 )
 
+var (
+	// logLevel is the lowest level logged: debug, info, warn or error. Set
+	// with LOG_LEVEL.
+	logLevel = new(slog.LevelVar)
+
+	// logFormat is json, for log aggregation, or text. Set with LOG_FORMAT.
+	logFormat = GetEnv("LOG_FORMAT", "json")
+
+	// logOutput is where records are written, stdout unless SetLogOutput
+	// changes it
+	logOutput = &logWriter{w: os.Stdout}
+)
+
+func init() {
+	setLogLevel()
+	config.OnReload(setLogLevel)
+}
+
+// setLogLevel sets the lowest level logged to LOG_LEVEL, or info if it
+// isn't a level
+func setLogLevel() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(GetEnv("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+}
+
+// logWriter writes to w, which can be changed after the logger is created
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// SetLogOutput makes the logger write to w, e.g. to stderr for commands
+// whose stdout is read by scripts
+func SetLogOutput(w io.Writer) {
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	logOutput.w = w
+}
+
 type stackFrame struct {
 	Func   string `json:"func"`
 	Source string `json:"source"`
@@ -73,11 +128,80 @@ func fmtErr(err error) slog.Value {
 	return slog.GroupValue(groupValues...)
 }
 
+var (
+	loggerOnce    sync.Once
+	defaultLogger *slog.Logger
+)
+
+// GetLogger returns the logger shared by the whole app. Records logged with
+// a context are tagged with its request ID and catalog.
 func GetLogger() *slog.Logger {
-	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		ReplaceAttr: replaceAttr,
+	loggerOnce.Do(func() {
+		opts := &slog.HandlerOptions{
+			Level:       logLevel,
+			ReplaceAttr: replaceAttr,
+		}
+
+		var h slog.Handler
+		if strings.EqualFold(logFormat, "text") {
+			h = slog.NewTextHandler(logOutput, opts)
+		} else {
+			h = slog.NewJSONHandler(logOutput, opts)
+		}
+
+		defaultLogger = slog.New(contextHandler{h})
 	})
 
-	logger := slog.New(h)
-	return logger
+	return defaultLogger
+}
+
+// contextHandler adds the request ID and catalog carried by the context of
+// a record to it
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if catalog := CatalogFromContext(ctx); catalog != DefaultCatalog {
+		r.AddAttrs(slog.String("catalog", catalog))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDContextKey struct{}
+
+// NewRequestID returns a random ID to tag the logs of an operation with
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID returns a copy of ctx that carries the request ID id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, empty if it
+// has none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// NewOperationContext returns a context with a new request ID, for the
+// operations that aren't started by a request, like CLI commands
+func NewOperationContext() context.Context {
+	return WithRequestID(context.Background(), NewRequestID())
 }
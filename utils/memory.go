@@ -0,0 +1,548 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// memoryStores holds the data of every catalog of the memory backend, so
+// that the clients of a process share it
+var memoryStores sync.Map
+
+// memoryStore is the data of a catalog of the memory backend
+type memoryStore struct {
+	mu sync.RWMutex
+
+	// fingerprints holds the packed couples of every address (see
+	// packCouple), and songAddresses the addresses of every song, so that
+	// deleting a song doesn't scan every address
+	fingerprints  map[uint32][]uint64
+	songAddresses map[uint32][]uint32
+
+	songs        map[uint32]Song
+	songKeys     map[string]uint32
+	songYTIDs    map[string]uint32
+	songUnique   map[string]uint32
+	settings     map[string]string
+	apiKeys      map[string]APIKey // by hash
+	recognitions []Recognition     // from the oldest
+	airplays     []Airplay         // sorted by start time
+	lastID       uint64            // of recognitions and airplays
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	s.resetFingerprints()
+	s.resetSongs()
+	s.settings = make(map[string]string)
+	s.apiKeys = make(map[string]APIKey)
+	return s
+}
+
+func (s *memoryStore) resetFingerprints() {
+	s.fingerprints = make(map[uint32][]uint64)
+	s.songAddresses = make(map[uint32][]uint32)
+}
+
+func (s *memoryStore) resetSongs() {
+	s.songs = make(map[uint32]Song)
+	s.songKeys = make(map[string]uint32)
+	s.songYTIDs = make(map[string]uint32)
+	s.songUnique = make(map[string]uint32)
+}
+
+// MemoryDB is a DBClient that keeps everything in the memory of the
+// process, for tests, demos and quick experiments. Nothing outlives the
+// process, and other processes, such as CLI commands run while the server
+// is up, don't see its data.
+type MemoryDB struct {
+	store *memoryStore
+}
+
+// newMemoryDB creates a new instance of MemoryDB for catalog, sharing its
+// data with the other instances of the process
+func newMemoryDB(catalog string) *MemoryDB {
+	store, _ := memoryStores.LoadOrStore(catalog, newMemoryStore())
+	return &MemoryDB{store: store.(*memoryStore)}
+}
+
+// Close does nothing, the data stays for the other clients
+func (db *MemoryDB) Close() error {
+	return nil
+}
+
+// Ping always succeeds
+func (db *MemoryDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Capabilities reports the capabilities of the memory backend, which
+// registers a song along with its fingerprints under one lock
+func (db *MemoryDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "memory",
+		Transactions: true,
+		MaxBatchSize: 0,
+		NativeSearch: false,
+		SharedAccess: false,
+	}
+}
+
+func (db *MemoryDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.storeFingerprints(fingerprints)
+	return nil
+}
+
+// storeFingerprints adds the couples of fingerprints that aren't stored yet
+func (s *memoryStore) storeFingerprints(fingerprints map[uint32]models.Couple) {
+	for address, couple := range fingerprints {
+		packed := packCouple(couple)
+		stored := false
+		for _, existing := range s.fingerprints[address] {
+			if existing == packed {
+				stored = true
+				break
+			}
+		}
+		if stored {
+			continue
+		}
+		s.fingerprints[address] = append(s.fingerprints[address], packed)
+		s.songAddresses[couple.SongID] = append(s.songAddresses[couple.SongID], address)
+	}
+}
+
+func (db *MemoryDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		for _, packed := range db.store.fingerprints[address] {
+			couples[address] = append(couples[address], unpackCouple(packed))
+		}
+	}
+	return couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every address, in
+// address order. The store isn't locked while fn runs, so fn can write to
+// it.
+func (db *MemoryDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	db.store.mu.RLock()
+	addresses := make([]uint32, 0, len(db.store.fingerprints))
+	for address := range db.store.fingerprints {
+		addresses = append(addresses, address)
+	}
+	db.store.mu.RUnlock()
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	for _, address := range addresses {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		couples, err := db.GetCouples(ctx, []uint32{address})
+		if err != nil {
+			return err
+		}
+		if len(couples[address]) == 0 {
+			continue
+		}
+		if err := fn(address, couples[address]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) TotalSongs(ctx context.Context) (int, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	return len(db.store.songs), nil
+}
+
+func (db *MemoryDB) TotalFingerprints(ctx context.Context) (int, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	total := 0
+	for _, couples := range db.store.fingerprints {
+		total += len(couples)
+	}
+	return total, nil
+}
+
+func (db *MemoryDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	return len(db.store.songAddresses[songID]), nil
+}
+
+// StorageSize estimates the memory taken up by the fingerprints and songs,
+// leaving out the overhead of the maps holding them
+func (db *MemoryDB) StorageSize(ctx context.Context) (int64, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	var size int64
+	for _, couples := range db.store.fingerprints {
+		// The couple, and the address of its song
+		size += int64(len(couples)) * (8 + 4)
+	}
+	for _, song := range db.store.songs {
+		size += int64(len(song.Title) + len(song.Artist) + len(song.YouTubeID) + len(song.Album) + len(song.CoverURL) + len(song.SourceURL))
+	}
+	return size, nil
+}
+
+func (db *MemoryDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	songID := GenerateUniqueID()
+	if err := db.store.registerSong(songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints registers a song and stores its
+// fingerprints under one lock, so that no reader sees one without the other
+func (db *MemoryDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	songID := GenerateUniqueID()
+	fingerprints := fingerprint(songID)
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	if err := db.store.registerSong(songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	db.store.storeFingerprints(fingerprints)
+	return songID, nil
+}
+
+func (s *memoryStore) registerSong(songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	key := GenerateSongKey(songTitle, songArtist)
+
+	// Reserve the (ytID, key) pair so the same song can't be registered twice
+	unique := ytID + "|" + key
+	if _, exists := s.songUnique[unique]; exists {
+		return fmt.Errorf("failed to register song: song with ytID or key already exists: %s", unique)
+	}
+
+	s.songUnique[unique] = songID
+	s.songs[songID] = Song{ID: songID, Title: songTitle, Artist: songArtist, YouTubeID: ytID, SongMetadata: meta}
+	s.songKeys[key] = songID
+	if ytID != "" {
+		s.songYTIDs[ytID] = songID
+	}
+	return nil
+}
+
+func (db *MemoryDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+	if err := ctx.Err(); err != nil {
+		return Song{}, false, err
+	}
+
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	var id uint32
+	var found bool
+	switch field {
+	case SongFieldID:
+		songID, ok := value.(uint32)
+		if !ok {
+			return Song{}, false, fmt.Errorf("failed to retrieve song: invalid song ID: %v", value)
+		}
+		id, found = songID, true
+	case SongFieldYTID:
+		id, found = db.store.songYTIDs[fmt.Sprint(value)]
+	case SongFieldKey:
+		id, found = db.store.songKeys[fmt.Sprint(value)]
+	default:
+		return Song{}, false, errSongField(field)
+	}
+	if !found {
+		return Song{}, false, nil
+	}
+
+	song, found := db.store.songs[id]
+	return song, found, nil
+}
+
+func (db *MemoryDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *MemoryDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *MemoryDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+func (db *MemoryDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.store.mu.RLock()
+	songs := make([]Song, 0, len(db.store.songs))
+	for _, song := range db.store.songs {
+		songs = append(songs, song)
+	}
+	db.store.mu.RUnlock()
+
+	return pageSongs(songs, offset, limit, sortBy)
+}
+
+// SearchSongs ranks every song, like the other backends without text
+// search
+func (db *MemoryDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *MemoryDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.DeleteSongs(ctx, []uint32{songID})
+}
+
+// DeleteSongs deletes songs along with their fingerprints
+func (db *MemoryDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	for _, songID := range songIDs {
+		db.store.deleteFingerprints(songID)
+
+		song, ok := db.store.songs[songID]
+		if !ok {
+			continue
+		}
+		key := GenerateSongKey(song.Title, song.Artist)
+		delete(db.store.songs, songID)
+		delete(db.store.songKeys, key)
+		delete(db.store.songUnique, song.YouTubeID+"|"+key)
+		if song.YouTubeID != "" {
+			delete(db.store.songYTIDs, song.YouTubeID)
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.deleteFingerprints(songID)
+	return nil
+}
+
+// deleteFingerprints removes the couples of songID from the addresses it
+// has couples at
+func (s *memoryStore) deleteFingerprints(songID uint32) {
+	for _, address := range s.songAddresses[songID] {
+		couples := s.fingerprints[address][:0]
+		for _, packed := range s.fingerprints[address] {
+			if unpackCouple(packed).SongID != songID {
+				couples = append(couples, packed)
+			}
+		}
+		if len(couples) == 0 {
+			delete(s.fingerprints, address)
+		} else {
+			s.fingerprints[address] = couples
+		}
+	}
+	delete(s.songAddresses, songID)
+}
+
+func (db *MemoryDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	value, ok := db.store.settings[key]
+	return value, ok, nil
+}
+
+func (db *MemoryDB) SetSetting(ctx context.Context, key, value string) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.settings[key] = value
+	return nil
+}
+
+func (db *MemoryDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.apiKeys[key.Hash] = key
+	return nil
+}
+
+func (db *MemoryDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	key, ok := db.store.apiKeys[hash]
+	return key, ok, nil
+}
+
+func (db *MemoryDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(db.store.apiKeys))
+	for _, key := range db.store.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys, nil
+}
+
+func (db *MemoryDB) DeleteAPIKey(ctx context.Context, id string) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	for hash, key := range db.store.apiKeys {
+		if key.ID == id {
+			delete(db.store.apiKeys, hash)
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.lastID++
+	recognition.ID = strconv.FormatUint(db.store.lastID, 10)
+	db.store.recognitions = append(db.store.recognitions, recognition)
+	return nil
+}
+
+func (db *MemoryDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	recognitions := []Recognition{}
+	skipped := 0
+	for i := len(db.store.recognitions) - 1; i >= 0 && len(recognitions) < limit; i-- {
+		recognition := db.store.recognitions[i]
+		if clientID != "" && recognition.ClientID != clientID {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		recognitions = append(recognitions, recognition)
+	}
+	return recognitions, nil
+}
+
+func (db *MemoryDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.lastID++
+	airplay.ID = strconv.FormatUint(db.store.lastID, 10)
+
+	// Airplays are mostly stored as they start, so the search for their
+	// place is usually short
+	i := len(db.store.airplays)
+	for i > 0 && db.store.airplays[i-1].Started.After(airplay.Started) {
+		i--
+	}
+	db.store.airplays = append(db.store.airplays, Airplay{})
+	copy(db.store.airplays[i+1:], db.store.airplays[i:])
+	db.store.airplays[i] = airplay
+	return nil
+}
+
+func (db *MemoryDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	airplays := []Airplay{}
+	skipped := 0
+	for i := len(db.store.airplays) - 1; i >= 0 && len(airplays) < limit; i-- {
+		airplay := db.store.airplays[i]
+		if !filter.matches(airplay) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		airplays = append(airplays, airplay)
+	}
+	return airplays, nil
+}
+
+// DeleteCollection empties the "songs", "fingerprints", "settings",
+// "recognitions" or "airplay" collection
+func (db *MemoryDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	switch collectionName {
+	case "fingerprints":
+		db.store.resetFingerprints()
+	case "settings":
+		db.store.settings = make(map[string]string)
+	case "recognitions":
+		db.store.recognitions = nil
+	case "airplay":
+		db.store.airplays = nil
+	case "songs":
+		db.store.resetSongs()
+	default:
+		return fmt.Errorf("error deleting collection: unknown collection %q", collectionName)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package utils_test
+
+import (
+	"song-recognition/storagetest"
+	"song-recognition/utils"
+	"testing"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func() utils.DBClient {
+		return utils.NewMemoryDB("conformance")
+	})
+}
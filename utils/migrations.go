@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// schemaVersionKey is the setting the applied schema version is stored under
+const schemaVersionKey = "schemaVersion"
+
+// Migration is a versioned change to a backend's schema. Up applies the
+// change and Down reverts it.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context) error
+	Down        func(ctx context.Context) error
+}
+
+// migrator is implemented by backends that have schema migrations. The
+// returned migrations are numbered from 1 in the order they apply.
+type migrator interface {
+	migrations() []Migration
+}
+
+// Migrate brings the schema of the catalog selected by ctx in the
+// STORAGE_TYPE backend to version target, or to the latest version when
+// target is negative. It returns the versions before and after migrating.
+func Migrate(ctx context.Context, target int) (from, to int, err error) {
+	if readOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	catalog := CatalogFromContext(ctx)
+	if !ValidCatalog(catalog) {
+		return 0, 0, fmt.Errorf("invalid catalog name: %q", catalog)
+	}
+
+	db, _, err := newBackend(catalog, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	return migrate(ctx, db, target)
+}
+
+// CheckSchema fails unless the schema of the catalog selected by ctx in the
+// STORAGE_TYPE backend is at the latest version. Read-only processes check
+// it on startup instead of migrating it.
+func CheckSchema(ctx context.Context) error {
+	catalog := CatalogFromContext(ctx)
+	if !ValidCatalog(catalog) {
+		return fmt.Errorf("invalid catalog name: %q", catalog)
+	}
+
+	db, _, err := newBackend(catalog, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return checkSchema(ctx, db)
+}
+
+func migrate(ctx context.Context, db DBClient, target int) (int, int, error) {
+	var migrations []Migration
+	if m, ok := db.(migrator); ok {
+		migrations = m.migrations()
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	latest := len(migrations)
+	if target < 0 {
+		target = latest
+	}
+	if target > latest {
+		return current, current, fmt.Errorf("schema version %d doesn't exist, the latest is %d", target, latest)
+	}
+	if current > latest {
+		return current, current, fmt.Errorf("schema version %d is newer than this build supports (%d)", current, latest)
+	}
+
+	from := current
+	for current < target {
+		m := migrations[current]
+		if err := m.Up(ctx); err != nil {
+			return from, current, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		current = m.Version
+		if err := db.SetSetting(ctx, schemaVersionKey, strconv.Itoa(current)); err != nil {
+			return from, current, err
+		}
+	}
+	for current > target {
+		m := migrations[current-1]
+		if err := m.Down(ctx); err != nil {
+			return from, current, fmt.Errorf("reverting migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		current = m.Version - 1
+		if err := db.SetSetting(ctx, schemaVersionKey, strconv.Itoa(current)); err != nil {
+			return from, current, err
+		}
+	}
+
+	return from, current, nil
+}
+
+// schemaVersion returns the schema version stored in db, 0 if none is
+func schemaVersion(ctx context.Context, db DBClient) (int, error) {
+	value, exists, err := db.GetSetting(ctx, schemaVersionKey)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %v", value, err)
+	}
+	return version, nil
+}
+
+// checkSchema fails unless the schema of db is at the latest version
+func checkSchema(ctx context.Context, db DBClient) error {
+	latest := 0
+	if m, ok := db.(migrator); ok {
+		latest = len(m.migrations())
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("schema version %d isn't the latest (%d), migrate it from a process that can write", current, latest)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of file, on systems it can't be
+// mapped in memory on
+func mapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases data, returned by mapFile
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,1227 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"regexp"
+	"song-recognition/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// mongoDatabase is the database of the default catalog. Other catalogs
+// have a database named after it and the catalog.
+const mongoDatabase = "song-recognition"
+
+// mongoSongFields maps the fields songs are looked up by to the fields of
+// song documents, whose ID is kept in _id
+var mongoSongFields = map[SongField]string{
+	SongFieldID:   "_id",
+	SongFieldYTID: "ytID",
+	SongFieldKey:  "key",
+}
+
+// MongoDB is a DBClient backed by MongoDB
+type MongoDB struct {
+	client   *mongo.Client
+	catalog  string
+	readOnly bool
+}
+
+var (
+	// mongoMaxPoolSize and mongoMinPoolSize bound the connections kept open
+	// to the server. Set with MONGO_MAX_POOL_SIZE and MONGO_MIN_POOL_SIZE.
+	mongoMaxPoolSize = intFromEnv("MONGO_MAX_POOL_SIZE", 100)
+	mongoMinPoolSize = intFromEnv("MONGO_MIN_POOL_SIZE", 0)
+
+	// mongoConnectTimeout bounds opening a connection, and
+	// mongoServerSelectionTimeout how long an operation waits for a server
+	// to become available. Set with MONGO_CONNECT_TIMEOUT and
+	// MONGO_SERVER_SELECTION_TIMEOUT.
+	mongoConnectTimeout         = durationFromEnv("MONGO_CONNECT_TIMEOUT", 10*time.Second)
+	mongoServerSelectionTimeout = durationFromEnv("MONGO_SERVER_SELECTION_TIMEOUT", 30*time.Second)
+
+	// mongoMaxRetries is how many times an operation failing with a
+	// transient error is retried, waiting mongoRetryBackoff before the
+	// first retry and twice as long before each next one. Set with
+	// MONGO_MAX_RETRIES and MONGO_RETRY_BACKOFF.
+	mongoMaxRetries   = intFromEnv("MONGO_MAX_RETRIES", 3)
+	mongoRetryBackoff = durationFromEnv("MONGO_RETRY_BACKOFF", 100*time.Millisecond)
+)
+
+// mongoMaxRetryBackoff caps the wait between two retries
+const mongoMaxRetryBackoff = 5 * time.Second
+
+var (
+	mongoClientMu sync.Mutex
+	// mongoClient is shared by every MongoDB of the process, so they draw
+	// from one connection pool instead of each opening its own
+	mongoClient *mongo.Client
+)
+
+// sharedMongoClient returns the client shared by every MongoDB, connecting
+// it the first time
+func sharedMongoClient() (*mongo.Client, error) {
+	mongoClientMu.Lock()
+	defer mongoClientMu.Unlock()
+
+	if mongoClient != nil {
+		return mongoClient, nil
+	}
+
+	dbUri := "mongodb://" + dbUsername + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName
+	if dbUsername == "" || dbPassword == "" {
+		dbUri = "mongodb://localhost:27017"
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(dbUri).
+		SetMaxPoolSize(uint64(mongoMaxPoolSize)).
+		SetMinPoolSize(uint64(mongoMinPoolSize)).
+		SetConnectTimeout(mongoConnectTimeout).
+		SetServerSelectionTimeout(mongoServerSelectionTimeout)
+	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MongoDB: %v", err)
+	}
+
+	mongoClient = client
+	return client, nil
+}
+
+// CloseConnections closes the connections shared by the clients of the
+// storage backends, once the process no longer needs them
+func CloseConnections(ctx context.Context) error {
+	closeCassandraSession()
+
+	mongoClientMu.Lock()
+	defer mongoClientMu.Unlock()
+
+	if mongoClient == nil {
+		return nil
+	}
+	err := mongoClient.Disconnect(ctx)
+	mongoClient = nil
+	return err
+}
+
+// newMongoDB creates a new instance of MongoDB for catalog. A read-only
+// instance reads from secondaries when there are any, which spreads
+// recognitions over the replica set.
+func newMongoDB(catalog string, readOnly bool) (*MongoDB, error) {
+	client, err := sharedMongoClient()
+	if err != nil {
+		return nil, err
+	}
+	return &MongoDB{client: client, catalog: catalog, readOnly: readOnly}, nil
+}
+
+// withMongoRetry calls op until it succeeds, fails with an error that isn't
+// transient, or has been retried mongoMaxRetries times. op must be safe to
+// repeat, and must return the errors of the driver unwrapped so they can be
+// told apart.
+func withMongoRetry(ctx context.Context, operation string, op func() error) error {
+	backoff := mongoRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > mongoMaxRetries || !transientMongoError(ctx, err) {
+			return err
+		}
+
+		// Waiting a random part of the backoff keeps clients that failed
+		// together from retrying together
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logger := GetLogger()
+		logger.WarnContext(ctx, "retrying MongoDB operation.",
+			slog.String("operation", operation),
+			slog.Int("attempt", attempt),
+			slog.Duration("wait", wait),
+			slog.Any("error", xerrors.New(err)),
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, mongoMaxRetryBackoff)
+	}
+}
+
+// transientMongoError reports whether err is likely to go away by itself,
+// like a dropped connection or an election, rather than be caused by the
+// operation or by ctx ending
+func transientMongoError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	return errors.As(err, &labeled) &&
+		(labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError"))
+}
+
+// database returns the database of the client's catalog
+func (db *MongoDB) database() *mongo.Database {
+	opts := options.Database()
+	if db.readOnly {
+		opts.SetReadPreference(readpref.SecondaryPreferred())
+	}
+
+	if db.catalog == DefaultCatalog {
+		return db.client.Database(mongoDatabase, opts)
+	}
+	return db.client.Database(mongoDatabase+"_"+db.catalog, opts)
+}
+
+// Close releases the client. The shared connection pool stays open for the
+// other clients, until CloseConnections.
+func (db *MongoDB) Close() error {
+	db.client = nil
+	return nil
+}
+
+// Ping checks that the MongoDB server can be reached
+func (db *MongoDB) Ping(ctx context.Context) error {
+	return db.client.Ping(ctx, nil)
+}
+
+// Capabilities reports the capabilities of MongoDB, which stores a
+// fingerprint per update
+func (db *MongoDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "mongo",
+		Transactions: false,
+		MaxBatchSize: 1,
+		NativeSearch: true,
+		SharedAccess: true,
+	}
+}
+
+func (db *MongoDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	collection := db.database().Collection("fingerprints")
+
+	for address, couple := range fingerprints {
+		filter := bson.M{"_id": address}
+		// $addToSet rather than $push, so an update that is retried after
+		// it was applied doesn't add the couple twice
+		update := bson.M{
+			"$addToSet": bson.M{
+				"couples": bson.M{
+					"anchorTimeMs": couple.AnchorTimeMs,
+					"songID":       couple.SongID,
+				},
+			},
+		}
+		opts := options.Update().SetUpsert(true)
+
+		err := withMongoRetry(ctx, "StoreFingerprints", func() error {
+			_, err := collection.UpdateOne(ctx, filter, update, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error upserting document: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *MongoDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	collection := db.database().Collection("fingerprints")
+
+	couples := make(map[uint32][]models.Couple)
+
+	for _, chunk := range chunkAddresses(addresses, addressBatchSize) {
+		// Find all documents corresponding to the addresses in this chunk.
+		// A retry reads the chunk again, overwriting what was read of it.
+		err := withMongoRetry(ctx, "GetCouples", func() error {
+			cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": chunk}})
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(ctx)
+
+			for cursor.Next(ctx) {
+				var result bson.M
+				if err := cursor.Decode(&result); err != nil {
+					return fmt.Errorf("error decoding document: %s", err)
+				}
+
+				address, docCouples, err := couplesFromDocument(result)
+				if err != nil {
+					return err
+				}
+				couples[address] = docCouples
+			}
+			return cursor.Err()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving documents for addresses: %s", err)
+		}
+	}
+
+	return couples, nil
+}
+
+// couplesFromDocument returns the address and couples of a document of the
+// fingerprints collection
+func couplesFromDocument(result bson.M) (uint32, []models.Couple, error) {
+	id, ok := result["_id"].(int64)
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid address in document: %v", result["_id"])
+	}
+	address := uint32(id)
+
+	couplesList, ok := result["couples"].(primitive.A)
+	if !ok {
+		return 0, nil, fmt.Errorf("couples field in document for address %d is not valid", address)
+	}
+
+	var couples []models.Couple
+	for _, item := range couplesList {
+		itemMap, ok := item.(primitive.M)
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid couple format in document for address %d", address)
+		}
+
+		couple := models.Couple{
+			AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
+			SongID:       uint32(itemMap["songID"].(int64)),
+		}
+		couples = append(couples, couple)
+	}
+
+	return address, couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address
+func (db *MongoDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	collection := db.database().Collection("fingerprints")
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("error retrieving fingerprints: %s", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var result bson.M
+		if err := cursor.Decode(&result); err != nil {
+			return fmt.Errorf("error decoding document: %s", err)
+		}
+
+		address, couples, err := couplesFromDocument(result)
+		if err != nil {
+			return err
+		}
+		if err := fn(address, couples); err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("error iterating documents: %s", err)
+	}
+	return nil
+}
+
+func (db *MongoDB) TotalSongs(ctx context.Context) (int, error) {
+	existingSongsCollection := db.database().Collection("songs")
+	var total int64
+	err := withMongoRetry(ctx, "TotalSongs", func() (err error) {
+		total, err = existingSongsCollection.CountDocuments(ctx, bson.D{})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(total), nil
+}
+
+func (db *MongoDB) TotalFingerprints(ctx context.Context) (int, error) {
+	return db.countCouples(ctx, "TotalFingerprints", mongo.Pipeline{
+		{{"$group", bson.M{"_id": nil, "total": bson.M{"$sum": bson.M{"$size": "$couples"}}}}},
+	})
+}
+
+func (db *MongoDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	ofSong := bson.M{"$filter": bson.M{
+		"input": "$couples",
+		"cond":  bson.M{"$eq": bson.A{"$$this.songID", songID}},
+	}}
+	return db.countCouples(ctx, "FingerprintCountBySong", mongo.Pipeline{
+		{{"$match", bson.M{"couples.songID": songID}}},
+		{{"$group", bson.M{"_id": nil, "total": bson.M{"$sum": bson.M{"$size": ofSong}}}}},
+	})
+}
+
+// countCouples runs an aggregation of the fingerprints that sums couples
+// into a total
+func (db *MongoDB) countCouples(ctx context.Context, operation string, pipeline mongo.Pipeline) (int, error) {
+	collection := db.database().Collection("fingerprints")
+
+	var total int64
+	err := withMongoRetry(ctx, operation, func() error {
+		cursor, err := collection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		// No document is returned when nothing matched
+		total = 0
+		if cursor.Next(ctx) {
+			var result struct {
+				Total int64 `bson:"total"`
+			}
+			if err := cursor.Decode(&result); err != nil {
+				return fmt.Errorf("error decoding count: %v", err)
+			}
+			total = result.Total
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count fingerprints: %v", err)
+	}
+
+	return int(total), nil
+}
+
+// StorageSize returns the size of the catalog's database on disk, indexes
+// included
+func (db *MongoDB) StorageSize(ctx context.Context) (int64, error) {
+	var stats struct {
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	err := withMongoRetry(ctx, "StorageSize", func() error {
+		return db.database().RunCommand(ctx, bson.D{{"dbStats", 1}}).Decode(&stats)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database stats: %v", err)
+	}
+
+	return int64(stats.StorageSize + stats.IndexSize), nil
+}
+
+func (db *MongoDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints stores the fingerprints of a song, then
+// registers it. See storeBeforeRegistering.
+func (db *MongoDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	err := storeBeforeRegistering(ctx, db, songID, fingerprint(songID), func() error {
+		return db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+func (db *MongoDB) registerSong(ctx context.Context, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	existingSongsCollection := db.database().Collection("songs")
+
+	// Create a compound unique index on ytID and key, if it doesn't already exist
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	err := withMongoRetry(ctx, "RegisterSong", func() error {
+		_, err := existingSongsCollection.Indexes().CreateOne(ctx, indexModel)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create unique index: %v", err)
+	}
+
+	// Attempt to insert the song with ytID and key
+	key := GenerateSongKey(songTitle, songArtist)
+	document := bson.M{
+		"_id":         songID,
+		"key":         key,
+		"title":       songTitle,
+		"artist":      songArtist,
+		"album":       meta.Album,
+		"duration":    int64(meta.Duration),
+		"releaseYear": int64(meta.ReleaseYear),
+		"coverURL":    meta.CoverURL,
+		"source":      meta.Source,
+		"sourceURL":   meta.SourceURL,
+	}
+	if meta.RecordingMBID != "" {
+		document["recordingMBID"] = meta.RecordingMBID
+	}
+	if meta.ReleaseMBID != "" {
+		document["releaseMBID"] = meta.ReleaseMBID
+	}
+	if !meta.Provenance.IsZero() {
+		document["provenance"] = meta.Provenance
+	}
+	// Songs without a YouTube ID leave the field out rather than store ""
+	if ytID != "" {
+		document["ytID"] = ytID
+	}
+
+	// The insert isn't retried here, since a retry after it was applied
+	// would fail on the unique index. The driver already retries it once,
+	// safely, on replica sets.
+	_, err = existingSongsCollection.InsertOne(ctx, document)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		} else {
+			return fmt.Errorf("failed to register song: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *MongoDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+
+	name, ok := mongoSongFields[field]
+	if !ok {
+		return Song{}, false, errSongField(field)
+	}
+
+	songsCollection := db.database().Collection("songs")
+	var song bson.M
+
+	filter := bson.M{name: value}
+
+	err := withMongoRetry(ctx, "GetSong", func() error {
+		return songsCollection.FindOne(ctx, filter).Decode(&song)
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+
+	return songFromDocument(song), true, nil
+}
+
+// songFromDocument builds a Song from a document of the songs collection
+func songFromDocument(song bson.M) Song {
+	id, _ := song["_id"].(int64)
+	ytID, _ := song["ytID"].(string)
+	title, _ := song["title"].(string)
+	artist, _ := song["artist"].(string)
+
+	album, _ := song["album"].(string)
+	coverURL, _ := song["coverURL"].(string)
+	source, _ := song["source"].(string)
+	sourceURL, _ := song["sourceURL"].(string)
+	recordingMBID, _ := song["recordingMBID"].(string)
+	releaseMBID, _ := song["releaseMBID"].(string)
+	meta := SongMetadata{
+		Album:         album,
+		Duration:      documentInt(song["duration"]),
+		ReleaseYear:   documentInt(song["releaseYear"]),
+		CoverURL:      coverURL,
+		Source:        source,
+		SourceURL:     sourceURL,
+		RecordingMBID: recordingMBID,
+		ReleaseMBID:   releaseMBID,
+	}
+	if provenance, ok := song["provenance"]; ok {
+		// A provenance that can't be decoded is left empty, like with the
+		// other backends
+		if data, err := bson.Marshal(provenance); err == nil {
+			bson.Unmarshal(data, &meta.Provenance)
+		}
+	}
+
+	return Song{ID: uint32(id), Title: title, Artist: artist, YouTubeID: ytID, SongMetadata: meta}
+}
+
+// documentInt returns the integer value of a document field, or 0 if the
+// field is missing, as in songs saved before it was added
+func documentInt(value interface{}) int {
+	switch v := value.(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+func (db *MongoDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *MongoDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *MongoDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+// mongoSongOrders maps the ListSongs orders to sort documents
+var mongoSongOrders = map[string]bson.D{
+	SortByTitle:  {{Key: "title", Value: 1}, {Key: "artist", Value: 1}, {Key: "_id", Value: 1}},
+	SortByArtist: {{Key: "artist", Value: 1}, {Key: "title", Value: 1}, {Key: "_id", Value: 1}},
+	SortByID:     {{Key: "_id", Value: 1}},
+}
+
+func (db *MongoDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	songsCollection := db.database().Collection("songs")
+
+	order, err := songOrder(sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(mongoSongOrders[order])
+	if offset > 0 {
+		opts.SetSkip(int64(offset))
+	}
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	var songs []Song
+	err = withMongoRetry(ctx, "ListSongs", func() error {
+		cursor, err := songsCollection.Find(ctx, bson.D{}, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		songs = []Song{}
+		for cursor.Next(ctx) {
+			var song bson.M
+			if err := cursor.Decode(&song); err != nil {
+				return fmt.Errorf("failed to decode song: %v", err)
+			}
+			songs = append(songs, songFromDocument(song))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+// SearchSongs ranks the songs whose title or artist contains the
+// beginning of a word of query
+func (db *MongoDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SongSearchResult{}, nil
+	}
+
+	conditions := bson.A{}
+	for _, term := range terms {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(term), Options: "i"}
+		conditions = append(conditions, bson.M{"title": pattern}, bson.M{"artist": pattern})
+	}
+
+	songsCollection := db.database().Collection("songs")
+	var songs []Song
+	err := withMongoRetry(ctx, "SearchSongs", func() error {
+		cursor, err := songsCollection.Find(ctx, bson.M{"$or": conditions})
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		songs = songs[:0]
+		for cursor.Next(ctx) {
+			var song bson.M
+			if err := cursor.Decode(&song); err != nil {
+				return fmt.Errorf("failed to decode song: %v", err)
+			}
+			songs = append(songs, songFromDocument(song))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *MongoDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	if err := db.DeleteFingerprintsBySongID(ctx, songID); err != nil {
+		return err
+	}
+
+	songsCollection := db.database().Collection("songs")
+
+	filter := bson.M{"_id": songID}
+
+	err := withMongoRetry(ctx, "DeleteSongByID", func() error {
+		_, err := songsCollection.DeleteOne(ctx, filter)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteSongs deletes songs along with their fingerprints, a batch of songs
+// at a time
+func (db *MongoDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	songsCollection := db.database().Collection("songs")
+
+	for _, chunk := range chunkAddresses(songIDs, addressBatchSize) {
+		if err := db.deleteFingerprints(ctx, "DeleteSongs", chunk); err != nil {
+			return err
+		}
+
+		err := withMongoRetry(ctx, "DeleteSongs", func() error {
+			_, err := songsCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": chunk}})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete songs: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteFingerprintsBySongID removes the couples of songID from every
+// address, and the addresses left without couples
+func (db *MongoDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	return db.deleteFingerprints(ctx, "DeleteFingerprintsBySongID", []uint32{songID})
+}
+
+// deleteFingerprints removes the couples of songIDs from every address, and
+// the addresses left without couples
+func (db *MongoDB) deleteFingerprints(ctx context.Context, operation string, songIDs []uint32) error {
+	collection := db.database().Collection("fingerprints")
+	ofSongs := bson.M{"$in": songIDs}
+
+	// Look the addresses up through the couples.songID index first, so the
+	// updates below don't scan the whole collection
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	var addresses []uint32
+	err := withMongoRetry(ctx, operation, func() error {
+		cursor, err := collection.Find(ctx, bson.M{"couples.songID": ofSongs}, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		addresses = addresses[:0]
+		for cursor.Next(ctx) {
+			var result bson.M
+			if err := cursor.Decode(&result); err != nil {
+				return fmt.Errorf("error decoding document: %s", err)
+			}
+			id, ok := result["_id"].(int64)
+			if !ok {
+				return fmt.Errorf("invalid address in document: %v", result["_id"])
+			}
+			addresses = append(addresses, uint32(id))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find fingerprints: %v", err)
+	}
+
+	update := bson.M{"$pull": bson.M{"couples": bson.M{"songID": ofSongs}}}
+	for _, chunk := range chunkAddresses(addresses, addressBatchSize) {
+		err := withMongoRetry(ctx, operation, func() error {
+			_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": chunk}}, update)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+
+		empty := bson.M{"_id": bson.M{"$in": chunk}, "couples": bson.M{"$size": 0}}
+		err = withMongoRetry(ctx, operation, func() error {
+			_, err := collection.DeleteMany(ctx, empty)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete empty fingerprints: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// GetSetting returns the value stored under key in the settings collection
+func (db *MongoDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	settingsCollection := db.database().Collection("settings")
+
+	var setting bson.M
+	err := withMongoRetry(ctx, "GetSetting", func() error {
+		return settingsCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&setting)
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	value, _ := setting["value"].(string)
+	return value, true, nil
+}
+
+// SetSetting stores value under key in the settings collection
+func (db *MongoDB) SetSetting(ctx context.Context, key, value string) error {
+	settingsCollection := db.database().Collection("settings")
+
+	opts := options.Update().SetUpsert(true)
+	err := withMongoRetry(ctx, "SetSetting", func() error {
+		_, err := settingsCollection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"value": value}}, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+// StoreAPIKey stores key in the apiKeys collection, under its hash
+func (db *MongoDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	collection := db.database().Collection("apiKeys")
+
+	_, err := collection.InsertOne(ctx, bson.M{
+		"_id":       key.Hash,
+		"id":        key.ID,
+		"name":      key.Name,
+		"catalog":   key.Catalog,
+		"rateLimit": key.RateLimit,
+		"created":   key.Created,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+// apiKeyFromDocument converts an apiKeys document to an APIKey
+func apiKeyFromDocument(doc bson.M) APIKey {
+	key := APIKey{}
+	key.Hash, _ = doc["_id"].(string)
+	key.ID, _ = doc["id"].(string)
+	key.Name, _ = doc["name"].(string)
+	key.Catalog, _ = doc["catalog"].(string)
+	switch rateLimit := doc["rateLimit"].(type) {
+	case int32:
+		key.RateLimit = int(rateLimit)
+	case int64:
+		key.RateLimit = int(rateLimit)
+	}
+	if created, ok := doc["created"].(primitive.DateTime); ok {
+		key.Created = created.Time().UTC()
+	}
+	return key
+}
+
+func (db *MongoDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	collection := db.database().Collection("apiKeys")
+
+	var doc bson.M
+	err := withMongoRetry(ctx, "GetAPIKey", func() error {
+		return collection.FindOne(ctx, bson.M{"_id": hash}).Decode(&doc)
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+
+	return apiKeyFromDocument(doc), true, nil
+}
+
+func (db *MongoDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	collection := db.database().Collection("apiKeys")
+
+	var keys []APIKey
+	err := withMongoRetry(ctx, "ListAPIKeys", func() error {
+		cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created", Value: 1}}))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		keys = []APIKey{}
+		for cursor.Next(ctx) {
+			var doc bson.M
+			if err := cursor.Decode(&doc); err != nil {
+				return fmt.Errorf("failed to decode API key: %v", err)
+			}
+			keys = append(keys, apiKeyFromDocument(doc))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+
+	return keys, nil
+}
+
+func (db *MongoDB) DeleteAPIKey(ctx context.Context, id string) error {
+	collection := db.database().Collection("apiKeys")
+
+	err := withMongoRetry(ctx, "DeleteAPIKey", func() error {
+		_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %v", err)
+	}
+
+	return nil
+}
+
+// StoreRecognition stores recognition in the recognitions collection
+func (db *MongoDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	collection := db.database().Collection("recognitions")
+
+	_, err := collection.InsertOne(ctx, bson.M{
+		"time":       recognition.Time,
+		"songID":     recognition.SongID,
+		"songTitle":  recognition.SongTitle,
+		"songArtist": recognition.SongArtist,
+		"confidence": recognition.Confidence,
+		"clientId":   recognition.ClientID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+// recognitionFromDocument converts a recognitions document to a Recognition
+func recognitionFromDocument(doc bson.M) Recognition {
+	recognition := Recognition{}
+	if id, ok := doc["_id"].(primitive.ObjectID); ok {
+		recognition.ID = id.Hex()
+	}
+	if t, ok := doc["time"].(primitive.DateTime); ok {
+		recognition.Time = t.Time().UTC()
+	}
+	switch songID := doc["songID"].(type) {
+	case int32:
+		recognition.SongID = uint32(songID)
+	case int64:
+		recognition.SongID = uint32(songID)
+	}
+	recognition.SongTitle, _ = doc["songTitle"].(string)
+	recognition.SongArtist, _ = doc["songArtist"].(string)
+	recognition.Confidence, _ = doc["confidence"].(float64)
+	recognition.ClientID, _ = doc["clientId"].(string)
+	return recognition
+}
+
+func (db *MongoDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	collection := db.database().Collection("recognitions")
+
+	filter := bson.M{}
+	if clientID != "" {
+		filter["clientId"] = clientID
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+
+	var recognitions []Recognition
+	err := withMongoRetry(ctx, "ListRecognitions", func() error {
+		cursor, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		recognitions = []Recognition{}
+		for cursor.Next(ctx) {
+			var doc bson.M
+			if err := cursor.Decode(&doc); err != nil {
+				return fmt.Errorf("failed to decode recognition: %v", err)
+			}
+			recognitions = append(recognitions, recognitionFromDocument(doc))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+
+	return recognitions, nil
+}
+
+// StoreAirplay stores airplay in the airplay collection
+func (db *MongoDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	collection := db.database().Collection("airplay")
+
+	_, err := collection.InsertOne(ctx, bson.M{
+		"station":    airplay.Station,
+		"songID":     airplay.SongID,
+		"songTitle":  airplay.SongTitle,
+		"songArtist": airplay.SongArtist,
+		"started":    airplay.Started,
+		"ended":      airplay.Ended,
+		"confidence": airplay.Confidence,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+// airplayFromDocument converts an airplay document to an Airplay
+func airplayFromDocument(doc bson.M) Airplay {
+	airplay := Airplay{}
+	if id, ok := doc["_id"].(primitive.ObjectID); ok {
+		airplay.ID = id.Hex()
+	}
+	airplay.Station, _ = doc["station"].(string)
+	switch songID := doc["songID"].(type) {
+	case int32:
+		airplay.SongID = uint32(songID)
+	case int64:
+		airplay.SongID = uint32(songID)
+	}
+	airplay.SongTitle, _ = doc["songTitle"].(string)
+	airplay.SongArtist, _ = doc["songArtist"].(string)
+	if t, ok := doc["started"].(primitive.DateTime); ok {
+		airplay.Started = t.Time().UTC()
+	}
+	if t, ok := doc["ended"].(primitive.DateTime); ok {
+		airplay.Ended = t.Time().UTC()
+	}
+	airplay.Confidence, _ = doc["confidence"].(float64)
+	return airplay
+}
+
+func (db *MongoDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	collection := db.database().Collection("airplay")
+
+	query := bson.M{}
+	if filter.Station != "" {
+		query["station"] = filter.Station
+	}
+	started := bson.M{}
+	if !filter.From.IsZero() {
+		started["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		started["$lt"] = filter.To
+	}
+	if len(started) > 0 {
+		query["started"] = started
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "started", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+
+	var airplays []Airplay
+	err := withMongoRetry(ctx, "ListAirplays", func() error {
+		cursor, err := collection.Find(ctx, query, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		airplays = []Airplay{}
+		for cursor.Next(ctx) {
+			var doc bson.M
+			if err := cursor.Decode(&doc); err != nil {
+				return fmt.Errorf("failed to decode airplay: %v", err)
+			}
+			airplays = append(airplays, airplayFromDocument(doc))
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+
+	return airplays, nil
+}
+
+func (db *MongoDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	collection := db.database().Collection(collectionName)
+	err := withMongoRetry(ctx, "DeleteCollection", func() error {
+		return collection.Drop(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// migrations returns the schema migrations of the MongoDB backend
+func (db *MongoDB) migrations() []Migration {
+	fingerprints := db.database().Collection("fingerprints")
+	songs := db.database().Collection("songs")
+	recognitions := db.database().Collection("recognitions")
+	airplay := db.database().Collection("airplay")
+
+	return []Migration{
+		{
+			Version:     1,
+			Description: "index fingerprints by song ID",
+			Up: func(ctx context.Context) error {
+				_, err := fingerprints.Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "couples.songID", Value: 1}},
+					Options: options.Index().SetName("couples_songID"),
+				})
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := fingerprints.Indexes().DropOne(ctx, "couples_songID")
+				return err
+			},
+		},
+		{
+			Version:     2,
+			Description: "store song titles and artists as fields for sorting",
+			Up: func(ctx context.Context) error {
+				cursor, err := songs.Find(ctx, bson.M{"title": bson.M{"$exists": false}})
+				if err != nil {
+					return err
+				}
+				defer cursor.Close(ctx)
+
+				for cursor.Next(ctx) {
+					var document bson.M
+					if err := cursor.Decode(&document); err != nil {
+						return err
+					}
+					parts := strings.Split(document["key"].(string), "---")
+					update := bson.M{"$set": bson.M{"title": parts[0], "artist": parts[1]}}
+					if _, err := songs.UpdateOne(ctx, bson.M{"_id": document["_id"]}, update); err != nil {
+						return err
+					}
+				}
+				return cursor.Err()
+			},
+			Down: func(ctx context.Context) error {
+				_, err := songs.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"title": "", "artist": ""}})
+				return err
+			},
+		},
+		{
+			Version:     3,
+			Description: "leave out empty YouTube IDs",
+			Up: func(ctx context.Context) error {
+				_, err := songs.UpdateMany(ctx, bson.M{"ytID": ""}, bson.M{"$unset": bson.M{"ytID": ""}})
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := songs.UpdateMany(ctx, bson.M{"ytID": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"ytID": ""}})
+				return err
+			},
+		},
+		{
+			Version:     4,
+			Description: "index recognitions by client ID and time",
+			Up: func(ctx context.Context) error {
+				_, err := recognitions.Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "clientId", Value: 1}, {Key: "time", Value: -1}},
+					Options: options.Index().SetName("clientId_time"),
+				})
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := recognitions.Indexes().DropOne(ctx, "clientId_time")
+				return err
+			},
+		},
+		{
+			Version:     5,
+			Description: "index airplay by station and start time",
+			Up: func(ctx context.Context) error {
+				_, err := airplay.Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{
+						Keys:    bson.D{{Key: "started", Value: -1}},
+						Options: options.Index().SetName("started"),
+					},
+					{
+						Keys:    bson.D{{Key: "station", Value: 1}, {Key: "started", Value: -1}},
+						Options: options.Index().SetName("station_started"),
+					},
+				})
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				if _, err := airplay.Indexes().DropOne(ctx, "started"); err != nil {
+					return err
+				}
+				_, err := airplay.Indexes().DropOne(ctx, "station_started")
+				return err
+			},
+		},
+		songKeyMigration(6, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		songKeyMigration(7, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// rekeySong saves a song under key
+func (db *MongoDB) rekeySong(ctx context.Context, song storedSongKey, key string) error {
+	_, err := db.database().Collection("songs").UpdateOne(ctx, bson.M{"_id": song.ID}, bson.M{"$set": bson.M{"key": key}})
+	return err
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *MongoDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	projection := options.Find().SetProjection(bson.M{"_id": 1, "ytID": 1, "title": 1, "artist": 1, "key": 1})
+	cursor, err := db.database().Collection("songs").Find(ctx, bson.M{}, projection)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []storedSongKey
+	for cursor.Next(ctx) {
+		var document bson.M
+		if err := cursor.Decode(&document); err != nil {
+			return nil, err
+		}
+		song := songFromDocument(document)
+		key, _ := document["key"].(string)
+		songs = append(songs, storedSongKey{ID: song.ID, YouTubeID: song.YouTubeID, Title: song.Title, Artist: song.Artist, Key: key})
+	}
+	return songs, cursor.Err()
+}
@@ -0,0 +1,902 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlColumns maps the fields songs are looked up by to MySQL column
+// names. "key" is a reserved word in MySQL, hence song_key.
+var mysqlColumns = map[SongField]string{
+	SongFieldID:   "id",
+	SongFieldYTID: "yt_id",
+	SongFieldKey:  "song_key",
+}
+
+// MySQLDB is a DBClient backed by MySQL or MariaDB
+type MySQLDB struct {
+	db *sql.DB
+}
+
+// newMySQLDB creates a new instance of MySQLDB for catalog and makes sure
+// the schema exists. Catalogs other than the default one have their own
+// database, named after DB_NAME and the catalog, which is created if needed.
+// A read-only instance creates nothing.
+func newMySQLDB(catalog string, readOnly bool) (*MySQLDB, error) {
+	host := dbHost
+	if host == "" {
+		host = "localhost"
+	}
+	port := dbPort
+	if port == "" {
+		port = "3306"
+	}
+	name := dbName
+	if name == "" {
+		name = "song-recognition"
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = dbUsername
+	cfg.Passwd = dbPassword
+	cfg.Net = "tcp"
+	cfg.Addr = host + ":" + port
+	cfg.DBName = name
+	cfg.ParseTime = true
+
+	if catalog != DefaultCatalog {
+		cfg.DBName = name + "_" + catalog
+	}
+	if catalog != DefaultCatalog && !readOnly {
+		if err := createMySQLDatabase(cfg); err != nil {
+			return nil, fmt.Errorf("error creating catalog database: %v", err)
+		}
+	}
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MySQL: %v", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to MySQL: %v", err)
+	}
+
+	my := &MySQLDB{db: db}
+	if readOnly {
+		return my, nil
+	}
+	if err := my.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return my, nil
+}
+
+// createMySQLDatabase creates the database of cfg if it doesn't exist
+func createMySQLDatabase(cfg *mysql.Config) error {
+	name := cfg.DBName
+	cfg = cfg.Clone()
+	cfg.DBName = ""
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS `" + name + "` CHARACTER SET utf8mb4")
+	return err
+}
+
+func (db *MySQLDB) createTables() error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS songs (
+			id INT UNSIGNED PRIMARY KEY,
+			title TEXT NOT NULL,
+			artist TEXT NOT NULL,
+			yt_id VARCHAR(64) NOT NULL,
+			song_key VARCHAR(512) NOT NULL,
+			UNIQUE KEY songs_yt_id_key (yt_id, song_key),
+			KEY songs_key (song_key)
+		) CHARACTER SET utf8mb4`,
+
+		`CREATE TABLE IF NOT EXISTS fingerprints (
+			address INT UNSIGNED NOT NULL,
+			anchor_time_ms INT UNSIGNED NOT NULL,
+			song_id INT UNSIGNED NOT NULL,
+			PRIMARY KEY (address, anchor_time_ms, song_id),
+			KEY fingerprints_song_id_idx (song_id)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS settings (
+			name VARCHAR(191) PRIMARY KEY,
+			value TEXT NOT NULL
+		) CHARACTER SET utf8mb4`,
+	}
+
+	for _, statement := range statements {
+		if _, err := db.db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying database handle
+func (db *MySQLDB) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+// Ping checks that the MySQL server can be reached
+func (db *MySQLDB) Ping(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+// Capabilities reports the capabilities of MySQL
+func (db *MySQLDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "mysql",
+		Transactions: true,
+		MaxBatchSize: insertBatchSize,
+		NativeSearch: true,
+		SharedAccess: true,
+	}
+}
+
+func (db *MySQLDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	err = insertFingerprints(ctx, tx, fingerprints, mysqlFingerprintsQuery)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// mysqlFingerprintsQuery returns the statement that inserts n
+// fingerprints, skipping those already stored
+func mysqlFingerprintsQuery(n int) string {
+	return "INSERT IGNORE INTO fingerprints (address, anchor_time_ms, song_id) VALUES (?, ?, ?)" +
+		strings.Repeat(", (?, ?, ?)", n-1)
+}
+
+func (db *MySQLDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples := make(map[uint32][]models.Couple)
+
+	for _, chunk := range chunkAddresses(addresses, addressBatchSize) {
+		args := make([]interface{}, len(chunk))
+		for i, address := range chunk {
+			args[i] = address
+		}
+
+		query := fmt.Sprintf(
+			"SELECT address, anchor_time_ms, song_id FROM fingerprints WHERE address IN (?%s)",
+			strings.Repeat(", ?", len(chunk)-1),
+		)
+
+		rows, err := db.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error querying couples: %v", err)
+		}
+
+		for rows.Next() {
+			var address uint32
+			var couple models.Couple
+			if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning couple: %v", err)
+			}
+			couples[address] = append(couples[address], couple)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating couples: %v", err)
+		}
+	}
+
+	return couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address
+func (db *MySQLDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	rows, err := db.db.QueryContext(ctx, "SELECT address, anchor_time_ms, song_id FROM fingerprints ORDER BY address")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	defer rows.Close()
+
+	var (
+		current uint32
+		couples []models.Couple
+	)
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning couple: %v", err)
+		}
+
+		// Rows are ordered by address, so an address is complete once the next one starts
+		if len(couples) > 0 && address != current {
+			if err := fn(current, couples); err != nil {
+				return err
+			}
+			couples = nil
+		}
+		current = address
+		couples = append(couples, couple)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating fingerprints: %v", err)
+	}
+
+	if len(couples) > 0 {
+		return fn(current, couples)
+	}
+	return nil
+}
+
+func (db *MySQLDB) TotalSongs(ctx context.Context) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (db *MySQLDB) TotalFingerprints(ctx context.Context) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (db *MySQLDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE song_id = ?", int64(songID)).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// StorageSize returns the size of the tables of the catalog's database,
+// indexes included
+func (db *MySQLDB) StorageSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := db.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables
+		WHERE table_schema = DATABASE()`).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (db *MySQLDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := insertMySQLSong(ctx, db.db, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints registers a song and stores its
+// fingerprints in one transaction
+func (db *MySQLDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	fingerprints := fingerprint(songID)
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	if err := insertMySQLSong(ctx, tx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := insertFingerprints(ctx, tx, fingerprints, mysqlFingerprintsQuery); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	return songID, nil
+}
+
+// insertMySQLSong inserts the row of a song with exec
+func insertMySQLSong(ctx context.Context, exec sqlExecer, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	key := GenerateSongKey(songTitle, songArtist)
+
+	_, err := exec.ExecContext(ctx,
+		`INSERT INTO songs (id, title, artist, yt_id, song_key, album, duration, release_year, cover_url, source, source_url, provenance, recording_mbid, release_mbid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		songID, songTitle, songArtist, nullString(ytID), key, meta.Album, meta.Duration, meta.ReleaseYear, meta.CoverURL,
+		meta.Source, meta.SourceURL, meta.Provenance, meta.RecordingMBID, meta.ReleaseMBID,
+	)
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 { // ER_DUP_ENTRY
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+	column, ok := mysqlColumns[field]
+	if !ok {
+		return Song{}, false, errSongField(field)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM songs WHERE %s = ?", sqlSongColumns, column)
+
+	var song Song
+	err := db.db.QueryRowContext(ctx, query, value).Scan(append([]interface{}{&song.ID}, songFields(&song)...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+
+	return song, true, nil
+}
+
+func (db *MySQLDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *MySQLDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *MySQLDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+func (db *MySQLDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	order, err := songOrder(sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + sqlSongColumns + " FROM songs ORDER BY " + sqlSongOrders[order]
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+		if offset > 0 {
+			query += fmt.Sprintf(" OFFSET %d", offset)
+		}
+	} else if offset > 0 {
+		// MySQL only takes an OFFSET after a LIMIT
+		query += fmt.Sprintf(" LIMIT 18446744073709551615 OFFSET %d", offset)
+	}
+
+	songs, err := db.querySongs(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+// SearchSongs ranks the songs whose title or artist contains the
+// beginning of a word of query
+func (db *MySQLDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SongSearchResult{}, nil
+	}
+
+	conditions := make([]string, len(terms))
+	args := make([]interface{}, 0, 2*len(terms))
+	for i, term := range terms {
+		conditions[i] = "LOWER(title) LIKE ? OR LOWER(artist) LIKE ?"
+		args = append(args, "%"+term+"%", "%"+term+"%")
+	}
+
+	songs, err := db.querySongs(ctx, "SELECT "+sqlSongColumns+" FROM songs WHERE "+strings.Join(conditions, " OR "), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// querySongs reads the songs query selects with sqlSongColumns
+func (db *MySQLDB) querySongs(ctx context.Context, query string, args ...interface{}) ([]Song, error) {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	songs := []Song{}
+	for rows.Next() {
+		var song Song
+		if err := rows.Scan(append([]interface{}{&song.ID}, songFields(&song)...)...); err != nil {
+			return nil, fmt.Errorf("failed to scan song: %v", err)
+		}
+		songs = append(songs, song)
+	}
+
+	return songs, rows.Err()
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *MySQLDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id = ?", songID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", songID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// DeleteSongs deletes songs along with their fingerprints in one
+// transaction
+func (db *MySQLDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	for _, chunk := range chunkAddresses(songIDs, addressBatchSize) {
+		args := make([]interface{}, len(chunk))
+		for i, songID := range chunk {
+			args[i] = songID
+		}
+		in := "?" + strings.Repeat(", ?", len(chunk)-1)
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id IN ("+in+")", args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE id IN ("+in+")", args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete songs: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *MySQLDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE name = ?", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	return value, true, nil
+}
+
+func (db *MySQLDB) SetSetting(ctx context.Context, key, value string) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE value = VALUES(value)`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO api_keys (hash, id, name, catalog, rate_limit, created)
+		VALUES (?, ?, ?, ?, ?, ?)`, key.Hash, key.ID, key.Name, key.Catalog, key.RateLimit, key.Created)
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	key := APIKey{Hash: hash}
+	err := db.db.QueryRowContext(ctx, "SELECT id, name, catalog, rate_limit, created FROM api_keys WHERE hash = ?", hash).
+		Scan(&key.ID, &key.Name, &key.Catalog, &key.RateLimit, &key.Created)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+
+	return key, true, nil
+}
+
+func (db *MySQLDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT hash, id, name, catalog, rate_limit, created FROM api_keys ORDER BY created, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.Hash, &key.ID, &key.Name, &key.Catalog, &key.RateLimit, &key.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (db *MySQLDB) DeleteAPIKey(ctx context.Context, id string) error {
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO recognitions (created, song_id, song_title, song_artist, confidence, client_id)
+		VALUES (?, ?, ?, ?, ?, ?)`, recognition.Time, recognition.SongID, recognition.SongTitle, recognition.SongArtist,
+		recognition.Confidence, recognition.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	query := "SELECT id, created, song_id, song_title, song_artist, confidence, client_id FROM recognitions"
+	args := []interface{}{}
+	if clientID != "" {
+		query += " WHERE client_id = ?"
+		args = append(args, clientID)
+	}
+	query += " ORDER BY created DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+	defer rows.Close()
+
+	recognitions := []Recognition{}
+	for rows.Next() {
+		var recognition Recognition
+		var id uint64
+		err := rows.Scan(&id, &recognition.Time, &recognition.SongID, &recognition.SongTitle, &recognition.SongArtist,
+			&recognition.Confidence, &recognition.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan recognition: %v", err)
+		}
+		recognition.ID = strconv.FormatUint(id, 10)
+		recognitions = append(recognitions, recognition)
+	}
+
+	return recognitions, rows.Err()
+}
+
+func (db *MySQLDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO airplay (station, song_id, song_title, song_artist, started, ended, confidence)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, airplay.Station, airplay.SongID, airplay.SongTitle, airplay.SongArtist,
+		airplay.Started, airplay.Ended, airplay.Confidence)
+	if err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+func (db *MySQLDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	var conditions []string
+	args := []interface{}{}
+	if filter.Station != "" {
+		conditions = append(conditions, "station = ?")
+		args = append(args, filter.Station)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "started >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "started < ?")
+		args = append(args, filter.To)
+	}
+
+	query := "SELECT id, station, song_id, song_title, song_artist, started, ended, confidence FROM airplay"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY started DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+	defer rows.Close()
+
+	airplays := []Airplay{}
+	for rows.Next() {
+		var airplay Airplay
+		var id uint64
+		err := rows.Scan(&id, &airplay.Station, &airplay.SongID, &airplay.SongTitle, &airplay.SongArtist,
+			&airplay.Started, &airplay.Ended, &airplay.Confidence)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan airplay: %v", err)
+		}
+		airplay.ID = strconv.FormatUint(id, 10)
+		airplays = append(airplays, airplay)
+	}
+
+	return airplays, rows.Err()
+}
+
+// DeleteCollection empties the table with the given name
+func (db *MySQLDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	if collectionName != "songs" && collectionName != "fingerprints" && collectionName != "settings" && collectionName != "recognitions" && collectionName != "airplay" {
+		return fmt.Errorf("error deleting collection: unknown table %q", collectionName)
+	}
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM `"+collectionName+"`")
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// migrations returns the schema migrations of the MySQL backend.
+// createTables sets up version 0.
+func (db *MySQLDB) migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "add song metadata columns",
+			Up: func(ctx context.Context) error {
+				// MySQL has no ADD COLUMN IF NOT EXISTS, and erase resets the schema version
+				if exists, err := db.columnExists(ctx, "songs", "album"); err != nil || exists {
+					return err
+				}
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN album VARCHAR(255) NOT NULL DEFAULT '',
+					ADD COLUMN duration INT NOT NULL DEFAULT 0,
+					ADD COLUMN release_year INT NOT NULL DEFAULT 0,
+					ADD COLUMN cover_url VARCHAR(1024) NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN album,
+					DROP COLUMN duration,
+					DROP COLUMN release_year,
+					DROP COLUMN cover_url`)
+				return err
+			},
+		},
+		{
+			Version:     2,
+			Description: "add song source columns",
+			Up: func(ctx context.Context) error {
+				if exists, err := db.columnExists(ctx, "songs", "source"); err != nil || exists {
+					return err
+				}
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN source VARCHAR(32) NOT NULL DEFAULT '',
+					ADD COLUMN source_url VARCHAR(1024) NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN source,
+					DROP COLUMN source_url`)
+				return err
+			},
+		},
+		{
+			Version:     3,
+			Description: "make YouTube IDs nullable",
+			Up: func(ctx context.Context) error {
+				// Without partial indexes MySQL can't keep keys unique among
+				// songs without a YouTube ID, so that is left to the duplicate
+				// check callers make before registering
+				if _, err := db.db.ExecContext(ctx, `ALTER TABLE songs MODIFY yt_id VARCHAR(64) NULL`); err != nil {
+					return err
+				}
+				_, err := db.db.ExecContext(ctx, `UPDATE songs SET yt_id = NULL WHERE yt_id = ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				if _, err := db.db.ExecContext(ctx, `UPDATE songs SET yt_id = '' WHERE yt_id IS NULL`); err != nil {
+					return err
+				}
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs MODIFY yt_id VARCHAR(64) NOT NULL`)
+				return err
+			},
+		},
+		{
+			Version:     4,
+			Description: "add API keys table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS api_keys (
+					hash CHAR(64) PRIMARY KEY,
+					id VARCHAR(32) NOT NULL,
+					name VARCHAR(255) NOT NULL,
+					catalog VARCHAR(32) NOT NULL,
+					rate_limit INT NOT NULL,
+					created DATETIME NOT NULL,
+					UNIQUE KEY api_keys_id (id)
+				) CHARACTER SET utf8mb4`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS api_keys`)
+				return err
+			},
+		},
+		{
+			Version:     5,
+			Description: "add recognition history table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS recognitions (
+					id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+					created DATETIME(3) NOT NULL,
+					song_id INT UNSIGNED NOT NULL,
+					song_title VARCHAR(255) NOT NULL,
+					song_artist VARCHAR(255) NOT NULL,
+					confidence DOUBLE NOT NULL,
+					client_id VARCHAR(64) NOT NULL,
+					KEY recognitions_client_id_created (client_id, created)
+				) CHARACTER SET utf8mb4`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS recognitions`)
+				return err
+			},
+		},
+		{
+			Version:     6,
+			Description: "add airplay table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS airplay (
+					id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+					station VARCHAR(255) NOT NULL,
+					song_id INT UNSIGNED NOT NULL,
+					song_title VARCHAR(255) NOT NULL,
+					song_artist VARCHAR(255) NOT NULL,
+					started DATETIME(3) NOT NULL,
+					ended DATETIME(3) NOT NULL,
+					confidence DOUBLE NOT NULL,
+					KEY airplay_started (started),
+					KEY airplay_station_started (station, started)
+				) CHARACTER SET utf8mb4`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS airplay`)
+				return err
+			},
+		},
+		{
+			Version:     7,
+			Description: "add song provenance column",
+			Up: func(ctx context.Context) error {
+				if exists, err := db.columnExists(ctx, "songs", "provenance"); err != nil || exists {
+					return err
+				}
+				// TEXT columns can't have a default, so songs saved before
+				// have a NULL provenance
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs ADD COLUMN provenance TEXT NULL`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs DROP COLUMN provenance`)
+				return err
+			},
+		},
+		songKeyMigration(8, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		{
+			Version:     9,
+			Description: "add song MusicBrainz ID columns",
+			Up: func(ctx context.Context) error {
+				if exists, err := db.columnExists(ctx, "songs", "recording_mbid"); err != nil || exists {
+					return err
+				}
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN recording_mbid CHAR(36) NOT NULL DEFAULT '',
+					ADD COLUMN release_mbid CHAR(36) NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN recording_mbid,
+					DROP COLUMN release_mbid`)
+				return err
+			},
+		},
+		songKeyMigration(10, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *MySQLDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT id, COALESCE(yt_id, ''), title, artist, song_key FROM songs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var songs []storedSongKey
+	for rows.Next() {
+		var song storedSongKey
+		if err := rows.Scan(&song.ID, &song.YouTubeID, &song.Title, &song.Artist, &song.Key); err != nil {
+			return nil, err
+		}
+		songs = append(songs, song)
+	}
+	return songs, rows.Err()
+}
+
+// rekeySong saves a song under key
+func (db *MySQLDB) rekeySong(ctx context.Context, song storedSongKey, key string) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE songs SET song_key = ? WHERE id = ?`, key, song.ID)
+	return err
+}
+
+// columnExists reports whether table has the given column
+func (db *MySQLDB) columnExists(ctx context.Context, table, column string) (bool, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&count)
+	return count > 0, err
+}
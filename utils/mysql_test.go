@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+// BenchmarkMySQLInsertFingerprints needs the MySQL server of the DB_*
+// settings, and is skipped without it
+func BenchmarkMySQLInsertFingerprints(b *testing.B) {
+	db, err := newMySQLDB("bench", false)
+	if err != nil {
+		b.Skipf("MySQL isn't available: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(context.Background()); err != nil {
+		b.Skipf("MySQL isn't available: %v", err)
+	}
+
+	benchmarkInsertFingerprints(b, db, db.db, mysqlFingerprintsQuery)
+}
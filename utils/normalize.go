@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeText reduces s to the form titles and artists are compared in:
+// compatibility characters such as full-width letters are replaced by their
+// usual form (NFKC), accents are stripped, case is folded and whitespace is
+// collapsed, so that "Beyoncé" and "ＢＥＹＯＮＣＥ" both become "beyonce".
+func NormalizeText(s string) string {
+	// Transformers keep state, so they can't be shared between goroutines
+	stripAccents := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if stripped, _, err := transform.String(stripAccents, s); err == nil {
+		s = stripped
+	}
+	return strings.Join(strings.Fields(cases.Fold().String(s)), " ")
+}
+
+// GenerateSongKey returns the key a song is looked up by and kept unique
+// with, made of its normalized title and artist, so that the same song
+// spelled with other accents, case or character widths has the same key.
+// The title is prefixed with its length, since titles and artists can hold
+// the "---" between them: "A---B" by "C" and "A" by "B---C" are different
+// songs.
+func GenerateSongKey(songTitle, songArtist string) string {
+	title := NormalizeText(songTitle)
+	return strconv.Itoa(len(title)) + ":" + title + "---" + NormalizeText(songArtist)
+}
+
+// normalizedSongKey returns the key of a song saved before the titles in
+// keys were prefixed with their length
+func normalizedSongKey(songTitle, songArtist string) string {
+	return NormalizeText(songTitle) + "---" + NormalizeText(songArtist)
+}
+
+// legacySongKey returns the key of a song saved before keys were
+// normalized
+func legacySongKey(songTitle, songArtist string) string {
+	return songTitle + "---" + songArtist
+}
+
+// storedSongKey is the key a song is saved under, as the song key
+// migrations of the backends read it
+type storedSongKey struct {
+	ID            uint32
+	YouTubeID     string
+	Title, Artist string
+	Key           string
+}
+
+// songKeyMigration returns the migration that saves the songs load returns
+// under the keys of up, rekeying with rekey those whose key changes, and
+// reverts to the keys of down
+func songKeyMigration(version int, description string, up, down func(songTitle, songArtist string) string,
+	load func(ctx context.Context) ([]storedSongKey, error), rekey func(ctx context.Context, song storedSongKey, key string) error) Migration {
+	rekeyAll := func(keyOf func(songTitle, songArtist string) string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			songs, err := load(ctx)
+			if err != nil {
+				return err
+			}
+			for _, change := range songKeyChanges(ctx, songs, keyOf) {
+				if err := rekey(ctx, change.song, change.key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return Migration{
+		Version:     version,
+		Description: description,
+		Up:          rekeyAll(up),
+		Down:        rekeyAll(down),
+	}
+}
+
+// songKeyChange is a song to save under a new key
+type songKeyChange struct {
+	song storedSongKey
+	key  string
+}
+
+// songKeyChanges returns the songs whose key changes with keyOf, along with
+// their new key. A song whose new key another song with the same YouTube ID
+// already has or gets keeps its old one, so that neither is lost, and is
+// logged to be merged or deleted by hand.
+func songKeyChanges(ctx context.Context, songs []storedSongKey, keyOf func(songTitle, songArtist string) string) []songKeyChange {
+	sort.Slice(songs, func(i, j int) bool { return songs[i].ID < songs[j].ID })
+
+	// Songs whose key doesn't change claim it first
+	taken := map[string]bool{}
+	var changed []storedSongKey
+	for _, song := range songs {
+		if keyOf(song.Title, song.Artist) == song.Key {
+			taken[song.YouTubeID+"|"+song.Key] = true
+		} else {
+			changed = append(changed, song)
+		}
+	}
+
+	var changes []songKeyChange
+	for _, song := range changed {
+		key := keyOf(song.Title, song.Artist)
+		if taken[song.YouTubeID+"|"+key] {
+			GetLogger().WarnContext(ctx, "song keeps its key, another song has the same one once normalized.",
+				slog.Int64("songID", int64(song.ID)),
+				slog.String("key", song.Key),
+				slog.String("normalizedKey", key),
+			)
+			continue
+		}
+		taken[song.YouTubeID+"|"+key] = true
+		changes = append(changes, songKeyChange{song: song, key: key})
+	}
+	return changes
+}
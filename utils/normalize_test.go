@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGenerateSongKey(t *testing.T) {
+	if a, b := GenerateSongKey("Beyoncé", "Halo"), GenerateSongKey("ＢＥＹＯＮＣＥ", " halo "); a != b {
+		t.Errorf("keys of the same song spelled differently differ: %q and %q", a, b)
+	}
+	if a, b := GenerateSongKey("A---B", "C"), GenerateSongKey("A", "B---C"); a == b {
+		t.Errorf("keys of different songs are the same: %q", a)
+	}
+	if a, b := GenerateSongKey("1:A", "B"), GenerateSongKey("1", "A---B"); a == b {
+		t.Errorf("keys of different songs are the same: %q", a)
+	}
+}
+
+func TestSongKeyMigration(t *testing.T) {
+	songs := []storedSongKey{
+		{ID: 1, YouTubeID: "a", Title: "A---B", Artist: "C", Key: normalizedSongKey("A---B", "C")},
+		{ID: 2, YouTubeID: "b", Title: "Title", Artist: "Artist", Key: normalizedSongKey("Title", "Artist")},
+	}
+	load := func(ctx context.Context) ([]storedSongKey, error) {
+		return append([]storedSongKey(nil), songs...), nil
+	}
+	rekey := func(ctx context.Context, song storedSongKey, key string) error {
+		for i := range songs {
+			if songs[i].ID == song.ID {
+				songs[i].Key = key
+			}
+		}
+		return nil
+	}
+	migration := songKeyMigration(1, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, load, rekey)
+
+	ctx := context.Background()
+	if err := migration.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, song := range songs {
+		if want := GenerateSongKey(song.Title, song.Artist); song.Key != want {
+			t.Errorf("after Up, song %d has key %q, want %q", song.ID, song.Key, want)
+		}
+	}
+
+	if err := migration.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, song := range songs {
+		if want := normalizedSongKey(song.Title, song.Artist); song.Key != want {
+			t.Errorf("after Down, song %d has key %q, want %q", song.ID, song.Key, want)
+		}
+	}
+}
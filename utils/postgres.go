@@ -0,0 +1,893 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sqlColumns maps the fields songs are looked up by to SQL column names
+var sqlColumns = map[SongField]string{
+	SongFieldID:   "id",
+	SongFieldYTID: "yt_id",
+	SongFieldKey:  "key",
+}
+
+// PostgresDB is a DBClient backed by PostgreSQL
+type PostgresDB struct {
+	db *sql.DB
+}
+
+// newPostgresDB creates a new instance of PostgresDB for catalog and makes
+// sure the schema exists. Catalogs other than the default one have their
+// own PostgreSQL schema, named catalog_<name>, which is created if needed.
+// A read-only instance creates nothing, and its sessions are read-only.
+func newPostgresDB(catalog string, readOnly bool) (*PostgresDB, error) {
+	host := dbHost
+	if host == "" {
+		host = "localhost"
+	}
+	port := dbPort
+	if port == "" {
+		port = "5432"
+	}
+	name := dbName
+	if name == "" {
+		name = "song-recognition"
+	}
+
+	dsn := fmt.Sprintf("host=%s port=%s dbname=%s sslmode=%s",
+		host, port, name, GetEnv("DB_SSLMODE", "disable"))
+	if dbUsername != "" {
+		dsn += fmt.Sprintf(" user=%s password=%s", dbUsername, dbPassword)
+	}
+	schema := "catalog_" + catalog
+	if catalog != DefaultCatalog {
+		dsn += " search_path=" + schema
+	}
+	if readOnly {
+		dsn += " default_transaction_read_only=on"
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to PostgreSQL: %v", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to PostgreSQL: %v", err)
+	}
+
+	pg := &PostgresDB{db: db}
+	if readOnly {
+		return pg, nil
+	}
+
+	if catalog != DefaultCatalog {
+		if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + schema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating catalog schema: %v", err)
+		}
+	}
+
+	if err := pg.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return pg, nil
+}
+
+func (db *PostgresDB) createTables() error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS songs (
+		id BIGINT PRIMARY KEY,
+		title TEXT NOT NULL,
+		artist TEXT NOT NULL,
+		yt_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		UNIQUE (yt_id, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS fingerprints (
+		address BIGINT NOT NULL,
+		anchor_time_ms BIGINT NOT NULL,
+		song_id BIGINT NOT NULL,
+		PRIMARY KEY (address, anchor_time_ms, song_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`
+
+	if _, err := db.db.Exec(schema); err != nil {
+		return fmt.Errorf("error creating tables: %v", err)
+	}
+	return nil
+}
+
+// Close closes the underlying database handle
+func (db *PostgresDB) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+// Ping checks that the PostgreSQL server can be reached
+func (db *PostgresDB) Ping(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+// Capabilities reports the capabilities of PostgreSQL
+func (db *PostgresDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "postgres",
+		Transactions: true,
+		MaxBatchSize: insertBatchSize,
+		NativeSearch: true,
+		SharedAccess: true,
+	}
+}
+
+func (db *PostgresDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	err = insertFingerprints(ctx, tx, fingerprints, postgresFingerprintsQuery)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// postgresFingerprintsQuery returns the statement that inserts n
+// fingerprints, skipping those already stored
+func postgresFingerprintsQuery(n int) string {
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = fmt.Sprintf("($%d, $%d, $%d)", 3*i+1, 3*i+2, 3*i+3)
+	}
+	return "INSERT INTO fingerprints (address, anchor_time_ms, song_id) VALUES " +
+		strings.Join(rows, ", ") + " ON CONFLICT DO NOTHING"
+}
+
+func (db *PostgresDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples := make(map[uint32][]models.Couple)
+
+	for _, chunk := range chunkAddresses(addresses, addressBatchSize) {
+		placeholders := make([]string, len(chunk))
+		args := make([]interface{}, len(chunk))
+		for i, address := range chunk {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = int64(address)
+		}
+
+		query := fmt.Sprintf(
+			"SELECT address, anchor_time_ms, song_id FROM fingerprints WHERE address IN (%s)",
+			strings.Join(placeholders, ", "),
+		)
+
+		rows, err := db.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error querying couples: %v", err)
+		}
+
+		for rows.Next() {
+			var address, anchorTimeMs, songID int64
+			if err := rows.Scan(&address, &anchorTimeMs, &songID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning couple: %v", err)
+			}
+			couples[uint32(address)] = append(couples[uint32(address)], models.Couple{
+				AnchorTimeMs: uint32(anchorTimeMs),
+				SongID:       uint32(songID),
+			})
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating couples: %v", err)
+		}
+	}
+
+	return couples, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address
+func (db *PostgresDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	rows, err := db.db.QueryContext(ctx, "SELECT address, anchor_time_ms, song_id FROM fingerprints ORDER BY address")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	defer rows.Close()
+
+	var (
+		current uint32
+		couples []models.Couple
+	)
+	for rows.Next() {
+		var address, anchorTimeMs, songID int64
+		if err := rows.Scan(&address, &anchorTimeMs, &songID); err != nil {
+			return fmt.Errorf("error scanning couple: %v", err)
+		}
+
+		// Rows are ordered by address, so an address is complete once the next one starts
+		if len(couples) > 0 && uint32(address) != current {
+			if err := fn(current, couples); err != nil {
+				return err
+			}
+			couples = nil
+		}
+		current = uint32(address)
+		couples = append(couples, models.Couple{AnchorTimeMs: uint32(anchorTimeMs), SongID: uint32(songID)})
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating fingerprints: %v", err)
+	}
+
+	if len(couples) > 0 {
+		return fn(current, couples)
+	}
+	return nil
+}
+
+func (db *PostgresDB) TotalSongs(ctx context.Context) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (db *PostgresDB) TotalFingerprints(ctx context.Context) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (db *PostgresDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	var total int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE song_id = $1", int64(songID)).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// StorageSize returns the size of the tables of the catalog's schema,
+// indexes included
+func (db *PostgresDB) StorageSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := db.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(pg_total_relation_size(c.oid)), 0) FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind = 'r'`).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (db *PostgresDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := insertPostgresSong(ctx, db.db, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints registers a song and stores its
+// fingerprints in one transaction
+func (db *PostgresDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	fingerprints := fingerprint(songID)
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	if err := insertPostgresSong(ctx, tx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := insertFingerprints(ctx, tx, fingerprints, postgresFingerprintsQuery); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	return songID, nil
+}
+
+// insertPostgresSong inserts the row of a song with exec
+func insertPostgresSong(ctx context.Context, exec sqlExecer, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	key := GenerateSongKey(songTitle, songArtist)
+
+	_, err := exec.ExecContext(ctx,
+		`INSERT INTO songs (id, title, artist, yt_id, key, album, duration, release_year, cover_url, source, source_url, provenance, recording_mbid, release_mbid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		int64(songID), songTitle, songArtist, nullString(ytID), key, meta.Album, meta.Duration, meta.ReleaseYear, meta.CoverURL,
+		meta.Source, meta.SourceURL, meta.Provenance, meta.RecordingMBID, meta.ReleaseMBID,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+	column, ok := sqlColumns[field]
+	if !ok {
+		return Song{}, false, errSongField(field)
+	}
+
+	if id, ok := value.(uint32); ok {
+		value = int64(id)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM songs WHERE %s = $1", sqlSongColumns, column)
+
+	var song Song
+	var id int64
+	err := db.db.QueryRowContext(ctx, query, value).Scan(append([]interface{}{&id}, songFields(&song)...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+	song.ID = uint32(id)
+
+	return song, true, nil
+}
+
+func (db *PostgresDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *PostgresDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *PostgresDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+func (db *PostgresDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	order, err := songOrder(sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + sqlSongColumns + " FROM songs ORDER BY " + sqlSongOrders[order]
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	if offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", offset)
+	}
+
+	songs, err := db.querySongs(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+// SearchSongs ranks the songs whose title or artist contains the
+// beginning of a word of query
+func (db *PostgresDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SongSearchResult{}, nil
+	}
+
+	conditions := make([]string, len(terms))
+	args := make([]interface{}, len(terms))
+	for i, term := range terms {
+		conditions[i] = fmt.Sprintf("LOWER(title) LIKE $%d OR LOWER(artist) LIKE $%d", i+1, i+1)
+		args[i] = "%" + term + "%"
+	}
+
+	songs, err := db.querySongs(ctx, "SELECT "+sqlSongColumns+" FROM songs WHERE "+strings.Join(conditions, " OR "), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// querySongs reads the songs query selects with sqlSongColumns
+func (db *PostgresDB) querySongs(ctx context.Context, query string, args ...interface{}) ([]Song, error) {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	songs := []Song{}
+	for rows.Next() {
+		var song Song
+		var id int64
+		if err := rows.Scan(append([]interface{}{&id}, songFields(&song)...)...); err != nil {
+			return nil, fmt.Errorf("failed to scan song: %v", err)
+		}
+		song.ID = uint32(id)
+		songs = append(songs, song)
+	}
+
+	return songs, rows.Err()
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *PostgresDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id = $1", int64(songID)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE id = $1", int64(songID)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// DeleteSongs deletes songs along with their fingerprints in one
+// transaction
+func (db *PostgresDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	for _, chunk := range chunkAddresses(songIDs, addressBatchSize) {
+		placeholders := make([]string, len(chunk))
+		args := make([]interface{}, len(chunk))
+		for i, songID := range chunk {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = int64(songID)
+		}
+		in := strings.Join(placeholders, ", ")
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id IN ("+in+")", args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE id IN ("+in+")", args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete songs: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *PostgresDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id = $1", int64(songID))
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE key = $1", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	return value, true, nil
+}
+
+func (db *PostgresDB) SetSetting(ctx context.Context, key, value string) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO api_keys (hash, id, name, catalog, rate_limit, created)
+		VALUES ($1, $2, $3, $4, $5, $6)`, key.Hash, key.ID, key.Name, key.Catalog, key.RateLimit, key.Created)
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	key := APIKey{Hash: hash}
+	err := db.db.QueryRowContext(ctx, "SELECT id, name, catalog, rate_limit, created FROM api_keys WHERE hash = $1", hash).
+		Scan(&key.ID, &key.Name, &key.Catalog, &key.RateLimit, &key.Created)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+
+	key.Created = key.Created.UTC()
+	return key, true, nil
+}
+
+func (db *PostgresDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT hash, id, name, catalog, rate_limit, created FROM api_keys ORDER BY created, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.Hash, &key.ID, &key.Name, &key.Catalog, &key.RateLimit, &key.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %v", err)
+		}
+		key.Created = key.Created.UTC()
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (db *PostgresDB) DeleteAPIKey(ctx context.Context, id string) error {
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO recognitions (created, song_id, song_title, song_artist, confidence, client_id)
+		VALUES ($1, $2, $3, $4, $5, $6)`, recognition.Time, recognition.SongID, recognition.SongTitle, recognition.SongArtist,
+		recognition.Confidence, recognition.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	query := "SELECT id, created, song_id, song_title, song_artist, confidence, client_id FROM recognitions"
+	args := []interface{}{}
+	if clientID != "" {
+		query += " WHERE client_id = $1"
+		args = append(args, clientID)
+	}
+	query += fmt.Sprintf(" ORDER BY created DESC, id DESC LIMIT %d OFFSET %d", limit, offset)
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+	defer rows.Close()
+
+	recognitions := []Recognition{}
+	for rows.Next() {
+		var recognition Recognition
+		var id int64
+		var songID int64
+		err := rows.Scan(&id, &recognition.Time, &songID, &recognition.SongTitle, &recognition.SongArtist,
+			&recognition.Confidence, &recognition.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan recognition: %v", err)
+		}
+		recognition.ID = strconv.FormatInt(id, 10)
+		recognition.SongID = uint32(songID)
+		recognition.Time = recognition.Time.UTC()
+		recognitions = append(recognitions, recognition)
+	}
+
+	return recognitions, rows.Err()
+}
+
+func (db *PostgresDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO airplay (station, song_id, song_title, song_artist, started, ended, confidence)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, airplay.Station, airplay.SongID, airplay.SongTitle, airplay.SongArtist,
+		airplay.Started, airplay.Ended, airplay.Confidence)
+	if err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+func (db *PostgresDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	var conditions []string
+	args := []interface{}{}
+	if filter.Station != "" {
+		args = append(args, filter.Station)
+		conditions = append(conditions, fmt.Sprintf("station = $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("started >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("started < $%d", len(args)))
+	}
+
+	query := "SELECT id, station, song_id, song_title, song_artist, started, ended, confidence FROM airplay"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY started DESC, id DESC LIMIT %d OFFSET %d", limit, offset)
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+	defer rows.Close()
+
+	airplays := []Airplay{}
+	for rows.Next() {
+		var airplay Airplay
+		var id int64
+		var songID int64
+		err := rows.Scan(&id, &airplay.Station, &songID, &airplay.SongTitle, &airplay.SongArtist,
+			&airplay.Started, &airplay.Ended, &airplay.Confidence)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan airplay: %v", err)
+		}
+		airplay.ID = strconv.FormatInt(id, 10)
+		airplay.SongID = uint32(songID)
+		airplay.Started = airplay.Started.UTC()
+		airplay.Ended = airplay.Ended.UTC()
+		airplays = append(airplays, airplay)
+	}
+
+	return airplays, rows.Err()
+}
+
+// DeleteCollection empties the table with the given name
+func (db *PostgresDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	if collectionName != "songs" && collectionName != "fingerprints" && collectionName != "settings" && collectionName != "recognitions" && collectionName != "airplay" {
+		return fmt.Errorf("error deleting collection: unknown table %q", collectionName)
+	}
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM "+pq.QuoteIdentifier(collectionName))
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// migrations returns the schema migrations of the PostgreSQL backend.
+// createTables sets up version 0.
+func (db *PostgresDB) migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "index fingerprints by song ID",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS fingerprints_song_id_idx ON fingerprints (song_id)`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP INDEX IF EXISTS fingerprints_song_id_idx`)
+				return err
+			},
+		},
+		{
+			Version:     2,
+			Description: "add song metadata columns",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN IF NOT EXISTS album TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS duration INT NOT NULL DEFAULT 0,
+					ADD COLUMN IF NOT EXISTS release_year INT NOT NULL DEFAULT 0,
+					ADD COLUMN IF NOT EXISTS cover_url TEXT NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN IF EXISTS album,
+					DROP COLUMN IF EXISTS duration,
+					DROP COLUMN IF EXISTS release_year,
+					DROP COLUMN IF EXISTS cover_url`)
+				return err
+			},
+		},
+		{
+			Version:     3,
+			Description: "add song source columns",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS source_url TEXT NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN IF EXISTS source,
+					DROP COLUMN IF EXISTS source_url`)
+				return err
+			},
+		},
+		{
+			Version:     4,
+			Description: "make YouTube IDs nullable",
+			Up: func(ctx context.Context) error {
+				// NULLs don't collide in the (yt_id, key) constraint, so songs
+				// without a YouTube ID need their own unique index on key
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs ALTER COLUMN yt_id DROP NOT NULL;
+					UPDATE songs SET yt_id = NULL WHERE yt_id = '';
+					CREATE UNIQUE INDEX IF NOT EXISTS songs_key_without_yt_id_idx ON songs (key) WHERE yt_id IS NULL`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP INDEX IF EXISTS songs_key_without_yt_id_idx;
+					UPDATE songs SET yt_id = '' WHERE yt_id IS NULL;
+					ALTER TABLE songs ALTER COLUMN yt_id SET NOT NULL`)
+				return err
+			},
+		},
+		{
+			Version:     5,
+			Description: "add API keys table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS api_keys (
+					hash TEXT PRIMARY KEY,
+					id TEXT NOT NULL UNIQUE,
+					name TEXT NOT NULL,
+					catalog TEXT NOT NULL,
+					rate_limit INTEGER NOT NULL,
+					created TIMESTAMPTZ NOT NULL
+				)`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS api_keys`)
+				return err
+			},
+		},
+		{
+			Version:     6,
+			Description: "add recognition history table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS recognitions (
+					id BIGSERIAL PRIMARY KEY,
+					created TIMESTAMPTZ NOT NULL,
+					song_id BIGINT NOT NULL,
+					song_title TEXT NOT NULL,
+					song_artist TEXT NOT NULL,
+					confidence DOUBLE PRECISION NOT NULL,
+					client_id TEXT NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS recognitions_client_id_created_idx ON recognitions (client_id, created)`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS recognitions`)
+				return err
+			},
+		},
+		{
+			Version:     7,
+			Description: "add airplay table",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS airplay (
+					id BIGSERIAL PRIMARY KEY,
+					station TEXT NOT NULL,
+					song_id BIGINT NOT NULL,
+					song_title TEXT NOT NULL,
+					song_artist TEXT NOT NULL,
+					started TIMESTAMPTZ NOT NULL,
+					ended TIMESTAMPTZ NOT NULL,
+					confidence DOUBLE PRECISION NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS airplay_started_idx ON airplay (started);
+				CREATE INDEX IF NOT EXISTS airplay_station_started_idx ON airplay (station, started)`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `DROP TABLE IF EXISTS airplay`)
+				return err
+			},
+		},
+		{
+			Version:     8,
+			Description: "add song provenance column",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs ADD COLUMN IF NOT EXISTS provenance TEXT NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs DROP COLUMN IF EXISTS provenance`)
+				return err
+			},
+		},
+		songKeyMigration(9, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		{
+			Version:     10,
+			Description: "add song MusicBrainz ID columns",
+			Up: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					ADD COLUMN IF NOT EXISTS recording_mbid TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS release_mbid TEXT NOT NULL DEFAULT ''`)
+				return err
+			},
+			Down: func(ctx context.Context) error {
+				_, err := db.db.ExecContext(ctx, `ALTER TABLE songs
+					DROP COLUMN IF EXISTS recording_mbid,
+					DROP COLUMN IF EXISTS release_mbid`)
+				return err
+			},
+		},
+		songKeyMigration(11, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *PostgresDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT id, COALESCE(yt_id, ''), title, artist, key FROM songs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var songs []storedSongKey
+	for rows.Next() {
+		var song storedSongKey
+		var id int64
+		if err := rows.Scan(&id, &song.YouTubeID, &song.Title, &song.Artist, &song.Key); err != nil {
+			return nil, err
+		}
+		song.ID = uint32(id)
+		songs = append(songs, song)
+	}
+	return songs, rows.Err()
+}
+
+// rekeySong saves a song under key
+func (db *PostgresDB) rekeySong(ctx context.Context, song storedSongKey, key string) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE songs SET key = $1 WHERE id = $2`, key, int64(song.ID))
+	return err
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+// BenchmarkPostgresGetCouples needs the PostgreSQL server of the DB_*
+// settings, and is skipped without it
+func BenchmarkPostgresGetCouples(b *testing.B) {
+	db, err := newPostgresDB("bench", false)
+	if err != nil {
+		b.Skipf("PostgreSQL isn't available: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(context.Background()); err != nil {
+		b.Skipf("PostgreSQL isn't available: %v", err)
+	}
+
+	benchmarkGetCouples(b, db)
+}
+
+// BenchmarkPostgresInsertFingerprints needs the PostgreSQL server of the
+// DB_* settings, and is skipped without it
+func BenchmarkPostgresInsertFingerprints(b *testing.B) {
+	db, err := newPostgresDB("bench", false)
+	if err != nil {
+		b.Skipf("PostgreSQL isn't available: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(context.Background()); err != nil {
+		b.Skipf("PostgreSQL isn't available: %v", err)
+	}
+
+	benchmarkInsertFingerprints(b, db, db.db, postgresFingerprintsQuery)
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrEmptySongFilter is returned when pruning with a filter that selects no
+// songs explicitly, which would otherwise delete the whole catalog
+var ErrEmptySongFilter = errors.New("select songs by ID, artist or source")
+
+// SongFilter selects the songs to delete in bulk. A song is selected when
+// it matches every field that is set.
+type SongFilter struct {
+	IDs []uint32
+	// Artist is compared ignoring case and surrounding spaces
+	Artist string
+	// Source is one of the Source constants
+	Source string
+}
+
+// IsEmpty reports whether f sets no field
+func (f SongFilter) IsEmpty() bool {
+	return len(f.IDs) == 0 && strings.TrimSpace(f.Artist) == "" && f.Source == ""
+}
+
+func (f SongFilter) matches(song Song, ids map[uint32]bool) bool {
+	return (len(ids) == 0 || ids[song.ID]) &&
+		(strings.TrimSpace(f.Artist) == "" || strings.EqualFold(strings.TrimSpace(song.Artist), strings.TrimSpace(f.Artist))) &&
+		(f.Source == "" || song.Source == f.Source)
+}
+
+// PruneResult is what PruneSongs deleted, or would delete in a dry run
+type PruneResult struct {
+	DryRun       bool     `json:"dryRun"`
+	SongIDs      []uint32 `json:"songIds"`
+	Songs        int      `json:"songs"`
+	Fingerprints int      `json:"fingerprints"`
+}
+
+// PruneSongs deletes the songs selected by filter along with their
+// fingerprints. With dryRun, it only reports what it would delete.
+func PruneSongs(ctx context.Context, db DBClient, filter SongFilter, dryRun bool) (PruneResult, error) {
+	result := PruneResult{DryRun: dryRun, SongIDs: []uint32{}}
+	if filter.IsEmpty() {
+		return result, ErrEmptySongFilter
+	}
+
+	ids := make(map[uint32]bool, len(filter.IDs))
+	for _, id := range filter.IDs {
+		ids[id] = true
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return result, err
+	}
+	for _, song := range songs {
+		if !filter.matches(song, ids) {
+			continue
+		}
+
+		count, err := db.FingerprintCountBySong(ctx, song.ID)
+		if err != nil {
+			return result, fmt.Errorf("failed to count fingerprints of song %d: %v", song.ID, err)
+		}
+		result.SongIDs = append(result.SongIDs, song.ID)
+		result.Fingerprints += count
+	}
+	result.Songs = len(result.SongIDs)
+
+	if dryRun || result.Songs == 0 {
+		return result, nil
+	}
+	if err := db.DeleteSongs(ctx, result.SongIDs); err != nil {
+		return result, err
+	}
+	return result, nil
+}
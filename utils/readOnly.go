@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"song-recognition/models"
+	"strconv"
+)
+
+// ErrReadOnly is returned by the writes of a read-only client
+var ErrReadOnly = errors.New("the database is open read-only")
+
+// readOnly makes every client of the process read-only, for recognition
+// servers scaled out next to a single process that ingests songs. Set with
+// READ_ONLY.
+var readOnly, _ = strconv.ParseBool(GetEnv("READ_ONLY", "false"))
+
+// ReadOnly reports whether every client of the process is read-only
+func ReadOnly() bool {
+	return readOnly
+}
+
+// readOnlyDB rejects the writes of the DBClient it wraps with ErrReadOnly,
+// so a read-only client fails the same way in every backend
+type readOnlyDB struct {
+	DBClient
+}
+
+func (db readOnlyDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (db readOnlyDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (db readOnlyDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) SetSetting(ctx context.Context, key, value string) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) DeleteAPIKey(ctx context.Context, id string) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	return ErrReadOnly
+}
+
+func (db readOnlyDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Recognition is a past recognition attempt, kept for the history of the
+// client that made it
+type Recognition struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// SongID is the best match, 0 if nothing matched. The title and artist
+	// are kept in case the song is deleted.
+	SongID     uint32  `json:"songId,omitempty"`
+	SongTitle  string  `json:"songTitle,omitempty"`
+	SongArtist string  `json:"songArtist,omitempty"`
+	Confidence float64 `json:"confidence"`
+	ClientID   string  `json:"clientId,omitempty"`
+}
+
+// Matched reports whether the recognition found a song
+func (r Recognition) Matched() bool {
+	return r.SongID != 0
+}
+
+// maxClientIDLength is the longest client ID recognitions are stored with
+const maxClientIDLength = 64
+
+// ValidClientID reports whether id can be used as a client ID: up to 64
+// printable ASCII characters, or empty for no client
+func ValidClientID(id string) bool {
+	return len(id) <= maxClientIDLength && !strings.ContainsFunc(id, func(c rune) bool { return c < '!' || c > '~' })
+}
+
+type clientIDContextKey struct{}
+
+// WithClientID returns a copy of ctx whose recognitions are recorded in the
+// history of the client id
+func WithClientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientIDContextKey{}, id)
+}
+
+// ClientIDFromContext returns the client ID carried by ctx, empty if it
+// has none
+func ClientIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDContextKey{}).(string)
+	return id
+}
+
+// decodeRecognitions decodes JSON encoded recognitions. It serves the
+// backends that store recognitions as JSON.
+func decodeRecognitions(values []string) ([]Recognition, error) {
+	recognitions := make([]Recognition, 0, len(values))
+	for _, value := range values {
+		var recognition Recognition
+		if err := json.Unmarshal([]byte(value), &recognition); err != nil {
+			return nil, fmt.Errorf("invalid recognition: %v", err)
+		}
+		recognitions = append(recognitions, recognition)
+	}
+	return recognitions, nil
+}
@@ -0,0 +1,903 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"song-recognition/couplecodec"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisFingerprintPrefix = "fingerprint:"
+	redisSongPrefix        = "song:"
+	redisSongKeyPrefix     = "song-key:"
+	redisSongYTIDPrefix    = "song-ytid:"
+	redisSongUniquePrefix  = "song-unique:"
+	redisSongIDs           = "songs"
+	redisSettings          = "settings"
+	redisAPIKeys           = "api-keys" // hash of API key hashes to the JSON encoded keys
+	redisRecognitionID     = "recognition-id"
+	redisRecognitions      = "recognitions"         // sorted set of JSON encoded recognitions, scored by ID
+	redisClientRecognition = "recognitions:client:" // the recognitions of one client, scored by ID
+	redisAirplayID         = "airplay-id"
+	redisAirplay           = "airplay"          // sorted set of JSON encoded airplays, scored by start time in milliseconds
+	redisStationAirplay    = "airplay:station:" // the airplays of one station, scored by start time in milliseconds
+)
+
+// RedisDB is a DBClient backed by Redis. Each fingerprint address is a
+// string of couples in the varint encoding of couplecodec, which saving a
+// song appends to. Couples appended twice are only returned once.
+type RedisDB struct {
+	client *redis.Client
+	// prefix is prepended to every key, so that catalogs sharing a server
+	// don't see each other's keys
+	prefix string
+}
+
+// newRedisDB creates a new instance of RedisDB for catalog. The keys of
+// catalogs other than the default one are prefixed with catalog:<name>:.
+func newRedisDB(catalog string) (*RedisDB, error) {
+	host := dbHost
+	if host == "" {
+		host = "localhost"
+	}
+	port := dbPort
+	if port == "" {
+		port = "6379"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     host + ":" + port,
+		Username: dbUsername,
+		Password: dbPassword,
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to Redis: %v", err)
+	}
+
+	db := &RedisDB{client: client}
+	if catalog != DefaultCatalog {
+		db.prefix = "catalog:" + catalog + ":"
+	}
+	return db, nil
+}
+
+// Close closes the underlying Redis client
+func (db *RedisDB) Close() error {
+	if db.client != nil {
+		return db.client.Close()
+	}
+	return nil
+}
+
+// Ping checks that the Redis server can be reached
+func (db *RedisDB) Ping(ctx context.Context) error {
+	return db.client.Ping(ctx).Err()
+}
+
+// Capabilities reports the capabilities of Redis, which stores the
+// fingerprints of a song in one pipeline
+func (db *RedisDB) Capabilities() Capabilities {
+	return Capabilities{
+		Backend:      "redis",
+		Transactions: false,
+		MaxBatchSize: 0,
+		NativeSearch: false,
+		SharedAccess: true,
+	}
+}
+
+func (db *RedisDB) StoreFingerprints(ctx context.Context, fingerprints map[uint32]models.Couple) error {
+	pipe := db.client.Pipeline()
+	for address, couple := range fingerprints {
+		key := db.prefix + redisFingerprintPrefix + strconv.FormatUint(uint64(address), 10)
+		pipe.Append(ctx, key, string(couplecodec.AppendVarint(nil, couple)))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error storing fingerprints: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples := make(map[uint32][]models.Couple)
+
+	for _, chunk := range chunkAddresses(addresses, addressBatchSize) {
+		keys := make([]string, len(chunk))
+		for i, address := range chunk {
+			keys[i] = db.prefix + redisFingerprintPrefix + strconv.FormatUint(uint64(address), 10)
+		}
+
+		lists, err := db.getCouples(ctx, keys)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving couples: %v", err)
+		}
+		for i, list := range lists {
+			if len(list) > 0 {
+				couples[chunk[i]] = list
+			}
+		}
+	}
+
+	return couples, nil
+}
+
+// getCouples returns the couples stored under every fingerprint key of
+// keys, in one round trip
+func (db *RedisDB) getCouples(ctx context.Context, keys []string) ([][]models.Couple, error) {
+	pipe := db.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	// Exec fails with redis.Nil when a key doesn't exist
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	lists := make([][]models.Couple, len(keys))
+	for i, cmd := range cmds {
+		value, err := cmd.Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		couples, err := couplecodec.DecodeVarint(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid couples in %q: %v", keys[i], err)
+		}
+		lists[i] = couplecodec.Unique(couples)
+	}
+	return lists, nil
+}
+
+// ForEachFingerprint calls fn with the couples of every stored address
+func (db *RedisDB) ForEachFingerprint(ctx context.Context, fn func(address uint32, couples []models.Couple) error) error {
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		address, err := strconv.ParseUint(strings.TrimPrefix(key, db.prefix+redisFingerprintPrefix), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid fingerprint key %q: %v", key, err)
+		}
+
+		couples, err := db.GetCouples(ctx, []uint32{uint32(address)})
+		if err != nil {
+			return err
+		}
+		if err := fn(uint32(address), couples[uint32(address)]); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+	return nil
+}
+
+func (db *RedisDB) TotalSongs(ctx context.Context) (int, error) {
+	total, err := db.client.SCard(ctx, db.prefix+redisSongIDs).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(total), nil
+}
+
+func (db *RedisDB) TotalFingerprints(ctx context.Context) (int, error) {
+	total := 0
+	var keys []string
+	count := func() error {
+		lists, err := db.getCouples(ctx, keys)
+		if err != nil {
+			return fmt.Errorf("failed to count fingerprints: %v", err)
+		}
+		for _, list := range lists {
+			total += len(list)
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == addressBatchSize {
+			if err := count(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+	if len(keys) > 0 {
+		if err := count(); err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+func (db *RedisDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	total := 0
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		lists, err := db.getCouples(ctx, []string{iter.Val()})
+		if err != nil {
+			return 0, fmt.Errorf("failed to count fingerprints: %v", err)
+		}
+
+		for _, couple := range lists[0] {
+			if couple.SongID == songID {
+				total++
+			}
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+	return total, nil
+}
+
+// StorageSize returns the memory the Redis server uses. Catalogs share a
+// server, so it covers them all.
+func (db *RedisDB) StorageSize(ctx context.Context) (int64, error) {
+	info, err := db.client.Info(ctx, "memory").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get memory info: %v", err)
+	}
+
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, "used_memory:"); ok {
+			return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("used_memory missing from memory info")
+}
+
+func (db *RedisDB) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata) (uint32, error) {
+	songID := GenerateUniqueID()
+	if err := db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta); err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+// RegisterSongWithFingerprints stores the fingerprints of a song, then
+// registers it. See storeBeforeRegistering.
+func (db *RedisDB) RegisterSongWithFingerprints(ctx context.Context, songTitle, songArtist, ytID string, meta SongMetadata, fingerprint FingerprintFunc) (uint32, error) {
+	songID := GenerateUniqueID()
+	err := storeBeforeRegistering(ctx, db, songID, fingerprint(songID), func() error {
+		return db.registerSong(ctx, songID, songTitle, songArtist, ytID, meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return songID, nil
+}
+
+func (db *RedisDB) registerSong(ctx context.Context, songID uint32, songTitle, songArtist, ytID string, meta SongMetadata) error {
+	key := GenerateSongKey(songTitle, songArtist)
+	id := strconv.FormatUint(uint64(songID), 10)
+
+	// Reserve the (ytID, key) pair so the same song can't be registered twice
+	unique := db.prefix + redisSongUniquePrefix + ytID + "|" + key
+	ok, err := db.client.SetNX(ctx, unique, id, 0).Result()
+	if err != nil {
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("song with ytID or key already exists: %s", unique)
+	}
+
+	pipe := db.client.TxPipeline()
+	pipe.HSet(ctx, db.prefix+redisSongPrefix+id,
+		"title", songTitle, "artist", songArtist, "ytID", ytID, "key", key,
+		"album", meta.Album, "duration", meta.Duration, "releaseYear", meta.ReleaseYear, "coverURL", meta.CoverURL,
+		"source", meta.Source, "sourceURL", meta.SourceURL, "provenance", meta.Provenance.encode(),
+		"recordingMBID", meta.RecordingMBID, "releaseMBID", meta.ReleaseMBID,
+	)
+	pipe.Set(ctx, db.prefix+redisSongKeyPrefix+key, id, 0)
+	if ytID != "" {
+		pipe.Set(ctx, db.prefix+redisSongYTIDPrefix+ytID, id, 0)
+	}
+	pipe.SAdd(ctx, db.prefix+redisSongIDs, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		db.client.Del(ctx, unique)
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) GetSong(ctx context.Context, field SongField, value interface{}) (s Song, songExists bool, e error) {
+
+	var id string
+	switch field {
+	case SongFieldID:
+		id = fmt.Sprint(value)
+	case SongFieldYTID, SongFieldKey:
+		if value == "" {
+			// Songs without a YouTube ID aren't indexed by it
+			return Song{}, false, nil
+		}
+
+		prefix := db.prefix + redisSongYTIDPrefix
+		if field == SongFieldKey {
+			prefix = db.prefix + redisSongKeyPrefix
+		}
+
+		songID, err := db.client.Get(ctx, prefix+fmt.Sprint(value)).Result()
+		if err != nil {
+			if err == redis.Nil {
+				return Song{}, false, nil
+			}
+			return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+		}
+		id = songID
+	default:
+		return Song{}, false, errSongField(field)
+	}
+
+	fields, err := db.client.HGetAll(ctx, db.prefix+redisSongPrefix+id).Result()
+	if err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+	if len(fields) == 0 {
+		return Song{}, false, nil
+	}
+
+	return songFromHash(id, fields), true, nil
+}
+
+// songFromHash builds a Song from the fields of a song hash
+func songFromHash(id string, fields map[string]string) Song {
+	songID, _ := strconv.ParseUint(id, 10, 32)
+	duration, _ := strconv.Atoi(fields["duration"])
+	releaseYear, _ := strconv.Atoi(fields["releaseYear"])
+
+	return Song{
+		ID:        uint32(songID),
+		Title:     fields["title"],
+		Artist:    fields["artist"],
+		YouTubeID: fields["ytID"],
+		SongMetadata: SongMetadata{
+			Album:         fields["album"],
+			Duration:      duration,
+			ReleaseYear:   releaseYear,
+			CoverURL:      fields["coverURL"],
+			Source:        fields["source"],
+			SourceURL:     fields["sourceURL"],
+			Provenance:    decodeSongProvenance(fields["provenance"]),
+			RecordingMBID: fields["recordingMBID"],
+			ReleaseMBID:   fields["releaseMBID"],
+		},
+	}
+}
+
+func (db *RedisDB) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldID, songID)
+}
+
+func (db *RedisDB) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldYTID, ytID)
+}
+
+func (db *RedisDB) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, SongFieldKey, key)
+}
+
+// ListSongs returns a page of songs. Redis can't sort them, so every song
+// is loaded and sorted in memory.
+func (db *RedisDB) ListSongs(ctx context.Context, offset, limit int, sortBy string) ([]Song, error) {
+	ids, err := db.client.SMembers(ctx, db.prefix+redisSongIDs).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	pipe := db.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, db.prefix+redisSongPrefix+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	songs := []Song{}
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			songs = append(songs, songFromHash(ids[i], fields))
+		}
+	}
+
+	return pageSongs(songs, offset, limit, sortBy)
+}
+
+// SearchSongs ranks every song, since Redis has no text queries
+func (db *RedisDB) SearchSongs(ctx context.Context, query string, limit int) ([]SongSearchResult, error) {
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search songs: %v", err)
+	}
+
+	return rankSongs(query, songs, limit), nil
+}
+
+// DeleteSongByID deletes a song along with its fingerprints
+func (db *RedisDB) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.DeleteSongs(ctx, []uint32{songID})
+}
+
+// DeleteSongs deletes songs along with their fingerprints, removing the
+// couples of them all in one scan of the addresses
+func (db *RedisDB) DeleteSongs(ctx context.Context, songIDs []uint32) error {
+	deleted := make(map[uint32]bool, len(songIDs))
+	for _, songID := range songIDs {
+		deleted[songID] = true
+	}
+	if err := db.deleteFingerprints(ctx, deleted); err != nil {
+		return err
+	}
+
+	for _, songID := range songIDs {
+		if err := db.deleteSong(ctx, songID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSong removes a song and the keys it is looked up by
+func (db *RedisDB) deleteSong(ctx context.Context, songID uint32) error {
+	id := strconv.FormatUint(uint64(songID), 10)
+
+	fields, err := db.client.HGetAll(ctx, db.prefix+redisSongPrefix+id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	keys := []string{
+		db.prefix + redisSongPrefix + id,
+		db.prefix + redisSongKeyPrefix + fields["key"],
+		db.prefix + redisSongUniquePrefix + fields["ytID"] + "|" + fields["key"],
+	}
+	if fields["ytID"] != "" {
+		keys = append(keys, db.prefix+redisSongYTIDPrefix+fields["ytID"])
+	}
+
+	pipe := db.client.TxPipeline()
+	pipe.Del(ctx, keys...)
+	pipe.SRem(ctx, db.prefix+redisSongIDs, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteFingerprintsBySongID removes the couples of songID from every
+// address. Redis has no index by song, so every address is scanned.
+func (db *RedisDB) DeleteFingerprintsBySongID(ctx context.Context, songID uint32) error {
+	return db.deleteFingerprints(ctx, map[uint32]bool{songID: true})
+}
+
+// deleteFingerprints removes the couples of the songs in songIDs from every
+// address
+func (db *RedisDB) deleteFingerprints(ctx context.Context, songIDs map[uint32]bool) error {
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := db.deleteCouples(ctx, iter.Val(), songIDs); err != nil {
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+	return nil
+}
+
+func (db *RedisDB) GetSetting(ctx context.Context, key string) (string, bool, error) {
+	value, err := db.client.HGet(ctx, db.prefix+redisSettings, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %v", err)
+	}
+
+	return value, true, nil
+}
+
+func (db *RedisDB) SetSetting(ctx context.Context, key, value string) error {
+	if err := db.client.HSet(ctx, db.prefix+redisSettings, key, value).Err(); err != nil {
+		return fmt.Errorf("failed to store setting: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) StoreAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	if err := db.client.HSet(ctx, db.prefix+redisAPIKeys, key.Hash, data).Err(); err != nil {
+		return fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) GetAPIKey(ctx context.Context, hash string) (APIKey, bool, error) {
+	data, err := db.client.HGet(ctx, db.prefix+redisAPIKeys, hash).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, fmt.Errorf("failed to retrieve API key: %v", err)
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return APIKey{}, false, fmt.Errorf("invalid API key %s: %v", hash, err)
+	}
+
+	return key, true, nil
+}
+
+func (db *RedisDB) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	values, err := db.client.HVals(ctx, db.prefix+redisAPIKeys).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+
+	return decodeAPIKeys(values)
+}
+
+func (db *RedisDB) DeleteAPIKey(ctx context.Context, id string) error {
+	keys, err := db.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key.ID == id {
+			if err := db.client.HDel(ctx, db.prefix+redisAPIKeys, key.Hash).Err(); err != nil {
+				return fmt.Errorf("failed to delete API key: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StoreRecognition adds recognition to the history of every client, and to
+// the history of its own client
+func (db *RedisDB) StoreRecognition(ctx context.Context, recognition Recognition) error {
+	id, err := db.client.Incr(ctx, db.prefix+redisRecognitionID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	recognition.ID = strconv.FormatInt(id, 10)
+	data, err := json.Marshal(recognition)
+	if err != nil {
+		return err
+	}
+
+	member := redis.Z{Score: float64(id), Member: data}
+	pipe := db.client.TxPipeline()
+	pipe.ZAdd(ctx, db.prefix+redisRecognitions, member)
+	if recognition.ClientID != "" {
+		pipe.ZAdd(ctx, db.prefix+redisClientRecognition+recognition.ClientID, member)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store recognition: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) ListRecognitions(ctx context.Context, clientID string, offset, limit int) ([]Recognition, error) {
+	key := db.prefix + redisRecognitions
+	if clientID != "" {
+		key = db.prefix + redisClientRecognition + clientID
+	}
+
+	values, err := db.client.ZRevRange(ctx, key, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recognitions: %v", err)
+	}
+
+	return decodeRecognitions(values)
+}
+
+// StoreAirplay adds airplay to the airplays of every station, and to those
+// of its own station
+func (db *RedisDB) StoreAirplay(ctx context.Context, airplay Airplay) error {
+	id, err := db.client.Incr(ctx, db.prefix+redisAirplayID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	airplay.ID = strconv.FormatInt(id, 10)
+	data, err := json.Marshal(airplay)
+	if err != nil {
+		return err
+	}
+
+	member := redis.Z{Score: float64(airplay.Started.UnixMilli()), Member: data}
+	pipe := db.client.TxPipeline()
+	pipe.ZAdd(ctx, db.prefix+redisAirplay, member)
+	pipe.ZAdd(ctx, db.prefix+redisStationAirplay+airplay.Station, member)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store airplay: %v", err)
+	}
+
+	return nil
+}
+
+func (db *RedisDB) ListAirplays(ctx context.Context, filter AirplayFilter, offset, limit int) ([]Airplay, error) {
+	key := db.prefix + redisAirplay
+	if filter.Station != "" {
+		key = db.prefix + redisStationAirplay + filter.Station
+	}
+
+	scores := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Offset: int64(offset), Count: int64(limit)}
+	if !filter.From.IsZero() {
+		scores.Min = strconv.FormatInt(filter.From.UnixMilli(), 10)
+	}
+	if !filter.To.IsZero() {
+		scores.Max = "(" + strconv.FormatInt(filter.To.UnixMilli(), 10)
+	}
+
+	values, err := db.client.ZRevRangeByScore(ctx, key, scores).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list airplays: %v", err)
+	}
+
+	return decodeAirplays(values)
+}
+
+// DeleteCollection removes every key belonging to the "songs", "fingerprints", "settings", "recognitions" or "airplay" collection
+func (db *RedisDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	var patterns []string
+	switch collectionName {
+	case "fingerprints":
+		patterns = []string{db.prefix + redisFingerprintPrefix + "*"}
+	case "settings":
+		if err := db.client.Del(ctx, db.prefix+redisSettings).Err(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	case "recognitions":
+		patterns = []string{db.prefix + redisClientRecognition + "*"}
+		if err := db.client.Del(ctx, db.prefix+redisRecognitions, db.prefix+redisRecognitionID).Err(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	case "airplay":
+		patterns = []string{db.prefix + redisStationAirplay + "*"}
+		if err := db.client.Del(ctx, db.prefix+redisAirplay, db.prefix+redisAirplayID).Err(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	case "songs":
+		patterns = []string{db.prefix + redisSongPrefix + "*", db.prefix + redisSongKeyPrefix + "*", db.prefix + redisSongYTIDPrefix + "*", db.prefix + redisSongUniquePrefix + "*"}
+		if err := db.client.Del(ctx, db.prefix+redisSongIDs).Err(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	default:
+		return fmt.Errorf("error deleting collection: unknown collection %q", collectionName)
+	}
+
+	for _, pattern := range patterns {
+		iter := db.client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			if err := db.client.Del(ctx, iter.Val()).Err(); err != nil {
+				return fmt.Errorf("error deleting collection: %v", err)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// deleteCouples removes the couples of the songs in songIDs from the
+// fingerprint key, deleting it if none are left. The key is written only
+// if no couples were appended to it meanwhile, and read again otherwise.
+func (db *RedisDB) deleteCouples(ctx context.Context, key string, songIDs map[uint32]bool) error {
+	for {
+		err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			couples, err := couplecodec.DecodeVarint(value)
+			if err != nil {
+				return fmt.Errorf("invalid couples in %q: %v", key, err)
+			}
+
+			var kept []byte
+			for _, couple := range couplecodec.Unique(couples) {
+				if !songIDs[couple.SongID] {
+					kept = couplecodec.AppendVarint(kept, couple)
+				}
+			}
+			if len(kept) == len(value) {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if len(kept) == 0 {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, kept, 0)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+// migrations returns the schema migrations of the Redis backend
+func (db *RedisDB) migrations() []Migration {
+	return []Migration{
+		songKeyMigration(1, "normalize song keys", normalizedSongKey, legacySongKey, db.songKeys, db.rekeySong),
+		{
+			Version:     2,
+			Description: "store the couples of each address as varint-encoded strings instead of sets",
+			Up:          db.encodeCoupleSets,
+			Down:        db.decodeCoupleStrings,
+		},
+		songKeyMigration(3, "prefix the titles in song keys with their length", GenerateSongKey, normalizedSongKey, db.songKeys, db.rekeySong),
+	}
+}
+
+// encodeCoupleSets replaces the sets of packed couples fingerprint keys
+// used to be with strings of encoded couples
+func (db *RedisDB) encodeCoupleSets(ctx context.Context) error {
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		kind, err := db.client.Type(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if kind != "set" {
+			// Already a string
+			continue
+		}
+		members, err := db.client.SMembers(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		for _, member := range members {
+			packed, err := strconv.ParseUint(member, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid couple in %q: %v", key, err)
+			}
+			value = couplecodec.AppendVarint(value, unpackCouple(packed))
+		}
+
+		pipe := db.client.TxPipeline()
+		pipe.Del(ctx, key)
+		if len(value) > 0 {
+			pipe.Set(ctx, key, value, 0)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// decodeCoupleStrings reverts encodeCoupleSets
+func (db *RedisDB) decodeCoupleStrings(ctx context.Context) error {
+	iter := db.client.Scan(ctx, 0, db.prefix+redisFingerprintPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		kind, err := db.client.Type(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if kind != "string" {
+			// Already a set
+			continue
+		}
+		value, err := db.client.Get(ctx, key).Bytes()
+		if err != nil {
+			return err
+		}
+		couples, err := couplecodec.DecodeVarint(value)
+		if err != nil {
+			return fmt.Errorf("invalid couples in %q: %v", key, err)
+		}
+
+		members := make([]interface{}, 0, len(couples))
+		for _, couple := range couples {
+			members = append(members, packCouple(couple))
+		}
+		pipe := db.client.TxPipeline()
+		pipe.Del(ctx, key)
+		if len(members) > 0 {
+			pipe.SAdd(ctx, key, members...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// songKeys returns the key of every song, for songKeyMigration
+func (db *RedisDB) songKeys(ctx context.Context) ([]storedSongKey, error) {
+	ids, err := db.client.SMembers(ctx, db.prefix+redisSongIDs).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := db.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, db.prefix+redisSongPrefix+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var songs []storedSongKey
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		song := songFromHash(ids[i], fields)
+		songs = append(songs, storedSongKey{ID: song.ID, YouTubeID: song.YouTubeID, Title: song.Title, Artist: song.Artist, Key: fields["key"]})
+	}
+	return songs, nil
+}
+
+// rekeySong saves a song and the keys it is looked up by under key
+func (db *RedisDB) rekeySong(ctx context.Context, song storedSongKey, key string) error {
+	id := strconv.FormatUint(uint64(song.ID), 10)
+
+	pipe := db.client.TxPipeline()
+	pipe.HSet(ctx, db.prefix+redisSongPrefix+id, "key", key)
+	pipe.Del(ctx, db.prefix+redisSongKeyPrefix+song.Key, db.prefix+redisSongUniquePrefix+song.YouTubeID+"|"+song.Key)
+	pipe.Set(ctx, db.prefix+redisSongKeyPrefix+key, id, 0)
+	pipe.Set(ctx, db.prefix+redisSongUniquePrefix+song.YouTubeID+"|"+key, id, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client talks to an S3 bucket, or to a server with the same API such as
+// MinIO, signing its requests with AWS Signature Version 4
+type s3Client struct {
+	// endpoint is the URL of the server. The bucket is addressed by host
+	// name on AWS, and by path on other servers.
+	endpoint     string
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	// now returns the time requests are signed at
+	now func() time.Time
+}
+
+// newS3Client creates a client of bucket from the AWS_* variables.
+// S3_ENDPOINT sets the server of other providers. Requests are sent
+// unsigned when AWS_ACCESS_KEY_ID is unset, which only public buckets
+// allow.
+func newS3Client(bucket string) *s3Client {
+	return &s3Client{
+		endpoint:     strings.TrimSuffix(GetEnv("S3_ENDPOINT"), "/"),
+		bucket:       bucket,
+		region:       GetEnv("AWS_REGION", "us-east-1"),
+		accessKey:    GetEnv("AWS_ACCESS_KEY_ID"),
+		secretKey:    GetEnv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: GetEnv("AWS_SESSION_TOKEN"),
+		http:         &http.Client{Timeout: 5 * time.Minute},
+		now:          time.Now,
+	}
+}
+
+// objectURL returns the URL of the object named key
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: c.bucket + ".s3." + c.region + ".amazonaws.com", Path: "/" + key}
+	if c.endpoint != "" {
+		endpoint, err := url.Parse(c.endpoint)
+		if err == nil {
+			u.Scheme, u.Host = endpoint.Scheme, endpoint.Host
+			u.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + c.bucket + "/" + key
+		}
+	}
+	return u
+}
+
+// GetRange returns length bytes of the object named key from offset, the
+// last length bytes when offset is negative, or the whole object when
+// length is negative
+func (c *s3Client) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case length < 0:
+	case offset < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=-%d", length))
+	default:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	resp, err := c.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// PutFile uploads the file at filePath as the object named key. S3 takes
+// objects of up to 5 GB in one request.
+func (c *s3Client) PutFile(ctx context.Context, key, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The payload is signed, so it's read once to hash it and once to send it
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key).String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := c.do(req, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete deletes the object named key
+func (c *s3Client) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, emptyPayloadHash)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Object is an object of a listing
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// List returns the objects whose keys start with prefix, in key order
+func (c *s3Client) List(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		u := c.objectURL("")
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", prefix, err)
+		}
+
+		var page struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", prefix, err)
+		}
+
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// do signs req and sends it, failing unless it succeeds
+func (c *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	c.sign(req, payloadHash)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+// sign adds the headers of Signature Version 4 to req, covering its host,
+// range and x-amz-* headers
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.accessKey == "" {
+		return
+	}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		// Values are sorted by Encode, and spaces have to be %20
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minSearchScore is the lowest score of the songs SearchSongs returns
+	minSearchScore = 0.5
+
+	// searchTermLength is the number of letters of a query word the
+	// backends look candidates up with, so that typos after them are
+	// still found
+	searchTermLength = 3
+
+	// maxSearchTerms bounds the number of words of a query that are looked
+	// up
+	maxSearchTerms = 8
+)
+
+// SongSearchResult is a song found by SearchSongs, with how closely it
+// matches the query, from 0 to 1
+type SongSearchResult struct {
+	Song
+	Score float64
+}
+
+// normalizeSearchText normalizes s with NormalizeText and reduces it to its
+// words of letters and digits
+func normalizeSearchText(s string) []string {
+	return strings.FieldsFunc(NormalizeText(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchTerms returns the lowercase fragments the backends select the
+// candidates of a query with: the beginning of each of its words. Words
+// shorter than searchTermLength are left out, unless they are all short.
+func searchTerms(query string) []string {
+	words := normalizeSearchText(query)
+
+	var terms []string
+	seen := map[string]bool{}
+	for _, short := range []bool{false, true} {
+		for _, word := range words {
+			runes := []rune(word)
+			if !short && len(runes) < searchTermLength {
+				continue
+			}
+			if len(runes) > searchTermLength {
+				runes = runes[:searchTermLength]
+			}
+			term := string(runes)
+			if !seen[term] && len(terms) < maxSearchTerms {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+		if len(terms) > 0 {
+			break
+		}
+	}
+	return terms
+}
+
+// rankSongs scores candidates against query and returns up to limit of
+// those that score at least minSearchScore, from the best. A limit of 0
+// returns them all.
+func rankSongs(query string, candidates []Song, limit int) []SongSearchResult {
+	queryWords := normalizeSearchText(query)
+	results := []SongSearchResult{}
+	if len(queryWords) == 0 {
+		return results
+	}
+
+	for _, song := range candidates {
+		score := songSearchScore(queryWords, song)
+		if score >= minSearchScore {
+			results = append(results, SongSearchResult{Song: song, Score: score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return strings.ToLower(results[i].Title) < strings.ToLower(results[j].Title)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// songSearchScore rates how closely song matches the words of a query. It
+// mostly counts how well each word matches a word of the title or artist,
+// so words can come in any order, and then how close the whole query is
+// to the title, the artist or both.
+func songSearchScore(queryWords []string, song Song) float64 {
+	titleWords, artistWords := normalizeSearchText(song.Title), normalizeSearchText(song.Artist)
+	songWords := append(append([]string(nil), titleWords...), artistWords...)
+
+	wordScore := 0.0
+	for _, queryWord := range queryWords {
+		best := 0.0
+		for _, songWord := range songWords {
+			best = max(best, similarity(queryWord, songWord))
+		}
+		wordScore += best
+	}
+	wordScore /= float64(len(queryWords))
+
+	query := strings.Join(queryWords, " ")
+	title, artist := strings.Join(titleWords, " "), strings.Join(artistWords, " ")
+	wholeScore := max(
+		similarity(query, title),
+		similarity(query, artist),
+		similarity(query, title+" "+artist),
+		similarity(query, artist+" "+title),
+	)
+
+	return 0.7*wordScore + 0.3*wholeScore
+}
+
+// similarity is 1 minus the Levenshtein distance between a and b divided
+// by the length of the longest, 1 for equal strings and 0 for entirely
+// different ones
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein returns the number of single rune insertions, deletions and
+// substitutions that turn a into b
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,1018 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"song-recognition/config"
+	"song-recognition/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segments are immutable files of fingerprints sorted by address, like the
+// SSTables of an LSM tree. The fingerprints of a segment are split in
+// blocks of segmentBlockEntries couples, followed by the index of the
+// blocks, the metadata of the segment and a footer:
+//
+//	block...  couples of 12 bytes: address, song ID, anchor time in ms
+//	index     per block, 16 bytes: first address, number of couples, offset
+//	metadata  JSON encoded segmentMeta
+//	footer    segmentMagic, index offset, number of blocks, metadata
+//	          length, number of couples, in 32 bytes
+//
+// Numbers are little-endian. A recognition reads the index of every
+// segment once, then only the blocks holding its addresses.
+const (
+	segmentMagic          = "STSEG001"
+	segmentExt            = ".seg"
+	segmentEntrySize      = 12
+	segmentIndexEntrySize = 16
+	segmentFooterSize     = 32
+	segmentBlockEntries   = 4096
+
+	// segmentFetchConcurrency is the number of block ranges a lookup reads
+	// at a time
+	segmentFetchConcurrency = 16
+)
+
+var (
+	// segmentsURL is where the segments of the fingerprints are kept,
+	// either s3://<bucket>/<prefix> or a directory. Segments are disabled
+	// when it's empty. Set with SEGMENTS_URL.
+	segmentsURL = GetEnv("SEGMENTS_URL")
+
+	// segmentsRefresh is how often the segments are listed again to find
+	// those built by other processes. Set with SEGMENTS_REFRESH.
+	segmentsRefresh = durationFromEnv("SEGMENTS_REFRESH", time.Minute)
+
+	// segmentBlocks caches the blocks read by every segmentIndex, up to
+	// SEGMENTS_CACHE_SIZE blocks of up to 48 KB
+	segmentBlocks = newBlockCache(intFromEnv("SEGMENTS_CACHE_SIZE", 1024))
+
+	// segmentIndexes are the indexes of the catalogs opened by the process
+	segmentIndexes sync.Map
+)
+
+func init() {
+	config.OnReload(func() {
+		segmentBlocks.resize(intFromEnv("SEGMENTS_CACHE_SIZE", 1024))
+	})
+}
+
+// ErrSegmentsDisabled is returned by the functions managing segments when
+// SEGMENTS_URL is unset
+var ErrSegmentsDisabled = errors.New("segments are disabled, set SEGMENTS_URL")
+
+// SegmentInfo describes a segment
+type SegmentInfo struct {
+	Name         string
+	Songs        int
+	Fingerprints int
+	Size         int64
+	Created      time.Time
+}
+
+// segmentMeta is the metadata of a segment
+type segmentMeta struct {
+	Created time.Time `json:"created"`
+	// Songs is the number of couples of every song of the segment
+	Songs map[uint32]int `json:"songs"`
+	// Replaces lists the segments that were compacted into this one, which
+	// are ignored until they are deleted
+	Replaces []string `json:"replaces,omitempty"`
+}
+
+// segmentEntry is a couple of a segment
+type segmentEntry struct {
+	address      uint32
+	songID       uint32
+	anchorTimeMs uint32
+}
+
+// segmentBlock is an entry of the index of a segment
+type segmentBlock struct {
+	first   uint32
+	entries int
+	offset  int64
+}
+
+// segment is a segment whose index has been read
+type segment struct {
+	name        string
+	size        int64
+	entries     int
+	blocks      []segmentBlock
+	indexOffset int64
+	meta        segmentMeta
+}
+
+func (s *segment) info() SegmentInfo {
+	return SegmentInfo{Name: s.name, Songs: len(s.meta.Songs), Fingerprints: s.entries, Size: s.size, Created: s.meta.Created}
+}
+
+// segmentStore is where the segments of a catalog are kept
+type segmentStore interface {
+	// List returns the names of the segments, sorted from the oldest
+	List(ctx context.Context) ([]string, error)
+	// ReadRange returns length bytes of segment name from offset, or its
+	// last length bytes when offset is negative
+	ReadRange(ctx context.Context, name string, offset, length int64) ([]byte, error)
+	// Upload stores the file at filePath as segment name
+	Upload(ctx context.Context, name, filePath string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// newSegmentStore returns the store of the segments of catalog under
+// segmentsURL. The segments of the default catalog are kept at its root,
+// and those of other catalogs under catalogs/<catalog>/.
+func newSegmentStore(catalog string) (segmentStore, error) {
+	sub := ""
+	if catalog != DefaultCatalog {
+		sub = "catalogs/" + catalog + "/"
+	}
+
+	if rest, ok := strings.CutPrefix(segmentsURL, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid SEGMENTS_URL %q: no bucket", segmentsURL)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3SegmentStore{client: newS3Client(bucket), prefix: prefix + sub}, nil
+	}
+
+	dir := strings.TrimPrefix(segmentsURL, "file://")
+	return &dirSegmentStore{dir: filepath.Join(dir, sub)}, nil
+}
+
+// s3SegmentStore keeps segments in an S3 bucket, reading only the ranges of
+// them that are needed
+type s3SegmentStore struct {
+	client *s3Client
+	prefix string
+}
+
+func (s *s3SegmentStore) List(ctx context.Context) ([]string, error) {
+	objects, err := s.client.List(ctx, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if strings.HasSuffix(name, segmentExt) && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *s3SegmentStore) ReadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	data, err := s.client.GetRange(ctx, s.prefix+name, offset, length)
+	if err == nil && int64(len(data)) != length {
+		err = fmt.Errorf("segment %s is truncated", name)
+	}
+	return data, err
+}
+
+func (s *s3SegmentStore) Upload(ctx context.Context, name, filePath string) error {
+	return s.client.PutFile(ctx, s.prefix+name, filePath)
+}
+
+func (s *s3SegmentStore) Delete(ctx context.Context, name string) error {
+	return s.client.Delete(ctx, s.prefix+name)
+}
+
+// dirSegmentStore keeps segments in a directory, such as a volume shared by
+// the servers
+type dirSegmentStore struct {
+	dir string
+}
+
+func (s *dirSegmentStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *dirSegmentStore) ReadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if offset < 0 {
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		offset = stat.Size() - length
+		if offset < 0 {
+			return nil, fmt.Errorf("segment %s is truncated", name)
+		}
+	}
+
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("segment %s is truncated", name)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Upload copies the file to the directory under a temporary name, then
+// renames it, so that the segment is never seen half written
+func (s *dirSegmentStore) Upload(ctx context.Context, name, filePath string) error {
+	if err := CreateFolder(s.dir); err != nil {
+		return err
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(s.dir, name))
+}
+
+func (s *dirSegmentStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// newSegmentName returns a name that sorts after the segments built before
+func newSegmentName() string {
+	return fmt.Sprintf("%016x-%08x%s", time.Now().UnixNano(), rand.Uint32(), segmentExt)
+}
+
+// writeSegment writes the segment of entries, sorted by address, to the
+// file at filePath
+func writeSegment(filePath string, entries []segmentEntry, meta segmentMeta) (err error) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	w := bufio.NewWriterSize(file, 1<<20)
+	var blocks []segmentBlock
+	var offset int64
+	buf := make([]byte, segmentEntrySize)
+	for i, entry := range entries {
+		if i%segmentBlockEntries == 0 {
+			blocks = append(blocks, segmentBlock{first: entry.address, offset: offset})
+		}
+		blocks[len(blocks)-1].entries++
+
+		binary.LittleEndian.PutUint32(buf[0:], entry.address)
+		binary.LittleEndian.PutUint32(buf[4:], entry.songID)
+		binary.LittleEndian.PutUint32(buf[8:], entry.anchorTimeMs)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		offset += segmentEntrySize
+	}
+
+	indexOffset := offset
+	buf = make([]byte, segmentIndexEntrySize)
+	for _, block := range blocks {
+		binary.LittleEndian.PutUint32(buf[0:], block.first)
+		binary.LittleEndian.PutUint32(buf[4:], uint32(block.entries))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(block.offset))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(metaData); err != nil {
+		return err
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	copy(footer, segmentMagic)
+	binary.LittleEndian.PutUint64(footer[8:], uint64(indexOffset))
+	binary.LittleEndian.PutUint32(footer[16:], uint32(len(blocks)))
+	binary.LittleEndian.PutUint32(footer[20:], uint32(len(metaData)))
+	binary.LittleEndian.PutUint64(footer[24:], uint64(len(entries)))
+	if _, err := w.Write(footer); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// openSegment reads the footer, index and metadata of segment name
+func openSegment(ctx context.Context, store segmentStore, name string) (*segment, error) {
+	footer, err := store.ReadRange(ctx, name, -1, segmentFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if string(footer[:8]) != segmentMagic {
+		return nil, fmt.Errorf("%s is not a segment", name)
+	}
+
+	seg := &segment{
+		name:        name,
+		indexOffset: int64(binary.LittleEndian.Uint64(footer[8:])),
+		entries:     int(binary.LittleEndian.Uint64(footer[24:])),
+	}
+	numBlocks := int64(binary.LittleEndian.Uint32(footer[16:]))
+	metaLength := int64(binary.LittleEndian.Uint32(footer[20:]))
+	indexLength := numBlocks * segmentIndexEntrySize
+	seg.size = seg.indexOffset + indexLength + metaLength + segmentFooterSize
+
+	data, err := store.ReadRange(ctx, name, seg.indexOffset, indexLength+metaLength)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < numBlocks; i++ {
+		entry := data[i*segmentIndexEntrySize:]
+		seg.blocks = append(seg.blocks, segmentBlock{
+			first:   binary.LittleEndian.Uint32(entry[0:]),
+			entries: int(binary.LittleEndian.Uint32(entry[4:])),
+			offset:  int64(binary.LittleEndian.Uint64(entry[8:])),
+		})
+	}
+	if err := json.Unmarshal(data[indexLength:], &seg.meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of segment %s: %v", name, err)
+	}
+
+	return seg, nil
+}
+
+// blockRange returns the first and last blocks of seg that can hold
+// address. The couples of an address can span several blocks.
+func (s *segment) blockRange(address uint32) (int, int, bool) {
+	// The last block starting at or before the address
+	last := sort.Search(len(s.blocks), func(i int) bool { return s.blocks[i].first > address }) - 1
+	if last < 0 {
+		return 0, 0, false
+	}
+	// The last block starting before the address, which can end with it
+	first := sort.Search(len(s.blocks), func(i int) bool { return s.blocks[i].first >= address }) - 1
+	if first < 0 {
+		first = 0
+	}
+	return first, last, true
+}
+
+// segmentIndex looks fingerprints up in the segments of a catalog
+type segmentIndex struct {
+	store segmentStore
+
+	mu       sync.Mutex
+	segments []*segment
+	loaded   time.Time
+}
+
+// segmentIndexFor returns the index of the segments of catalog, shared by
+// the clients of the process
+func segmentIndexFor(catalog string) (*segmentIndex, error) {
+	if !SegmentsEnabled() {
+		return nil, ErrSegmentsDisabled
+	}
+	if index, ok := segmentIndexes.Load(catalog); ok {
+		return index.(*segmentIndex), nil
+	}
+
+	store, err := newSegmentStore(catalog)
+	if err != nil {
+		return nil, err
+	}
+	index, _ := segmentIndexes.LoadOrStore(catalog, &segmentIndex{store: store})
+	return index.(*segmentIndex), nil
+}
+
+// live returns the segments that aren't replaced by another, listing them
+// again when they were listed more than segmentsRefresh ago
+func (x *segmentIndex) live(ctx context.Context) ([]*segment, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if !x.loaded.IsZero() && time.Since(x.loaded) < segmentsRefresh {
+		return x.segments, nil
+	}
+
+	names, err := x.store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing segments: %v", err)
+	}
+
+	opened := make(map[string]*segment, len(x.segments))
+	for _, seg := range x.segments {
+		opened[seg.name] = seg
+	}
+	var segments []*segment
+	replaced := map[string]bool{}
+	for _, name := range names {
+		seg := opened[name]
+		if seg == nil {
+			if seg, err = openSegment(ctx, x.store, name); err != nil {
+				return nil, fmt.Errorf("error opening segment: %v", err)
+			}
+		}
+		segments = append(segments, seg)
+		for _, name := range seg.meta.Replaces {
+			replaced[name] = true
+		}
+	}
+
+	x.segments = x.segments[:0:0]
+	for _, seg := range segments {
+		if !replaced[seg.name] {
+			x.segments = append(x.segments, seg)
+		}
+	}
+	x.loaded = time.Now()
+	return x.segments, nil
+}
+
+// reload makes the next lookup list the segments again
+func (x *segmentIndex) reload() {
+	x.mu.Lock()
+	x.loaded = time.Time{}
+	x.mu.Unlock()
+}
+
+// blockFetch is a run of consecutive blocks of a segment read in one
+// request
+type blockFetch struct {
+	seg         *segment
+	first, last int
+}
+
+// lookup returns the couples of addresses found in the segments
+func (x *segmentIndex) lookup(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	segments, err := x.live(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the blocks that aren't cached yet, reading runs of consecutive
+	// blocks with a single request
+	var fetches []blockFetch
+	for _, seg := range segments {
+		needed := map[int]bool{}
+		for _, address := range addresses {
+			first, last, ok := seg.blockRange(address)
+			for i := first; ok && i <= last; i++ {
+				if !segmentBlocks.has(blockKey{seg, i}) {
+					needed[i] = true
+				}
+			}
+		}
+		blocks := make([]int, 0, len(needed))
+		for i := range needed {
+			blocks = append(blocks, i)
+		}
+		sort.Ints(blocks)
+		for _, i := range blocks {
+			if n := len(fetches); n > 0 && fetches[n-1].seg == seg && fetches[n-1].last == i-1 {
+				fetches[n-1].last = i
+				continue
+			}
+			fetches = append(fetches, blockFetch{seg, i, i})
+		}
+	}
+
+	fetched := make([]map[int][]byte, len(fetches))
+	err = runParallel(len(fetches), segmentFetchConcurrency, func(i int) error {
+		blocks, err := x.fetch(ctx, fetches[i])
+		fetched[i] = blocks
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading segments: %v", err)
+	}
+	loaded := map[blockKey][]byte{}
+	for i, blocks := range fetched {
+		for block, data := range blocks {
+			loaded[blockKey{fetches[i].seg, block}] = data
+		}
+	}
+
+	couples := make(map[uint32][]models.Couple)
+	for _, seg := range segments {
+		for _, address := range addresses {
+			first, last, ok := seg.blockRange(address)
+			for i := first; ok && i <= last; i++ {
+				data, cached := loaded[blockKey{seg, i}]
+				if !cached {
+					if data, cached = segmentBlocks.get(blockKey{seg, i}); !cached {
+						// Evicted since, read it again
+						blocks, err := x.fetch(ctx, blockFetch{seg, i, i})
+						if err != nil {
+							return nil, fmt.Errorf("error reading segments: %v", err)
+						}
+						data = blocks[i]
+					}
+				}
+				couples[address] = appendBlockCouples(couples[address], data, address)
+			}
+		}
+	}
+	for address, addressCouples := range couples {
+		if len(addressCouples) == 0 {
+			delete(couples, address)
+		}
+	}
+	return couples, nil
+}
+
+// fetch reads the blocks of f and caches them
+func (x *segmentIndex) fetch(ctx context.Context, f blockFetch) (map[int][]byte, error) {
+	start := f.seg.blocks[f.first].offset
+	end := f.seg.indexOffset
+	if f.last+1 < len(f.seg.blocks) {
+		end = f.seg.blocks[f.last+1].offset
+	}
+	data, err := x.store.ReadRange(ctx, f.seg.name, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[int][]byte, f.last-f.first+1)
+	for i := f.first; i <= f.last; i++ {
+		block := f.seg.blocks[i]
+		from := block.offset - start
+		blocks[i] = data[from : from+int64(block.entries*segmentEntrySize)]
+		segmentBlocks.add(blockKey{f.seg, i}, blocks[i])
+	}
+	return blocks, nil
+}
+
+// appendBlockCouples appends the couples of address in the block data to
+// couples
+func appendBlockCouples(couples []models.Couple, data []byte, address uint32) []models.Couple {
+	n := len(data) / segmentEntrySize
+	i := sort.Search(n, func(i int) bool {
+		return binary.LittleEndian.Uint32(data[i*segmentEntrySize:]) >= address
+	})
+	for ; i < n; i++ {
+		entry := data[i*segmentEntrySize:]
+		if binary.LittleEndian.Uint32(entry) != address {
+			break
+		}
+		couples = append(couples, models.Couple{
+			SongID:       binary.LittleEndian.Uint32(entry[4:]),
+			AnchorTimeMs: binary.LittleEndian.Uint32(entry[8:]),
+		})
+	}
+	return couples
+}
+
+// readEntries returns every couple of seg
+func (x *segmentIndex) readEntries(ctx context.Context, seg *segment) ([]segmentEntry, error) {
+	if seg.indexOffset == 0 {
+		return nil, nil
+	}
+	data, err := x.store.ReadRange(ctx, seg.name, 0, seg.indexOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]segmentEntry, 0, len(data)/segmentEntrySize)
+	for i := 0; i+segmentEntrySize <= len(data); i += segmentEntrySize {
+		entries = append(entries, segmentEntry{
+			address:      binary.LittleEndian.Uint32(data[i:]),
+			songID:       binary.LittleEndian.Uint32(data[i+4:]),
+			anchorTimeMs: binary.LittleEndian.Uint32(data[i+8:]),
+		})
+	}
+	return entries, nil
+}
+
+// upload writes the segment of entries to a temporary file and uploads it
+func (x *segmentIndex) upload(ctx context.Context, entries []segmentEntry, meta segmentMeta) (SegmentInfo, error) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.address != b.address {
+			return a.address < b.address
+		}
+		if a.songID != b.songID {
+			return a.songID < b.songID
+		}
+		return a.anchorTimeMs < b.anchorTimeMs
+	})
+
+	tmp, err := os.CreateTemp("", "segment-*"+segmentExt)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := writeSegment(tmp.Name(), entries, meta); err != nil {
+		return SegmentInfo{}, fmt.Errorf("error writing segment: %v", err)
+	}
+	stat, err := os.Stat(tmp.Name())
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	name := newSegmentName()
+	if err := x.store.Upload(ctx, name, tmp.Name()); err != nil {
+		return SegmentInfo{}, fmt.Errorf("error uploading segment: %v", err)
+	}
+	x.reload()
+
+	return SegmentInfo{Name: name, Songs: len(meta.Songs), Fingerprints: len(entries), Size: stat.Size(), Created: meta.Created}, nil
+}
+
+// waitForReaders waits until every process has listed the segments again
+func waitForReaders(ctx context.Context) error {
+	select {
+	case <-time.After(segmentsRefresh):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SegmentsEnabled reports whether SEGMENTS_URL is set
+func SegmentsEnabled() bool {
+	return segmentsURL != ""
+}
+
+// ListSegments returns the segments of the fingerprints of catalog
+func ListSegments(ctx context.Context, catalog string) ([]SegmentInfo, error) {
+	index, err := segmentIndexFor(catalog)
+	if err != nil {
+		return nil, err
+	}
+	index.reload()
+	segments, err := index.live(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SegmentInfo, 0, len(segments))
+	for _, seg := range segments {
+		infos = append(infos, seg.info())
+	}
+	return infos, nil
+}
+
+// BuildSegment moves the fingerprints of the songs of catalog in db into a
+// new segment. The fingerprints of songs still being saved are left in db
+// for the next segment. They are deleted from db once every process had
+// SEGMENTS_REFRESH to find the segment, so recognitions keep finding them
+// meanwhile. It returns a zero SegmentInfo when there is nothing to move.
+func BuildSegment(ctx context.Context, db DBClient, catalog string) (SegmentInfo, error) {
+	index, err := segmentIndexFor(catalog)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	saved := make(map[uint32]bool, len(songs))
+	for _, song := range songs {
+		saved[song.ID] = true
+	}
+
+	var entries []segmentEntry
+	meta := segmentMeta{Created: time.Now().UTC(), Songs: map[uint32]int{}}
+	err = db.ForEachFingerprint(ctx, func(address uint32, couples []models.Couple) error {
+		for _, couple := range couples {
+			if saved[couple.SongID] {
+				entries = append(entries, segmentEntry{address, couple.SongID, couple.AnchorTimeMs})
+				meta.Songs[couple.SongID]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SegmentInfo{}, fmt.Errorf("error scanning fingerprints: %v", err)
+	}
+	if len(entries) == 0 {
+		return SegmentInfo{}, nil
+	}
+
+	info, err := index.upload(ctx, entries, meta)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	if err := waitForReaders(ctx); err != nil {
+		return info, err
+	}
+	for songID := range meta.Songs {
+		if err := db.DeleteFingerprintsBySongID(ctx, songID); err != nil {
+			return info, fmt.Errorf("error deleting fingerprints moved to segment %s: %v", info.Name, err)
+		}
+	}
+
+	return info, nil
+}
+
+// CompactSegments merges the segments of catalog into one, leaving out the
+// fingerprints of the songs db no longer has. The merged segments are
+// deleted once every process had SEGMENTS_REFRESH to find the new one. It
+// returns the new segment and the number of segments it replaced.
+func CompactSegments(ctx context.Context, db DBClient, catalog string) (SegmentInfo, int, error) {
+	index, err := segmentIndexFor(catalog)
+	if err != nil {
+		return SegmentInfo{}, 0, err
+	}
+	index.reload()
+	segments, err := index.live(ctx)
+	if err != nil {
+		return SegmentInfo{}, 0, err
+	}
+	if len(segments) == 0 {
+		return SegmentInfo{}, 0, nil
+	}
+
+	songs, err := db.ListSongs(ctx, 0, 0, SortByID)
+	if err != nil {
+		return SegmentInfo{}, 0, err
+	}
+	saved := make(map[uint32]bool, len(songs))
+	for _, song := range songs {
+		saved[song.ID] = true
+	}
+
+	var entries []segmentEntry
+	meta := segmentMeta{Created: time.Now().UTC(), Songs: map[uint32]int{}}
+	for _, seg := range segments {
+		segEntries, err := index.readEntries(ctx, seg)
+		if err != nil {
+			return SegmentInfo{}, 0, fmt.Errorf("error reading segment %s: %v", seg.name, err)
+		}
+		for _, entry := range segEntries {
+			if saved[entry.songID] {
+				entries = append(entries, entry)
+				meta.Songs[entry.songID]++
+			}
+		}
+		meta.Replaces = append(meta.Replaces, seg.name)
+	}
+
+	info, err := index.upload(ctx, entries, meta)
+	if err != nil {
+		return SegmentInfo{}, 0, err
+	}
+
+	if err := waitForReaders(ctx); err != nil {
+		return info, 0, err
+	}
+	for _, name := range meta.Replaces {
+		if err := index.store.Delete(ctx, name); err != nil {
+			return info, 0, fmt.Errorf("error deleting segment %s: %v", name, err)
+		}
+	}
+	index.reload()
+
+	return info, len(meta.Replaces), nil
+}
+
+// deleteSegments deletes every segment of the index
+func (x *segmentIndex) deleteSegments(ctx context.Context) error {
+	names, err := x.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := x.store.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	x.reload()
+	return nil
+}
+
+// segmentedDB looks fingerprints up in the segments of a catalog as well as
+// in the database, which keeps those of the songs saved since the last
+// segment was built. Deleted songs keep their couples in the segments until
+// they are compacted, and recognitions skip them.
+type segmentedDB struct {
+	DBClient
+	index *segmentIndex
+}
+
+func (db *segmentedDB) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples, err := db.DBClient.GetCouples(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+	found, err := db.index.lookup(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	for address, segmentCouples := range found {
+		if len(couples[address]) == 0 {
+			couples[address] = segmentCouples
+			continue
+		}
+		// While a segment is being built, its couples are in the database
+		// too, and they would count twice
+		seen := make(map[models.Couple]bool, len(couples[address]))
+		for _, couple := range couples[address] {
+			seen[couple] = true
+		}
+		for _, couple := range segmentCouples {
+			if !seen[couple] {
+				couples[address] = append(couples[address], couple)
+			}
+		}
+	}
+	return couples, nil
+}
+
+func (db *segmentedDB) TotalFingerprints(ctx context.Context) (int, error) {
+	total, err := db.DBClient.TotalFingerprints(ctx)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := db.index.live(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, seg := range segments {
+		total += seg.entries
+	}
+	return total, nil
+}
+
+func (db *segmentedDB) FingerprintCountBySong(ctx context.Context, songID uint32) (int, error) {
+	count, err := db.DBClient.FingerprintCountBySong(ctx, songID)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := db.index.live(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, seg := range segments {
+		count += seg.meta.Songs[songID]
+	}
+	return count, nil
+}
+
+// StorageSize adds the size of the segments to that of the database
+func (db *segmentedDB) StorageSize(ctx context.Context) (int64, error) {
+	size, err := db.DBClient.StorageSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := db.index.live(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, seg := range segments {
+		size += seg.size
+	}
+	return size, nil
+}
+
+// DeleteCollection deletes the segments along with the fingerprints
+func (db *segmentedDB) DeleteCollection(ctx context.Context, collectionName string) error {
+	if err := db.DBClient.DeleteCollection(ctx, collectionName); err != nil {
+		return err
+	}
+	if collectionName == "fingerprints" {
+		if err := db.index.deleteSegments(ctx); err != nil {
+			return fmt.Errorf("error deleting segments: %v", err)
+		}
+	}
+	return nil
+}
+
+// blockKey identifies a block of a segment
+type blockKey struct {
+	seg   *segment
+	block int
+}
+
+// blockCache is an LRU cache of segment blocks
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used
+	entries  map[blockKey]*list.Element
+}
+
+type blockCacheEntry struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[blockKey]*list.Element),
+	}
+}
+
+// resize changes the capacity of the cache, evicting the least recently
+// used blocks beyond it
+func (c *blockCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blockCacheEntry).key)
+	}
+}
+
+func (c *blockCache) has(key blockKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*blockCacheEntry).data, true
+}
+
+func (c *blockCache) add(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	// Blocks are sliced from larger reads, copying them lets those go
+	c.entries[key] = c.order.PushFront(&blockCacheEntry{key, bytes.Clone(data)})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blockCacheEntry).key)
+	}
+}
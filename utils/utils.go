@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"errors"
 	"math/rand"
-	"os"
+	"song-recognition/config"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,12 +16,8 @@ func GenerateUniqueID() uint32 {
 	return randomNumber
 }
 
-func GenerateSongKey(songTitle, songArtist string) string {
-	return songTitle + "---" + songArtist
-}
-
 func GetEnv(key string, fallback ...string) string {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := config.Lookup(key); ok {
 		return value
 	}
 
@@ -27,3 +26,42 @@ func GetEnv(key string, fallback ...string) string {
 	}
 	return ""
 }
+
+// intFromEnv returns the setting name as a positive integer, or fallback if
+// it isn't set or isn't one
+func intFromEnv(name string, fallback int) int {
+	n, err := strconv.Atoi(GetEnv(name, strconv.Itoa(fallback)))
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
+
+// durationFromEnv returns the setting name as a duration, or fallback if it
+// isn't set or isn't a positive one
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(GetEnv(name, fallback.String()))
+	if err != nil || d < 0 {
+		return fallback
+	}
+	return d
+}
+
+// runParallel calls fn with every index up to n, running up to limit calls
+// at a time, and returns the errors they returned
+func runParallel(n, limit int, fn func(i int) error) error {
+	errs := make([]error, n)
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
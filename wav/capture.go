@@ -0,0 +1,61 @@
+package wav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// captureChunkSamples is the number of samples Capture passes on at a time,
+// a tenth of a second
+const captureChunkSamples = CanonicalSampleRate / 10
+
+// Capture decodes the live audio FFmpeg reads with inputArgs, e.g. a
+// microphone or an internet radio stream, and calls onSamples with every
+// tenth of a second of it as mono samples at CanonicalSampleRate. It
+// returns when the input ends, FFmpeg fails or ctx is done.
+func Capture(ctx context.Context, inputArgs []string, onSamples func(samples []float64)) error {
+	args := append([]string{"-v", "error"}, inputArgs...)
+	args = append(args,
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"-ac", "1",
+		"-ar", fmt.Sprint(CanonicalSampleRate),
+		"pipe:1",
+	)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	buf := make([]byte, captureChunkSamples*2)
+	for {
+		n, err := io.ReadFull(stdout, buf)
+		// The last chunk may be cut in the middle of a sample
+		if n -= n % 2; n > 0 {
+			samples, _ := WavBytesToSamples(buf[:n])
+			onSamples(samples)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg stopped: %v, output %v", err, stderr.String())
+	}
+	return nil
+}
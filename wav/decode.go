@@ -0,0 +1,133 @@
+package wav
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// CanonicalSampleRate is the rate songs are fingerprinted at. FFmpeg
+// decodes straight to it, and audio at other rates is resampled to it
+// before fingerprinting.
+const CanonicalSampleRate = 44100
+
+// Format is an audio container format detected from a file's leading bytes
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatWAV
+	FormatMP3
+	FormatFLAC
+	FormatOGG
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatWAV:
+		return "wav"
+	case FormatMP3:
+		return "mp3"
+	case FormatFLAC:
+		return "flac"
+	case FormatOGG:
+		return "ogg"
+	default:
+		return "unknown"
+	}
+}
+
+// Audio holds decoded mono samples in the range [-1, 1]
+type Audio struct {
+	Samples    []float64
+	SampleRate int
+	Duration   float64
+}
+
+// DetectFormat sniffs the audio format from the first bytes of a file
+func DetectFormat(header []byte) Format {
+	switch {
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return FormatWAV
+	case len(header) >= 4 && string(header[:4]) == "fLaC":
+		return FormatFLAC
+	case len(header) >= 4 && string(header[:4]) == "OggS":
+		return FormatOGG
+	case len(header) >= 3 && string(header[:3]) == "ID3":
+		return FormatMP3
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync
+		return FormatMP3
+	default:
+		return FormatUnknown
+	}
+}
+
+func detectFileFormat(filePath string) (Format, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 12)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return FormatUnknown, err
+	}
+
+	return DetectFormat(header[:n]), nil
+}
+
+// DecodeFile decodes an audio file to mono samples. The decoder is chosen
+// from the file's magic bytes: 16-bit PCM WAV, FLAC and Ogg Vorbis are
+// decoded natively, while MP3 and any other format FFmpeg understands (or
+// a native decode failure, e.g. Opus in an Ogg container) are decoded to
+// 44.1kHz mono with FFmpeg. Use OpenStream for long files.
+func DecodeFile(filePath string) (*Audio, error) {
+	return DecodeFileContext(context.Background(), filePath)
+}
+
+// DecodeFileContext is DecodeFile, giving up with ctx's error once ctx is
+// done
+func DecodeFileContext(ctx context.Context, filePath string) (*Audio, error) {
+	stream, err := OpenStream(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	samples, err := stream.readAll(ctx)
+	if err != nil {
+		if !stream.native || ctx.Err() != nil {
+			return nil, err
+		}
+		return decodeWithFFmpeg(ctx, filePath)
+	}
+
+	return &Audio{
+		Samples:    samples,
+		SampleRate: stream.SampleRate,
+		Duration:   float64(len(samples)) / float64(stream.SampleRate),
+	}, nil
+}
+
+// decodeWithFFmpeg decodes filePath to raw 16-bit mono PCM through an FFmpeg pipe
+func decodeWithFFmpeg(ctx context.Context, filePath string) (*Audio, error) {
+	stream, err := openStream(filePath, openFFmpegDecoder)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	samples, err := stream.readAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Audio{
+		Samples:    samples,
+		SampleRate: CanonicalSampleRate,
+		Duration:   float64(len(samples)) / CanonicalSampleRate,
+	}, nil
+}
@@ -0,0 +1,539 @@
+package wav
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// flacStreamInfo holds the fields of the STREAMINFO block needed to decode frames
+type flacStreamInfo struct {
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  uint64
+}
+
+// bitReader reads big-endian bit fields from a byte slice. The first read
+// past the end of the data sets err, after which every read returns zero.
+type bitReader struct {
+	data []byte
+	pos  int // bit offset
+	err  error
+}
+
+func (br *bitReader) read(n uint) uint64 {
+	if br.err != nil {
+		return 0
+	}
+	if br.pos+int(n) > len(br.data)*8 {
+		br.err = io.ErrUnexpectedEOF
+		return 0
+	}
+
+	var v uint64
+	for n > 0 {
+		offset := uint(br.pos & 7)
+		take := 8 - offset
+		if n < take {
+			take = n
+		}
+		bits := uint64(br.data[br.pos>>3]>>(8-offset-take)) & (1<<take - 1)
+		v = v<<take | bits
+		br.pos += int(take)
+		n -= take
+	}
+	return v
+}
+
+// readSigned reads an n-bit two's complement value
+func (br *bitReader) readSigned(n uint) int64 {
+	v := br.read(n)
+	if n > 0 && v&(1<<(n-1)) != 0 {
+		return int64(v) - int64(1)<<n
+	}
+	return int64(v)
+}
+
+// readUnary counts zero bits up to and including the next one bit
+func (br *bitReader) readUnary() uint64 {
+	var n uint64
+	for br.err == nil {
+		if br.pos >= len(br.data)*8 {
+			br.err = io.ErrUnexpectedEOF
+			break
+		}
+		if br.pos&7 == 0 && br.data[br.pos>>3] == 0 {
+			n += 8
+			br.pos += 8
+			continue
+		}
+		if br.read(1) == 1 {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func (br *bitReader) alignByte() {
+	br.pos = (br.pos + 7) &^ 7
+}
+
+func (br *bitReader) remaining() int {
+	return len(br.data)*8 - br.pos
+}
+
+// flacMaxBlockSize is the largest number of samples a FLAC frame can hold
+const flacMaxBlockSize = 1 << 16
+
+// flacDecoder decodes a FLAC file a few frames at a time. Frames are read
+// from a buffer that is topped up from the file before each frame, so it
+// always holds the largest frame the stream can have.
+type flacDecoder struct {
+	file *os.File
+	info *flacStreamInfo
+	br   *bitReader
+	buf  []byte
+	// maxFrameSize bounds the size of a frame in bytes
+	maxFrameSize int
+	// eof is set once the whole file was read into buf
+	eof     bool
+	decoded uint64
+	done    bool
+}
+
+func openFLACDecoder(filePath string) (decoder, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(file, marker); err != nil || string(marker) != "fLaC" {
+		file.Close()
+		return nil, 0, errors.New("invalid FLAC stream")
+	}
+
+	info, err := readFLACMetadata(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	// A frame never takes more room than its samples stored verbatim, with
+	// an extra bit for side channels, plus its headers
+	maxFrameSize := flacMaxBlockSize*info.channels*(info.bitsPerSample+1)/8 + 1024
+	d := &flacDecoder{
+		file:         file,
+		info:         info,
+		buf:          make([]byte, 2*maxFrameSize),
+		maxFrameSize: maxFrameSize,
+	}
+	d.br = &bitReader{data: d.buf[:0]}
+	return d, info.sampleRate, nil
+}
+
+// fill moves the unread bytes to the start of the buffer and tops it up
+// from the file
+func (d *flacDecoder) fill() error {
+	if d.eof {
+		return nil
+	}
+
+	consumed := d.br.pos >> 3
+	n := copy(d.buf, d.br.data[consumed:])
+	d.br.pos -= consumed * 8
+
+	m, err := io.ReadFull(d.file, d.buf[n:])
+	d.br.data = d.buf[:n+m]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.eof = true
+		return nil
+	}
+	return err
+}
+
+func (d *flacDecoder) next() ([]float64, error) {
+	var samples []float64
+	for !d.done && len(samples) < streamChunkSamples {
+		if d.br.remaining() < d.maxFrameSize*8 {
+			if err := d.fill(); err != nil {
+				return nil, err
+			}
+		}
+
+		decoded := d.decoded + uint64(len(samples))
+		switch {
+		case d.info.totalSamples > 0 && decoded >= d.info.totalSamples:
+			d.done = true
+		// A stream cut between frames decodes up to the cut, while a frame
+		// cut short fails to decode below
+		case d.br.remaining() == 0:
+			d.done = true
+		// Anything after the last frame (such as an ID3v1 tag) isn't audio
+		case d.br.data[d.br.pos>>3] != 0xFF && decoded > 0:
+			d.done = true
+		default:
+			var err error
+			samples, err = decodeFLACFrame(d.br, d.info, samples)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.decoded += uint64(len(samples))
+
+	if len(samples) > 0 {
+		return samples, nil
+	}
+	if d.decoded == 0 {
+		return nil, errors.New("FLAC stream has no audio frames")
+	}
+	return nil, io.EOF
+}
+
+func (d *flacDecoder) Close() error {
+	return d.file.Close()
+}
+
+// readFLACMetadata reads the metadata blocks up to the first frame and
+// returns the stream info. Blocks other than the stream info, such as
+// cover art, are skipped.
+func readFLACMetadata(r io.ReadSeeker) (*flacStreamInfo, error) {
+	var info *flacStreamInfo
+
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("error reading FLAC metadata: %v", err)
+		}
+		br := &bitReader{data: header}
+		last := br.read(1) == 1
+		blockType := br.read(7)
+		length := int64(br.read(24))
+
+		if blockType == 0 {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errors.New("error reading FLAC metadata: truncated block")
+			}
+
+			block := &bitReader{data: data}
+			block.read(16) // min block size
+			block.read(16) // max block size
+			block.read(24) // min frame size
+			block.read(24) // max frame size
+			info = &flacStreamInfo{
+				sampleRate:    int(block.read(20)),
+				channels:      int(block.read(3)) + 1,
+				bitsPerSample: int(block.read(5)) + 1,
+				totalSamples:  block.read(36),
+			}
+			if block.err != nil || info.sampleRate == 0 {
+				return nil, errors.New("invalid FLAC STREAMINFO block")
+			}
+		} else if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("error reading FLAC metadata: %v", err)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if info == nil {
+		return nil, errors.New("FLAC stream has no STREAMINFO block")
+	}
+
+	return info, nil
+}
+
+// decodeFLACFrame decodes one frame, appends its samples downmixed to mono
+// and returns the extended slice
+func decodeFLACFrame(br *bitReader, info *flacStreamInfo, samples []float64) ([]float64, error) {
+	if sync := br.read(14); sync != 0x3FFE {
+		return nil, errors.New("invalid FLAC frame sync code")
+	}
+	br.read(1) // reserved
+	br.read(1) // blocking strategy
+
+	blockSizeCode := br.read(4)
+	sampleRateCode := br.read(4)
+	channelAssignment := br.read(4)
+	sampleSizeCode := br.read(3)
+	br.read(1) // reserved
+
+	// Frame or sample number, UTF-8 coded
+	first := br.read(8)
+	for mask := uint64(0x40); first&0x80 != 0 && first&mask != 0 && mask > 1; mask >>= 1 {
+		br.read(8)
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		blockSize = int(br.read(8)) + 1
+	case blockSizeCode == 7:
+		blockSize = int(br.read(16)) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return nil, errors.New("reserved FLAC block size")
+	}
+
+	// Only consume the bits; the stream info sample rate is used for the whole file
+	switch sampleRateCode {
+	case 12:
+		br.read(8)
+	case 13, 14:
+		br.read(16)
+	case 15:
+		return nil, errors.New("invalid FLAC sample rate")
+	}
+
+	bitsPerSample := [8]int{info.bitsPerSample, 8, 12, 0, 16, 20, 24, 32}[sampleSizeCode]
+	if bitsPerSample == 0 {
+		return nil, errors.New("reserved FLAC sample size")
+	}
+
+	var channels int
+	switch {
+	case channelAssignment < 8:
+		channels = int(channelAssignment) + 1
+	case channelAssignment <= 10:
+		channels = 2
+	default:
+		return nil, errors.New("reserved FLAC channel assignment")
+	}
+
+	br.read(8) // CRC-8
+	if br.err != nil {
+		return nil, fmt.Errorf("error reading FLAC frame header: %v", br.err)
+	}
+
+	subframes := make([][]int64, channels)
+	for ch := range subframes {
+		// The side channel of a stereo pair needs one extra bit
+		sideChannel := (channelAssignment == 8 && ch == 1) ||
+			(channelAssignment == 9 && ch == 0) ||
+			(channelAssignment == 10 && ch == 1)
+
+		subframeBits := uint(bitsPerSample)
+		if sideChannel {
+			subframeBits++
+		}
+
+		subframe, err := decodeFLACSubframe(br, blockSize, subframeBits)
+		if err != nil {
+			return nil, err
+		}
+		subframes[ch] = subframe
+	}
+
+	br.alignByte()
+	br.read(16) // CRC-16
+	if br.err != nil {
+		return nil, fmt.Errorf("error reading FLAC frame: %v", br.err)
+	}
+
+	switch channelAssignment {
+	case 8: // left/side
+		for i := range subframes[1] {
+			subframes[1][i] = subframes[0][i] - subframes[1][i]
+		}
+	case 9: // side/right
+		for i := range subframes[0] {
+			subframes[0][i] += subframes[1][i]
+		}
+	case 10: // mid/side
+		for i := range subframes[0] {
+			side := subframes[1][i]
+			mid := subframes[0][i]<<1 | side&1
+			subframes[0][i] = (mid + side) >> 1
+			subframes[1][i] = (mid - side) >> 1
+		}
+	}
+
+	scale := float64(int64(1)<<(bitsPerSample-1)) * float64(channels)
+	for i := 0; i < blockSize; i++ {
+		var sum int64
+		for ch := range subframes {
+			sum += subframes[ch][i]
+		}
+		samples = append(samples, float64(sum)/scale)
+	}
+
+	return samples, nil
+}
+
+func decodeFLACSubframe(br *bitReader, blockSize int, bitsPerSample uint) ([]int64, error) {
+	br.read(1) // zero padding
+	subframeType := br.read(6)
+
+	var wastedBits uint
+	if br.read(1) == 1 {
+		wastedBits = uint(br.readUnary()) + 1
+	}
+	if wastedBits >= bitsPerSample {
+		return nil, errors.New("invalid FLAC wasted bits")
+	}
+	bitsPerSample -= wastedBits
+
+	samples := make([]int64, blockSize)
+	var err error
+
+	switch {
+	case subframeType == 0: // constant
+		value := br.readSigned(bitsPerSample)
+		for i := range samples {
+			samples[i] = value
+		}
+	case subframeType == 1: // verbatim
+		for i := range samples {
+			samples[i] = br.readSigned(bitsPerSample)
+		}
+	case subframeType >= 8 && subframeType <= 12:
+		err = decodeFLACFixed(br, samples, int(subframeType-8), bitsPerSample)
+	case subframeType >= 32:
+		err = decodeFLACLPC(br, samples, int(subframeType-31), bitsPerSample)
+	default:
+		return nil, fmt.Errorf("reserved FLAC subframe type %d", subframeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("error reading FLAC subframe: %v", br.err)
+	}
+
+	if wastedBits > 0 {
+		for i := range samples {
+			samples[i] <<= wastedBits
+		}
+	}
+
+	return samples, nil
+}
+
+func decodeFLACFixed(br *bitReader, samples []int64, order int, bitsPerSample uint) error {
+	if order > len(samples) {
+		return errors.New("invalid FLAC predictor order")
+	}
+
+	for i := 0; i < order; i++ {
+		samples[i] = br.readSigned(bitsPerSample)
+	}
+
+	if err := decodeFLACResidual(br, samples, order); err != nil {
+		return err
+	}
+
+	for i := order; i < len(samples); i++ {
+		switch order {
+		case 1:
+			samples[i] += samples[i-1]
+		case 2:
+			samples[i] += 2*samples[i-1] - samples[i-2]
+		case 3:
+			samples[i] += 3*samples[i-1] - 3*samples[i-2] + samples[i-3]
+		case 4:
+			samples[i] += 4*samples[i-1] - 6*samples[i-2] + 4*samples[i-3] - samples[i-4]
+		}
+	}
+
+	return nil
+}
+
+func decodeFLACLPC(br *bitReader, samples []int64, order int, bitsPerSample uint) error {
+	if order > len(samples) {
+		return errors.New("invalid FLAC predictor order")
+	}
+
+	for i := 0; i < order; i++ {
+		samples[i] = br.readSigned(bitsPerSample)
+	}
+
+	precision := br.read(4)
+	if precision == 15 {
+		return errors.New("invalid FLAC LPC precision")
+	}
+	precision++
+
+	shift := br.readSigned(5)
+	if shift < 0 {
+		return errors.New("negative FLAC LPC shift")
+	}
+
+	coefficients := make([]int64, order)
+	for i := range coefficients {
+		coefficients[i] = br.readSigned(uint(precision))
+	}
+
+	if err := decodeFLACResidual(br, samples, order); err != nil {
+		return err
+	}
+
+	for i := order; i < len(samples); i++ {
+		var prediction int64
+		for j, c := range coefficients {
+			prediction += c * samples[i-1-j]
+		}
+		samples[i] += prediction >> uint(shift)
+	}
+
+	return nil
+}
+
+// decodeFLACResidual reads the Rice-coded residual into samples[order:]
+func decodeFLACResidual(br *bitReader, samples []int64, order int) error {
+	method := br.read(2)
+	if method > 1 {
+		return errors.New("reserved FLAC residual coding method")
+	}
+
+	paramBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+
+	partitionOrder := br.read(4)
+	partitions := 1 << partitionOrder
+	partitionSize := len(samples) >> partitionOrder
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		count := partitionSize
+		if p == 0 {
+			count -= order
+		}
+		if count < 0 || i+count > len(samples) {
+			return errors.New("invalid FLAC residual partition")
+		}
+
+		param := br.read(paramBits)
+		if param == escape {
+			bits := uint(br.read(5))
+			for end := i + count; i < end; i++ {
+				samples[i] = br.readSigned(bits)
+			}
+			continue
+		}
+
+		for end := i + count; i < end; i++ {
+			u := br.readUnary()<<param | br.read(uint(param))
+			samples[i] = int64(u>>1) ^ -int64(u&1)
+		}
+
+		if br.err != nil {
+			return fmt.Errorf("error reading FLAC residual: %v", br.err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,513 @@
+package wav
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flacBitWriter writes big-endian bit fields, the way bitReader reads them
+type flacBitWriter struct {
+	data  []byte
+	nbits int
+}
+
+func (w *flacBitWriter) write(v uint64, n uint) {
+	for ; n > 0; n-- {
+		if w.nbits&7 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>(n-1)&1) << (7 - w.nbits&7)
+		w.nbits++
+	}
+}
+
+func (w *flacBitWriter) writeSigned(v int64, n uint) {
+	w.write(uint64(v)&(1<<n-1), n)
+}
+
+func (w *flacBitWriter) align() {
+	for w.nbits&7 != 0 {
+		w.write(0, 1)
+	}
+}
+
+// flacFrameHeader holds the coded fields of a frame header
+type flacFrameHeader struct {
+	blockSizeCode, sampleRateCode, assignment, sampleSizeCode uint64
+	blockSize                                                 int
+}
+
+// newFLACFrameHeader returns the header of a frame of blockSize samples,
+// with the smallest block size code that can hold it
+func newFLACFrameHeader(blockSize int, assignment uint64) flacFrameHeader {
+	header := flacFrameHeader{blockSizeCode: 7, assignment: assignment, blockSize: blockSize}
+	codes := map[int]uint64{192: 1, 576: 2, 1152: 3, 2304: 4, 4608: 5, 256: 8, 512: 9, 1024: 10, 2048: 11, 4096: 12}
+	if code, ok := codes[blockSize]; ok {
+		header.blockSizeCode = code
+	} else if blockSize <= 256 {
+		header.blockSizeCode = 6
+	}
+	return header
+}
+
+func (h flacFrameHeader) write(w *flacBitWriter, frameNumber int) {
+	w.write(0x3FFE, 14)
+	w.write(0, 2) // reserved, fixed blocking
+	w.write(h.blockSizeCode, 4)
+	w.write(h.sampleRateCode, 4)
+	w.write(h.assignment, 4)
+	w.write(h.sampleSizeCode, 3)
+	w.write(0, 1)
+	w.write(uint64(frameNumber), 8)
+	switch h.blockSizeCode {
+	case 6:
+		w.write(uint64(h.blockSize-1), 8)
+	case 7:
+		w.write(uint64(h.blockSize-1), 16)
+	}
+	w.write(0, 8) // CRC-8, which the decoder doesn't check
+}
+
+// flacSubframeEncoder writes samples, each of bits bits, as a subframe
+type flacSubframeEncoder func(w *flacBitWriter, samples []int64, bits uint)
+
+func constantSubframe(w *flacBitWriter, samples []int64, bits uint) {
+	w.write(0<<1, 8)
+	w.writeSigned(samples[0], bits)
+}
+
+func verbatimSubframe(w *flacBitWriter, samples []int64, bits uint) {
+	w.write(1<<1, 8)
+	for _, sample := range samples {
+		w.writeSigned(sample, bits)
+	}
+}
+
+// wastedBitSubframe writes even samples verbatim, without their low bit
+func wastedBitSubframe(w *flacBitWriter, samples []int64, bits uint) {
+	w.write(1<<1|1, 8)
+	w.write(1, 1) // unary coded wasted bits - 1
+	for _, sample := range samples {
+		w.writeSigned(sample>>1, bits-1)
+	}
+}
+
+var flacFixedCoefficients = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+func fixedSubframe(order int) flacSubframeEncoder {
+	return func(w *flacBitWriter, samples []int64, bits uint) {
+		w.write(uint64(8+order)<<1, 8)
+		for _, sample := range samples[:order] {
+			w.writeSigned(sample, bits)
+		}
+
+		residual := make([]int64, len(samples))
+		for i := order; i < len(samples); i++ {
+			residual[i] = samples[i]
+			for j, c := range flacFixedCoefficients[order] {
+				residual[i] -= c * samples[i-1-j]
+			}
+		}
+		writeFLACResidual(w, residual, order)
+	}
+}
+
+// lpcSubframe writes samples with the second order predictor of the fixed
+// subframes, coded as 4-bit coefficients of twice the size and a shift of 1
+func lpcSubframe(w *flacBitWriter, samples []int64, bits uint) {
+	w.write(uint64(32+2-1)<<1, 8)
+	for _, sample := range samples[:2] {
+		w.writeSigned(sample, bits)
+	}
+	w.write(4-1, 4)     // precision - 1
+	w.writeSigned(1, 5) // shift
+	w.writeSigned(4, 4)
+	w.writeSigned(-2, 4)
+
+	residual := make([]int64, len(samples))
+	for i := 2; i < len(samples); i++ {
+		residual[i] = samples[i] - (4*samples[i-1]-2*samples[i-2])>>1
+	}
+	writeFLACResidual(w, residual, 2)
+}
+
+// writeFLACResidual writes residual[order:] in four Rice partitions, the
+// second of which is escaped to fixed-size values
+func writeFLACResidual(w *flacBitWriter, residual []int64, order int) {
+	const partitionOrder, param, escapeBits = 2, 6, 24
+	w.write(0, 2) // 4-bit Rice parameters
+	w.write(partitionOrder, 4)
+
+	partitionSize := len(residual) >> partitionOrder
+	for p := 0; p < 1<<partitionOrder; p++ {
+		start := p * partitionSize
+		if p == 0 {
+			start = order
+		}
+		values := residual[start : (p+1)*partitionSize]
+
+		if p == 1 {
+			w.write(15, 4)
+			w.write(escapeBits, 5)
+			for _, r := range values {
+				w.writeSigned(r, escapeBits)
+			}
+			continue
+		}
+
+		w.write(param, 4)
+		for _, r := range values {
+			u := uint64(r<<1 ^ r>>63)
+			for q := u >> param; q > 0; q-- {
+				w.write(0, 1)
+			}
+			w.write(1, 1)
+			w.write(u, param)
+		}
+	}
+}
+
+// testFLAC is a 16-bit FLAC stream coded from left (and right, unless the
+// stream is mono) channel samples
+type testFLAC struct {
+	data []byte
+	// metadataEnd is the offset of the first frame in data
+	metadataEnd int
+	// frameEnds are the offsets of the ends of the frames in data
+	frameEnds []int
+	// samples are the mono samples the stream decodes to
+	samples []float64
+}
+
+const testFLACBits = 16
+
+// encodeTestFLAC codes left and right into frames of blockSizes samples,
+// with their channels stored as assignment says
+func encodeTestFLAC(left, right []int64, blockSizes []int, assignment uint64, encode flacSubframeEncoder) testFLAC {
+	channels := 1
+	if right != nil {
+		channels = 2
+	}
+
+	var stream testFLAC
+	w := &flacBitWriter{}
+	w.data = append(w.data, "fLaC"...)
+	w.nbits = len(w.data) * 8
+
+	// Padding ahead of the stream info, which the decoder skips
+	w.write(1, 8)
+	w.write(3, 24)
+	w.write(0, 24)
+
+	w.write(1<<7, 8) // last block, STREAMINFO
+	w.write(34, 24)
+	w.write(uint64(blockSizes[0]), 16)
+	w.write(uint64(blockSizes[0]), 16)
+	w.write(0, 48) // frame sizes
+	w.write(44100, 20)
+	w.write(uint64(channels-1), 3)
+	w.write(testFLACBits-1, 5)
+	w.write(uint64(len(left)), 36)
+	w.write(0, 64)
+	w.write(0, 64) // MD5
+
+	stream.metadataEnd = len(w.data)
+	start := 0
+	for frame, blockSize := range blockSizes {
+		l := left[start : start+blockSize]
+		newFLACFrameHeader(blockSize, assignment).write(w, frame)
+
+		if channels == 1 {
+			encode(w, l, testFLACBits)
+		} else {
+			r := right[start : start+blockSize]
+			side := make([]int64, blockSize)
+			mid := make([]int64, blockSize)
+			for i := range side {
+				side[i] = l[i] - r[i]
+				mid[i] = (l[i] + r[i]) >> 1
+			}
+
+			switch assignment {
+			case 8: // left/side
+				encode(w, l, testFLACBits)
+				encode(w, side, testFLACBits+1)
+			case 9: // side/right
+				encode(w, side, testFLACBits+1)
+				encode(w, r, testFLACBits)
+			case 10: // mid/side
+				encode(w, mid, testFLACBits)
+				encode(w, side, testFLACBits+1)
+			default:
+				encode(w, l, testFLACBits)
+				encode(w, r, testFLACBits)
+			}
+		}
+
+		w.align()
+		w.write(0, 16) // CRC-16
+		stream.frameEnds = append(stream.frameEnds, len(w.data))
+		start += blockSize
+	}
+
+	scale := float64(int64(1)<<(testFLACBits-1)) * float64(channels)
+	for i := range left {
+		sum := left[i]
+		if right != nil {
+			sum += right[i]
+		}
+		stream.samples = append(stream.samples, float64(sum)/scale)
+	}
+
+	stream.data = w.data
+	return stream
+}
+
+// testTone returns n samples of a sine wave with the given period, rounded
+// to a multiple of step
+func testTone(n int, amplitude, period, phase float64, step int64) []int64 {
+	samples := make([]int64, n)
+	for i := range samples {
+		v := amplitude * math.Sin(2*math.Pi*float64(i)/period+phase)
+		samples[i] = int64(math.Round(v/float64(step))) * step
+	}
+	return samples
+}
+
+// decodeTestFLAC decodes data with the FLAC decoder, through a file
+func decodeTestFLAC(tb testing.TB, data []byte) ([]float64, error) {
+	filePath := filepath.Join(tb.TempDir(), "audio.flac")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	dec, _, err := openFLACDecoder(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	var samples []float64
+	for {
+		chunk, err := dec.next()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, chunk...)
+	}
+}
+
+func equalSamples(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeFLAC(t *testing.T) {
+	blockSizes := []int{4096, 1152, 100}
+	n := 4096 + 1152 + 100
+	left := testTone(n, 12000, 37, 0, 1)
+	right := testTone(n, 8000, 53, 1, 1)
+
+	constant := func(value int64) []int64 {
+		samples := make([]int64, n)
+		for i := range samples {
+			samples[i] = value
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name        string
+		left, right []int64
+		assignment  uint64
+		encode      flacSubframeEncoder
+	}{
+		{"mono, verbatim", left, nil, 0, verbatimSubframe},
+		{"mono, constant", constant(-1234), nil, 0, constantSubframe},
+		{"mono, wasted bit", testTone(n, 12000, 37, 0, 2), nil, 0, wastedBitSubframe},
+		{"mono, fixed order 0", left, nil, 0, fixedSubframe(0)},
+		{"mono, fixed order 1", left, nil, 0, fixedSubframe(1)},
+		{"mono, fixed order 2", left, nil, 0, fixedSubframe(2)},
+		{"mono, fixed order 3", left, nil, 0, fixedSubframe(3)},
+		{"mono, fixed order 4", left, nil, 0, fixedSubframe(4)},
+		{"mono, LPC", left, nil, 0, lpcSubframe},
+		{"stereo, independent", left, right, 1, fixedSubframe(2)},
+		{"stereo, left/side", left, right, 8, fixedSubframe(2)},
+		{"stereo, side/right", left, right, 9, lpcSubframe},
+		{"stereo, mid/side", left, right, 10, verbatimSubframe},
+		{"stereo, mid/side of odd sums", constant(1001), constant(-32768), 10, constantSubframe},
+	}
+
+	for _, test := range tests {
+		stream := encodeTestFLAC(test.left, test.right, blockSizes, test.assignment, test.encode)
+		samples, err := decodeTestFLAC(t, stream.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !equalSamples(samples, stream.samples) {
+			t.Errorf("%s: decoded samples differ from the PCM the stream was coded from", test.name)
+		}
+	}
+}
+
+func TestDecodeFLACTruncated(t *testing.T) {
+	left := testTone(1000, 12000, 37, 0, 1)
+	right := testTone(1000, 8000, 53, 1, 1)
+	stream := encodeTestFLAC(left, right, []int{256, 256, 256, 232}, 10, fixedSubframe(2))
+
+	frameEnds := map[int]int{}
+	for i, end := range stream.frameEnds {
+		frameEnds[end] = (i + 1) * 256
+	}
+
+	for size := 0; size < len(stream.data); size++ {
+		samples, err := decodeTestFLAC(t, stream.data[:size])
+
+		// Streams cut between frames decode up to the cut
+		if n, ok := frameEnds[size]; ok {
+			if err != nil {
+				t.Errorf("stream cut after %d samples: %v", n, err)
+			} else if !equalSamples(samples, stream.samples[:n]) {
+				t.Errorf("stream cut after %d samples decoded %d samples", n, len(samples))
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("stream cut to %d of %d bytes decoded without an error", size, len(stream.data))
+		}
+	}
+}
+
+func TestDecodeFLACCorrupt(t *testing.T) {
+	header := newFLACFrameHeader(8, 0)
+	withHeader := func(change func(h *flacFrameHeader)) flacFrameHeader {
+		h := header
+		change(&h)
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		header flacFrameHeader
+		// subframe writes the subframe following header
+		subframe func(w *flacBitWriter)
+	}{
+		{"reserved block size", withHeader(func(h *flacFrameHeader) { h.blockSizeCode = 0 }), nil},
+		{"invalid sample rate", withHeader(func(h *flacFrameHeader) { h.sampleRateCode = 15 }), nil},
+		{"reserved sample size", withHeader(func(h *flacFrameHeader) { h.sampleSizeCode = 3 }), nil},
+		{"reserved channel assignment", withHeader(func(h *flacFrameHeader) { h.assignment = 11 }), nil},
+		{"reserved subframe type", header, func(w *flacBitWriter) {
+			w.write(2<<1, 8)
+		}},
+		{"as many wasted bits as sample bits", header, func(w *flacBitWriter) {
+			w.write(1<<1|1, 8)
+			w.write(1, 16)
+		}},
+		{"fixed predictor order over the block size", newFLACFrameHeader(2, 0), func(w *flacBitWriter) {
+			w.write(12<<1, 8)
+		}},
+		{"LPC order over the block size", header, func(w *flacBitWriter) {
+			w.write(uint64(32+9-1)<<1, 8)
+		}},
+		{"invalid LPC precision", header, func(w *flacBitWriter) {
+			w.write(32<<1, 8)
+			w.write(0, 16)
+			w.write(15, 4)
+		}},
+		{"negative LPC shift", header, func(w *flacBitWriter) {
+			w.write(32<<1, 8)
+			w.write(0, 16)
+			w.write(3, 4)
+			w.writeSigned(-1, 5)
+		}},
+		{"reserved residual coding method", header, func(w *flacBitWriter) {
+			w.write(8<<1, 8)
+			w.write(2, 2)
+		}},
+		{"residual partitions shorter than the predictor order", header, func(w *flacBitWriter) {
+			w.write(12<<1, 8)
+			w.write(0, 64)
+			w.write(0, 2)
+			w.write(2, 4)
+		}},
+		{"more residual partitions than samples", header, func(w *flacBitWriter) {
+			w.write(8<<1, 8)
+			w.write(0, 2)
+			w.write(15, 4)
+			w.write(0, 64)
+		}},
+	}
+
+	valid := encodeTestFLAC(make([]int64, 8), nil, []int{8}, 0, verbatimSubframe)
+	metadataEnd := valid.metadataEnd
+
+	for _, test := range tests {
+		w := &flacBitWriter{data: append([]byte(nil), valid.data[:metadataEnd]...)}
+		w.nbits = len(w.data) * 8
+		test.header.write(w, 0)
+		if test.subframe != nil {
+			test.subframe(w)
+		}
+		// Enough zero bits that the frame doesn't end before the error
+		w.align()
+		w.data = append(w.data, make([]byte, 64)...)
+
+		if samples, err := decodeTestFLAC(t, w.data); err == nil {
+			t.Errorf("%s: decoded %d samples without an error", test.name, len(samples))
+		}
+	}
+
+	if _, err := decodeTestFLAC(t, valid.data); err != nil {
+		t.Errorf("valid stream: %v", err)
+	}
+	if _, err := decodeTestFLAC(t, valid.data[:metadataEnd]); err == nil {
+		t.Error("stream without frames decoded without an error")
+	}
+	if _, err := decodeTestFLAC(t, []byte("fLaC")); err == nil {
+		t.Error("stream without metadata decoded without an error")
+	}
+}
+
+func FuzzDecodeFLAC(f *testing.F) {
+	left := testTone(600, 12000, 37, 0, 2)
+	right := testTone(600, 8000, 53, 1, 2)
+	encodings := []struct {
+		assignment uint64
+		encode     flacSubframeEncoder
+	}{
+		{10, fixedSubframe(2)},
+		{8, lpcSubframe},
+		{1, wastedBitSubframe},
+	}
+	for _, encoding := range encodings {
+		stream := encodeTestFLAC(left, right, []int{256, 256, 88}, encoding.assignment, encoding.encode)
+		f.Add(stream.data)
+		f.Add(stream.data[:len(stream.data)-1])
+		f.Add(stream.data[:stream.frameEnds[0]+10])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Errors are expected; out of range reads panic
+		samples, err := decodeTestFLAC(t, data)
+		if err != nil {
+			return
+		}
+		for i, sample := range samples {
+			if math.IsNaN(sample) || math.IsInf(sample, 0) {
+				t.Fatalf("sample %d is %v", i, sample)
+			}
+		}
+	})
+}
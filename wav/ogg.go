@@ -0,0 +1,91 @@
+package wav
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// oggDecoder decodes an Ogg Vorbis file a chunk of samples at a time
+type oggDecoder struct {
+	file   *os.File
+	reader *oggvorbis.Reader
+	buf    []float32
+	// remaining is the number of samples left when the length of the
+	// stream is known, -1 otherwise
+	remaining int64
+	done      bool
+}
+
+func openOggDecoder(filePath string) (decoder, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader, err := oggvorbis.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if reader.Channels() < 1 || reader.SampleRate() < 1 {
+		file.Close()
+		return nil, 0, errors.New("invalid Ogg Vorbis format")
+	}
+
+	d := &oggDecoder{
+		file:      file,
+		reader:    reader,
+		buf:       make([]float32, streamChunkSamples*reader.Channels()),
+		remaining: -1,
+	}
+	if reader.Length() > 0 {
+		d.remaining = reader.Length() - reader.Position()
+	}
+	return d, reader.SampleRate(), nil
+}
+
+func (d *oggDecoder) next() ([]float64, error) {
+	if d.done || d.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	channels := d.reader.Channels()
+	buf := d.buf
+	if d.remaining > 0 && int64(len(buf)) > d.remaining*int64(channels) {
+		buf = buf[:d.remaining*int64(channels)]
+	}
+
+	n, err := d.reader.Read(buf)
+	switch {
+	case err == io.EOF:
+		d.done = true
+	case err != nil:
+		return nil, err
+	case n == 0:
+		return nil, io.ErrNoProgress
+	}
+
+	samples := make([]float64, n/channels)
+	for i := range samples {
+		var sum float64
+		for ch := 0; ch < channels; ch++ {
+			sum += float64(buf[i*channels+ch])
+		}
+		samples[i] = sum / float64(channels)
+	}
+	if d.remaining > 0 {
+		d.remaining -= int64(len(samples))
+	}
+
+	if len(samples) == 0 {
+		return nil, io.EOF
+	}
+	return samples, nil
+}
+
+func (d *oggDecoder) Close() error {
+	return d.file.Close()
+}
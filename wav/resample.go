@@ -0,0 +1,156 @@
+package wav
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	// resampleZeroCrossings is the number of sinc zero crossings on each side
+	// of the resampling kernel. More give a sharper anti-aliasing filter at
+	// the cost of speed.
+	resampleZeroCrossings = 16
+	// resampleRolloff places the filter cutoff just below the Nyquist
+	// frequency, leaving room for the window's transition band
+	resampleRolloff = 0.95
+)
+
+// Resample converts samples from fromRate to toRate with a Blackman-windowed
+// sinc filter. When downsampling, the filter cutoff follows the new Nyquist
+// frequency so the frequencies that can't be represented are removed
+// instead of aliasing into the ones that can.
+func Resample(samples []float64, fromRate, toRate int) ([]float64, error) {
+	if fromRate <= 0 || toRate <= 0 {
+		return nil, errors.New("sample rates must be positive")
+	}
+	if fromRate == toRate {
+		return samples, nil
+	}
+
+	ratio := float64(toRate) / float64(fromRate)
+	cutoff := resampleRolloff * math.Min(1, ratio) // as a fraction of the input Nyquist frequency
+	halfWidth := resampleZeroCrossings / cutoff    // in input samples
+
+	out := make([]float64, int(float64(len(samples))*ratio))
+	interpolateRange(out, 0, samples, 0, ratio, cutoff, halfWidth)
+	return out, nil
+}
+
+// interpolateRange sets out to the output samples from first on, from the
+// input samples starting at start. Output samples are independent, so they
+// are computed in contiguous chunks concurrently.
+func interpolateRange(out []float64, first int, samples []float64, start int, ratio, cutoff, halfWidth float64) {
+	workers := runtime.NumCPU()
+	chunkSize := (len(out) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(out); lo += chunkSize {
+		hi := lo + chunkSize
+		if hi > len(out) {
+			hi = len(out)
+		}
+
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for n := lo; n < hi; n++ {
+				out[n] = interpolate(samples, start, float64(first+n)/ratio, cutoff, halfWidth)
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+}
+
+// Resampler resamples audio passed to it a chunk at a time, to the same
+// samples Resample returns for the whole of it, holding only the input
+// samples the filter still spans
+type Resampler struct {
+	ratio, cutoff, halfWidth float64
+	// total and outTotal are the numbers of input and output samples
+	total, outTotal int
+	// in holds the input samples received from the start-th on
+	in    []float64
+	start int
+	next  int // index of the next output sample
+}
+
+// NewResampler returns a Resampler from fromRate to toRate of total input
+// samples
+func NewResampler(fromRate, toRate, total int) (*Resampler, error) {
+	if fromRate <= 0 || toRate <= 0 {
+		return nil, errors.New("sample rates must be positive")
+	}
+
+	ratio := float64(toRate) / float64(fromRate)
+	cutoff := resampleRolloff * math.Min(1, ratio)
+	return &Resampler{
+		ratio:     ratio,
+		cutoff:    cutoff,
+		halfWidth: resampleZeroCrossings / cutoff,
+		total:     total,
+		outTotal:  int(float64(total) * ratio),
+	}, nil
+}
+
+// Len returns the number of output samples of the whole input
+func (r *Resampler) Len() int {
+	return r.outTotal
+}
+
+// Write adds the next input samples, and returns the output samples that
+// can be computed from the input so far
+func (r *Resampler) Write(samples []float64) []float64 {
+	r.in = append(r.in, samples...)
+	received := r.start + len(r.in)
+
+	// An output sample is ready once the input it spans was received
+	ready := r.next
+	for ready < r.outTotal && (received >= r.total || int(math.Floor(float64(ready)/r.ratio+r.halfWidth)) < received) {
+		ready++
+	}
+
+	out := make([]float64, ready-r.next)
+	interpolateRange(out, r.next, r.in, r.start, r.ratio, r.cutoff, r.halfWidth)
+	r.next = ready
+
+	// Drop the input the next output sample doesn't span
+	if first := int(math.Ceil(float64(r.next)/r.ratio - r.halfWidth)); first > r.start {
+		drop := min(first-r.start, len(r.in))
+		r.in = append(r.in[:0], r.in[drop:]...)
+		r.start += drop
+	}
+	return out
+}
+
+// interpolate returns the value of samples at the fractional position t,
+// low-pass filtered at cutoff. samples starts with the start-th sample.
+func interpolate(samples []float64, start int, t, cutoff, halfWidth float64) float64 {
+	first := int(math.Ceil(t - halfWidth))
+	last := int(math.Floor(t + halfWidth))
+	if first < start {
+		first = start
+	}
+	if last >= start+len(samples) {
+		last = start + len(samples) - 1
+	}
+
+	var sum float64
+	for k := first; k <= last; k++ {
+		x := t - float64(k)
+		sum += samples[k-start] * cutoff * sinc(cutoff*x) * blackman(x/halfWidth)
+	}
+	return sum
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over [-1, 1]
+func blackman(u float64) float64 {
+	return 0.42 + 0.5*math.Cos(math.Pi*u) + 0.08*math.Cos(2*math.Pi*u)
+}
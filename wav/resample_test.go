@@ -0,0 +1,132 @@
+package wav
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sineWave returns n samples of a sine wave of freq Hz at sampleRate
+func sineWave(n, sampleRate int, freq, amplitude float64) []float64 {
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate))
+	}
+	return samples
+}
+
+// fitSine returns the amplitude of the sine wave of freq Hz closest to
+// samples, and the RMS of what is left of samples without it
+func fitSine(samples []float64, sampleRate int, freq float64) (amplitude, residual float64) {
+	var sinSum, cosSum float64
+	for i, sample := range samples {
+		phase := 2 * math.Pi * freq * float64(i) / float64(sampleRate)
+		sinSum += sample * math.Sin(phase)
+		cosSum += sample * math.Cos(phase)
+	}
+	a, b := 2*sinSum/float64(len(samples)), 2*cosSum/float64(len(samples))
+
+	for i, sample := range samples {
+		phase := 2 * math.Pi * freq * float64(i) / float64(sampleRate)
+		diff := sample - a*math.Sin(phase) - b*math.Cos(phase)
+		residual += diff * diff
+	}
+	return math.Hypot(a, b), math.Sqrt(residual / float64(len(samples)))
+}
+
+func TestResamplerMatchesResample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]float64, 20000)
+	for i := range samples {
+		samples[i] = rng.Float64()*2 - 1
+	}
+
+	rates := [][2]int{{48000, 44100}, {22050, 44100}, {44100, 8000}, {8000, 44100}}
+	chunkSizes := []func() int{
+		func() int { return 1 },
+		func() int { return 7 },
+		func() int { return 4096 },
+		func() int { return rng.Intn(3000) },
+	}
+
+	for _, rate := range rates {
+		want, err := Resample(samples, rate[0], rate[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, chunkSize := range chunkSizes {
+			r, err := NewResampler(rate[0], rate[1], len(samples))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Len() != len(want) {
+				t.Errorf("%d to %d Hz: Len is %d, Resample returns %d samples", rate[0], rate[1], r.Len(), len(want))
+			}
+
+			var got []float64
+			for start := 0; start < len(samples); {
+				end := min(start+chunkSize(), len(samples))
+				got = append(got, r.Write(samples[start:end])...)
+				start = end
+			}
+
+			if len(got) != len(want) {
+				t.Errorf("%d to %d Hz, chunk sizes %d: got %d samples, want %d", rate[0], rate[1], i, len(got), len(want))
+				continue
+			}
+			for n := range got {
+				if got[n] != want[n] {
+					t.Errorf("%d to %d Hz, chunk sizes %d: sample %d is %v, want %v", rate[0], rate[1], i, n, got[n], want[n])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestResampleTones(t *testing.T) {
+	const amplitude = 0.5
+	// edge is the number of output samples at each end left out, where the
+	// filter runs past the input
+	const edge = 200
+
+	tests := []struct {
+		fromRate, toRate int
+		freq             float64
+		// kept is whether the tone is below the new Nyquist frequency
+		kept bool
+	}{
+		{48000, 8000, 1000, true},
+		{44100, 11025, 4000, true},
+		{22050, 44100, 5000, true},
+		{48000, 8000, 6000, false},
+		{44100, 11025, 7000, false},
+		{44100, 8000, 4500, false},
+	}
+
+	for _, test := range tests {
+		in := sineWave(test.fromRate, test.fromRate, test.freq, amplitude)
+		out, err := Resample(in, test.fromRate, test.toRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = out[edge : len(out)-edge]
+
+		if test.kept {
+			got, residual := fitSine(out, test.toRate, test.freq)
+			if math.Abs(got-amplitude) > 0.01*amplitude || residual > 0.01*amplitude {
+				t.Errorf("%v Hz from %d to %d Hz: amplitude %v, residual %v, want amplitude %v", test.freq, test.fromRate, test.toRate, got, residual, amplitude)
+			}
+			continue
+		}
+
+		var energy float64
+		for _, sample := range out {
+			energy += sample * sample
+		}
+		if rms := math.Sqrt(energy / float64(len(out))); rms > 0.001*amplitude {
+			t.Errorf("%v Hz from %d to %d Hz: RMS %v, want it attenuated by 60dB from %v", test.freq, test.fromRate, test.toRate, rms, amplitude/math.Sqrt2)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package wav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// streamChunkSamples is about the number of samples a Stream decodes at a
+// time
+const streamChunkSamples = 1 << 16
+
+// decoder decodes an audio file a chunk of mono samples at a time
+type decoder interface {
+	// next returns the next samples, or io.EOF after the last
+	next() ([]float64, error)
+	Close() error
+}
+
+// Stream decodes the mono samples of an audio file a chunk at a time, so
+// that files of any length are decoded in constant memory
+type Stream struct {
+	SampleRate int
+
+	dec    decoder
+	native bool
+	// first is the chunk decoded when the stream was opened, and firstErr
+	// the error decoding it returned
+	first    []float64
+	firstErr error
+}
+
+// OpenStream opens an audio file for decoding with the decoder DecodeFile
+// would pick. A native decoder that can't read the file, up to its first
+// samples, is replaced by FFmpeg.
+func OpenStream(filePath string) (*Stream, error) {
+	format, err := detectFileFormat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var open func(string) (decoder, int, error)
+	switch format {
+	case FormatWAV:
+		open = openWAVDecoder
+	case FormatFLAC:
+		open = openFLACDecoder
+	case FormatOGG:
+		open = openOggDecoder
+	}
+	if open != nil {
+		if stream, err := openStream(filePath, open); err == nil {
+			stream.native = true
+			return stream, nil
+		}
+	}
+
+	return openStream(filePath, openFFmpegDecoder)
+}
+
+// openStream opens filePath with open and decodes its first chunk, so that
+// files the decoder can't read fail before any samples are passed on
+func openStream(filePath string, open func(string) (decoder, int, error)) (*Stream, error) {
+	dec, sampleRate, err := open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := dec.next()
+	if err != nil && err != io.EOF {
+		dec.Close()
+		return nil, err
+	}
+	return &Stream{SampleRate: sampleRate, dec: dec, first: first, firstErr: err}, nil
+}
+
+// Read returns the next chunk of samples, or io.EOF after the last
+func (s *Stream) Read() ([]float64, error) {
+	if s.first != nil || s.firstErr != nil {
+		samples, err := s.first, s.firstErr
+		s.first, s.firstErr = nil, nil
+		return samples, err
+	}
+	return s.dec.next()
+}
+
+// Close stops decoding and releases the file
+func (s *Stream) Close() error {
+	return s.dec.Close()
+}
+
+// readAll decodes the rest of the stream, stopping with ctx's error once
+// ctx is done
+func (s *Stream) readAll(ctx context.Context) ([]float64, error) {
+	var samples []float64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk, err := s.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, chunk...)
+	}
+}
+
+// wavDecoder decodes the PCM samples of a WAV file
+type wavDecoder struct {
+	file *os.File
+	info *WavInfo
+	// remaining is the number of bytes of samples left to read
+	remaining int64
+}
+
+func openWAVDecoder(filePath string) (decoder, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, dataSize, err := readWavFormat(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return &wavDecoder{file: file, info: info, remaining: dataSize}, info.SampleRate, nil
+}
+
+func (d *wavDecoder) next() ([]float64, error) {
+	if d.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	frameSize := int64(d.info.Channels * d.info.BitsPerSample / 8)
+	data := make([]byte, min(d.remaining, streamChunkSamples*frameSize))
+	if _, err := io.ReadFull(d.file, data); err != nil {
+		return nil, fmt.Errorf("error reading WAV samples: %v", err)
+	}
+	d.remaining -= int64(len(data))
+
+	return PCMBytesToMonoSamples(data, d.info.Channels, d.info.BitsPerSample, d.info.Float)
+}
+
+func (d *wavDecoder) Close() error {
+	return d.file.Close()
+}
+
+// ffmpegDecoder decodes a file to raw 16-bit mono PCM through an FFmpeg
+// pipe
+type ffmpegDecoder struct {
+	cmd     *exec.Cmd
+	stdout  io.ReadCloser
+	stderr  bytes.Buffer
+	decoded int
+	done    bool
+}
+
+func openFFmpegDecoder(filePath string) (decoder, int, error) {
+	d := &ffmpegDecoder{}
+	d.cmd = exec.Command(
+		"ffmpeg",
+		"-v", "error",
+		"-i", filePath,
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"-ac", "1",
+		"-ar", fmt.Sprint(CanonicalSampleRate),
+		"pipe:1",
+	)
+	d.cmd.Stderr = &d.stderr
+
+	stdout, err := d.cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	d.stdout = stdout
+	if err := d.cmd.Start(); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode audio: %v", err)
+	}
+	return d, CanonicalSampleRate, nil
+}
+
+func (d *ffmpegDecoder) next() ([]float64, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, streamChunkSamples*2)
+	n, err := io.ReadFull(d.stdout, buf)
+	if err == nil {
+		d.decoded += n / 2
+		return WavBytesToSamples(buf)
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to decode audio: %v", err)
+	}
+
+	d.done = true
+	if err := d.cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to decode audio: %v, output %v", err, d.stderr.String())
+	}
+	// A sample cut in half can only be left by a broken pipe
+	if n -= n % 2; n > 0 {
+		d.decoded += n / 2
+		return WavBytesToSamples(buf[:n])
+	}
+	if d.decoded == 0 {
+		return nil, errors.New("failed to decode audio: no samples")
+	}
+	return nil, io.EOF
+}
+
+// Close stops FFmpeg if it is still decoding
+func (d *ffmpegDecoder) Close() error {
+	if d.done {
+		return nil
+	}
+	d.done = true
+	d.cmd.Process.Kill()
+	d.cmd.Wait()
+	return nil
+}
+
+// CopyToMonoWav decodes an audio file into a mono 16-bit WAV file at the
+// file's sample rate, a chunk at a time, and returns the sample rate and
+// number of samples of the audio
+func CopyToMonoWav(filePath, wavFilePath string) (sampleRate, samples int, err error) {
+	stream, err := OpenStream(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stream.Close()
+
+	w, err := CreateMonoWavFile(wavFilePath, stream.SampleRate)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for {
+		chunk, err := stream.Read()
+		if err == io.EOF {
+			return stream.SampleRate, w.Samples(), nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := w.Write(chunk); err != nil {
+			return 0, 0, err
+		}
+	}
+}
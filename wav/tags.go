@@ -0,0 +1,79 @@
+package wav
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Tag returns the first of the tags names that is set, ignoring case. ID3
+// tags are read from the format, and Vorbis comments of Ogg files from the
+// audio stream, so both are looked up.
+func (m FFmpegMetadata) Tag(names ...string) string {
+	for _, name := range names {
+		for key, value := range m.Format.Tags {
+			if strings.EqualFold(key, name) && strings.TrimSpace(value) != "" {
+				return strings.TrimSpace(value)
+			}
+		}
+		for _, stream := range m.Streams {
+			if stream.CodecType != "audio" {
+				continue
+			}
+			for key, value := range stream.Tags {
+				if strings.EqualFold(key, name) && strings.TrimSpace(value) != "" {
+					return strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Picture returns the index of the stream holding the artwork embedded in
+// the file, such as an ID3 APIC frame or a FLAC picture, and the extension
+// of the image ExtractPicture makes of it
+func (m FFmpegMetadata) Picture() (int, string, bool) {
+	for _, stream := range m.Streams {
+		if stream.CodecType != "video" || stream.Disposition["attached_pic"] != 1 {
+			continue
+		}
+		if stream.CodecName == "mjpeg" {
+			return stream.Index, ".jpg", true
+		}
+		return stream.Index, ".png", true
+	}
+	return 0, "", false
+}
+
+// ExtractPicture returns the image of the artwork in stream of the file at
+// filePath. JPEG and PNG images are returned as they are, others are
+// converted to PNG.
+func ExtractPicture(filePath string, stream int, ext string) ([]byte, error) {
+	codec := "copy"
+	if ext == ".png" {
+		codec = "png"
+	}
+
+	cmd := exec.Command(
+		"ffmpeg",
+		"-v", "error",
+		"-i", filePath,
+		"-map", fmt.Sprintf("0:%d", stream),
+		"-c:v", codec,
+		"-frames:v", "1",
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to extract artwork: %v, output %v", err, stderr.String())
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("failed to extract artwork: empty image")
+	}
+	return stdout.Bytes(), nil
+}
@@ -6,7 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 )
@@ -28,9 +29,9 @@ type WavHeader struct {
 	Subchunk2Size uint32
 }
 
-func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsPerSample int) error {
+func writeWavHeader(f *os.File, dataSize int, sampleRate int, channels int, bitsPerSample int) error {
 	// Validate input
-	if len(data)%channels != 0 {
+	if dataSize%channels != 0 {
 		return errors.New("data size not divisible by channels")
 	}
 
@@ -38,12 +39,12 @@ func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsP
 	subchunk1Size := uint32(16) // Assuming PCM format
 	bytesPerSample := bitsPerSample / 8
 	blockAlign := uint16(channels * bytesPerSample)
-	subchunk2Size := uint32(len(data))
+	subchunk2Size := uint32(dataSize)
 
 	// Build WAV header
 	header := WavHeader{
 		ChunkID:       [4]byte{'R', 'I', 'F', 'F'},
-		ChunkSize:     uint32(36 + len(data)),
+		ChunkSize:     uint32(36 + dataSize),
 		Format:        [4]byte{'W', 'A', 'V', 'E'},
 		Subchunk1ID:   [4]byte{'f', 'm', 't', ' '},
 		Subchunk1Size: subchunk1Size,
@@ -76,7 +77,7 @@ func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bi
 		)
 	}
 
-	err = writeWavHeader(f, data, sampleRate, channels, bitsPerSample)
+	err = writeWavHeader(f, len(data), sampleRate, channels, bitsPerSample)
 	if err != nil {
 		return err
 	}
@@ -85,50 +86,132 @@ func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bi
 	return err
 }
 
+// WAV audio format codes
+const (
+	formatPCM        = 1
+	formatFloat      = 3
+	formatExtensible = 0xFFFE
+)
+
 // WavInfo defines a struct containing information extracted from the WAV header
 type WavInfo struct {
-	Channels   int
-	SampleRate int
-	Data       []byte
-	Duration   float64
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	Float         bool
+	Data          []byte
+	Duration      float64
 }
 
+// ReadWavInfo reads the format and sample data of a WAV file. The chunks are
+// walked instead of assuming a 44 byte header, since recording apps often
+// add LIST, fact or other chunks before the data.
 func ReadWavInfo(filename string) (*WavInfo, error) {
-	data, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	if len(data) < 44 {
-		return nil, errors.New("invalid WAV file size (too small)")
+	info, dataSize, err := readWavFormat(file)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read header chunks
-	var header WavHeader
-	err = binary.Read(bytes.NewReader(data[:44]), binary.LittleEndian, &header)
-	if err != nil {
+	info.Data = make([]byte, dataSize)
+	if _, err := io.ReadFull(file, info.Data); err != nil {
 		return nil, err
 	}
+	return info, nil
+}
+
+// readWavFormat reads the format of a WAV file up to its data chunk, and
+// returns it along with the size of the samples, which the file is then
+// positioned at
+func readWavFormat(file *os.File) (*WavInfo, int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	fileSize := stat.Size()
 
-	if string(header.ChunkID[:]) != "RIFF" || string(header.Format[:]) != "WAVE" || header.AudioFormat != 1 {
-		return nil, errors.New("invalid WAV header format")
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, 0, errors.New("invalid WAV header format")
 	}
 
-	// Extract information
-	info := &WavInfo{
-		Channels:   int(header.NumChannels),
-		SampleRate: int(header.SampleRate),
-		Data:       data[44:],
+	info := &WavInfo{}
+	var audioFormat uint16
+	var haveFormat, haveData bool
+	var dataSize int64
+	chunkHeader := make([]byte, 8)
+	for pos := int64(12); pos+8 <= fileSize && !haveData; {
+		if _, err := file.Seek(pos, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		if _, err := io.ReadFull(file, chunkHeader); err != nil {
+			return nil, 0, err
+		}
+		id := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		// Streaming recorders may leave the size of the last chunk unset
+		if size > fileSize-pos-8 {
+			size = fileSize - pos - 8
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, errors.New("invalid WAV fmt chunk")
+			}
+			body := make([]byte, size)
+			if _, err := io.ReadFull(file, body); err != nil {
+				return nil, 0, err
+			}
+			audioFormat = binary.LittleEndian.Uint16(body[0:2])
+			info.Channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			info.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			info.BitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			// The real format of extensible files is the first two bytes of
+			// their sub-format GUID
+			if audioFormat == formatExtensible && len(body) >= 26 {
+				audioFormat = binary.LittleEndian.Uint16(body[24:26])
+			}
+			haveFormat = true
+		case "data":
+			dataSize = size
+			haveData = true
+		}
+
+		// Chunks are padded to an even size
+		pos += 8 + size + size%2
 	}
 
-	// Calculate audio duration (assuming data contains PCM data)
-	if header.BitsPerSample == 16 {
-		info.Duration = float64(len(info.Data)) / float64(int(header.NumChannels)*2*int(header.SampleRate))
-	} else {
-		return nil, errors.New("unsupported bits per sample format")
+	if !haveFormat {
+		return nil, 0, errors.New("WAV file has no fmt chunk")
+	}
+	if !haveData {
+		return nil, 0, errors.New("WAV file has no data chunk")
 	}
 
-	return info, nil
+	switch {
+	case audioFormat == formatPCM && (info.BitsPerSample == 8 || info.BitsPerSample == 16 ||
+		info.BitsPerSample == 24 || info.BitsPerSample == 32):
+	case audioFormat == formatFloat && (info.BitsPerSample == 32 || info.BitsPerSample == 64):
+		info.Float = true
+	default:
+		return nil, 0, fmt.Errorf("unsupported WAV format (format: %d, bits per sample: %d)", audioFormat, info.BitsPerSample)
+	}
+	if info.Channels < 1 || info.SampleRate < 1 {
+		return nil, 0, fmt.Errorf("invalid WAV format (channels: %d, sample rate: %d)", info.Channels, info.SampleRate)
+	}
+
+	// Drop a trailing partial frame left by an interrupted recording
+	frameSize := int64(info.Channels * info.BitsPerSample / 8)
+	dataSize -= dataSize % frameSize
+	info.Duration = float64(dataSize/frameSize) / float64(info.SampleRate)
+
+	return info, dataSize, nil
 }
 
 // WavBytesToFloat64 converts a slice of bytes from a .wav file to a slice of float64 samples
@@ -151,6 +234,131 @@ func WavBytesToSamples(input []byte) ([]float64, error) {
 	return output, nil
 }
 
+// WavBytesToMonoSamples converts interleaved 16-bit PCM bytes with the given
+// number of channels to mono float64 samples by averaging the channels
+func WavBytesToMonoSamples(input []byte, channels int) ([]float64, error) {
+	return PCMBytesToMonoSamples(input, channels, 16, false)
+}
+
+// PCMBytesToMonoSamples converts interleaved little-endian PCM bytes to mono
+// float64 samples in the range [-1, 1] by averaging the channels. Integer
+// samples can be 8 (unsigned), 16, 24 or 32 bits wide, and float samples 32
+// or 64 bits.
+func PCMBytesToMonoSamples(input []byte, channels, bitsPerSample int, float bool) ([]float64, error) {
+	if channels < 1 {
+		return nil, errors.New("invalid number of channels")
+	}
+
+	var sampleAt func(b []byte) float64
+	switch {
+	case !float && bitsPerSample == 8:
+		sampleAt = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case !float && bitsPerSample == 16:
+		sampleAt = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	case !float && bitsPerSample == 24:
+		sampleAt = func(b []byte) float64 {
+			// Shift the sample into the top of an int32 to sign-extend it
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case !float && bitsPerSample == 32:
+		sampleAt = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case float && bitsPerSample == 32:
+		sampleAt = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case float && bitsPerSample == 64:
+		sampleAt = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("unsupported sample format (bits per sample: %d, float: %t)", bitsPerSample, float)
+	}
+
+	sampleSize := bitsPerSample / 8
+	frameSize := sampleSize * channels
+	if len(input)%frameSize != 0 {
+		return nil, errors.New("invalid input length")
+	}
+
+	output := make([]float64, len(input)/frameSize)
+	for i := range output {
+		frame := input[i*frameSize:]
+		var sum float64
+		for c := 0; c < channels; c++ {
+			sum += sampleAt(frame[c*sampleSize:])
+		}
+		output[i] = sum / float64(channels)
+	}
+
+	return output, nil
+}
+
+// SamplesToWavBytes converts float64 samples in the range [-1, 1] to
+// 16-bit little-endian PCM bytes
+func SamplesToWavBytes(samples []float64) []byte {
+	output := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		sample = math.Max(-1, math.Min(1, sample))
+		binary.LittleEndian.PutUint16(output[i*2:], uint16(int16(sample*32767)))
+	}
+
+	return output
+}
+
+// WriteMonoWavFile writes float64 samples in the range [-1, 1] to a mono
+// 16-bit WAV file
+func WriteMonoWavFile(filename string, samples []float64, sampleRate int) error {
+	return WriteWavFile(filename, SamplesToWavBytes(samples), sampleRate, 1, 16)
+}
+
+// MonoWavWriter writes float64 samples in the range [-1, 1] to a mono
+// 16-bit WAV file as they come. The sizes in the header are filled in when
+// it is closed.
+type MonoWavWriter struct {
+	file       *os.File
+	sampleRate int
+	samples    int
+}
+
+// CreateMonoWavFile creates a mono 16-bit WAV file to write samples to
+func CreateMonoWavFile(filename string, sampleRate int) (*MonoWavWriter, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("sample rate must be greater than zero (sampleRate: %d)", sampleRate)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeWavHeader(f, 0, sampleRate, 1, 16); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &MonoWavWriter{file: f, sampleRate: sampleRate}, nil
+}
+
+// Write appends samples to the file
+func (w *MonoWavWriter) Write(samples []float64) error {
+	if _, err := w.file.Write(SamplesToWavBytes(samples)); err != nil {
+		return err
+	}
+	w.samples += len(samples)
+	return nil
+}
+
+// Samples returns the number of samples written
+func (w *MonoWavWriter) Samples() int {
+	return w.samples
+}
+
+// Close writes the header for the samples written and closes the file
+func (w *MonoWavWriter) Close() error {
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err == nil {
+		err = writeWavHeader(w.file, w.samples*2, w.sampleRate, 1, 16)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // FFmpegMetadata represents the metadata structure returned by ffprobe.
 type FFmpegMetadata struct {
 	Streams []struct {
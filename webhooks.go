@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"song-recognition/events"
+	"song-recognition/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+var (
+	// webhookURLs are the comma-separated URLs the server posts events to.
+	// Set with WEBHOOK_URLS.
+	webhookURLs = utils.GetEnv("WEBHOOK_URLS")
+
+	// webhookSecret signs the body of every webhook, empty not to sign
+	// them. Set with WEBHOOK_SECRET.
+	webhookSecret = utils.GetEnv("WEBHOOK_SECRET")
+
+	// webhookEvents are the comma-separated lifecycle event types posted to
+	// the webhooks. Set with WEBHOOK_EVENTS.
+	webhookEvents = utils.GetEnv("WEBHOOK_EVENTS", events.FingerprintsStored+","+events.MatchFound)
+
+	// webhookTimeout bounds a single attempt to post a webhook. Set with
+	// WEBHOOK_TIMEOUT.
+	webhookTimeout = durationFromEnv("WEBHOOK_TIMEOUT", 10*time.Second)
+
+	// webhookMaxAttempts is the number of times a webhook is posted before
+	// it is given up on. Set with WEBHOOK_MAX_ATTEMPTS.
+	webhookMaxAttempts = intFromEnv("WEBHOOK_MAX_ATTEMPTS", 5)
+)
+
+const (
+	// webhookQueueSize is the number of webhooks waiting to be posted past
+	// which new ones are dropped
+	webhookQueueSize = 256
+
+	// webhookRetryDelay is how long the first retry of a webhook waits,
+	// doubled on every retry after it
+	webhookRetryDelay = time.Second
+
+	// webhookDrainTimeout is how long shutdown waits for the queued
+	// webhooks to be posted
+	webhookDrainTimeout = 10 * time.Second
+
+	// webhookSignatureHeader holds the hex encoded HMAC-SHA256 of the body
+	// of a webhook, keyed with WEBHOOK_SECRET and prefixed with "sha256="
+	webhookSignatureHeader = "X-SeekTune-Signature"
+)
+
+// webhookBody is what a webhook posts: a lifecycle event and its payload
+type webhookBody struct {
+	ID        string      `json:"id"` // same on every attempt, to drop duplicates
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	RequestID string      `json:"requestId,omitempty"`
+	Catalog   string      `json:"catalog,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDelivery is a webhook waiting to be posted to a URL
+type webhookDelivery struct {
+	url       string
+	id        string
+	eventType string
+	body      []byte
+}
+
+// webhookDispatcher posts the lifecycle events it listens to to the
+// webhook URLs, from a queue so that publishers never wait on them
+type webhookDispatcher struct {
+	urls   []string
+	secret []byte
+	events map[string]bool
+	client *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan webhookDelivery
+	wg     sync.WaitGroup
+
+	ctx    context.Context // cancelled to give up on retries
+	cancel context.CancelFunc
+}
+
+// parseWebhookURLs parses the comma-separated URLs of WEBHOOK_URLS
+func parseWebhookURLs(value string) ([]string, error) {
+	var urls []string
+	for _, rawURL := range strings.Split(value, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q, expected an http or https URL", rawURL)
+		}
+		urls = append(urls, rawURL)
+	}
+	return urls, nil
+}
+
+// parseWebhookEvents parses the comma-separated event types of
+// WEBHOOK_EVENTS
+func parseWebhookEvents(value string) (map[string]bool, error) {
+	known := map[string]bool{
+		events.SongDownloaded:     true,
+		events.FingerprintsStored: true,
+		events.MatchFound:         true,
+		events.JobFailed:          true,
+	}
+
+	types := map[string]bool{}
+	for _, eventType := range strings.Split(value, ",") {
+		eventType = strings.TrimSpace(eventType)
+		if eventType == "" {
+			continue
+		}
+		if !known[eventType] {
+			return nil, fmt.Errorf("unknown webhook event %q, expected %s, %s, %s or %s", eventType,
+				events.SongDownloaded, events.FingerprintsStored, events.MatchFound, events.JobFailed)
+		}
+		types[eventType] = true
+	}
+	return types, nil
+}
+
+// startWebhooks posts the lifecycle events selected by WEBHOOK_EVENTS to
+// the URLs of WEBHOOK_URLS until the returned function is called, which
+// waits a while for the queued webhooks to be posted
+func startWebhooks() (func(), error) {
+	urls, err := parseWebhookURLs(webhookURLs)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return func() {}, nil
+	}
+	eventTypes, err := parseWebhookEvents(webhookEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newWebhookDispatcher(urls, []byte(webhookSecret), eventTypes)
+	d.start(len(urls))
+	events.Listen(d.listen)
+
+	logger := utils.GetLogger()
+	logger.Info("posting webhooks.", slog.Int("urls", len(urls)), slog.String("events", webhookEvents))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookDrainTimeout)
+		defer cancel()
+		d.close(ctx)
+	}, nil
+}
+
+func newWebhookDispatcher(urls []string, secret []byte, eventTypes map[string]bool) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookDispatcher{
+		urls:   urls,
+		secret: secret,
+		events: eventTypes,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookDelivery, webhookQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// start starts the workers posting the queued webhooks
+func (d *webhookDispatcher) start(workers int) {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for delivery := range d.queue {
+				d.deliver(delivery)
+			}
+		}()
+	}
+}
+
+// listen queues the webhooks of event, if it is of a selected type. It is
+// an events listener, so it never blocks: webhooks that don't fit in the
+// queue are dropped.
+func (d *webhookDispatcher) listen(event events.Event) {
+	if !d.events[event.Type] {
+		return
+	}
+
+	logger := utils.GetLogger()
+	id := utils.NewRequestID()
+	body, err := json.Marshal(webhookBody{
+		ID:        id,
+		Type:      event.Type,
+		Timestamp: time.Now().UTC(),
+		RequestID: event.RequestID,
+		Catalog:   event.Catalog,
+		Data:      event.Payload,
+	})
+	if err != nil {
+		logger.Error("failed to marshal webhook.", slog.String("type", event.Type), slog.Any("error", xerrors.New(err)))
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for _, u := range d.urls {
+		select {
+		case d.queue <- webhookDelivery{url: u, id: id, eventType: event.Type, body: body}:
+		default:
+			logger.Warn("webhook queue is full, dropping webhook.", slog.String("url", u), slog.String("type", event.Type))
+		}
+	}
+}
+
+// deliver posts a webhook until it is accepted, retrying failed attempts
+// with a growing delay up to webhookMaxAttempts times
+func (d *webhookDispatcher) deliver(delivery webhookDelivery) {
+	logger := utils.GetLogger()
+	delay := webhookRetryDelay
+	attempts := max(webhookMaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(delivery)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= attempts {
+			logger.Error("failed to post webhook.",
+				slog.String("url", delivery.url),
+				slog.String("type", delivery.eventType),
+				slog.String("delivery_id", delivery.id),
+				slog.Int("attempts", attempt),
+				slog.Any("error", xerrors.New(err)),
+			)
+			return
+		}
+		logger.Warn("webhook failed, retrying.",
+			slog.String("url", delivery.url),
+			slog.String("delivery_id", delivery.id),
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.Any("error", err),
+		)
+
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			logger.Error("gave up on webhook on shutdown.", slog.String("url", delivery.url), slog.String("delivery_id", delivery.id))
+			return
+		}
+		delay *= 2
+	}
+}
+
+// post makes one attempt to post a webhook, and reports whether a failed
+// attempt is worth retrying: network errors, 429 and server errors are,
+// other responses mean the receiver rejected the webhook
+func (d *webhookDispatcher) post(delivery webhookDelivery) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SeekTune-Webhook")
+	req.Header.Set("X-SeekTune-Event", delivery.eventType)
+	req.Header.Set("X-SeekTune-Delivery", delivery.id)
+	if len(d.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(d.secret, delivery.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of body keyed with secret
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// close stops queueing webhooks and waits for the queued ones to be
+// posted, giving up on those left once ctx is done
+func (d *webhookDispatcher) close(ctx context.Context) {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}